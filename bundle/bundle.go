@@ -0,0 +1,444 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package bundle implements a portable release artifact: a zip archive
+// containing an image, its manifest, release notes, signing metadata, and
+// SBOM, along with an index that protects the integrity of the archive
+// contents.
+package bundle
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const BUNDLE_FORMAT_VERSION = 1
+
+const (
+	INDEX_FILENAME         = "index.json"
+	IMAGE_FILENAME         = "image.img"
+	MANIFEST_FILENAME      = "manifest.json"
+	RELEASE_NOTES_FILENAME = "release-notes.txt"
+	SIGNING_FILENAME       = "signing.json"
+	SBOM_FILENAME          = "sbom"
+)
+
+// SigningInfo describes how a bundled image was signed.
+type SigningInfo struct {
+	Signer    string         `json:"signer,omitempty"`
+	Date      string         `json:"date,omitempty"`
+	Sigs      []SigningEntry `json:"sigs"`
+	Encrypted bool           `json:"encrypted"`
+}
+
+// SigningEntry describes a single image signature.
+type SigningEntry struct {
+	Type    string `json:"type"`
+	KeyHash string `json:"key_hash"`
+}
+
+// IndexEntry describes one file in a bundle.
+type IndexEntry struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Index lists the contents of a bundle.  Hash is the SHA256 of the sorted
+// entries; it identifies the bundle as a whole.
+type Index struct {
+	Version int          `json:"version"`
+	Entries []IndexEntry `json:"entries"`
+	Hash    string       `json:"hash"`
+}
+
+// Bundle is a release artifact.  Only the image is mandatory.
+type Bundle struct {
+	Image        image.Image
+	Manifest     *manifest.Manifest
+	ReleaseNotes string
+	Signing      *SigningInfo
+
+	// Software bill of materials; must match the image's SBOM TLV.
+	Sbom *image.Sbom
+}
+
+// NewSigningInfo produces signing metadata describing an image's current
+// signatures.
+func NewSigningInfo(img image.Image) (SigningInfo, error) {
+	info := SigningInfo{}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return info, err
+	}
+
+	for _, sig := range sigs {
+		info.Sigs = append(info.Sigs, SigningEntry{
+			Type:    sec.SigTypeString(sig.Type),
+			KeyHash: hex.EncodeToString(sig.KeyHash),
+		})
+	}
+
+	info.Encrypted = img.IsEncrypted()
+
+	return info, nil
+}
+
+func calcIndexHash(entries []IndexEntry) string {
+	h := sha256.New()
+	for _, e := range entries {
+		h.Write([]byte(e.Name))
+		h.Write([]byte{0})
+		h.Write([]byte(e.Sha256))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// files serializes each of the bundle's components.
+func (b *Bundle) files() (map[string][]byte, error) {
+	files := map[string][]byte{}
+
+	bin, err := b.Image.Bin()
+	if err != nil {
+		return nil, err
+	}
+	files[IMAGE_FILENAME] = bin
+
+	if b.Manifest != nil {
+		buf := &bytes.Buffer{}
+		if _, err := b.Manifest.Write(buf); err != nil {
+			return nil, err
+		}
+		files[MANIFEST_FILENAME] = buf.Bytes()
+	}
+
+	if b.ReleaseNotes != "" {
+		files[RELEASE_NOTES_FILENAME] = []byte(b.ReleaseNotes)
+	}
+
+	if b.Signing != nil {
+		j, err := json.MarshalIndent(b.Signing, "", "  ")
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encode signing info")
+		}
+		files[SIGNING_FILENAME] = j
+	}
+
+	if b.Sbom != nil {
+		files[SBOM_FILENAME] = b.Sbom.Doc
+	}
+
+	return files, nil
+}
+
+func buildIndex(files map[string][]byte) Index {
+	idx := Index{
+		Version: BUNDLE_FORMAT_VERSION,
+	}
+
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		idx.Entries = append(idx.Entries, IndexEntry{
+			Name:   name,
+			Size:   len(data),
+			Sha256: hex.EncodeToString(sum[:]),
+		})
+	}
+	sort.Slice(idx.Entries, func(i int, j int) bool {
+		return idx.Entries[i].Name < idx.Entries[j].Name
+	})
+
+	idx.Hash = calcIndexHash(idx.Entries)
+
+	return idx
+}
+
+// Index produces the index that would be written with the bundle.
+func (b *Bundle) Index() (Index, error) {
+	files, err := b.files()
+	if err != nil {
+		return Index{}, err
+	}
+
+	return buildIndex(files), nil
+}
+
+// Write packs the bundle into a zip archive.
+func (b *Bundle) Write(w io.Writer) error {
+	files, err := b.files()
+	if err != nil {
+		return err
+	}
+
+	idx := buildIndex(files)
+	j, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode bundle index")
+	}
+
+	zw := zip.NewWriter(w)
+
+	add := func(name string, data []byte) error {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add \"%s\" to bundle", name)
+		}
+		if _, err := fw.Write(data); err != nil {
+			return errors.Wrapf(err, "failed to add \"%s\" to bundle", name)
+		}
+		return nil
+	}
+
+	// The index comes first so that readers can locate it quickly.
+	if err := add(INDEX_FILENAME, j); err != nil {
+		return err
+	}
+	for _, e := range idx.Entries {
+		if err := add(e.Name, files[e.Name]); err != nil {
+			return err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return errors.Wrapf(err, "failed to write bundle")
+	}
+
+	return nil
+}
+
+// WriteToFile packs the bundle into a zip archive file.
+func (b *Bundle) WriteToFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open bundle destination file")
+	}
+	defer f.Close()
+
+	return b.Write(f)
+}
+
+func readZipFile(zf *zip.File) ([]byte, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open \"%s\" in bundle",
+			zf.Name)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read \"%s\" in bundle",
+			zf.Name)
+	}
+
+	return data, nil
+}
+
+// Parse unpacks a bundle from a zip archive.  The contents are checked
+// against the index; an error is returned if any file is missing, unlisted,
+// or corrupt.
+func Parse(data []byte) (Bundle, Index, error) {
+	b := Bundle{}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return b, Index{}, errors.Wrapf(err, "invalid bundle archive")
+	}
+
+	files := map[string][]byte{}
+	for _, zf := range zr.File {
+		if _, ok := files[zf.Name]; ok {
+			return b, Index{}, errors.Errorf(
+				"bundle contains duplicate file \"%s\"", zf.Name)
+		}
+
+		data, err := readZipFile(zf)
+		if err != nil {
+			return b, Index{}, err
+		}
+		files[zf.Name] = data
+	}
+
+	j := files[INDEX_FILENAME]
+	if j == nil {
+		return b, Index{}, errors.Errorf("bundle does not contain an index")
+	}
+	delete(files, INDEX_FILENAME)
+
+	idx := Index{}
+	if err := json.Unmarshal(j, &idx); err != nil {
+		return b, Index{}, errors.Wrapf(err, "failed to decode bundle index")
+	}
+	if idx.Version != BUNDLE_FORMAT_VERSION {
+		return b, idx, errors.Errorf(
+			"unsupported bundle format version: %d", idx.Version)
+	}
+
+	if err := idx.verify(files); err != nil {
+		return b, idx, err
+	}
+
+	img, err := image.ParseImage(files[IMAGE_FILENAME])
+	if err != nil {
+		return b, idx, errors.Wrapf(err, "bundle contains invalid image")
+	}
+	b.Image = img
+
+	if j := files[MANIFEST_FILENAME]; j != nil {
+		man := manifest.Manifest{}
+		if err := json.Unmarshal(j, &man); err != nil {
+			return b, idx, errors.Wrapf(err,
+				"bundle contains invalid manifest")
+		}
+		b.Manifest = &man
+	}
+
+	if notes := files[RELEASE_NOTES_FILENAME]; notes != nil {
+		b.ReleaseNotes = string(notes)
+	}
+
+	if j := files[SIGNING_FILENAME]; j != nil {
+		info := SigningInfo{}
+		if err := json.Unmarshal(j, &info); err != nil {
+			return b, idx, errors.Wrapf(err,
+				"bundle contains invalid signing info")
+		}
+		b.Signing = &info
+	}
+
+	if doc := files[SBOM_FILENAME]; doc != nil {
+		sbom, err := image.NewSbom(doc)
+		if err != nil {
+			return b, idx, errors.Wrapf(err, "bundle contains invalid SBOM")
+		}
+		b.Sbom = &sbom
+	}
+
+	return b, idx, nil
+}
+
+// ReadBundle unpacks a bundle from a zip archive file.
+func ReadBundle(filename string) (Bundle, Index, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Bundle{}, Index{}, errors.Wrapf(err,
+			"failed to read bundle from file")
+	}
+
+	return Parse(data)
+}
+
+// verify checks the given set of files against the index.
+func (idx *Index) verify(files map[string][]byte) error {
+	if calcIndexHash(idx.Entries) != idx.Hash {
+		return errors.Errorf("bundle index hash mismatch")
+	}
+
+	listed := map[string]bool{}
+	for _, e := range idx.Entries {
+		listed[e.Name] = true
+
+		data, ok := files[e.Name]
+		if !ok {
+			return errors.Errorf("bundle is missing \"%s\"", e.Name)
+		}
+
+		sum := sha256.Sum256(data)
+		if len(data) != e.Size || hex.EncodeToString(sum[:]) != e.Sha256 {
+			return errors.Errorf("bundle file \"%s\" is corrupt", e.Name)
+		}
+	}
+
+	for name := range files {
+		if !listed[name] {
+			return errors.Errorf(
+				"bundle contains unlisted file \"%s\"", name)
+		}
+	}
+
+	if !listed[IMAGE_FILENAME] {
+		return errors.Errorf("bundle does not contain an image")
+	}
+
+	return nil
+}
+
+// Verify checks the bundle's contents for consistency: the image must be
+// well-formed and match the manifest, the signing info must describe the
+// image's signatures, and the SBOM must be the one bound to the image.  If keys are provided, the image signatures are
+// verified as well.
+func (b *Bundle) Verify(pubKeys []sec.PubSignKey) error {
+	if err := b.Image.VerifyStructure(); err != nil {
+		return err
+	}
+
+	if b.Manifest != nil {
+		if err := b.Image.VerifyManifest(*b.Manifest); err != nil {
+			return err
+		}
+	}
+
+	if b.Signing != nil {
+		info, err := NewSigningInfo(b.Image)
+		if err != nil {
+			return err
+		}
+
+		if len(info.Sigs) != len(b.Signing.Sigs) {
+			return errors.Errorf(
+				"signing info lists %d signatures; image contains %d",
+				len(b.Signing.Sigs), len(info.Sigs))
+		}
+		for i, s := range info.Sigs {
+			if s != b.Signing.Sigs[i] {
+				return errors.Errorf(
+					"signing info does not match image signature %d", i)
+			}
+		}
+	}
+
+	if b.Sbom != nil {
+		if err := b.Image.VerifySbom(*b.Sbom); err != nil {
+			return err
+		}
+	}
+
+	if len(pubKeys) > 0 {
+		if _, err := b.Image.VerifySigs(pubKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
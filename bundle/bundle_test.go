@@ -0,0 +1,157 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	ic := image.NewImageCreator()
+	ic.Version = image.ImageVersion{Major: 1, Minor: 2, Rev: 3, BuildNum: 4}
+	ic.Body = make([]byte, 256)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashStr := fmt.Sprintf("%x", hash)
+
+	info, err := NewSigningInfo(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := Bundle{
+		Image: img,
+		Manifest: &manifest.Manifest{
+			Name:      "test",
+			Version:   "1.2.3.4",
+			BuildID:   hashStr,
+			ImageHash: hashStr,
+		},
+		ReleaseNotes: "Initial release.\n",
+		Signing:      &info,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := b.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b2, idx, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 4 {
+		t.Fatalf("wrong number of index entries: have=%d want=4",
+			len(idx.Entries))
+	}
+	if b2.ReleaseNotes != b.ReleaseNotes {
+		t.Fatalf("release notes mismatch")
+	}
+	if err := b2.Verify(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the release notes; the index must catch it.
+	data := bytes.Replace(buf.Bytes(), []byte("Initial"), []byte("Altered"), 1)
+	if _, _, err := Parse(data); err == nil {
+		t.Fatalf("corrupt bundle parsed successfully")
+	}
+}
+
+func TestBundleSbom(t *testing.T) {
+	doc := []byte(`{"bomFormat": "CycloneDX", "specVersion": "1.5"}`)
+	sbom, err := image.NewSbom(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := image.NewImageCreator()
+	ic.Version = image.ImageVersion{Major: 1}
+	ic.Body = make([]byte, 256)
+	ic.Sbom = &sbom
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashStr := fmt.Sprintf("%x", hash)
+
+	ms := sbom.ManifestSbom(true)
+	b := Bundle{
+		Image: img,
+		Manifest: &manifest.Manifest{
+			Version:   "1.0.0.0",
+			BuildID:   hashStr,
+			ImageHash: hashStr,
+			Sbom:      &ms,
+		},
+		Sbom: &sbom,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := b.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b2, _, err := Parse(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2.Sbom == nil || b2.Sbom.Format != image.SBOM_FORMAT_CYCLONEDX {
+		t.Fatalf("SBOM not round-tripped: %+v", b2.Sbom)
+	}
+	if err := b2.Verify(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A different SBOM must not verify against the image.
+	other, err := image.NewSbom([]byte(`{"spdxVersion": "SPDX-2.3"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2.Sbom = &other
+	if err := b2.Verify(nil); err == nil {
+		t.Fatalf("swapped SBOM accepted")
+	}
+
+	b2.Sbom = nil
+	b2.Manifest.Sbom.Document = `{"bomFormat": "CycloneDX"}`
+	if err := b2.Verify(nil); err == nil {
+		t.Fatalf("swapped manifest SBOM accepted")
+	}
+}
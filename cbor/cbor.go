@@ -0,0 +1,418 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package cbor implements a minimal CBOR (RFC 8949) codec for the small
+// structures embedded in images, upload requests, and COSE messages.
+// Encoding is deterministic: integers and lengths use their shortest form and
+// map keys are sorted by their encoded bytes.  Decoding rejects indefinite
+// lengths, and the generic decoder rejects tags and non-text map keys;
+// callers that need these read items with a Reader.
+package cbor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Major types.
+const (
+	MAJOR_UINT   = 0
+	MAJOR_NEGINT = 1
+	MAJOR_BYTES  = 2
+	MAJOR_TEXT   = 3
+	MAJOR_ARRAY  = 4
+	MAJOR_MAP    = 5
+	MAJOR_TAG    = 6
+	MAJOR_SIMPLE = 7
+)
+
+// The deepest nesting of arrays and maps the decoder accepts.
+const MAX_DEPTH = 16
+
+// WriteHead appends an item's initial byte and argument: the value of an
+// integer, the length of a string, array, or map, or a tag number.
+func WriteHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= 0xff:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+// WriteText appends a text string.
+func WriteText(buf *bytes.Buffer, s string) {
+	WriteHead(buf, MAJOR_TEXT, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// WriteBytes appends a byte string.
+func WriteBytes(buf *bytes.Buffer, b []byte) {
+	WriteHead(buf, MAJOR_BYTES, uint64(len(b)))
+	buf.Write(b)
+}
+
+// WriteInt appends a signed integer.
+func WriteInt(buf *bytes.Buffer, v int64) {
+	if v < 0 {
+		WriteHead(buf, MAJOR_NEGINT, uint64(-(v + 1)))
+	} else {
+		WriteHead(buf, MAJOR_UINT, uint64(v))
+	}
+}
+
+func encodeMap(buf *bytes.Buffer, m map[string]interface{}) error {
+	type entry struct {
+		name string
+		key  []byte
+		val  interface{}
+	}
+
+	entries := make([]entry, 0, len(m))
+	for k, v := range m {
+		kb := &bytes.Buffer{}
+		WriteText(kb, k)
+		entries = append(entries, entry{k, kb.Bytes(), v})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	WriteHead(buf, MAJOR_MAP, uint64(len(entries)))
+	for _, e := range entries {
+		buf.Write(e.key)
+		if err := Encode(buf, e.val); err != nil {
+			return errors.Wrapf(err, "map key \"%s\"", e.name)
+		}
+	}
+
+	return nil
+}
+
+// Encode appends the CBOR encoding of v to buf.  v must be nil, a bool,
+// an integer, a float, a string, a []byte, a []interface{}, a []string, a
+// map[string]interface{}, or a map[string]string.
+func Encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case int:
+		WriteInt(buf, int64(v))
+	case int8:
+		WriteInt(buf, int64(v))
+	case int16:
+		WriteInt(buf, int64(v))
+	case int32:
+		WriteInt(buf, int64(v))
+	case int64:
+		WriteInt(buf, v)
+	case uint:
+		WriteHead(buf, MAJOR_UINT, uint64(v))
+	case uint8:
+		WriteHead(buf, MAJOR_UINT, uint64(v))
+	case uint16:
+		WriteHead(buf, MAJOR_UINT, uint64(v))
+	case uint32:
+		WriteHead(buf, MAJOR_UINT, uint64(v))
+	case uint64:
+		WriteHead(buf, MAJOR_UINT, v)
+	case float32:
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(float64(v)))
+	case float64:
+		buf.WriteByte(0xfb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case string:
+		WriteText(buf, v)
+	case []byte:
+		WriteBytes(buf, v)
+	case []string:
+		WriteHead(buf, MAJOR_ARRAY, uint64(len(v)))
+		for _, s := range v {
+			WriteText(buf, s)
+		}
+	case []interface{}:
+		WriteHead(buf, MAJOR_ARRAY, uint64(len(v)))
+		for i, e := range v {
+			if err := Encode(buf, e); err != nil {
+				return errors.Wrapf(err, "array index %d", i)
+			}
+		}
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, s := range v {
+			m[k] = s
+		}
+		return encodeMap(buf, m)
+	case map[string]interface{}:
+		return encodeMap(buf, v)
+	default:
+		return errors.Errorf("cannot encode %T as CBOR", v)
+	}
+
+	return nil
+}
+
+// Reader reads CBOR items from a byte slice.
+type Reader struct {
+	b   []byte
+	off int
+}
+
+// NewReader returns a reader positioned at the start of b.
+func NewReader(b []byte) *Reader {
+	return &Reader{b: b}
+}
+
+// Remaining returns the number of unread bytes.
+func (d *Reader) Remaining() int {
+	return len(d.b) - d.off
+}
+
+// Next reads the next n bytes.
+func (d *Reader) Next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errors.Errorf(
+			"CBOR item truncated at offset %d: need %d bytes, have %d",
+			d.off, n, len(d.b)-d.off)
+	}
+
+	b := d.b[d.off : d.off+int(n)]
+	d.off += int(n)
+	return b, nil
+}
+
+// Head reads an item's initial byte, returning its major type, additional
+// information, and argument.
+func (d *Reader) Head() (byte, byte, uint64, error) {
+	b, err := d.Next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major := b[0] >> 5
+	info := b[0] & 0x1f
+
+	var size uint64
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size = 1 << (info - 24)
+	default:
+		return 0, 0, 0, errors.Errorf(
+			"unsupported CBOR additional info at offset %d: %d",
+			d.off-1, info)
+	}
+
+	b, err = d.Next(size)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+
+	return major, info, n, nil
+}
+
+func (d *Reader) decode(depth int) (interface{}, error) {
+	if depth > MAX_DEPTH {
+		return nil, errors.Errorf(
+			"CBOR nesting too deep: max=%d", MAX_DEPTH)
+	}
+
+	major, info, n, err := d.Head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case MAJOR_UINT:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+
+	case MAJOR_NEGINT:
+		if n > math.MaxInt64 {
+			return nil, errors.Errorf(
+				"CBOR negative integer out of range: -1-%d", n)
+		}
+		return -1 - int64(n), nil
+
+	case MAJOR_BYTES:
+		b, err := d.Next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), b...), nil
+
+	case MAJOR_TEXT:
+		b, err := d.Next(n)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+
+	case MAJOR_ARRAY:
+		if n > uint64(len(d.b)-d.off) {
+			return nil, errors.Errorf(
+				"CBOR array length exceeds remaining data: %d", n)
+		}
+		arr := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+
+	case MAJOR_MAP:
+		return d.decodeMap(n, depth)
+
+	case MAJOR_SIMPLE:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 25:
+			return halfToFloat(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		}
+		return nil, errors.Errorf("unsupported CBOR simple value: %d", info)
+
+	default:
+		return nil, errors.Errorf("unsupported CBOR major type: %d", major)
+	}
+}
+
+func (d *Reader) decodeMap(n uint64, depth int) (
+	map[string]interface{}, error) {
+
+	if n > uint64(len(d.b)-d.off) {
+		return nil, errors.Errorf(
+			"CBOR map length exceeds remaining data: %d", n)
+	}
+
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		major, _, kn, err := d.Head()
+		if err != nil {
+			return nil, err
+		}
+		if major != MAJOR_TEXT {
+			return nil, errors.Errorf(
+				"CBOR map key is not a text string: major type %d", major)
+		}
+		kb, err := d.Next(kn)
+		if err != nil {
+			return nil, err
+		}
+		key := string(kb)
+		if _, ok := m[key]; ok {
+			return nil, errors.Errorf("duplicate CBOR map key \"%s\"", key)
+		}
+
+		v, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, errors.Wrapf(err, "map key \"%s\"", key)
+		}
+		m[key] = v
+	}
+
+	return m, nil
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// Value decodes the next item.  The item's representation is as described
+// for Decode.
+func (d *Reader) Value() (interface{}, error) {
+	return d.decode(0)
+}
+
+// Decode decodes a single CBOR item that spans all of b.  Unsigned
+// integers are returned as int64 if they fit and uint64 otherwise; negative
+// integers as int64; floats as float64; arrays as []interface{}; maps (which
+// must have text keys) as map[string]interface{}.
+func Decode(b []byte) (interface{}, error) {
+	d := NewReader(b)
+	v, err := d.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(b) {
+		return nil, errors.Errorf(
+			"%d trailing bytes after CBOR item", len(b)-d.off)
+	}
+
+	return v, nil
+}
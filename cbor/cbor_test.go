@@ -0,0 +1,163 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		val  interface{}
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{-1, "20"},
+		{-500, "3901f3"},
+		{uint64(math.MaxUint64), "1bffffffffffffffff"},
+		{"a", "6161"},
+		{[]byte{1, 2}, "420102"},
+		{nil, "f6"},
+		{true, "f5"},
+		{[]interface{}{1, "x"}, "82016178"},
+		// Keys are sorted by their encoding: shorter keys first.
+		{map[string]interface{}{"bb": 1, "a": 2, "c": 3},
+			"a3616102616303626262" + "01"},
+	}
+
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, test.val); err != nil {
+			t.Fatal(err)
+		}
+		have := hex.EncodeToString(buf.Bytes())
+		if have != test.want {
+			t.Fatalf("wrong encoding of %#v: have=%s want=%s",
+				test.val, have, test.want)
+		}
+	}
+
+	if err := Encode(&bytes.Buffer{}, struct{}{}); err == nil {
+		t.Fatalf("unsupported type encoded")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	v := map[string]interface{}{
+		"int":   int64(-7),
+		"big":   uint64(math.MaxUint64),
+		"float": 2.5,
+		"bytes": []byte{0xde, 0xad},
+		"list":  []interface{}{true, false, nil, "s"},
+		"map":   map[string]interface{}{"k": int64(1)},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, v); err != nil {
+		t.Fatal(err)
+	}
+	have, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(have, v) {
+		t.Fatalf("round trip mismatch: have=%#v want=%#v", have, v)
+	}
+
+	// Half-precision float.
+	f, err := Decode([]byte{0xf9, 0x3e, 0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != 1.5 {
+		t.Fatalf("wrong half float: %v", f)
+	}
+
+	bad := []string{
+		"",                   // empty
+		"1a0001",             // truncated argument
+		"43aabb",             // truncated byte string
+		"5f",                 // indefinite length
+		"c100",               // tag
+		"a10101",             // integer map key
+		"a2616101616102",     // duplicate map key
+		"0000",               // trailing bytes
+		"9bffffffffffffffff", // array length exceeds data
+		"f8ff",               // unsupported simple value
+	}
+	for _, s := range bad {
+		b, _ := hex.DecodeString(s)
+		if _, err := Decode(b); err == nil {
+			t.Fatalf("malformed CBOR accepted: %s", s)
+		}
+	}
+
+	// Nesting is bounded.
+	deep := bytes.Repeat([]byte{0x81}, MAX_DEPTH+2)
+	deep = append(deep, 0x00)
+	if _, err := Decode(deep); err == nil {
+		t.Fatalf("excessively nested CBOR accepted")
+	}
+}
+
+func TestReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteHead(buf, MAJOR_TAG, 18)
+	WriteInt(buf, -8)
+	WriteBytes(buf, []byte("abc"))
+
+	r := NewReader(buf.Bytes())
+	major, _, n, err := r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if major != MAJOR_TAG || n != 18 {
+		t.Fatalf("wrong head: major=%d n=%d", major, n)
+	}
+
+	v, err := r.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != int64(-8) {
+		t.Fatalf("wrong value: %#v", v)
+	}
+
+	major, _, n, err = r.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Next(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if major != MAJOR_BYTES || string(b) != "abc" {
+		t.Fatalf("wrong byte string: major=%d b=%q", major, b)
+	}
+	if r.Remaining() != 0 {
+		t.Fatalf("unexpected remaining bytes: %d", r.Remaining())
+	}
+}
@@ -0,0 +1,1197 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+var imageGroup = &group{
+	desc: "Mynewt images",
+	cmds: map[string]*command{
+		"show": {
+			usage: "<image>",
+			desc:  "Print an image's structure as JSON",
+			run:   runImageShow,
+		},
+		"tlvs": {
+			usage: "<image>",
+			desc:  "List an image's TLVs with their decoded values",
+			run:   runImageTlvs,
+		},
+		"analyze": {
+			usage: "<image>",
+			desc:  "Report suspicious header and TLV combinations",
+			run:   runImageAnalyze,
+		},
+		"create": {
+			usage: "--bin <file> -o <image> [flags]",
+			desc:  "Create an image from a binary or ELF file",
+			flags: imageCreateFlags,
+			run:   runImageCreate,
+		},
+		"xip-pair": {
+			usage: "--bin0 <file> --addr0 <addr> --bin1 <file> " +
+				"--addr1 <addr> -o <prefix> [flags]",
+			desc:  "Create a direct-XIP image pair, one per slot",
+			flags: imageXipPairFlags,
+			run:   runImageXipPair,
+		},
+		"sign": {
+			usage: "--key <key> [-o <out>] <image>",
+			desc:  "Add signatures to an existing image",
+			flags: imageSignFlags,
+			run:   runImageSign,
+		},
+		"threshold-init": {
+			usage: "-k <num> --key <pubkey>... -o <session> <image>",
+			desc:  "Start a k-of-n signing session for an image",
+			flags: imageThresholdInitFlags,
+			run:   runImageThresholdInit,
+		},
+		"threshold-sign": {
+			usage: "--key <key> [-o <out>] <session>",
+			desc:  "Add signatures to a k-of-n signing session",
+			flags: imageThresholdSignFlags,
+			run:   runImageThresholdSign,
+		},
+		"threshold-finalize": {
+			usage: "--session <session> [-o <out>] <image>",
+			desc:  "Attach a completed session's signatures to an image",
+			flags: imageThresholdFinalizeFlags,
+			run:   runImageThresholdFinalize,
+		},
+		"verify": {
+			usage: "[--key <key>] [--enc-key <key>] [--profile <name>] <image>",
+			desc:  "Verify an image's structure, hash, and signatures",
+			flags: imageVerifyFlags,
+			run:   runImageVerify,
+		},
+		"decrypt": {
+			usage: "--key <key> -o <out> <image>",
+			desc:  "Decrypt an image body (the encrypted flag is retained)",
+			flags: imageDecryptFlags,
+			run:   runImageDecrypt,
+		},
+		"serial-info": {
+			usage: "[--image <num>] [--chunk-size <size>] [-o <out>] <image>",
+			desc:  "Add upload size and hash info for serial recovery",
+			flags: imageSerialInfoFlags,
+			run:   runImageSerialInfo,
+		},
+		"rollback-plan": {
+			usage: "<image>...",
+			desc:  "Plan a fleet rollout order and report rollback hazards",
+			run:   runImageRollbackPlan,
+		},
+		"flash-script": {
+			usage: "--manifest <manifest> [--format jlink|pyocd] [flags] " +
+				"<image>",
+			desc:  "Print a script that programs an image into its slot",
+			flags: imageFlashScriptFlags,
+			run:   runImageFlashScript,
+		},
+		"convert-v1": {
+			usage: "-o <out> [--key <key>] [--v1-key <key>] <v1-image>",
+			desc:  "Convert a legacy v1 image to the v2 format",
+			flags: imageConvertV1Flags,
+			run:   runImageConvertV1,
+		},
+	},
+}
+
+func runImageShow(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	j, err := img.Json()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\n", j)
+	return nil
+}
+
+func runImageTlvs(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, tlv := range img.ProtTlvs {
+		fmt.Fprintf(w, "prot %s\n", tlv.String())
+	}
+	for _, tlv := range img.Tlvs {
+		fmt.Fprintf(w, "     %s\n", tlv.String())
+	}
+
+	return nil
+}
+
+func runImageAnalyze(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	r := image.Analyze(img)
+	for _, f := range r.Findings {
+		fmt.Fprintf(w, "%s\n", f.String())
+	}
+
+	return r.Err()
+}
+
+func imageCreateFlags(fs *flag.FlagSet) {
+	fs.String("bin", "", "Source binary")
+	fs.String("elf", "", "Source ELF file (instead of --bin)")
+	fs.String("o", "", "Output image file")
+	fs.String("version", "0.0.0.0", "Image version")
+	addKeyFlag(fs, "Private signing key file, PKCS#11 URI, or ssh-agent:[key]")
+	fs.String("enc-key", "", "Public key-exchange encryption key, or "+
+		"base64 secret with --hw-key-index")
+	fs.Int("hw-key-index", -1, "Hardware encryption key index")
+	fs.String("device-id", "", "Hex device ID; derive the device's key "+
+		"from the --enc-key master key")
+	fs.String("kdf", "hkdf-sha256", "Device key derivation function "+
+		"(hkdf-sha256 or cmac)")
+	fs.String("kdf-label", "", "Device key derivation label")
+	fs.String("provision", "", "Provisioning records (JSON or CSV); "+
+		"select the --enc-key-candidate provisioned to --provision-device")
+	fs.String("provision-device", "", "Hex ID of the target device")
+	fs.Var(&stringList{}, "enc-key-candidate",
+		"Candidate encryption key file for --provision (may be repeated)")
+	fs.Int("hdr-pad", 0, "Header size")
+	fs.Int("pad", 0, "Pad the body to a multiple of this size")
+	fs.Int("align", 0, "Flash write alignment")
+	fs.Int("body-align", 0, "Required alignment of the body start "+
+		"(e.g., vector table)")
+	fs.Bool("pad-body-align", false, "Grow the header to satisfy --body-align")
+	fs.String("build-id", "", "Hex build identifier (e.g., git SHA)")
+	fs.String("sbom", "", "SPDX or CycloneDX document to bind to the image")
+	fs.String("channel", "", "Release channel (e.g., beta)")
+	fs.String("user-data", "", "JSON object of provisioning values to "+
+		"bind to the image (USER_DATA TLV)")
+	fs.String("rom-fixed", "", "Mark the image ROM-fixed (direct-XIP) at "+
+		"this flash address (e.g., 0x10020000)")
+	fs.String("endian", "little", "Header byte order (little or big)")
+	fs.Int("hash-tree", 0, "Add a hash tree with this chunk size "+
+		"(e.g., 4096)")
+	fs.Bool("hash-last", false, "Emit the SHA256 TLV after the signatures")
+	fs.Bool("group-sigs", false, "Emit all key hashes before all signatures")
+	fs.Bool("protect-sigs", false, "Emit key hashes and signatures in the "+
+		"protected region (not supported by standard MCUboot)")
+	fs.Bool("hash-only", false, "Create an unsigned development image "+
+		"(incompatible with --key)")
+	fs.Bool("hash-ciphertext", false, "Hash the encrypted body rather "+
+		"than the plaintext (requires --enc-key)")
+	fs.String("hash-alg", "sha256", "Image hash algorithm (sha256 or "+
+		"blake2s)")
+	fs.String("key-hash", "", "KEYHASH TLV scheme: <len>[:raw]; "+
+		"e.g., 8, 16, or full")
+	fs.Int("budget", 0, "Image size budget, in bytes")
+	fs.String("budget-manifest", "", "Manifest whose flash map slot, "+
+		"minus its trailer, sets the size budget")
+	fs.String("baseline", "", "Previous image; report growth relative to it")
+	fs.Bool("enforce-budget", false, "Fail if the image exceeds its budget")
+	addAuditFlags(fs)
+}
+
+// sizeBudget constructs a size budget from the image creation flags.  It
+// returns nil if no budget is specified.
+func sizeBudget(fs *flag.FlagSet,
+	opts *image.ImageCreateOpts) (*image.SizeBudget, error) {
+
+	b := &image.SizeBudget{
+		Max:     flagInt(fs, "budget"),
+		Enforce: flagBool(fs, "enforce-budget"),
+	}
+
+	if manPath := flagString(fs, "budget-manifest"); manPath != "" {
+		man, err := manifest.ReadManifest(manPath)
+		if err != nil {
+			return nil, err
+		}
+		if man.FlashMap == nil {
+			return nil, errors.Errorf(
+				"manifest lacks a flash map: %s", manPath)
+		}
+
+		fm := man.FlashMap.FlashMap()
+		opts.FlashMap = &fm
+		b.Area = man.FlashMap.Slot
+		b.TrailerSize = man.FlashMap.TrailerSize
+	} else if b.Max == 0 {
+		if b.Enforce || flagString(fs, "baseline") != "" {
+			return nil, errors.Errorf(
+				"--enforce-budget and --baseline require --budget or " +
+					"--budget-manifest")
+		}
+		return nil, nil
+	}
+
+	if filename := flagString(fs, "baseline"); filename != "" {
+		baseline, err := image.ReadImage(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read baseline image")
+		}
+		b.Baseline = &baseline
+	}
+
+	return b, nil
+}
+
+func runImageCreate(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 0, "no positional arguments"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("missing output filename (-o)")
+	}
+	if flagString(fs, "bin") == "" && flagString(fs, "elf") == "" {
+		return errors.Errorf("missing source file (--bin or --elf)")
+	}
+
+	ver, err := image.ParseVersion(flagString(fs, "version"))
+	if err != nil {
+		return err
+	}
+
+	signers, err := sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(signers)
+	signers, closeAudit, err := auditSigners(fs, signers)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	endianness, err := image.EndiannessFromString(flagString(fs, "endian"))
+	if err != nil {
+		return err
+	}
+
+	hashAlg, err := image.HashAlgFromString(flagString(fs, "hash-alg"))
+	if err != nil {
+		return err
+	}
+
+	opts := image.ImageCreateOpts{
+		SrcBinFilename:    flagString(fs, "bin"),
+		SrcElfFilename:    flagString(fs, "elf"),
+		SrcEncKeyFilename: flagString(fs, "enc-key"),
+		SrcEncKeyIndex:    flagInt(fs, "hw-key-index"),
+		Version:           ver,
+		Signers:           signers,
+		HdrPad:            flagInt(fs, "hdr-pad"),
+		ImagePad:          flagInt(fs, "pad"),
+		Align:             flagInt(fs, "align"),
+		BodyAlign:         flagInt(fs, "body-align"),
+		PadBodyAlign:      flagBool(fs, "pad-body-align"),
+		SbomFilename:      flagString(fs, "sbom"),
+		Channel:           flagString(fs, "channel"),
+		Endianness:        endianness,
+		HashTreeChunkSize: flagInt(fs, "hash-tree"),
+		HashOnly:          flagBool(fs, "hash-only"),
+		HashCiphertext:    flagBool(fs, "hash-ciphertext"),
+		HashAlg:           hashAlg,
+		TlvLayout: image.TlvLayout{
+			HashLast:  flagBool(fs, "hash-last"),
+			GroupSigs: flagBool(fs, "group-sigs"),
+		},
+	}
+
+	opts.KeyHash, err = keyHashScheme(fs)
+	if err != nil {
+		return err
+	}
+
+	if flagBool(fs, "protect-sigs") {
+		opts.TlvLayout.Protected = image.ProtectedSigTlvTypes()
+	}
+
+	if filename := flagString(fs, "user-data"); filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read user data")
+		}
+		opts.UserData, err = image.UserDataFromJson(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s := flagString(fs, "rom-fixed"); s != "" {
+		addr, err := parseFlashAddr(s)
+		if err != nil {
+			return err
+		}
+		opts.RomFixedAddr = &addr
+	}
+
+	if s := flagString(fs, "build-id"); s != "" {
+		opts.BuildId, err = image.ParseBuildId(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s := flagString(fs, "device-id"); s != "" {
+		opts.DeviceId, err = hex.DecodeString(s)
+		if err != nil {
+			return errors.Errorf("invalid device ID: %s", s)
+		}
+
+		opts.Kdf.Alg, err = sec.KdfAlgFromString(flagString(fs, "kdf"))
+		if err != nil {
+			return err
+		}
+		opts.Kdf.Label = []byte(flagString(fs, "kdf-label"))
+	}
+
+	if filename := flagString(fs, "provision"); filename != "" {
+		recs, err := sec.ReadProvisionRecords(filename)
+		if err != nil {
+			return err
+		}
+		opts.ProvisionRecords = &recs
+
+		s := flagString(fs, "provision-device")
+		if s == "" {
+			return errors.Errorf("--provision requires --provision-device")
+		}
+		opts.ProvisionDeviceId, err = hex.DecodeString(s)
+		if err != nil {
+			return errors.Errorf("invalid device ID: %s", s)
+		}
+		opts.SrcEncKeyCandidates = flagStrings(fs, "enc-key-candidate")
+	}
+
+	// Map the binary rather than reading it, unless the image is about to
+	// overwrite it.
+	if opts.SrcElfFilename == "" && opts.SrcBinFilename != out {
+		m, err := image.MapFile(opts.SrcBinFilename)
+		if err != nil {
+			return err
+		}
+		defer m.Close()
+
+		opts.SrcBin = m.Data
+	}
+
+	opts.SizeBudget, err = sizeBudget(fs, &opts)
+	if err != nil {
+		return err
+	}
+
+	img, budget, err := image.GenerateImageWithBudget(opts)
+	if opts.SizeBudget != nil && budget.Budget > 0 {
+		fmt.Fprintf(w, "Size budget: %s\n", budget.String())
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := img.WriteToFile(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Created %s (version %s)\n", out, ver.String())
+	if budget.Exceeded() {
+		fmt.Fprintf(w, "warning: image exceeds its size budget by %d "+
+			"bytes\n", -budget.Free)
+	}
+	if len(signers) == 0 && !opts.HashOnly {
+		fmt.Fprintf(w, "warning: image is unsigned; pass --hash-only to "+
+			"create a development image deliberately\n")
+	}
+	return nil
+}
+
+func imageXipPairFlags(fs *flag.FlagSet) {
+	fs.String("o", "", "Output filename prefix; writes <prefix>.slot0.img "+
+		"and <prefix>.slot1.img")
+	for i := 0; i < image.XIP_NUM_SLOTS; i++ {
+		fs.String(fmt.Sprintf("bin%d", i), "",
+			fmt.Sprintf("Binary linked for slot %d", i))
+		fs.String(fmt.Sprintf("addr%d", i), "",
+			fmt.Sprintf("Flash address of slot %d", i))
+	}
+	fs.String("version", "0.0.0.0", "Image version")
+	addKeyFlag(fs, "Private signing key file, PKCS#11 URI, or ssh-agent:[key]")
+	fs.Int("hdr-pad", 0, "Header size")
+	fs.Int("pad", 0, "Pad the body to a multiple of this size")
+	fs.Int("align", 0, "Flash write alignment")
+	addAuditFlags(fs)
+}
+
+func runImageXipPair(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 0, "no positional arguments"); err != nil {
+		return err
+	}
+
+	prefix := flagString(fs, "o")
+	if prefix == "" {
+		return errors.Errorf("missing output filename prefix (-o)")
+	}
+
+	ver, err := image.ParseVersion(flagString(fs, "version"))
+	if err != nil {
+		return err
+	}
+
+	signers, err := sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(signers)
+	signers, closeAudit, err := auditSigners(fs, signers)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	opts := image.XipPairOpts{
+		Image: image.ImageCreateOpts{
+			SrcEncKeyIndex: -1,
+			Version:        ver,
+			Signers:        signers,
+			HdrPad:         flagInt(fs, "hdr-pad"),
+			ImagePad:       flagInt(fs, "pad"),
+			Align:          flagInt(fs, "align"),
+		},
+	}
+
+	for i, _ := range opts.Slots {
+		bin := flagString(fs, fmt.Sprintf("bin%d", i))
+		if bin == "" {
+			return errors.Errorf("missing slot %d binary (--bin%d)", i, i)
+		}
+		s := flagString(fs, fmt.Sprintf("addr%d", i))
+		if s == "" {
+			return errors.Errorf("missing slot %d address (--addr%d)", i, i)
+		}
+		addr, err := parseFlashAddr(s)
+		if err != nil {
+			return err
+		}
+
+		opts.Slots[i] = image.XipSlot{
+			SrcBinFilename: bin,
+			Addr:           addr,
+		}
+	}
+
+	pair, err := image.GenerateXipPair(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := pair.WriteFiles(prefix); err != nil {
+		return err
+	}
+
+	for i, name := range image.XipPairFilenames(prefix) {
+		fmt.Fprintf(w, "Created %s (version %s, slot %d at 0x%08x)\n",
+			name, ver.String(), i, opts.Slots[i].Addr)
+	}
+	return nil
+}
+
+func imageSignFlags(fs *flag.FlagSet) {
+	addKeyFlag(fs, "Private signing key file, PKCS#11 URI, or ssh-agent:[key]")
+	fs.String("o", "", "Output image file (default: overwrite input)")
+	fs.Bool("embed-pubkey", false, "Embed the full public key")
+	fs.String("key-hash", "", "KEYHASH TLV scheme: <len>[:raw]; "+
+		"e.g., 8, 16, or full")
+	addAuditFlags(fs)
+}
+
+func runImageSign(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	signers, err := sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(signers)
+	if len(signers) == 0 {
+		return errors.Errorf("no signing keys specified (--key)")
+	}
+	signers, closeAudit, err := auditSigners(fs, signers)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+	if img.HasProtectedSigs() {
+		return errors.Errorf(
+			"cannot add signatures to an image with protected signatures")
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+
+	keyHash, err := keyHashScheme(fs)
+	if err != nil {
+		return err
+	}
+
+	tlvs, err := image.BuildSignerSigTlvs(signers, hash, image.SigTlvOpts{
+		EmbedPubKey: flagBool(fs, "embed-pubkey"),
+		KeyHash:     keyHash,
+	})
+	if err != nil {
+		return err
+	}
+	img.Tlvs = append(img.Tlvs, tlvs...)
+
+	out := flagString(fs, "o")
+	if out == "" {
+		out = args[0]
+	}
+	if err := img.WriteToFile(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Added %d signature(s) to %s\n", len(signers), out)
+	return nil
+}
+
+func imageThresholdInitFlags(fs *flag.FlagSet) {
+	fs.Int("k", 0, "Number of signatures required")
+	addKeyFlag(fs, "Public key of an authorized signer")
+	fs.String("o", "", "Output session file")
+	fs.String("comment", "", "Description of the signing ceremony")
+}
+
+func runImageThresholdInit(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("missing output filename (-o)")
+	}
+
+	keys, err := sec.ReadPubSignKeys(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	session, err := image.NewThresholdSession(img, flagInt(fs, "k"), keys)
+	if err != nil {
+		return err
+	}
+	session.Comment = flagString(fs, "comment")
+
+	if err := writeThresholdSession(session, out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Started %d-of-%d signing session %s\n",
+		session.Threshold, len(session.Signers), out)
+	return nil
+}
+
+func imageThresholdSignFlags(fs *flag.FlagSet) {
+	addKeyFlag(fs, "Private signing key file, PKCS#11 URI, or ssh-agent:[key]")
+	fs.String("o", "", "Output session file (default: overwrite input)")
+	addAuditFlags(fs)
+}
+
+func runImageThresholdSign(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "a session filename"); err != nil {
+		return err
+	}
+
+	signers, err := sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(signers)
+	if len(signers) == 0 {
+		return errors.Errorf("no signing keys specified (--key)")
+	}
+	signers, closeAudit, err := auditSigners(fs, signers)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	session, err := readThresholdSession(args[0])
+	if err != nil {
+		return err
+	}
+
+	// Unlike Distribute, every key must sign; a key that cannot is an error.
+	for _, signer := range signers {
+		if err := session.Sign(signer); err != nil {
+			return err
+		}
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		out = args[0]
+	}
+	if err := writeThresholdSession(session, out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Added %d signature(s) to %s; %d more required\n",
+		len(signers), out, session.Remaining())
+	return nil
+}
+
+func imageThresholdFinalizeFlags(fs *flag.FlagSet) {
+	fs.String("session", "", "Completed signing session file")
+	fs.String("o", "", "Output image file (default: overwrite input)")
+	fs.Bool("embed-pubkey", false, "Embed the full public keys")
+	fs.String("key-hash", "", "KEYHASH TLV scheme: <len>[:raw]; "+
+		"e.g., 8, 16, or full")
+}
+
+func runImageThresholdFinalize(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	if flagString(fs, "session") == "" {
+		return errors.Errorf("missing session filename (--session)")
+	}
+	session, err := readThresholdSession(flagString(fs, "session"))
+	if err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+	if img.HasProtectedSigs() {
+		return errors.Errorf(
+			"cannot add signatures to an image with protected signatures")
+	}
+
+	keyHash, err := keyHashScheme(fs)
+	if err != nil {
+		return err
+	}
+
+	img, err = image.FinalizeThreshold(img, session, image.SigTlvOpts{
+		EmbedPubKey: flagBool(fs, "embed-pubkey"),
+		KeyHash:     keyHash,
+	})
+	if err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		out = args[0]
+	}
+	if err := img.WriteToFile(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Added %d threshold signature(s) to %s\n",
+		len(session.Sigs), out)
+	return nil
+}
+
+func readThresholdSession(filename string) (sec.ThresholdSession, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return sec.ThresholdSession{}, errors.Wrapf(err,
+			"failed to read threshold session")
+	}
+
+	return sec.ParseThresholdSession(b)
+}
+
+func writeThresholdSession(session sec.ThresholdSession,
+	filename string) error {
+
+	b, err := session.Marshal()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write threshold session")
+	}
+
+	return nil
+}
+
+func imageVerifyFlags(fs *flag.FlagSet) {
+	addKeyFlag(fs, "Public signing key file")
+	fs.Var(&stringList{}, "enc-key",
+		"Private decryption key file (may be repeated)")
+	fs.String("profile", "", "Verification profile")
+	fs.Int("min-sigs", 0, "Minimum number of valid signatures "+
+		"(default: 1 if keys are specified)")
+	fs.Var(&stringList{}, "channel",
+		"Accepted release channel (may be repeated)")
+	fs.String("fixed-addr", "", "Require a ROM-fixed image linked for "+
+		"this flash address")
+	fs.String("min-security-counter", "",
+		"Require an imgtool security counter of at least this value")
+	fs.String("revocations", "", "Signed key revocation list file")
+	fs.Var(&stringList{}, "revocation-root",
+		"Public key that signs the revocation list (may be repeated)")
+	fs.Bool("reject-hash-only", false, "Reject unsigned development images")
+	fs.String("hash-coverage", "auto", "Required hash convention of an "+
+		"encrypted image (auto, plaintext, or ciphertext)")
+}
+
+func runImageVerify(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "failed to read image from file")
+	}
+	if image.IsImageV1(data) {
+		return verifyImageV1(fs, data, w)
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	opts := image.VerifyOpts{
+		MinSigs:        flagInt(fs, "min-sigs"),
+		Channels:       flagStrings(fs, "channel"),
+		RejectHashOnly: flagBool(fs, "reject-hash-only"),
+	}
+
+	opts.HashCoverage, err = image.HashCoverageFromString(
+		flagString(fs, "hash-coverage"))
+	if err != nil {
+		return err
+	}
+
+	if s := flagString(fs, "fixed-addr"); s != "" {
+		addr, err := parseFlashAddr(s)
+		if err != nil {
+			return err
+		}
+		opts.FixedAddr = &addr
+	}
+
+	if s := flagString(fs, "min-security-counter"); s != "" {
+		cnt, err := strconv.ParseUint(s, 0, 32)
+		if err != nil {
+			return errors.Errorf("invalid security counter: %s", s)
+		}
+		minCnt := uint32(cnt)
+		opts.MinSecurityCounter = &minCnt
+	}
+
+	opts.SigKeys, err = sec.ReadPubSignKeys(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	if len(opts.SigKeys) > 0 && opts.MinSigs == 0 {
+		opts.MinSigs = 1
+	}
+
+	opts.EncKeys, err = sec.ReadPrivEncKeys(flagStrings(fs, "enc-key"))
+	if err != nil {
+		return err
+	}
+
+	if filename := flagString(fs, "revocations"); filename != "" {
+		roots, err := sec.ReadPubSignKeys(flagStrings(fs, "revocation-root"))
+		if err != nil {
+			return err
+		}
+		if len(roots) == 0 {
+			return errors.Errorf(
+				"--revocations requires at least one --revocation-root")
+		}
+
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read revocation list")
+		}
+
+		rl, err := sec.ParseRevocationList(b, roots)
+		if err != nil {
+			return err
+		}
+		opts.Revocations = &rl
+	}
+
+	var r image.VerifyReport
+	if profile := flagString(fs, "profile"); profile != "" {
+		r, err = image.VerifyImageProfile(img, profile, opts)
+		if err != nil {
+			return err
+		}
+	} else {
+		r = image.VerifyImage(img, opts)
+	}
+
+	for _, rule := range r.Rules {
+		status := "ok"
+		if !rule.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%-18s %-4s %s\n", rule.Name, status, rule.Detail)
+	}
+	for _, warning := range r.Warnings {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+	if r.HashOnly {
+		fmt.Fprintf(w, "note: image is hash-only (unsigned); "+
+			"for development use only\n")
+	}
+
+	return r.Err()
+}
+
+func imageDecryptFlags(fs *flag.FlagSet) {
+	fs.String("key", "", "Private decryption key file")
+	fs.String("o", "", "Output image file")
+}
+
+func runImageDecrypt(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("missing output filename (-o)")
+	}
+
+	key, err := sec.ReadPrivEncKey(flagString(fs, "key"))
+	if err != nil {
+		return err
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	dec, err := image.Decrypt(img, key)
+	if err != nil {
+		return err
+	}
+
+	if err := dec.WriteToFile(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Decrypted %s to %s\n", args[0], out)
+	return nil
+}
+
+func imageSerialInfoFlags(fs *flag.FlagSet) {
+	fs.Int("image", 0, "Image number to upload to")
+	fs.Int("chunk-size", 0, "Upload chunk size (0: unspecified)")
+	fs.String("o", "", "Output image file (default: overwrite input)")
+}
+
+func runImageSerialInfo(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	imageNum := flagInt(fs, "image")
+	if imageNum < 0 || imageNum > 0xff {
+		return errors.Errorf("invalid image number: %d", imageNum)
+	}
+	chunkSize := flagInt(fs, "chunk-size")
+	if chunkSize < 0 {
+		return errors.Errorf("invalid chunk size: %d", chunkSize)
+	}
+
+	img, err := image.ReadImage(args[0])
+	if err != nil {
+		return err
+	}
+
+	err = img.AddSerialInfo(uint8(imageNum), uint32(chunkSize))
+	if err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		out = args[0]
+	}
+	if err := img.WriteToFile(out); err != nil {
+		return err
+	}
+
+	info, err := img.SerialInfo()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Added serial info to %s: size=%d hash=%x\n",
+		out, info.ImageSize, info.ImageHash)
+	return nil
+}
+
+func runImageRollbackPlan(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if len(args) == 0 {
+		return errors.Errorf("expected at least one image filename")
+	}
+
+	var infos []image.RollbackInfo
+	for _, filename := range args {
+		img, err := image.ReadImage(filename)
+		if err != nil {
+			return err
+		}
+
+		info, err := image.ExtractRollbackInfo(img)
+		if err != nil {
+			return errors.Wrapf(err, "path=%s", filename)
+		}
+		info.Name = filename
+		infos = append(infos, info)
+	}
+
+	plan := image.PlanRollback(infos)
+	for _, i := range plan.Order {
+		info := plan.Images[i]
+		cnt := "-"
+		if info.SecurityCounter != nil {
+			cnt = fmt.Sprintf("%d", *info.SecurityCounter)
+		}
+
+		var to []string
+		for _, j := range plan.Upgrades[i] {
+			to = append(to, plan.Images[j].Name)
+		}
+		fmt.Fprintf(w, "%-16s sec-cnt=%-4s %s -> [%s]\n",
+			info.Version.String(), cnt, info.Name, strings.Join(to, ", "))
+	}
+
+	return plan.Err()
+}
+
+func verifyImageV1(fs *flag.FlagSet, data []byte, w io.Writer) error {
+	img, err := image.ParseImageV1(data)
+	if err != nil {
+		return err
+	}
+
+	keys, err := sec.ReadPubSignKeys(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-18s %-4s\n", "v1-structure", "ok")
+
+	if err := img.VerifyHash(nil); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%-18s %-4s\n", "v1-hash", "ok")
+
+	if len(keys) > 0 {
+		if _, err := img.VerifySigs(keys); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%-18s %-4s\n", "v1-signature", "ok")
+	}
+
+	return nil
+}
+
+func imageConvertV1Flags(fs *flag.FlagSet) {
+	addKeyFlag(fs, "Private signing key for the v2 image")
+	fs.Var(&stringList{}, "v1-key",
+		"Public key to verify the v1 signature with (may be repeated)")
+	fs.String("o", "", "Output image file")
+}
+
+func runImageConvertV1(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("missing output filename (-o)")
+	}
+
+	v1, err := image.ReadImageV1(args[0])
+	if err != nil {
+		return err
+	}
+
+	opts := image.V1ConvertOpts{}
+	opts.Keys, err = sec.ReadPubSignKeys(flagStrings(fs, "v1-key"))
+	if err != nil {
+		return err
+	}
+	opts.Signers, err = sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(opts.Signers)
+
+	img, err := image.ConvertV1(v1, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := img.WriteToFile(out); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Converted %s to %s\n", args[0], out)
+	return nil
+}
+
+func imageFlashScriptFlags(fs *flag.FlagSet) {
+	fs.String("manifest", "", "Image manifest containing the flash map")
+	addScriptFlags(fs)
+}
+
+func runImageFlashScript(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "an image filename"); err != nil {
+		return err
+	}
+
+	manPath := flagString(fs, "manifest")
+	if manPath == "" {
+		return errors.Errorf("missing manifest filename (--manifest)")
+	}
+
+	man, err := manifest.ReadManifest(manPath)
+	if err != nil {
+		return err
+	}
+	if man.FlashMap == nil {
+		return errors.Errorf("manifest lacks a flash map: %s", manPath)
+	}
+
+	opts, err := scriptOpts(fs)
+	if err != nil {
+		return err
+	}
+
+	bin, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "failed to read image")
+	}
+
+	fm := man.FlashMap.FlashMap()
+	file, err := fm.AreaScriptFile(man.FlashMap.Slot, args[0], len(bin))
+	if err != nil {
+		return err
+	}
+
+	script, err := fm.Script([]flash.ScriptFile{file}, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s", script)
+	return nil
+}
+
+// keyHashScheme parses the -key-hash flag.
+func keyHashScheme(fs *flag.FlagSet) (sec.KeyHashScheme, error) {
+	s := flagString(fs, "key-hash")
+	if s == "" {
+		return sec.KeyHashScheme{}, nil
+	}
+
+	return sec.ParseKeyHashScheme(s)
+}
+
+func parseFlashAddr(s string) (uint32, error) {
+	addr, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid flash address: %s", s)
+	}
+
+	return uint32(addr), nil
+}
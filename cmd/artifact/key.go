@@ -0,0 +1,135 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+var keyGroup = &group{
+	desc: "Signing and encryption keys",
+	cmds: map[string]*command{
+		"show": {
+			usage: "<key-file>...",
+			desc:  "Print the type and hash of signing keys",
+			run:   runKeyShow,
+		},
+		"fingerprint": {
+			usage: "<key-file>...",
+			desc:  "Print the fingerprint of encryption keys",
+			run:   runKeyFingerprint,
+		},
+	},
+}
+
+// readAnySignKey reads a public signing key from a file containing either a
+// private or a public key.
+func readAnySignKey(filename string) (sec.PubSignKey, bool, error) {
+	priv, err := sec.ReadPrivSignKey(filename)
+	if err == nil {
+		return priv.PubKey(), true, nil
+	}
+
+	pub, err := sec.ReadPubSignKey(filename)
+	if err == nil {
+		return pub, false, nil
+	}
+
+	return sec.PubSignKey{}, false, errors.Errorf(
+		"\"%s\" does not contain a signing key", filename)
+}
+
+func runKeyShow(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.Errorf("expected at least one key filename")
+	}
+
+	for _, filename := range args {
+		pub, private, err := readAnySignKey(filename)
+		if err != nil {
+			return err
+		}
+
+		typ, err := pub.SigType()
+		if err != nil {
+			return err
+		}
+
+		hash, err := pub.Hash()
+		if err != nil {
+			return err
+		}
+
+		kind := "public"
+		if private {
+			kind = "private"
+		}
+
+		fmt.Fprintf(w, "%s: %s %s key, hash=%s\n", filename,
+			sec.SigTypeString(typ), kind, hex.EncodeToString(hash))
+	}
+
+	return nil
+}
+
+// readAnyEncKey reads a public encryption key from a file containing either
+// a private or a public key.
+func readAnyEncKey(filename string) (sec.PubEncKey, error) {
+	priv, err := sec.ReadPrivEncKey(filename)
+	if err == nil {
+		return priv.PubEncKey(), nil
+	}
+
+	pub, err := sec.ReadPubEncKey(filename)
+	if err == nil {
+		return pub, nil
+	}
+
+	return sec.PubEncKey{}, errors.Errorf(
+		"\"%s\" does not contain an encryption key", filename)
+}
+
+func runKeyFingerprint(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.Errorf("expected at least one key filename")
+	}
+
+	for _, filename := range args {
+		key, err := readAnyEncKey(filename)
+		if err != nil {
+			return err
+		}
+
+		fp, err := key.Fingerprint()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "%s: %s\n", filename, hex.EncodeToString(fp))
+	}
+
+	return nil
+}
@@ -0,0 +1,333 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Command artifact is the reference command-line interface to the
+// mynewt-artifact library.  It inspects, creates, signs, verifies, and
+// decrypts the artifact formats defined by this repository.
+//
+// Usage:
+//
+//	artifact image show|create|xip-pair|sign|threshold-init|threshold-sign|threshold-finalize|verify|decrypt|serial-info|rollback-plan|flash-script [flags] <args>
+//	artifact mfg show|verify|layout|rebuild|flash-script [flags] <args>
+//	artifact manifest schema|validate|sign-cose|verify-cose [flags] <args>
+//	artifact key show|fingerprint [flags] <key-file>...
+//
+// Commands are dispatched with cobra.  Each command's flags are defined on a
+// standard library flag.FlagSet and parsed by cobra, so long flags take two
+// dashes (e.g., --key) and single-letter flags one (e.g., -o).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/spf13/cobra"
+)
+
+// command is a single leaf subcommand (e.g., "image show").
+type command struct {
+	usage string
+	desc  string
+	run   func(fs *flag.FlagSet, args []string, w io.Writer) error
+
+	// Registers the command's flags.
+	flags func(fs *flag.FlagSet)
+}
+
+// group is a set of related commands (e.g., "image").
+type group struct {
+	desc string
+	cmds map[string]*command
+}
+
+var groups = map[string]*group{
+	"image":    imageGroup,
+	"mfg":      mfgGroup,
+	"manifest": manifestGroup,
+	"key":      keyGroup,
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func (l *stringList) Get() interface{} {
+	return []string(*l)
+}
+
+func flagValue(fs *flag.FlagSet, name string) interface{} {
+	return fs.Lookup(name).Value.(flag.Getter).Get()
+}
+
+func flagString(fs *flag.FlagSet, name string) string {
+	return flagValue(fs, name).(string)
+}
+
+func flagStrings(fs *flag.FlagSet, name string) []string {
+	return flagValue(fs, name).([]string)
+}
+
+func flagInt(fs *flag.FlagSet, name string) int {
+	return flagValue(fs, name).(int)
+}
+
+func flagBool(fs *flag.FlagSet, name string) bool {
+	return flagValue(fs, name).(bool)
+}
+
+func addKeyFlag(fs *flag.FlagSet, usage string) {
+	fs.Var(&stringList{}, "key", usage+" (may be repeated)")
+}
+
+// addAuditFlags adds the flags that configure signing audit events.
+func addAuditFlags(fs *flag.FlagSet) {
+	fs.String("audit-log", "", "Append a JSON audit event per signature "+
+		"to this file")
+	fs.String("audit-url", "", "POST a JSON audit event per signature "+
+		"to this URL")
+	fs.String("audit-syslog", "", "Send an audit event per signature to "+
+		"the local syslog with this tag")
+	fs.Var(&stringList{}, "audit-meta",
+		"key=value metadata for audit events (may be repeated)")
+}
+
+// auditSigners wraps the signers according to the audit flags.  The
+// returned function releases the audit sinks.
+func auditSigners(fs *flag.FlagSet,
+	signers []sec.Signer) ([]sec.Signer, func(), error) {
+
+	var sinks []sec.AuditSink
+	var closers []func() error
+	closeAll := func() {
+		for _, c := range closers {
+			c()
+		}
+	}
+
+	if filename := flagString(fs, "audit-log"); filename != "" {
+		s, err := sec.OpenFileAuditSink(filename)
+		if err != nil {
+			return nil, closeAll, err
+		}
+		sinks = append(sinks, s)
+		closers = append(closers, s.Close)
+	}
+	if url := flagString(fs, "audit-url"); url != "" {
+		sinks = append(sinks, &sec.HttpAuditSink{Url: url})
+	}
+	if tag := flagString(fs, "audit-syslog"); tag != "" {
+		s, err := sec.NewSyslogAuditSink("", "", tag)
+		if err != nil {
+			closeAll()
+			return nil, closeAll, err
+		}
+		sinks = append(sinks, s)
+		closers = append(closers, s.Close)
+	}
+
+	if len(sinks) == 0 {
+		return signers, closeAll, nil
+	}
+
+	meta := map[string]string{}
+	for _, kv := range flagStrings(fs, "audit-meta") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			closeAll()
+			return nil, closeAll, errors.Errorf(
+				"invalid audit metadata (want key=value): %s", kv)
+		}
+		meta[parts[0]] = parts[1]
+	}
+
+	sink := sec.AuditFunc(func(ev sec.AuditEvent) error {
+		for _, s := range sinks {
+			if err := s.Record(ev); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return sec.AuditSigners(signers, sink, meta), closeAll, nil
+}
+
+// addScriptFlags adds the flags that configure flash programming scripts.
+func addScriptFlags(fs *flag.FlagSet) {
+	fs.String("format", "jlink", "Script format (jlink or pyocd)")
+	fs.String("target", "", "J-Link device name or pyOCD target type")
+	fs.Int("speed", 0, "Debug interface clock in kHz")
+	fs.Var(&stringList{}, "base", "<device>=<addr>: CPU address of a "+
+		"flash device's offset 0 (may be repeated)")
+	fs.Bool("erase", false, "Erase the whole chip before programming")
+	fs.Bool("reset", false, "Reset and run the target after programming")
+}
+
+// scriptOpts builds flash script options from the script flags.
+func scriptOpts(fs *flag.FlagSet) (flash.ScriptOpts, error) {
+	format, err := flash.ScriptFormatFromString(flagString(fs, "format"))
+	if err != nil {
+		return flash.ScriptOpts{}, err
+	}
+
+	bases := map[int]uint32{}
+	for _, kv := range flagStrings(fs, "base") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return flash.ScriptOpts{}, errors.Errorf(
+				"invalid device base (want <device>=<addr>): %s", kv)
+		}
+		dev, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return flash.ScriptOpts{}, errors.Errorf(
+				"invalid flash device: %s", parts[0])
+		}
+		addr, err := parseFlashAddr(parts[1])
+		if err != nil {
+			return flash.ScriptOpts{}, err
+		}
+		bases[dev] = addr
+	}
+
+	return flash.ScriptOpts{
+		Format:      format,
+		Target:      flagString(fs, "target"),
+		SpeedKhz:    flagInt(fs, "speed"),
+		DeviceBases: bases,
+		Erase:       flagBool(fs, "erase"),
+		Reset:       flagBool(fs, "reset"),
+	}, nil
+}
+
+// checkArgs ensures that exactly n positional arguments were specified.
+func checkArgs(args []string, n int, what string) error {
+	if len(args) != n {
+		return errors.Errorf("expected %s; got %d argument(s)",
+			what, len(args))
+	}
+	return nil
+}
+
+func sortedNames(m map[string]*command) []string {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unknownCommand rejects a group invocation that does not name one of the
+// group's commands.
+func unknownCommand(what string) func(*cobra.Command, []string) error {
+	return func(cmd *cobra.Command, args []string) error {
+		cmd.Usage()
+		if len(args) == 0 {
+			return errors.Errorf("missing %s", what)
+		}
+		return errors.Errorf("unknown %s: \"%s\"", what, args[0])
+	}
+}
+
+// newCommand creates the cobra command for a leaf subcommand.  The
+// command's flags are registered on a flag.FlagSet, which cobra parses.
+func newCommand(gname string, name string, c *command,
+	w io.Writer) *cobra.Command {
+
+	fs := flag.NewFlagSet(gname+" "+name, flag.ContinueOnError)
+	if c.flags != nil {
+		c.flags(fs)
+	}
+
+	cc := &cobra.Command{
+		Use:   strings.TrimSpace(name + " " + c.usage),
+		Short: c.desc,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return c.run(fs, args, w)
+		},
+	}
+	cc.Flags().AddGoFlagSet(fs)
+
+	return cc
+}
+
+// newRootCommand creates the "artifact" command and its command groups.
+func newRootCommand(w io.Writer) *cobra.Command {
+	root := &cobra.Command{
+		Use:           "artifact <group> <command> [flags] <args>",
+		Short:         "Inspect, create, sign, and verify Mynewt artifacts",
+		RunE:          unknownCommand("command group"),
+		SilenceErrors: true,
+		SilenceUsage:  true,
+	}
+	root.SetOut(w)
+	root.SetErr(w)
+
+	var gnames []string
+	for name := range groups {
+		gnames = append(gnames, name)
+	}
+	sort.Strings(gnames)
+
+	for _, gname := range gnames {
+		g := groups[gname]
+		gc := &cobra.Command{
+			Use:   gname + " <command>",
+			Short: g.desc,
+			RunE:  unknownCommand(gname + " command"),
+		}
+		for _, cname := range sortedNames(g.cmds) {
+			gc.AddCommand(newCommand(gname, cname, g.cmds[cname], w))
+		}
+		root.AddCommand(gc)
+	}
+
+	return root
+}
+
+// run executes the command line (excluding the program name), writing
+// regular output to w.
+func run(args []string, w io.Writer) error {
+	root := newRootCommand(w)
+	root.SetArgs(args)
+	return root.Execute()
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,138 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+)
+
+const testdataDir = "../../image/testdata"
+
+func runOk(t *testing.T, args ...string) string {
+	buf := &bytes.Buffer{}
+	if err := run(args, buf); err != nil {
+		t.Fatalf("artifact %s: %v\n%s", strings.Join(args, " "), err,
+			buf.String())
+	}
+	return buf.String()
+}
+
+func TestImageCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "app.bin")
+	if err := ioutil.WriteFile(bin, make([]byte, 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img := filepath.Join(dir, "app.img")
+	signKey := filepath.Join(testdataDir, "sign-key.pem")
+	pubKey := filepath.Join(testdataDir, "sign-key-pub.pem")
+
+	runOk(t, "image", "create", "--bin", bin, "-o", img, "--version", "1.2.3.4")
+
+	out := runOk(t, "image", "show", img)
+	if !strings.Contains(out, "\"tlvs\"") {
+		t.Fatalf("unexpected image show output:\n%s", out)
+	}
+
+	runOk(t, "image", "analyze", img)
+
+	out = runOk(t, "image", "tlvs", img)
+	if !strings.Contains(out, "SHA256: ") {
+		t.Fatalf("unexpected image tlvs output:\n%s", out)
+	}
+
+	// Unsigned image fails verification with a key.
+	if err := run([]string{"image", "verify", "--key", pubKey, img},
+		&bytes.Buffer{}); err == nil {
+
+		t.Fatalf("unsigned image verified")
+	}
+
+	runOk(t, "image", "sign", "--key", signKey, img)
+	out = runOk(t, "image", "verify", "--key", pubKey, img)
+	if !strings.Contains(out, "signatures") {
+		t.Fatalf("unexpected image verify output:\n%s", out)
+	}
+
+	out = runOk(t, "key", "show", signKey, pubKey)
+	if strings.Count(out, "hash=") != 2 {
+		t.Fatalf("unexpected key show output:\n%s", out)
+	}
+
+	if err := run([]string{"image", "bogus"}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("unknown command accepted")
+	}
+}
+
+func TestDecryptCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifact-cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(testdataDir, "good-signed-encrypted.img")
+	out := filepath.Join(dir, "dec.img")
+	runOk(t, "image", "decrypt",
+		"--key", filepath.Join(testdataDir, "enc-key.der"), "-o", out, src)
+
+	enc, err := image.ReadImage(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := image.ReadImage(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encrypted flag remains set, so check the body directly.
+	if len(dec.Body) != len(enc.Body) || bytes.Equal(dec.Body, enc.Body) {
+		t.Fatalf("image body not decrypted")
+	}
+	if len(dec.FindTlvsIf(func(tlv image.ImageTlv) bool {
+		return image.ImageTlvTypeIsSecret(tlv.Header.Type)
+	})) != 0 {
+		t.Fatalf("decrypted image retains secret TLV")
+	}
+}
+
+func TestMfgCommands(t *testing.T) {
+	base := "../../mfg/testdata/hash1-fm1-ext1-tgts1-sign1"
+
+	out := runOk(t, "mfg", "show", "--manifest", base+".json", base+".bin")
+	if !strings.Contains(out, "hash:") {
+		t.Fatalf("unexpected mfg show output:\n%s", out)
+	}
+
+	runOk(t, "mfg", "verify", "--manifest", base+".json", base+".bin")
+}
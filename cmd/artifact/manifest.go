@@ -0,0 +1,205 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+var manifestGroup = &group{
+	desc: "Image manifests",
+	cmds: map[string]*command{
+		"schema": {
+			usage: "",
+			desc:  "Print the manifest JSON Schema",
+			run:   runManifestSchema,
+		},
+		"validate": {
+			usage: "<manifest>...",
+			desc:  "Check manifests against the manifest schema",
+			run:   runManifestValidate,
+		},
+		"sign-cose": {
+			usage: "--key <key> -o <out> <manifest>",
+			desc:  "Sign a manifest as a COSE_Sign1 message",
+			flags: manifestSignCoseFlags,
+			run:   runManifestSignCose,
+		},
+		"verify-cose": {
+			usage: "--key <key> [-o <manifest>] <cose>",
+			desc:  "Verify a COSE_Sign1 manifest and extract it",
+			flags: manifestVerifyCoseFlags,
+			run:   runManifestVerifyCose,
+		},
+	},
+}
+
+func runManifestSchema(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 0, "no arguments"); err != nil {
+		return err
+	}
+
+	schema, err := manifest.ManifestSchema()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\n", schema)
+	return nil
+}
+
+func runManifestValidate(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if len(args) == 0 {
+		return errors.Errorf("expected at least one manifest filename")
+	}
+
+	failed := 0
+	for _, filename := range args {
+		_, err := manifest.ReadManifestOpts(filename,
+			manifest.ParseOpts{Strict: true})
+		if err == nil {
+			fmt.Fprintf(w, "%s: ok\n", filename)
+			continue
+		}
+
+		failed++
+		serr, ok := errors.Cause(err).(*manifest.SchemaError)
+		if !ok {
+			fmt.Fprintf(w, "%s: %s\n", filename, err.Error())
+			continue
+		}
+		for _, v := range serr.Violations {
+			fmt.Fprintf(w, "%s: %s\n", filename, v.String())
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d manifests are invalid",
+			failed, len(args))
+	}
+
+	return nil
+}
+
+func manifestSignCoseFlags(fs *flag.FlagSet) {
+	fs.Var(&stringList{}, "key",
+		"Private signing key file, PKCS#11 URI, or ssh-agent:[key]")
+	fs.String("o", "", "Output COSE_Sign1 file")
+	addAuditFlags(fs)
+}
+
+func runManifestSignCose(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "a manifest filename"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("no output file specified (-o)")
+	}
+
+	signers, err := sec.ReadSigners(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	defer sec.CloseSigners(signers)
+	if len(signers) != 1 {
+		return errors.Errorf("COSE_Sign1 requires exactly one signing key " +
+			"(--key)")
+	}
+	signers, closeAudit, err := auditSigners(fs, signers)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+
+	m, err := manifest.ReadManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	b, err := m.SignCose(signers[0])
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write COSE_Sign1 file")
+	}
+
+	fmt.Fprintf(w, "Wrote %s (%d bytes)\n", out, len(b))
+	return nil
+}
+
+func manifestVerifyCoseFlags(fs *flag.FlagSet) {
+	addKeyFlag(fs, "Public signing key file")
+	fs.String("o", "", "Write the verified manifest to this file")
+}
+
+func runManifestVerifyCose(fs *flag.FlagSet, args []string,
+	w io.Writer) error {
+
+	if err := checkArgs(args, 1, "a COSE_Sign1 filename"); err != nil {
+		return err
+	}
+
+	keys, err := sec.ReadPubSignKeys(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.Errorf("no verification keys specified (--key)")
+	}
+
+	b, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return errors.Wrapf(err, "failed to read COSE_Sign1 file")
+	}
+
+	m, idx, err := manifest.ParseCoseManifest(b, keys, manifest.ParseOpts{})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "signature verified with key %d\n", idx)
+
+	if out := flagString(fs, "o"); out != "" {
+		buf := &bytes.Buffer{}
+		if _, err := m.Write(buf); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(out, buf.Bytes(), 0644); err != nil {
+			return errors.Wrapf(err, "failed to write manifest")
+		}
+	}
+
+	fmt.Fprintf(w, "%s: ok\n", args[0])
+	return nil
+}
@@ -0,0 +1,310 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/mfg"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+var mfgGroup = &group{
+	desc: "Manufacturing images",
+	cmds: map[string]*command{
+		"show": {
+			usage: "--manifest <manifest> <mfgimage>",
+			desc:  "Print an mfgimage's MMR and targets",
+			flags: mfgFlags,
+			run:   runMfgShow,
+		},
+		"verify": {
+			usage: "--manifest <manifest> [--key <key>] <mfgimage>",
+			desc:  "Verify an mfgimage against its manifest",
+			flags: mfgVerifyFlags,
+			run:   runMfgVerify,
+		},
+		"layout": {
+			usage: "--manifest <manifest> <mfgimage>",
+			desc:  "Print flash area utilization and gaps as JSON",
+			flags: mfgFlags,
+			run:   runMfgLayout,
+		},
+		"rebuild": {
+			usage: "-o <mfgimage> [--content-dir <dir>] <manifest>",
+			desc:  "Re-assemble an mfgimage from its manifest",
+			flags: mfgRebuildFlags,
+			run:   runMfgRebuild,
+		},
+		"flash-script": {
+			usage: "--manifest <manifest> [--format jlink|pyocd] [flags] " +
+				"<mfgimage>",
+			desc:  "Print a script that programs an mfgimage",
+			flags: mfgFlashScriptFlags,
+			run:   runMfgFlashScript,
+		},
+	},
+}
+
+func mfgFlags(fs *flag.FlagSet) {
+	fs.String("manifest", "", "Mfg manifest file")
+}
+
+func mfgVerifyFlags(fs *flag.FlagSet) {
+	mfgFlags(fs)
+	addKeyFlag(fs, "Public signing key file")
+}
+
+// readMfg reads an mfgimage and its manifest.
+func readMfg(fs *flag.FlagSet, args []string) (mfg.Mfg,
+	manifest.MfgManifest, error) {
+
+	if err := checkArgs(args, 1, "an mfgimage filename"); err != nil {
+		return mfg.Mfg{}, manifest.MfgManifest{}, err
+	}
+
+	manPath := flagString(fs, "manifest")
+	if manPath == "" {
+		return mfg.Mfg{}, manifest.MfgManifest{},
+			errors.Errorf("missing manifest filename (--manifest)")
+	}
+
+	man, err := manifest.ReadMfgManifest(manPath)
+	if err != nil {
+		return mfg.Mfg{}, man, err
+	}
+
+	bin, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return mfg.Mfg{}, man, errors.Wrapf(err, "failed to read mfgimage")
+	}
+
+	metaEndOff := -1
+	if man.Meta != nil {
+		metaEndOff = man.Meta.EndOffset
+	}
+
+	m, err := mfg.Parse(bin, metaEndOff, man.EraseVal)
+	if err != nil {
+		return m, man, err
+	}
+
+	return m, man, nil
+}
+
+func runMfgShow(fs *flag.FlagSet, args []string, w io.Writer) error {
+	m, man, err := readMfg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "name:   %s\n", man.Name)
+	fmt.Fprintf(w, "size:   %d\n", len(m.Bin))
+
+	hash, err := m.Hash(man.EraseVal)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "hash:   %s\n", hex.EncodeToString(hash))
+
+	for _, t := range man.Targets {
+		fmt.Fprintf(w, "target: %s offset=0x%x size=%d\n",
+			t.Name, t.Offset, t.Size)
+	}
+
+	if m.Meta != nil {
+		j, err := m.Meta.Json(m.MetaOff)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "mmr:\n%s\n", j)
+	}
+
+	return nil
+}
+
+func runMfgVerify(fs *flag.FlagSet, args []string, w io.Writer) error {
+	m, man, err := readMfg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := m.VerifyStructure(man.EraseVal); err != nil {
+		return err
+	}
+	if err := m.VerifyManifest(man); err != nil {
+		return err
+	}
+
+	if m.Meta != nil {
+		r := m.VerifyMeta(man.FlashAreas, man.Device, man.EraseVal)
+		for _, rule := range r.Rules {
+			status := "ok"
+			if !rule.Passed {
+				status = "FAIL"
+			}
+			fmt.Fprintf(w, "%-12s %-4s %s\n", rule.Name, status, rule.Detail)
+		}
+		if err := r.Err(); err != nil {
+			return err
+		}
+	}
+
+	keys, err := sec.ReadPubSignKeys(flagStrings(fs, "key"))
+	if err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		idx, err := mfg.VerifySigs(man, keys)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "signature verified with key %d\n", idx)
+	}
+
+	fmt.Fprintf(w, "%s: ok\n", args[0])
+	return nil
+}
+
+func mfgRebuildFlags(fs *flag.FlagSet) {
+	fs.String("o", "", "Output mfgimage file")
+	fs.String("content-dir", "", "Directory containing the files that "+
+		"the manifest's content references refer to")
+}
+
+func runMfgRebuild(fs *flag.FlagSet, args []string, w io.Writer) error {
+	if err := checkArgs(args, 1, "a manifest filename"); err != nil {
+		return err
+	}
+
+	out := flagString(fs, "o")
+	if out == "" {
+		return errors.Errorf("missing output filename (-o)")
+	}
+
+	man, err := manifest.ReadMfgManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	var r manifest.ContentResolver
+	if dir := flagString(fs, "content-dir"); dir != "" {
+		r = manifest.NewDirResolver(dir)
+	}
+
+	m, err := mfg.Rebuild(man, filepath.Dir(args[0]), r)
+	if err != nil {
+		return err
+	}
+
+	b, err := m.Bytes(man.EraseVal)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write mfgimage")
+	}
+
+	fmt.Fprintf(w, "Rebuilt %s (%d bytes)\n", out, len(b))
+	return nil
+}
+
+func runMfgLayout(fs *flag.FlagSet, args []string, w io.Writer) error {
+	m, man, err := readMfg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	l, err := mfg.LayoutReport(m, flash.FlashMap{Areas: man.FlashAreas},
+		man.Device, man.EraseVal)
+	if err != nil {
+		return err
+	}
+
+	j, err := l.Json()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s\n", j)
+	return nil
+}
+
+func mfgFlashScriptFlags(fs *flag.FlagSet) {
+	mfgFlags(fs)
+	addScriptFlags(fs)
+}
+
+func runMfgFlashScript(fs *flag.FlagSet, args []string, w io.Writer) error {
+	m, man, err := readMfg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// The script programs the mfgimage as a whole, so it cannot honor
+	// areas that are to be erased, filled, or left untouched.
+	policies, err := mfg.AreaPolicies(man)
+	if err != nil {
+		return err
+	}
+	for name, policy := range policies {
+		if policy != mfg.AREA_POLICY_WRITE {
+			return errors.Errorf(
+				"mfgimage flash area \"%s\" has policy \"%s\"; "+
+					"program the emitted segments instead",
+				name, mfg.AreaPolicyString(policy))
+		}
+	}
+
+	fills, err := mfg.AreaFills(man)
+	if err != nil {
+		return err
+	}
+	if len(fills) > 0 {
+		return errors.Errorf("mfgimage specifies area fill patterns; " +
+			"program the emitted segments instead")
+	}
+
+	opts, err := scriptOpts(fs)
+	if err != nil {
+		return err
+	}
+
+	fm := flash.FlashMap{Areas: man.FlashAreas}
+	script, err := fm.Script([]flash.ScriptFile{{
+		Filename: args[0],
+		Device:   man.Device,
+		Size:     len(m.Bin),
+	}}, opts)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%s", script)
+	return nil
+}
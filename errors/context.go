@@ -0,0 +1,211 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package errors
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	pkgerrors "github.com/pkg/errors"
+)
+
+// Context describes where in an artifact an error occurred.  Unknown numeric
+// fields are -1.
+type Context struct {
+	Kind     string // Artifact kind (e.g., "image", "mfgimage").
+	File     string // Name of the artifact file.
+	Offset   int    // Byte offset within the artifact.
+	TlvIndex int    // Index of the TLV within its region.
+	TlvType  int    // TLV type.
+	TlvName  string // TLV type name.
+}
+
+type contextError struct {
+	ctx   Context
+	cause error
+}
+
+func newContext() Context {
+	return Context{
+		Offset:   -1,
+		TlvIndex: -1,
+		TlvType:  -1,
+	}
+}
+
+// String renders the context in the form
+// "image.bin@0x1f40 [TLV #2 0x23 RSA3072]".
+func (c Context) String() string {
+	var parts []string
+
+	loc := c.File
+	if loc == "" {
+		loc = c.Kind
+	}
+	if c.Offset >= 0 {
+		loc += fmt.Sprintf("@0x%x", c.Offset)
+	}
+	if loc != "" {
+		parts = append(parts, loc)
+	}
+
+	if c.TlvType >= 0 || c.TlvIndex >= 0 {
+		tlv := "TLV"
+		if c.TlvIndex >= 0 {
+			tlv += fmt.Sprintf(" #%d", c.TlvIndex)
+		}
+		if c.TlvType >= 0 {
+			tlv += fmt.Sprintf(" 0x%02x", c.TlvType)
+		}
+		if c.TlvName != "" {
+			tlv += " " + c.TlvName
+		}
+		parts = append(parts, "["+tlv+"]")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// merge fills the unset fields of c with those of other.
+func (c Context) merge(other Context) Context {
+	if c.Kind == "" {
+		c.Kind = other.Kind
+	}
+	if c.File == "" {
+		c.File = other.File
+	}
+	if c.Offset < 0 {
+		c.Offset = other.Offset
+	}
+	if c.TlvIndex < 0 {
+		c.TlvIndex = other.TlvIndex
+	}
+	if c.TlvType < 0 {
+		c.TlvType = other.TlvType
+	}
+	if c.TlvName == "" {
+		c.TlvName = other.TlvName
+	}
+
+	return c
+}
+
+func (e *contextError) Error() string {
+	s := e.ctx.String()
+	if s == "" {
+		return e.cause.Error()
+	}
+
+	return s + ": " + e.cause.Error()
+}
+
+func (e *contextError) Cause() error {
+	return e.cause
+}
+
+func (e *contextError) StackTrace() pkgerrors.StackTrace {
+	return e.cause.(stackTracer).StackTrace()
+}
+
+func (e *contextError) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		if s.Flag('+') {
+			if c := e.ctx.String(); c != "" {
+				io.WriteString(s, c+": ")
+			}
+			fmt.Fprintf(s, "%+v", e.cause)
+			return
+		}
+		fallthrough
+	case 's':
+		io.WriteString(s, e.Error())
+	case 'q':
+		fmt.Fprintf(s, "%q", e.Error())
+	}
+}
+
+// withContext attaches ctx to err.  If err already carries a context, the
+// existing (more specific) values take precedence.
+func withContext(err error, ctx Context) error {
+	if err == nil {
+		return nil
+	}
+
+	if ce, ok := err.(*contextError); ok {
+		return &contextError{
+			ctx:   ce.ctx.merge(ctx),
+			cause: ce.cause,
+		}
+	}
+
+	return &contextError{
+		ctx:   ctx,
+		cause: WithStack(err),
+	}
+}
+
+// WithArtifact annotates err with the kind and file name of the artifact
+// being processed.  Either may be empty.
+func WithArtifact(err error, kind string, file string) error {
+	ctx := newContext()
+	ctx.Kind = kind
+	ctx.File = file
+
+	return withContext(err, ctx)
+}
+
+// WithOffset annotates err with the artifact byte offset at which it
+// occurred.
+func WithOffset(err error, offset int) error {
+	ctx := newContext()
+	ctx.Offset = offset
+
+	return withContext(err, ctx)
+}
+
+// WithTlv annotates err with the TLV being processed.  A negative index
+// indicates that the index is unknown.
+func WithTlv(err error, index int, tlvType uint8, name string) error {
+	ctx := newContext()
+	ctx.TlvIndex = index
+	ctx.TlvType = int(tlvType)
+	ctx.TlvName = name
+
+	return withContext(err, ctx)
+}
+
+// GetContext retrieves the artifact context attached to err, if any.
+func GetContext(err error) (Context, bool) {
+	for err != nil {
+		if ce, ok := err.(*contextError); ok {
+			return ce.ctx, true
+		}
+
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = c.Cause()
+	}
+
+	return Context{}, false
+}
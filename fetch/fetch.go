@@ -0,0 +1,251 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package fetch downloads image and mfgimage artifacts over HTTP(S) and
+// verifies them before handing them to the caller.
+//
+// A download is rejected if it exceeds a size limit, if its hash differs from
+// a pinned value, or if it is not signed by one of a set of trusted keys.
+// The file hash and size limit are enforced as the response body streams in,
+// so an oversized or tampered download is abandoned without being buffered
+// in full.
+package fetch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/mfg"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const FETCH_TIMEOUT = 60 * time.Second
+const FETCH_DEFAULT_MAX_SIZE = 16 * 1024 * 1024
+
+// Opts specifies how a download is verified.  Zero values disable the
+// corresponding check.
+type Opts struct {
+	// Client used to issue the request; nil for a client with FETCH_TIMEOUT.
+	Client *http.Client
+
+	// Largest acceptable download; 0 for FETCH_DEFAULT_MAX_SIZE.
+	MaxSize int64
+
+	// Expected SHA256 of the file as served.
+	FileHash []byte
+
+	// Expected artifact hash (image hash or mfg hash), e.g., from a
+	// repository index.
+	Hash []byte
+
+	// If non-empty, the artifact must carry a signature from one of these
+	// keys.
+	Keys []sec.PubSignKey
+
+	// Keys used to verify the hash of an encrypted image.
+	EncKeys []sec.PrivEncKey
+}
+
+func (opts *Opts) maxSize() int64 {
+	if opts.MaxSize == 0 {
+		return FETCH_DEFAULT_MAX_SIZE
+	}
+
+	return opts.MaxSize
+}
+
+// Download retrieves the file at the given URL, enforcing the size limit and
+// file hash specified in opts.
+func Download(url string, opts Opts) ([]byte, error) {
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: FETCH_TIMEOUT}
+	}
+
+	rsp, err := client.Get(url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", url)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch %s: %s", url, rsp.Status)
+	}
+
+	maxSize := opts.maxSize()
+	if rsp.ContentLength > maxSize {
+		return nil, errors.Errorf(
+			"artifact too large: have=%d max=%d", rsp.ContentLength, maxSize)
+	}
+
+	h := sha256.New()
+	var b bytes.Buffer
+
+	// Read one byte past the limit to detect an oversized body.
+	r := io.TeeReader(io.LimitReader(rsp.Body, maxSize+1), h)
+	if _, err := b.ReadFrom(r); err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", url)
+	}
+	if int64(b.Len()) > maxSize {
+		return nil, errors.Errorf(
+			"artifact too large: have>%d max=%d", maxSize, maxSize)
+	}
+
+	if opts.FileHash != nil {
+		sum := h.Sum(nil)
+		if !bytes.Equal(sum, opts.FileHash) {
+			return nil, errors.Errorf(
+				"file hash mismatch: have=%s want=%s",
+				hex.EncodeToString(sum), hex.EncodeToString(opts.FileHash))
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+func checkHash(hash []byte, want []byte) error {
+	if want != nil && !bytes.Equal(hash, want) {
+		return errors.Errorf(
+			"artifact hash mismatch: have=%s want=%s",
+			hex.EncodeToString(hash), hex.EncodeToString(want))
+	}
+
+	return nil
+}
+
+// checkSigs verifies that at least one of the given signatures over hash
+// was produced by one of the given keys.
+func checkSigs(keys []sec.PubSignKey, sigs []sec.Sig, hash []byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if len(sigs) == 0 {
+		return errors.Errorf("artifact is not signed")
+	}
+
+	for _, key := range keys {
+		idx, err := sec.VerifySigs(key, sigs, hash)
+		if err != nil {
+			return err
+		}
+		if idx != -1 {
+			return nil
+		}
+	}
+
+	return errors.Errorf("artifact not signed by a trusted key")
+}
+
+// FetchImage downloads and parses the image at the given URL.  The image's
+// structure and hash are always verified; opts specifies additional checks.
+func FetchImage(url string, opts Opts) (image.Image, error) {
+	data, err := Download(url, opts)
+	if err != nil {
+		return image.Image{}, err
+	}
+
+	img, err := image.ParseImage(data)
+	if err != nil {
+		return img, err
+	}
+
+	if err := img.VerifyStructure(); err != nil {
+		return img, err
+	}
+	if _, err := img.VerifyHash(opts.EncKeys); err != nil {
+		return img, err
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return img, err
+	}
+	if err := checkHash(hash, opts.Hash); err != nil {
+		return img, err
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return img, err
+	}
+	sigHash, err := img.SigHash()
+	if err != nil {
+		return img, err
+	}
+	if err := checkSigs(opts.Keys, sigs, sigHash); err != nil {
+		return img, err
+	}
+
+	return img, nil
+}
+
+// FetchMfg downloads and parses the mfgimage at the given URL.  The mfgimage
+// must match its manifest, which also supplies the signatures checked
+// against opts.Keys.
+func FetchMfg(url string, man manifest.MfgManifest,
+	opts Opts) (mfg.Mfg, error) {
+
+	data, err := Download(url, opts)
+	if err != nil {
+		return mfg.Mfg{}, err
+	}
+
+	metaEndOff := -1
+	if man.Meta != nil {
+		metaEndOff = man.Meta.EndOffset
+	}
+
+	m, err := mfg.Parse(data, metaEndOff, man.EraseVal)
+	if err != nil {
+		return m, err
+	}
+
+	if err := m.VerifyStructure(man.EraseVal); err != nil {
+		return m, err
+	}
+	if err := m.VerifyManifest(man); err != nil {
+		return m, err
+	}
+
+	hash, err := m.Hash(man.EraseVal)
+	if err != nil {
+		return m, err
+	}
+	if err := checkHash(hash, opts.Hash); err != nil {
+		return m, err
+	}
+
+	sigs, err := man.SecSigs()
+	if err != nil {
+		return m, err
+	}
+	if err := checkSigs(opts.Keys, sigs, hash); err != nil {
+		return m, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,182 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package fetch
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testdataPath = "../mfg/testdata"
+
+func newKey(t *testing.T) sec.PrivSignKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sec.PrivSignKey{Ed25519: &priv}
+}
+
+func serve(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, ok := files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(b)
+		}))
+}
+
+func TestFetchImage(t *testing.T) {
+	signKey := newKey(t)
+	ic := image.NewImageCreator()
+	ic.Body = make([]byte, 1024)
+	ic.SigKeys = []sec.PrivSignKey{signKey}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileHash := sha256.Sum256(bin)
+
+	bad := append([]byte(nil), bin...)
+	bad[len(bad)/2] ^= 0xff
+
+	srv := serve(map[string][]byte{
+		"/app.img": bin,
+		"/bad.img": bad,
+	})
+	defer srv.Close()
+
+	trusted := []sec.PubSignKey{signKey.PubKey()}
+	opts := Opts{
+		FileHash: fileHash[:],
+		Hash:     hash,
+		Keys:     trusted,
+	}
+
+	have, err := FetchImage(srv.URL+"/app.img", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Header != img.Header {
+		t.Fatalf("wrong image header: have=%+v want=%+v",
+			have.Header, img.Header)
+	}
+
+	// Corrupted body.
+	if _, err := FetchImage(srv.URL+"/bad.img", Opts{}); err == nil {
+		t.Fatalf("corrupt image accepted")
+	}
+
+	// Wrong pins.
+	if _, err := FetchImage(srv.URL+"/app.img",
+		Opts{FileHash: hash}); err == nil {
+
+		t.Fatalf("file hash mismatch accepted")
+	}
+	if _, err := FetchImage(srv.URL+"/app.img",
+		Opts{Hash: fileHash[:]}); err == nil {
+
+		t.Fatalf("artifact hash mismatch accepted")
+	}
+
+	// Untrusted signer.
+	otherKey := newKey(t)
+	if _, err := FetchImage(srv.URL+"/app.img",
+		Opts{Keys: []sec.PubSignKey{otherKey.PubKey()}}); err == nil {
+
+		t.Fatalf("untrusted signature accepted")
+	}
+
+	// Size limit.
+	if _, err := FetchImage(srv.URL+"/app.img",
+		Opts{MaxSize: int64(len(bin) - 1)}); err == nil {
+
+		t.Fatalf("oversized download accepted")
+	}
+	if _, err := FetchImage(srv.URL+"/app.img",
+		Opts{MaxSize: int64(len(bin))}); err != nil {
+
+		t.Fatal(err)
+	}
+
+	// Missing file.
+	if _, err := FetchImage(srv.URL+"/none.img", Opts{}); err == nil {
+		t.Fatalf("missing file accepted")
+	}
+}
+
+func TestFetchMfg(t *testing.T) {
+	const basename = "hash1-fm1-ext1-tgts1-sign1"
+
+	bin, err := ioutil.ReadFile(testdataPath + "/" + basename + ".bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	man, err := manifest.ReadMfgManifest(
+		testdataPath + "/" + basename + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := sec.ReadPrivSignKey(testdataPath + "/sign-key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := serve(map[string][]byte{"/mfgimg.bin": bin})
+	defer srv.Close()
+
+	opts := Opts{Keys: []sec.PubSignKey{key.PubKey()}}
+	if _, err := FetchMfg(srv.URL+"/mfgimg.bin", man, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey := newKey(t)
+	opts.Keys = []sec.PubSignKey{otherKey.PubKey()}
+	if _, err := FetchMfg(srv.URL+"/mfgimg.bin", man, opts); err == nil {
+		t.Fatalf("untrusted signature accepted")
+	}
+
+	man.MfgHash = "00" + man.MfgHash[2:]
+	if _, err := FetchMfg(srv.URL+"/mfgimg.bin", man, Opts{}); err == nil {
+		t.Fatalf("manifest hash mismatch accepted")
+	}
+}
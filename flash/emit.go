@@ -0,0 +1,147 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// FlashMap is the complete set of flash areas for a target, along with the
+// geometry of the devices they reside on.  Devices is optional; it is only
+// needed for sector-level operations.
+type FlashMap struct {
+	Areas   []FlashArea
+	Devices []FlashDevice
+}
+
+// DtsOpts controls devicetree overlay generation.
+type DtsOpts struct {
+	// Maps flash device numbers to devicetree node labels.  Devices without
+	// an entry use "flash<device>".
+	DeviceNodes map[int]string
+}
+
+// Validate ensures that no two areas overlap or share an ID.
+func (fm *FlashMap) Validate() error {
+	overlaps, conflicts := DetectErrors(fm.Areas)
+	if len(overlaps) > 0 || len(conflicts) > 0 {
+		return errors.Errorf("invalid flash map:\n%s",
+			ErrorText(overlaps, conflicts))
+	}
+
+	return nil
+}
+
+// cIdent converts an area name into a C identifier.
+func cIdent(name string) string {
+	var b strings.Builder
+	for i, c := range strings.ToUpper(name) {
+		if (c >= 'A' && c <= 'Z') || c == '_' || (c >= '0' && c <= '9' && i > 0) {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+
+	return b.String()
+}
+
+// dtsLabel converts an area name into a devicetree label; e.g.,
+// "FLASH_AREA_IMAGE_0" becomes "image_0".
+func dtsLabel(name string) string {
+	s := strings.TrimPrefix(strings.ToUpper(name), "FLASH_AREA_")
+	return strings.ToLower(cIdent(s))
+}
+
+// CHeader produces a C header defining the ID, device, offset, and size of
+// each flash area.  guard is the name of the include guard macro.
+func (fm *FlashMap) CHeader(guard string) (string, error) {
+	if err := fm.Validate(); err != nil {
+		return "", err
+	}
+
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "/* Generated by mynewt-artifact; do not edit. */\n\n")
+	fmt.Fprintf(b, "#ifndef %s\n", guard)
+	fmt.Fprintf(b, "#define %s\n\n", guard)
+
+	areas := SortFlashAreasById(fm.Areas)
+	fmt.Fprintf(b, "#define FLASH_AREA_COUNT %d\n", len(areas))
+
+	for _, area := range areas {
+		id := cIdent(area.Name)
+		fmt.Fprintf(b, "\n")
+		fmt.Fprintf(b, "#define %s %d\n", id, area.Id)
+		fmt.Fprintf(b, "#define %s_DEVICE %d\n", id, area.Device)
+		fmt.Fprintf(b, "#define %s_OFFSET 0x%08x\n", id, area.Offset)
+		fmt.Fprintf(b, "#define %s_SIZE 0x%x\n", id, area.Size)
+	}
+
+	fmt.Fprintf(b, "\n#endif\n")
+
+	return b.String(), nil
+}
+
+// DtsOverlay produces a devicetree overlay describing each flash area as a
+// fixed partition of its flash device.
+func (fm *FlashMap) DtsOverlay(opts DtsOpts) (string, error) {
+	if err := fm.Validate(); err != nil {
+		return "", err
+	}
+
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "/* Generated by mynewt-artifact; do not edit. */\n")
+
+	areas := SortFlashAreasByDevOff(fm.Areas)
+	for i, area := range areas {
+		if i == 0 || area.Device != areas[i-1].Device {
+			node := opts.DeviceNodes[area.Device]
+			if node == "" {
+				node = fmt.Sprintf("flash%d", area.Device)
+			}
+
+			fmt.Fprintf(b, "\n&%s {\n", node)
+			fmt.Fprintf(b, "\tpartitions {\n")
+			fmt.Fprintf(b, "\t\tcompatible = \"fixed-partitions\";\n")
+			fmt.Fprintf(b, "\t\t#address-cells = <1>;\n")
+			fmt.Fprintf(b, "\t\t#size-cells = <1>;\n")
+		}
+
+		label := dtsLabel(area.Name)
+		fmt.Fprintf(b, "\n")
+		fmt.Fprintf(b, "\t\t%s_partition: partition@%x {\n", label, area.Offset)
+		fmt.Fprintf(b, "\t\t\tlabel = \"%s\";\n", label)
+		fmt.Fprintf(b, "\t\t\treg = <0x%08x 0x%x>;\n", area.Offset, area.Size)
+		fmt.Fprintf(b, "\t\t};\n")
+
+		if i == len(areas)-1 || area.Device != areas[i+1].Device {
+			fmt.Fprintf(b, "\t};\n")
+			fmt.Fprintf(b, "};\n")
+		}
+	}
+
+	return b.String(), nil
+}
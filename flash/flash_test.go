@@ -0,0 +1,259 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"strings"
+	"testing"
+)
+
+var testAreas = []FlashArea{
+	{Name: FLASH_AREA_NAME_BOOTLOADER, Id: 0, Device: 0, Offset: 0, Size: 0x4000},
+	{Name: FLASH_AREA_NAME_IMAGE_0, Id: 1, Device: 0, Offset: 0x8000, Size: 0x3a000},
+	{Name: FLASH_AREA_NAME_IMAGE_1, Id: 2, Device: 0, Offset: 0x42000, Size: 0x3a000},
+	{Name: "FLASH_AREA_NFFS", Id: 17, Device: 1, Offset: 0, Size: 0x3000},
+}
+
+func TestCHeader(t *testing.T) {
+	fm := FlashMap{Areas: testAreas}
+
+	h, err := fm.CHeader("H_SYSFLASH_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"#ifndef H_SYSFLASH_\n",
+		"#define FLASH_AREA_COUNT 4\n",
+		"#define FLASH_AREA_IMAGE_0 1\n",
+		"#define FLASH_AREA_IMAGE_0_OFFSET 0x00008000\n",
+		"#define FLASH_AREA_NFFS_DEVICE 1\n",
+	} {
+		if !strings.Contains(h, want) {
+			t.Fatalf("C header lacks %q:\n%s", want, h)
+		}
+	}
+
+	bad := FlashMap{Areas: append([]FlashArea{
+		{Name: "FLASH_AREA_BAD", Id: 18, Device: 0, Offset: 0x1000, Size: 0x1000},
+	}, testAreas...)}
+	if _, err := bad.CHeader("H_SYSFLASH_"); err == nil {
+		t.Fatalf("overlapping flash map accepted")
+	}
+}
+
+func TestDtsOverlay(t *testing.T) {
+	fm := FlashMap{Areas: testAreas}
+
+	dts, err := fm.DtsOverlay(DtsOpts{
+		DeviceNodes: map[int]string{1: "spi_flash"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"&flash0 {\n",
+		"&spi_flash {\n",
+		"\t\timage_1_partition: partition@42000 {\n",
+		"\t\t\treg = <0x00042000 0x3a000>;\n",
+	} {
+		if !strings.Contains(dts, want) {
+			t.Fatalf("overlay lacks %q:\n%s", want, dts)
+		}
+	}
+
+	if strings.Count(dts, "partitions {") != 2 {
+		t.Fatalf("overlay should contain one partitions node per device:\n%s",
+			dts)
+	}
+}
+
+func testGeometryMap() FlashMap {
+	return FlashMap{
+		Areas: testAreas,
+		Devices: []FlashDevice{
+			{
+				Id: 0,
+				Sectors: []SectorRun{
+					{Count: 4, Size: 0x2000},
+					{Count: 60, Size: 0x1000},
+					{Count: 29, Size: 0x2000},
+				},
+			},
+			{
+				Id:      1,
+				Sectors: []SectorRun{{Count: 16, Size: 0x1000}},
+			},
+		},
+	}
+}
+
+func TestSectors(t *testing.T) {
+	fm := testGeometryMap()
+
+	if err := fm.CheckSectorAlignment(); err != nil {
+		t.Fatal(err)
+	}
+
+	sectors, err := fm.AreaSectors(FLASH_AREA_NAME_BOOTLOADER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sectors) != 2 || sectors[1].Offset != 0x2000 {
+		t.Fatalf("wrong bootloader sectors: %+v", sectors)
+	}
+
+	// Slot 1 spans the tail of the 4K run and the head of the 8K run.
+	sectors, err = fm.AreaSectors(FLASH_AREA_NAME_IMAGE_1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sectors) != 30 {
+		t.Fatalf("wrong slot 1 sector count: have=%d want=30", len(sectors))
+	}
+
+	sector, err := fm.Devices[0].SectorAt(0x9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sector.Offset != 0x9000 || sector.Size != 0x1000 {
+		t.Fatalf("wrong sector at 0x9000: %+v", sector)
+	}
+
+	fm.Areas = append([]FlashArea{}, testAreas...)
+	fm.Areas[0].Size = 0x3000
+	if err := fm.CheckSectorAlignment(); err == nil {
+		t.Fatalf("misaligned area accepted")
+	}
+}
+
+func TestTrailerSize(t *testing.T) {
+	size, err := TrailerSize(TrailerOpts{
+		SwapType:      SWAP_TYPE_SCRATCH,
+		MinWriteSize:  4,
+		MaxImgSectors: 128,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 128*3*4+8*4+16 {
+		t.Fatalf("wrong trailer size: %d", size)
+	}
+
+	size, err = TrailerSize(TrailerOpts{
+		SwapType:      SWAP_TYPE_MOVE,
+		MinWriteSize:  8,
+		MaxImgSectors: 10,
+		Encrypted:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 10*2*8+16*2+8*4+16 {
+		t.Fatalf("wrong trailer size: %d", size)
+	}
+
+	fm := testGeometryMap()
+	size, err = fm.AreaTrailerSize(FLASH_AREA_NAME_IMAGE_1, TrailerOpts{
+		SwapType:     SWAP_TYPE_SCRATCH,
+		MinWriteSize: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 0x2000 {
+		t.Fatalf("wrong slot 1 trailer size: %d", size)
+	}
+}
+
+func TestScript(t *testing.T) {
+	fm := FlashMap{Areas: testAreas}
+
+	img, err := fm.AreaScriptFile(FLASH_AREA_NAME_IMAGE_0, "app.img", 0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []ScriptFile{
+		{Filename: "boot.bin", Device: 0, Offset: 0, Size: 0x3000},
+		img,
+		{Filename: "nffs.bin", Device: 1, Offset: 0},
+	}
+	opts := ScriptOpts{
+		Format:      SCRIPT_FORMAT_JLINK,
+		Target:      "nRF52840_xxAA",
+		SpeedKhz:    4000,
+		DeviceBases: map[int]uint32{1: 0x12000000},
+		Reset:       true,
+	}
+
+	jlink, err := fm.Script(files, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"device nRF52840_xxAA\n",
+		"speed 4000\n",
+		"loadbin boot.bin, 0x00000000\n",
+		"loadbin app.img, 0x00008000\n",
+		"loadbin nffs.bin, 0x12000000\n",
+		"g\nexit\n",
+	} {
+		if !strings.Contains(jlink, want) {
+			t.Fatalf("J-Link script lacks %q:\n%s", want, jlink)
+		}
+	}
+
+	opts.Format = SCRIPT_FORMAT_PYOCD
+	yml, err := fm.Script(files, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"target_override: nRF52840_xxAA\n",
+		"frequency: 4000000\n",
+		"  - file: \"app.img\"\n    format: bin\n    base_address: 0x00008000\n",
+		"--base-address 0x12000000 nffs.bin\n",
+	} {
+		if !strings.Contains(yml, want) {
+			t.Fatalf("pyOCD script lacks %q:\n%s", want, yml)
+		}
+	}
+
+	// Image larger than its slot.
+	big, err := fm.AreaScriptFile(FLASH_AREA_NAME_IMAGE_0, "big.img", 0x3b000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fm.Script([]ScriptFile{big}, opts); err == nil {
+		t.Fatalf("oversized image accepted")
+	}
+
+	// Unknown device.
+	if _, err := fm.Script([]ScriptFile{{Filename: "x.bin", Device: 2}},
+		opts); err == nil {
+
+		t.Fatalf("file on unknown device accepted")
+	}
+
+	if _, err := fm.AreaScriptFile("FLASH_AREA_BOGUS", "x.bin", 0); err == nil {
+		t.Fatalf("unknown area accepted")
+	}
+}
@@ -0,0 +1,289 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Programming script formats.
+type ScriptFormat int
+
+const (
+	SCRIPT_FORMAT_JLINK ScriptFormat = iota
+	SCRIPT_FORMAT_PYOCD
+)
+
+var scriptFormatNameMap = map[ScriptFormat]string{
+	SCRIPT_FORMAT_JLINK: "jlink",
+	SCRIPT_FORMAT_PYOCD: "pyocd",
+}
+
+func ScriptFormatString(f ScriptFormat) string {
+	s := scriptFormatNameMap[f]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func ScriptFormatFromString(s string) (ScriptFormat, error) {
+	for f, name := range scriptFormatNameMap {
+		if s == name {
+			return f, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown script format: \"%s\"", s)
+}
+
+// ScriptFile is a binary file to be programmed at a device offset.
+type ScriptFile struct {
+	Filename string
+	Device   int
+	Offset   int
+
+	// Size of the file, or 0 if unknown.  When known, the file is checked
+	// against the flash map.
+	Size int
+
+	// If non-empty, the name of the flash area the file must fit within.
+	Area string
+}
+
+// ScriptOpts controls programming script generation.
+type ScriptOpts struct {
+	Format ScriptFormat
+
+	// The J-Link device name or pyOCD target type (e.g., "nRF52840_xxAA"
+	// or "nrf52840").  Optional.
+	Target string
+
+	// Debug interface clock, in kHz.  0 leaves the tool's default.
+	SpeedKhz int
+
+	// Maps flash device numbers to the CPU address of the device's offset
+	// 0.  Devices without an entry are based at address 0.
+	DeviceBases map[int]uint32
+
+	// Erase the whole chip before programming.
+	Erase bool
+
+	// Reset and run the target after programming.
+	Reset bool
+}
+
+// AreaScriptFile returns a script file that is programmed at the start of
+// the named flash area.
+func (fm *FlashMap) AreaScriptFile(name string, filename string,
+	size int) (ScriptFile, error) {
+
+	for _, area := range fm.Areas {
+		if area.Name == name {
+			return ScriptFile{
+				Filename: filename,
+				Device:   area.Device,
+				Offset:   area.Offset,
+				Size:     size,
+				Area:     name,
+			}, nil
+		}
+	}
+
+	return ScriptFile{}, errors.Errorf(
+		"flash map does not contain area \"%s\"", name)
+}
+
+// scriptAddr calculates the CPU address a file is programmed at, ensuring
+// the file fits the flash map.
+func (fm *FlashMap) scriptAddr(file ScriptFile,
+	bases map[int]uint32) (uint32, error) {
+
+	devEnd := -1
+	var area *FlashArea
+	for i, a := range fm.Areas {
+		if a.Device != file.Device {
+			continue
+		}
+		if a.Offset+a.Size > devEnd {
+			devEnd = a.Offset + a.Size
+		}
+		if a.Name == file.Area {
+			area = &fm.Areas[i]
+		}
+	}
+
+	if devEnd < 0 {
+		return 0, errors.Errorf(
+			"flash map does not contain device %d (file \"%s\")",
+			file.Device, file.Filename)
+	}
+	if file.Area != "" && area == nil {
+		return 0, errors.Errorf(
+			"flash map does not contain area \"%s\" (file \"%s\")",
+			file.Area, file.Filename)
+	}
+
+	start := file.Offset
+	end := start + file.Size
+	if start < 0 || end > devEnd {
+		return 0, errors.Errorf(
+			"file \"%s\" extends beyond flash device %d: "+
+				"offset=0x%x size=%d device-end=0x%x",
+			file.Filename, file.Device, start, file.Size, devEnd)
+	}
+	if area != nil && (start < area.Offset ||
+		end > area.Offset+area.Size) {
+
+		return 0, errors.Errorf(
+			"file \"%s\" does not fit in flash area \"%s\": "+
+				"offset=0x%x size=%d area-offset=0x%x area-size=%d",
+			file.Filename, area.Name, start, file.Size,
+			area.Offset, area.Size)
+	}
+
+	addr := uint64(bases[file.Device]) + uint64(start)
+	if addr+uint64(file.Size) > 1<<32 {
+		return 0, errors.Errorf(
+			"file \"%s\" exceeds the 32-bit address space: addr=0x%x",
+			file.Filename, addr)
+	}
+
+	return uint32(addr), nil
+}
+
+// Script produces a script that programs each file at its flash address.
+func (fm *FlashMap) Script(files []ScriptFile,
+	opts ScriptOpts) (string, error) {
+
+	if err := fm.Validate(); err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", errors.Errorf("no files to program")
+	}
+
+	addrs := make([]uint32, len(files))
+	for i, file := range files {
+		if strings.ContainsAny(file.Filename, ",\r\n") {
+			return "", errors.Errorf(
+				"unsupported character in filename: \"%s\"",
+				file.Filename)
+		}
+
+		addr, err := fm.scriptAddr(file, opts.DeviceBases)
+		if err != nil {
+			return "", err
+		}
+		addrs[i] = addr
+	}
+
+	switch opts.Format {
+	case SCRIPT_FORMAT_JLINK:
+		return jlinkScript(files, addrs, opts), nil
+	case SCRIPT_FORMAT_PYOCD:
+		return pyocdScript(files, addrs, opts), nil
+	default:
+		return "", errors.Errorf("unknown script format: %d", opts.Format)
+	}
+}
+
+// jlinkScript produces a J-Link Commander command file (JLinkExe
+// -CommandFile).
+func jlinkScript(files []ScriptFile, addrs []uint32, opts ScriptOpts) string {
+	b := &bytes.Buffer{}
+
+	if opts.Target != "" {
+		fmt.Fprintf(b, "device %s\n", opts.Target)
+	}
+	fmt.Fprintf(b, "si SWD\n")
+	if opts.SpeedKhz > 0 {
+		fmt.Fprintf(b, "speed %d\n", opts.SpeedKhz)
+	}
+	fmt.Fprintf(b, "connect\n")
+	fmt.Fprintf(b, "r\n")
+	fmt.Fprintf(b, "h\n")
+	if opts.Erase {
+		fmt.Fprintf(b, "erase\n")
+	}
+
+	for i, file := range files {
+		fmt.Fprintf(b, "loadbin %s, 0x%08x\n", file.Filename, addrs[i])
+		fmt.Fprintf(b, "verifybin %s, 0x%08x\n", file.Filename, addrs[i])
+	}
+
+	if opts.Reset {
+		fmt.Fprintf(b, "r\n")
+		fmt.Fprintf(b, "g\n")
+	}
+	fmt.Fprintf(b, "exit\n")
+
+	return b.String()
+}
+
+// pyocdScript produces a pyOCD configuration file describing the files to
+// program.  The "program" list is not interpreted by pyOCD itself; each
+// entry is accompanied by the equivalent "pyocd load" command.
+func pyocdScript(files []ScriptFile, addrs []uint32, opts ScriptOpts) string {
+	b := &bytes.Buffer{}
+
+	fmt.Fprintf(b, "# Generated by mynewt-artifact; do not edit.\n")
+	fmt.Fprintf(b, "#\n")
+	fmt.Fprintf(b, "# Program with:\n")
+	if opts.Erase {
+		fmt.Fprintf(b, "#   pyocd erase --config <this-file> --chip\n")
+	}
+	for i, file := range files {
+		fmt.Fprintf(b, "#   pyocd load --config <this-file> "+
+			"--format bin --base-address 0x%08x %s\n",
+			addrs[i], file.Filename)
+	}
+	if opts.Reset {
+		fmt.Fprintf(b, "#   pyocd reset --config <this-file>\n")
+	}
+	fmt.Fprintf(b, "\n")
+
+	if opts.Target != "" {
+		fmt.Fprintf(b, "target_override: %s\n", opts.Target)
+	}
+	if opts.SpeedKhz > 0 {
+		fmt.Fprintf(b, "frequency: %d\n", opts.SpeedKhz*1000)
+	}
+	if opts.Erase {
+		fmt.Fprintf(b, "chip_erase: chip\n")
+	} else {
+		fmt.Fprintf(b, "chip_erase: sector\n")
+	}
+
+	fmt.Fprintf(b, "program:\n")
+	for i, file := range files {
+		fmt.Fprintf(b, "  - file: %s\n", strconv.Quote(file.Filename))
+		fmt.Fprintf(b, "    format: bin\n")
+		fmt.Fprintf(b, "    base_address: 0x%08x\n", addrs[i])
+	}
+
+	return b.String()
+}
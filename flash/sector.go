@@ -0,0 +1,339 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package flash
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// SectorRun describes a run of consecutive equally-sized sectors.
+type SectorRun struct {
+	Count int `json:"count"`
+	Size  int `json:"size"`
+}
+
+// FlashDevice describes the sector layout of a single flash device.  Devices
+// with non-uniform sector sizes are expressed as several runs.
+type FlashDevice struct {
+	Id      int         `json:"id"`
+	Sectors []SectorRun `json:"sectors"`
+}
+
+// FlashSector is a single erasable unit of a flash device.
+type FlashSector struct {
+	Index  int
+	Offset int
+	Size   int
+}
+
+// Swap strategies supported by MCUboot.
+type SwapType int
+
+const (
+	SWAP_TYPE_SCRATCH SwapType = iota
+	SWAP_TYPE_MOVE
+)
+
+var swapTypeNameMap = map[SwapType]string{
+	SWAP_TYPE_SCRATCH: "scratch",
+	SWAP_TYPE_MOVE:    "move",
+}
+
+func SwapTypeString(st SwapType) string {
+	s := swapTypeNameMap[st]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func SwapStringType(s string) (SwapType, error) {
+	for st, name := range swapTypeNameMap {
+		if s == name {
+			return st, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown swap type: \"%s\"", s)
+}
+
+// Number of status bytes (in units of the write size) that MCUboot records
+// per sector during a swap.
+var swapStatusStateCount = map[SwapType]int{
+	SWAP_TYPE_SCRATCH: 3,
+	SWAP_TYPE_MOVE:    2,
+}
+
+const BOOT_MAGIC_SIZE = 16
+const BOOT_ENC_KEY_SIZE = 16
+const BOOT_DEFAULT_MAX_ALIGN = 8
+
+// TrailerOpts describes an MCUboot configuration for the purpose of
+// computing its image trailer size.
+type TrailerOpts struct {
+	SwapType SwapType
+
+	// Smallest unit the device can write.
+	MinWriteSize int
+
+	// MCUboot's BOOT_MAX_ALIGN; 0 means BOOT_DEFAULT_MAX_ALIGN.
+	MaxAlign int
+
+	// Maximum number of sectors in an image slot.
+	MaxImgSectors int
+
+	// Whether encrypted images are supported (adds space for the
+	// per-slot encryption keys).
+	Encrypted bool
+}
+
+func alignUp(val int, align int) int {
+	return (val + align - 1) / align * align
+}
+
+// Size returns the total size of the device, in bytes.
+func (d *FlashDevice) Size() int {
+	size := 0
+	for _, run := range d.Sectors {
+		size += run.Count * run.Size
+	}
+
+	return size
+}
+
+// SectorList returns every sector in the device, in offset order.
+func (d *FlashDevice) SectorList() []FlashSector {
+	var sectors []FlashSector
+
+	off := 0
+	for _, run := range d.Sectors {
+		for i := 0; i < run.Count; i++ {
+			sectors = append(sectors, FlashSector{
+				Index:  len(sectors),
+				Offset: off,
+				Size:   run.Size,
+			})
+			off += run.Size
+		}
+	}
+
+	return sectors
+}
+
+// SectorAt returns the sector containing the specified device offset.
+func (d *FlashDevice) SectorAt(offset int) (FlashSector, error) {
+	for _, sector := range d.SectorList() {
+		if offset >= sector.Offset && offset < sector.Offset+sector.Size {
+			return sector, nil
+		}
+	}
+
+	return FlashSector{}, errors.Errorf(
+		"offset 0x%x beyond end of flash device %d (size=0x%x)",
+		offset, d.Id, d.Size())
+}
+
+// ResolveArea looks up a flash area by name (e.g., "FLASH_AREA_IMAGE_0").
+// Unlike FindArea, it accepts a nil map, so that options which reference
+// areas by name can pass their (possibly absent) map directly.
+func (fm *FlashMap) ResolveArea(name string) (FlashArea, error) {
+	if fm == nil {
+		return FlashArea{}, errors.Errorf(
+			"flash area \"%s\" referenced by name without a flash map", name)
+	}
+
+	area := fm.FindArea(name)
+	if area == nil {
+		return FlashArea{}, errors.Errorf("flash map lacks area \"%s\"", name)
+	}
+
+	return *area, nil
+}
+
+// AreaSectors returns the list of sectors that make up the specified area.
+// An error is returned if the area does not start and end on sector
+// boundaries.
+func (d *FlashDevice) AreaSectors(area FlashArea) ([]FlashSector, error) {
+	if area.Device != d.Id {
+		return nil, errors.Errorf(
+			"flash area %s is on device %d, not %d",
+			area.Name, area.Device, d.Id)
+	}
+
+	end := area.Offset + area.Size
+	if end > d.Size() {
+		return nil, errors.Errorf(
+			"flash area %s extends beyond end of device %d "+
+				"(end=0x%x size=0x%x)", area.Name, d.Id, end, d.Size())
+	}
+
+	var sectors []FlashSector
+	for _, sector := range d.SectorList() {
+		if sector.Offset+sector.Size <= area.Offset || sector.Offset >= end {
+			continue
+		}
+
+		if sector.Offset < area.Offset {
+			return nil, errors.Errorf(
+				"flash area %s does not start on a sector boundary "+
+					"(offset=0x%x sector=0x%x)",
+				area.Name, area.Offset, sector.Offset)
+		}
+		if sector.Offset+sector.Size > end {
+			return nil, errors.Errorf(
+				"flash area %s does not end on a sector boundary "+
+					"(end=0x%x sector-end=0x%x)",
+				area.Name, end, sector.Offset+sector.Size)
+		}
+
+		sectors = append(sectors, sector)
+	}
+
+	return sectors, nil
+}
+
+// FindDevice retrieves the device with the specified ID.
+func (fm *FlashMap) FindDevice(id int) *FlashDevice {
+	for i, _ := range fm.Devices {
+		if fm.Devices[i].Id == id {
+			return &fm.Devices[i]
+		}
+	}
+
+	return nil
+}
+
+// FindArea retrieves the area with the specified name.
+func (fm *FlashMap) FindArea(name string) *FlashArea {
+	for i, _ := range fm.Areas {
+		if fm.Areas[i].Name == name {
+			return &fm.Areas[i]
+		}
+	}
+
+	return nil
+}
+
+// AreaSectors returns the list of sectors that make up the named area.
+func (fm *FlashMap) AreaSectors(name string) ([]FlashSector, error) {
+	area := fm.FindArea(name)
+	if area == nil {
+		return nil, errors.Errorf("flash map lacks area \"%s\"", name)
+	}
+
+	dev := fm.FindDevice(area.Device)
+	if dev == nil {
+		return nil, errors.Errorf(
+			"flash map lacks geometry for device %d (area %s)",
+			area.Device, area.Name)
+	}
+
+	return dev.AreaSectors(*area)
+}
+
+// CheckSectorAlignment ensures that every area in the flash map begins and
+// ends on a sector boundary of its device.
+func (fm *FlashMap) CheckSectorAlignment() error {
+	for _, area := range SortFlashAreasByDevOff(fm.Areas) {
+		if _, err := fm.AreaSectors(area.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TrailerSize computes the size of the MCUboot image trailer for the
+// specified configuration.  This mirrors MCUboot's `boot_trailer_sz()`.
+func TrailerSize(opts TrailerOpts) (int, error) {
+	stateCount, ok := swapStatusStateCount[opts.SwapType]
+	if !ok {
+		return 0, errors.Errorf("unknown swap type: %d", int(opts.SwapType))
+	}
+
+	if opts.MinWriteSize <= 0 {
+		return 0, errors.Errorf(
+			"invalid minimum write size: %d", opts.MinWriteSize)
+	}
+
+	maxAlign := opts.MaxAlign
+	if maxAlign == 0 {
+		maxAlign = BOOT_DEFAULT_MAX_ALIGN
+	}
+	if opts.MinWriteSize > maxAlign {
+		return 0, errors.Errorf(
+			"minimum write size (%d) exceeds max alignment (%d)",
+			opts.MinWriteSize, maxAlign)
+	}
+
+	// Swap status area.
+	size := opts.MaxImgSectors * stateCount * opts.MinWriteSize
+
+	// Encryption keys for both slots.
+	if opts.Encrypted {
+		size += alignUp(BOOT_ENC_KEY_SIZE, maxAlign) * 2
+	}
+
+	// swap-size, swap-info, copy-done, image-ok.
+	size += maxAlign * 4
+
+	// Magic.
+	size += alignUp(BOOT_MAGIC_SIZE, maxAlign)
+
+	return size, nil
+}
+
+// AreaTrailerSize computes the MCUboot trailer size for the named image
+// slot.  If opts.MaxImgSectors is 0, the slot's own sector count is used.
+// The trailer size is rounded up to a whole number of the slot's trailing
+// sectors, since MCUboot must erase the trailer independently of the image.
+func (fm *FlashMap) AreaTrailerSize(name string,
+	opts TrailerOpts) (int, error) {
+
+	sectors, err := fm.AreaSectors(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(sectors) == 0 {
+		return 0, errors.Errorf("flash area %s contains no sectors", name)
+	}
+
+	if opts.MaxImgSectors == 0 {
+		opts.MaxImgSectors = len(sectors)
+	}
+
+	size, err := TrailerSize(opts)
+	if err != nil {
+		return 0, err
+	}
+
+	covered := 0
+	for i := len(sectors) - 1; i >= 0 && covered < size; i-- {
+		covered += sectors[i].Size
+	}
+	if covered < size {
+		return 0, errors.Errorf(
+			"MCUboot trailer (%d bytes) larger than flash area %s",
+			size, name)
+	}
+
+	return covered, nil
+}
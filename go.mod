@@ -1,10 +1,19 @@
 module github.com/supervillain101/mynewt-artifact
 
-go 1.12
+go 1.21
 
 require (
 	github.com/NickBall/go-aes-key-wrap v0.0.0-20170929221519-1c3aa3e4dfc5
+	github.com/cloudflare/circl v1.4.0
 	github.com/pkg/errors v0.8.1
+	github.com/spf13/cobra v1.10.2
+	golang.org/x/crypto v0.11.1-0.20230711161743-2e82bdd1719d
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.9 // indirect
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20190618222545-ea8f1a30c443
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/term v0.10.0 // indirect
 )
@@ -0,0 +1,284 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// AnalysisSeverity indicates how likely an analysis finding is to make an
+// image unusable.
+type AnalysisSeverity int
+
+const (
+	// Unusual but possibly intended.
+	ANALYSIS_SEVERITY_INFO AnalysisSeverity = iota
+
+	// Likely a mistake.
+	ANALYSIS_SEVERITY_WARNING
+
+	// The image will almost certainly be rejected by the boot loader.
+	ANALYSIS_SEVERITY_ERROR
+)
+
+var analysisSeverityNameMap = map[AnalysisSeverity]string{
+	ANALYSIS_SEVERITY_INFO:    "info",
+	ANALYSIS_SEVERITY_WARNING: "warning",
+	ANALYSIS_SEVERITY_ERROR:   "error",
+}
+
+const (
+	ANALYSIS_HDR_SZ              = "hdr_sz"
+	ANALYSIS_PROT_SZ             = "prot_sz"
+	ANALYSIS_FLAGS               = "flags"
+	ANALYSIS_NO_HASH             = "no_hash"
+	ANALYSIS_NON_BOOTABLE        = "non_bootable"
+	ANALYSIS_ENC_FLAG            = "enc_flag"
+	ANALYSIS_ZERO_VERSION        = "zero_version"
+	ANALYSIS_PROT_SIG            = "protected_signature"
+	ANALYSIS_UNKNOWN_TLV         = "unknown_tlv"
+	ANALYSIS_SIG_WITHOUT_KEYHASH = "sig_without_keyhash"
+)
+
+// AnalysisFinding describes a suspicious property of an image.  Detail
+// describes what was found; Explanation describes why it matters.
+type AnalysisFinding struct {
+	Code        string
+	Severity    AnalysisSeverity
+	Detail      string
+	Explanation string
+}
+
+// AnalysisReport is the outcome of analyzing an image.
+type AnalysisReport struct {
+	Findings []AnalysisFinding
+}
+
+func AnalysisSeverityString(sev AnalysisSeverity) string {
+	s := analysisSeverityNameMap[sev]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func AnalysisSeverityFromString(s string) (AnalysisSeverity, error) {
+	for k, v := range analysisSeverityNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown analysis severity name: \"%s\"", s)
+}
+
+func (f AnalysisFinding) String() string {
+	return fmt.Sprintf("%s: %s: %s (%s)", AnalysisSeverityString(f.Severity),
+		f.Code, f.Detail, f.Explanation)
+}
+
+// AtLeast returns the findings with the given severity or higher.
+func (r *AnalysisReport) AtLeast(sev AnalysisSeverity) []AnalysisFinding {
+	var findings []AnalysisFinding
+	for _, f := range r.Findings {
+		if f.Severity >= sev {
+			findings = append(findings, f)
+		}
+	}
+
+	return findings
+}
+
+// Err returns an error describing each error-severity finding, or nil if
+// there are none.
+func (r *AnalysisReport) Err() error {
+	errs := r.AtLeast(ANALYSIS_SEVERITY_ERROR)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, f := range errs {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Code, f.Detail))
+	}
+
+	return errors.Errorf("image analysis found errors: %s",
+		strings.Join(msgs, "; "))
+}
+
+func (r *AnalysisReport) add(code string, sev AnalysisSeverity,
+	explanation string, format string, args ...interface{}) {
+
+	r.Findings = append(r.Findings, AnalysisFinding{
+		Code:        code,
+		Severity:    sev,
+		Detail:      fmt.Sprintf(format, args...),
+		Explanation: explanation,
+	})
+}
+
+// Analyze inspects an image for combinations of header fields and TLVs that
+// are individually valid but suspicious together.  Unlike VerifyStructure,
+// it does not stop at the first problem and it reports likely mistakes that
+// do not make the image malformed.  No keys are required.
+func Analyze(img Image) AnalysisReport {
+	r := AnalysisReport{}
+
+	analyzeHeader(img, &r)
+	analyzeHash(img, &r)
+	analyzeEnc(img, &r)
+	analyzeSigs(img, &r)
+
+	return r
+}
+
+func analyzeHeader(img Image, r *AnalysisReport) {
+	hdrSz := int(img.Header.HdrSz)
+	if hdrSz < IMAGE_HEADER_SIZE {
+		r.add(ANALYSIS_HDR_SZ, ANALYSIS_SEVERITY_ERROR,
+			"the boot loader locates the body using hdr_sz",
+			"header size smaller than image header: hdr-sz=%d min=%d",
+			hdrSz, IMAGE_HEADER_SIZE)
+	} else if len(img.Pad) != hdrSz-IMAGE_HEADER_SIZE {
+		r.add(ANALYSIS_HDR_SZ, ANALYSIS_SEVERITY_ERROR,
+			"the body would not start where hdr_sz says it does",
+			"header padding does not match header size: hdr-sz=%d pad=%d",
+			hdrSz, len(img.Pad))
+	}
+
+	wantProtSz := 0
+	if len(img.ProtTlvs) > 0 {
+		wantProtSz = int(img.ProtTrailer().TlvTotLen)
+	}
+	if int(img.Header.ProtSz) != wantProtSz {
+		r.add(ANALYSIS_PROT_SZ, ANALYSIS_SEVERITY_ERROR,
+			"the boot loader hashes prot_sz bytes of protected TLVs",
+			"protected size does not match protected TLVs: "+
+				"prot-sz=%d want=%d", img.Header.ProtSz, wantProtSz)
+	}
+
+	if unknown := img.Header.Flags &^ IMAGE_F_KNOWN; unknown != 0 {
+		r.add(ANALYSIS_FLAGS, ANALYSIS_SEVERITY_WARNING,
+			"the boot loader may reject or misinterpret unknown flags",
+			"header contains unknown flags: 0x%08x", unknown)
+	}
+
+	if img.Header.Vers == (ImageVersion{}) && len(img.FindTlvsIf(
+		func(tlv ImageTlv) bool { return ImageTlvTypeIsSig(tlv.Header.Type) },
+	)) > 0 {
+		r.add(ANALYSIS_ZERO_VERSION, ANALYSIS_SEVERITY_WARNING,
+			"a signed release with version 0.0.0.0 defeats downgrade "+
+				"protection; this is usually a development build that "+
+				"was signed by mistake",
+			"signed image has version %s", img.Header.Vers.String())
+	}
+
+	for _, tlv := range append(append([]ImageTlv(nil), img.ProtTlvs...),
+		img.Tlvs...) {
+
+		if !ImageTlvTypeIsValid(tlv.Header.Type) {
+			r.add(ANALYSIS_UNKNOWN_TLV, ANALYSIS_SEVERITY_INFO,
+				"the boot loader ignores TLVs it does not recognize",
+				"image contains unknown TLV type 0x%02x", tlv.Header.Type)
+		}
+	}
+}
+
+func analyzeHash(img Image, r *AnalysisReport) {
+	hash, err := img.Hash()
+	if err != nil {
+		r.add(ANALYSIS_NO_HASH, ANALYSIS_SEVERITY_ERROR,
+			"the boot loader requires exactly one SHA256 TLV",
+			"%s", err.Error())
+		return
+	}
+
+	// The hash of a non-bootable (split) image covers the loader's hash.
+	// If the hash matches without it, the loader hash was likely omitted
+	// at creation time.  The check is only possible for plaintext bodies.
+	if img.Header.Flags&IMAGE_F_NON_BOOTABLE != 0 && !img.IsEncrypted() {
+		plain, err := img.CalcHash(nil)
+		if err == nil && bytes.Equal(plain, hash) {
+			r.add(ANALYSIS_NON_BOOTABLE, ANALYSIS_SEVERITY_WARNING,
+				"a split application's hash must include the loader's "+
+					"hash or the boot loader will reject the pair",
+				"non-bootable image hash does not include a loader hash")
+		}
+	}
+}
+
+func analyzeEnc(img Image, r *AnalysisReport) {
+	encTlvs := img.FindAllTlvsIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsSecret(tlv.Header.Type)
+	})
+
+	if img.IsEncrypted() && len(encTlvs) == 0 {
+		r.add(ANALYSIS_ENC_FLAG, ANALYSIS_SEVERITY_ERROR,
+			"the boot loader cannot recover the body key",
+			"encrypted flag set, but image contains no key-exchange TLV")
+	} else if !img.IsEncrypted() && len(encTlvs) > 0 {
+		r.add(ANALYSIS_ENC_FLAG, ANALYSIS_SEVERITY_ERROR,
+			"the boot loader will run the body without decrypting it",
+			"image contains %s TLV, but encrypted flag unset",
+			ImageTlvTypeName(encTlvs[0].Header.Type))
+	}
+
+	if img.IsEncrypted() && img.HasEncryptionPayload() {
+		r.add(ANALYSIS_ENC_FLAG, ANALYSIS_SEVERITY_WARNING,
+			"hardware-key images are decrypted by the flash controller, "+
+				"not the boot loader",
+			"encrypted flag set on image with hardware key payload")
+	}
+}
+
+func analyzeSigs(img Image, r *AnalysisReport) {
+	if img.HasProtectedSigs() {
+		if err := img.ValidateTlvPlacement(); err != nil {
+			r.add(ANALYSIS_PROT_SIG, ANALYSIS_SEVERITY_ERROR,
+				"signatures cover the protected TLVs and can only be "+
+					"among them in the protected-signature layout",
+				"%s", err.Error())
+		} else {
+			r.add(ANALYSIS_PROT_SIG, ANALYSIS_SEVERITY_WARNING,
+				"standard MCUboot cannot verify signatures in the "+
+					"protected region",
+				"image uses the protected-signature layout")
+		}
+	}
+
+	// MCUboot expects each signature to be preceded by the hash of the key
+	// that produced it.
+	prevKeyHash := false
+	for _, tlv := range img.Tlvs {
+		if ImageTlvTypeIsSig(tlv.Header.Type) && !prevKeyHash {
+			r.add(ANALYSIS_SIG_WITHOUT_KEYHASH, ANALYSIS_SEVERITY_WARNING,
+				"the boot loader uses the key hash to select a key",
+				"%s TLV not preceded by KEYHASH or PUBKEY TLV",
+				ImageTlvTypeName(tlv.Header.Type))
+		}
+		prevKeyHash = tlv.Header.Type == IMAGE_TLV_KEYHASH ||
+			tlv.Header.Type == IMAGE_TLV_PUBKEY
+	}
+}
@@ -0,0 +1,189 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+)
+
+// SizeBudget limits the size of a created image.  The limit is either given
+// explicitly or derived from a flash map: the size of the image slot minus
+// the space reserved for the boot loader's trailer.
+type SizeBudget struct {
+	// The maximum image size, in bytes.  If 0, the limit is derived from
+	// the slot.
+	Max int
+
+	// The slot the image is written to; "" for ImageCreateOpts.SlotArea.
+	Area string
+
+	// Bytes reserved at the end of the slot for the MCUboot trailer.  If
+	// Trailer is non-nil, the trailer size is instead computed from the
+	// slot's sectors.
+	TrailerSize int
+	Trailer     *flash.TrailerOpts
+
+	// The previous release of the image; nil for none.  Growth is reported
+	// relative to its size.
+	Baseline *Image
+
+	// If true, creating an image that exceeds the budget fails.
+	// Otherwise, the overrun is only reported.
+	Enforce bool
+}
+
+// SizeBudgetReport describes how much of its size budget an image uses.
+type SizeBudgetReport struct {
+	Area   string // The slot the budget was derived from; "" if explicit.
+	Budget int
+	Used   int
+	Free   int // Negative if the image exceeds the budget.
+
+	// Size of the baseline image, and the image's growth relative to it.
+	// Baseline is -1 if no baseline was provided.
+	Baseline  int
+	Growth    int
+	GrowthPct float64
+}
+
+// Exceeded indicates whether the image is larger than its budget.
+func (r *SizeBudgetReport) Exceeded() bool {
+	return r.Free < 0
+}
+
+// UsedPct returns the percentage of the budget that the image uses.
+func (r *SizeBudgetReport) UsedPct() float64 {
+	if r.Budget == 0 {
+		return 0
+	}
+
+	return float64(r.Used) * 100 / float64(r.Budget)
+}
+
+// Err returns an error if the image exceeds its budget.
+func (r *SizeBudgetReport) Err() error {
+	if !r.Exceeded() {
+		return nil
+	}
+
+	return errors.Errorf(
+		"image exceeds size budget: size=%d budget=%d over=%d",
+		r.Used, r.Budget, -r.Free)
+}
+
+// String produces a one-line summary of the report.
+func (r *SizeBudgetReport) String() string {
+	s := fmt.Sprintf("used=%d (%.1f%%) free=%d budget=%d",
+		r.Used, r.UsedPct(), r.Free, r.Budget)
+	if r.Area != "" {
+		s += fmt.Sprintf(" area=%s", r.Area)
+	}
+	if r.Baseline >= 0 {
+		s += fmt.Sprintf(" growth=%+d (%+.1f%%) baseline=%d",
+			r.Growth, r.GrowthPct, r.Baseline)
+	}
+
+	return s
+}
+
+// Limit calculates the budget's maximum image size.  If the budget does not
+// specify a size, it is derived from the named slot in fm.  The returned
+// string is the slot's name, or "" if the size was given explicitly.
+func (b *SizeBudget) Limit(fm *flash.FlashMap,
+	slotArea string) (int, string, error) {
+
+	if b.Max < 0 {
+		return 0, "", errors.Errorf("invalid size budget: %d", b.Max)
+	}
+	if b.Max > 0 {
+		return b.Max, "", nil
+	}
+
+	name := b.Area
+	if name == "" {
+		name = slotArea
+	}
+	if name == "" {
+		return 0, "", errors.Errorf(
+			"size budget specifies neither a size nor a slot")
+	}
+
+	area, err := fm.ResolveArea(name)
+	if err != nil {
+		return 0, "", err
+	}
+
+	trailerSize := b.TrailerSize
+	if b.Trailer != nil {
+		trailerSize, err = fm.AreaTrailerSize(name, *b.Trailer)
+		if err != nil {
+			return 0, "", err
+		}
+	}
+
+	if trailerSize < 0 || trailerSize >= area.Size {
+		return 0, "", errors.Errorf(
+			"trailer size invalid for slot \"%s\": "+
+				"trailer-size=%d slot-size=%d",
+			name, trailerSize, area.Size)
+	}
+
+	return area.Size - trailerSize, name, nil
+}
+
+// Check measures an image against the budget.  An error is returned only if
+// the budget cannot be determined; an image that exceeds it is indicated by
+// the report.
+func (b *SizeBudget) Check(img Image, fm *flash.FlashMap,
+	slotArea string) (SizeBudgetReport, error) {
+
+	r := SizeBudgetReport{
+		Baseline: -1,
+	}
+
+	var err error
+	r.Budget, r.Area, err = b.Limit(fm, slotArea)
+	if err != nil {
+		return r, err
+	}
+
+	r.Used, err = img.TotalSize()
+	if err != nil {
+		return r, err
+	}
+	r.Free = r.Budget - r.Used
+
+	if b.Baseline != nil {
+		r.Baseline, err = b.Baseline.TotalSize()
+		if err != nil {
+			return r, errors.Wrapf(err, "invalid baseline image")
+		}
+
+		r.Growth = r.Used - r.Baseline
+		if r.Baseline > 0 {
+			r.GrowthPct = float64(r.Growth) * 100 / float64(r.Baseline)
+		}
+	}
+
+	return r, nil
+}
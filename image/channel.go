@@ -0,0 +1,113 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The maximum length of a release channel name.
+const IMAGE_CHANNEL_MAX_SIZE = 32
+
+// ValidateChannel checks that a release channel name (e.g., "alpha", "beta",
+// "prod") is 1-32 characters from [a-z0-9._-].
+func ValidateChannel(channel string) error {
+	if len(channel) == 0 || len(channel) > IMAGE_CHANNEL_MAX_SIZE {
+		return errors.Errorf(
+			"release channel has invalid length: have=%d want=1-%d",
+			len(channel), IMAGE_CHANNEL_MAX_SIZE)
+	}
+
+	for _, c := range channel {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') &&
+			c != '.' && c != '_' && c != '-' {
+
+			return errors.Errorf(
+				"release channel contains invalid character: \"%s\"",
+				channel)
+		}
+	}
+
+	return nil
+}
+
+// GenerateChannelTlv creates a CHANNEL TLV naming the release channel or
+// rollout ring the image is intended for.
+func GenerateChannelTlv(channel string) (ImageTlv, error) {
+	if err := ValidateChannel(channel); err != nil {
+		return ImageTlv{}, err
+	}
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_CHANNEL,
+			Pad:  0,
+			Len:  uint16(len(channel)),
+		},
+		Data: []byte(channel),
+	}, nil
+}
+
+// Channel returns the release channel in an image's protected CHANNEL TLV.
+// It returns "" if the image does not specify a channel.
+func (img *Image) Channel() (string, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_CHANNEL)
+	if err != nil {
+		return "", err
+	}
+	if tlv == nil {
+		return "", nil
+	}
+
+	channel := string(tlv.Data)
+	if err := ValidateChannel(channel); err != nil {
+		return "", errors.Wrapf(err, "invalid CHANNEL TLV")
+	}
+
+	return channel, nil
+}
+
+func (img *Image) verifyPolicyChannel(opts VerifyOpts, r *VerifyReport) {
+	if len(opts.Channels) == 0 {
+		return
+	}
+
+	channel, err := img.Channel()
+	if err == nil {
+		if channel == "" {
+			err = errors.Errorf("image does not specify a release channel")
+		} else {
+			allowed := false
+			for _, c := range opts.Channels {
+				if c == channel {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				err = errors.Errorf(
+					"release channel not allowed: have=%s want=%v",
+					channel, opts.Channels)
+			}
+		}
+	}
+
+	r.add(VERIFY_RULE_CHANNEL, err, "channel="+channel)
+}
@@ -0,0 +1,229 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// DeviceState describes a device as reported to an OTA server.  Zero-valued
+// fields impose no restriction.
+type DeviceState struct {
+	// Version of the image currently running in the target slot's image.
+	Version ImageVersion
+
+	// Size of the slot the image would be written to, in bytes.
+	SlotSize int
+
+	// Index of the device's hardware encryption key, or -1 if it has none.
+	HWKeyIndex int
+
+	// Indicates whether the bootloader can decrypt key-exchange encrypted
+	// images (ENC_RSA, ENC_KEK, ENC_EC256).
+	KeyExchangeEnc bool
+
+	// Signature algorithms the bootloader supports.  If empty, any
+	// algorithm is accepted.
+	SigTypes []sec.SigType
+
+	// Versions of the device's other images, indexed by image ID.  Used to
+	// evaluate the image's dependencies.
+	ImageVersions map[uint8]ImageVersion
+
+	// If true, images older than or equal to Version are accepted.
+	AllowDowngrade bool
+}
+
+// CompatReason explains why an image cannot be installed.
+type CompatReason struct {
+	Code   string
+	Detail string
+}
+
+// CompatResult is the outcome of an installability check.
+type CompatResult struct {
+	Reasons []CompatReason
+}
+
+const (
+	COMPAT_ERR_STRUCTURE  = "structure"
+	COMPAT_ERR_SIZE       = "size"
+	COMPAT_ERR_VERSION    = "version"
+	COMPAT_ERR_BOOTABLE   = "bootable"
+	COMPAT_ERR_ENC        = "encryption"
+	COMPAT_ERR_SIG_TYPE   = "signature_type"
+	COMPAT_ERR_DEPENDENCY = "dependency"
+)
+
+// NewDeviceState creates a device state that imposes no restrictions.
+func NewDeviceState() DeviceState {
+	return DeviceState{
+		HWKeyIndex: -1,
+	}
+}
+
+// Installable indicates whether the image can be installed on the device.
+func (r *CompatResult) Installable() bool {
+	return len(r.Reasons) == 0
+}
+
+// Err returns an error describing why the image cannot be installed, or nil
+// if it can.
+func (r *CompatResult) Err() error {
+	if len(r.Reasons) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, reason := range r.Reasons {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", reason.Code, reason.Detail))
+	}
+
+	return errors.Errorf("image not installable: %s",
+		strings.Join(msgs, "; "))
+}
+
+func (r *CompatResult) add(code string, format string, args ...interface{}) {
+	r.Reasons = append(r.Reasons, CompatReason{
+		Code:   code,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+func checkCompatEnc(img Image, dev DeviceState, r *CompatResult) {
+	if !img.IsEncrypted() {
+		return
+	}
+
+	if img.HasEncryptionPayload() {
+		tlv, _ := img.FindAllUniqueTlv(IMAGE_TLV_SECRET_ID)
+		if tlv == nil {
+			tlv, _ = img.FindAllUniqueTlv(IMAGE_TLV_SECRET_ID_LEGACY)
+		}
+		if tlv == nil || len(tlv.Data) != 4 {
+			r.add(COMPAT_ERR_ENC, "image contains invalid secret ID TLV")
+			return
+		}
+
+		idx := int(img.Endianness.ByteOrder().Uint32(tlv.Data))
+		if dev.HWKeyIndex < 0 {
+			r.add(COMPAT_ERR_ENC,
+				"image encrypted with hardware key %d; device has none", idx)
+		} else if idx != dev.HWKeyIndex {
+			r.add(COMPAT_ERR_ENC,
+				"image encrypted with hardware key %d; device uses key %d",
+				idx, dev.HWKeyIndex)
+		}
+		return
+	}
+
+	if !dev.KeyExchangeEnc {
+		r.add(COMPAT_ERR_ENC,
+			"image is encrypted; device does not support encrypted images")
+	}
+}
+
+func checkCompatSigs(img Image, dev DeviceState, r *CompatResult) {
+	if len(dev.SigTypes) == 0 {
+		return
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		r.add(COMPAT_ERR_SIG_TYPE, "%s", err.Error())
+		return
+	}
+
+	for _, sig := range sigs {
+		for _, t := range dev.SigTypes {
+			if sig.Type == t {
+				return
+			}
+		}
+	}
+
+	r.add(COMPAT_ERR_SIG_TYPE,
+		"image has no signature of a supported type (%s)",
+		sigTypesString(dev.SigTypes))
+}
+
+func checkCompatDeps(img Image, dev DeviceState, r *CompatResult) {
+	deps, err := img.Dependencies()
+	if err != nil {
+		r.add(COMPAT_ERR_DEPENDENCY, "%s", err.Error())
+		return
+	}
+
+	for _, dep := range deps {
+		have, ok := dev.ImageVersions[dep.ImageId]
+		if !ok {
+			r.add(COMPAT_ERR_DEPENDENCY,
+				"image requires image %d >= %s; device does not report it",
+				dep.ImageId, dep.MinVersion.String())
+		} else if CompareVersions(have, dep.MinVersion) < 0 {
+			r.add(COMPAT_ERR_DEPENDENCY,
+				"image requires image %d >= %s; device has %s",
+				dep.ImageId, dep.MinVersion.String(), have.String())
+		}
+	}
+}
+
+// CheckCompat determines whether an image can be installed on a device with
+// the given state.  Every failed check is reported.
+func CheckCompat(img Image, dev DeviceState) CompatResult {
+	r := CompatResult{}
+
+	if err := img.VerifyStructure(); err != nil {
+		r.add(COMPAT_ERR_STRUCTURE, "%s", err.Error())
+		return r
+	}
+
+	if dev.SlotSize > 0 {
+		size, err := img.TotalSize()
+		if err != nil {
+			r.add(COMPAT_ERR_SIZE, "%s", err.Error())
+		} else if size > dev.SlotSize {
+			r.add(COMPAT_ERR_SIZE, "image size %d exceeds slot size %d",
+				size, dev.SlotSize)
+		}
+	}
+
+	if !dev.AllowDowngrade &&
+		CompareVersions(img.Header.Vers, dev.Version) <= 0 {
+
+		r.add(COMPAT_ERR_VERSION,
+			"image version %s is not newer than device version %s",
+			img.Header.Vers.String(), dev.Version.String())
+	}
+
+	if img.Header.Flags&IMAGE_F_NON_BOOTABLE != 0 {
+		r.add(COMPAT_ERR_BOOTABLE, "image is not bootable")
+	}
+
+	checkCompatEnc(img, dev, &r)
+	checkCompatSigs(img, dev, &r)
+	checkCompatDeps(img, dev, &r)
+
+	return r
+}
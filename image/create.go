@@ -20,52 +20,333 @@
 package image
 
 import (
-    "fmt"
 	"bytes"
-	"crypto"
-	"crypto/ecdsa"
+	"crypto/cipher"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/asn1"
 	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"hash"
 	"io/ioutil"
+	"log/slog"
 	"math/big"
+	"runtime"
+	"sync"
+	"time"
 
 	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
 	"github.com/apache/mynewt-artifact/sec"
-	"golang.org/x/crypto/ed25519"
 )
 
 type ImageCreator struct {
+	// The created image's body may share this slice's storage, so it
+	// must not be modified while the image is in use.
 	Body         []byte
 	Version      ImageVersion
 	SigKeys      []sec.PrivSignKey
+	Signers      []sec.Signer // Additional signers (e.g., PKCS#11 keys).
 	Sections     []Section
 	HWKeyIndex   int
 	Nonce        []byte
 	PlainSecret  []byte
 	CipherSecret []byte
 	HeaderSize   int
+	HdrPadVal    byte // Fill byte for header padding.
+	BodyAlign    int  // Required alignment of the body start; 0 for none.
+	PadBodyAlign bool // Grow the header to satisfy BodyAlign.
+	BodyPadVal   byte // Fill byte for body and alignment padding.
+	Align        int  // Flash write alignment; 0 for none.
 	InitialHash  []byte
 	Bootable     bool
 	UseLegacyTLV bool
+	EmbedPubKey  bool
+	FullKeyHash  bool       // Untruncated KEYHASH TLVs, as written by imgtool.
+	SignThreads  int        // Concurrent signing limit; 0 for serial.
+	BuildTime    *time.Time // nil to omit the BUILD_TIME TLV.
+	BuildId      []byte     // nil to omit the BUILD_ID TLV.
+	Dependencies []ImageDependency
+	Sbom         *Sbom  // nil to omit the SBOM TLV.
+	Channel      string // "" to omit the CHANNEL TLV.
+	Endianness   Endianness
+
+	// Chunk size of the HASH_TREE TLV; 0 to omit it.
+	HashTreeChunkSize int
+
+	// Product-specific provisioning values; nil to omit the USER_DATA TLV.
+	UserData map[string]interface{}
+
+	// Custom steps applied to the unpadded body; see Transformer.
+	Transformers []Transformer
+
+	// The image hash algorithm; the zero value is SHA256.
+	HashAlg HashAlg
+
+	LoadAddr      uint32     // Written to the header's Pad1 field.
+	RomFixedAddr  *uint32    // Direct-XIP address; nil if not ROM-fixed.
+	ExtraFlags    uint32     // ORed into the header flags.
+	ExtraProtTlvs []ImageTlv // Appended after the dependency TLVs.
+	TlvLayout     TlvLayout  // Order and placement of the unprotected TLVs.
+
+	// If non-nil, each signing operation is reported to this sink along
+	// with AuditMetadata.
+	Audit         sec.AuditSink
+	AuditMetadata map[string]string
+
+	// How KEYHASH TLVs identify keys; the zero value is the default scheme.
+	KeyHash sec.KeyHashScheme
+
+	// Explicitly requests a hash-only (unsigned) development image.
+	// Creation fails if signing keys are also specified.
+	HashOnly bool
+
+	// If true, the hash of an encrypted image covers the ciphertext rather
+	// than the plaintext body, so the image can be verified without its
+	// decryption key.  The bootloader must be built to match.
+	HashCiphertext bool
+
+	// If non-nil, receives debug-level events as the image is created.
+	Logger *slog.Logger
 }
 
 type ImageCreateOpts struct {
+	SrcBin            []byte // Used instead of SrcBinFilename if non-nil.
 	SrcBinFilename    string
+	SrcElfFilename    string // Used instead of SrcBinFilename if set.
+	ElfSections       bool   // Emit a section TLV per ELF section.
 	SrcEncKeyFilename string
 	SrcEncKeyIndex    int
 	Version           ImageVersion
 	SigKeys           []sec.PrivSignKey
+	Signers           []sec.Signer
 	Sections          []Section
 	LoaderHash        []byte
 	HdrPad            int
+	HdrPadVal         *byte   // nil means 0x00.
+	BodyAlign         int     // E.g., vector table alignment; 0 for none.
+	PadBodyAlign      bool    // Grow the header rather than fail.
+	SlotAddr          *uint64 // Checked against the ELF load address.
 	ImagePad          int
+	ImagePadVal       *byte // nil means 0xff.
+	Align             int
 	UseLegacyTLV      bool
+	EmbedPubKey       bool
+	NonceSource       NonceSource
+	Nonce             []byte // Only used with NONCE_SOURCE_CALLER.
+	BuildTimeSource   BuildTimeSource
+	BuildTime         time.Time // Only used with BUILD_TIME_SOURCE_CALLER.
+	BuildId           []byte    // Git SHA or other build identifier.
+	TsaUrl            string    // RFC 3161 TSA to timestamp the image; "" for none.
+	SbomFilename      string    // SPDX or CycloneDX document to bind.
+	Channel           string    // Release channel (e.g., "beta"); "" for none.
+	RomFixedAddr      *uint32   // Direct-XIP address; nil if not ROM-fixed.
+	Endianness        Endianness
+	HashTreeChunkSize int // 0 to omit the HASH_TREE TLV.
+	TlvLayout         TlvLayout
+	ExtraProtTlvs     []ImageTlv
+	SignThreads       int           // Concurrent signing limit; 0 for serial.
+	Audit             sec.AuditSink // Receives an event per signature.
+	AuditMetadata     map[string]string
+	HashOnly          bool // Unsigned development image; see ImageCreator.
+	HashCiphertext    bool // Hash the encrypted body; see ImageCreator.
+	KeyHash           sec.KeyHashScheme
+
+	// Provisioning values for the USER_DATA TLV; nil for none.
+	UserData map[string]interface{}
+
+	// Custom steps applied to the unpadded body; see Transformer.
+	Transformers []Transformer
+
+	// The image hash algorithm; the zero value is SHA256.
+	HashAlg HashAlg
+
+	// With SrcEncKeyIndex: if non-nil, the SrcEncKeyFilename secret is a
+	// master key from which the device's key is derived.
+	DeviceId []byte
+	Kdf      sec.KdfOpts
+
+	// Per-device encryption: if ProvisionRecords is non-nil, the key that
+	// the records assign to ProvisionDeviceId is selected from
+	// SrcEncKeyCandidates and used in place of SrcEncKeyFilename.
+	ProvisionRecords    *sec.ProvisionRecords
+	ProvisionDeviceId   []byte
+	SrcEncKeyCandidates []string
+
+	// Flash areas referenced by name (e.g., "FLASH_AREA_IMAGE_0") rather
+	// than by address.  Names are resolved via FlashMap; an area's address
+	// is FlashBase plus its offset.  A name overrides the corresponding
+	// address field, which must otherwise be nil or agree with it.
+	FlashMap     *flash.FlashMap
+	FlashBase    uint64
+	SlotArea     string // Sets SlotAddr.
+	RomFixedArea string // Sets RomFixedAddr.
+
+	// If non-nil, the created image is measured against this budget; see
+	// GenerateImageWithBudget.
+	SizeBudget *SizeBudget
+
+	Logger *slog.Logger // Debug-level creation events; nil for none.
 }
 
+// flashAreaAddr calculates the address of a flash area referenced by name.
+func flashAreaAddr(opts ImageCreateOpts, name string) (uint64, error) {
+	area, err := opts.FlashMap.ResolveArea(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return opts.FlashBase + uint64(area.Offset), nil
+}
+
+// resolveFlashAreas replaces named flash area references with the
+// corresponding addresses.
+func resolveFlashAreas(opts *ImageCreateOpts) error {
+	if opts.SlotArea != "" {
+		addr, err := flashAreaAddr(*opts, opts.SlotArea)
+		if err != nil {
+			return err
+		}
+		if opts.SlotAddr != nil && *opts.SlotAddr != addr {
+			return errors.Errorf(
+				"slot address conflicts with flash area \"%s\": "+
+					"have=0x%x want=0x%x",
+				opts.SlotArea, *opts.SlotAddr, addr)
+		}
+		opts.SlotAddr = &addr
+	}
+
+	if opts.RomFixedArea != "" {
+		addr, err := flashAreaAddr(*opts, opts.RomFixedArea)
+		if err != nil {
+			return err
+		}
+		if addr > 0xffffffff {
+			return errors.Errorf(
+				"flash area \"%s\" address too large for ROM-fixed "+
+					"image: 0x%x", opts.RomFixedArea, addr)
+		}
+		if opts.RomFixedAddr != nil && uint64(*opts.RomFixedAddr) != addr {
+			return errors.Errorf(
+				"ROM-fixed address conflicts with flash area \"%s\": "+
+					"have=0x%x want=0x%x",
+				opts.RomFixedArea, *opts.RomFixedAddr, addr)
+		}
+		fixed := uint32(addr)
+		opts.RomFixedAddr = &fixed
+	}
+
+	return nil
+}
+
+// selectProvisionedEncKey returns the name of the candidate key file that
+// holds the key provisioned to the target device.
+func selectProvisionedEncKey(opts ImageCreateOpts) (string, error) {
+	if opts.SrcEncKeyFilename != "" {
+		return "", errors.Errorf(
+			"provisioning records and an explicit enc key are mutually " +
+				"exclusive")
+	}
+	if opts.ProvisionDeviceId == nil {
+		return "", errors.Errorf("provisioning records require a device ID")
+	}
+
+	keys, err := sec.ReadPubEncKeys(opts.SrcEncKeyCandidates)
+	if err != nil {
+		return "", err
+	}
+
+	idx, err := opts.ProvisionRecords.SelectEncKey(opts.ProvisionDeviceId,
+		keys)
+	if err != nil {
+		return "", err
+	}
+
+	return opts.SrcEncKeyCandidates[idx], nil
+}
+
+// NonceSource indicates how the AES-CTR nonce of an encrypted image is
+// produced.
+type NonceSource int
+
+const (
+	// Hardware-key images use a derived nonce; key-exchange images use no
+	// nonce (all-zero IV).
+	NONCE_SOURCE_DEFAULT NonceSource = iota
+
+	// The first 8 bytes of the SHA256 of the (padded) plaintext body.
+	NONCE_SOURCE_DERIVED
+
+	// 8 randomly generated bytes.
+	NONCE_SOURCE_RANDOM
+
+	// Supplied by the caller.
+	NONCE_SOURCE_CALLER
+)
+
+const IMAGE_NONCE_SIZE = 8
+
+// BuildTimeSource indicates what timestamp, if any, is recorded in an
+// image's BUILD_TIME TLV.
+type BuildTimeSource int
+
+const (
+	// No BUILD_TIME TLV.
+	BUILD_TIME_SOURCE_NONE BuildTimeSource = iota
+
+	// The current time.
+	BUILD_TIME_SOURCE_NOW
+
+	// The Unix epoch.  Keeps the TLV layout stable for reproducible builds.
+	BUILD_TIME_SOURCE_ZERO
+
+	// Supplied by the caller (e.g., the commit time of the source tree).
+	BUILD_TIME_SOURCE_CALLER
+)
+
+const IMAGE_BUILD_TIME_SIZE = 8
+
+var buildTimeSourceNameMap = map[BuildTimeSource]string{
+	BUILD_TIME_SOURCE_NONE:   "none",
+	BUILD_TIME_SOURCE_NOW:    "now",
+	BUILD_TIME_SOURCE_ZERO:   "zero",
+	BUILD_TIME_SOURCE_CALLER: "caller",
+}
+
+var nonceSourceNameMap = map[NonceSource]string{
+	NONCE_SOURCE_DEFAULT: "default",
+	NONCE_SOURCE_DERIVED: "derived",
+	NONCE_SOURCE_RANDOM:  "random",
+	NONCE_SOURCE_CALLER:  "caller",
+}
+
+// SigTlvOpts controls how signature TLVs are generated.
+type SigTlvOpts struct {
+	// If true, each signature is preceded by a PUBKEY TLV containing the full
+	// public key rather than a KEYHASH TLV.
+	EmbedPubKey bool
+
+	// If true, KEYHASH TLVs contain the full SHA256 of the key, as written by
+	// imgtool, rather than the first four bytes.  Overrides the length of
+	// KeyHash.
+	FullKeyHash bool
+
+	// How KEYHASH TLVs identify keys; the zero value is the default scheme.
+	KeyHash sec.KeyHashScheme
+
+	// The maximum number of signatures computed at once; 0 or 1 signs
+	// serially and SIGN_CONCURRENCY_CPU means one per CPU.  Signing runs
+	// concurrently only at the caller's request, since sec.Signer does not
+	// require Sign to be safe for concurrent use; signers that share state
+	// (e.g., a PKCS#11 session or an ssh-agent connection) must not be
+	// signed with concurrently.  The TLV order does not depend on this
+	// setting.
+	Concurrency int
+}
+
+// Requests one concurrent signing operation per CPU.
+const SIGN_CONCURRENCY_CPU = -1
+
 type ECDSASig struct {
 	R *big.Int
 	S *big.Int
@@ -74,42 +355,32 @@ type ECDSASig struct {
 func NewImageCreator() ImageCreator {
 	return ImageCreator{
 		HeaderSize: IMAGE_HEADER_SIZE,
+		BodyPadVal: 0xff,
 		Bootable:   true,
 	}
 }
 
-func sigTlvType(key sec.PrivSignKey) uint8 {
-	key.AssertValid()
-
-	if key.Rsa != nil {
-		pubk := key.Rsa.Public().(*rsa.PublicKey)
-		switch pubk.Size() {
-		case 256:
-			return IMAGE_TLV_RSA2048
-		case 384:
-			return IMAGE_TLV_RSA3072
-		default:
-			return 0
-		}
-	} else if key.Ec != nil {
-		switch key.Ec.Curve.Params().Name {
-		case "P-224":
-			return IMAGE_TLV_ECDSA224
-		case "P-256":
-			return IMAGE_TLV_ECDSA256
-		default:
-			return 0
-		}
-	} else {
-		return IMAGE_TLV_ED25519
+func sigTlvType(sigType sec.SigType) uint8 {
+	alg, ok := sec.SigAlgForType(sigType)
+	if !ok {
+		return 0
 	}
+
+	return alg.TlvType
 }
 
-// GenerateHWKeyIndexTLV creates a hardware key index TLV.
+// GenerateHWKeyIndexTLV creates a little-endian hardware key index TLV.
 func GenerateHWKeyIndexTLV(secretIndex uint32, useLegacyTLV bool) (ImageTlv, error) {
+	return generateHWKeyIndexTLV(secretIndex, useLegacyTLV,
+		binary.LittleEndian)
+}
+
+func generateHWKeyIndexTLV(secretIndex uint32, useLegacyTLV bool,
+	order binary.ByteOrder) (ImageTlv, error) {
+
 	var tlvType uint8
 	id := make([]byte, 4)
-	binary.LittleEndian.PutUint32(id, secretIndex)
+	order.PutUint32(id, secretIndex)
 
 	if useLegacyTLV {
 		tlvType = IMAGE_TLV_SECRET_ID_LEGACY
@@ -171,12 +442,19 @@ func GenerateEncTlv(cipherSecret []byte) (ImageTlv, error) {
 	}, nil
 }
 
-// GenerateEncTlv creates an encryption-secret TLV given a secret.
+// GenerateSectionTlv creates a little-endian SECTION TLV describing a region
+// of the body.
 func GenerateSectionTlv(section Section) (ImageTlv, error) {
+	return generateSectionTlv(section, binary.LittleEndian)
+}
+
+func generateSectionTlv(section Section,
+	order binary.ByteOrder) (ImageTlv, error) {
+
 	data := make([]byte, 8+len(section.Name))
 
-	binary.LittleEndian.PutUint32(data[0:], uint32(section.Offset))
-	binary.LittleEndian.PutUint32(data[4:], uint32(section.Size))
+	order.PutUint32(data[0:], uint32(section.Offset))
+	order.PutUint32(data[4:], uint32(section.Size))
 	copy(data[8:], section.Name)
 
 	return ImageTlv{
@@ -191,80 +469,33 @@ func GenerateSectionTlv(section Section) (ImageTlv, error) {
 
 // GenerateSig signs an image using an rsa key.
 func GenerateSigRsa(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	opts := rsa.PSSOptions{
-		SaltLength: rsa.PSSSaltLengthEqualsHash,
-	}
-	signature, err := rsa.SignPSS(
-		rand.Reader, key.Rsa, crypto.SHA256, hash, &opts)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to compute signature")
-	}
-
-	return signature, nil
+	return key.Sign(hash)
 }
 
 // GenerateSig signs an image using an ec key.
 func GenerateSigEc(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	r, s, err := ecdsa.Sign(rand.Reader, key.Ec, hash)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to compute signature")
-	}
-
-	ECDSA := ECDSASig{
-		R: r,
-		S: s,
-	}
-
-	signature, err := asn1.Marshal(ECDSA)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to construct signature")
-	}
-
-	sigLen := key.SigLen()
-	if len(signature) > int(sigLen) {
-		return nil, errors.Errorf("signature truncated")
-	}
-
-	return signature, nil
+	return key.Sign(hash)
 }
 
 // GenerateSig signs an image using an ed25519 key.
 func GenerateSigEd25519(key sec.PrivSignKey, hash []byte) ([]byte, error) {
-	sig := ed25519.Sign(*key.Ed25519, hash)
-
-	if len(sig) != ed25519.SignatureSize {
-		return nil, errors.Errorf(
-			"ed25519 signature has wrong length: have=%d want=%d",
-			len(sig), ed25519.SignatureSize)
-	}
-
-	return sig, nil
+	return key.Sign(hash)
 }
 
 // GenerateSig signs an image.
 func GenerateSig(key sec.PrivSignKey, hash []byte) (sec.Sig, error) {
-	pub := key.PubKey()
+	return GenerateSignerSig(&key, hash)
+}
+
+// GenerateSignerSig signs an image using a generic signer.
+func GenerateSignerSig(signer sec.Signer, hash []byte) (sec.Sig, error) {
+	pub := signer.PubKey()
 	typ, err := pub.SigType()
 	if err != nil {
 		return sec.Sig{}, err
 	}
 
-	var data []byte
-
-	switch typ {
-	case sec.SIG_TYPE_RSA2048, sec.SIG_TYPE_RSA3072:
-		data, err = GenerateSigRsa(key, hash)
-
-	case sec.SIG_TYPE_ECDSA224, sec.SIG_TYPE_ECDSA256:
-		data, err = GenerateSigEc(key, hash)
-
-	case sec.SIG_TYPE_ED25519:
-		data, err = GenerateSigEd25519(key, hash)
-
-	default:
-		err = errors.Errorf("unknown sig type: %v", typ)
-	}
-
+	data, err := signer.Sign(hash)
 	if err != nil {
 		return sec.Sig{}, err
 	}
@@ -295,187 +526,721 @@ func BuildKeyHashTlv(keyBytes []byte) ImageTlv {
 	}
 }
 
+// BuildPubKeyTlv produces a public key TLV given a public verification key.
+// Users do not normally need to call this.  Call BuildSigTlvsOpts instead.
+func BuildPubKeyTlv(keyBytes []byte) ImageTlv {
+	data := append([]byte(nil), keyBytes...)
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_PUBKEY,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
 // BuildSigTlvs signs an image and creates a pair of TLVs representing the
 // signature.
 func BuildSigTlvs(keys []sec.PrivSignKey, hash []byte) ([]ImageTlv, error) {
-	var tlvs []ImageTlv
+	return BuildSigTlvsOpts(keys, hash, SigTlvOpts{})
+}
 
-	for _, key := range keys {
-		key.AssertValid()
+// BuildSigTlvsOpts signs an image and creates a pair of TLVs representing the
+// signature.  The opts argument controls how the key is identified.
+func BuildSigTlvsOpts(keys []sec.PrivSignKey, hash []byte,
+	opts SigTlvOpts) ([]ImageTlv, error) {
 
-		// Key hash TLV.
-		pubKey, err := key.PubBytes()
-		if err != nil {
-			return nil, err
+	signers := make([]sec.Signer, len(keys))
+	for i := range keys {
+		keys[i].AssertValid()
+		signers[i] = &keys[i]
+	}
+
+	return BuildSignerSigTlvs(signers, hash, opts)
+}
+
+// generateSignerSigs signs an image with each of the provided signers,
+// running at most concurrency signing operations at once.  The signatures are
+// returned in signer order.  If several signers fail, the error from the
+// first is returned.
+func generateSignerSigs(signers []sec.Signer, hash []byte,
+	concurrency int) ([]sec.Sig, error) {
+
+	if concurrency < 0 {
+		concurrency = runtime.NumCPU()
+	}
+
+	sigs := make([]sec.Sig, len(signers))
+	errs := make([]error, len(signers))
+
+	if concurrency <= 1 || len(signers) <= 1 {
+		for i, signer := range signers {
+			sigs[i], errs[i] = GenerateSignerSig(signer, hash)
+		}
+	} else {
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+
+		for i, signer := range signers {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(i int, signer sec.Signer) {
+				defer wg.Done()
+				sigs[i], errs[i] = GenerateSignerSig(signer, hash)
+				<-sem
+			}(i, signer)
 		}
-		tlv := BuildKeyHashTlv(pubKey)
-		tlvs = append(tlvs, tlv)
 
-		// Signature TLV.
-		sig, err := GenerateSig(key, hash)
+		wg.Wait()
+	}
+
+	for _, err := range errs {
 		if err != nil {
 			return nil, err
 		}
-		tlv = ImageTlv{
-			Header: ImageTlvHdr{
-				Type: sigTlvType(key),
-				Len:  uint16(len(sig.Data)),
-			},
-			Data: sig.Data,
-		}
-		tlvs = append(tlvs, tlv)
 	}
 
-	return tlvs, nil
+	return sigs, nil
 }
 
-// GeneratePlainSecret randomly generates a 16-byte image-encrypting secret.
-func GeneratePlainSecret() ([]byte, error) {
-	plainSecret := make([]byte, 16)
-	if _, err := rand.Read(plainSecret); err != nil {
-		return nil, errors.Wrapf(err, "random generation error")
+// BuildSignerSigTlvs signs an image with each of the provided signers and
+// creates a pair of TLVs representing each signature.  Signatures may be
+// computed concurrently (see SigTlvOpts.Concurrency); the TLVs are in signer
+// order.
+func BuildSignerSigTlvs(signers []sec.Signer, hash []byte,
+	opts SigTlvOpts) ([]ImageTlv, error) {
+
+	sigs, err := generateSignerSigs(signers, hash, opts.Concurrency)
+	if err != nil {
+		return nil, err
 	}
 
-	return plainSecret, nil
+	var tlvs []ImageTlv
+	for i, signer := range signers {
+		pair, err := BuildSigTlvPair(signer.PubKey(), sigs[i], opts)
+		if err != nil {
+			return nil, err
+		}
+		tlvs = append(tlvs, pair...)
+	}
+
+	return tlvs, nil
 }
 
-// GenerateImage produces an Image object from a set of image creation options.
-func GenerateImage(opts ImageCreateOpts) (Image, error) {
-	ic := NewImageCreator()
+// BuildSigTlvPair creates the key hash (or public key) TLV and signature TLV
+// representing a signature made by the given key.  This allows signatures
+// computed elsewhere (e.g., in a threshold signing session) to be attached to
+// an image.
+func BuildSigTlvPair(pub sec.PubSignKey, sig sec.Sig,
+	opts SigTlvOpts) ([]ImageTlv, error) {
 
-	srcBin, err := ioutil.ReadFile(opts.SrcBinFilename)
+	// Key hash or public key TLV.
+	pubKey, err := pub.Bytes()
 	if err != nil {
-		return Image{}, errors.Wrapf(err, "Can't read app binary")
+		return nil, err
+	}
+	var tlv ImageTlv
+	if opts.EmbedPubKey {
+		tlv = BuildPubKeyTlv(pubKey)
+	} else {
+		scheme := opts.KeyHash
+		if opts.FullKeyHash {
+			scheme.Len = sec.KEY_HASH_LEN_FULL
+		}
+		keyHash, err := scheme.Hash(&pub)
+		if err != nil {
+			return nil, err
+		}
+		tlv = BuildKeyHashTlv(pubKey)
+		tlv.Data = keyHash
+		tlv.Header.Len = uint16(len(tlv.Data))
 	}
 
-	ic.Body = srcBin
-	ic.Version = opts.Version
-	ic.SigKeys = opts.SigKeys
-	ic.HWKeyIndex = opts.SrcEncKeyIndex
-	ic.Sections = opts.Sections
-	ic.UseLegacyTLV = opts.UseLegacyTLV
+	// Signature TLV.
+	return []ImageTlv{
+		tlv,
+		{
+			Header: ImageTlvHdr{
+				Type: sigTlvType(sig.Type),
+				Len:  uint16(len(sig.Data)),
+			},
+			Data: sig.Data,
+		},
+	}, nil
+}
 
-	if opts.LoaderHash != nil {
-		ic.InitialHash = opts.LoaderHash
-		ic.Bootable = false
+func NonceSourceString(src NonceSource) string {
+	s := nonceSourceNameMap[src]
+	if s == "" {
+		return "unknown"
 	} else {
-		ic.Bootable = true
+		return s
 	}
+}
 
-	if opts.HdrPad > 0 {
-		ic.HeaderSize = opts.HdrPad
+func NonceStringSource(s string) (NonceSource, error) {
+	for k, v := range nonceSourceNameMap {
+		if s == v {
+			return k, nil
+		}
 	}
 
-	if opts.ImagePad > 0 {
-		tail_pad := opts.ImagePad - (len(ic.Body) % opts.ImagePad)
-		ic.Body = append(ic.Body, bytes.Repeat([]byte{byte(0xff)}, tail_pad)...)
-	}
+	return 0, errors.Errorf("unknown nonce source name: \"%s\"", s)
+}
 
-	if ic.HWKeyIndex >= 0 {
-		hash := sha256.Sum256(ic.Body)
-		ic.Nonce = hash[:8]
+func BuildTimeSourceString(src BuildTimeSource) string {
+	s := buildTimeSourceNameMap[src]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
 	}
+}
 
-	if opts.SrcEncKeyFilename != "" {
-		plainSecret, err := GeneratePlainSecret()
-		if err != nil {
-			return Image{}, err
+func BuildTimeStringSource(s string) (BuildTimeSource, error) {
+	for k, v := range buildTimeSourceNameMap {
+		if s == v {
+			return k, nil
 		}
+	}
 
-		pubKeBytes, err := ioutil.ReadFile(opts.SrcEncKeyFilename)
-		if err != nil {
-			return Image{}, errors.Wrapf(err, "error reading pubkey file")
-		}
+	return 0, errors.Errorf("unknown build time source name: \"%s\"", s)
+}
 
-		if ic.HWKeyIndex < 0 {
-			pubKe, err := sec.ParsePubEncKey(pubKeBytes)
-			if err != nil {
-				return Image{}, err
-			}
+// GenerateBuildTime produces an image timestamp according to the specified
+// source.  nil is returned if the source calls for no timestamp.
+func GenerateBuildTime(src BuildTimeSource,
+	callerTime time.Time) (*time.Time, error) {
 
-			cipherSecret, err := pubKe.Encrypt(plainSecret)
-			if err != nil {
-				return Image{}, err
-			}
+	var t time.Time
 
-			ic.CipherSecret = cipherSecret
-			ic.PlainSecret = plainSecret
-		} else {
-			ic.PlainSecret, err = base64.StdEncoding.DecodeString(string(pubKeBytes))
-			if err != nil {
-				return Image{}, err
-			}
+	switch src {
+	case BUILD_TIME_SOURCE_NONE:
+		return nil, nil
+
+	case BUILD_TIME_SOURCE_NOW:
+		t = time.Now()
+
+	case BUILD_TIME_SOURCE_ZERO:
+		t = time.Unix(0, 0)
+
+	case BUILD_TIME_SOURCE_CALLER:
+		if callerTime.Before(time.Unix(0, 0)) {
+			return nil, errors.Errorf(
+				"caller-supplied build time precedes Unix epoch: %s",
+				callerTime.Format(time.RFC3339))
 		}
-	}
+		t = callerTime
 
-	ri, err := ic.Create()
-	if err != nil {
-		return Image{}, err
+	default:
+		return nil, errors.Errorf("unknown build time source: %d", src)
 	}
 
-	return ri, nil
+	t = t.UTC().Truncate(time.Second)
+	return &t, nil
 }
 
-// calcHash calculates the sha256 for an image with the given components.
-func calcHash(initialHash []byte, hdr ImageHdr, pad []byte,
-	plainBody []byte, protTlvs []ImageTlv) ([]byte, error) {
+// GenerateBuildTimeTlv creates a BUILD_TIME TLV holding the given timestamp
+// as little-endian Unix seconds.
+func GenerateBuildTimeTlv(t time.Time) (ImageTlv, error) {
+	return generateBuildTimeTlv(t, binary.LittleEndian)
+}
 
-    fmt.Printf("PHIL 2\n")
+func generateBuildTimeTlv(t time.Time,
+	order binary.ByteOrder) (ImageTlv, error) {
 
-	hash := sha256.New()
+	if t.Before(time.Unix(0, 0)) {
+		return ImageTlv{}, errors.Errorf(
+			"build time precedes Unix epoch: %s", t.Format(time.RFC3339))
+	}
 
-	add := func(itf interface{}) error {
-		b := &bytes.Buffer{}
-		if err := binary.Write(b, binary.LittleEndian, itf); err != nil {
-			return err
-		}
-		if err := binary.Write(hash, binary.LittleEndian, itf); err != nil {
-			return errors.Wrapf(err, "failed to hash data")
-		}
+	data := make([]byte, IMAGE_BUILD_TIME_SIZE)
+	order.PutUint64(data, uint64(t.Unix()))
 
-		return nil
-	}
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_BUILD_TIME,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}, nil
+}
 
-	if initialHash != nil {
-		if err := add(initialHash); err != nil {
-			return nil, err
-		}
-	}
+// The maximum size of a BUILD_ID TLV; large enough for a SHA256-based git
+// object ID.
+const IMAGE_BUILD_ID_MAX_SIZE = 32
 
-	if err := add(hdr); err != nil {
-		return nil, err
+// ParseBuildId decodes a hex build identifier, such as a git commit SHA.
+func ParseBuildId(s string) ([]byte, error) {
+	id, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, errors.Errorf("invalid build ID: \"%s\"", s)
 	}
 
-	if err := add(pad); err != nil {
-		return nil, err
+	if len(id) == 0 || len(id) > IMAGE_BUILD_ID_MAX_SIZE {
+		return nil, errors.Errorf(
+			"build ID has invalid length: have=%d want=1-%d",
+			len(id), IMAGE_BUILD_ID_MAX_SIZE)
 	}
 
-	if err := add(plainBody); err != nil {
-		return nil, err
+	return id, nil
+}
+
+// GenerateBuildIdTlv creates a BUILD_ID TLV holding the given identifier.
+func GenerateBuildIdTlv(id []byte) (ImageTlv, error) {
+	if len(id) == 0 || len(id) > IMAGE_BUILD_ID_MAX_SIZE {
+		return ImageTlv{}, errors.Errorf(
+			"build ID has invalid length: have=%d want=1-%d",
+			len(id), IMAGE_BUILD_ID_MAX_SIZE)
 	}
 
-	if len(protTlvs) > 0 {
-		trailer := ImageTrailer{
-			Magic:     IMAGE_PROT_TRAILER_MAGIC,
-			TlvTotLen: hdr.ProtSz,
+	data := append([]byte(nil), id...)
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_BUILD_ID,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}, nil
+}
+
+// DeriveNonce calculates the nonce that NONCE_SOURCE_DERIVED produces for the
+// given plaintext body.
+func DeriveNonce(plainBody []byte) []byte {
+	hash := sha256.Sum256(plainBody)
+	return hash[:IMAGE_NONCE_SIZE]
+}
+
+// GenerateNonce produces an image nonce according to the specified source.
+// hwKey indicates whether the image is to be encrypted with a hardware key;
+// it only affects the behavior of NONCE_SOURCE_DEFAULT.  A nil nonce (i.e.,
+// an all-zero IV) is returned if the source calls for no nonce.
+func GenerateNonce(src NonceSource, plainBody []byte, callerNonce []byte,
+	hwKey bool) ([]byte, error) {
+
+	switch src {
+	case NONCE_SOURCE_DEFAULT:
+		if !hwKey {
+			return nil, nil
 		}
-		if err := add(trailer); err != nil {
-			return nil, err
+		return DeriveNonce(plainBody), nil
+
+	case NONCE_SOURCE_DERIVED:
+		return DeriveNonce(plainBody), nil
+
+	case NONCE_SOURCE_RANDOM:
+		nonce := make([]byte, IMAGE_NONCE_SIZE)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, errors.Wrapf(err, "random generation error")
 		}
+		return nonce, nil
 
-		for _, tlv := range protTlvs {
-			if err := add(tlv.Header); err != nil {
-				return nil, err
-			}
-			if err := add(tlv.Data); err != nil {
-				return nil, err
-			}
+	case NONCE_SOURCE_CALLER:
+		if len(callerNonce) == 0 || len(callerNonce) > 16 {
+			return nil, errors.Errorf(
+				"caller-supplied nonce has invalid length: have=%d want=1-16",
+				len(callerNonce))
 		}
+		return append([]byte(nil), callerNonce...), nil
+
+	default:
+		return nil, errors.Errorf("unknown nonce source: %d", src)
+	}
+}
+
+// GeneratePlainSecret randomly generates a 16-byte image-encrypting secret.
+func GeneratePlainSecret() ([]byte, error) {
+	plainSecret := make([]byte, 16)
+	if _, err := rand.Read(plainSecret); err != nil {
+		return nil, errors.Wrapf(err, "random generation error")
+	}
+
+	return plainSecret, nil
+}
+
+// GenerateImage produces an Image object from a set of image creation options.
+func GenerateImage(opts ImageCreateOpts) (Image, error) {
+	img, _, err := GenerateImageWithBudget(opts)
+	return img, err
+}
+
+// GenerateImageWithBudget creates an image and, if opts.SizeBudget is
+// non-nil, reports its size relative to the budget.  If the budget is
+// enforced and the image exceeds it, the report is returned along with an
+// error.
+func GenerateImageWithBudget(opts ImageCreateOpts) (
+	Image, SizeBudgetReport, error) {
+
+	img, err := generateImage(opts)
+	if err != nil || opts.SizeBudget == nil {
+		return img, SizeBudgetReport{}, err
+	}
+
+	r, err := opts.SizeBudget.Check(img, opts.FlashMap, opts.SlotArea)
+	if err != nil {
+		return img, r, err
+	}
+
+	logOrDiscard(opts.Logger).Debug("size budget",
+		"budget", r.Budget,
+		"used", r.Used,
+		"free", r.Free,
+		"growth", r.Growth)
+
+	if opts.SizeBudget.Enforce {
+		if err := r.Err(); err != nil {
+			return img, r, err
+		}
+	}
+
+	return img, r, nil
+}
+
+func generateImage(opts ImageCreateOpts) (Image, error) {
+	ic := NewImageCreator()
+
+	if err := resolveFlashAreas(&opts); err != nil {
+		return Image{}, err
+	}
+
+	var srcBin []byte
+	var elfSections []Section
+	var elfLoadAddr *uint64
+	var err error
+	if opts.SrcElfFilename != "" {
+		padVal := byte(0xff)
+		if opts.ImagePadVal != nil {
+			padVal = *opts.ImagePadVal
+		}
+
+		ei, err := ReadElf(opts.SrcElfFilename, padVal)
+		if err != nil {
+			return Image{}, err
+		}
+		srcBin = ei.Body
+		elfLoadAddr = &ei.LoadAddr
+		if opts.ElfSections {
+			elfSections = ei.Sections
+		}
+	} else if opts.SrcBin != nil {
+		// Clip the capacity so that padding never writes into the caller's
+		// backing array.
+		srcBin = opts.SrcBin[:len(opts.SrcBin):len(opts.SrcBin)]
+	} else {
+		srcBin, err = ioutil.ReadFile(opts.SrcBinFilename)
+		if err != nil {
+			return Image{}, errors.Wrapf(err, "Can't read app binary")
+		}
+	}
+
+	l := logOrDiscard(opts.Logger)
+	l.Debug("read image source",
+		"size", len(srcBin),
+		"elf", opts.SrcElfFilename != "")
+
+	ic.Logger = opts.Logger
+	ic.Body = srcBin
+	ic.Version = opts.Version
+	ic.SigKeys = opts.SigKeys
+	ic.Signers = opts.Signers
+	ic.HWKeyIndex = opts.SrcEncKeyIndex
+	ic.Sections = append(append([]Section(nil), opts.Sections...),
+		elfSections...)
+	ic.UseLegacyTLV = opts.UseLegacyTLV
+	ic.EmbedPubKey = opts.EmbedPubKey
+
+	if opts.LoaderHash != nil {
+		ic.InitialHash = opts.LoaderHash
+		ic.Bootable = false
+	} else {
+		ic.Bootable = true
+	}
+
+	if opts.HdrPad > 0 {
+		ic.HeaderSize = opts.HdrPad
+	}
+
+	ic.BodyAlign = opts.BodyAlign
+	ic.PadBodyAlign = opts.PadBodyAlign
+	ic.HeaderSize, err = ic.bodyAlignedHeaderSize()
+	if err != nil {
+		return Image{}, err
+	}
+
+	if elfLoadAddr != nil && opts.SlotAddr != nil {
+		err := CheckLoadAddr(*elfLoadAddr, *opts.SlotAddr, ic.HeaderSize)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	ic.ExtraProtTlvs = opts.ExtraProtTlvs
+	ic.Transformers = opts.Transformers
+	if err := ic.applyTransformers(); err != nil {
+		return Image{}, err
+	}
+
+	if opts.HdrPadVal != nil {
+		ic.HdrPadVal = *opts.HdrPadVal
+	}
+	if opts.ImagePadVal != nil {
+		ic.BodyPadVal = *opts.ImagePadVal
+	}
+
+	if opts.ImagePad > 0 {
+		tail_pad := opts.ImagePad - (len(ic.Body) % opts.ImagePad)
+		ic.Body = append(ic.Body, bytes.Repeat([]byte{ic.BodyPadVal}, tail_pad)...)
+	}
+
+	// Apply alignment padding now so that a derived nonce covers the final
+	// body.
+	ic.Align = opts.Align
+	ic.Body, err = ic.alignedBody()
+	if err != nil {
+		return Image{}, err
+	}
+
+	if opts.SbomFilename != "" {
+		doc, err := ioutil.ReadFile(opts.SbomFilename)
+		if err != nil {
+			return Image{}, errors.Wrapf(err, "error reading SBOM file")
+		}
+
+		sbom, err := NewSbom(doc)
+		if err != nil {
+			return Image{}, err
+		}
+		ic.Sbom = &sbom
+	}
+
+	ic.BuildId = opts.BuildId
+	ic.Channel = opts.Channel
+	ic.UserData = opts.UserData
+	ic.HashAlg = opts.HashAlg
+	ic.RomFixedAddr = opts.RomFixedAddr
+	ic.SignThreads = opts.SignThreads
+	ic.Audit = opts.Audit
+	ic.AuditMetadata = opts.AuditMetadata
+	ic.HashOnly = opts.HashOnly
+	ic.HashCiphertext = opts.HashCiphertext
+	ic.KeyHash = opts.KeyHash
+	ic.Endianness = opts.Endianness
+	ic.HashTreeChunkSize = opts.HashTreeChunkSize
+	ic.TlvLayout = opts.TlvLayout
+	ic.BuildTime, err = GenerateBuildTime(opts.BuildTimeSource, opts.BuildTime)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if opts.NonceSource != NONCE_SOURCE_DEFAULT &&
+		opts.SrcEncKeyFilename == "" && opts.ProvisionRecords == nil {
+
+		return Image{}, errors.Errorf(
+			"nonce source \"%s\" requires an encryption key",
+			NonceSourceString(opts.NonceSource))
+	}
+
+	if ic.HWKeyIndex >= 0 || opts.NonceSource != NONCE_SOURCE_DEFAULT {
+		ic.Nonce, err = GenerateNonce(opts.NonceSource, ic.Body, opts.Nonce,
+			ic.HWKeyIndex >= 0)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	if opts.ProvisionRecords != nil {
+		opts.SrcEncKeyFilename, err = selectProvisionedEncKey(opts)
+		if err != nil {
+			return Image{}, err
+		}
+	}
+
+	if opts.SrcEncKeyFilename != "" {
+		plainSecret, err := GeneratePlainSecret()
+		if err != nil {
+			return Image{}, err
+		}
+
+		pubKeBytes, err := ioutil.ReadFile(opts.SrcEncKeyFilename)
+		if err != nil {
+			return Image{}, errors.Wrapf(err, "error reading pubkey file")
+		}
+
+		if ic.HWKeyIndex < 0 {
+			pubKe, err := sec.ParsePubEncKey(pubKeBytes)
+			if err != nil {
+				return Image{}, err
+			}
+
+			cipherSecret, err := pubKe.Encrypt(plainSecret)
+			if err != nil {
+				return Image{}, err
+			}
+
+			ic.CipherSecret = cipherSecret
+			ic.PlainSecret = plainSecret
+		} else {
+			ic.PlainSecret, err = base64.StdEncoding.DecodeString(string(pubKeBytes))
+			if err != nil {
+				return Image{}, err
+			}
+
+			if opts.DeviceId != nil {
+				ic.PlainSecret, err = sec.DeriveDeviceKey(ic.PlainSecret,
+					opts.DeviceId, opts.Kdf)
+				if err != nil {
+					return Image{}, err
+				}
+			}
+		}
+	}
+
+	if opts.DeviceId != nil &&
+		(ic.HWKeyIndex < 0 || opts.SrcEncKeyFilename == "") {
+
+		return Image{}, errors.Errorf(
+			"device key derivation requires a hardware key index and " +
+				"master key")
+	}
+
+	ri, err := ic.Create()
+	if err != nil {
+		return Image{}, err
+	}
+
+	if opts.TsaUrl != "" {
+		if err := ri.RequestTimestamp(opts.TsaUrl); err != nil {
+			return Image{}, err
+		}
+	}
+
+	return ri, nil
+}
+
+// calcHash calculates the hash of an image with the given components.
+func calcHash(alg HashAlg, initialHash []byte, order binary.ByteOrder,
+	hdr ImageHdr, pad []byte, plainBody []byte,
+	protTlvs []ImageTlv) ([]byte, error) {
+
+	hash, err := alg.New()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := hashPrefix(hash, order, initialHash, hdr, pad); err != nil {
+		return nil, err
+	}
+
+	if err := hashAdd(hash, order, plainBody); err != nil {
+		return nil, err
+	}
+
+	if err := hashSuffix(hash, order, hdr, protTlvs); err != nil {
+		return nil, err
 	}
 
 	return hash.Sum(nil), nil
 }
 
+// The number of body bytes hashed and encrypted at a time when creating an
+// encrypted image.  Small enough that each chunk is still in cache when it
+// is encrypted.
+const IMAGE_PIPELINE_CHUNK_SIZE = 32 * 1024
+
+// calcHashEncrypt calculates an image's hash and encrypts its body in a
+// single pass.  Each chunk of plaintext is hashed and then encrypted while
+// it is still in cache.  It returns the hash and the encrypted body.
+func calcHashEncrypt(alg HashAlg, initialHash []byte, order binary.ByteOrder,
+	hdr ImageHdr, pad []byte, plainBody []byte, protTlvs []ImageTlv,
+	stream cipher.Stream) ([]byte, []byte, error) {
+
+	hash, err := alg.New()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := hashPrefix(hash, order, initialHash, hdr, pad); err != nil {
+		return nil, nil, err
+	}
+
+	encBody := make([]byte, len(plainBody))
+	for off := 0; off < len(plainBody); off += IMAGE_PIPELINE_CHUNK_SIZE {
+		end := off + IMAGE_PIPELINE_CHUNK_SIZE
+		if end > len(plainBody) {
+			end = len(plainBody)
+		}
+
+		chunk := plainBody[off:end]
+		hash.Write(chunk)
+		stream.XORKeyStream(encBody[off:end], chunk)
+	}
+
+	if err := hashSuffix(hash, order, hdr, protTlvs); err != nil {
+		return nil, nil, err
+	}
+
+	return hash.Sum(nil), encBody, nil
+}
+
+func hashAdd(h hash.Hash, order binary.ByteOrder, itf interface{}) error {
+	if err := binary.Write(h, order, itf); err != nil {
+		return errors.Wrapf(err, "failed to hash data")
+	}
+
+	return nil
+}
+
+// hashPrefix adds everything that precedes the body to an image hash.
+func hashPrefix(h hash.Hash, order binary.ByteOrder, initialHash []byte,
+	hdr ImageHdr, pad []byte) error {
+
+	if initialHash != nil {
+		if err := hashAdd(h, order, initialHash); err != nil {
+			return err
+		}
+	}
+
+	if err := hashAdd(h, order, hdr); err != nil {
+		return err
+	}
+
+	if err := hashAdd(h, order, pad); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// hashSuffix adds the protected TLVs, if any, to an image hash.
+func hashSuffix(h hash.Hash, order binary.ByteOrder, hdr ImageHdr,
+	protTlvs []ImageTlv) error {
+	if len(protTlvs) == 0 {
+		return nil
+	}
+
+	trailer := ImageTrailer{
+		Magic:     IMAGE_PROT_TRAILER_MAGIC,
+		TlvTotLen: hdr.ProtSz,
+	}
+	if err := hashAdd(h, order, trailer); err != nil {
+		return err
+	}
+
+	for _, tlv := range protTlvs {
+		if err := hashAdd(h, order, tlv.Header); err != nil {
+			return err
+		}
+		if err := hashAdd(h, order, tlv.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // calcProtSize calculates the size, in bytes, of a set of protected TLVs.
 func calcProtSize(protTlvs []ImageTlv) uint16 {
 	var size = uint16(0)
@@ -489,18 +1254,215 @@ func calcProtSize(protTlvs []ImageTlv) uint16 {
 	return size
 }
 
+// The largest supported flash write alignment.
+const IMAGE_MAX_ALIGN = 32
+
+// ValidateAlign checks that a flash write alignment is one this package
+// supports.  0 indicates no alignment.
+func ValidateAlign(align int) error {
+	switch align {
+	case 0, 1, 2, 4, 8, 16, IMAGE_MAX_ALIGN:
+		return nil
+	default:
+		return errors.Errorf(
+			"invalid alignment: have=%d want=1, 2, 4, 8, 16, or 32", align)
+	}
+}
+
+// ValidateBodyAlign checks that a body alignment is a power of two.  0
+// indicates no alignment requirement.
+func ValidateBodyAlign(align int) error {
+	if align < 0 || align&(align-1) != 0 {
+		return errors.Errorf(
+			"invalid body alignment: have=%d want=power of two", align)
+	}
+
+	return nil
+}
+
+// bodyAlignedHeaderSize returns the header size to use such that the body,
+// which immediately follows the header, starts on an ic.BodyAlign boundary
+// relative to the start of the slot.  Many targets require this of the
+// vector table.  If the configured header size does not satisfy the
+// requirement, it is rounded up if ic.PadBodyAlign is set; otherwise an
+// error is returned.
+func (ic *ImageCreator) bodyAlignedHeaderSize() (int, error) {
+	if err := ValidateBodyAlign(ic.BodyAlign); err != nil {
+		return 0, err
+	}
+
+	hdrSz := ic.HeaderSize
+	if hdrSz == 0 {
+		hdrSz = IMAGE_HEADER_SIZE
+	}
+
+	if ic.BodyAlign <= 1 || hdrSz%ic.BodyAlign == 0 {
+		return hdrSz, nil
+	}
+
+	if !ic.PadBodyAlign {
+		return 0, errors.Errorf(
+			"image body offset not aligned: hdr-sz=0x%x body-align=0x%x; "+
+				"adjust the header padding", hdrSz, ic.BodyAlign)
+	}
+
+	return (hdrSz + ic.BodyAlign - 1) &^ (ic.BodyAlign - 1), nil
+}
+
+// CheckLoadAddr verifies that a binary linked to run at loadAddr is placed
+// correctly when written to the slot at slotAddr, i.e., that the linker's
+// FLASH origin accounts for the image header.
+func CheckLoadAddr(loadAddr uint64, slotAddr uint64, hdrSz int) error {
+	want := slotAddr + uint64(hdrSz)
+	if loadAddr != want {
+		return errors.Errorf(
+			"load address does not match slot address plus header size: "+
+				"load-addr=0x%x slot-addr=0x%x hdr-sz=0x%x want=0x%x",
+			loadAddr, slotAddr, hdrSz, want)
+	}
+
+	return nil
+}
+
+// applyTransformers runs the creator's transformers over its unpadded body,
+// its extra header flags, and its extra protected TLVs, and then clears
+// them.  This happens before the body is aligned and before a derived nonce
+// is calculated, so both reflect the transformed body.
+func (ic *ImageCreator) applyTransformers() error {
+	if len(ic.Transformers) == 0 {
+		return nil
+	}
+
+	img := Image{
+		Header: ImageHdr{
+			Magic: IMAGE_MAGIC,
+			Flags: ic.ExtraFlags,
+			Vers:  ic.Version,
+		},
+		Body:       append([]byte(nil), ic.Body...),
+		Endianness: ic.Endianness,
+	}
+	for _, tlv := range ic.ExtraProtTlvs {
+		img.ProtTlvs = append(img.ProtTlvs, tlv.Clone())
+	}
+
+	img, err := ApplyTransformers(img, ic.Transformers)
+	if err != nil {
+		return err
+	}
+
+	ic.Body = img.Body
+	ic.ExtraFlags = img.Header.Flags
+	ic.ExtraProtTlvs = img.ProtTlvs
+	ic.Transformers = nil
+
+	return nil
+}
+
+// alignedBody returns the body padded such that the trailer which follows it
+// begins on an ic.Align boundary.  The original body is returned if no
+// padding is required.
+func (ic *ImageCreator) alignedBody() ([]byte, error) {
+	if err := ValidateAlign(ic.Align); err != nil {
+		return nil, err
+	}
+
+	if ic.Align <= 1 {
+		return ic.Body, nil
+	}
+
+	hdrSz, err := ic.bodyAlignedHeaderSize()
+	if err != nil {
+		return nil, err
+	}
+
+	rem := (hdrSz + len(ic.Body)) % ic.Align
+	if rem == 0 {
+		return ic.Body, nil
+	}
+
+	body := make([]byte, len(ic.Body), len(ic.Body)+ic.Align-rem)
+	copy(body, ic.Body)
+	return append(body, bytes.Repeat([]byte{ic.BodyPadVal}, ic.Align-rem)...), nil
+}
+
 // Create produces an Image object.
 func (ic *ImageCreator) Create() (Image, error) {
-	img := Image{}
+	return ic.create(nil)
+}
+
+// CreateWithStats creates an image and reports the time spent in each stage
+// of its creation.
+func (ic *ImageCreator) CreateWithStats() (Image, Stats, error) {
+	var stats Stats
+	img, err := ic.create(&stats)
+	return img, stats, err
+}
+
+func (ic *ImageCreator) create(stats *Stats) (Image, error) {
+	if len(ic.Transformers) > 0 {
+		// Transform a copy so that the caller's creator is unchanged.
+		dup := *ic
+		if err := dup.applyTransformers(); err != nil {
+			return Image{}, err
+		}
+		return dup.create(stats)
+	}
+
+	c := newStatsCollector(stats)
+	defer c.finish()
+
+	l := logOrDiscard(ic.Logger)
+	l.Debug("creating image",
+		"version", ic.Version.String(),
+		"body_size", len(ic.Body),
+		"header_size", ic.HeaderSize,
+		"encrypted", ic.PlainSecret != nil,
+		"hash_ciphertext", ic.HashCiphertext,
+		"signers", len(ic.SigKeys)+len(ic.Signers))
+
+	img := Image{
+		Endianness: ic.Endianness,
+	}
+
+	if ic.HashOnly && (len(ic.SigKeys) > 0 || len(ic.Signers) > 0) {
+		return img, errors.Errorf(
+			"hash-only image requested, but signing keys specified")
+	}
+
+	if ic.HashCiphertext && ic.PlainSecret == nil {
+		return img, errors.Errorf(
+			"ciphertext hash requested, but image not encrypted")
+	}
+
+	if _, err := ic.HashAlg.New(); err != nil {
+		return img, err
+	}
+
+	if err := ValidateTlvLayout(ic.TlvLayout); err != nil {
+		return img, err
+	}
+	if len(ic.TlvLayout.Protected) > 0 &&
+		(ic.PlainSecret != nil || ic.InitialHash != nil) {
+
+		return img, errors.Errorf(
+			"protected signatures are not supported for encrypted or " +
+				"split images")
+	}
+
+	body, err := ic.alignedBody()
+	if err != nil {
+		return img, err
+	}
 
 	// First the header
 	img.Header = ImageHdr{
 		Magic:  IMAGE_MAGIC,
-		Pad1:   0,
+		Pad1:   ic.LoadAddr,
 		HdrSz:  IMAGE_HEADER_SIZE,
 		ProtSz: 0,
-		ImgSz:  uint32(len(ic.Body)),
-		Flags:  0,
+		ImgSz:  uint32(len(body)),
+		Flags:  ic.ExtraFlags,
 		Vers:   ic.Version,
 		Pad3:   0,
 	}
@@ -509,27 +1471,48 @@ func (ic *ImageCreator) Create() (Image, error) {
 		img.Header.Flags |= IMAGE_F_NON_BOOTABLE
 	}
 
+	if ic.RomFixedAddr != nil {
+		if ic.LoadAddr != 0 && ic.LoadAddr != *ic.RomFixedAddr {
+			return img, errors.Errorf(
+				"load address conflicts with ROM-fixed address: "+
+					"load=0x%08x rom-fixed=0x%08x",
+				ic.LoadAddr, *ic.RomFixedAddr)
+		}
+		img.Header.Pad1 = *ic.RomFixedAddr
+		img.Header.Flags |= IMAGE_F_ROM_FIXED
+	}
+
 	// Set encrypted image flag if image is to be treated as encrypted
 	if ic.CipherSecret != nil && ic.HWKeyIndex < 0 {
 		img.Header.Flags |= IMAGE_F_ENCRYPTED
 	}
 
-	if ic.HeaderSize != 0 {
-		// Pad the header out to the given size.  There will just be zeros
-		// between the header and the start of the image when it is padded.
-		extra := ic.HeaderSize - IMAGE_HEADER_SIZE
+	hdrSz := ic.HeaderSize
+	if ic.BodyAlign > 1 {
+		hdrSz, err = ic.bodyAlignedHeaderSize()
+		if err != nil {
+			return img, err
+		}
+	}
+
+	if hdrSz != 0 {
+		// Pad the header out to the given size.  The padding between the
+		// header and the start of the image is filled with HdrPadVal.
+		extra := hdrSz - IMAGE_HEADER_SIZE
 		if extra < 0 {
 			return img, errors.Errorf(
 				"image header must be at least %d bytes", IMAGE_HEADER_SIZE)
 		}
 
-		img.Header.HdrSz = uint16(ic.HeaderSize)
-		img.Pad = make([]byte, extra)
+		img.Header.HdrSz = uint16(hdrSz)
+		img.Pad = bytes.Repeat([]byte{ic.HdrPadVal}, extra)
 	}
 
+	order := ic.Endianness.ByteOrder()
+
 	if ic.HWKeyIndex >= 0 {
-		tlv, err := GenerateHWKeyIndexTLV(uint32(ic.HWKeyIndex),
-			ic.UseLegacyTLV)
+		tlv, err := generateHWKeyIndexTLV(uint32(ic.HWKeyIndex),
+			ic.UseLegacyTLV, order)
 		if err != nil {
 			return img, err
 		}
@@ -540,48 +1523,131 @@ func (ic *ImageCreator) Create() (Image, error) {
 			return img, err
 		}
 		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	} else if ic.CipherSecret != nil && ic.Nonce != nil {
+		// Key-exchange encryption with an explicit nonce.  Record the nonce
+		// so that the image can be decrypted.
+		tlv, err := GenerateNonceTLV(ic.Nonce, ic.UseLegacyTLV)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
 	}
 
 	for s := range ic.Sections {
-		tlv, err := GenerateSectionTlv(ic.Sections[s])
+		tlv, err := generateSectionTlv(ic.Sections[s], order)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	}
+
+	if ic.BuildTime != nil {
+		tlv, err := generateBuildTimeTlv(*ic.BuildTime, order)
 		if err != nil {
 			return img, err
 		}
 		img.ProtTlvs = append(img.ProtTlvs, tlv)
 	}
 
+	if ic.BuildId != nil {
+		tlv, err := GenerateBuildIdTlv(ic.BuildId)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	}
+
+	for _, dep := range ic.Dependencies {
+		img.ProtTlvs = append(img.ProtTlvs, buildDependencyTlv(dep, order))
+	}
+
+	for _, tlv := range ic.ExtraProtTlvs {
+		img.ProtTlvs = append(img.ProtTlvs, tlv.Clone())
+	}
+
+	if ic.Sbom != nil {
+		tlv, err := GenerateSbomTlv(*ic.Sbom)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	}
+
+	if ic.Channel != "" {
+		tlv, err := GenerateChannelTlv(ic.Channel)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	}
+
+	if ic.UserData != nil {
+		tlv, err := GenerateUserDataTlv(ic.UserData)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+	}
+
+	if ic.RomFixedAddr != nil {
+		img.ProtTlvs = append(img.ProtTlvs,
+			GenerateFixedAddrTlv(*ic.RomFixedAddr))
+	}
+
+	if ic.HashTreeChunkSize > 0 {
+		tlv, err := ic.generateHashTreeTlv(body)
+		if err != nil {
+			return img, err
+		}
+		img.ProtTlvs = append(img.ProtTlvs, tlv)
+		c.hashed(len(body))
+	}
+
 	img.Header.ProtSz = calcProtSize(img.ProtTlvs)
+	c.stage(STATS_STAGE_PREPARE)
 
 	// Followed by data.
 	var hashBytes []byte
-	var err error
-	if ic.PlainSecret != nil {
+	if ic.PlainSecret != nil && ic.HashCiphertext {
+		img.Body, err = sec.EncryptAES(body, ic.PlainSecret, ic.Nonce)
+		if err != nil {
+			return img, err
+		}
+		hashBytes, err = img.calcHashAlg(ic.HashAlg, ic.InitialHash)
+		if err != nil {
+			return img, err
+		}
+	} else if ic.PlainSecret != nil {
 		// For encrypted images, must calculate the hash with the plain
 		// body and encrypt the payload afterwards
-        fmt.Printf("PHILS MOD 1\n")
-		img.Body = append(img.Body, ic.Body...)
-		hashBytes, err = img.CalcHash(ic.InitialHash)
+		stream, err := sec.NewAESStream(ic.PlainSecret, ic.Nonce)
 		if err != nil {
 			return img, err
 		}
-		encBody, err := sec.EncryptAES(ic.Body, ic.PlainSecret, ic.Nonce)
+		hashBytes, img.Body, err = calcHashEncrypt(ic.HashAlg,
+			ic.InitialHash, img.Endianness.ByteOrder(), img.Header,
+			img.Pad, body, img.ProtTlvs, stream)
 		if err != nil {
 			return img, err
 		}
-		img.Body = nil
-		img.Body = append(img.Body, encBody...)
 	} else {
-		img.Body = append(img.Body, ic.Body...)
-		hashBytes, err = img.CalcHash(ic.InitialHash)
+		img.Body = body
+		hashBytes, err = img.calcHashAlg(ic.HashAlg, ic.InitialHash)
 		if err != nil {
 			return img, err
 		}
 	}
 
+	c.hashed(img.hashedSize(ic.InitialHash))
+	c.stage(STATS_STAGE_HASH)
+	l.Debug("image hash calculated",
+		"sha256", hex.EncodeToString(hashBytes),
+		"bytes_hashed", img.hashedSize(ic.InitialHash))
+
 	// Hash TLV.
 	tlv := ImageTlv{
 		Header: ImageTlvHdr{
-			Type: IMAGE_TLV_SHA256,
+			Type: ic.HashAlg.TlvType(),
 			Pad:  0,
 			Len:  uint16(len(hashBytes)),
 		},
@@ -589,12 +1655,43 @@ func (ic *ImageCreator) Create() (Image, error) {
 	}
 	img.Tlvs = append(img.Tlvs, tlv)
 
-	tlvs, err := BuildSigTlvs(ic.SigKeys, hashBytes)
+	var signers []sec.Signer
+	for i := range ic.SigKeys {
+		signers = append(signers, &ic.SigKeys[i])
+	}
+	signers = append(signers, ic.Signers...)
+	if ic.Audit != nil {
+		signers = sec.AuditSigners(signers, ic.Audit, ic.AuditMetadata)
+	}
+
+	tlvs, err := BuildSignerSigTlvs(signers, hashBytes, SigTlvOpts{
+		EmbedPubKey: ic.EmbedPubKey,
+		FullKeyHash: ic.FullKeyHash,
+		KeyHash:     ic.KeyHash,
+		Concurrency: ic.SignThreads,
+	})
 	if err != nil {
 		return img, err
 	}
 	img.Tlvs = append(img.Tlvs, tlvs...)
 
+	if len(ic.TlvLayout.Protected) > 0 {
+		// The signatures cover the hash calculated above.  The image hash
+		// covers the signatures as well.
+		img.protectSigs(ic.TlvLayout.Protected)
+		hashBytes, err = img.calcHashAlg(ic.HashAlg, nil)
+		if err != nil {
+			return img, err
+		}
+		img.FindTlvs(ic.HashAlg.TlvType())[0].Data = hashBytes
+
+		if err := img.ValidateTlvPlacement(); err != nil {
+			return img, err
+		}
+	}
+	c.stage(STATS_STAGE_SIGN)
+	img.logSigs(l, "image signed")
+
 	if ic.HWKeyIndex < 0 && ic.CipherSecret != nil {
 		tlv, err := GenerateEncTlv(ic.CipherSecret)
 		if err != nil {
@@ -603,5 +1700,45 @@ func (ic *ImageCreator) Create() (Image, error) {
 		img.Tlvs = append(img.Tlvs, tlv)
 	}
 
+	img.ArrangeTlvs(ic.TlvLayout)
+
+	if ic.Align > 1 {
+		// Pad the end of the image out to a multiple of the write alignment.
+		size, err := img.TotalSize()
+		if err != nil {
+			return img, err
+		}
+		if rem := size % ic.Align; rem != 0 {
+			img.TailPad = bytes.Repeat([]byte{ic.BodyPadVal}, ic.Align-rem)
+		}
+	}
+	c.stage(STATS_STAGE_FINISH)
+
+	img.logTlvs(l, "generated tlv")
+	if size, err := img.TotalSize(); err == nil {
+		l.Debug("image created", "total_size", size)
+	}
+
 	return img, nil
 }
+
+// generateHashTreeTlv creates a HASH_TREE TLV for the given plaintext body.
+// The tree covers the body as it is stored, so an encrypted body is
+// encrypted before it is hashed.
+func (ic *ImageCreator) generateHashTreeTlv(body []byte) (ImageTlv, error) {
+	stored := body
+	if ic.PlainSecret != nil {
+		var err error
+		stored, err = sec.EncryptAES(body, ic.PlainSecret, ic.Nonce)
+		if err != nil {
+			return ImageTlv{}, err
+		}
+	}
+
+	ht, err := BuildHashTree(stored, ic.HashTreeChunkSize)
+	if err != nil {
+		return ImageTlv{}, err
+	}
+
+	return GenerateHashTreeTlv(ht)
+}
@@ -0,0 +1,163 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// TlvDecoder converts the value of a TLV into a short human-readable string.
+type TlvDecoder func(data []byte) (string, error)
+
+var imageTlvDecoderMap = map[uint8]TlvDecoder{
+	IMAGE_TLV_DEPENDENCY:       decodeDependencyTlv,
+	IMAGE_TLV_SECTION:          decodeSectionTlv,
+	IMAGE_TLV_SECRET_ID:        decodeSecretIdTlv,
+	IMAGE_TLV_SECRET_ID_LEGACY: decodeSecretIdTlv,
+	IMAGE_TLV_ENC_RSA:          encAlgDecoder("RSA-OAEP"),
+	IMAGE_TLV_ENC_KEK:          encAlgDecoder("AES-KW"),
+	IMAGE_TLV_ENC_EC256:        encAlgDecoder("ECIES-P256"),
+	IMAGE_TLV_ENC_X25519:       encAlgDecoder("ECIES-X25519"),
+	IMAGE_TLV_BUILD_TIME:       decodeBuildTimeTlv,
+	IMAGE_TLV_SBOM:             decodeSbomTlv,
+	IMAGE_TLV_CHANNEL:          decodeChannelTlv,
+	IMAGE_TLV_HASH_TREE:        decodeHashTreeTlv,
+	IMAGE_TLV_FIXED_ADDR:       decodeFixedAddrTlv,
+	IMAGE_TLV_XIP_PEER:         decodeXipPeerTlv,
+	IMAGE_TLV_SERIAL_INFO:      decodeSerialInfoTlv,
+	IMAGE_TLV_USER_DATA:        decodeUserDataTlv,
+}
+
+// RegisterTlvDecoder installs a decoder for the given TLV type, replacing any
+// existing one.  This allows vendor TLVs to be rendered in image dumps.
+func RegisterTlvDecoder(tlvType uint8, d TlvDecoder) {
+	imageTlvDecoderMap[tlvType] = d
+}
+
+// Decode produces a human-readable rendering of a TLV's value.  TLV types
+// without a decoder are rendered as hex.
+func (tlv *ImageTlv) Decode() (string, error) {
+	d := imageTlvDecoderMap[tlv.Header.Type]
+	if d == nil {
+		return hex.EncodeToString(tlv.Data), nil
+	}
+
+	return d(tlv.Data)
+}
+
+// String renders a TLV as "TYPE: value".  If the value cannot be decoded, it
+// is printed as hex.
+func (tlv *ImageTlv) String() string {
+	s, err := tlv.Decode()
+	if err != nil {
+		s = hex.EncodeToString(tlv.Data)
+	}
+
+	return fmt.Sprintf("%s: %s", ImageTlvTypeName(tlv.Header.Type), s)
+}
+
+func decodeDependencyTlv(data []byte) (string, error) {
+	if len(data) != IMAGE_DEPENDENCY_SIZE {
+		return "", errors.Errorf(
+			"invalid DEPENDENCY TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_DEPENDENCY_SIZE)
+	}
+
+	ver := ImageVersion{
+		Major:    data[4],
+		Minor:    data[5],
+		Rev:      binary.LittleEndian.Uint16(data[6:]),
+		BuildNum: binary.LittleEndian.Uint32(data[8:]),
+	}
+
+	return fmt.Sprintf("img%d >= %s", data[0], ver.String()), nil
+}
+
+func decodeSectionTlv(data []byte) (string, error) {
+	if len(data) < 8 {
+		return "", errors.Errorf(
+			"invalid SECTION TLV: have-len=%d want-len>=8", len(data))
+	}
+
+	return fmt.Sprintf("%s offset=0x%x size=%d",
+		string(data[8:]),
+		binary.LittleEndian.Uint32(data[0:]),
+		binary.LittleEndian.Uint32(data[4:])), nil
+}
+
+func decodeSecretIdTlv(data []byte) (string, error) {
+	if len(data) != 4 {
+		return "", errors.Errorf(
+			"invalid SEC_KEY_ID TLV: have-len=%d want-len=4", len(data))
+	}
+
+	return fmt.Sprintf("%d", binary.LittleEndian.Uint32(data)), nil
+}
+
+func encAlgDecoder(alg string) TlvDecoder {
+	return func(data []byte) (string, error) {
+		return fmt.Sprintf("%s (%d bytes)", alg, len(data)), nil
+	}
+}
+
+func decodeBuildTimeTlv(data []byte) (string, error) {
+	if len(data) != IMAGE_BUILD_TIME_SIZE {
+		return "", errors.Errorf(
+			"invalid BUILD_TIME TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_BUILD_TIME_SIZE)
+	}
+
+	secs := binary.LittleEndian.Uint64(data)
+	return time.Unix(int64(secs), 0).UTC().Format(time.RFC3339), nil
+}
+
+func decodeSbomTlv(data []byte) (string, error) {
+	if len(data) != IMAGE_SBOM_SIZE {
+		return "", errors.Errorf(
+			"invalid SBOM TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_SBOM_SIZE)
+	}
+
+	return fmt.Sprintf("%s sha256=%s",
+		SbomFormatString(SbomFormat(data[0])),
+		hex.EncodeToString(data[4:])), nil
+}
+
+func decodeUserDataTlv(data []byte) (string, error) {
+	m, err := DecodeUserData(data)
+	if err != nil {
+		return "", err
+	}
+
+	return userDataString(m), nil
+}
+
+func decodeChannelTlv(data []byte) (string, error) {
+	if err := ValidateChannel(string(data)); err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
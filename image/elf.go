@@ -0,0 +1,155 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"debug/elf"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Refuse to flatten ELF files whose loadable segments are spread further
+// apart than this; such files almost certainly mix RAM and flash addresses.
+const ELF_MAX_IMAGE_SIZE = 16 * 1024 * 1024
+
+// ElfImage is the flat binary extracted from an ELF file.
+type ElfImage struct {
+	// Contents of all loadable segments, placed at their load addresses
+	// relative to LoadAddr.  Gaps between segments are filled with the pad
+	// byte passed to ParseElf.
+	Body []byte
+
+	// Physical (load) address of the first byte of Body.
+	LoadAddr uint64
+
+	// Allocated sections with file contents, as offsets into Body.
+	Sections []Section
+}
+
+type elfSeg struct {
+	prog *elf.Prog
+	data []byte
+}
+
+// ParseElf extracts a flat image body from an ELF file.  Loadable segments
+// are placed according to their physical addresses, so initialized data is
+// included at its flash location rather than its run-time RAM address.
+func ParseElf(r io.ReaderAt, padVal byte) (ElfImage, error) {
+	f, err := elf.NewFile(r)
+	if err != nil {
+		return ElfImage{}, errors.Wrapf(err, "failed to parse ELF file")
+	}
+	defer f.Close()
+
+	var segs []elfSeg
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Filesz == 0 {
+			continue
+		}
+
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return ElfImage{}, errors.Wrapf(err,
+				"failed to read ELF segment at 0x%x", prog.Paddr)
+		}
+
+		segs = append(segs, elfSeg{prog, data})
+	}
+
+	if len(segs) == 0 {
+		return ElfImage{}, errors.Errorf("ELF file has no loadable segments")
+	}
+
+	sort.Slice(segs, func(i int, j int) bool {
+		return segs[i].prog.Paddr < segs[j].prog.Paddr
+	})
+
+	base := segs[0].prog.Paddr
+	last := segs[len(segs)-1].prog
+	end := last.Paddr + last.Filesz
+	if end-base > ELF_MAX_IMAGE_SIZE {
+		return ElfImage{}, errors.Errorf(
+			"ELF loadable segments span too large a range: "+
+				"0x%x-0x%x (max %d bytes)", base, end, ELF_MAX_IMAGE_SIZE)
+	}
+
+	body := bytes.Repeat([]byte{padVal}, int(end-base))
+	for i, seg := range segs {
+		off := seg.prog.Paddr - base
+		if i > 0 {
+			prev := segs[i-1].prog
+			if seg.prog.Paddr < prev.Paddr+prev.Filesz {
+				return ElfImage{}, errors.Errorf(
+					"ELF segments overlap at 0x%x", seg.prog.Paddr)
+			}
+		}
+		copy(body[off:], seg.data)
+	}
+
+	ei := ElfImage{
+		Body:     body,
+		LoadAddr: base,
+	}
+
+	// Map each allocated section into the body via the segment that
+	// contains it.
+	for _, s := range f.Sections {
+		if s.Type != elf.SHT_PROGBITS || s.Flags&elf.SHF_ALLOC == 0 ||
+			s.Size == 0 {
+
+			continue
+		}
+
+		for _, seg := range segs {
+			p := seg.prog
+			if s.Offset >= p.Off && s.Offset+s.Size <= p.Off+p.Filesz {
+				lma := p.Paddr + (s.Offset - p.Off)
+				ei.Sections = append(ei.Sections, Section{
+					Name:   s.Name,
+					Offset: int(lma - base),
+					Size:   int(s.Size),
+				})
+				break
+			}
+		}
+	}
+
+	return ei, nil
+}
+
+// ReadElf extracts a flat image body from the specified ELF file.
+func ReadElf(filename string, padVal byte) (ElfImage, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ElfImage{}, errors.Wrapf(err, "failed to open ELF file")
+	}
+	defer f.Close()
+
+	ei, err := ParseElf(f, padVal)
+	if err != nil {
+		return ElfImage{}, errors.Wrapf(err, "%s", filename)
+	}
+
+	return ei, nil
+}
@@ -0,0 +1,251 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image_test
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+)
+
+// buildElf constructs a minimal 32-bit ARM executable with a .text segment
+// and a .data segment whose load address follows .text in flash.
+func buildElf() []byte {
+	text := []byte{0x01, 0x02, 0x03, 0x04}
+	data := []byte{0x05, 0x06, 0x07, 0x08}
+	shstrtab := []byte("\x00.text\x00.data\x00.shstrtab\x00")
+
+	const (
+		phOff   = 52
+		textOff = phOff + 2*32
+		dataOff = textOff + 4
+		strOff  = dataOff + 4
+		shOff   = 148
+	)
+
+	hdr := elf.Header32{
+		Type:      uint16(elf.ET_EXEC),
+		Machine:   uint16(elf.EM_ARM),
+		Version:   uint32(elf.EV_CURRENT),
+		Entry:     0x8020,
+		Phoff:     phOff,
+		Shoff:     shOff,
+		Ehsize:    52,
+		Phentsize: 32,
+		Phnum:     2,
+		Shentsize: 40,
+		Shnum:     4,
+		Shstrndx:  3,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	progs := []elf.Prog32{
+		{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    textOff,
+			Vaddr:  0x8020,
+			Paddr:  0x8020,
+			Filesz: 4,
+			Memsz:  4,
+			Flags:  uint32(elf.PF_R | elf.PF_X),
+		},
+		{
+			Type:   uint32(elf.PT_LOAD),
+			Off:    dataOff,
+			Vaddr:  0x20000000,
+			Paddr:  0x8030,
+			Filesz: 4,
+			Memsz:  4,
+			Flags:  uint32(elf.PF_R | elf.PF_W),
+		},
+	}
+
+	sections := []elf.Section32{
+		{},
+		{
+			Name:  1,
+			Type:  uint32(elf.SHT_PROGBITS),
+			Flags: uint32(elf.SHF_ALLOC | elf.SHF_EXECINSTR),
+			Addr:  0x8020,
+			Off:   textOff,
+			Size:  4,
+		},
+		{
+			Name:  7,
+			Type:  uint32(elf.SHT_PROGBITS),
+			Flags: uint32(elf.SHF_ALLOC | elf.SHF_WRITE),
+			Addr:  0x20000000,
+			Off:   dataOff,
+			Size:  4,
+		},
+		{
+			Name: 13,
+			Type: uint32(elf.SHT_STRTAB),
+			Off:  strOff,
+			Size: uint32(len(shstrtab)),
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, hdr)
+	binary.Write(buf, binary.LittleEndian, progs)
+	buf.Write(text)
+	buf.Write(data)
+	buf.Write(shstrtab)
+	for buf.Len() < shOff {
+		buf.WriteByte(0)
+	}
+	binary.Write(buf, binary.LittleEndian, sections)
+
+	return buf.Bytes()
+}
+
+func TestParseElf(t *testing.T) {
+	ei, err := image.ParseElf(bytes.NewReader(buildElf()), 0xff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ei.LoadAddr != 0x8020 {
+		t.Fatalf("wrong load address: have=0x%x want=0x8020", ei.LoadAddr)
+	}
+
+	expBody := []byte{
+		0x01, 0x02, 0x03, 0x04, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x05, 0x06, 0x07, 0x08,
+	}
+	if !bytes.Equal(ei.Body, expBody) {
+		t.Fatalf("wrong body: have=%x want=%x", ei.Body, expBody)
+	}
+
+	expSections := []image.Section{
+		{Name: ".text", Offset: 0, Size: 4},
+		{Name: ".data", Offset: 16, Size: 4},
+	}
+	if len(ei.Sections) != len(expSections) {
+		t.Fatalf("wrong section count: have=%d want=%d",
+			len(ei.Sections), len(expSections))
+	}
+	for i, s := range expSections {
+		if ei.Sections[i] != s {
+			t.Fatalf("wrong section %d: have=%+v want=%+v",
+				i, ei.Sections[i], s)
+		}
+	}
+}
+
+func TestGenerateImageElf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.elf")
+	if err := ioutil.WriteFile(path, buildElf(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := image.GenerateImage(image.ImageCreateOpts{
+		SrcElfFilename: path,
+		ElfSections:    true,
+		Version:        image.ImageVersion{Major: 1, Minor: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(img.Body) != 20 {
+		t.Fatalf("wrong body size: have=%d want=20", len(img.Body))
+	}
+	if tlvs := img.FindProtTlvs(image.IMAGE_TLV_SECTION); len(tlvs) != 2 {
+		t.Fatalf("wrong section TLV count: have=%d want=2", len(tlvs))
+	}
+}
+
+func TestBodyAlign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.elf")
+	if err := ioutil.WriteFile(path, buildElf(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test ELF is linked at 0x8020: a slot at 0x8000 with a 0x20 byte
+	// header.
+	slotAddr := uint64(0x8000)
+	opts := image.ImageCreateOpts{
+		SrcElfFilename: path,
+		SlotAddr:       &slotAddr,
+		BodyAlign:      0x20,
+	}
+	img, err := image.GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.HdrSz != 0x20 {
+		t.Fatalf("wrong header size: have=0x%x want=0x20", img.Header.HdrSz)
+	}
+
+	// Header too small for the required alignment.
+	opts.BodyAlign = 0x80
+	if _, err := image.GenerateImage(opts); err == nil {
+		t.Fatalf("misaligned body accepted")
+	}
+
+	// Padding the header moves the body away from the link address.
+	opts.PadBodyAlign = true
+	if _, err := image.GenerateImage(opts); err == nil {
+		t.Fatalf("load address mismatch accepted")
+	}
+
+	// Without the load address check, the header is padded.
+	opts.SlotAddr = nil
+	img, err = image.GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.HdrSz != 0x80 || len(img.Pad) != 0x60 {
+		t.Fatalf("wrong header padding: hdr-sz=0x%x pad=%d",
+			img.Header.HdrSz, len(img.Pad))
+	}
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.BodyAlign = 3
+	if _, err := image.GenerateImage(opts); err == nil {
+		t.Fatalf("invalid body alignment accepted")
+	}
+}
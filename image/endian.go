@@ -0,0 +1,90 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/binary"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Endianness is the byte order of an image's header, trailers, and TLV
+// headers.  MCUboot reads these structures in the target's native byte order,
+// so images for big-endian MCUs must be encoded big-endian.
+//
+// Multi-byte values within the DEPENDENCY, SECTION, SEC_KEY_ID, and
+// BUILD_TIME TLV payloads use the same byte order.
+type Endianness int
+
+const (
+	ENDIANNESS_LITTLE Endianness = iota
+	ENDIANNESS_BIG
+)
+
+var endiannessNameMap = map[Endianness]string{
+	ENDIANNESS_LITTLE: "little",
+	ENDIANNESS_BIG:    "big",
+}
+
+func EndiannessString(e Endianness) string {
+	s := endiannessNameMap[e]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func EndiannessFromString(s string) (Endianness, error) {
+	for k, v := range endiannessNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown endianness: \"%s\"", s)
+}
+
+// ByteOrder returns the binary.ByteOrder corresponding to an endianness.
+func (e Endianness) ByteOrder() binary.ByteOrder {
+	if e == ENDIANNESS_BIG {
+		return binary.BigEndian
+	}
+
+	return binary.LittleEndian
+}
+
+// DetectEndianness determines an image's endianness from its header magic.
+// It returns false if the data does not begin with a v2 image magic in
+// either byte order.
+func DetectEndianness(imgData []byte) (Endianness, bool) {
+	if len(imgData) < 4 {
+		return ENDIANNESS_LITTLE, false
+	}
+
+	switch {
+	case binary.LittleEndian.Uint32(imgData) == IMAGE_MAGIC:
+		return ENDIANNESS_LITTLE, true
+	case binary.BigEndian.Uint32(imgData) == IMAGE_MAGIC:
+		return ENDIANNESS_BIG, true
+	default:
+		return ENDIANNESS_LITTLE, false
+	}
+}
@@ -0,0 +1,53 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"testing"
+)
+
+func FuzzParseImage(f *testing.F) {
+	for _, name := range []string{
+		"good-unsigned-unencrypted",
+		"good-signed-unencrypted",
+		"good-signed-encrypted",
+		"bad-hash",
+		"truncated",
+		"garbage",
+	} {
+		f.Add(readImageData(name))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		img, strictErr := ParseImage(data)
+		if strictErr == nil {
+			// Anything that parses must serialize.
+			if _, err := img.Bin(); err != nil {
+				t.Fatalf("parsed image failed to serialize: %s", err.Error())
+			}
+		}
+
+		_, warnings, err := ParseImageOpts(data, ParseOpts{Lenient: true})
+		if strictErr == nil && (err != nil || len(warnings) > 0) {
+			t.Fatalf("lenient parse of valid image reported problems: "+
+				"err=%v warnings=%v", err, warnings)
+		}
+	})
+}
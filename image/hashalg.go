@@ -0,0 +1,119 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto/sha256"
+	"hash"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/blake2s"
+)
+
+// HashAlg is the algorithm used to calculate an image's hash.  MCUboot uses
+// SHA256; BLAKE2s-256 is offered for bootloaders built with that algorithm
+// instead.  The algorithm is identified by the type of the image's hash TLV.
+// Both algorithms produce 32-byte digests, so signatures and other TLVs that
+// cover the hash are unaffected by the choice.
+type HashAlg int
+
+const (
+	HASH_ALG_SHA256 HashAlg = iota
+	HASH_ALG_BLAKE2S
+)
+
+var hashAlgNameMap = map[HashAlg]string{
+	HASH_ALG_SHA256:  "sha256",
+	HASH_ALG_BLAKE2S: "blake2s",
+}
+
+var hashAlgTlvTypeMap = map[HashAlg]uint8{
+	HASH_ALG_SHA256:  IMAGE_TLV_SHA256,
+	HASH_ALG_BLAKE2S: IMAGE_TLV_BLAKE2S,
+}
+
+func HashAlgString(alg HashAlg) string {
+	s := hashAlgNameMap[alg]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func HashAlgFromString(s string) (HashAlg, error) {
+	for k, v := range hashAlgNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown hash algorithm: \"%s\"", s)
+}
+
+// TlvType returns the type of the TLV that carries a hash calculated with
+// the algorithm.
+func (alg HashAlg) TlvType() uint8 {
+	return hashAlgTlvTypeMap[alg]
+}
+
+// New returns a hash.Hash implementing the algorithm.
+func (alg HashAlg) New() (hash.Hash, error) {
+	switch alg {
+	case HASH_ALG_SHA256:
+		return sha256.New(), nil
+	case HASH_ALG_BLAKE2S:
+		return blake2s.New256(nil)
+	default:
+		return nil, errors.Errorf("unknown hash algorithm: %d", int(alg))
+	}
+}
+
+// ImageTlvTypeIsHash indicates whether a TLV type carries an image hash.
+func ImageTlvTypeIsHash(tlvType uint8) bool {
+	for _, t := range hashAlgTlvTypeMap {
+		if t == tlvType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HashAlg determines the algorithm of an image's hash from the type of its
+// hash TLV.  An image without a hash TLV is assumed to use SHA256.
+func (img *Image) HashAlg() (HashAlg, error) {
+	found := false
+	alg := HASH_ALG_SHA256
+
+	for a, t := range hashAlgTlvTypeMap {
+		if len(img.FindTlvs(t)) == 0 {
+			continue
+		}
+		if found {
+			return 0, errors.Errorf(
+				"image contains hash TLVs of more than one algorithm")
+		}
+		found = true
+		alg = a
+	}
+
+	return alg, nil
+}
@@ -0,0 +1,423 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// This file implements the HASH_TREE TLV: a Merkle tree over fixed-size chunks
+// of an image body.  It allows a device or OTA client to verify a large image
+// one chunk at a time as it is downloaded, rather than only after the entire
+// image has been received.
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const HASH_TREE_DEFAULT_CHUNK_SIZE = 4096
+
+// Domain separation prefixes, as in RFC 6962, prevent a leaf hash from being
+// passed off as an interior node.
+const (
+	hashTreeLeafPrefix = 0x00
+	hashTreeNodePrefix = 0x01
+)
+
+// The size of the fixed portion of a HASH_TREE TLV: chunk size and root hash.
+const HASH_TREE_TLV_HDR_SIZE = 4 + sha256.Size
+
+// HashTree is a Merkle tree over the chunks of an image body.  Leaves[i] is
+// the hash of the i'th ChunkSize-byte chunk; the final chunk may be short.
+type HashTree struct {
+	ChunkSize int
+	Root      []byte
+	Leaves    [][]byte
+}
+
+func hashTreeLeaf(chunk []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{hashTreeLeafPrefix})
+	h.Write(chunk)
+	return h.Sum(nil)
+}
+
+func hashTreeNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{hashTreeNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// hashTreeRoot calculates the root of a Merkle tree with the given leaves.  A
+// node without a sibling is promoted to the next level unchanged.
+func hashTreeRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return hashTreeLeaf(nil)
+	}
+
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, hashTreeNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+// ValidateHashTreeChunkSize checks that a hash tree chunk size is a nonzero
+// power of two.
+func ValidateHashTreeChunkSize(chunkSize int) error {
+	if chunkSize <= 0 || chunkSize&(chunkSize-1) != 0 {
+		return errors.Errorf(
+			"invalid hash tree chunk size: %d (must be a power of two)",
+			chunkSize)
+	}
+
+	return nil
+}
+
+// BuildHashTree calculates the hash tree for the given data.
+func BuildHashTree(data []byte, chunkSize int) (HashTree, error) {
+	if err := ValidateHashTreeChunkSize(chunkSize); err != nil {
+		return HashTree{}, err
+	}
+
+	ht := HashTree{
+		ChunkSize: chunkSize,
+	}
+	for off := 0; off < len(data); off += chunkSize {
+		end := off + chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ht.Leaves = append(ht.Leaves, hashTreeLeaf(data[off:end]))
+	}
+	ht.Root = hashTreeRoot(ht.Leaves)
+
+	return ht, nil
+}
+
+// NumChunks returns the number of chunks the tree covers.
+func (ht *HashTree) NumChunks() int {
+	return len(ht.Leaves)
+}
+
+// ChunkRange returns the offset and size of the given chunk within data of
+// the given total size.
+func (ht *HashTree) ChunkRange(idx int, dataSize int) (int, int) {
+	off := idx * ht.ChunkSize
+	size := ht.ChunkSize
+	if off+size > dataSize {
+		size = dataSize - off
+	}
+
+	return off, size
+}
+
+// Validate checks that a hash tree's leaves produce its root.  The root is
+// the only value covered by an image's hash; the leaves must not be trusted
+// until they have been validated.
+func (ht *HashTree) Validate() error {
+	if err := ValidateHashTreeChunkSize(ht.ChunkSize); err != nil {
+		return err
+	}
+
+	if root := hashTreeRoot(ht.Leaves); !bytes.Equal(root, ht.Root) {
+		return errors.Errorf(
+			"hash tree leaves do not match root: have=%x want=%x",
+			root, ht.Root)
+	}
+
+	return nil
+}
+
+// VerifyChunk checks a single chunk against the tree.  The tree itself should
+// be validated first.
+func (ht *HashTree) VerifyChunk(idx int, chunk []byte) error {
+	if idx < 0 || idx >= len(ht.Leaves) {
+		return errors.Errorf("hash tree chunk index out of range: %d (%d chunks)",
+			idx, len(ht.Leaves))
+	}
+	if len(chunk) > ht.ChunkSize {
+		return errors.Errorf("hash tree chunk too large: have=%d want<=%d",
+			len(chunk), ht.ChunkSize)
+	}
+
+	if !bytes.Equal(hashTreeLeaf(chunk), ht.Leaves[idx]) {
+		return errors.Errorf("hash tree chunk %d does not match", idx)
+	}
+
+	return nil
+}
+
+// VerifyData checks that a hash tree describes the given data.
+func (ht *HashTree) VerifyData(data []byte) error {
+	if err := ht.Validate(); err != nil {
+		return err
+	}
+
+	want := (len(data) + ht.ChunkSize - 1) / ht.ChunkSize
+	if len(ht.Leaves) != want {
+		return errors.Errorf(
+			"hash tree chunk count mismatch: have=%d want=%d",
+			len(ht.Leaves), want)
+	}
+
+	for i := range ht.Leaves {
+		off, size := ht.ChunkRange(i, len(data))
+		if err := ht.VerifyChunk(i, data[off:off+size]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GenerateHashTreeTlv creates a HASH_TREE TLV.  The TLV consists of the
+// 32-bit chunk size, the root hash, and the leaf hashes.
+func GenerateHashTreeTlv(ht HashTree) (ImageTlv, error) {
+	size := HASH_TREE_TLV_HDR_SIZE + len(ht.Leaves)*sha256.Size
+	if size > 0xffff {
+		return ImageTlv{}, errors.Errorf(
+			"hash tree too large for TLV: %d chunks of %d bytes; "+
+				"use a larger chunk size", len(ht.Leaves), ht.ChunkSize)
+	}
+
+	data := make([]byte, 4, size)
+	binary.LittleEndian.PutUint32(data, uint32(ht.ChunkSize))
+	data = append(data, ht.Root...)
+	for _, leaf := range ht.Leaves {
+		data = append(data, leaf...)
+	}
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_HASH_TREE,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}, nil
+}
+
+// ParseHashTreeTlv parses the value of a HASH_TREE TLV.  The resulting tree
+// is not validated.
+func ParseHashTreeTlv(data []byte) (HashTree, error) {
+	if len(data) < HASH_TREE_TLV_HDR_SIZE ||
+		(len(data)-HASH_TREE_TLV_HDR_SIZE)%sha256.Size != 0 {
+
+		return HashTree{}, errors.Errorf(
+			"invalid HASH_TREE TLV: length=%d", len(data))
+	}
+
+	ht := HashTree{
+		ChunkSize: int(binary.LittleEndian.Uint32(data)),
+		Root:      data[4:HASH_TREE_TLV_HDR_SIZE],
+	}
+	for off := HASH_TREE_TLV_HDR_SIZE; off < len(data); off += sha256.Size {
+		ht.Leaves = append(ht.Leaves, data[off:off+sha256.Size])
+	}
+
+	return ht, nil
+}
+
+// HashTree returns the tree in an image's protected HASH_TREE TLV, or nil if
+// the image does not have one.
+func (img *Image) HashTree() (*HashTree, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_HASH_TREE)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	ht, err := ParseHashTreeTlv(tlv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ht, nil
+}
+
+// VerifyHashTree checks an image's hash tree against its body (as stored,
+// i.e., encrypted if the image is encrypted).  It succeeds if the image has
+// no hash tree.
+func (img *Image) VerifyHashTree() error {
+	ht, err := img.HashTree()
+	if err != nil {
+		return err
+	}
+	if ht == nil {
+		return nil
+	}
+
+	return ht.VerifyData(img.Body)
+}
+
+// verifyPolicyHashTree checks an image's hash tree, if it has one.  It
+// returns true if the tree was checked against the body.
+func (img *Image) verifyPolicyHashTree(r *VerifyReport) bool {
+	ht, err := img.HashTree()
+	if err == nil && ht == nil {
+		return false
+	}
+	hashed := false
+	if err == nil {
+		err = ht.VerifyData(img.Body)
+		hashed = true
+	}
+
+	detail := ""
+	if ht != nil {
+		detail = fmt.Sprintf("chunks=%d chunk_size=%d",
+			ht.NumChunks(), ht.ChunkSize)
+	}
+	r.add(VERIFY_RULE_HASH_TREE, err, detail)
+
+	return hashed
+}
+
+func decodeHashTreeTlv(data []byte) (string, error) {
+	ht, err := ParseHashTreeTlv(data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("chunk_size=%d chunks=%d root=%x",
+		ht.ChunkSize, ht.NumChunks(), ht.Root), nil
+}
+
+// ByteRange is a contiguous span of bytes.
+type ByteRange struct {
+	Offset int
+	Size   int
+}
+
+// DownloadReport describes the state of a partially downloaded image body.
+// Each chunk index appears in exactly one of the lists.
+type DownloadReport struct {
+	// Chunks that were fully downloaded and match the hash tree.
+	Verified []int
+
+	// Chunks that were fully downloaded but do not match the hash tree.
+	Corrupt []int
+
+	// Chunks that were not, or only partially, downloaded.
+	Missing []int
+
+	chunkSize int
+	bodySize  int
+}
+
+// Complete indicates whether every chunk has been downloaded and verified.
+func (r *DownloadReport) Complete() bool {
+	return len(r.Corrupt) == 0 && len(r.Missing) == 0
+}
+
+// Refetch returns the body ranges that must be downloaded (again) to complete
+// the body: all corrupt and missing chunks, with adjacent chunks coalesced.
+// Offsets are relative to the start of the body; the body begins HdrSz bytes
+// into the image.
+func (r *DownloadReport) Refetch() []ByteRange {
+	chunks := append(append([]int(nil), r.Corrupt...), r.Missing...)
+	sort.Ints(chunks)
+
+	var ranges []ByteRange
+	for _, c := range chunks {
+		off := c * r.chunkSize
+		size := r.chunkSize
+		if off+size > r.bodySize {
+			size = r.bodySize - off
+		}
+
+		if n := len(ranges); n > 0 &&
+			ranges[n-1].Offset+ranges[n-1].Size == off {
+
+			ranges[n-1].Size += size
+		} else {
+			ranges = append(ranges, ByteRange{Offset: off, Size: size})
+		}
+	}
+
+	return ranges
+}
+
+// VerifyDownload checks the portion of an image body that has been downloaded
+// so far.  data contains the body bytes starting at the given offset; bodySize
+// is the size of the complete body (the header's ImgSz).  Chunks that only
+// partially overlap the downloaded data are reported as missing.
+//
+// An error is returned if the tree itself is invalid or does not describe a
+// body of the given size; in that case no chunk can be trusted.
+func (ht *HashTree) VerifyDownload(bodySize int, offset int,
+	data []byte) (DownloadReport, error) {
+
+	r := DownloadReport{
+		chunkSize: ht.ChunkSize,
+		bodySize:  bodySize,
+	}
+
+	if err := ht.Validate(); err != nil {
+		return r, err
+	}
+
+	want := (bodySize + ht.ChunkSize - 1) / ht.ChunkSize
+	if len(ht.Leaves) != want {
+		return r, errors.Errorf(
+			"hash tree chunk count mismatch: have=%d want=%d",
+			len(ht.Leaves), want)
+	}
+
+	if offset < 0 || offset+len(data) > bodySize {
+		return r, errors.Errorf(
+			"downloaded range [%d, %d) outside of body (size=%d)",
+			offset, offset+len(data), bodySize)
+	}
+
+	end := offset + len(data)
+	for i := range ht.Leaves {
+		off, size := ht.ChunkRange(i, bodySize)
+		if off < offset || off+size > end {
+			r.Missing = append(r.Missing, i)
+			continue
+		}
+
+		chunk := data[off-offset : off-offset+size]
+		if ht.VerifyChunk(i, chunk) == nil {
+			r.Verified = append(r.Verified, i)
+		} else {
+			r.Corrupt = append(r.Corrupt, i)
+		}
+	}
+
+	return r, nil
+}
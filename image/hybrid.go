@@ -0,0 +1,189 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// HybridPolicy determines which signatures of a hybrid (classical + PQC)
+// signer must verify.  An image is hybrid-signed by listing both of the
+// signer's private keys in ImageCreator.SigKeys.
+type HybridPolicy int
+
+const (
+	// Either the classical or the post-quantum signature suffices.
+	HYBRID_POLICY_ANY HybridPolicy = iota
+
+	// Both signatures must be present and valid.
+	HYBRID_POLICY_ALL
+
+	// The classical signature must be valid.  The post-quantum signature is
+	// optional, but if present it must also be valid.  Intended for fleets
+	// migrating to post-quantum signatures.
+	HYBRID_POLICY_CLASSICAL_THEN_PQC
+)
+
+var hybridPolicyNameMap = map[HybridPolicy]string{
+	HYBRID_POLICY_ANY:                "any",
+	HYBRID_POLICY_ALL:                "all",
+	HYBRID_POLICY_CLASSICAL_THEN_PQC: "classical-then-pqc",
+}
+
+func HybridPolicyString(policy HybridPolicy) string {
+	s := hybridPolicyNameMap[policy]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func HybridStringPolicy(s string) (HybridPolicy, error) {
+	for k, v := range hybridPolicyNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown hybrid policy name: \"%s\"", s)
+}
+
+// hybridSigState indicates whether a key signed an image, and whether the
+// signature is valid.
+type hybridSigState int
+
+const (
+	hybridSigAbsent hybridSigState = iota
+	hybridSigInvalid
+	hybridSigValid
+)
+
+func hybridCheckKey(key sec.PubSignKey, sigs []sec.Sig,
+	hash []byte) (hybridSigState, error) {
+
+	var keySigs []sec.Sig
+	for _, sig := range sigs {
+		match, err := sec.KeyHashMatchesKey(&key, sig.KeyHash)
+		if err != nil {
+			return hybridSigAbsent, err
+		}
+		if match {
+			keySigs = append(keySigs, sig)
+		}
+	}
+	if len(keySigs) == 0 {
+		return hybridSigAbsent, nil
+	}
+
+	idx, err := sec.VerifySigs(key, keySigs, hash)
+	if err != nil {
+		return hybridSigAbsent, err
+	}
+	if idx == -1 {
+		return hybridSigInvalid, nil
+	}
+
+	return hybridSigValid, nil
+}
+
+// checkHybridKey evaluates the policy for a single hybrid signer.
+func checkHybridKey(key sec.HybridPubSignKey, sigs []sec.Sig, hash []byte,
+	policy HybridPolicy) error {
+
+	if typ, err := key.PostQuantum.SigType(); err != nil {
+		return err
+	} else if !sec.SigTypeIsPostQuantum(typ) {
+		return errors.Errorf("hybrid key: %s is not a post-quantum algorithm",
+			sec.SigTypeString(typ))
+	}
+
+	classical, err := hybridCheckKey(key.Classical, sigs, hash)
+	if err != nil {
+		return err
+	}
+	pqc, err := hybridCheckKey(key.PostQuantum, sigs, hash)
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case HYBRID_POLICY_ANY:
+		if classical != hybridSigValid && pqc != hybridSigValid {
+			return errors.Errorf("no valid signature from hybrid signer")
+		}
+
+	case HYBRID_POLICY_ALL:
+		if classical != hybridSigValid {
+			return errors.Errorf("classical signature missing or invalid")
+		}
+		if pqc != hybridSigValid {
+			return errors.Errorf("post-quantum signature missing or invalid")
+		}
+
+	case HYBRID_POLICY_CLASSICAL_THEN_PQC:
+		if classical != hybridSigValid {
+			return errors.Errorf("classical signature missing or invalid")
+		}
+		if pqc == hybridSigInvalid {
+			return errors.Errorf("post-quantum signature invalid")
+		}
+
+	default:
+		return errors.Errorf("unknown hybrid policy: %d", policy)
+	}
+
+	return nil
+}
+
+// VerifyHybridSigs checks an image's signatures against a set of hybrid
+// signers according to the given policy.  It returns the index of the first
+// signer that satisfies the policy, or an error if none does.
+func (img *Image) VerifyHybridSigs(keys []sec.HybridPubSignKey,
+	policy HybridPolicy) (int, error) {
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return -1, err
+	}
+
+	hash, err := img.SigHash()
+	if err != nil {
+		return -1, err
+	}
+
+	var lastErr error
+	for i, key := range keys {
+		err := checkHybridKey(key, sigs, hash, policy)
+		if err == nil {
+			return i, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr == nil {
+		return -1, errors.Errorf("no hybrid signing keys provided")
+	}
+
+	return -1, errors.Wrapf(lastErr,
+		"image does not satisfy hybrid policy \"%s\"",
+		HybridPolicyString(policy))
+}
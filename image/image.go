@@ -27,6 +27,8 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/sec"
@@ -51,6 +53,10 @@ const (
 	IMAGE_F_PIC          = 0x00000001
 	IMAGE_F_ENCRYPTED    = 0x00000004 /* encrypted image */
 	IMAGE_F_NON_BOOTABLE = 0x00000010 /* non bootable image */
+	IMAGE_F_ROM_FIXED    = 0x00000100 /* runs in place at a fixed address */
+
+	IMAGE_F_KNOWN = IMAGE_F_PIC | IMAGE_F_ENCRYPTED | IMAGE_F_NON_BOOTABLE |
+		IMAGE_F_ROM_FIXED
 )
 
 /*
@@ -58,6 +64,7 @@ const (
  */
 const (
 	IMAGE_TLV_KEYHASH          = 0x01
+	IMAGE_TLV_PUBKEY           = 0x02
 	IMAGE_TLV_SHA256           = 0x10
 	IMAGE_TLV_RSA2048          = 0x20
 	IMAGE_TLV_ECDSA224         = 0x21
@@ -67,15 +74,32 @@ const (
 	IMAGE_TLV_ENC_RSA          = 0x30
 	IMAGE_TLV_ENC_KEK          = 0x31
 	IMAGE_TLV_ENC_EC256        = 0x32
+	IMAGE_TLV_ENC_X25519       = 0x33
+	IMAGE_TLV_DEPENDENCY       = 0x40
 	IMAGE_TLV_AES_NONCE_LEGACY = 0x50
 	IMAGE_TLV_SECRET_ID_LEGACY = 0x60
 	IMAGE_TLV_AES_NONCE        = 0xa1
 	IMAGE_TLV_SECRET_ID        = 0xa2
 	IMAGE_TLV_SECTION          = 0xa3
+	IMAGE_TLV_MLDSA44          = 0xa4 // Experimental.
+	IMAGE_TLV_BUILD_TIME       = 0xa5
+	IMAGE_TLV_BUILD_ID         = 0xa6
+	IMAGE_TLV_TIMESTAMP        = 0xa7
+	IMAGE_TLV_TLOG_ENTRY       = 0xa8
+	IMAGE_TLV_SBOM             = 0xa9
+	IMAGE_TLV_CHANNEL          = 0xaa
+	IMAGE_TLV_HASH_TREE        = 0xab
+	IMAGE_TLV_FIXED_ADDR       = 0xac
+	IMAGE_TLV_XIP_PEER         = 0xad
+	IMAGE_TLV_ED448            = 0xae
+	IMAGE_TLV_SERIAL_INFO      = 0xaf
+	IMAGE_TLV_USER_DATA        = 0xb0
+	IMAGE_TLV_BLAKE2S          = 0xb1
 )
 
 var imageTlvTypeNameMap = map[uint8]string{
 	IMAGE_TLV_KEYHASH:          "KEYHASH",
+	IMAGE_TLV_PUBKEY:           "PUBKEY",
 	IMAGE_TLV_SHA256:           "SHA256",
 	IMAGE_TLV_RSA2048:          "RSA2048",
 	IMAGE_TLV_ECDSA224:         "ECDSA224",
@@ -85,19 +109,27 @@ var imageTlvTypeNameMap = map[uint8]string{
 	IMAGE_TLV_ENC_RSA:          "ENC_RSA",
 	IMAGE_TLV_ENC_KEK:          "ENC_KEK",
 	IMAGE_TLV_ENC_EC256:        "ENC_EC256",
+	IMAGE_TLV_ENC_X25519:       "ENC_X25519",
+	IMAGE_TLV_DEPENDENCY:       "DEPENDENCY",
 	IMAGE_TLV_AES_NONCE:        "AES_NONCE",
 	IMAGE_TLV_SECRET_ID:        "SEC_KEY_ID",
 	IMAGE_TLV_AES_NONCE_LEGACY: "AES_NONCE",
 	IMAGE_TLV_SECRET_ID_LEGACY: "SEC_KEY_ID",
 	IMAGE_TLV_SECTION:          "SECTION",
-}
-
-var imageTlvTypeSigTypeMap = map[uint8]sec.SigType{
-	IMAGE_TLV_RSA2048:  sec.SIG_TYPE_RSA2048,
-	IMAGE_TLV_ECDSA224: sec.SIG_TYPE_ECDSA224,
-	IMAGE_TLV_ECDSA256: sec.SIG_TYPE_ECDSA256,
-	IMAGE_TLV_RSA3072:  sec.SIG_TYPE_RSA3072,
-	IMAGE_TLV_ED25519:  sec.SIG_TYPE_ED25519,
+	IMAGE_TLV_MLDSA44:          "MLDSA44",
+	IMAGE_TLV_BUILD_TIME:       "BUILD_TIME",
+	IMAGE_TLV_BUILD_ID:         "BUILD_ID",
+	IMAGE_TLV_TIMESTAMP:        "TIMESTAMP",
+	IMAGE_TLV_TLOG_ENTRY:       "TLOG_ENTRY",
+	IMAGE_TLV_SBOM:             "SBOM",
+	IMAGE_TLV_CHANNEL:          "CHANNEL",
+	IMAGE_TLV_HASH_TREE:        "HASH_TREE",
+	IMAGE_TLV_FIXED_ADDR:       "FIXED_ADDR",
+	IMAGE_TLV_XIP_PEER:         "XIP_PEER",
+	IMAGE_TLV_ED448:            "ED448",
+	IMAGE_TLV_SERIAL_INFO:      "SERIAL_INFO",
+	IMAGE_TLV_USER_DATA:        "USER_DATA",
+	IMAGE_TLV_BLAKE2S:          "BLAKE2S",
 }
 
 type ImageVersion struct {
@@ -107,6 +139,16 @@ type ImageVersion struct {
 	BuildNum uint32
 }
 
+// ImageDependency is the body of a DEPENDENCY TLV.  It indicates that the
+// image requires image ImageId to be at version MinVersion or later.
+type ImageDependency struct {
+	ImageId    uint8
+	Pad        [3]uint8
+	MinVersion ImageVersion
+}
+
+const IMAGE_DEPENDENCY_SIZE = 12
+
 type ImageHdr struct {
 	Magic  uint32
 	Pad1   uint32
@@ -140,6 +182,12 @@ type Image struct {
 	Body     []byte
 	ProtTlvs []ImageTlv
 	Tlvs     []ImageTlv
+
+	// Fill bytes following the final TLV; used to align the image size.
+	TailPad []byte
+
+	// Byte order of the header, trailers, and TLV headers.
+	Endianness Endianness
 }
 
 type ImageOffsets struct {
@@ -160,35 +208,39 @@ type Section struct {
 
 func ImageTlvTypeIsValid(tlvType uint8) bool {
 	_, ok := imageTlvTypeNameMap[tlvType]
-	return ok
+	return ok || ImageTlvTypeIsSig(tlvType)
 }
 
 func ImageTlvTypeName(tlvType uint8) string {
 	name, ok := imageTlvTypeNameMap[tlvType]
 	if !ok {
+		// Signature algorithms may be registered at runtime.
+		if alg, ok := sec.SigAlgForTlv(tlvType); ok {
+			return strings.ToUpper(alg.Name)
+		}
 		return "???"
 	}
 
 	return name
 }
 
+// ImageTlvTypeToSigType maps a signature TLV type to a signature type using
+// the sec package's algorithm registry.
 func ImageTlvTypeToSigType(tlvType uint8) (sec.SigType, bool) {
-	typ, ok := imageTlvTypeSigTypeMap[tlvType]
-	return typ, ok
+	alg, ok := sec.SigAlgForTlv(tlvType)
+	return alg.Type, ok
 }
 
 func ImageTlvTypeIsSig(tlvType uint8) bool {
-	return tlvType == IMAGE_TLV_RSA2048 ||
-		tlvType == IMAGE_TLV_RSA3072 ||
-		tlvType == IMAGE_TLV_ECDSA224 ||
-		tlvType == IMAGE_TLV_ECDSA256 ||
-		tlvType == IMAGE_TLV_ED25519
+	_, ok := sec.SigAlgForTlv(tlvType)
+	return ok
 }
 
 func ImageTlvTypeIsSecret(tlvType uint8) bool {
 	return tlvType == IMAGE_TLV_ENC_RSA ||
 		tlvType == IMAGE_TLV_ENC_KEK ||
-		tlvType == IMAGE_TLV_ENC_EC256
+		tlvType == IMAGE_TLV_ENC_EC256 ||
+		tlvType == IMAGE_TLV_ENC_X25519
 }
 
 func (ver ImageVersion) String() string {
@@ -196,6 +248,32 @@ func (ver ImageVersion) String() string {
 		ver.Major, ver.Minor, ver.Rev, ver.BuildNum)
 }
 
+// CompareVersions compares two image versions.  It returns -1 if a < b, 0 if
+// a == b, and 1 if a > b.  All four components, including the build number,
+// are considered.
+func CompareVersions(a ImageVersion, b ImageVersion) int {
+	cmp := func(x uint64, y uint64) int {
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		} else {
+			return 0
+		}
+	}
+
+	if c := cmp(uint64(a.Major), uint64(b.Major)); c != 0 {
+		return c
+	}
+	if c := cmp(uint64(a.Minor), uint64(b.Minor)); c != 0 {
+		return c
+	}
+	if c := cmp(uint64(a.Rev), uint64(b.Rev)); c != 0 {
+		return c
+	}
+	return cmp(uint64(a.BuildNum), uint64(b.BuildNum))
+}
+
 func (tlv *ImageTlv) Clone() ImageTlv {
 	return ImageTlv{
 		Header: tlv.Header,
@@ -204,9 +282,14 @@ func (tlv *ImageTlv) Clone() ImageTlv {
 }
 
 func (tlv *ImageTlv) Write(w io.Writer) (int, error) {
+	return tlv.write(w, binary.LittleEndian)
+}
+
+// write writes a TLV whose header is encoded in the given byte order.
+func (tlv *ImageTlv) write(w io.Writer, order binary.ByteOrder) (int, error) {
 	totalSize := 0
 
-	err := binary.Write(w, binary.LittleEndian, &tlv.Header)
+	err := binary.Write(w, order, &tlv.Header)
 	if err != nil {
 		return totalSize, errors.Wrapf(err, "failed to write image TLV header")
 	}
@@ -229,6 +312,9 @@ func (img *Image) Clone() Image {
 		Body:     append([]byte(nil), img.Body...),
 		ProtTlvs: make([]ImageTlv, len(img.ProtTlvs)),
 		Tlvs:     make([]ImageTlv, len(img.Tlvs)),
+		TailPad:  append([]byte(nil), img.TailPad...),
+
+		Endianness: img.Endianness,
 	}
 
 	for i, tlv := range img.ProtTlvs {
@@ -453,6 +539,72 @@ func (i *Image) FindAllUniqueTlv(tlvType uint8) (*ImageTlv, error) {
 	return tlvs[0], nil
 }
 
+// IterTlvs calls fn for each TLV in an image in serialization order: first
+// the protected TLVs, then the unprotected ones.  The offset passed to fn is
+// the TLV's offset within the serialized image.  Iteration stops early if fn
+// returns false.
+func (img *Image) IterTlvs(
+	fn func(tlv *ImageTlv, isProtected bool, offset int) bool) error {
+
+	offs, err := img.Offsets()
+	if err != nil {
+		return err
+	}
+
+	for i, _ := range img.ProtTlvs {
+		if !fn(&img.ProtTlvs[i], true, offs.ProtTlvs[i]) {
+			return nil
+		}
+	}
+
+	for i, _ := range img.Tlvs {
+		if !fn(&img.Tlvs[i], false, offs.Tlvs[i]) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// TlvEntry describes a TLV along with its location in a serialized image.
+type TlvEntry struct {
+	Tlv         *ImageTlv
+	IsProtected bool
+	Offset      int
+}
+
+// FindTlvEntriesIf searches both TLV regions of an image for TLVs satisfying
+// the given predicate.  The entries are returned in serialization order.
+func (img *Image) FindTlvEntriesIf(
+	pred func(tlv ImageTlv) bool) ([]TlvEntry, error) {
+
+	var entries []TlvEntry
+
+	err := img.IterTlvs(func(tlv *ImageTlv, isProtected bool, offset int) bool {
+		if pred(*tlv) {
+			entries = append(entries, TlvEntry{
+				Tlv:         tlv,
+				IsProtected: isProtected,
+				Offset:      offset,
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// FindTlvEntries searches both TLV regions of an image for TLVs of the
+// specified type.  The entries are returned in serialization order.
+func (img *Image) FindTlvEntries(tlvType uint8) ([]TlvEntry, error) {
+	return img.FindTlvEntriesIf(func(tlv ImageTlv) bool {
+		return tlv.Header.Type == tlvType
+	})
+}
+
 // ProtTrailer constructs a protected ImageTrailer corresponding to the given
 // image.
 func (img *Image) ProtTrailer() ImageTrailer {
@@ -480,9 +632,20 @@ func (img *Image) Trailer() ImageTrailer {
 	return trailer
 }
 
-// Hash retrieves the contents of an image's SHA256 TLV.
+// HashTlv returns an image's hash TLV: SHA256, or BLAKE2S if the image was
+// hashed with BLAKE2s.  It returns nil if the image has no hash TLV.
+func (i *Image) HashTlv() (*ImageTlv, error) {
+	alg, err := i.HashAlg()
+	if err != nil {
+		return nil, err
+	}
+
+	return i.FindUniqueTlv(alg.TlvType())
+}
+
+// Hash retrieves the contents of an image's hash TLV.
 func (i *Image) Hash() ([]byte, error) {
-	tlv, err := i.FindUniqueTlv(IMAGE_TLV_SHA256)
+	tlv, err := i.HashTlv()
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to retrieve image hash")
 	}
@@ -495,10 +658,21 @@ func (i *Image) Hash() ([]byte, error) {
 	return tlv.Data, nil
 }
 
-// CalcHash calculates a SHA256 of the given image.  initialHash should be nil
-// for non-split-images.
+// CalcHash calculates the hash of the given image, using the algorithm of
+// its hash TLV (SHA256 if it has none).  initialHash should be nil for
+// non-split-images.
 func (i *Image) CalcHash(initialHash []byte) ([]byte, error) {
-	return calcHash(initialHash, i.Header, i.Pad, i.Body, i.ProtTlvs)
+	alg, err := i.HashAlg()
+	if err != nil {
+		return nil, err
+	}
+
+	return i.calcHashAlg(alg, initialHash)
+}
+
+func (i *Image) calcHashAlg(alg HashAlg, initialHash []byte) ([]byte, error) {
+	return calcHash(alg, initialHash, i.Endianness.ByteOrder(), i.Header,
+		i.Pad, i.Body, i.ProtTlvs)
 }
 
 // WritePlusOffsets writes a binary image to the given writer.  It returns
@@ -506,16 +680,17 @@ func (i *Image) CalcHash(initialHash []byte) ([]byte, error) {
 func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 	offs := ImageOffsets{}
 	offset := 0
+	order := i.Endianness.ByteOrder()
 
 	offs.Header = offset
 
-	err := binary.Write(w, binary.LittleEndian, &i.Header)
+	err := binary.Write(w, order, &i.Header)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image header")
 	}
 	offset += IMAGE_HEADER_SIZE
 
-	err = binary.Write(w, binary.LittleEndian, i.Pad)
+	err = binary.Write(w, order, i.Pad)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image padding")
 	}
@@ -531,7 +706,7 @@ func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 	if i.Header.ProtSz > 0 {
 		protTrailer := i.ProtTrailer()
 		offs.ProtTrailer = offset
-		err = binary.Write(w, binary.LittleEndian, &protTrailer)
+		err = binary.Write(w, order, &protTrailer)
 		if err != nil {
 			return offs, errors.Wrapf(err, "failed to write image trailer")
 		}
@@ -539,7 +714,7 @@ func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 
 		for _, tlv := range i.ProtTlvs {
 			offs.ProtTlvs = append(offs.ProtTlvs, offset)
-			size, err := tlv.Write(w)
+			size, err := tlv.write(w, order)
 			if err != nil {
 				return offs, errors.Wrapf(err, "failed to write image TLV")
 			}
@@ -549,7 +724,7 @@ func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 
 	trailer := i.Trailer()
 	offs.Trailer = offset
-	err = binary.Write(w, binary.LittleEndian, &trailer)
+	err = binary.Write(w, order, &trailer)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image trailer")
 	}
@@ -557,13 +732,21 @@ func (i *Image) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 
 	for _, tlv := range i.Tlvs {
 		offs.Tlvs = append(offs.Tlvs, offset)
-		size, err := tlv.Write(w)
+		size, err := tlv.write(w, order)
 		if err != nil {
 			return offs, errors.Wrapf(err, "failed to write image TLV")
 		}
 		offset += size
 	}
 
+	if len(i.TailPad) > 0 {
+		size, err := w.Write(i.TailPad)
+		if err != nil {
+			return offs, errors.Wrapf(err, "failed to write image tail padding")
+		}
+		offset += size
+	}
+
 	offs.TotalSize = offset
 
 	return offs, nil
@@ -594,6 +777,12 @@ func (i *Image) Write(w io.Writer) (int, error) {
 	return offs.TotalSize, nil
 }
 
+// WriteTo serializes and writes a Mynewt image.  It implements io.WriterTo.
+func (i *Image) WriteTo(w io.Writer) (int64, error) {
+	n, err := i.Write(w)
+	return int64(n), err
+}
+
 // WriteToFile writes a Mynewt image to a file.
 func (i *Image) WriteToFile(filename string) error {
 	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
@@ -609,42 +798,197 @@ func (i *Image) WriteToFile(filename string) error {
 }
 
 // CollectSigs returns a slice of all signatures present in an image's
-// trailer.
+// trailer.  Each signature is identified by the KEYHASH or PUBKEY TLV that
+// precedes it.  Protected signatures (see SigHash) are included.
 func (img *Image) CollectSigs() ([]sec.Sig, error) {
+	if !img.HasProtectedSigs() {
+		return CollectTlvSigs(img.Tlvs)
+	}
+
+	sigs, err := CollectTlvSigs(img.ProtTlvs)
+	if err != nil {
+		return nil, err
+	}
+
+	unprot, err := CollectTlvSigs(img.Tlvs)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(sigs, unprot...), nil
+}
+
+// CollectTlvSigs returns a slice of all signatures present in a TLV list.
+// Each signature is identified by a KEYHASH or PUBKEY TLV that precedes it.
+// Key TLVs and signatures are matched in order, so both the usual layout
+// (each key TLV immediately followed by its signature) and a grouped layout
+// (all key TLVs, then all signatures) are accepted.
+func CollectTlvSigs(tlvs []ImageTlv) ([]sec.Sig, error) {
 	var sigs []sec.Sig
 
-	var keyHashTlv *ImageTlv
-	for i, _ := range img.Tlvs {
-		t := &img.Tlvs[i]
+	var keyTlvs []*ImageTlv
+	for i, _ := range tlvs {
+		t := &tlvs[i]
 
-		if t.Header.Type == IMAGE_TLV_KEYHASH {
-			if keyHashTlv != nil {
-				return nil, errors.Errorf(
-					"image contains keyhash tlv without subsequent signature")
-			}
-			keyHashTlv = t
+		if t.Header.Type == IMAGE_TLV_KEYHASH ||
+			t.Header.Type == IMAGE_TLV_PUBKEY {
+
+			keyTlvs = append(keyTlvs, t)
 		} else {
 			sigType, ok := ImageTlvTypeToSigType(t.Header.Type)
 			if ok {
-				if keyHashTlv == nil {
+				if len(keyTlvs) == 0 {
 					return nil, errors.Errorf(
 						"image contains signature tlv without preceding keyhash")
 				}
+				keyTlv := keyTlvs[0]
+				keyTlvs = keyTlvs[1:]
+
+				keyHash := keyTlv.Data
+				if keyTlv.Header.Type == IMAGE_TLV_PUBKEY {
+					keyHash = sec.RawKeyHash(keyTlv.Data)
+				}
 
 				sigs = append(sigs, sec.Sig{
 					Type:    sigType,
-					KeyHash: keyHashTlv.Data,
+					KeyHash: keyHash,
 					Data:    t.Data,
 				})
-
-				keyHashTlv = nil
 			}
 		}
 	}
 
+	if len(keyTlvs) > 0 {
+		return nil, errors.Errorf(
+			"image contains %s tlv without subsequent signature",
+			ImageTlvTypeName(keyTlvs[0].Header.Type))
+	}
+
 	return sigs, nil
 }
 
+// EmbeddedPubKeys parses the contents of each PUBKEY TLV in an image's
+// trailer.  It returns an empty slice if the image does not contain any
+// embedded keys.
+func (img *Image) EmbeddedPubKeys() ([]sec.PubSignKey, error) {
+	var keys []sec.PubSignKey
+
+	for _, tlv := range img.FindAllTlvs(IMAGE_TLV_PUBKEY) {
+		key, err := sec.ParsePubSignKeyBytes(tlv.Data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "image contains invalid PUBKEY TLV")
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// Dependencies returns the image dependencies listed in an image's
+// protected DEPENDENCY TLVs.
+func (img *Image) Dependencies() ([]ImageDependency, error) {
+	var deps []ImageDependency
+
+	for _, tlv := range img.FindProtTlvs(IMAGE_TLV_DEPENDENCY) {
+		var dep ImageDependency
+		r := bytes.NewReader(tlv.Data)
+		if len(tlv.Data) != IMAGE_DEPENDENCY_SIZE ||
+			binary.Read(r, img.Endianness.ByteOrder(), &dep) != nil {
+
+			return nil, errors.Errorf(
+				"invalid DEPENDENCY TLV: have-len=%d want-len=%d",
+				len(tlv.Data), IMAGE_DEPENDENCY_SIZE)
+		}
+		deps = append(deps, dep)
+	}
+
+	return deps, nil
+}
+
+// BuildDependencyTlv produces a little-endian protected DEPENDENCY TLV.
+func BuildDependencyTlv(dep ImageDependency) ImageTlv {
+	return buildDependencyTlv(dep, binary.LittleEndian)
+}
+
+func buildDependencyTlv(dep ImageDependency, order binary.ByteOrder) ImageTlv {
+	b := &bytes.Buffer{}
+	binary.Write(b, order, &dep)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_DEPENDENCY,
+			Pad:  0,
+			Len:  uint16(b.Len()),
+		},
+		Data: b.Bytes(),
+	}
+}
+
+// Sections returns the body sections listed in an image's protected SECTION
+// TLVs.
+func (img *Image) Sections() ([]Section, error) {
+	var sections []Section
+
+	order := img.Endianness.ByteOrder()
+	for _, tlv := range img.FindProtTlvs(IMAGE_TLV_SECTION) {
+		if len(tlv.Data) < 8 {
+			return nil, errors.Errorf(
+				"invalid SECTION TLV: have-len=%d want-len>=8", len(tlv.Data))
+		}
+
+		sections = append(sections, Section{
+			Offset: int(order.Uint32(tlv.Data[0:])),
+			Size:   int(order.Uint32(tlv.Data[4:])),
+			Name:   string(tlv.Data[8:]),
+		})
+	}
+
+	return sections, nil
+}
+
+// BuildTime returns the timestamp in an image's protected BUILD_TIME TLV.  It
+// returns nil if the image does not contain a timestamp.
+func (img *Image) BuildTime() (*time.Time, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_BUILD_TIME)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	if len(tlv.Data) != IMAGE_BUILD_TIME_SIZE {
+		return nil, errors.Errorf(
+			"invalid BUILD_TIME TLV: have-len=%d want-len=%d",
+			len(tlv.Data), IMAGE_BUILD_TIME_SIZE)
+	}
+
+	secs := img.Endianness.ByteOrder().Uint64(tlv.Data)
+	t := time.Unix(int64(secs), 0).UTC()
+	return &t, nil
+}
+
+// BuildId returns the contents of an image's protected BUILD_ID TLV.  It
+// returns nil if the image does not contain a build identifier.
+func (img *Image) BuildId() ([]byte, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_BUILD_ID)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	if len(tlv.Data) == 0 || len(tlv.Data) > IMAGE_BUILD_ID_MAX_SIZE {
+		return nil, errors.Errorf(
+			"invalid BUILD_ID TLV: have-len=%d want-len=1-%d",
+			len(tlv.Data), IMAGE_BUILD_ID_MAX_SIZE)
+	}
+
+	return tlv.Data, nil
+}
+
 // CollectSecret finds the "secret" TLV in an image and returns its body.  It
 // returns nil if there is no "secret" TLV.
 func (img *Image) CollectSecret() ([]byte, error) {
@@ -735,7 +1079,12 @@ func Decrypt(img Image, privEncKey sec.PrivEncKey) (Image, error) {
 		return img, err
 	}
 
-	body, err := sec.EncryptAES(dup.Body, plainSecret, nil)
+	nonce, err := dup.Nonce()
+	if err != nil {
+		return img, err
+	}
+
+	body, err := sec.EncryptAES(dup.Body, plainSecret, nonce)
 	if err != nil {
 		return img, err
 	}
@@ -750,19 +1099,14 @@ func Decrypt(img Image, privEncKey sec.PrivEncKey) (Image, error) {
 func DecryptHw(img Image, secret []byte) (Image, error) {
 	dup := img.Clone()
 
-	tlvs := dup.FindProtTlvs(IMAGE_TLV_AES_NONCE)
-	if len(tlvs) != 1 {
-		// try to find legacy TLV
-		tlvs := dup.FindProtTlvs(IMAGE_TLV_AES_NONCE_LEGACY)
-
-		if len(tlvs) != 1 {
-
-			return dup, errors.Errorf(
-				"failed to decrypt hw-encrypted image: "+
-					"wrong count of AES nonce TLVs; have=%d want=1", len(tlvs))
-		}
+	nonce, err := dup.Nonce()
+	if err != nil {
+		return dup, errors.Wrapf(err, "failed to decrypt hw-encrypted image")
+	}
+	if nonce == nil {
+		return dup, errors.Errorf(
+			"failed to decrypt hw-encrypted image: no AES nonce TLV")
 	}
-	nonce := tlvs[0].Data
 
 	body, err := sec.EncryptAES(dup.Body, secret, nonce)
 	if err != nil {
@@ -792,6 +1136,22 @@ func DecryptHwFull(img Image, secret []byte) (Image, error) {
 	return img, nil
 }
 
+// Nonce retrieves the contents of an image's AES nonce TLV (current or
+// legacy).  It returns nil if the image does not contain a nonce.
+func (img *Image) Nonce() ([]byte, error) {
+	for _, typ := range []uint8{IMAGE_TLV_AES_NONCE, IMAGE_TLV_AES_NONCE_LEGACY} {
+		tlv, err := img.FindProtUniqueTlv(typ)
+		if err != nil {
+			return nil, err
+		}
+		if tlv != nil {
+			return tlv.Data, nil
+		}
+	}
+
+	return nil, nil
+}
+
 // IsEncrypted indicates whether an image's "encrypted" flag is set.
 func (img *Image) IsEncrypted() bool {
 	return img.Header.Flags&IMAGE_F_ENCRYPTED != 0
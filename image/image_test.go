@@ -20,13 +20,30 @@
 package image
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
 	"github.com/apache/mynewt-artifact/manifest"
 	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
 )
 
 const testdataPath = "testdata"
@@ -278,3 +295,3717 @@ func TestImageVerify(t *testing.T) {
 		testOne(t, e)
 	}
 }
+
+func TestIterTlvs(t *testing.T) {
+	tlv := func(typ uint8, data string) ImageTlv {
+		return ImageTlv{
+			Header: ImageTlvHdr{Type: typ, Len: uint16(len(data))},
+			Data:   []byte(data),
+		}
+	}
+
+	const testTlvType = 0xa0
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 100)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img.ProtTlvs = append(img.ProtTlvs,
+		tlv(testTlvType, "prot-a"),
+		tlv(testTlvType+1, "other"),
+		tlv(testTlvType, "prot-bb"))
+	img.Header.ProtSz = calcProtSize(img.ProtTlvs)
+	img.Tlvs = append(img.Tlvs,
+		tlv(testTlvType, "unprot-c"),
+		tlv(testTlvType, "unprot-dd"))
+
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every TLV is visited once, protected TLVs first, at its offset.
+	var visited []*ImageTlv
+	prev := -1
+	err = img.IterTlvs(func(tlv *ImageTlv, isProtected bool, offset int) bool {
+		i := len(visited)
+		visited = append(visited, tlv)
+
+		want := i < len(img.ProtTlvs)
+		if isProtected != want {
+			t.Fatalf("TLV %d: wrong region: have=%v want=%v",
+				i, isProtected, want)
+		}
+		if offset <= prev {
+			t.Fatalf("TLV %d: offsets out of order: %d <= %d",
+				i, offset, prev)
+		}
+		prev = offset
+
+		data := bin[offset+IMAGE_TLV_SIZE : offset+IMAGE_TLV_SIZE+len(tlv.Data)]
+		if bin[offset] != tlv.Header.Type || !bytes.Equal(data, tlv.Data) {
+			t.Fatalf("TLV %d: wrong offset: %d", i, offset)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(visited) != len(img.ProtTlvs)+len(img.Tlvs) {
+		t.Fatalf("wrong TLV count: have=%d want=%d",
+			len(visited), len(img.ProtTlvs)+len(img.Tlvs))
+	}
+	for i := range img.ProtTlvs {
+		if visited[i] != &img.ProtTlvs[i] {
+			t.Fatalf("protected TLV %d: wrong pointer", i)
+		}
+	}
+	for i := range img.Tlvs {
+		if visited[len(img.ProtTlvs)+i] != &img.Tlvs[i] {
+			t.Fatalf("unprotected TLV %d: wrong pointer", i)
+		}
+	}
+
+	// Iteration stops when fn returns false.
+	calls := 0
+	if err := img.IterTlvs(func(*ImageTlv, bool, int) bool {
+		calls++
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("iteration did not stop: calls=%d", calls)
+	}
+
+	// FindTlvEntries reports serialization order; FindAllTlvs keeps its
+	// historical order (unprotected TLVs first).
+	want := []string{"prot-a", "prot-bb", "unprot-c", "unprot-dd"}
+	wantAll := []string{"unprot-c", "unprot-dd", "prot-a", "prot-bb"}
+
+	all := img.FindAllTlvs(testTlvType)
+	entries, err := img.FindTlvEntries(testTlvType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(wantAll) || len(entries) != len(want) {
+		t.Fatalf("wrong match count: all=%d entries=%d want=%d",
+			len(all), len(entries), len(want))
+	}
+	for i, w := range wantAll {
+		if string(all[i].Data) != w {
+			t.Fatalf("FindAllTlvs match %d: wrong TLV: have=%s want=%s",
+				i, all[i].Data, w)
+		}
+	}
+
+	for i, w := range want {
+		e := entries[i]
+		if string(e.Tlv.Data) != w {
+			t.Fatalf("match %d: wrong TLV: have=%s want=%s",
+				i, e.Tlv.Data, w)
+		}
+		if all[(i+2)%4] != e.Tlv {
+			t.Fatalf("match %d: FindAllTlvs and FindTlvEntries disagree", i)
+		}
+		if e.IsProtected != (i < 2) {
+			t.Fatalf("match %d: wrong region", i)
+		}
+		if !bytes.Equal(bin[e.Offset+IMAGE_TLV_SIZE:][:len(w)], []byte(w)) {
+			t.Fatalf("match %d: wrong offset: %d", i, e.Offset)
+		}
+	}
+
+	// Offsets agree with those of the parsed image.
+	parsed, err := ParseImage(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsedEntries, err := parsed.FindTlvEntries(testTlvType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range parsedEntries {
+		if e.Offset != entries[i].Offset ||
+			e.IsProtected != entries[i].IsProtected {
+
+			t.Fatalf("match %d: parsed entry differs", i)
+		}
+	}
+
+	entries, err = img.FindTlvEntries(IMAGE_TLV_ECDSA256)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("unexpected matches: %d %v", len(entries), err)
+	}
+}
+
+func TestNonceSource(t *testing.T) {
+	body := make([]byte, 200)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+	derived := DeriveNonce(body)
+	if len(derived) != IMAGE_NONCE_SIZE {
+		t.Fatalf("wrong derived nonce length: have=%d want=%d",
+			len(derived), IMAGE_NONCE_SIZE)
+	}
+	if bytes.Equal(DeriveNonce(body[1:]), derived) {
+		t.Fatalf("derived nonce does not depend on the body")
+	}
+
+	// Default: no nonce for key-exchange images; derived for hardware keys.
+	nonce, err := GenerateNonce(NONCE_SOURCE_DEFAULT, body, nil, false)
+	if err != nil || nonce != nil {
+		t.Fatalf("default nonce without hw key: have=%x err=%v", nonce, err)
+	}
+	nonce, err = GenerateNonce(NONCE_SOURCE_DEFAULT, body, nil, true)
+	if err != nil || !bytes.Equal(nonce, derived) {
+		t.Fatalf("default nonce with hw key: have=%x err=%v", nonce, err)
+	}
+
+	nonce, err = GenerateNonce(NONCE_SOURCE_DERIVED, body, nil, false)
+	if err != nil || !bytes.Equal(nonce, derived) {
+		t.Fatalf("derived nonce: have=%x err=%v", nonce, err)
+	}
+
+	r1, err := GenerateNonce(NONCE_SOURCE_RANDOM, body, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := GenerateNonce(NONCE_SOURCE_RANDOM, body, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r1) != IMAGE_NONCE_SIZE || bytes.Equal(r1, r2) {
+		t.Fatalf("bad random nonces: %x %x", r1, r2)
+	}
+
+	caller := bytes.Repeat([]byte{0x5a}, 16)
+	nonce, err = GenerateNonce(NONCE_SOURCE_CALLER, body, caller, false)
+	if err != nil || !bytes.Equal(nonce, caller) {
+		t.Fatalf("caller nonce: have=%x err=%v", nonce, err)
+	}
+	caller[0] = 0
+	if nonce[0] != 0x5a {
+		t.Fatalf("caller nonce not copied")
+	}
+	for _, bad := range [][]byte{nil, {}, make([]byte, 17)} {
+		_, err := GenerateNonce(NONCE_SOURCE_CALLER, body, bad, false)
+		if err == nil {
+			t.Fatalf("caller nonce of length %d accepted", len(bad))
+		}
+	}
+	if _, err := GenerateNonce(NonceSource(99), body, nil, false); err == nil {
+		t.Fatalf("unknown nonce source accepted")
+	}
+
+	for src := NONCE_SOURCE_DEFAULT; src <= NONCE_SOURCE_CALLER; src++ {
+		have, err := NonceStringSource(NonceSourceString(src))
+		if err != nil || have != src {
+			t.Fatalf("nonce source name round trip failed: %d", src)
+		}
+	}
+
+	// Each source produces an image that decrypts with its own nonce.
+	binFile := filepath.Join(t.TempDir(), "body.bin")
+	if err := ioutil.WriteFile(binFile, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	encKey := readPrivEncKey()
+	for _, src := range []NonceSource{
+		NONCE_SOURCE_DERIVED, NONCE_SOURCE_RANDOM, NONCE_SOURCE_CALLER,
+	} {
+		img, err := GenerateImage(ImageCreateOpts{
+			SrcBinFilename:    binFile,
+			SrcEncKeyFilename: testdataPath + "/enc-key-pub.pem",
+			SrcEncKeyIndex:    -1,
+			NonceSource:       src,
+			Nonce:             []byte{1, 2, 3, 4, 5, 6, 7, 8, 9},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		nonce, err := img.Nonce()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch src {
+		case NONCE_SOURCE_DERIVED:
+			if !bytes.Equal(nonce, derived) {
+				t.Fatalf("wrong derived nonce TLV: %x", nonce)
+			}
+		case NONCE_SOURCE_CALLER:
+			if !bytes.Equal(nonce, []byte{1, 2, 3, 4, 5, 6, 7, 8, 9}) {
+				t.Fatalf("wrong caller nonce TLV: %x", nonce)
+			}
+		default:
+			if len(nonce) != IMAGE_NONCE_SIZE ||
+				bytes.Equal(nonce, make([]byte, IMAGE_NONCE_SIZE)) {
+
+				t.Fatalf("bad random nonce TLV: %x", nonce)
+			}
+		}
+
+		dec, err := Decrypt(img, encKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(dec.Body, body) {
+			t.Fatalf("%s: decrypted body differs", NonceSourceString(src))
+		}
+
+		// Decryption must use the nonce TLV rather than a zero IV.
+		tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_AES_NONCE)
+		if err != nil || tlv == nil {
+			t.Fatalf("image lacks nonce TLV: %v", err)
+		}
+		tlv.Data[0] ^= 0x01
+		dec, err = Decrypt(img, encKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(dec.Body, body) {
+			t.Fatalf("%s: nonce TLV ignored by decryption",
+				NonceSourceString(src))
+		}
+	}
+
+	_, err = GenerateImage(ImageCreateOpts{
+		SrcBinFilename:    binFile,
+		SrcEncKeyFilename: testdataPath + "/enc-key-pub.pem",
+		SrcEncKeyIndex:    -1,
+		NonceSource:       NONCE_SOURCE_CALLER,
+	})
+	if err == nil {
+		t.Fatalf("image created without caller nonce")
+	}
+
+	// A nonce source is meaningless without encryption.
+	_, err = GenerateImage(ImageCreateOpts{
+		SrcBin:         body,
+		SrcEncKeyIndex: -1,
+		NonceSource:    NONCE_SOURCE_RANDOM,
+	})
+	if err == nil {
+		t.Fatalf("nonce source accepted for unencrypted image")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	allBytes := func(b []byte, val byte) bool {
+		return len(bytes.Trim(b, string([]byte{val}))) == 0
+	}
+	hdrPadVal := byte(0xa5)
+	imagePadVal := byte(0x00)
+
+	tests := []struct {
+		src        []byte
+		opts       ImageCreateOpts
+		hdrPadVal  byte
+		bodyPadVal byte
+		bodyLen    int
+	}{
+		{
+			// Default fill bytes; alignment padding only.
+			src: bytes.Repeat([]byte{0x11}, 50),
+			opts: ImageCreateOpts{
+				Align: 32,
+			},
+			hdrPadVal:  0x00,
+			bodyPadVal: 0xff,
+			bodyLen:    64,
+		},
+		{
+			// Explicit fill bytes; ImagePad leaves the trailer aligned.
+			src: bytes.Repeat([]byte{0x11}, 100),
+			opts: ImageCreateOpts{
+				HdrPad:      0x40,
+				HdrPadVal:   &hdrPadVal,
+				ImagePad:    64,
+				ImagePadVal: &imagePadVal,
+				Align:       16,
+			},
+			hdrPadVal:  0xa5,
+			bodyPadVal: 0x00,
+			bodyLen:    128,
+		},
+		{
+			// Header padding and alignment padding both apply.
+			src: bytes.Repeat([]byte{0x11}, 33),
+			opts: ImageCreateOpts{
+				HdrPad:    0x30,
+				HdrPadVal: &hdrPadVal,
+				Align:     8,
+			},
+			hdrPadVal:  0xa5,
+			bodyPadVal: 0xff,
+			bodyLen:    40,
+		},
+	}
+
+	dir := t.TempDir()
+	writeSrc := func(name string, src []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, src, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for i, tst := range tests {
+		srcLen := len(tst.src)
+		tst.opts.SrcBinFilename = writeSrc(fmt.Sprintf("src%d.bin", i),
+			tst.src)
+		tst.opts.SrcEncKeyIndex = -1
+
+		img, err := GenerateImage(tst.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !allBytes(img.Pad, tst.hdrPadVal) ||
+			int(img.Header.HdrSz) != IMAGE_HEADER_SIZE+len(img.Pad) {
+
+			t.Fatalf("case %d: bad header padding: %x", i, img.Pad)
+		}
+		if len(img.Body) != tst.bodyLen {
+			t.Fatalf("case %d: wrong body length: have=%d want=%d",
+				i, len(img.Body), tst.bodyLen)
+		}
+		if !allBytes(img.Body[srcLen:], tst.bodyPadVal) {
+			t.Fatalf("case %d: bad body padding: %x", i, img.Body[srcLen:])
+		}
+		if (int(img.Header.HdrSz)+len(img.Body))%tst.opts.Align != 0 {
+			t.Fatalf("case %d: trailer not aligned", i)
+		}
+		if !allBytes(img.TailPad, tst.bodyPadVal) {
+			t.Fatalf("case %d: bad tail padding: %x", i, img.TailPad)
+		}
+
+		bin, err := img.Bin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size, err := img.TotalSize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bin) != size || size%tst.opts.Align != 0 {
+			t.Fatalf("case %d: bad total size: have=%d bin=%d align=%d",
+				i, size, len(bin), tst.opts.Align)
+		}
+		if len(img.TailPad) >= tst.opts.Align {
+			t.Fatalf("case %d: excess tail padding: %d", i,
+				len(img.TailPad))
+		}
+
+		parsed, err := ParseImage(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(parsed.Pad, img.Pad) {
+			t.Fatalf("case %d: header padding lost in parse", i)
+		}
+		if _, err := parsed.VerifyHash(nil); err != nil {
+			t.Fatalf("case %d: %s", i, err.Error())
+		}
+	}
+
+	_, err := GenerateImage(ImageCreateOpts{
+		SrcBinFilename: writeSrc("short.bin", make([]byte, 16)),
+		SrcEncKeyIndex: -1,
+		Align:          3,
+	})
+	if err == nil {
+		t.Fatalf("invalid alignment accepted")
+	}
+}
+
+func TestVerifyImagePolicy(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := VerifyOpts{
+		SigKeys:         []sec.PubSignKey{readPubSignKey()},
+		MinSigs:         1,
+		AllowedSigTypes: []sec.SigType{sec.SIG_TYPE_RSA2048},
+		RequiredTlvs:    []uint8{IMAGE_TLV_SHA256},
+		MaxSize:         1024 * 1024,
+	}
+
+	r := VerifyImage(img, opts)
+	if err := r.Err(); err != nil {
+		t.Fatalf("policy rejected good image: %s", err.Error())
+	}
+
+	// Each of these modifications must cause exactly one rule to fail.
+	failCases := map[string]func(o *VerifyOpts){
+		VERIFY_RULE_SIGS: func(o *VerifyOpts) {
+			o.MinSigs = 2
+		},
+		VERIFY_RULE_SIG_TYPES: func(o *VerifyOpts) {
+			o.AllowedSigTypes = []sec.SigType{sec.SIG_TYPE_ED25519}
+		},
+		VERIFY_RULE_FORBIDDEN_TLVS: func(o *VerifyOpts) {
+			o.ForbiddenTlvs = []uint8{IMAGE_TLV_KEYHASH}
+		},
+		VERIFY_RULE_MAX_SIZE: func(o *VerifyOpts) {
+			o.MaxSize = 16
+		},
+		VERIFY_RULE_VERSION: func(o *VerifyOpts) {
+			o.MinVersion = &ImageVersion{Major: 255}
+		},
+	}
+
+	for name, modify := range failCases {
+		o := opts
+		modify(&o)
+
+		r := VerifyImage(img, o)
+		failures := r.Failures()
+		if len(failures) != 1 || failures[0].Name != name {
+			t.Fatalf("unexpected policy failures for rule \"%s\": %+v",
+				name, failures)
+		}
+	}
+
+	// A duplicated signature pair must not let one key satisfy MinSigs=2.
+	dup := img.Clone()
+	var pair []ImageTlv
+	for _, tlv := range dup.Tlvs {
+		if tlv.Header.Type == IMAGE_TLV_KEYHASH ||
+			tlv.Header.Type == IMAGE_TLV_RSA2048 {
+
+			pair = append(pair, tlv)
+		}
+	}
+	dup.Tlvs = append(dup.Tlvs, pair...)
+
+	o := opts
+	o.MinSigs = 2
+	r = VerifyImage(dup, o)
+	failures := r.Failures()
+	if len(failures) != 1 || failures[0].Name != VERIFY_RULE_SIGS ||
+		!strings.Contains(failures[0].Detail, "duplicate") {
+
+		t.Fatalf("duplicated signature accepted: %+v", failures)
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := countValidSigs(append(sigs, sigs...), opts.SigKeys, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("key counted more than once: have=%d want=1", count)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := VerifyOpts{
+		SigKeys: []sec.PubSignKey{readPubSignKey()},
+		MinSigs: 1,
+	}
+
+	cache := NewMemVerifyCache(2)
+
+	r := VerifyImageCached(img, opts, cache)
+	if r.Cached || r.Err() != nil {
+		t.Fatalf("unexpected first report: cached=%v err=%v",
+			r.Cached, r.Err())
+	}
+
+	r = VerifyImageCached(img, opts, cache)
+	if !r.Cached || r.Err() != nil {
+		t.Fatalf("unexpected second report: cached=%v err=%v",
+			r.Cached, r.Err())
+	}
+
+	// A policy change must not be served from the cache.
+	o := opts
+	o.MinSigs = 2
+	r = VerifyImageCached(img, o, cache)
+	if r.Cached || r.Err() == nil {
+		t.Fatalf("changed policy served stale report: cached=%v", r.Cached)
+	}
+
+	// Nor may a key set change.
+	o = opts
+	o.SigKeys = nil
+	k1, err := VerifyCacheKey(img, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := VerifyCacheKey(img, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1 == k2 {
+		t.Fatalf("cache key does not depend on signing keys")
+	}
+
+	// Nor may a change to the image.
+	mod := img.Clone()
+	mod.Body[0] ^= 0xff
+	r = VerifyImageCached(mod, opts, cache)
+	if r.Cached || r.Err() == nil {
+		t.Fatalf("modified image served stale report: cached=%v", r.Cached)
+	}
+
+	if cache.Len() != 2 {
+		t.Fatalf("cache not bounded: len=%d want=2", cache.Len())
+	}
+
+	cache.Purge()
+	if r := VerifyImageCached(mod, opts, cache); r.Cached {
+		t.Fatalf("report served after purge")
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	data := readImageData("good-signed-encrypted")
+
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := img.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatalf("WriteTo produced different bytes than the source image")
+	}
+
+	// Data following the image must be left in the stream.
+	buf.WriteString("trailing")
+
+	img2, err := ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin, err := img2.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bin, data) {
+		t.Fatalf("ReadFrom produced a different image")
+	}
+	if buf.String() != "trailing" {
+		t.Fatalf("ReadFrom consumed data following the image")
+	}
+
+	if _, err := ReadFrom(bytes.NewReader(readImageData("truncated"))); err == nil {
+		t.Fatalf("ReadFrom accepted a truncated image")
+	}
+}
+
+func TestManifestStrict(t *testing.T) {
+	for _, name := range []string{
+		"good-signed-unencrypted",
+		"good-signed-encrypted",
+	} {
+		path := fmt.Sprintf("%s/%s.json", testdataPath, name)
+		if _, err := manifest.ReadManifestOpts(path,
+			manifest.ParseOpts{Strict: true}); err != nil {
+
+			t.Fatalf("strict parse of %s failed: %s", name, err.Error())
+		}
+	}
+
+	data, err := ioutil.ReadFile(testdataPath + "/good-signed-unencrypted.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "image_hash")
+	doc["imagehash"] = "00"
+	doc["build_version"] = 1
+	doc["flash_map"] = map[string]interface{}{
+		"areas": []interface{}{
+			map[string]interface{}{
+				"name": "slot0", "id": 1, "device": 0,
+				"offset": 0, "size": -1,
+			},
+		},
+		"slot": "slot0",
+	}
+	bad, _ := json.Marshal(doc)
+
+	// A non-strict parse catches the type mismatch, but silently ignores
+	// missing, unknown, and out-of-range fields.
+	if _, err := manifest.ParseManifest(bad); err == nil {
+		t.Fatalf("mistyped manifest parsed without error")
+	}
+	delete(doc, "build_version")
+	lenient, _ := json.Marshal(doc)
+	if _, err := manifest.ParseManifest(lenient); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = manifest.ParseManifestOpts(bad, manifest.ParseOpts{Strict: true})
+	serr, ok := errors.Cause(err).(*manifest.SchemaError)
+	if !ok {
+		t.Fatalf("strict parse returned wrong error: %v", err)
+	}
+
+	want := []string{
+		"build_version",
+		"flash_map.areas[0].size",
+		"image_hash",
+		"imagehash",
+	}
+	var have []string
+	for _, v := range serr.Violations {
+		have = append(have, v.Field)
+	}
+	sort.Strings(have)
+	if strings.Join(have, ",") != strings.Join(want, ",") {
+		t.Fatalf("wrong violations: have=%v want=%v", serr.Violations, want)
+	}
+
+	schema, err := manifest.ManifestSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(schema) {
+		t.Fatalf("manifest schema is not valid JSON")
+	}
+}
+
+func TestCheckCompat(t *testing.T) {
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{2, 0, 0, 0}
+	ic.Body = make([]byte, 256)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.ProtTlvs = append(img.ProtTlvs, BuildDependencyTlv(ImageDependency{
+		ImageId:    1,
+		MinVersion: ImageVersion{1, 1, 0, 0},
+	}))
+	img.Header.ProtSz = calcProtSize(img.ProtTlvs)
+
+	dev := NewDeviceState()
+	dev.Version = ImageVersion{1, 0, 0, 0}
+	dev.SlotSize = 1024
+	dev.ImageVersions = map[uint8]ImageVersion{1: ImageVersion{1, 2, 0, 0}}
+
+	r := CheckCompat(img, dev)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.Version = ImageVersion{2, 0, 0, 0}
+	dev.SlotSize = 100
+	dev.ImageVersions[1] = ImageVersion{1, 0, 0, 0}
+	dev.SigTypes = []sec.SigType{sec.SIG_TYPE_ED25519}
+
+	r = CheckCompat(img, dev)
+	var codes []string
+	for _, reason := range r.Reasons {
+		codes = append(codes, reason.Code)
+	}
+	exp := []string{
+		COMPAT_ERR_SIZE,
+		COMPAT_ERR_VERSION,
+		COMPAT_ERR_SIG_TYPE,
+		COMPAT_ERR_DEPENDENCY,
+	}
+	if fmt.Sprint(codes) != fmt.Sprint(exp) {
+		t.Fatalf("wrong compat reasons: have=%v want=%v", codes, exp)
+	}
+}
+
+func TestParseErrorContext(t *testing.T) {
+	data := readImageData("good-signed-unencrypted")
+
+	// Corrupt the length of the final TLV so that it extends past the end
+	// of the image.
+	img, err := ParseImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := len(img.Tlvs) - 1
+	off := len(data) - len(img.Tlvs[last].Data) - IMAGE_TLV_SIZE
+	data[off+2]++
+
+	_, err = ParseImage(data)
+	if err == nil {
+		t.Fatalf("corrupt image parsed successfully")
+	}
+
+	ctx, ok := errors.GetContext(err)
+	if !ok {
+		t.Fatalf("parse error lacks context: %s", err.Error())
+	}
+	if ctx.Kind != "image" || ctx.Offset != off {
+		t.Fatalf("wrong error context: have=%+v want-offset=%d", ctx, off)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	data := readImageData("truncated")
+
+	if _, err := ParseImage(data); err == nil {
+		t.Fatalf("strict parse of truncated image succeeded")
+	}
+
+	img, warnings, err := ParseImageOpts(data, ParseOpts{Lenient: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) == 0 {
+		t.Fatalf("lenient parse of truncated image produced no warnings")
+	}
+	if img.Header.Magic != IMAGE_MAGIC || len(img.Body) == 0 {
+		t.Fatalf("lenient parse failed to salvage header and body")
+	}
+}
+
+func TestSections(t *testing.T) {
+	create := func(sections []Section) Image {
+		ic := NewImageCreator()
+		ic.Body = make([]byte, 64)
+		ic.Sections = sections
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	good := []Section{
+		{Name: ".text", Offset: 0, Size: 48},
+		{Name: ".data", Offset: 48, Size: 16},
+	}
+	img := create(good)
+
+	sections, err := img.Sections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) != len(good) {
+		t.Fatalf("wrong section count: have=%d want=%d",
+			len(sections), len(good))
+	}
+	for i, s := range good {
+		if sections[i] != s {
+			t.Fatalf("wrong section %d: have=%+v want=%+v",
+				i, sections[i], s)
+		}
+	}
+
+	warnings, err := img.VerifySections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+
+	badCases := [][]Section{
+		// Beyond body.
+		{{Name: ".text", Offset: 32, Size: 64}},
+		// Overlapping.
+		{{Name: ".text", Offset: 0, Size: 40}, {Name: ".data", Offset: 32, Size: 8}},
+	}
+	for i, bad := range badCases {
+		img := create(bad)
+		if _, err := img.VerifySections(); err == nil {
+			t.Fatalf("bad case %d: invalid sections accepted", i)
+		}
+
+		r := VerifyImage(img, VerifyOpts{})
+		failures := r.Failures()
+		if len(failures) != 1 || failures[0].Name != VERIFY_RULE_SECTIONS {
+			t.Fatalf("bad case %d: unexpected policy failures: %+v",
+				i, failures)
+		}
+	}
+
+	img = create([]Section{{Name: "", Offset: 0, Size: 0}})
+	if r := VerifyImage(img, VerifyOpts{}); len(r.Warnings) != 2 {
+		t.Fatalf("wrong warning count: have=%d want=2", len(r.Warnings))
+	}
+}
+
+func TestBuildTime(t *testing.T) {
+	create := func(src BuildTimeSource, callerTime time.Time) Image {
+		dir, err := ioutil.TempDir("", "buildtime")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "app.bin")
+		if err := ioutil.WriteFile(path, make([]byte, 64), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := GenerateImage(ImageCreateOpts{
+			SrcBinFilename:  path,
+			BuildTimeSource: src,
+			BuildTime:       callerTime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := create(BUILD_TIME_SOURCE_NONE, time.Time{})
+	if bt, err := img.BuildTime(); err != nil || bt != nil {
+		t.Fatalf("unexpected build time: %v %v", bt, err)
+	}
+
+	img = create(BUILD_TIME_SOURCE_ZERO, time.Time{})
+	if bt, err := img.BuildTime(); err != nil || bt == nil || bt.Unix() != 0 {
+		t.Fatalf("wrong zero build time: %v %v", bt, err)
+	}
+
+	want := time.Date(2020, 3, 14, 15, 9, 26, 0, time.UTC)
+	img = create(BUILD_TIME_SOURCE_CALLER, want)
+	bt, err := img.BuildTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt == nil || !bt.Equal(want) {
+		t.Fatalf("wrong build time: have=%v want=%v", bt, want)
+	}
+
+	// The timestamp is protected by the image hash.
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildId(t *testing.T) {
+	id, err := ParseBuildId("0e9aafc1c3d8a5c1b2ef0a6a0d6c0e2bd3a1f6a7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.BuildId = id
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := img.BuildId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, id) {
+		t.Fatalf("wrong build ID: have=%x want=%x", have, id)
+	}
+
+	if _, err := ParseBuildId(strings.Repeat("ab", 33)); err == nil {
+		t.Fatalf("oversized build ID accepted")
+	}
+
+	ic.BuildId = nil
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := img.BuildId(); err != nil || have != nil {
+		t.Fatalf("unexpected build ID: %x %v", have, err)
+	}
+}
+
+func TestVerifyProfile(t *testing.T) {
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := VerifyOpts{
+		SigKeys: []sec.PubSignKey{readPubSignKey()},
+		MinSigs: 1,
+	}
+
+	r, err := VerifyImageProfile(img, "mcuboot-rsa2048", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("profile rejected good image: %s", err.Error())
+	}
+
+	r, err = VerifyImageProfile(img, "mcuboot-ec256-sha256", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]bool{}
+	for _, f := range r.Failures() {
+		failed[f.Name] = true
+	}
+	if !failed[VERIFY_RULE_SIG_TYPES] || !failed[VERIFY_RULE_REQUIRED_TLVS] {
+		t.Fatalf("unexpected profile failures: %+v", r.Failures())
+	}
+
+	if _, err := VerifyImageProfile(img, "bogus", opts); err == nil {
+		t.Fatalf("unknown profile accepted")
+	}
+}
+
+func TestCalcHashEncrypt(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x5a}, 16)
+	nonce := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	body := make([]byte, 3*IMAGE_PIPELINE_CHUNK_SIZE+123)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+
+	hdr := ImageHdr{Magic: IMAGE_MAGIC, HdrSz: IMAGE_HEADER_SIZE}
+	protTlvs := []ImageTlv{BuildDependencyTlv(ImageDependency{ImageId: 1})}
+	hdr.ProtSz = calcProtSize(protTlvs)
+
+	wantHash, err := calcHash(HASH_ALG_SHA256, nil, binary.LittleEndian, hdr,
+		nil, body, protTlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantBody, err := sec.EncryptAES(body, secret, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := sec.NewAESStream(secret, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	haveHash, haveBody, err := calcHashEncrypt(HASH_ALG_SHA256, nil,
+		binary.LittleEndian, hdr, nil, body, protTlvs, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(haveHash, wantHash) {
+		t.Fatalf("wrong hash: have=%x want=%x", haveHash, wantHash)
+	}
+	if !bytes.Equal(haveBody, wantBody) {
+		t.Fatalf("wrong ciphertext")
+	}
+}
+
+func benchmarkCreate(b *testing.B, encrypt bool) {
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 4*1024*1024)
+	if encrypt {
+		ic.PlainSecret = bytes.Repeat([]byte{0x5a}, 16)
+		ic.CipherSecret = ic.PlainSecret
+	}
+
+	b.SetBytes(int64(len(ic.Body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ic.Create(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	benchmarkCreate(b, false)
+}
+
+func BenchmarkCreateEncrypted(b *testing.B) {
+	benchmarkCreate(b, true)
+}
+
+func benchmarkSignedImage(b *testing.B) (Image, sec.PubSignKey) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 4*1024*1024)
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+
+	img, err := ic.Create()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return img, sec.PubSignKey{Ed25519: key.Public().(ed25519.PublicKey)}
+}
+
+func BenchmarkCreateSigned(b *testing.B) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 4*1024*1024)
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+
+	b.SetBytes(int64(len(ic.Body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ic.Create(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	img, _ := benchmarkSignedImage(b)
+	var buf bytes.Buffer
+	if _, err := img.Write(&buf); err != nil {
+		b.Fatal(err)
+	}
+	bin := buf.Bytes()
+
+	b.SetBytes(int64(len(bin)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseImage(bin); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	img, pub := benchmarkSignedImage(b)
+	opts := VerifyOpts{
+		SigKeys: []sec.PubSignKey{pub},
+		MinSigs: 1,
+	}
+
+	b.SetBytes(int64(len(img.Body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := VerifyImage(img, opts)
+		if err := r.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMapImage(t *testing.T) {
+	dir := t.TempDir()
+
+	ic := NewImageCreator()
+	ic.Body = bytes.Repeat([]byte{0xa5}, 8192)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body is not copied unless it must be padded or encrypted.
+	if &img.Body[0] != &ic.Body[0] {
+		t.Fatalf("image body copied")
+	}
+
+	filename := filepath.Join(dir, "img.bin")
+	if err := img.WriteToFile(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	mapped, m, err := MapImage(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mapped.Body, img.Body) {
+		t.Fatalf("mapped image body differs")
+	}
+	if _, err := mapped.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Empty files cannot be mapped; they are read instead.
+	empty := filepath.Join(dir, "empty.bin")
+	if err := ioutil.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err = MapFile(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mapped() || len(m.Data) != 0 {
+		t.Fatalf("empty file mapped")
+	}
+	m.Close()
+
+	if _, _, err := MapImage(empty); err == nil {
+		t.Fatalf("empty image parsed")
+	}
+
+	// Padding a caller-supplied body never writes past its length.
+	src := bytes.Repeat([]byte{0x11}, 128)
+	if _, err := GenerateImage(ImageCreateOpts{
+		SrcBin:   src[:100],
+		ImagePad: 64,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src[100:], bytes.Repeat([]byte{0x11}, 28)) {
+		t.Fatalf("padding written into caller's buffer")
+	}
+}
+
+func TestStats(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{3}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 4096)
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.HashTreeChunkSize = 1024
+
+	img, stats, err := ic.CreateWithStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantStages := []string{
+		STATS_STAGE_PREPARE,
+		STATS_STAGE_HASH,
+		STATS_STAGE_SIGN,
+		STATS_STAGE_FINISH,
+	}
+	if len(stats.Stages) != len(wantStages) {
+		t.Fatalf("wrong number of create stages: have=%d want=%d",
+			len(stats.Stages), len(wantStages))
+	}
+	for i, name := range wantStages {
+		if stats.Stages[i].Name != name {
+			t.Fatalf("wrong create stage %d: have=%s want=%s",
+				i, stats.Stages[i].Name, name)
+		}
+	}
+
+	// The hash tree and the image hash each cover the body.
+	wantHashed := uint64(img.hashedSize(nil) + len(img.Body))
+	if stats.BytesHashed != wantHashed {
+		t.Fatalf("wrong bytes hashed: have=%d want=%d",
+			stats.BytesHashed, wantHashed)
+	}
+	if stats.Allocs == 0 {
+		t.Fatalf("no allocations recorded")
+	}
+
+	r, stats := VerifyImageWithStats(img, VerifyOpts{
+		SigKeys: []sec.PubSignKey{{
+			Ed25519: key.Public().(ed25519.PublicKey),
+		}},
+		MinSigs: 1,
+	})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.BytesHashed != wantHashed {
+		t.Fatalf("wrong bytes hashed on verify: have=%d want=%d",
+			stats.BytesHashed, wantHashed)
+	}
+	if stats.Stage(STATS_STAGE_SIGS) == 0 && stats.Total() == 0 {
+		t.Fatalf("no verification time recorded")
+	}
+}
+
+func TestVerifySet(t *testing.T) {
+	create := func(ver ImageVersion, deps ...ImageDependency) Image {
+		ic := NewImageCreator()
+		ic.Version = ver
+		ic.Body = make([]byte, 64)
+		ic.Dependencies = deps
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	dep := func(id uint8, ver ImageVersion) ImageDependency {
+		return ImageDependency{ImageId: id, MinVersion: ver}
+	}
+
+	// App core depends on net core >= 1.1.
+	images := []Image{
+		create(ImageVersion{2, 0, 0, 0}, dep(1, ImageVersion{1, 1, 0, 0})),
+		create(ImageVersion{1, 2, 0, 0}),
+	}
+
+	r := VerifySet(images, nil)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Nodes) != 2 || len(r.Nodes[0].Deps) != 1 {
+		t.Fatalf("wrong set report: %+v", r)
+	}
+
+	// Unsatisfied version constraint and missing image.
+	images = []Image{
+		create(ImageVersion{2, 0, 0, 0},
+			dep(1, ImageVersion{1, 3, 0, 0}),
+			dep(2, ImageVersion{1, 0, 0, 0})),
+		create(ImageVersion{1, 2, 0, 0}),
+	}
+
+	r = VerifySet(images, nil)
+	if r.Passed() {
+		t.Fatalf("unsatisfied dependencies accepted")
+	}
+	failures := r.Nodes[0].Report.Failures()
+	if len(failures) != 1 || failures[0].Name != VERIFY_RULE_DEPENDENCIES {
+		t.Fatalf("wrong failures: %+v", failures)
+	}
+	if !r.Nodes[1].Report.Passed() {
+		t.Fatalf("independent image failed: %+v", r.Nodes[1].Report)
+	}
+
+	// Cycle: 0 -> 1 -> 2 -> 1.
+	images = []Image{
+		create(ImageVersion{1, 0, 0, 0}, dep(1, ImageVersion{})),
+		create(ImageVersion{1, 0, 0, 0}, dep(2, ImageVersion{})),
+		create(ImageVersion{1, 0, 0, 0}, dep(1, ImageVersion{})),
+	}
+
+	r = VerifySet(images, nil)
+	if fmt.Sprint(r.Cycles) != "[[1 2]]" {
+		t.Fatalf("wrong cycles: %v", r.Cycles)
+	}
+	if !r.Nodes[0].Report.Passed() || r.Nodes[1].Report.Passed() ||
+		r.Nodes[2].Report.Passed() {
+
+		t.Fatalf("wrong cycle results: %+v", r.Nodes)
+	}
+}
+
+func TestDecodeTlvs(t *testing.T) {
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.Sections = []Section{{Name: ".text", Offset: 0x10, Size: 48}}
+	ic.Dependencies = []ImageDependency{
+		{ImageId: 1, MinVersion: ImageVersion{1, 2, 0, 0}},
+	}
+	ic.HWKeyIndex = 7
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[uint8]string{
+		IMAGE_TLV_DEPENDENCY: "DEPENDENCY: img1 >= 1.2.0.0",
+		IMAGE_TLV_SECTION:    "SECTION: .text offset=0x10 size=48",
+		IMAGE_TLV_SECRET_ID:  "SEC_KEY_ID: 7",
+	}
+	for typ, s := range want {
+		tlvs := img.FindProtTlvs(typ)
+		if len(tlvs) != 1 {
+			t.Fatalf("wrong %s TLV count: %d", ImageTlvTypeName(typ), len(tlvs))
+		}
+		if have := tlvs[0].String(); have != s {
+			t.Fatalf("wrong rendering: have=%q want=%q", have, s)
+		}
+	}
+
+	m, err := img.Map()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tm := range m["prot_tlvs"].([]map[string]interface{}) {
+		if tm["type"] == uint8(IMAGE_TLV_DEPENDENCY) &&
+			tm["_decoded"] != "img1 >= 1.2.0.0" {
+
+			t.Fatalf("wrong decoded value in map: %v", tm["_decoded"])
+		}
+	}
+
+	// Undecodable TLVs fall back to hex.
+	bad := ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_SECTION, Len: 2},
+		Data:   []byte{0xab, 0xcd},
+	}
+	if _, err := bad.Decode(); err == nil {
+		t.Fatalf("short SECTION TLV decoded")
+	}
+	if s := bad.String(); s != "SECTION: abcd" {
+		t.Fatalf("wrong fallback rendering: %q", s)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	codes := func(r AnalysisReport) string {
+		var s []string
+		for _, f := range r.Findings {
+			s = append(s, f.Code)
+		}
+		return strings.Join(s, ",")
+	}
+
+	for _, basename := range []string{
+		"good-unsigned-unencrypted",
+		"good-signed-unencrypted",
+		"good-signed-encrypted",
+	} {
+		img, err := ParseImage(readImageData(basename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := Analyze(img); len(r.AtLeast(ANALYSIS_SEVERITY_WARNING)) != 0 {
+			t.Fatalf("%s: unexpected findings: %s", basename, codes(r))
+		}
+	}
+
+	img, err := ParseImage(readImageData("good-signed-unencrypted"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Header.ProtSz += 4
+	img.Header.Flags |= IMAGE_F_ENCRYPTED
+	img.Header.Vers = ImageVersion{}
+
+	r := Analyze(img)
+	if have, want := codes(r), "prot_sz,zero_version,enc_flag"; have != want {
+		t.Fatalf("wrong findings: have=%s want=%s", have, want)
+	}
+	if err := r.Err(); err == nil {
+		t.Fatalf("error findings not reported")
+	}
+
+	// Split application created without the loader's hash.
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.Bootable = false
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = Analyze(img)
+	if have, want := codes(r), "non_bootable"; have != want {
+		t.Fatalf("wrong findings: have=%s want=%s", have, want)
+	}
+	if r.Err() != nil {
+		t.Fatalf("warning reported as error: %v", r.Err())
+	}
+
+	ic.InitialHash = make([]byte, 32)
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := Analyze(img); len(r.Findings) != 0 {
+		t.Fatalf("unexpected findings: %s", codes(r))
+	}
+}
+
+func TestHashOnly(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{4}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.HashOnly = true
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("hash-only image created with signing key")
+	}
+
+	ic.SigKeys = nil
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := VerifyImage(img, VerifyOpts{})
+	if !r.HashOnly || r.Err() != nil {
+		t.Fatalf("unexpected report for hash-only image: hash-only=%v "+
+			"err=%v", r.HashOnly, r.Err())
+	}
+
+	r = VerifyImage(img, VerifyOpts{RejectHashOnly: true})
+	failures := r.Failures()
+	if len(failures) != 1 || failures[0].Name != VERIFY_RULE_HASH_ONLY {
+		t.Fatalf("hash-only image not rejected: %+v", failures)
+	}
+
+	ic.HashOnly = false
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = VerifyImage(img, VerifyOpts{
+		SigKeys:        []sec.PubSignKey{{Ed25519: key.Public().(ed25519.PublicKey)}},
+		RejectHashOnly: true,
+	})
+	if r.HashOnly || r.Err() != nil {
+		t.Fatalf("signed image rejected: hash-only=%v err=%v",
+			r.HashOnly, r.Err())
+	}
+}
+
+func TestSerialInfo(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{5}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 100)
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.VerifySerialInfo(); err == nil {
+		t.Fatalf("image without serial info passed verification")
+	}
+
+	if err := img.AddSerialInfo(1, 512); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.VerifySerialInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := parsed.SerialInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := parsed.Hash()
+	if info.ImageNum != 1 || info.ChunkSize != 512 ||
+		int(info.ImageSize) != buf.Len() || !bytes.Equal(info.ImageHash, hash) {
+
+		t.Fatalf("wrong serial info: %+v", info)
+	}
+
+	// The TLV is unprotected; the signature remains valid.
+	r := VerifyImage(parsed, VerifyOpts{
+		SigKeys: []sec.PubSignKey{{Ed25519: key.Public().(ed25519.PublicKey)}},
+	})
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+
+	// Re-adding replaces the TLV rather than duplicating it.
+	if err := parsed.AddSerialInfo(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(parsed.FindTlvs(IMAGE_TLV_SERIAL_INFO)); n != 1 {
+		t.Fatalf("wrong number of SERIAL_INFO TLVs: have=%d want=1", n)
+	}
+
+	// Adding a TLV afterwards invalidates the recorded size.
+	tlv, _ := GenerateBuildIdTlv([]byte{1})
+	parsed.Tlvs = append(parsed.Tlvs, tlv)
+	if err := parsed.VerifySerialInfo(); err == nil {
+		t.Fatalf("stale serial info passed verification")
+	}
+}
+
+func TestUploadChunks(t *testing.T) {
+	data := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	chunks, err := UploadChunks(data, UploadOpts{ChunkSize: 4, Upgrade: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("wrong number of chunks: have=%d want=3", len(chunks))
+	}
+
+	var joined []byte
+	for i, c := range chunks {
+		if int(c.Off) != len(joined) || c.First != (i == 0) {
+			t.Fatalf("chunk %d has wrong offset or first flag: %+v", i, c)
+		}
+		joined = append(joined, c.Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatalf("chunks do not reassemble image")
+	}
+
+	sha := sha256.Sum256(data)
+	if chunks[0].Len != 10 || !bytes.Equal(chunks[0].Sha, sha[:]) {
+		t.Fatalf("first chunk has wrong length or sha: %+v", chunks[0])
+	}
+
+	// {"off": 4, "data": h'05060708'}
+	want, _ := hex.DecodeString("a2636f66660464646174614405060708")
+	if !bytes.Equal(chunks[1].Payload(), want) {
+		t.Fatalf("wrong payload: have=%x want=%x", chunks[1].Payload(), want)
+	}
+
+	frame, err := chunks[1].Frame(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHdr := []byte{SMP_OP_WRITE, 0, 0, byte(len(want)),
+		0, SMP_GROUP_IMAGE, 7, SMP_ID_IMAGE_UPLOAD}
+	if !bytes.Equal(frame[:SMP_HDR_SIZE], wantHdr) ||
+		!bytes.Equal(frame[SMP_HDR_SIZE:], want) {
+
+		t.Fatalf("wrong frame: %x", frame)
+	}
+
+	// Unspecified options are taken from the SERIAL_INFO TLV.
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 300)
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.AddSerialInfo(2, 128); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err = img.UploadChunks(UploadOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := img.TotalSize()
+	if len(chunks) != (size+127)/128 || chunks[0].ImageNum != 2 {
+		t.Fatalf("serial info not applied: chunks=%d image=%d",
+			len(chunks), chunks[0].ImageNum)
+	}
+}
+
+func TestChannel(t *testing.T) {
+	create := func(channel string) Image {
+		ic := NewImageCreator()
+		ic.Body = make([]byte, 64)
+		ic.Channel = channel
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := create("beta")
+	channel, err := img.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel != "beta" {
+		t.Fatalf("wrong channel: have=%s want=beta", channel)
+	}
+
+	opts := VerifyOpts{Channels: []string{"beta", "prod"}}
+	r := VerifyImage(img, opts)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Channels = []string{"prod"}
+	r = VerifyImage(img, opts)
+	failures := r.Failures()
+	if len(failures) != 1 || failures[0].Name != VERIFY_RULE_CHANNEL {
+		t.Fatalf("unexpected policy failures: %+v", failures)
+	}
+
+	// An image without a channel is rejected by a channel-gated policy but
+	// accepted otherwise.
+	img = create("")
+	if r := VerifyImage(img, opts); r.Passed() {
+		t.Fatalf("image without channel accepted")
+	}
+	if r := VerifyImage(img, VerifyOpts{}); r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+
+	for _, bad := range []string{"Beta", "a b", strings.Repeat("x", 33)} {
+		ic := NewImageCreator()
+		ic.Body = make([]byte, 64)
+		ic.Channel = bad
+		if _, err := ic.Create(); err == nil {
+			t.Fatalf("invalid channel accepted: \"%s\"", bad)
+		}
+	}
+}
+
+func TestVerifySlotFit(t *testing.T) {
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 1000)
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := img.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fm := manifest.ManifestFlashMap{
+		Areas: []flash.FlashArea{
+			{Name: flash.FLASH_AREA_NAME_IMAGE_0, Id: 1, Offset: 0, Size: 2048},
+			{Name: flash.FLASH_AREA_NAME_IMAGE_1, Id: 2, Offset: 2048, Size: 2048},
+		},
+		Slot:        flash.FLASH_AREA_NAME_IMAGE_0,
+		TrailerSize: 2048 - size,
+	}
+	if err := img.VerifySlotFit(fm); err != nil {
+		t.Fatal(err)
+	}
+
+	// One byte too many for the trailer.
+	fm.TrailerSize++
+	if err := img.VerifySlotFit(fm); err == nil {
+		t.Fatalf("oversized image accepted")
+	}
+
+	// Checked as part of manifest verification.
+	man := manifest.Manifest{
+		Version:  img.Header.Vers.String(),
+		FlashMap: &fm,
+	}
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	man.BuildID = fmt.Sprintf("%x", hash)
+	man.ImageHash = man.BuildID
+	if err := img.VerifyManifest(man); err == nil {
+		t.Fatalf("manifest with undersized slot accepted")
+	}
+	fm.TrailerSize = 0
+	if err := img.VerifyManifest(man); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown slot and overlapping areas.
+	fm.Slot = "FLASH_AREA_MISSING"
+	if err := img.VerifySlotFit(fm); err == nil {
+		t.Fatalf("unknown slot accepted")
+	}
+	fm.Slot = flash.FLASH_AREA_NAME_IMAGE_0
+	fm.Areas[1].Offset = 1024
+	if err := img.VerifySlotFit(fm); err == nil {
+		t.Fatalf("overlapping flash map accepted")
+	}
+}
+
+func TestEndianness(t *testing.T) {
+	section := Section{Name: "text", Offset: 0x10, Size: 0x20}
+	buildTime := time.Unix(1700000000, 0).UTC()
+	dep := ImageDependency{
+		ImageId:    1,
+		MinVersion: ImageVersion{1, 2, 0x0304, 0x05060708},
+	}
+
+	imgs := map[Endianness]Image{}
+	for _, e := range []Endianness{ENDIANNESS_LITTLE, ENDIANNESS_BIG} {
+		ic := NewImageCreator()
+		ic.Version = ImageVersion{1, 2, 3, 4}
+		ic.Body = make([]byte, 100)
+		ic.HeaderSize = 64
+		ic.BuildId = []byte{1, 2, 3, 4}
+		ic.Sections = []Section{section}
+		ic.BuildTime = &buildTime
+		ic.Dependencies = []ImageDependency{dep}
+		ic.Endianness = e
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		imgs[e] = img
+
+		buf := &bytes.Buffer{}
+		if _, err := img.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		if have := e.ByteOrder().Uint32(data); have != IMAGE_MAGIC {
+			t.Fatalf("%s-endian image has wrong magic: 0x%08x",
+				EndiannessString(e), have)
+		}
+
+		for _, parse := range []func() (Image, error){
+			func() (Image, error) { return ParseImage(data) },
+			func() (Image, error) { return ReadFrom(bytes.NewReader(data)) },
+		} {
+			parsed, err := parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Endianness != e {
+				t.Fatalf("wrong endianness: have=%s want=%s",
+					EndiannessString(parsed.Endianness), EndiannessString(e))
+			}
+			if parsed.Header.HdrSz != 64 || len(parsed.ProtTlvs) != 6 {
+				t.Fatalf("%s-endian image parsed incorrectly",
+					EndiannessString(e))
+			}
+
+			// TLV payloads use the image's byte order.
+			tlv, _ := parsed.FindProtUniqueTlv(IMAGE_TLV_BUILD_TIME)
+			if e.ByteOrder().Uint64(tlv.Data) != uint64(buildTime.Unix()) {
+				t.Fatalf("%s-endian BUILD_TIME TLV encoded incorrectly",
+					EndiannessString(e))
+			}
+			secs, err := parsed.Sections()
+			if err != nil || len(secs) != 1 || secs[0] != section {
+				t.Fatalf("%s-endian sections changed: %+v err=%v",
+					EndiannessString(e), secs, err)
+			}
+			bt, err := parsed.BuildTime()
+			if err != nil || bt == nil || !bt.Equal(buildTime) {
+				t.Fatalf("%s-endian build time changed: %v err=%v",
+					EndiannessString(e), bt, err)
+			}
+			deps, err := parsed.Dependencies()
+			if err != nil || len(deps) != 1 || deps[0] != dep {
+				t.Fatalf("%s-endian dependencies changed: %+v err=%v",
+					EndiannessString(e), deps, err)
+			}
+			if _, err := parsed.VerifyHash(nil); err != nil {
+				t.Fatal(err)
+			}
+
+			out := &bytes.Buffer{}
+			if _, err := parsed.Write(out); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Fatalf("%s-endian image did not round-trip",
+					EndiannessString(e))
+			}
+		}
+	}
+
+	// The hash covers the header as encoded.
+	leImg, beImg := imgs[ENDIANNESS_LITTLE], imgs[ENDIANNESS_BIG]
+	le, _ := leImg.Hash()
+	be, _ := beImg.Hash()
+	if bytes.Equal(le, be) {
+		t.Fatalf("little- and big-endian images have the same hash")
+	}
+
+	tlv, err := generateHWKeyIndexTLV(0x01020304, false, binary.BigEndian)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tlv.Data, []byte{1, 2, 3, 4}) {
+		t.Fatalf("big-endian key index TLV encoded incorrectly: %x",
+			tlv.Data)
+	}
+
+	if _, err := EndiannessFromString("middle"); err == nil {
+		t.Fatalf("invalid endianness accepted")
+	}
+}
+
+func TestHashTree(t *testing.T) {
+	body := make([]byte, 10000)
+	for i := range body {
+		body[i] = byte(i * 13)
+	}
+
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{1, 0, 0, 0}
+	ic.Body = body
+	ic.HashTreeChunkSize = 1024
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ht, err := img.HashTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ht == nil || ht.NumChunks() != 10 || ht.ChunkSize != 1024 {
+		t.Fatalf("image has wrong hash tree: %+v", ht)
+	}
+	if err := img.VerifyHashTree(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := VerifyImage(img, VerifyOpts{})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, rule := range r.Rules {
+		found = found || rule.Name == VERIFY_RULE_HASH_TREE
+	}
+	if !found {
+		t.Fatalf("hash tree rule not evaluated")
+	}
+
+	// Corrupting the body invalidates exactly one chunk.
+	bad := img.Clone()
+	bad.Body[5000] ^= 0xff
+	if err := bad.VerifyHashTree(); err == nil {
+		t.Fatalf("corrupt body passed hash tree check")
+	}
+	for i := 0; i < ht.NumChunks(); i++ {
+		off, size := ht.ChunkRange(i, len(bad.Body))
+		err := ht.VerifyChunk(i, bad.Body[off:off+size])
+		if (err != nil) != (i == 4) {
+			t.Fatalf("wrong result for chunk %d: %v", i, err)
+		}
+	}
+
+	// Leaves must match the root.
+	tampered := *ht
+	tampered.Leaves = append([][]byte(nil), ht.Leaves...)
+	tampered.Leaves[0] = make([]byte, 32)
+	if err := tampered.Validate(); err == nil {
+		t.Fatalf("tampered hash tree validated")
+	}
+
+	// Encrypted images are hashed as stored.
+	ic.PlainSecret = make([]byte, 16)
+	ic.HWKeyIndex = 3
+	enc, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.VerifyHashTree(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := BuildHashTree(body, 1000); err == nil {
+		t.Fatalf("invalid chunk size accepted")
+	}
+
+	big, err := BuildHashTree(make([]byte, 4096*4096), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GenerateHashTreeTlv(big); err == nil {
+		t.Fatalf("oversized hash tree TLV generated")
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	body := make([]byte, 4500)
+	for i := range body {
+		body[i] = byte(i * 7)
+	}
+
+	ht, err := BuildHashTree(body, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Chunks 0-4; the final chunk is 404 bytes.  Download [1000, 4500) with
+	// a corrupt byte in chunk 2.
+	data := append([]byte(nil), body[1000:]...)
+	data[2048+10-1000] ^= 0xff
+
+	r, err := ht.VerifyDownload(len(body), 1000, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, have []int, want []int) {
+		if fmt.Sprint(have) != fmt.Sprint(want) {
+			t.Fatalf("wrong %s chunks: have=%v want=%v", name, have, want)
+		}
+	}
+	check("verified", r.Verified, []int{1, 3, 4})
+	check("corrupt", r.Corrupt, []int{2})
+	check("missing", r.Missing, []int{0})
+
+	if r.Complete() {
+		t.Fatalf("incomplete download reported complete")
+	}
+
+	want := []ByteRange{{0, 1024}, {2048, 1024}}
+	if have := r.Refetch(); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("wrong refetch ranges: have=%v want=%v", have, want)
+	}
+
+	// A complete, correct download.
+	r, err = ht.VerifyDownload(len(body), 0, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Complete() || len(r.Refetch()) != 0 {
+		t.Fatalf("complete download reported incomplete")
+	}
+
+	// Adjacent missing chunks are coalesced, including the short final one.
+	r, err = ht.VerifyDownload(len(body), 0, body[:1500])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []ByteRange{{1024, 4500 - 1024}}
+	if have := r.Refetch(); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Fatalf("wrong refetch ranges: have=%v want=%v", have, want)
+	}
+
+	if _, err := ht.VerifyDownload(len(body)+5000, 0, nil); err == nil {
+		t.Fatalf("wrong body size accepted")
+	}
+	if _, err := ht.VerifyDownload(len(body), 4000, body[:1000]); err == nil {
+		t.Fatalf("out of range download accepted")
+	}
+}
+
+// imgtoolTlv is a TLV in an imgtoolReference image.
+type imgtoolTlv struct {
+	typ  uint8
+	data []byte
+}
+
+// imgtoolReference builds an image the way MCUboot's imgtool does.  It
+// deliberately shares no code with the image creator.
+func imgtoolReference(body []byte, ver ImageVersion, hdrSize int,
+	loadAddr uint32, flags uint32, prot []imgtoolTlv,
+	key ed25519.PrivateKey) []byte {
+
+	le := func(w *bytes.Buffer, v interface{}) {
+		binary.Write(w, binary.LittleEndian, v)
+	}
+	tlvArea := func(magic uint16, tlvs []imgtoolTlv) []byte {
+		size := 4
+		for _, tlv := range tlvs {
+			size += 4 + len(tlv.data)
+		}
+		b := &bytes.Buffer{}
+		le(b, magic)
+		le(b, uint16(size))
+		for _, tlv := range tlvs {
+			le(b, tlv.typ)
+			le(b, uint8(0))
+			le(b, uint16(len(tlv.data)))
+			b.Write(tlv.data)
+		}
+		return b.Bytes()
+	}
+
+	var protArea []byte
+	if len(prot) > 0 {
+		protArea = tlvArea(0x6908, prot)
+	}
+
+	b := &bytes.Buffer{}
+	le(b, uint32(0x96f3b83d))
+	le(b, loadAddr)
+	le(b, uint16(hdrSize))
+	le(b, uint16(len(protArea)))
+	le(b, uint32(len(body)))
+	le(b, flags)
+	le(b, ver.Major)
+	le(b, ver.Minor)
+	le(b, ver.Rev)
+	le(b, ver.BuildNum)
+	le(b, uint32(0))
+	b.Write(make([]byte, hdrSize-32))
+	b.Write(body)
+	b.Write(protArea)
+
+	digest := sha256.Sum256(b.Bytes())
+	tlvs := []imgtoolTlv{{0x10, digest[:]}}
+	if key != nil {
+		spki, _ := hex.DecodeString("302a300506032b6570032100")
+		spki = append(spki, key.Public().(ed25519.PublicKey)...)
+		keyHash := sha256.Sum256(spki)
+		tlvs = append(tlvs,
+			imgtoolTlv{0x01, keyHash[:]},
+			imgtoolTlv{0x24, ed25519.Sign(key, digest[:])})
+	}
+	b.Write(tlvArea(0x6907, tlvs))
+
+	return b.Bytes()
+}
+
+func TestImgtoolCompat(t *testing.T) {
+	body := make([]byte, 1000)
+	for i := range body {
+		body[i] = byte(i * 3)
+	}
+	ver := ImageVersion{1, 2, 3, 4}
+
+	imgBytes := func(img Image) []byte {
+		b := &bytes.Buffer{}
+		if _, err := img.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Bytes()
+	}
+
+	// Unsigned image with default options.
+	ic := NewImgtoolImageCreator()
+	ic.Body = body
+	ic.Version = ver
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := imgtoolReference(body, ver, 32, 0, 0, nil, nil)
+	if !bytes.Equal(imgBytes(img), want) {
+		t.Fatalf("unsigned image does not match imgtool output")
+	}
+
+	// Signed image with padded header, dependency, security counter, and
+	// RAM load address.
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+	dep := ImageDependency{ImageId: 1, MinVersion: ImageVersion{2, 0, 0, 0}}
+	depData := []byte{1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}
+	secCnt := uint32(5)
+	opts := ImgtoolOpts{
+		LoadAddr:        0x20000000,
+		RamLoad:         true,
+		SecurityCounter: &secCnt,
+	}
+
+	ic = NewImgtoolImageCreator()
+	ic.Body = body
+	ic.Version = ver
+	ic.HeaderSize = 0x200
+	ic.Dependencies = []ImageDependency{dep}
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.ApplyImgtoolOpts(opts)
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = imgtoolReference(body, ver, 0x200, 0x20000000,
+		IMGTOOL_F_RAM_LOAD, []imgtoolTlv{
+			{IMAGE_TLV_DEPENDENCY, depData},
+			{IMGTOOL_TLV_SEC_CNT, []byte{5, 0, 0, 0}},
+		}, key)
+	if !bytes.Equal(imgBytes(img), want) {
+		t.Fatalf("signed image does not match imgtool output")
+	}
+
+	// Import an imgtool image that was padded out to its slot.
+	padded := append(append([]byte(nil), want...),
+		bytes.Repeat([]byte{0xff}, 100)...)
+	imported, info, err := ImportImgtool(padded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LoadAddr != 0x20000000 || !info.RamLoad || info.RomFixed ||
+		info.SecurityCounter == nil || *info.SecurityCounter != 5 ||
+		info.SlotPad != 100 {
+
+		t.Fatalf("wrong imgtool info: %+v", info)
+	}
+	if !bytes.Equal(imgBytes(imported), want) {
+		t.Fatalf("imported image not normalized")
+	}
+
+	pub := sec.PubSignKey{Ed25519: key.Public().(ed25519.PublicKey)}
+	if _, err := imported.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := imported.VerifySigs(
+		[]sec.PubSignKey{pub}); err != nil || idx != 0 {
+
+		t.Fatalf("imported signature check failed: idx=%d err=%v", idx, err)
+	}
+
+	// Re-creating the image from the extracted options reproduces it.
+	ic = NewImgtoolImageCreator()
+	ic.Body = imported.Body
+	ic.Version = imported.Header.Vers
+	ic.HeaderSize = int(imported.Header.HdrSz)
+	ic.Dependencies = []ImageDependency{dep}
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.ApplyImgtoolOpts(info.ImgtoolOpts)
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(imgBytes(img), want) {
+		t.Fatalf("round-tripped image does not match imgtool output")
+	}
+
+	// A security counter policy reads the TLV as imgtool defines it.
+	verifySecCnt := func(img Image, min uint32) error {
+		r := VerifyImage(img, VerifyOpts{MinSecurityCounter: &min})
+		for _, rule := range r.Rules {
+			if rule.Name == VERIFY_RULE_SEC_CNT {
+				if !rule.Passed {
+					return errors.Errorf("%s", rule.Detail)
+				}
+				return nil
+			}
+		}
+		t.Fatalf("security counter rule not evaluated")
+		return nil
+	}
+	if err := verifySecCnt(imported, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySecCnt(imported, 6); err == nil {
+		t.Fatalf("low security counter accepted")
+	}
+
+	// A legacy nonce shares the security counter's TLV type.  It satisfies
+	// a TLV type rule but not a security counter rule.
+	ic = NewImageCreator()
+	ic.Body = body
+	ic.HWKeyIndex = 2
+	ic.UseLegacyTLV = true
+	ic.PlainSecret = make([]byte, 16)
+	ic.Nonce = DeriveNonce(body)
+	legacy, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := VerifyImage(legacy, VerifyOpts{
+		RequiredTlvs: []uint8{IMGTOOL_TLV_SEC_CNT},
+	})
+	for _, f := range r.Failures() {
+		if f.Name == VERIFY_RULE_REQUIRED_TLVS {
+			t.Fatalf("legacy nonce does not satisfy TLV type rule")
+		}
+	}
+	if err := verifySecCnt(legacy, 0); err == nil {
+		t.Fatalf("legacy nonce accepted as a security counter")
+	}
+
+	// The default creator differs: it emits hardware-key TLVs.
+	ic = NewImageCreator()
+	ic.Body = body
+	ic.Version = ver
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.ProtTlvs) == 0 {
+		t.Fatalf("default creator unexpectedly imgtool-compatible")
+	}
+}
+
+// countingReaderAt counts the reads made through it.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+	bytes int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	c.bytes += len(p)
+	return c.r.ReadAt(p, off)
+}
+
+func TestReadInfo(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{9}, ed25519.SeedSize))
+	signer := sec.PrivSignKey{Ed25519: &key}
+
+	ic := NewImageCreator()
+	ic.Version = ImageVersion{3, 1, 4, 15}
+	ic.Body = make([]byte, 100000)
+	ic.BuildId = []byte{1, 2, 3}
+	ic.SigKeys = []sec.PrivSignKey{signer}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	cr := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+	info, err := ReadInfo(cr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.reads != 3 || cr.bytes > 1000 {
+		t.Fatalf("too much I/O: reads=%d bytes=%d", cr.reads, cr.bytes)
+	}
+
+	hash, _ := img.Hash()
+	pub := signer.PubKey()
+	keyHash, _ := pub.Hash()
+	if info.Version() != ic.Version || info.Size != buf.Len() ||
+		info.Header.Flags != img.Header.Flags ||
+		!bytes.Equal(info.Hash, hash) {
+
+		t.Fatalf("wrong image info: %+v", info)
+	}
+	if len(info.SigTypes) != 1 || info.SigTypes[0] != sec.SIG_TYPE_ED25519 ||
+		!bytes.Equal(info.KeyHashes[0], keyHash) {
+
+		t.Fatalf("wrong signature info: types=%v keyhashes=%x",
+			info.SigTypes, info.KeyHashes)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-10]
+	if _, err := ReadInfo(bytes.NewReader(truncated)); err == nil {
+		t.Fatalf("truncated image accepted")
+	}
+	if _, err := ReadInfo(bytes.NewReader(make([]byte, 64))); err == nil {
+		t.Fatalf("garbage accepted")
+	}
+}
+
+func TestReEncrypt(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := sec.PrivSignKey{Ed25519: &edKey}
+	pubSignKeys := []sec.PubSignKey{signKey.PubKey()}
+
+	oldKey := readPrivEncKey()
+	oldPub := oldKey.PubEncKey()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey := sec.PrivEncKey{Rsa: rsaKey}
+	newPub := newKey.PubEncKey()
+
+	body := make([]byte, 1000)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = body
+	ic.HWKeyIndex = -1
+	ic.SigKeys = []sec.PrivSignKey{signKey}
+	ic.PlainSecret, err = GeneratePlainSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.CipherSecret, err = oldPub.Encrypt(ic.PlainSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re, err := ReEncrypt(img, oldKey, newPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(re.Body, img.Body) {
+		t.Fatalf("body not re-encrypted")
+	}
+	idx, err := re.VerifyHash([]sec.PrivEncKey{oldKey, newKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 1 {
+		t.Fatalf("wrong decryption key: have=%d want=1", idx)
+	}
+	if _, err := re.VerifySigs(pubSignKeys); err != nil {
+		t.Fatal(err)
+	}
+	dec, err := Decrypt(re, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Body, body) {
+		t.Fatalf("wrong plaintext after re-encryption")
+	}
+
+	// Wrong old key.
+	if _, err := ReEncrypt(re, oldKey, newPub); err == nil {
+		t.Fatalf("image re-encrypted with wrong old key")
+	}
+
+	// Hardware key.
+	oldSecret := bytes.Repeat([]byte{0x11}, 16)
+	newSecret := bytes.Repeat([]byte{0x22}, 16)
+
+	ic = NewImageCreator()
+	ic.Body = body
+	ic.HWKeyIndex = 4
+	ic.Nonce = DeriveNonce(body)
+	ic.PlainSecret = oldSecret
+	ic.SigKeys = []sec.PrivSignKey{signKey}
+	hw, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	re, err = ReEncryptHw(hw, oldSecret, newSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := re.VerifySigs(pubSignKeys); err != nil {
+		t.Fatal(err)
+	}
+	dec, err = DecryptHw(re, newSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Body, body) {
+		t.Fatalf("wrong plaintext after hw re-encryption")
+	}
+	if _, err := ReEncryptHw(re, oldSecret, newSecret); err == nil {
+		t.Fatalf("image re-encrypted with wrong old secret")
+	}
+
+	// A hash tree over the ciphertext cannot be preserved.
+	ic.HashTreeChunkSize = 256
+	hw, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReEncryptHw(hw, oldSecret, newSecret); err == nil {
+		t.Fatalf("image with hash tree re-encrypted")
+	}
+
+	// Not encrypted.
+	ic = NewImageCreator()
+	ic.Body = body
+	ic.HWKeyIndex = -1
+	plain, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReEncrypt(plain, oldKey, newPub); err == nil {
+		t.Fatalf("unencrypted image re-encrypted")
+	}
+}
+
+func TestTlvLayout(t *testing.T) {
+	var keys []sec.PrivSignKey
+	var pubKeys []sec.PubSignKey
+	for i := 0; i < 2; i++ {
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := sec.PrivSignKey{Ed25519: &edKey}
+		keys = append(keys, key)
+		pubKeys = append(pubKeys, key.PubKey())
+	}
+
+	tlvTypes := func(tlvs []ImageTlv) string {
+		var names []string
+		for _, tlv := range tlvs {
+			names = append(names, ImageTlvTypeName(tlv.Header.Type))
+		}
+		return strings.Join(names, ",")
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.HWKeyIndex = -1
+	ic.SigKeys = keys
+
+	for _, test := range []struct {
+		layout TlvLayout
+		want   string
+	}{
+		{TlvLayout{}, "SHA256,KEYHASH,ED25519,KEYHASH,ED25519"},
+		{TlvLayout{HashLast: true}, "KEYHASH,ED25519,KEYHASH,ED25519,SHA256"},
+		{TlvLayout{GroupSigs: true}, "SHA256,KEYHASH,KEYHASH,ED25519,ED25519"},
+		{TlvLayout{HashLast: true, GroupSigs: true},
+			"KEYHASH,KEYHASH,ED25519,ED25519,SHA256"},
+	} {
+		ic.TlvLayout = test.layout
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := tlvTypes(img.Tlvs); have != test.want {
+			t.Fatalf("wrong TLV order: have=%s want=%s", have, test.want)
+		}
+
+		bin, err := img.Bin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err = ParseImage(bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range pubKeys {
+			idx, err := img.VerifySigs(pubKeys[i : i+1])
+			if err != nil || idx != 0 {
+				t.Fatalf("signature %d invalid after reordering: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestProtectedSigs(t *testing.T) {
+	for _, test := range []struct {
+		protected []uint8
+		ok        bool
+	}{
+		{nil, true},
+		{ProtectedSigTlvTypes(), true},
+		{[]uint8{IMAGE_TLV_SHA256}, false},
+		{[]uint8{IMAGE_TLV_ENC_RSA}, false},
+		{[]uint8{IMAGE_TLV_ED25519}, false},
+		{[]uint8{IMAGE_TLV_KEYHASH, IMAGE_TLV_PUBKEY}, false},
+		{[]uint8{IMAGE_TLV_KEYHASH, IMAGE_TLV_KEYHASH,
+			IMAGE_TLV_ED25519}, false},
+		{[]uint8{IMAGE_TLV_PUBKEY, IMAGE_TLV_PUBKEY,
+			IMAGE_TLV_ED25519}, false},
+		{append(ProtectedSigTlvTypes(), IMAGE_TLV_ED25519), false},
+		{[]uint8{IMAGE_TLV_KEYHASH, IMAGE_TLV_PUBKEY,
+			IMAGE_TLV_ED25519}, true},
+	} {
+		err := ValidateTlvLayout(TlvLayout{Protected: test.protected})
+		if (err == nil) != test.ok {
+			t.Fatalf("wrong validation result for %v: %v",
+				test.protected, err)
+		}
+	}
+
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{6}, ed25519.SeedSize))
+	pub := sec.PubSignKey{Ed25519: key.Public().(ed25519.PublicKey)}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.HWKeyIndex = -1
+	ic.Channel = "beta"
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.TlvLayout.Protected = ProtectedSigTlvTypes()
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = ParseImage(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !img.HasProtectedSigs() || len(img.Tlvs) != 1 {
+		t.Fatalf("signatures not protected: %d unprotected TLVs",
+			len(img.Tlvs))
+	}
+
+	// The image hash covers the signatures; the signatures cover the hash
+	// of the image without them.
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := img.Hash()
+	sigHash, err := img.SigHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(hash, sigHash) {
+		t.Fatalf("signed hash equals image hash")
+	}
+
+	r := VerifyImage(img, VerifyOpts{SigKeys: []sec.PubSignKey{pub}})
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+
+	// Tampering with a protected signature breaks the image hash.
+	bad := img.Clone()
+	bad.ProtTlvs[len(bad.ProtTlvs)-1].Data[0] ^= 1
+	if _, err := bad.VerifyHash(nil); err == nil {
+		t.Fatalf("tampered signature not covered by image hash")
+	}
+
+	// Protected key TLVs must be followed only by other key and signature
+	// TLVs.
+	bad = img.Clone()
+	bad.ProtTlvs = append(bad.ProtTlvs, GenerateFixedAddrTlv(0))
+	if err := bad.ValidateTlvPlacement(); err == nil {
+		t.Fatalf("invalid protected layout passed validation")
+	}
+
+	ic.PlainSecret = make([]byte, 16)
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("encrypted image created with protected signatures")
+	}
+}
+
+func TestDupPolicy(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.HWKeyIndex = -1
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &edKey}}
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Distinct signatures are not duplicates.
+	if dups := FindDuplicateTlvs(append(img.Tlvs, ImageTlv{
+		Header: ImageTlvHdr{Type: IMAGE_TLV_ED25519},
+		Data:   make([]byte, 64),
+	})); len(dups) != 0 {
+		t.Fatalf("distinct signatures reported as duplicates: %v", dups)
+	}
+
+	// Repeat the signature and the hash.
+	dup := img.Clone()
+	dup.Tlvs = append(dup.Tlvs, img.Tlvs[2], img.Tlvs[0])
+	bin, err := dup.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := ParseImage(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have.Tlvs) != 5 {
+		t.Fatalf("duplicates not kept: have=%d want=5", len(have.Tlvs))
+	}
+
+	have, _, err = ParseImageOpts(bin,
+		ParseOpts{Duplicates: DUP_POLICY_KEEP_FIRST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have.Tlvs) != 3 {
+		t.Fatalf("duplicates not dropped: have=%d want=3", len(have.Tlvs))
+	}
+	if _, err := have.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ParseImageOpts(bin, ParseOpts{Duplicates: DUP_POLICY_ERROR})
+	if err == nil {
+		t.Fatalf("duplicate TLV accepted")
+	}
+	if ctx, ok := errors.GetContext(err); !ok || ctx.TlvIndex != 3 {
+		t.Fatalf("wrong duplicate TLV context: %+v", ctx)
+	}
+
+	_, warnings, err := ParseImageOpts(bin, ParseOpts{
+		Lenient:    true,
+		Duplicates: DUP_POLICY_ERROR,
+	})
+	if err != nil || len(warnings) != 1 {
+		t.Fatalf("wrong lenient result: err=%v warnings=%v", err, warnings)
+	}
+
+	// Protected duplicates are covered by the hash and always kept.
+	buildId, err := GenerateBuildIdTlv([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.ExtraProtTlvs = []ImageTlv{buildId, buildId}
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err = img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, _, err = ParseImageOpts(bin,
+		ParseOpts{Duplicates: DUP_POLICY_KEEP_FIRST})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(have.FindProtTlvs(IMAGE_TLV_BUILD_ID)) != 2 {
+		t.Fatalf("protected duplicate dropped")
+	}
+	if _, _, err = ParseImageOpts(bin,
+		ParseOpts{Duplicates: DUP_POLICY_ERROR}); err == nil {
+
+		t.Fatalf("protected duplicate TLV accepted")
+	}
+
+	if p, err := DupPolicyFromString("keep-first"); err != nil ||
+		p != DUP_POLICY_KEEP_FIRST {
+
+		t.Fatalf("wrong policy from string: %v %v", p, err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{5}, ed25519.SeedSize))
+	buildId, err := GenerateBuildIdTlv([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var creators []ImageCreator
+	add := func(f func(ic *ImageCreator)) {
+		ic := NewImageCreator()
+		ic.Version = ImageVersion{1, 2, 3, 4}
+		ic.Body = bytes.Repeat([]byte{0x11, 0x22, 0x33}, 100)
+		ic.HWKeyIndex = -1
+		f(&ic)
+		creators = append(creators, ic)
+	}
+
+	add(func(ic *ImageCreator) {})
+	add(func(ic *ImageCreator) {
+		ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+		ic.EmbedPubKey = true
+	})
+	add(func(ic *ImageCreator) {
+		ic.PlainSecret = bytes.Repeat([]byte{0x5a}, 16)
+		ic.CipherSecret = bytes.Repeat([]byte{0x6b}, 24)
+	})
+	add(func(ic *ImageCreator) {
+		ic.HeaderSize = 0x80
+		ic.HdrPadVal = 0xff
+		ic.ExtraProtTlvs = []ImageTlv{buildId}
+	})
+	add(func(ic *ImageCreator) {
+		ic.Align = 32
+		ic.BodyPadVal = 0xff
+	})
+	add(func(ic *ImageCreator) {
+		ic.Endianness = ENDIANNESS_BIG
+		ic.HashTreeChunkSize = 64
+	})
+	add(func(ic *ImageCreator) {
+		ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+		ic.TlvLayout = TlvLayout{HashLast: true, GroupSigs: true}
+	})
+
+	for i, ic := range creators {
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := img.Bin()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := ParseImage(want)
+		if err != nil {
+			t.Fatalf("image %d: %s", i, err.Error())
+		}
+		have, err := parsed.Bin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("image %d: parse then write not byte-identical", i)
+		}
+	}
+
+	for _, name := range []string{
+		"good-signed-encrypted",
+		"good-signed-unencrypted",
+		"good-unsigned-unencrypted",
+	} {
+		want := readImageData(name)
+		img, err := ParseImage(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := img.Bin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%s: parse then write not byte-identical", name)
+		}
+	}
+
+	// Data following the image that is not padding is discarded.
+	img, err := creators[0].Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = ParseImage(append(bin, "trailing"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.TailPad) != 0 {
+		t.Fatalf("trailing data retained as padding")
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{6}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.HWKeyIndex = -1
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.PlainSecret = bytes.Repeat([]byte{0x5a}, 16)
+	ic.CipherSecret = bytes.Repeat([]byte{0x6b}, 24)
+
+	canon, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := canon.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rearrange the unprotected TLVs and pad the image.
+	ic.TlvLayout = TlvLayout{HashLast: true, GroupSigs: true}
+	ic.Align = 16
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(img.Tlvs)
+	img.Tlvs = append(append([]ImageTlv(nil), img.Tlvs[n-2:]...),
+		img.Tlvs[:n-2]...)
+
+	if err := img.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	have, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Fatalf("canonicalized image differs from default layout")
+	}
+
+	// Canonicalizing a canonical image changes nothing.
+	if err := img.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := img.Bin(); !bytes.Equal(have, want) {
+		t.Fatalf("canonicalization not idempotent")
+	}
+
+	// A header that disagrees with the contents cannot be fixed.
+	bad := canon.Clone()
+	bad.Header.ImgSz++
+	if err := bad.Canonicalize(); err == nil {
+		t.Fatalf("canonicalized image with inconsistent header")
+	}
+
+	// Nor can an unpaired signature.
+	bad = canon.Clone()
+	bad.RemoveTlvsWithType(IMAGE_TLV_KEYHASH)
+	if err := bad.Canonicalize(); err == nil {
+		t.Fatalf("canonicalized image with unpaired signature")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	buildId, err := GenerateBuildIdTlv([]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 1024)
+	ic.HWKeyIndex = -1
+	ic.ExtraProtTlvs = []ImageTlv{buildId, buildId, buildId}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParseImage(bin); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, limits := range []ParseLimits{
+		{MaxImageSize: 1024},
+		{MaxProtSize: 16},
+		{MaxTlvLen: 3},
+		{MaxTlvs: 3},
+	} {
+		_, _, err := ParseImageOpts(bin, ParseOpts{Limits: limits})
+		if err == nil {
+			t.Fatalf("limit %d not enforced", i)
+		}
+
+		// Limits apply in lenient mode as well.
+		_, _, err = ParseImageOpts(bin, ParseOpts{
+			Lenient: true,
+			Limits:  limits,
+		})
+		if err == nil {
+			t.Fatalf("limit %d not enforced in lenient mode", i)
+		}
+	}
+
+	// A header declaring a huge body is rejected before the body is read.
+	img.Header.ImgSz = 0xffffffff
+	var buf bytes.Buffer
+	if _, err := img.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrom(&buf); err == nil ||
+		!strings.Contains(err.Error(), "too large") {
+
+		t.Fatalf("oversized image not rejected: %v", err)
+	}
+}
+
+func TestRomFixed(t *testing.T) {
+	const addr = 0x10020000
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.RomFixedAddr = new(uint32)
+	*ic.RomFixedAddr = addr
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Header.Flags&IMAGE_F_ROM_FIXED == 0 {
+		t.Fatalf("ROM_FIXED flag not set")
+	}
+
+	have, fixed, err := img.RomFixedAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fixed || have != addr {
+		t.Fatalf("wrong ROM-fixed address: have=0x%x,%v want=0x%x",
+			have, fixed, addr)
+	}
+
+	area := flash.FlashArea{Name: "FLASH_AREA_IMAGE_1", Offset: 0x20000}
+	if err := img.VerifyRomFixed(area, 0x10000000); err != nil {
+		t.Fatal(err)
+	}
+	area.Offset = 0x80000
+	if err := img.VerifyRomFixed(area, 0x10000000); err == nil {
+		t.Fatalf("ROM-fixed image accepted for wrong flash area")
+	}
+
+	want := uint32(addr)
+	r := VerifyImage(img, VerifyOpts{FixedAddr: &want})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	want++
+	r = VerifyImage(img, VerifyOpts{FixedAddr: &want})
+	failures := r.Failures()
+	if len(failures) != 1 || failures[0].Name != VERIFY_RULE_FIXED_ADDR {
+		t.Fatalf("unexpected policy failures: %+v", failures)
+	}
+
+	// The TLV must agree with the header.
+	img.Header.Pad1++
+	if _, _, err := img.RomFixedAddr(); err == nil {
+		t.Fatalf("mismatched FIXED_ADDR TLV accepted")
+	}
+
+	// A conflicting load address is rejected.
+	ic.LoadAddr = addr + 4
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("conflicting load address accepted")
+	}
+}
+
+func TestXipPair(t *testing.T) {
+	opts := XipPairOpts{
+		Image: ImageCreateOpts{
+			SrcEncKeyIndex: -1,
+			Version:        ImageVersion{1, 2, 3, 4},
+		},
+	}
+	for i, _ := range opts.Slots {
+		bin := bytes.Repeat([]byte{byte(i + 1)}, 256)
+		opts.Slots[i] = XipSlot{
+			SrcBin: bin,
+			Addr:   0x10000000 + uint32(i)*0x80000,
+		}
+	}
+
+	pair, err := GenerateXipPair(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pair.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, img := range pair.Images {
+		addr, fixed, err := img.RomFixedAddr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fixed || addr != opts.Slots[i].Addr {
+			t.Fatalf("slot %d: wrong ROM-fixed address: 0x%08x", i, addr)
+		}
+		r := VerifyImage(img, VerifyOpts{})
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Images from different pairs do not match.
+	opts.Slots[1].SrcBin = bytes.Repeat([]byte{0x7f}, 256)
+	other, err := GenerateXipPair(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyXipPair(pair.Images[0], other.Images[1]); err == nil {
+		t.Fatalf("images from different pairs accepted")
+	}
+
+	if err := VerifyXipPair(pair.Images[0], pair.Images[0]); err == nil {
+		t.Fatalf("image paired with itself accepted")
+	}
+
+	opts.Slots[1].Addr = opts.Slots[0].Addr
+	if _, err := GenerateXipPair(opts); err == nil {
+		t.Fatalf("pair with shared address accepted")
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{7}, ed25519.SeedSize))
+
+	cnt := uint32(5)
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.Version = ImageVersion{Major: 1, Minor: 2}
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.ApplyImgtoolOpts(ImgtoolOpts{SecurityCounter: &cnt})
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ExtractRollbackInfo(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SecurityCounter == nil || *info.SecurityCounter != cnt {
+		t.Fatalf("wrong security counter: %v", info.SecurityCounter)
+	}
+	if CompareVersions(info.Version, ic.Version) != 0 {
+		t.Fatalf("wrong version: %s", info.Version.String())
+	}
+	if len(info.KeyIds) != 1 {
+		t.Fatalf("wrong key IDs: %v", info.KeyIds)
+	}
+
+	mk := func(name string, minor uint8, cnt uint32,
+		keyId string) RollbackInfo {
+
+		return RollbackInfo{
+			Name:            name,
+			Version:         ImageVersion{Major: 1, Minor: minor},
+			SecurityCounter: &cnt,
+			KeyIds:          []string{keyId},
+		}
+	}
+
+	// Listed out of order; the plan sorts them.
+	plan := PlanRollback([]RollbackInfo{
+		mk("b", 1, 2, "aa"),
+		mk("a", 0, 1, "aa"),
+	})
+	if err := plan.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(plan.Order) != "[1 0]" ||
+		fmt.Sprint(plan.Upgrades) != "[[] [0]]" {
+
+		t.Fatalf("wrong plan: order=%v upgrades=%v",
+			plan.Order, plan.Upgrades)
+	}
+
+	// "c" lowers the security counter, stranding devices running "b".
+	plan = PlanRollback([]RollbackInfo{
+		mk("a", 0, 1, "aa"),
+		mk("b", 1, 2, "aa"),
+		mk("c", 2, 1, "aa"),
+	})
+	var codes []string
+	for _, h := range plan.Hazards {
+		codes = append(codes, h.Code)
+	}
+	want := []string{ROLLBACK_HAZARD_COUNTER, ROLLBACK_HAZARD_STRANDED}
+	if fmt.Sprint(codes) != fmt.Sprint(want) {
+		t.Fatalf("wrong hazards: have=%v want=%v", codes, want)
+	}
+
+	// "d" is signed with a different key.
+	plan = PlanRollback([]RollbackInfo{
+		mk("a", 0, 1, "aa"),
+		mk("d", 1, 1, "bb"),
+	})
+	if len(plan.Hazards) == 0 ||
+		plan.Hazards[0].Code != ROLLBACK_HAZARD_KEY {
+
+		t.Fatalf("key rotation not flagged: %+v", plan.Hazards)
+	}
+}
+
+func TestNamedFlashAreas(t *testing.T) {
+	fm := flash.FlashMap{Areas: []flash.FlashArea{
+		{Name: flash.FLASH_AREA_NAME_IMAGE_0, Id: 1, Offset: 0x20000,
+			Size: 0x60000},
+		{Name: flash.FLASH_AREA_NAME_IMAGE_1, Id: 2, Offset: 0x80000,
+			Size: 0x60000},
+	}}
+
+	opts := ImageCreateOpts{
+		SrcBin:         make([]byte, 64),
+		SrcEncKeyIndex: -1,
+		FlashMap:       &fm,
+		FlashBase:      0x10000000,
+		RomFixedArea:   flash.FLASH_AREA_NAME_IMAGE_1,
+	}
+	img, err := GenerateImage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, fixed, err := img.RomFixedAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fixed || addr != 0x10080000 {
+		t.Fatalf("wrong ROM-fixed address: 0x%08x", addr)
+	}
+
+	// A conflicting explicit address is rejected.
+	opts.RomFixedAddr = new(uint32)
+	*opts.RomFixedAddr = 0x10020000
+	if _, err := GenerateImage(opts); err == nil {
+		t.Fatalf("conflicting ROM-fixed address accepted")
+	}
+
+	// Names require a flash map.
+	opts.RomFixedAddr = nil
+	opts.FlashMap = nil
+	if _, err := GenerateImage(opts); err == nil {
+		t.Fatalf("flash area resolved without a flash map")
+	}
+
+	xopts := XipPairOpts{
+		Image: ImageCreateOpts{
+			SrcEncKeyIndex: -1,
+			FlashMap:       &fm,
+			FlashBase:      0x10000000,
+		},
+	}
+	for i, _ := range xopts.Slots {
+		xopts.Slots[i] = XipSlot{
+			SrcBin: bytes.Repeat([]byte{byte(i + 1)}, 256),
+			Area:   fm.Areas[i].Name,
+		}
+	}
+	pair, err := GenerateXipPair(xopts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, img := range pair.Images {
+		addr, _, err := img.RomFixedAddr()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := uint32(0x10000000 + fm.Areas[i].Offset)
+		if addr != want {
+			t.Fatalf("slot %d: wrong address: have=0x%08x want=0x%08x",
+				i, addr, want)
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf,
+		&slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{5}, ed25519.SeedSize))
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.SigKeys = []sec.PrivSignKey{{Ed25519: &key}}
+	ic.Logger = l
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := img.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseImageOpts(b.Bytes(),
+		ParseOpts{Logger: l}); err != nil {
+
+		t.Fatal(err)
+	}
+
+	pub := sec.PubSignKey{Ed25519: key.Public().(ed25519.PublicKey)}
+	r := VerifyImage(img, VerifyOpts{
+		SigKeys: []sec.PubSignKey{pub},
+		Logger:  l,
+	})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"msg=\"creating image\"",
+		"msg=\"generated tlv\" type=SHA256",
+		"msg=\"parsed tlv\"",
+		"msg=\"image signature\" key_id=",
+		"msg=\"verification step\" stage=hash rule=hash passed=true",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("log lacks %s:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestHashCiphertext(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := sec.PrivSignKey{Ed25519: &edKey}
+
+	encKey := readPrivEncKey()
+	encPub := encKey.PubEncKey()
+
+	body := make([]byte, 1000)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	create := func(hashCiphertext bool) Image {
+		ic := NewImageCreator()
+		ic.Body = body
+		ic.HWKeyIndex = -1
+		ic.SigKeys = []sec.PrivSignKey{signKey}
+		ic.HashCiphertext = hashCiphertext
+		ic.PlainSecret, err = GeneratePlainSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ic.CipherSecret, err = encPub.Encrypt(ic.PlainSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	plain := create(false)
+	cipher := create(true)
+
+	// A ciphertext hash verifies without a key.
+	hc, idx, err := cipher.VerifyHashCoverage(nil, HASH_COVERAGE_AUTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc != HASH_COVERAGE_CIPHERTEXT || idx != -1 {
+		t.Fatalf("wrong hash coverage: have=%s,%d want=ciphertext,-1",
+			HashCoverageString(hc), idx)
+	}
+	if _, err := cipher.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plaintext hash still requires a key.
+	if _, err := plain.VerifyHash(nil); err == nil {
+		t.Fatalf("plaintext hash verified without a key")
+	}
+	hc, idx, err = plain.VerifyHashCoverage([]sec.PrivEncKey{encKey},
+		HASH_COVERAGE_AUTO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hc != HASH_COVERAGE_PLAINTEXT || idx != 0 {
+		t.Fatalf("wrong hash coverage: have=%s,%d want=plaintext,0",
+			HashCoverageString(hc), idx)
+	}
+
+	// Required conventions.
+	_, _, err = cipher.VerifyHashCoverage([]sec.PrivEncKey{encKey},
+		HASH_COVERAGE_PLAINTEXT)
+	if err == nil {
+		t.Fatalf("ciphertext hash accepted as plaintext")
+	}
+	_, _, err = plain.VerifyHashCoverage([]sec.PrivEncKey{encKey},
+		HASH_COVERAGE_CIPHERTEXT)
+	if err == nil {
+		t.Fatalf("plaintext hash accepted as ciphertext")
+	}
+
+	// The decrypted body is unaffected by the hash convention.
+	dec, err := Decrypt(cipher, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.Body, body) {
+		t.Fatalf("decrypted body mismatch")
+	}
+
+	r := VerifyImage(cipher, VerifyOpts{
+		SigKeys: []sec.PubSignKey{signKey.PubKey()},
+		MinSigs: 1,
+	})
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if r.HashCoverage != HASH_COVERAGE_CIPHERTEXT {
+		t.Fatalf("wrong reported hash coverage: have=%s want=ciphertext",
+			HashCoverageString(r.HashCoverage))
+	}
+
+	if _, err := ReEncrypt(cipher, encKey, encPub); err == nil {
+		t.Fatalf("ciphertext-hashed image re-encrypted")
+	}
+
+	ic := NewImageCreator()
+	ic.Body = body
+	ic.HashCiphertext = true
+	if _, err := ic.Create(); err == nil {
+		t.Fatalf("ciphertext hash accepted for unencrypted image")
+	}
+}
+
+func TestSizeBudget(t *testing.T) {
+	fm := flash.FlashMap{Areas: []flash.FlashArea{
+		{Name: flash.FLASH_AREA_NAME_IMAGE_0, Id: 1, Offset: 0x20000,
+			Size: 0x1000},
+	}}
+
+	baseline, err := GenerateImage(ImageCreateOpts{
+		SrcBin:         make([]byte, 0x400),
+		SrcEncKeyIndex: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseSize, err := baseline.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	budget := SizeBudget{
+		TrailerSize: 0x100,
+		Baseline:    &baseline,
+		Enforce:     true,
+	}
+	opts := ImageCreateOpts{
+		SrcBin:         make([]byte, 0x800),
+		SrcEncKeyIndex: -1,
+		FlashMap:       &fm,
+		SlotArea:       flash.FLASH_AREA_NAME_IMAGE_0,
+		SizeBudget:     &budget,
+	}
+
+	img, r, err := GenerateImageWithBudget(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := img.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Budget != 0xf00 || r.Used != size || r.Free != 0xf00-size {
+		t.Fatalf("wrong budget report: %s", r.String())
+	}
+	if r.Area != flash.FLASH_AREA_NAME_IMAGE_0 {
+		t.Fatalf("wrong budget area: have=%s want=%s",
+			r.Area, flash.FLASH_AREA_NAME_IMAGE_0)
+	}
+	if r.Baseline != baseSize || r.Growth != size-baseSize ||
+		r.GrowthPct <= 0 {
+
+		t.Fatalf("wrong growth: %s", r.String())
+	}
+
+	// An enforced budget rejects an image that does not fit.
+	opts.SrcBin = make([]byte, 0x1000)
+	_, r, err = GenerateImageWithBudget(opts)
+	if err == nil || !r.Exceeded() {
+		t.Fatalf("oversized image accepted: %s", r.String())
+	}
+
+	// An unenforced budget only reports the overrun.
+	budget.Enforce = false
+	if _, r, err = GenerateImageWithBudget(opts); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Exceeded() || r.Err() == nil {
+		t.Fatalf("overrun not reported: %s", r.String())
+	}
+
+	// An explicit size overrides the slot.
+	budget.Max = 0x2000
+	if _, r, err = GenerateImageWithBudget(opts); err != nil {
+		t.Fatal(err)
+	}
+	if r.Exceeded() || r.Area != "" {
+		t.Fatalf("explicit budget not applied: %s", r.String())
+	}
+
+	// A derived budget requires a slot.
+	budget.Max = 0
+	opts.SlotArea = ""
+	if _, _, err = GenerateImageWithBudget(opts); err == nil {
+		t.Fatalf("budget derived without a slot")
+	}
+}
+
+func TestUserData(t *testing.T) {
+	data := map[string]interface{}{
+		"region":  "eu",
+		"hw_rev":  3,
+		"offset":  -2,
+		"cal":     []interface{}{uint8(1), 2.5, true, nil},
+		"serial":  []byte{0xde, 0xad},
+		"limits":  map[string]interface{}{"max": uint64(1) << 63},
+		"enabled": false,
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.UserData = data
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The TLV is protected, so the values are covered by the image hash.
+	if len(img.FindProtTlvs(IMAGE_TLV_USER_DATA)) != 1 {
+		t.Fatalf("USER_DATA TLV not in protected area")
+	}
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := img.UserData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"region":  "eu",
+		"hw_rev":  int64(3),
+		"offset":  int64(-2),
+		"cal":     []interface{}{int64(1), 2.5, true, nil},
+		"serial":  []byte{0xde, 0xad},
+		"limits":  map[string]interface{}{"max": uint64(1) << 63},
+		"enabled": false,
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("wrong user data: have=%#v want=%#v", have, want)
+	}
+
+	// Encoding is deterministic: a round trip reproduces the TLV exactly.
+	b, err := EncodeUserData(have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlv := img.FindProtTlvs(IMAGE_TLV_USER_DATA)[0]
+	if !bytes.Equal(b, tlv.Data) {
+		t.Fatalf("user data encoding not deterministic")
+	}
+
+	s, err := tlv.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(s, `"serial": h'dead'`) {
+		t.Fatalf("unexpected USER_DATA rendering: %s", s)
+	}
+
+	// JSON input.
+	m, err := UserDataFromJson([]byte(`{"a": 1, "b": [1.5, "x"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]interface{}{
+		"a": int64(1),
+		"b": []interface{}{1.5, "x"},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Fatalf("wrong JSON user data: have=%#v want=%#v", m, want)
+	}
+
+	// Images without user data.
+	ic.UserData = nil
+	img, err = ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := img.UserData(); err != nil || m != nil {
+		t.Fatalf("unexpected user data: %v %v", m, err)
+	}
+
+	// Malformed values are rejected.
+	for _, b := range [][]byte{
+		{0x01},             // Not a map.
+		{0xa1, 0x01, 0x01}, // Non-text key.
+		{0xa1, 0x61, 0x61}, // Truncated.
+		{0xa0, 0x00},       // Trailing bytes.
+		{0xbf, 0xff},       // Indefinite length.
+		{0xa2, 0x61, 0x61, 0x01, 0x61, 0x61, 0x02}, // Duplicate key.
+	} {
+		if _, err := DecodeUserData(b); err == nil {
+			t.Fatalf("malformed user data accepted: %x", b)
+		}
+	}
+
+	if _, err := EncodeUserData(map[string]interface{}{
+		"x": struct{}{},
+	}); err == nil {
+		t.Fatalf("unsupported type encoded")
+	}
+}
+
+func TestTransformer(t *testing.T) {
+	watermark := NewTransformer("test-watermark",
+		func(img Image) (Image, error) {
+			copy(img.Body, "WMRK")
+			return img, nil
+		})
+	vendor := NewTransformer("test-vendor",
+		func(img Image) (Image, error) {
+			img.ProtTlvs = append(img.ProtTlvs, ImageTlv{
+				Header: ImageTlvHdr{Type: 0xc0, Len: 2},
+				Data:   []byte{0x12, 0x34},
+			})
+			return img, nil
+		})
+
+	for _, tr := range []Transformer{watermark, vendor} {
+		if err := RegisterTransformer(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterTransformer(vendor); err == nil {
+		t.Fatalf("duplicate transformer registered")
+	}
+	if _, err := LookupTransformers([]string{"test-none"}); err == nil {
+		t.Fatalf("unknown transformer found")
+	}
+
+	ts, err := LookupTransformers([]string{"test-watermark", "test-vendor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.Transformers = ts
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The transformers' changes are covered by the image hash.
+	if string(img.Body[:4]) != "WMRK" {
+		t.Fatalf("body not watermarked")
+	}
+	if len(img.FindProtTlvs(0xc0)) != 1 {
+		t.Fatalf("vendor TLV not in protected area")
+	}
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	fail := NewTransformer("test-fail", func(img Image) (Image, error) {
+		return img, errors.Errorf("no stamp available")
+	})
+	ic.Transformers = []Transformer{fail}
+	if _, err := ic.Create(); err == nil ||
+		!strings.Contains(err.Error(), "test-fail") {
+
+		t.Fatalf("transformer failure not reported: %v", err)
+	}
+
+	// A transformer that grows the body runs before alignment padding and
+	// before the nonce is derived.
+	grow := NewTransformer("test-grow", func(img Image) (Image, error) {
+		img.Body = append(img.Body, "TAIL"...)
+		return img, nil
+	})
+	encKey := readPrivEncKey()
+
+	img, err = GenerateImage(ImageCreateOpts{
+		SrcBin:            make([]byte, 60),
+		SrcEncKeyFilename: testdataPath + "/enc-key-pub.pem",
+		SrcEncKeyIndex:    -1,
+		NonceSource:       NONCE_SOURCE_DERIVED,
+		Align:             32,
+		Transformers:      []Transformer{grow},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (int(img.Header.HdrSz)+len(img.Body))%32 != 0 {
+		t.Fatalf("transformed body not aligned: hdr=%d body=%d",
+			img.Header.HdrSz, len(img.Body))
+	}
+
+	dec, err := Decrypt(img, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec.Body[60:64]) != "TAIL" {
+		t.Fatalf("body not transformed before padding")
+	}
+	nonce, err := img.Nonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nonce, DeriveNonce(dec.Body)) {
+		t.Fatalf("derived nonce does not cover the transformed body")
+	}
+}
+
+func TestHashAlg(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signKey := sec.PrivSignKey{Ed25519: &edKey}
+
+	encKey := readPrivEncKey()
+	encPub := encKey.PubEncKey()
+
+	create := func(encrypt bool) Image {
+		ic := NewImageCreator()
+		ic.Body = make([]byte, 1000)
+		ic.HWKeyIndex = -1
+		ic.SigKeys = []sec.PrivSignKey{signKey}
+		ic.HashAlg = HASH_ALG_BLAKE2S
+		if encrypt {
+			ic.PlainSecret, err = GeneratePlainSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ic.CipherSecret, err = encPub.Encrypt(ic.PlainSecret)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	img := create(false)
+	if len(img.FindTlvs(IMAGE_TLV_SHA256)) != 0 ||
+		len(img.FindTlvs(IMAGE_TLV_BLAKE2S)) != 1 {
+
+		t.Fatalf("wrong hash TLVs")
+	}
+	alg, err := img.HashAlg()
+	if err != nil || alg != HASH_ALG_BLAKE2S {
+		t.Fatalf("wrong hash algorithm: have=%s err=%v",
+			HashAlgString(alg), err)
+	}
+
+	// The hash is BLAKE2s-256 of the same data SHA256 would cover.
+	sha, err := img.calcHashAlg(HASH_ALG_SHA256, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := img.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 32 || bytes.Equal(hash, sha) {
+		t.Fatalf("image hash is not BLAKE2s: %x", hash)
+	}
+
+	if _, err := img.VerifyHash(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := img.VerifySigs(
+		[]sec.PubSignKey{signKey.PubKey()}); err != nil {
+
+		t.Fatal(err)
+	}
+
+	// Encrypted images verify with the decryption key.
+	img = create(true)
+	if _, err := img.VerifyHash([]sec.PrivEncKey{encKey}); err != nil {
+		t.Fatal(err)
+	}
+	r := VerifyImage(img, VerifyOpts{
+		SigKeys: []sec.PubSignKey{signKey.PubKey()},
+		EncKeys: []sec.PrivEncKey{encKey},
+	})
+	if !r.Passed() {
+		t.Fatalf("BLAKE2s image failed verification: %v", r.Err())
+	}
+
+	// A tampered body is detected.
+	img.Body[0] ^= 1
+	if _, err := img.VerifyHash([]sec.PrivEncKey{encKey}); err == nil {
+		t.Fatalf("tampered BLAKE2s image verified")
+	}
+
+	if _, err := HashAlgFromString("blake3"); err == nil {
+		t.Fatalf("unsupported hash algorithm accepted")
+	}
+}
@@ -0,0 +1,210 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// This file provides interoperability with images produced by MCUboot's
+// imgtool.  The two tools share a format, but differ in some defaults and in
+// the meaning of a few TLV types; see the "imgtool compatibility" section of
+// the README for the full list.
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// TLV types whose imgtool meaning conflicts with this package's legacy
+// encryption TLVs (IMAGE_TLV_AES_NONCE_LEGACY and IMAGE_TLV_SECRET_ID_LEGACY).
+// A TLV of either type is interpreted according to the caller's context:
+// ImportImgtool, SecurityCounter, and VerifyOpts.MinSecurityCounter read
+// them as imgtool TLVs; Nonce and the decryption functions read them as
+// legacy encryption TLVs.
+const (
+	IMGTOOL_TLV_SEC_CNT     = 0x50
+	IMGTOOL_TLV_BOOT_RECORD = 0x60
+)
+
+// Header flags set by imgtool.  Except for ROM_FIXED, this package does not
+// set them itself.
+const (
+	IMGTOOL_F_ENCRYPTED_AES256 = 0x00000008
+	IMGTOOL_F_RAM_LOAD         = 0x00000020
+	IMGTOOL_F_ROM_FIXED        = IMAGE_F_ROM_FIXED
+)
+
+// ImgtoolOpts specifies imgtool features that have no equivalent in
+// ImageCreator.
+type ImgtoolOpts struct {
+	LoadAddr        uint32  // imgtool --load-addr / --rom-fixed address.
+	RamLoad         bool    // Set IMGTOOL_F_RAM_LOAD.
+	RomFixed        bool    // Set IMGTOOL_F_ROM_FIXED.
+	SecurityCounter *uint32 // imgtool --security-counter; nil to omit.
+	BootRecord      []byte  // imgtool --boot-record (CBOR); nil to omit.
+}
+
+// ImgtoolInfo describes the imgtool-specific properties of an imported
+// image.
+type ImgtoolInfo struct {
+	ImgtoolOpts
+
+	// AES-256 rather than AES-128 encryption (IMGTOOL_F_ENCRYPTED_AES256).
+	Aes256 bool
+
+	// Number of bytes following the image, e.g., the slot padding and boot
+	// trailer written by imgtool --pad.
+	SlotPad int
+}
+
+// NewImgtoolImageCreator creates an image creator whose output matches
+// imgtool's for the same inputs.  In particular, the hardware-key TLVs that
+// NewImageCreator emits by default are disabled.  Callers should not enable
+// features imgtool lacks (sections, build time, vendor TLVs, alignment
+// padding) if byte-for-byte compatibility is required.
+func NewImgtoolImageCreator() ImageCreator {
+	ic := NewImageCreator()
+	ic.HWKeyIndex = -1
+	ic.HdrPadVal = 0
+	ic.FullKeyHash = true
+
+	return ic
+}
+
+// ApplyImgtoolOpts configures an image creator to emit the given imgtool
+// features.
+func (ic *ImageCreator) ApplyImgtoolOpts(opts ImgtoolOpts) {
+	ic.LoadAddr = opts.LoadAddr
+	if opts.RamLoad {
+		ic.ExtraFlags |= IMGTOOL_F_RAM_LOAD
+	}
+	if opts.RomFixed {
+		ic.ExtraFlags |= IMGTOOL_F_ROM_FIXED
+	}
+
+	// imgtool emits the security counter before the boot record, both after
+	// any dependencies.
+	if opts.SecurityCounter != nil {
+		data := make([]byte, 4)
+		binary.LittleEndian.PutUint32(data, *opts.SecurityCounter)
+		ic.ExtraProtTlvs = append(ic.ExtraProtTlvs, ImageTlv{
+			Header: ImageTlvHdr{
+				Type: IMGTOOL_TLV_SEC_CNT,
+				Len:  uint16(len(data)),
+			},
+			Data: data,
+		})
+	}
+	if opts.BootRecord != nil {
+		ic.ExtraProtTlvs = append(ic.ExtraProtTlvs, ImageTlv{
+			Header: ImageTlvHdr{
+				Type: IMGTOOL_TLV_BOOT_RECORD,
+				Len:  uint16(len(opts.BootRecord)),
+			},
+			Data: append([]byte(nil), opts.BootRecord...),
+		})
+	}
+}
+
+// ImportImgtool parses an image created by imgtool and extracts the
+// imgtool-specific information.  The image itself is returned unmodified (its
+// hash and signatures remain valid), except that any slot padding following
+// the image is dropped.
+//
+// Because imgtool's SEC_CNT and BOOT_RECORD TLVs share type values with this
+// package's legacy nonce and secret ID TLVs, the returned image must not be
+// passed to Decrypt or DecryptHw if either is present.
+func ImportImgtool(data []byte) (Image, ImgtoolInfo, error) {
+	info := ImgtoolInfo{}
+
+	img, err := ParseImage(data)
+	if err != nil {
+		return img, info, err
+	}
+
+	size, err := img.TotalSize()
+	if err != nil {
+		return img, info, err
+	}
+	info.SlotPad = len(data) - size
+
+	info.LoadAddr = img.Header.Pad1
+	info.RamLoad = img.Header.Flags&IMGTOOL_F_RAM_LOAD != 0
+	info.RomFixed = img.Header.Flags&IMGTOOL_F_ROM_FIXED != 0
+	info.Aes256 = img.Header.Flags&IMGTOOL_F_ENCRYPTED_AES256 != 0
+
+	info.SecurityCounter, err = img.SecurityCounter()
+	if err != nil {
+		return img, info, err
+	}
+
+	tlv, err := img.FindProtUniqueTlv(IMGTOOL_TLV_BOOT_RECORD)
+	if err != nil {
+		return img, info, err
+	}
+	if tlv != nil {
+		info.BootRecord = tlv.Data
+	}
+
+	return img, info, nil
+}
+
+// SecurityCounter returns the image's imgtool security counter (a protected
+// IMGTOOL_TLV_SEC_CNT TLV), or nil if it has none.
+func (img *Image) SecurityCounter() (*uint32, error) {
+	tlv, err := img.FindProtUniqueTlv(IMGTOOL_TLV_SEC_CNT)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	if len(tlv.Data) != 4 {
+		return nil, errors.Errorf(
+			"invalid security counter TLV: have-len=%d want-len=4",
+			len(tlv.Data))
+	}
+	cnt := binary.LittleEndian.Uint32(tlv.Data)
+
+	return &cnt, nil
+}
+
+func (img *Image) verifyPolicySecurityCounter(opts VerifyOpts,
+	r *VerifyReport) {
+
+	if opts.MinSecurityCounter == nil {
+		return
+	}
+
+	cnt, err := img.SecurityCounter()
+	detail := ""
+	if err == nil {
+		if cnt == nil {
+			err = errors.Errorf("image has no security counter")
+		} else if *cnt < *opts.MinSecurityCounter {
+			err = errors.Errorf(
+				"security counter too low: have=%d want>=%d",
+				*cnt, *opts.MinSecurityCounter)
+		} else {
+			detail = fmt.Sprintf("security counter=%d", *cnt)
+		}
+	}
+	r.add(VERIFY_RULE_SEC_CNT, err, detail)
+}
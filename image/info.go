@@ -0,0 +1,134 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// ImageInfo summarizes an image without its body or protected TLVs.
+type ImageInfo struct {
+	Header     ImageHdr
+	Endianness Endianness
+
+	// Total size of the image, in bytes, excluding any tail padding.
+	Size int
+
+	// The unprotected TLVs (hash, signatures, key hashes, etc.).
+	Tlvs []ImageTlv
+
+	// Contents of the SHA256 TLV.
+	Hash []byte
+
+	// One entry per signature, in TLV order.  A signature identified by a
+	// PUBKEY TLV is reported with the hash of the embedded key.
+	SigTypes  []sec.SigType
+	KeyHashes [][]byte
+}
+
+// Version returns the image version from the header.
+func (info *ImageInfo) Version() ImageVersion {
+	return info.Header.Vers
+}
+
+// ReadInfo reads an image's header and unprotected TLVs.  Only three small
+// reads are performed regardless of image size: the header, the TLV trailer,
+// and the TLVs themselves.  The body is neither read nor checked against the
+// hash; use ReadImage for that.
+func ReadInfo(r io.ReaderAt) (ImageInfo, error) {
+	info := ImageInfo{}
+
+	buf := make([]byte, IMAGE_HEADER_SIZE)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return info, errors.Wrapf(err, "failed to read image header")
+	}
+
+	info.Endianness, _ = DetectEndianness(buf)
+	order := info.Endianness.ByteOrder()
+
+	var hdr ImageHdr
+	if err := binary.Read(bytes.NewReader(buf), order, &hdr); err != nil {
+		return info, errors.Wrapf(err, "error reading image header")
+	}
+	if hdr.Magic != IMAGE_MAGIC {
+		return info, errors.Errorf(
+			"image magic incorrect; expected 0x%08x, got 0x%08x",
+			uint32(IMAGE_MAGIC), hdr.Magic)
+	}
+	if int(hdr.HdrSz) < IMAGE_HEADER_SIZE {
+		return info, errors.Errorf(
+			"invalid image header size: %d", hdr.HdrSz)
+	}
+	info.Header = hdr
+
+	trailerOff := int64(hdr.HdrSz) + int64(hdr.ImgSz) + int64(hdr.ProtSz)
+	buf = make([]byte, IMAGE_TRAILER_SIZE)
+	if _, err := r.ReadAt(buf, trailerOff); err != nil {
+		return info, errors.WithOffset(errors.Wrapf(err,
+			"failed to read image trailer"), int(trailerOff))
+	}
+
+	trailer, _, err := parseRawTrailer(buf, 0, order)
+	if err != nil {
+		return info, errors.WithOffset(err, int(trailerOff))
+	}
+	if trailer.Magic != IMAGE_TRAILER_MAGIC ||
+		trailer.TlvTotLen < IMAGE_TRAILER_SIZE {
+
+		return info, errors.WithOffset(errors.Errorf(
+			"invalid image trailer: magic=0x%04x tlv-len=%d",
+			trailer.Magic, trailer.TlvTotLen), int(trailerOff))
+	}
+
+	tlvsLen := int(trailer.TlvTotLen) - IMAGE_TRAILER_SIZE
+	buf = make([]byte, tlvsLen)
+	if _, err := r.ReadAt(buf, trailerOff+IMAGE_TRAILER_SIZE); err != nil {
+		return info, errors.Wrapf(err, "failed to read image TLVs")
+	}
+
+	info.Tlvs, err = parseRawTlvs(buf, 0, tlvsLen, order)
+	if err != nil {
+		return info, err
+	}
+	info.Size = int(trailerOff) + int(trailer.TlvTotLen)
+
+	for _, tlv := range info.Tlvs {
+		if ImageTlvTypeIsHash(tlv.Header.Type) {
+			info.Hash = tlv.Data
+			break
+		}
+	}
+
+	sigs, err := CollectTlvSigs(info.Tlvs)
+	if err != nil {
+		return info, err
+	}
+	for _, sig := range sigs {
+		info.SigTypes = append(info.SigTypes, sig.Type)
+		info.KeyHashes = append(info.KeyHashes, sig.KeyHash)
+	}
+
+	return info, nil
+}
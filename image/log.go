@@ -0,0 +1,98 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"context"
+	"encoding/hex"
+	"log/slog"
+
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// Entry points that accept a *slog.Logger log stage-level events at debug
+// level: the TLVs generated or parsed, sizes, the key IDs used, and each
+// verification step.  A nil logger disables logging.
+
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog handler that drops every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool {
+	return false
+}
+
+func (discardHandler) Handle(context.Context, slog.Record) error {
+	return nil
+}
+
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler {
+	return h
+}
+
+func (h discardHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func logOrDiscard(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return discardLogger
+	}
+	return l
+}
+
+func logTlv(l *slog.Logger, msg string, tlv ImageTlv, prot bool) {
+	l.Debug(msg,
+		"type", ImageTlvTypeName(tlv.Header.Type),
+		"len", tlv.Header.Len,
+		"protected", prot)
+}
+
+// logTlvs logs each of an image's TLVs.
+func (img *Image) logTlvs(l *slog.Logger, msg string) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	for _, tlv := range img.ProtTlvs {
+		logTlv(l, msg, tlv, true)
+	}
+	for _, tlv := range img.Tlvs {
+		logTlv(l, msg, tlv, false)
+	}
+}
+
+// logSigs logs the key ID and algorithm of each of an image's signatures.
+func (img *Image) logSigs(l *slog.Logger, msg string) {
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return
+	}
+	for _, sig := range sigs {
+		l.Debug(msg,
+			"key_id", hex.EncodeToString(sig.KeyHash),
+			"sig_type", sec.SigTypeString(sig.Type))
+	}
+}
@@ -53,7 +53,7 @@ func (t *ImageTrailer) Map(offset int) map[string]interface{} {
 }
 
 func (t *ImageTlv) Map(index int, offset int) map[string]interface{} {
-	return map[string]interface{}{
+	m := map[string]interface{}{
 		"_index":   index,
 		"_offset":  offset,
 		"_typestr": ImageTlvTypeName(t.Header.Type),
@@ -61,6 +61,15 @@ func (t *ImageTlv) Map(index int, offset int) map[string]interface{} {
 		"len":      t.Header.Len,
 		"type":     t.Header.Type,
 	}
+
+	// Include a readable rendering for TLV types that have a decoder.
+	if imageTlvDecoderMap[t.Header.Type] != nil {
+		if s, err := t.Decode(); err == nil {
+			m["_decoded"] = s
+		}
+	}
+
+	return m
 }
 
 // Map produces a JSON-friendly map representation of an image.
@@ -71,6 +80,7 @@ func (img *Image) Map() (map[string]interface{}, error) {
 	}
 
 	m := map[string]interface{}{}
+	m["endianness"] = EndiannessString(img.Endianness)
 	m["header"] = img.Header.Map(offs.Header)
 	m["body"] = rawBodyMap(offs.Body)
 
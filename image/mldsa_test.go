@@ -0,0 +1,149 @@
+//go:build go1.27
+
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image_test
+
+import (
+	"crypto/mldsa"
+	"crypto/rand"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestMlDsa(t *testing.T) {
+	priv, err := mldsa.GenerateKey(mldsa.MLDSA44())
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sec.PrivSignKey{MlDsa: priv}
+
+	ic := image.NewImageCreator()
+	ic.Version = image.ImageVersion{1, 9, 0, 0}
+	ic.Body = make([]byte, 256)
+	ic.SigKeys = []sec.PrivSignKey{key}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlvs := img.FindTlvs(image.IMAGE_TLV_MLDSA44)
+	if len(tlvs) != 1 || len(tlvs[0].Data) != mldsa.MLDSA44SignatureSize {
+		t.Fatalf("image lacks ML-DSA-44 signature TLV")
+	}
+
+	idx, err := img.VerifySigs([]sec.PubSignKey{key.PubKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 0 {
+		t.Fatalf("wrong key index: have=%d want=0", idx)
+	}
+}
+
+func TestHybridPolicy(t *testing.T) {
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pqPriv, err := mldsa.GenerateKey(mldsa.MLDSA44())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	classical := sec.PrivSignKey{Ed25519: &edPriv}
+	pqc := sec.PrivSignKey{MlDsa: pqPriv}
+	hybrid := sec.HybridPubSignKey{
+		Classical:   classical.PubKey(),
+		PostQuantum: pqc.PubKey(),
+	}
+
+	create := func(keys ...sec.PrivSignKey) image.Image {
+		ic := image.NewImageCreator()
+		ic.Version = image.ImageVersion{1, 10, 0, 0}
+		ic.Body = make([]byte, 256)
+		ic.SigKeys = keys
+
+		img, err := ic.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	both := create(classical, pqc)
+	classicalOnly := create(classical)
+	pqcOnly := create(pqc)
+
+	tests := []struct {
+		img    image.Image
+		policy image.HybridPolicy
+		expOk  bool
+	}{
+		{both, image.HYBRID_POLICY_ANY, true},
+		{both, image.HYBRID_POLICY_ALL, true},
+		{both, image.HYBRID_POLICY_CLASSICAL_THEN_PQC, true},
+		{classicalOnly, image.HYBRID_POLICY_ANY, true},
+		{classicalOnly, image.HYBRID_POLICY_ALL, false},
+		{classicalOnly, image.HYBRID_POLICY_CLASSICAL_THEN_PQC, true},
+		{pqcOnly, image.HYBRID_POLICY_ANY, true},
+		{pqcOnly, image.HYBRID_POLICY_ALL, false},
+		{pqcOnly, image.HYBRID_POLICY_CLASSICAL_THEN_PQC, false},
+	}
+
+	for i, test := range tests {
+		_, err := test.img.VerifyHybridSigs(
+			[]sec.HybridPubSignKey{hybrid}, test.policy)
+		if test.expOk && err != nil {
+			t.Fatalf("test %d (%s): unexpected failure: %s",
+				i, image.HybridPolicyString(test.policy), err.Error())
+		}
+		if !test.expOk && err == nil {
+			t.Fatalf("test %d (%s): unexpected success",
+				i, image.HybridPolicyString(test.policy))
+		}
+	}
+
+	// A corrupted post-quantum signature must be rejected by every policy
+	// except "any".
+	bad := create(classical, pqc)
+	tlv := bad.FindTlvs(image.IMAGE_TLV_MLDSA44)[0]
+	tlv.Data[0] ^= 0xff
+
+	for _, policy := range []image.HybridPolicy{
+		image.HYBRID_POLICY_ALL,
+		image.HYBRID_POLICY_CLASSICAL_THEN_PQC,
+	} {
+		if _, err := bad.VerifyHybridSigs(
+			[]sec.HybridPubSignKey{hybrid}, policy); err == nil {
+
+			t.Fatalf("%s: corrupt pqc signature accepted",
+				image.HybridPolicyString(policy))
+		}
+	}
+
+	if _, err := image.HybridStringPolicy("classical-then-pqc"); err != nil {
+		t.Fatal(err)
+	}
+}
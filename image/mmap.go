@@ -0,0 +1,112 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// MappedFile is a read-only view of a file's contents.  Where the platform
+// supports it, the file is memory-mapped so that large binaries are not
+// copied onto the heap; otherwise it is read into memory.
+//
+// The file must not be modified or truncated while it is mapped.  Data, and
+// anything that aliases it (e.g., the body of an image parsed from it), is
+// invalid after Close.
+type MappedFile struct {
+	Data   []byte
+	mapped bool
+}
+
+// MapFile memory-maps the specified file.  It falls back to reading the file
+// if it cannot be mapped (e.g., it is empty or not a regular file).
+func MapFile(filename string) (*MappedFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open file")
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat file")
+	}
+
+	size := fi.Size()
+	if fi.Mode().IsRegular() && size > 0 && int64(int(size)) == size {
+		if data, err := mmapFile(f, int(size)); err == nil {
+			return &MappedFile{Data: data, mapped: true}, nil
+		}
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read file")
+	}
+
+	return &MappedFile{Data: data}, nil
+}
+
+// Mapped indicates whether the file is memory-mapped rather than read into
+// memory.
+func (m *MappedFile) Mapped() bool {
+	return m.mapped
+}
+
+// Close releases the file's contents.
+func (m *MappedFile) Close() error {
+	data := m.Data
+	mapped := m.mapped
+
+	m.Data = nil
+	m.mapped = false
+
+	if !mapped {
+		return nil
+	}
+
+	if err := munmapFile(data); err != nil {
+		return errors.Wrapf(err, "failed to unmap file")
+	}
+
+	return nil
+}
+
+// MapImage memory-maps and parses an image file.  The image's body and TLVs
+// refer to the mapping, so the caller must close the returned file once it
+// is done with the image.
+func MapImage(filename string) (Image, *MappedFile, error) {
+	m, err := MapFile(filename)
+	if err != nil {
+		return Image{}, nil, errors.Wrapf(err,
+			"failed to read image from file")
+	}
+
+	img, err := ParseImage(m.Data)
+	if err != nil {
+		m.Close()
+		return Image{}, nil, errors.WithArtifact(err, "", filename)
+	}
+
+	return img, m, nil
+}
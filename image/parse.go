@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"strconv"
 	"strings"
 
@@ -70,27 +71,30 @@ func ParseVersion(versStr string) (ImageVersion, error) {
 	return ver, nil
 }
 
-func parseRawHeader(imgData []byte, offset int) (ImageHdr, int, error) {
+func parseRawHeader(imgData []byte, offset int,
+	order binary.ByteOrder) (ImageHdr, int, error) {
+
 	var hdr ImageHdr
 
 	r := bytes.NewReader(imgData)
 	r.Seek(int64(offset), io.SeekStart)
 
-	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
-		return hdr, 0, errors.Wrapf(err, "error reading image header")
+	if err := binary.Read(r, order, &hdr); err != nil {
+		return hdr, 0, errors.WithOffset(
+			errors.Wrapf(err, "error reading image header"), offset)
 	}
 
 	if hdr.Magic != IMAGE_MAGIC {
-		return hdr, 0, errors.Errorf(
+		return hdr, 0, errors.WithOffset(errors.Errorf(
 			"image magic incorrect; expected 0x%08x, got 0x%08x",
-			uint32(IMAGE_MAGIC), hdr.Magic)
+			uint32(IMAGE_MAGIC), hdr.Magic), offset)
 	}
 
 	remLen := len(imgData) - offset
 	if remLen < int(hdr.HdrSz) {
-		return hdr, 0, errors.Errorf(
+		return hdr, 0, errors.WithOffset(errors.Errorf(
 			"image header incomplete; expected %d bytes, got %d bytes",
-			hdr.HdrSz, remLen)
+			hdr.HdrSz, remLen), offset)
 	}
 
 	return hdr, int(hdr.HdrSz), nil
@@ -103,150 +107,476 @@ func parseRawBody(imgData []byte, hdr ImageHdr,
 	remLen := len(imgData) - offset
 
 	if remLen < imgSz {
-		return nil, 0, errors.Errorf(
+		return nil, 0, errors.WithOffset(errors.Errorf(
 			"image body incomplete; expected %d bytes, got %d bytes",
-			imgSz, remLen)
+			imgSz, remLen), offset)
 	}
 
 	return imgData[offset : offset+imgSz], imgSz, nil
 }
 
-func parseRawTrailer(imgData []byte, offset int) (ImageTrailer, int, error) {
+func parseRawTrailer(imgData []byte, offset int,
+	order binary.ByteOrder) (ImageTrailer, int, error) {
+
 	var trailer ImageTrailer
 
 	r := bytes.NewReader(imgData)
 	r.Seek(int64(offset), io.SeekStart)
 
-	if err := binary.Read(r, binary.LittleEndian, &trailer); err != nil {
-		return trailer, 0, errors.Wrapf(err,
-			"image contains invalid trailer at offset %d", offset)
+	if err := binary.Read(r, order, &trailer); err != nil {
+		return trailer, 0, errors.WithOffset(errors.Wrapf(err,
+			"image contains invalid trailer"), offset)
 	}
 
 	return trailer, IMAGE_TRAILER_SIZE, nil
 }
 
-func parseRawTlv(imgData []byte, offset int) (ImageTlv, int, error) {
+func parseRawTlv(imgData []byte, offset int,
+	order binary.ByteOrder) (ImageTlv, int, error) {
+
 	tlv := ImageTlv{}
 
 	r := bytes.NewReader(imgData)
 	r.Seek(int64(offset), io.SeekStart)
 
-	if err := binary.Read(r, binary.LittleEndian, &tlv.Header); err != nil {
-		return tlv, 0, errors.Wrapf(err,
-			"image contains invalid TLV at offset %d", offset)
+	if err := binary.Read(r, order, &tlv.Header); err != nil {
+		return tlv, 0, errors.WithOffset(errors.Wrapf(err,
+			"image contains invalid TLV"), offset)
 	}
 
 	tlv.Data = make([]byte, tlv.Header.Len)
 	if _, err := r.Read(tlv.Data); err != nil {
-		return tlv, 0, errors.Wrapf(err,
-			"image contains invalid TLV at offset %d", offset)
+		err = errors.Wrapf(err, "image contains invalid TLV")
+		err = errors.WithTlv(err, -1, tlv.Header.Type,
+			ImageTlvTypeName(tlv.Header.Type))
+		return tlv, 0, errors.WithOffset(err, offset)
 	}
 
 	return tlv, IMAGE_TLV_SIZE + int(tlv.Header.Len), nil
 }
 
-func parseRawTlvs(imgData []byte, offset int, size int) ([]ImageTlv, error) {
+// parseRawTlvs parses a sequence of TLVs.  On error, the TLVs successfully
+// parsed prior to the failure are returned along with the error.
+func parseRawTlvs(imgData []byte, offset int, size int,
+	order binary.ByteOrder) ([]ImageTlv, error) {
+
 	var tlvs []ImageTlv
 
 	end := offset + size
 	for offset < end {
-		tlv, tlvSize, err := parseRawTlv(imgData, offset)
+		tlv, tlvSize, err := parseRawTlv(imgData, offset, order)
 		if err != nil {
-			return nil, err
+			return tlvs, err
 		}
 
-		tlvs = append(tlvs, tlv)
+		if offset+tlvSize > end {
+			err := errors.Errorf("TLVs extend beyond end of image")
+			err = errors.WithTlv(err, len(tlvs), tlv.Header.Type,
+				ImageTlvTypeName(tlv.Header.Type))
+			return tlvs, errors.WithOffset(err, offset)
+		}
 
+		tlvs = append(tlvs, tlv)
 		offset += tlvSize
-		if offset > end {
-			return nil, errors.Errorf("TLVs extend beyond end of image")
-		}
 	}
 
 	return tlvs, nil
 }
 
+// checkTlvLimits verifies that a sequence of TLVs contains no more than
+// maxCount TLVs and that none is longer than maxLen.  Only the TLV headers
+// are read, so the check is done before any TLV data is allocated.
+// Malformed TLVs are left for the parser to report.
+func checkTlvLimits(imgData []byte, offset int, size int,
+	order binary.ByteOrder, maxLen int, maxCount int) error {
+
+	r := bytes.NewReader(imgData)
+
+	end := offset + size
+	for idx := 0; offset < end; idx++ {
+		var hdr ImageTlvHdr
+		r.Seek(int64(offset), io.SeekStart)
+		if err := binary.Read(r, order, &hdr); err != nil {
+			return nil
+		}
+
+		if idx >= maxCount {
+			return errors.WithOffset(errors.Errorf(
+				"image contains too many TLVs: max=%d", maxCount), offset)
+		}
+		if int(hdr.Len) > maxLen {
+			err := errors.Errorf("TLV too long: have=%d max=%d",
+				hdr.Len, maxLen)
+			err = errors.WithTlv(err, idx, hdr.Type,
+				ImageTlvTypeName(hdr.Type))
+			return errors.WithOffset(err, offset)
+		}
+
+		offset += IMAGE_TLV_SIZE + int(hdr.Len)
+	}
+
+	return nil
+}
+
+// Default parse limits.  These are far larger than any real image needs, but
+// bound the work done for a hostile one.
+const (
+	PARSE_DEFAULT_MAX_IMAGE_SIZE = 64 * 1024 * 1024
+	PARSE_DEFAULT_MAX_PROT_SIZE  = 0xffff
+	PARSE_DEFAULT_MAX_TLV_LEN    = 0xffff
+	PARSE_DEFAULT_MAX_TLVS       = 1024
+)
+
+// ParseLimits caps the resources consumed when parsing an image, for
+// services that parse untrusted uploads.  Exceeding a limit is an error even
+// in lenient mode.  Zero-valued fields select the defaults.
+type ParseLimits struct {
+	// The maximum size of the image, from the start of the header to the
+	// end of the TLVs.
+	MaxImageSize int
+
+	// The maximum size of the protected TLV area, including its trailer.
+	MaxProtSize int
+
+	// The maximum length of a single TLV's data.
+	MaxTlvLen int
+
+	// The maximum number of TLVs, protected and unprotected combined.
+	MaxTlvs int
+}
+
+func (l ParseLimits) withDefaults() ParseLimits {
+	if l.MaxImageSize == 0 {
+		l.MaxImageSize = PARSE_DEFAULT_MAX_IMAGE_SIZE
+	}
+	if l.MaxProtSize == 0 {
+		l.MaxProtSize = PARSE_DEFAULT_MAX_PROT_SIZE
+	}
+	if l.MaxTlvLen == 0 {
+		l.MaxTlvLen = PARSE_DEFAULT_MAX_TLV_LEN
+	}
+	if l.MaxTlvs == 0 {
+		l.MaxTlvs = PARSE_DEFAULT_MAX_TLVS
+	}
+
+	return l
+}
+
+// checkHeader verifies that the sizes an image header declares are within
+// the limits.  tlvTotLen is the length of the unprotected TLV area, or 0 if
+// it is not yet known.
+func (l ParseLimits) checkHeader(hdr ImageHdr, tlvTotLen int) error {
+	if int(hdr.ProtSz) > l.MaxProtSize {
+		return errors.WithOffset(errors.Errorf(
+			"protected TLV area too large: have=%d max=%d",
+			hdr.ProtSz, l.MaxProtSize), 0)
+	}
+
+	size := int(hdr.HdrSz) + int(hdr.ImgSz) + int(hdr.ProtSz) + tlvTotLen
+	if size > l.MaxImageSize {
+		return errors.WithOffset(errors.Errorf(
+			"image too large: have>=%d max=%d", size, l.MaxImageSize), 0)
+	}
+
+	return nil
+}
+
+// ParseOpts controls how images are parsed.
+type ParseOpts struct {
+	// If true, recoverable problems are reported as warnings and parsing
+	// continues with as much of the image as can be salvaged.  Intended for
+	// forensic tools; a leniently parsed image should not be trusted.
+	Lenient bool
+
+	// How duplicate TLVs are treated.
+	Duplicates DupPolicy
+
+	Limits ParseLimits
+
+	// If non-nil, receives debug-level events describing the parsed image.
+	Logger *slog.Logger
+}
+
+type imageParser struct {
+	opts     ParseOpts
+	warnings []error
+}
+
+// problem reports a recoverable parse error.  In strict mode the error is
+// returned; in lenient mode it is recorded as a warning and nil is returned.
+func (p *imageParser) problem(err error) error {
+	if !p.opts.Lenient {
+		return err
+	}
+
+	p.warnings = append(p.warnings, errors.WithArtifact(err, "image", ""))
+	return nil
+}
+
+// ParseImage parses a serialized Mynewt image.  Parse errors carry artifact
+// context (offset and TLV) retrievable with errors.GetContext.
 func ParseImage(imgData []byte) (Image, error) {
+	img, _, err := ParseImageOpts(imgData, ParseOpts{})
+	return img, err
+}
+
+// ParseImageOpts parses a serialized Mynewt image according to the given
+// options.  In lenient mode, the returned slice contains a warning for each
+// recoverable problem encountered; an error is only returned if nothing
+// useful could be parsed.
+func ParseImageOpts(imgData []byte, opts ParseOpts) (Image, []error, error) {
+	opts.Limits = opts.Limits.withDefaults()
+	p := imageParser{
+		opts: opts,
+	}
+
+	l := logOrDiscard(opts.Logger)
+
+	img, err := p.parse(imgData)
+	if err != nil {
+		l.Debug("image parse failed", "err", err)
+		return Image{}, p.warnings, errors.WithArtifact(err, "image", "")
+	}
+
+	l.Debug("parsed image",
+		"version", img.Header.Vers.String(),
+		"header_size", img.Header.HdrSz,
+		"body_size", len(img.Body),
+		"flags", img.Header.Flags)
+	img.logTlvs(l, "parsed tlv")
+	for _, w := range p.warnings {
+		l.Debug("image parse warning", "err", w)
+	}
+
+	return img, p.warnings, nil
+}
+
+func (p *imageParser) parse(imgData []byte) (Image, error) {
 	img := Image{}
 	offset := 0
 
-	hdr, size, err := parseRawHeader(imgData, offset)
+	// The magic indicates the byte order; if it is unrecognized, assume
+	// little-endian and let the header check report the problem.
+	img.Endianness, _ = DetectEndianness(imgData)
+	order := img.Endianness.ByteOrder()
+
+	hdr, size, err := parseRawHeader(imgData, offset, order)
 	if err != nil {
-		return img, err
+		// Only a magic mismatch is recoverable.
+		if hdr.Magic == IMAGE_MAGIC || len(imgData) < int(hdr.HdrSz) ||
+			int(hdr.HdrSz) < IMAGE_HEADER_SIZE {
+
+			return img, err
+		}
+		if err := p.problem(err); err != nil {
+			return img, err
+		}
+		size = int(hdr.HdrSz)
 	}
 	offset += size
 
+	limits := p.opts.Limits
+	if err := limits.checkHeader(hdr, 0); err != nil {
+		return img, err
+	}
+
+	img.Header = hdr
+	extra := int(hdr.HdrSz) - IMAGE_HEADER_SIZE
+	if extra > 0 {
+		img.Pad = append([]byte(nil),
+			imgData[IMAGE_HEADER_SIZE:IMAGE_HEADER_SIZE+extra]...)
+	}
+
 	body, size, err := parseRawBody(imgData, hdr, offset)
 	if err != nil {
-		return img, err
+		if err := p.problem(err); err != nil {
+			return img, err
+		}
+
+		// Salvage what there is of the body; nothing follows it.
+		img.Body = imgData[offset:]
+		return img, nil
 	}
+	img.Body = body
 	offset += size
 
 	var protTrailer *ImageTrailer
-	var protTlvs []ImageTlv
 	if hdr.ProtSz > 0 {
-		pt, size, err := parseRawTrailer(imgData, offset)
+		pt, size, err := parseRawTrailer(imgData, offset, order)
 		if err != nil {
-			return img, err
+			return img, p.problem(err)
 		}
 		protTrailer = &pt
 		offset += size
 
 		tlvsLen := int(hdr.ProtSz) - IMAGE_TRAILER_SIZE
 
-		pts, err := parseRawTlvs(imgData, offset, tlvsLen)
-		if err != nil {
+		if err := checkTlvLimits(imgData, offset, tlvsLen, order,
+			limits.MaxTlvLen, limits.MaxTlvs); err != nil {
+
 			return img, err
 		}
-		protTlvs = pts
+
+		pts, err := parseRawTlvs(imgData, offset, tlvsLen, order)
+		img.ProtTlvs = pts
+		if err != nil {
+			return img, p.problem(err)
+		}
 		offset += tlvsLen
 	}
 
-	trailer, size, err := parseRawTrailer(imgData, offset)
+	trailer, size, err := parseRawTrailer(imgData, offset, order)
 	if err != nil {
-		return img, err
+		return img, p.problem(err)
 	}
 	offset += size
 
+	if err := limits.checkHeader(hdr, int(trailer.TlvTotLen)); err != nil {
+		return img, err
+	}
+
 	totalLen := int(hdr.HdrSz) + len(body) + int(trailer.TlvTotLen)
 	if protTrailer != nil {
 		totalLen += int(protTrailer.TlvTotLen)
 	}
 	if len(imgData) < totalLen {
-		return img, errors.Errorf("image data truncated: have=%d want=%d",
+		err := errors.Errorf("image data truncated: have=%d want=%d",
 			len(imgData), totalLen)
+		if err := p.problem(err); err != nil {
+			return img, err
+		}
+	} else {
+		// Retain alignment padding following the image trailer so that the
+		// image is rewritten byte-for-byte; discard anything else.
+		img.TailPad = parseTailPad(imgData[totalLen:])
+		imgData = imgData[:totalLen]
 	}
 
-	// Trim excess data following image trailer.
-	imgData = imgData[:totalLen]
-
 	remLen := len(imgData) - offset
-	tlvs, err := parseRawTlvs(imgData, offset, remLen)
-	if err != nil {
+	if remLen < 0 {
+		remLen = 0
+	}
+	if err := checkTlvLimits(imgData, offset, remLen, order,
+		limits.MaxTlvLen, limits.MaxTlvs-len(img.ProtTlvs)); err != nil {
+
 		return img, err
 	}
 
+	tlvs, err := parseRawTlvs(imgData, offset, remLen, order)
+	img.Tlvs = tlvs
+	if err != nil {
+		return img, p.problem(err)
+	}
+
 	tlvLen := IMAGE_TRAILER_SIZE
 
 	if int(trailer.TlvTotLen) != IMAGE_TRAILER_SIZE+remLen {
-		return img, errors.Errorf(
+		err := errors.WithOffset(errors.Errorf(
 			"invalid image: trailer indicates TLV-length=%d; actual=%d",
-			trailer.TlvTotLen, tlvLen)
+			trailer.TlvTotLen, tlvLen), offset-IMAGE_TRAILER_SIZE)
+		if err := p.problem(err); err != nil {
+			return img, err
+		}
 	}
 
-	img.Header = hdr
-	img.Body = body
-	img.Tlvs = tlvs
-	img.ProtTlvs = protTlvs
-
-	extra := img.Header.HdrSz - IMAGE_HEADER_SIZE
-	if extra > 0 {
-		img.Pad = make([]byte, extra)
+	if err := p.applyDupPolicy(&img); err != nil {
+		return img, err
 	}
 
 	return img, nil
 }
 
+// parseTailPad returns the data following an image trailer if it looks like
+// the padding ImageCreator adds for write alignment: fewer than
+// IMAGE_MAX_ALIGN bytes, all of the same value.  Otherwise, the data is
+// unrelated to the image and nil is returned.
+func parseTailPad(data []byte) []byte {
+	if len(data) == 0 || len(data) >= IMAGE_MAX_ALIGN {
+		return nil
+	}
+
+	for _, b := range data {
+		if b != data[0] {
+			return nil
+		}
+	}
+
+	return append([]byte(nil), data...)
+}
+
+// readFull appends exactly n bytes from r to buf.
+func readFull(r io.Reader, buf []byte, n int, what string) ([]byte, error) {
+	chunk := make([]byte, n)
+	if _, err := io.ReadFull(r, chunk); err != nil {
+		return nil, errors.Wrapf(err, "failed to read image %s", what)
+	}
+
+	return append(buf, chunk...), nil
+}
+
+// ReadFrom reads a Mynewt image from a stream.  Only the bytes comprising the
+// image are consumed; any data following the image trailer is left unread.
+func ReadFrom(r io.Reader) (Image, error) {
+	buf, err := readFull(r, nil, IMAGE_HEADER_SIZE, "header")
+	if err != nil {
+		return Image{}, err
+	}
+
+	endianness, _ := DetectEndianness(buf)
+	order := endianness.ByteOrder()
+
+	var hdr ImageHdr
+	if err := binary.Read(bytes.NewReader(buf), order, &hdr); err != nil {
+
+		return Image{}, errors.Wrapf(err, "error reading image header")
+	}
+	if hdr.Magic != IMAGE_MAGIC {
+		return Image{}, errors.Errorf(
+			"image magic incorrect; expected 0x%08x, got 0x%08x",
+			uint32(IMAGE_MAGIC), hdr.Magic)
+	}
+	if int(hdr.HdrSz) < IMAGE_HEADER_SIZE {
+		return Image{}, errors.Errorf(
+			"invalid image header size: %d", hdr.HdrSz)
+	}
+
+	// Check the declared sizes before allocating anything.
+	limits := ParseLimits{}.withDefaults()
+	if err := limits.checkHeader(hdr, 0); err != nil {
+		return Image{}, err
+	}
+
+	// Header padding, body, protected TLVs, and the trailer header.
+	n := int(hdr.HdrSz) - IMAGE_HEADER_SIZE + int(hdr.ImgSz) +
+		int(hdr.ProtSz) + IMAGE_TRAILER_SIZE
+	buf, err = readFull(r, buf, n, "body")
+	if err != nil {
+		return Image{}, err
+	}
+
+	trailer, _, err := parseRawTrailer(buf, len(buf)-IMAGE_TRAILER_SIZE,
+		order)
+	if err != nil {
+		return Image{}, err
+	}
+	if int(trailer.TlvTotLen) < IMAGE_TRAILER_SIZE {
+		return Image{}, errors.Errorf(
+			"invalid image: trailer indicates TLV-length=%d",
+			trailer.TlvTotLen)
+	}
+	if err := limits.checkHeader(hdr, int(trailer.TlvTotLen)); err != nil {
+		return Image{}, err
+	}
+
+	buf, err = readFull(r, buf,
+		int(trailer.TlvTotLen)-IMAGE_TRAILER_SIZE, "TLVs")
+	if err != nil {
+		return Image{}, err
+	}
+
+	return ParseImage(buf)
+}
+
 func ReadImage(filename string) (Image, error) {
 	ri := Image{}
 
@@ -255,5 +585,10 @@ func ReadImage(filename string) (Image, error) {
 		return ri, errors.Wrapf(err, "failed to read image from file")
 	}
 
-	return ParseImage(imgData)
+	img, err := ParseImage(imgData)
+	if err != nil {
+		return img, errors.WithArtifact(err, "", filename)
+	}
+
+	return img, nil
 }
@@ -0,0 +1,499 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// VerifyOpts is a policy describing the conditions an image must satisfy to
+// be accepted.  Zero-valued fields impose no restriction.
+type VerifyOpts struct {
+	// Keys used to verify the image's signatures.
+	SigKeys []sec.PubSignKey
+
+	// Keys used to decrypt an encrypted image before its hash is checked.
+	// Not needed if the image's hash covers its ciphertext.
+	EncKeys []sec.PrivEncKey
+
+	// The hash convention an encrypted image must use; HASH_COVERAGE_AUTO
+	// accepts either.
+	HashCoverage HashCoverage
+
+	// The minimum number of signatures that must be verified by SigKeys.
+	MinSigs int
+
+	// If non-nil, signatures from SigKeys that this list revokes are not
+	// counted.  An image signed only by revoked keys is rejected.
+	Revocations *sec.RevocationList
+
+	// Hybrid (classical + post-quantum) signers.  If non-empty, at least
+	// one signer must satisfy HybridPolicy.
+	HybridKeys   []sec.HybridPubSignKey
+	HybridPolicy HybridPolicy
+
+	// If non-empty, every signature in the image must use one of these
+	// algorithms.
+	AllowedSigTypes []sec.SigType
+
+	// TLV types that must be present (in either TLV region), e.g.,
+	// IMAGE_TLV_BUILD_ID.  Types are matched by value alone, so the imgtool
+	// TLVs that share values with this package's legacy encryption TLVs
+	// (IMGTOOL_TLV_SEC_CNT and IMGTOOL_TLV_BOOT_RECORD) cannot be required
+	// reliably; use MinSecurityCounter instead.
+	RequiredTlvs []uint8
+
+	// TLV types that must not be present (in either TLV region).
+	ForbiddenTlvs []uint8
+
+	// The maximum serialized image size, in bytes.
+	MaxSize int
+
+	// The acceptable range of image versions (inclusive).
+	MinVersion *ImageVersion
+	MaxVersion *ImageVersion
+
+	// If non-empty, the image must specify one of these release channels.
+	Channels []string
+
+	// If non-nil, the image must be ROM-fixed at this flash address.
+	FixedAddr *uint32
+
+	// If non-nil, the image must carry an imgtool security counter of at
+	// least this value.
+	MinSecurityCounter *uint32
+
+	// If true, hash-only (unsigned) images are rejected.  Production
+	// verifiers should set this even when they do not hold the signing
+	// keys.
+	RejectHashOnly bool
+
+	// If non-nil, receives a debug-level event for each verification step.
+	Logger *slog.Logger
+}
+
+// VerifyRuleResult is the outcome of evaluating a single policy rule.
+type VerifyRuleResult struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// VerifyReport is the outcome of evaluating a policy against an image.
+type VerifyReport struct {
+	Rules []VerifyRuleResult
+
+	// Index of the encryption key that decrypted the image, or -1.
+	EncKeyIdx int
+
+	// Describes the nonce of an encrypted image.
+	Nonce NonceInfo
+
+	// Whether the image hash covers the plaintext or ciphertext body;
+	// HASH_COVERAGE_AUTO if the hash could not be verified.
+	HashCoverage HashCoverage
+
+	// Problems that do not cause a rule to fail.
+	Warnings []string
+
+	// Indicates that the image carries no signatures; i.e., it is a
+	// development image.
+	HashOnly bool
+
+	// Indicates that the report was served from a VerifyCache.
+	Cached bool
+}
+
+const (
+	VERIFY_RULE_STRUCTURE      = "structure"
+	VERIFY_RULE_HASH           = "hash"
+	VERIFY_RULE_SIGS           = "signatures"
+	VERIFY_RULE_HYBRID_SIGS    = "hybrid_signatures"
+	VERIFY_RULE_SIG_TYPES      = "signature_types"
+	VERIFY_RULE_REQUIRED_TLVS  = "required_tlvs"
+	VERIFY_RULE_FORBIDDEN_TLVS = "forbidden_tlvs"
+	VERIFY_RULE_MAX_SIZE       = "max_size"
+	VERIFY_RULE_VERSION        = "version"
+	VERIFY_RULE_SECTIONS       = "sections"
+	VERIFY_RULE_CHANNEL        = "channel"
+	VERIFY_RULE_HASH_TREE      = "hash_tree"
+	VERIFY_RULE_REVOCATION     = "revocation"
+	VERIFY_RULE_FIXED_ADDR     = "fixed_addr"
+	VERIFY_RULE_HASH_ONLY      = "hash_only"
+	VERIFY_RULE_SEC_CNT        = "security_counter"
+)
+
+// Passed indicates whether every evaluated rule passed.
+func (r *VerifyReport) Passed() bool {
+	for _, rule := range r.Rules {
+		if !rule.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Failures returns the results of all rules that did not pass.
+func (r *VerifyReport) Failures() []VerifyRuleResult {
+	var failures []VerifyRuleResult
+	for _, rule := range r.Rules {
+		if !rule.Passed {
+			failures = append(failures, rule)
+		}
+	}
+
+	return failures
+}
+
+// Err returns an error describing each failed rule, or nil if the image
+// satisfied the policy.
+func (r *VerifyReport) Err() error {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, f := range failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, f.Detail))
+	}
+
+	return errors.Errorf("image violates verification policy: %s",
+		strings.Join(msgs, "; "))
+}
+
+func (r *VerifyReport) add(name string, err error, detail string) {
+	res := VerifyRuleResult{
+		Name:   name,
+		Passed: err == nil,
+		Detail: detail,
+	}
+	if err != nil {
+		res.Detail = err.Error()
+	}
+
+	r.Rules = append(r.Rules, res)
+}
+
+func sigTypesString(types []sec.SigType) string {
+	var names []string
+	for _, t := range types {
+		names = append(names, sec.SigTypeString(t))
+	}
+
+	return strings.Join(names, ",")
+}
+
+// checkDupSigs returns an error if the same signature appears more than once.
+// Repeating a signature TLV must not let one key count twice toward MinSigs.
+func checkDupSigs(sigs []sec.Sig) error {
+	for i := 0; i < len(sigs); i++ {
+		for j := i + 1; j < len(sigs); j++ {
+			if sigs[i].Type == sigs[j].Type &&
+				bytes.Equal(sigs[i].Data, sigs[j].Data) {
+
+				return errors.Errorf(
+					"duplicate signature TLV (type=%s)",
+					sec.SigTypeString(sigs[i].Type))
+			}
+		}
+	}
+
+	return nil
+}
+
+// countValidSigs returns the number of distinct keys that produced at least
+// one valid signature.  Each key is counted at most once.
+func countValidSigs(sigs []sec.Sig, keys []sec.PubSignKey,
+	hash []byte) (int, error) {
+
+	used := make([]bool, len(keys))
+	count := 0
+	for _, sig := range sigs {
+		for i, key := range keys {
+			if used[i] {
+				continue
+			}
+			idx, err := sec.VerifySigs(key, []sec.Sig{sig}, hash)
+			if err != nil {
+				return 0, err
+			}
+			if idx != -1 {
+				used[i] = true
+				count++
+				break
+			}
+		}
+	}
+
+	return count, nil
+}
+
+func (img *Image) verifyPolicySigs(opts VerifyOpts, r *VerifyReport) {
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		r.add(VERIFY_RULE_SIGS, err, "")
+		return
+	}
+	if err := checkDupSigs(sigs); err != nil {
+		r.add(VERIFY_RULE_SIGS, err, "")
+		return
+	}
+
+	if len(opts.AllowedSigTypes) > 0 {
+		var typeErr error
+		for _, sig := range sigs {
+			allowed := false
+			for _, t := range opts.AllowedSigTypes {
+				if sig.Type == t {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				typeErr = errors.Errorf(
+					"signature type %s not allowed (allowed=%s)",
+					sec.SigTypeString(sig.Type),
+					sigTypesString(opts.AllowedSigTypes))
+				break
+			}
+		}
+		r.add(VERIFY_RULE_SIG_TYPES, typeErr, "all signature types allowed")
+	}
+
+	keys := opts.SigKeys
+	var revokedKeys []sec.PubSignKey
+	if opts.Revocations != nil {
+		keys, revokedKeys, err = opts.Revocations.Filter(opts.SigKeys)
+		if err != nil {
+			r.add(VERIFY_RULE_REVOCATION, err, "")
+			return
+		}
+	}
+
+	count := 0
+	revokedCount := 0
+	if len(sigs) > 0 {
+		hash, err := img.SigHash()
+		if err != nil {
+			r.add(VERIFY_RULE_SIGS, err, "")
+			return
+		}
+
+		count, err = countValidSigs(sigs, keys, hash)
+		if err != nil {
+			r.add(VERIFY_RULE_SIGS, err, "")
+			return
+		}
+
+		revokedCount, err = countValidSigs(sigs, revokedKeys, hash)
+		if err != nil {
+			r.add(VERIFY_RULE_REVOCATION, err, "")
+			return
+		}
+	}
+
+	if opts.Revocations != nil {
+		var revErr error
+		if count == 0 && revokedCount > 0 {
+			revErr = errors.Errorf("image signed only by revoked keys")
+		}
+		r.add(VERIFY_RULE_REVOCATION, revErr,
+			fmt.Sprintf("%d signatures from revoked keys ignored",
+				revokedCount))
+	}
+
+	var sigErr error
+	if count < opts.MinSigs {
+		sigErr = errors.Errorf(
+			"too few valid signatures: have=%d want>=%d", count, opts.MinSigs)
+	} else if len(sigs) > 0 && count == 0 {
+		sigErr = errors.Errorf("image signatures do not match provided keys")
+	}
+	r.add(VERIFY_RULE_SIGS, sigErr,
+		fmt.Sprintf("%d of %d signatures valid", count, len(sigs)))
+
+	if len(opts.HybridKeys) > 0 {
+		idx, err := img.VerifyHybridSigs(opts.HybridKeys, opts.HybridPolicy)
+		r.add(VERIFY_RULE_HYBRID_SIGS, err,
+			fmt.Sprintf("hybrid signer %d satisfies policy \"%s\"",
+				idx, HybridPolicyString(opts.HybridPolicy)))
+	}
+}
+
+func (img *Image) verifyPolicyHashOnly(opts VerifyOpts, r *VerifyReport) {
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		// Reported by the signature rule.
+		return
+	}
+	r.HashOnly = len(sigs) == 0
+
+	if opts.RejectHashOnly {
+		var err error
+		if r.HashOnly {
+			err = errors.Errorf("hash-only image rejected")
+		}
+		r.add(VERIFY_RULE_HASH_ONLY, err, "image is signed")
+	}
+}
+
+func (img *Image) verifyPolicyTlvs(opts VerifyOpts, r *VerifyReport) {
+	if len(opts.RequiredTlvs) > 0 {
+		var err error
+		for _, typ := range opts.RequiredTlvs {
+			if len(img.FindAllTlvs(typ)) == 0 {
+				err = errors.Errorf("missing required TLV: 0x%02x (%s)",
+					typ, ImageTlvTypeName(typ))
+				break
+			}
+		}
+		r.add(VERIFY_RULE_REQUIRED_TLVS, err, "all required TLVs present")
+	}
+
+	if len(opts.ForbiddenTlvs) > 0 {
+		var err error
+		for _, typ := range opts.ForbiddenTlvs {
+			if len(img.FindAllTlvs(typ)) != 0 {
+				err = errors.Errorf("contains forbidden TLV: 0x%02x (%s)",
+					typ, ImageTlvTypeName(typ))
+				break
+			}
+		}
+		r.add(VERIFY_RULE_FORBIDDEN_TLVS, err, "no forbidden TLVs present")
+	}
+}
+
+func (img *Image) verifyPolicyLimits(opts VerifyOpts, r *VerifyReport) {
+	if opts.MaxSize > 0 {
+		size, err := img.TotalSize()
+		if err == nil && size > opts.MaxSize {
+			err = errors.Errorf("image too large: have=%d want<=%d",
+				size, opts.MaxSize)
+		}
+		r.add(VERIFY_RULE_MAX_SIZE, err, fmt.Sprintf("size=%d", size))
+	}
+
+	if opts.MinVersion != nil || opts.MaxVersion != nil {
+		var err error
+		ver := img.Header.Vers
+		if opts.MinVersion != nil && CompareVersions(ver, *opts.MinVersion) < 0 {
+			err = errors.Errorf("version too old: have=%s want>=%s",
+				ver.String(), opts.MinVersion.String())
+		} else if opts.MaxVersion != nil &&
+			CompareVersions(ver, *opts.MaxVersion) > 0 {
+
+			err = errors.Errorf("version too new: have=%s want<=%s",
+				ver.String(), opts.MaxVersion.String())
+		}
+		r.add(VERIFY_RULE_VERSION, err, "version="+ver.String())
+	}
+}
+
+// VerifyImage evaluates an image against a verification policy.  Every rule
+// that applies is evaluated, even after a failure, so that the returned
+// report is complete.  Use VerifyReport.Err() to reduce the report to a
+// single pass / fail result.
+func VerifyImage(img Image, opts VerifyOpts) VerifyReport {
+	return verifyImage(img, opts, nil)
+}
+
+// VerifyImageWithStats evaluates a policy against an image and reports the
+// time spent in each stage of verification.
+func VerifyImageWithStats(img Image, opts VerifyOpts) (VerifyReport, Stats) {
+	var stats Stats
+	r := verifyImage(img, opts, &stats)
+	return r, stats
+}
+
+func verifyImage(img Image, opts VerifyOpts, stats *Stats) VerifyReport {
+	c := newStatsCollector(stats)
+	defer c.finish()
+
+	r := VerifyReport{
+		EncKeyIdx: -1,
+	}
+
+	// Logs the rules evaluated by each stage as it completes.
+	l := logOrDiscard(opts.Logger)
+	logged := 0
+	stage := func(name string) {
+		c.stage(name)
+		for _, rule := range r.Rules[logged:] {
+			l.Debug("verification step",
+				"stage", name,
+				"rule", rule.Name,
+				"passed", rule.Passed,
+				"detail", rule.Detail)
+		}
+		logged = len(r.Rules)
+	}
+
+	r.add(VERIFY_RULE_STRUCTURE, img.VerifyStructure(), "structure valid")
+	stage(STATS_STAGE_STRUCTURE)
+
+	hc, encKeyIdx, err := img.VerifyHashCoverage(opts.EncKeys,
+		opts.HashCoverage)
+	r.HashCoverage = hc
+	detail := HashCoverageString(hc)
+	if alg, _ := img.HashAlg(); alg != HASH_ALG_SHA256 {
+		detail += ", " + HashAlgString(alg)
+	}
+	r.add(VERIFY_RULE_HASH, err, fmt.Sprintf("hash valid (%s)", detail))
+	if err == nil && encKeyIdx >= 0 {
+		r.EncKeyIdx = encKeyIdx
+		if dec, err := Decrypt(img, opts.EncKeys[encKeyIdx]); err == nil {
+			r.Nonce, _ = img.InspectNonce(dec.Body)
+		}
+	}
+	c.hashed(img.hashedSize(nil))
+	stage(STATS_STAGE_HASH)
+
+	warnings, err := img.VerifySections()
+	r.add(VERIFY_RULE_SECTIONS, err, "sections valid")
+	r.Warnings = append(r.Warnings, warnings...)
+	stage(STATS_STAGE_SECTIONS)
+
+	if img.verifyPolicyHashTree(&r) {
+		c.hashed(len(img.Body))
+	}
+	stage(STATS_STAGE_HASH_TREE)
+
+	img.verifyPolicySigs(opts, &r)
+	img.verifyPolicyHashOnly(opts, &r)
+	img.logSigs(l, "image signature")
+	stage(STATS_STAGE_SIGS)
+
+	img.verifyPolicyTlvs(opts, &r)
+	img.verifyPolicyLimits(opts, &r)
+	img.verifyPolicyChannel(opts, &r)
+	img.verifyPolicyFixedAddr(opts, &r)
+	img.verifyPolicySecurityCounter(opts, &r)
+	stage(STATS_STAGE_POLICY)
+
+	return r
+}
@@ -0,0 +1,131 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// VerifyProfile describes the image format accepted by a particular
+// bootloader configuration.  Applying a profile to a set of verification
+// options restricts them to what that bootloader build can handle.
+type VerifyProfile struct {
+	Name string
+
+	// The signature algorithm the bootloader is built for.  The image must
+	// carry a signature of this type, and no other.
+	SigType sec.SigType
+
+	// The key-exchange TLV the bootloader can decrypt, or 0 if it is built
+	// without encryption support.
+	EncTlv uint8
+}
+
+var verifyProfiles = map[string]VerifyProfile{
+	"mcuboot-rsa2048": {
+		Name:    "mcuboot-rsa2048",
+		SigType: sec.SIG_TYPE_RSA2048,
+		EncTlv:  IMAGE_TLV_ENC_RSA,
+	},
+	"mcuboot-rsa3072": {
+		Name:    "mcuboot-rsa3072",
+		SigType: sec.SIG_TYPE_RSA3072,
+		EncTlv:  IMAGE_TLV_ENC_RSA,
+	},
+	"mcuboot-ec256-sha256": {
+		Name:    "mcuboot-ec256-sha256",
+		SigType: sec.SIG_TYPE_ECDSA256,
+		EncTlv:  IMAGE_TLV_ENC_EC256,
+	},
+	"mcuboot-ed25519-x25519": {
+		Name:    "mcuboot-ed25519-x25519",
+		SigType: sec.SIG_TYPE_ED25519,
+		EncTlv:  IMAGE_TLV_ENC_X25519,
+	},
+}
+
+// encTlvTypes lists every key-exchange TLV type.
+var encTlvTypes = []uint8{
+	IMAGE_TLV_ENC_RSA,
+	IMAGE_TLV_ENC_KEK,
+	IMAGE_TLV_ENC_EC256,
+	IMAGE_TLV_ENC_X25519,
+}
+
+// VerifyProfileNames returns the names of all predefined verification
+// profiles, sorted.
+func VerifyProfileNames() []string {
+	var names []string
+	for name := range verifyProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// FindVerifyProfile retrieves the predefined verification profile with the
+// specified name.
+func FindVerifyProfile(name string) (VerifyProfile, error) {
+	p, ok := verifyProfiles[name]
+	if !ok {
+		return VerifyProfile{}, errors.Errorf(
+			"unknown verification profile: \"%s\"", name)
+	}
+
+	return p, nil
+}
+
+// Apply returns a copy of the given verification options with the profile's
+// restrictions added.  Keys and other caller-specified settings are
+// preserved.
+func (p VerifyProfile) Apply(opts VerifyOpts) VerifyOpts {
+	alg, _ := sec.SigAlgForType(p.SigType)
+
+	opts.AllowedSigTypes = []sec.SigType{p.SigType}
+
+	opts.RequiredTlvs = append(append([]uint8(nil), opts.RequiredTlvs...),
+		IMAGE_TLV_SHA256, alg.TlvType)
+
+	opts.ForbiddenTlvs = append([]uint8(nil), opts.ForbiddenTlvs...)
+	for _, typ := range encTlvTypes {
+		if typ != p.EncTlv {
+			opts.ForbiddenTlvs = append(opts.ForbiddenTlvs, typ)
+		}
+	}
+
+	return opts
+}
+
+// VerifyImageProfile evaluates an image against a predefined verification
+// profile combined with the given options.
+func VerifyImageProfile(img Image, profileName string,
+	opts VerifyOpts) (VerifyReport, error) {
+
+	p, err := FindVerifyProfile(profileName)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	return VerifyImage(img, p.Apply(opts)), nil
+}
@@ -0,0 +1,224 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// By default, signatures and the KEYHASH or PUBKEY TLVs that identify them
+// are unprotected: each signature covers the image hash, and the image hash
+// covers the protected TLVs, so a signature cannot be among them.  Some
+// deployments nonetheless want signatures covered by the hash.  In that
+// layout, the signatures cover the "signed hash": the image hash calculated
+// as though the protected key and signature TLVs were absent.  These TLVs
+// form the end of the protected region, so the signed hash can always be
+// recalculated by removing them.  The SHA256 TLV remains unprotected and
+// covers everything, signatures included.
+//
+// Standard MCUboot does not support this layout; it requires a boot loader
+// that verifies signatures against the signed hash.
+
+func tlvTypeIsKeyOrSig(tlvType uint8) bool {
+	return tlvType == IMAGE_TLV_KEYHASH || tlvType == IMAGE_TLV_PUBKEY ||
+		ImageTlvTypeIsSig(tlvType)
+}
+
+// ProtectedSigTlvTypes returns the TLV types to list in
+// TlvLayout.Protected to place all key and signature TLVs in the protected
+// region.
+func ProtectedSigTlvTypes() []uint8 {
+	types := []uint8{IMAGE_TLV_KEYHASH, IMAGE_TLV_PUBKEY}
+	for _, alg := range sec.SigAlgs() {
+		types = append(types, alg.TlvType)
+	}
+
+	return types
+}
+
+// ValidateTlvLayout checks that a layout produces a verifiable image.  Only
+// key and signature TLVs may be moved to the protected region, and key TLVs
+// must be placed in the same region as the signatures they identify.  Each
+// type may be listed only once.
+func ValidateTlvLayout(layout TlvLayout) error {
+	var keyHash, pubKey, sigs bool
+
+	seen := map[uint8]struct{}{}
+	for _, t := range layout.Protected {
+		if _, ok := seen[t]; ok {
+			return errors.Errorf(
+				"%s TLV listed more than once", ImageTlvTypeName(t))
+		}
+		seen[t] = struct{}{}
+
+		switch {
+		case ImageTlvTypeIsHash(t):
+			return errors.Errorf(
+				"%s TLV cannot be protected; the image hash "+
+					"cannot cover itself", ImageTlvTypeName(t))
+
+		case t == IMAGE_TLV_KEYHASH:
+			keyHash = true
+
+		case t == IMAGE_TLV_PUBKEY:
+			pubKey = true
+
+		case ImageTlvTypeIsSig(t):
+			sigs = true
+
+		default:
+			return errors.Errorf(
+				"%s TLV cannot be moved to the protected region",
+				ImageTlvTypeName(t))
+		}
+	}
+
+	if sigs && (!keyHash || !pubKey) {
+		return errors.Errorf(
+			"protected signatures require protected KEYHASH and " +
+				"PUBKEY TLVs")
+	}
+	if (keyHash || pubKey) && !sigs {
+		return errors.Errorf(
+			"protected key TLVs require protected signatures")
+	}
+
+	return nil
+}
+
+// protSigStart returns the index of the first of the key and signature TLVs
+// that end the protected region.  It returns len(img.ProtTlvs) if the
+// protected region does not end with any.
+func (img *Image) protSigStart() int {
+	start := len(img.ProtTlvs)
+	for start > 0 && tlvTypeIsKeyOrSig(img.ProtTlvs[start-1].Header.Type) {
+		start--
+	}
+
+	return start
+}
+
+// HasProtectedSigs indicates whether an image's signatures are in its
+// protected region.
+func (img *Image) HasProtectedSigs() bool {
+	for _, tlv := range img.ProtTlvs {
+		if tlvTypeIsKeyOrSig(tlv.Header.Type) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidateTlvPlacement checks that an image's key and signature TLVs are
+// placed such that its signatures can be verified: all in the unprotected
+// region, or all at the end of the protected region of a plaintext,
+// bootable image.
+func (img *Image) ValidateTlvPlacement() error {
+	hashTlvs := img.FindProtTlvsIf(func(tlv ImageTlv) bool {
+		return ImageTlvTypeIsHash(tlv.Header.Type)
+	})
+	if len(hashTlvs) > 0 {
+		return errors.Errorf("protected region contains %s TLV",
+			ImageTlvTypeName(hashTlvs[0].Header.Type))
+	}
+
+	if !img.HasProtectedSigs() {
+		return nil
+	}
+
+	start := img.protSigStart()
+	for _, tlv := range img.ProtTlvs[:start] {
+		if tlvTypeIsKeyOrSig(tlv.Header.Type) {
+			return errors.Errorf(
+				"protected %s TLV is followed by other protected TLVs",
+				ImageTlvTypeName(tlv.Header.Type))
+		}
+	}
+
+	if tlvs := img.FindTlvsIf(func(tlv ImageTlv) bool {
+		return tlvTypeIsKeyOrSig(tlv.Header.Type)
+	}); len(tlvs) > 0 {
+		return errors.Errorf(
+			"image contains both protected and unprotected %s TLVs",
+			ImageTlvTypeName(tlvs[0].Header.Type))
+	}
+
+	if img.IsEncrypted() {
+		return errors.Errorf(
+			"protected signatures are not supported for encrypted images")
+	}
+	if img.Header.Flags&IMAGE_F_NON_BOOTABLE != 0 {
+		return errors.Errorf(
+			"protected signatures are not supported for non-bootable " +
+				"images")
+	}
+
+	if _, err := CollectTlvSigs(img.ProtTlvs[start:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SigHash returns the hash that an image's signatures cover.  This is the
+// image hash unless the signatures are protected, in which case it is the
+// signed hash described above.
+func (img *Image) SigHash() ([]byte, error) {
+	if !img.HasProtectedSigs() {
+		return img.Hash()
+	}
+
+	if err := img.ValidateTlvPlacement(); err != nil {
+		return nil, err
+	}
+
+	alg, err := img.HashAlg()
+	if err != nil {
+		return nil, err
+	}
+
+	protTlvs := img.ProtTlvs[:img.protSigStart()]
+	hdr := img.Header
+	hdr.ProtSz = calcProtSize(protTlvs)
+
+	return calcHash(alg, nil, img.Endianness.ByteOrder(), hdr, img.Pad,
+		img.Body, protTlvs)
+}
+
+// protectSigs moves the key and signature TLVs of the types in the given
+// list from the unprotected region to the end of the protected region.
+func (img *Image) protectSigs(types []uint8) {
+	protect := func(tlv ImageTlv) bool {
+		if !tlvTypeIsKeyOrSig(tlv.Header.Type) {
+			return false
+		}
+		for _, t := range types {
+			if tlv.Header.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	img.ProtTlvs = append(img.ProtTlvs, img.RemoveTlvsIf(protect)...)
+	img.Header.ProtSz = calcProtSize(img.ProtTlvs)
+}
@@ -0,0 +1,164 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"crypto/rand"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// Re-encryption personalizes one signed release for many devices.  The
+// image hash, and therefore every signature, covers the plaintext body and
+// the protected TLVs.  Only the body ciphertext and the unprotected "secret"
+// TLV change; the nonce is protected and is retained.  A fresh secret is
+// generated for each key-exchange re-encryption, so the nonce is never
+// reused with the same key.
+
+// checkReEncryptable ensures that re-encrypting an image will not invalidate
+// any of its protected TLVs.
+func (img *Image) checkReEncryptable() error {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_HASH_TREE)
+	if err != nil {
+		return err
+	}
+	if tlv != nil {
+		return errors.Errorf(
+			"cannot re-encrypt image: hash tree covers the ciphertext")
+	}
+
+	if img.verifyHashDecrypted() == nil {
+		return errors.Errorf(
+			"cannot re-encrypt image: image hash covers the ciphertext")
+	}
+
+	return nil
+}
+
+// reEncryptBody decrypts an image body with one secret, checks the result
+// against the image hash, and encrypts it with another secret.
+func reEncryptBody(img *Image, oldSecret []byte, newSecret []byte) error {
+	nonce, err := img.Nonce()
+	if err != nil {
+		return err
+	}
+
+	plain, err := sec.EncryptAES(img.Body, oldSecret, nonce)
+	if err != nil {
+		return err
+	}
+
+	dec := img.Clone()
+	dec.Body = plain
+	if err := dec.verifyHashDecrypted(); err != nil {
+		return errors.Wrapf(err, "failed to decrypt image with old key")
+	}
+
+	body, err := sec.EncryptAES(plain, newSecret, nonce)
+	if err != nil {
+		return err
+	}
+	img.Body = body
+
+	return nil
+}
+
+// ReEncrypt re-encrypts a key-exchange encrypted image for a different
+// recipient.  The body is decrypted using the secret that oldKey recovers
+// from the image's "secret" TLV, then encrypted with a new random secret
+// wrapped by newKey.  The image's signatures remain valid.
+func ReEncrypt(img Image, oldKey sec.PrivEncKey,
+	newKey sec.PubEncKey) (Image, error) {
+
+	dup := img.Clone()
+
+	if err := dup.checkReEncryptable(); err != nil {
+		return img, err
+	}
+
+	secretIdx := -1
+	for i, tlv := range dup.Tlvs {
+		if ImageTlvTypeIsSecret(tlv.Header.Type) {
+			if secretIdx != -1 {
+				return img, errors.Errorf(
+					"cannot re-encrypt image: multiple \"secret\" TLVs")
+			}
+			secretIdx = i
+		}
+	}
+	if secretIdx == -1 || dup.Header.Flags&IMAGE_F_ENCRYPTED == 0 {
+		return img, errors.Errorf(
+			"cannot re-encrypt image: image is not encrypted")
+	}
+
+	oldSecret, err := oldKey.Decrypt(dup.Tlvs[secretIdx].Data)
+	if err != nil {
+		return img, err
+	}
+
+	// Preserve the AES key size.
+	newSecret := make([]byte, len(oldSecret))
+	if _, err := rand.Read(newSecret); err != nil {
+		return img, errors.Wrapf(err, "random generation error")
+	}
+
+	cipherSecret, err := newKey.Encrypt(newSecret)
+	if err != nil {
+		return img, err
+	}
+	tlv, err := GenerateEncTlv(cipherSecret)
+	if err != nil {
+		return img, err
+	}
+
+	if err := reEncryptBody(&dup, oldSecret, newSecret); err != nil {
+		return img, err
+	}
+	dup.Tlvs[secretIdx] = tlv
+
+	return dup, nil
+}
+
+// ReEncryptHw re-encrypts a hardware-key encrypted image with a different
+// device secret (e.g., one produced by sec.DeriveDeviceKey).  The secret ID
+// and nonce TLVs are unchanged, so the image's signatures remain valid.
+func ReEncryptHw(img Image, oldSecret []byte, newSecret []byte) (Image, error) {
+	dup := img.Clone()
+
+	if err := dup.checkReEncryptable(); err != nil {
+		return img, err
+	}
+
+	nonce, err := dup.Nonce()
+	if err != nil {
+		return img, err
+	}
+	if nonce == nil {
+		return img, errors.Errorf(
+			"cannot re-encrypt hw-encrypted image: no AES nonce TLV")
+	}
+
+	if err := reEncryptBody(&dup, oldSecret, newSecret); err != nil {
+		return img, err
+	}
+
+	return dup, nil
+}
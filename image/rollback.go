@@ -0,0 +1,289 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Rollback hazards.  Each indicates a set of images that cannot safely be
+// rolled out to the same fleet in version order.
+const (
+	ROLLBACK_HAZARD_DUP_VERSION = "duplicate_version"
+	ROLLBACK_HAZARD_NO_COUNTER  = "missing_security_counter"
+	ROLLBACK_HAZARD_COUNTER     = "security_counter_regression"
+	ROLLBACK_HAZARD_KEY         = "key_rotation"
+	ROLLBACK_HAZARD_STRANDED    = "stranded"
+)
+
+// RollbackInfo is the anti-rollback metadata of a single image.
+type RollbackInfo struct {
+	// Caller-supplied label (e.g., a file name) used in hazard details.
+	Name string
+
+	Version ImageVersion
+
+	// The imgtool security counter, or nil if the image has none.
+	SecurityCounter *uint32
+
+	// Hex-encoded key hashes of the keys that signed the image.
+	KeyIds []string
+}
+
+// RollbackHazard describes a problem with a fleet update plan.
+type RollbackHazard struct {
+	Code string
+
+	// Indices (into RollbackPlan.Images) of the images involved.
+	Images []int
+
+	Detail string
+}
+
+// RollbackPlan is an update-ordering plan for a set of images.
+type RollbackPlan struct {
+	Images []RollbackInfo
+
+	// Indices of the images in the order they should be rolled out.
+	Order []int
+
+	// Upgrades[i] lists the images that a device running image i can
+	// upgrade to.
+	Upgrades [][]int
+
+	Hazards []RollbackHazard
+}
+
+// ExtractRollbackInfo reads an image's version, security counter, and key
+// IDs.
+func ExtractRollbackInfo(img Image) (RollbackInfo, error) {
+	info := RollbackInfo{
+		Version: img.Header.Vers,
+	}
+
+	cnt, err := img.SecurityCounter()
+	if err != nil {
+		return info, err
+	}
+	info.SecurityCounter = cnt
+
+	for _, tlv := range img.FindAllTlvs(IMAGE_TLV_KEYHASH) {
+		info.KeyIds = append(info.KeyIds, hex.EncodeToString(tlv.Data))
+	}
+
+	return info, nil
+}
+
+// ExtractRollbackInfos reads the anti-rollback metadata of a batch of
+// images.
+func ExtractRollbackInfos(imgs []Image) ([]RollbackInfo, error) {
+	infos := make([]RollbackInfo, len(imgs))
+	for i, img := range imgs {
+		info, err := ExtractRollbackInfo(img)
+		if err != nil {
+			return nil, errors.Wrapf(err, "image %d", i)
+		}
+		infos[i] = info
+	}
+
+	return infos, nil
+}
+
+func (info *RollbackInfo) label(idx int) string {
+	if info.Name != "" {
+		return info.Name
+	}
+	return fmt.Sprintf("image %d", idx)
+}
+
+func (info *RollbackInfo) counter() uint32 {
+	if info.SecurityCounter == nil {
+		return 0
+	}
+	return *info.SecurityCounter
+}
+
+func keyIdsOverlap(a []string, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		// Unsigned images place no constraint on the bootloader's keys.
+		return true
+	}
+
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CanUpgrade indicates whether a device running image "from" would accept
+// image "to": the version must increase, the security counter must not
+// decrease, and at least one signing key must be shared.
+func CanUpgrade(from RollbackInfo, to RollbackInfo) bool {
+	return CompareVersions(to.Version, from.Version) > 0 &&
+		to.counter() >= from.counter() &&
+		keyIdsOverlap(from.KeyIds, to.KeyIds)
+}
+
+func (p *RollbackPlan) add(code string, images []int, format string,
+	args ...interface{}) {
+
+	p.Hazards = append(p.Hazards, RollbackHazard{
+		Code:   code,
+		Images: images,
+		Detail: fmt.Sprintf(format, args...),
+	})
+}
+
+// PlanRollback determines which of a set of images can upgrade to which,
+// the order in which to roll them out, and any anti-rollback hazards.
+func PlanRollback(infos []RollbackInfo) RollbackPlan {
+	p := RollbackPlan{
+		Images:   infos,
+		Order:    make([]int, len(infos)),
+		Upgrades: make([][]int, len(infos)),
+	}
+
+	for i, _ := range infos {
+		p.Order[i] = i
+	}
+	sort.SliceStable(p.Order, func(a int, b int) bool {
+		x := &infos[p.Order[a]]
+		y := &infos[p.Order[b]]
+		if c := CompareVersions(x.Version, y.Version); c != 0 {
+			return c < 0
+		}
+		return x.counter() < y.counter()
+	})
+
+	haveCnt := 0
+	for _, info := range infos {
+		if info.SecurityCounter != nil {
+			haveCnt++
+		}
+	}
+
+	for i, _ := range infos {
+		a := &infos[i]
+		if haveCnt > 0 && a.SecurityCounter == nil {
+			p.add(ROLLBACK_HAZARD_NO_COUNTER, []int{i},
+				"%s has no security counter; other images do",
+				a.label(i))
+		}
+
+		for j, _ := range infos {
+			b := &infos[j]
+			if CanUpgrade(*a, *b) {
+				p.Upgrades[i] = append(p.Upgrades[i], j)
+			}
+
+			if j <= i {
+				continue
+			}
+
+			cmp := CompareVersions(a.Version, b.Version)
+			if cmp == 0 {
+				p.add(ROLLBACK_HAZARD_DUP_VERSION, []int{i, j},
+					"%s and %s both have version %s",
+					a.label(i), b.label(j), a.Version.String())
+				continue
+			}
+
+			lo, hi := i, j
+			if cmp > 0 {
+				lo, hi = j, i
+			}
+			older := &infos[lo]
+			newer := &infos[hi]
+			if newer.counter() < older.counter() {
+				p.add(ROLLBACK_HAZARD_COUNTER, []int{lo, hi},
+					"%s (%s) has security counter %d; older %s (%s) "+
+						"has %d", newer.label(hi), newer.Version.String(),
+					newer.counter(), older.label(lo),
+					older.Version.String(), older.counter())
+			}
+			if !keyIdsOverlap(older.KeyIds, newer.KeyIds) {
+				p.add(ROLLBACK_HAZARD_KEY, []int{lo, hi},
+					"%s and %s share no signing key",
+					older.label(lo), newer.label(hi))
+			}
+		}
+	}
+
+	// Every image must have an upgrade path to the final image.
+	if len(p.Order) > 0 {
+		last := p.Order[len(p.Order)-1]
+		reach := make([]bool, len(infos))
+		reach[last] = true
+		for changed := true; changed; {
+			changed = false
+			for i, _ := range infos {
+				if reach[i] {
+					continue
+				}
+				for _, j := range p.Upgrades[i] {
+					if reach[j] {
+						reach[i] = true
+						changed = true
+						break
+					}
+				}
+			}
+		}
+
+		for _, i := range p.Order {
+			if !reach[i] {
+				p.add(ROLLBACK_HAZARD_STRANDED, []int{i, last},
+					"devices running %s cannot reach %s",
+					infos[i].label(i), infos[last].label(last))
+			}
+		}
+	}
+
+	return p
+}
+
+// Safe indicates whether the plan has no hazards.
+func (p *RollbackPlan) Safe() bool {
+	return len(p.Hazards) == 0
+}
+
+// Err returns an error describing each hazard, or nil if the plan is safe.
+func (p *RollbackPlan) Err() error {
+	if len(p.Hazards) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, h := range p.Hazards {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", h.Code, h.Detail))
+	}
+
+	return errors.Errorf("unsafe rollout plan: %s", strings.Join(msgs, "; "))
+}
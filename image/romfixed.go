@@ -0,0 +1,145 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+)
+
+// A ROM-fixed image executes in place (direct-XIP) and therefore only works
+// at the flash address it was linked for.  The IMAGE_F_ROM_FIXED header flag
+// marks such an image, and the header's load address field (Pad1) holds the
+// address, as in MCUboot.  The address is repeated in a protected FIXED_ADDR
+// TLV for boot loaders and tools that do not interpret the header field.
+
+const IMAGE_FIXED_ADDR_SIZE = 4
+
+// GenerateFixedAddrTlv creates a FIXED_ADDR TLV holding the given flash
+// address, little-endian.
+func GenerateFixedAddrTlv(addr uint32) ImageTlv {
+	data := make([]byte, IMAGE_FIXED_ADDR_SIZE)
+	binary.LittleEndian.PutUint32(data, addr)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_FIXED_ADDR,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
+func parseFixedAddrTlv(data []byte) (uint32, error) {
+	if len(data) != IMAGE_FIXED_ADDR_SIZE {
+		return 0, errors.Errorf(
+			"invalid FIXED_ADDR TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_FIXED_ADDR_SIZE)
+	}
+
+	return binary.LittleEndian.Uint32(data), nil
+}
+
+func decodeFixedAddrTlv(data []byte) (string, error) {
+	addr, err := parseFixedAddrTlv(data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("0x%08x", addr), nil
+}
+
+// RomFixedAddr returns the flash address a ROM-fixed image must be
+// programmed at.  The bool is false if the image is not ROM-fixed.  It is an
+// error for the FIXED_ADDR TLV to disagree with the header.
+func (img *Image) RomFixedAddr() (uint32, bool, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_FIXED_ADDR)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if img.Header.Flags&IMAGE_F_ROM_FIXED == 0 {
+		if tlv != nil {
+			return 0, false, errors.Errorf(
+				"image contains FIXED_ADDR TLV but is not ROM-fixed")
+		}
+		return 0, false, nil
+	}
+
+	addr := img.Header.Pad1
+	if tlv != nil {
+		tlvAddr, err := parseFixedAddrTlv(tlv.Data)
+		if err != nil {
+			return 0, false, err
+		}
+		if tlvAddr != addr {
+			return 0, false, errors.Errorf(
+				"FIXED_ADDR TLV does not match header: "+
+					"tlv=0x%08x header=0x%08x", tlvAddr, addr)
+		}
+	}
+
+	return addr, true, nil
+}
+
+// VerifyRomFixed checks that the image can run from the given flash area.
+// flashBase is the address at which the area's flash device is mapped.  An
+// image that is not ROM-fixed can run from any area.
+func (img *Image) VerifyRomFixed(area flash.FlashArea, flashBase uint32) error {
+	addr, fixed, err := img.RomFixedAddr()
+	if err != nil {
+		return err
+	}
+	if !fixed {
+		return nil
+	}
+
+	want := uint64(flashBase) + uint64(area.Offset)
+	if uint64(addr) != want {
+		return errors.Errorf(
+			"ROM-fixed image linked for 0x%08x; flash area \"%s\" is at "+
+				"0x%08x", addr, area.Name, want)
+	}
+
+	return nil
+}
+
+func (img *Image) verifyPolicyFixedAddr(opts VerifyOpts, r *VerifyReport) {
+	if opts.FixedAddr == nil {
+		return
+	}
+
+	addr, fixed, err := img.RomFixedAddr()
+	if err == nil {
+		if !fixed {
+			err = errors.Errorf("image is not ROM-fixed")
+		} else if addr != *opts.FixedAddr {
+			err = errors.Errorf(
+				"ROM-fixed address mismatch: have=0x%08x want=0x%08x",
+				addr, *opts.FixedAddr)
+		}
+	}
+	r.add(VERIFY_RULE_FIXED_ADDR, err,
+		fmt.Sprintf("image runs at 0x%08x", addr))
+}
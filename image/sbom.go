@@ -0,0 +1,242 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// SbomFormat identifies the format of a software bill of materials.
+type SbomFormat uint8
+
+const (
+	SBOM_FORMAT_SPDX      SbomFormat = 1
+	SBOM_FORMAT_CYCLONEDX SbomFormat = 2
+)
+
+var sbomFormatNameMap = map[SbomFormat]string{
+	SBOM_FORMAT_SPDX:      "spdx",
+	SBOM_FORMAT_CYCLONEDX: "cyclonedx",
+}
+
+func SbomFormatString(format SbomFormat) string {
+	s := sbomFormatNameMap[format]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func SbomStringFormat(s string) (SbomFormat, error) {
+	for format, name := range sbomFormatNameMap {
+		if s == name {
+			return format, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown SBOM format: \"%s\"", s)
+}
+
+// Sbom is a software bill of materials document.
+type Sbom struct {
+	Format SbomFormat
+	Doc    []byte
+}
+
+// ImageSbom is the body of an SBOM TLV.  It binds an SBOM document to the
+// image by recording the document's SHA256.
+type ImageSbom struct {
+	Format SbomFormat
+	Pad    [3]uint8
+	Hash   [sha256.Size]byte
+}
+
+const IMAGE_SBOM_SIZE = 36
+
+// DetectSbomFormat determines the format of an SBOM document.  SPDX (JSON or
+// tag-value) and CycloneDX (JSON) documents are recognized.
+func DetectSbomFormat(doc []byte) (SbomFormat, error) {
+	trimmed := bytes.TrimSpace(doc)
+
+	if bytes.HasPrefix(trimmed, []byte("SPDXVersion:")) {
+		return SBOM_FORMAT_SPDX, nil
+	}
+
+	var fields struct {
+		SpdxVersion string `json:"spdxVersion"`
+		BomFormat   string `json:"bomFormat"`
+	}
+	if err := json.Unmarshal(trimmed, &fields); err == nil {
+		if fields.SpdxVersion != "" {
+			return SBOM_FORMAT_SPDX, nil
+		}
+		if fields.BomFormat == "CycloneDX" {
+			return SBOM_FORMAT_CYCLONEDX, nil
+		}
+	}
+
+	return 0, errors.Errorf("unrecognized SBOM document format")
+}
+
+// NewSbom constructs an SBOM from a document, detecting its format.
+func NewSbom(doc []byte) (Sbom, error) {
+	format, err := DetectSbomFormat(doc)
+	if err != nil {
+		return Sbom{}, err
+	}
+
+	return Sbom{
+		Format: format,
+		Doc:    doc,
+	}, nil
+}
+
+// Hash calculates the SHA256 of the SBOM document.
+func (s *Sbom) Hash() []byte {
+	sum := sha256.Sum256(s.Doc)
+	return sum[:]
+}
+
+// GenerateSbomTlv creates a protected SBOM TLV binding the given document to
+// an image.
+func GenerateSbomTlv(sbom Sbom) (ImageTlv, error) {
+	if _, ok := sbomFormatNameMap[sbom.Format]; !ok {
+		return ImageTlv{}, errors.Errorf(
+			"unknown SBOM format: %d", int(sbom.Format))
+	}
+
+	body := ImageSbom{
+		Format: sbom.Format,
+	}
+	copy(body.Hash[:], sbom.Hash())
+
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, &body)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_SBOM,
+			Pad:  0,
+			Len:  uint16(b.Len()),
+		},
+		Data: b.Bytes(),
+	}, nil
+}
+
+// SbomBinding returns the contents of the image's SBOM TLV, or nil if the
+// image has none.
+func (img *Image) SbomBinding() (*ImageSbom, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_SBOM)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	var body ImageSbom
+	r := bytes.NewReader(tlv.Data)
+	if len(tlv.Data) != IMAGE_SBOM_SIZE ||
+		binary.Read(r, binary.LittleEndian, &body) != nil {
+
+		return nil, errors.Errorf(
+			"invalid SBOM TLV: have-len=%d want-len=%d",
+			len(tlv.Data), IMAGE_SBOM_SIZE)
+	}
+
+	return &body, nil
+}
+
+// VerifySbom checks that the given SBOM document is the one bound to the
+// image.  Because the SBOM TLV is protected, a valid image signature also
+// vouches for the document.
+func (img *Image) VerifySbom(sbom Sbom) error {
+	body, err := img.SbomBinding()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return errors.Errorf("image does not contain an SBOM TLV")
+	}
+
+	if body.Format != sbom.Format {
+		return errors.Errorf("SBOM format mismatch: image=%s document=%s",
+			SbomFormatString(body.Format), SbomFormatString(sbom.Format))
+	}
+
+	if !bytes.Equal(body.Hash[:], sbom.Hash()) {
+		return errors.Errorf("SBOM hash mismatch: image=%x document=%x",
+			body.Hash[:], sbom.Hash())
+	}
+
+	return nil
+}
+
+// ManifestSbom produces the manifest description of an SBOM.  If embed is
+// true, the document itself is included.
+func (s *Sbom) ManifestSbom(embed bool) manifest.ManifestSbom {
+	ms := manifest.ManifestSbom{
+		Format: SbomFormatString(s.Format),
+		Sha256: hex.EncodeToString(s.Hash()),
+	}
+	if embed {
+		ms.Document = string(s.Doc)
+	}
+
+	return ms
+}
+
+// verifyManifestSbom checks that a manifest's SBOM description (and
+// document, if embedded) matches the image's SBOM TLV.
+func (img *Image) verifyManifestSbom(ms manifest.ManifestSbom) error {
+	body, err := img.SbomBinding()
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		return errors.Errorf(
+			"manifest describes an SBOM; image lacks an SBOM TLV")
+	}
+
+	format, err := SbomStringFormat(ms.Format)
+	if err != nil {
+		return err
+	}
+
+	if format != body.Format || ms.Sha256 != hex.EncodeToString(body.Hash[:]) {
+		return errors.Errorf(
+			"manifest SBOM different from image TLV: man=%s:%s img=%s:%x",
+			ms.Format, ms.Sha256, SbomFormatString(body.Format), body.Hash[:])
+	}
+
+	if ms.Document != "" {
+		return img.VerifySbom(Sbom{Format: format, Doc: []byte(ms.Document)})
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// MCUboot's serial recovery (and mcumgr image upload in general) transfers
+// an image in chunks, and the first chunk announces the total length and
+// hash of the image.  An unprotected SERIAL_INFO TLV records these values
+// in the image itself so that an upload tool can prepare its first request
+// without parsing the image or post-processing the artifact.  Because the
+// TLV is not protected, existing signatures remain valid.
+
+const (
+	IMAGE_SERIAL_HASH_SIZE = 32
+	IMAGE_SERIAL_INFO_SIZE = 12 + IMAGE_SERIAL_HASH_SIZE
+)
+
+// SerialInfo is the body of a SERIAL_INFO TLV.
+type SerialInfo struct {
+	// The image number (slot pair) the image is to be uploaded to.
+	ImageNum uint8
+
+	// Total size of the image, including the SERIAL_INFO TLV itself.
+	ImageSize uint32
+
+	// Size of each upload chunk the image was prepared for; 0 if
+	// unspecified.
+	ChunkSize uint32
+
+	// Duplicate of the image hash (the SHA256 TLV), as reported by
+	// mcumgr's image list.
+	ImageHash []byte
+}
+
+// GenerateSerialInfoTlv creates a SERIAL_INFO TLV.
+func GenerateSerialInfoTlv(info SerialInfo) (ImageTlv, error) {
+	if len(info.ImageHash) != IMAGE_SERIAL_HASH_SIZE {
+		return ImageTlv{}, errors.Errorf(
+			"invalid serial info image hash: have-len=%d want-len=%d",
+			len(info.ImageHash), IMAGE_SERIAL_HASH_SIZE)
+	}
+
+	data := make([]byte, IMAGE_SERIAL_INFO_SIZE)
+	data[0] = info.ImageNum
+	binary.LittleEndian.PutUint32(data[4:], info.ImageSize)
+	binary.LittleEndian.PutUint32(data[8:], info.ChunkSize)
+	copy(data[12:], info.ImageHash)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_SERIAL_INFO,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}, nil
+}
+
+func parseSerialInfoTlv(data []byte) (SerialInfo, error) {
+	var info SerialInfo
+
+	if len(data) != IMAGE_SERIAL_INFO_SIZE {
+		return info, errors.Errorf(
+			"invalid SERIAL_INFO TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_SERIAL_INFO_SIZE)
+	}
+
+	info.ImageNum = data[0]
+	info.ImageSize = binary.LittleEndian.Uint32(data[4:])
+	info.ChunkSize = binary.LittleEndian.Uint32(data[8:])
+	info.ImageHash = append([]byte(nil), data[12:]...)
+
+	return info, nil
+}
+
+func decodeSerialInfoTlv(data []byte) (string, error) {
+	info, err := parseSerialInfoTlv(data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("image=%d size=%d chunk=%d hash=%x",
+		info.ImageNum, info.ImageSize, info.ChunkSize, info.ImageHash), nil
+}
+
+// AddSerialInfo adds a SERIAL_INFO TLV to the end of the image's
+// unprotected TLVs, replacing any existing one.  It must be the last change
+// made to the image: adding TLVs afterwards (e.g., signatures) invalidates
+// the recorded size.
+func (img *Image) AddSerialInfo(imageNum uint8, chunkSize uint32) error {
+	img.RemoveTlvsWithType(IMAGE_TLV_SERIAL_INFO)
+
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+
+	size, err := img.TotalSize()
+	if err != nil {
+		return err
+	}
+
+	tlv, err := GenerateSerialInfoTlv(SerialInfo{
+		ImageNum:  imageNum,
+		ImageSize: uint32(size + IMAGE_TLV_SIZE + IMAGE_SERIAL_INFO_SIZE),
+		ChunkSize: chunkSize,
+		ImageHash: hash,
+	})
+	if err != nil {
+		return err
+	}
+
+	img.Tlvs = append(img.Tlvs, tlv)
+	return nil
+}
+
+// SerialInfo returns the contents of the image's SERIAL_INFO TLV, or nil if
+// it has none.
+func (img *Image) SerialInfo() (*SerialInfo, error) {
+	tlv, err := img.FindUniqueTlv(IMAGE_TLV_SERIAL_INFO)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	info, err := parseSerialInfoTlv(tlv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// VerifySerialInfo checks that the image's SERIAL_INFO TLV matches the
+// image's actual size and hash.
+func (img *Image) VerifySerialInfo() error {
+	info, err := img.SerialInfo()
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return errors.Errorf("image does not contain a SERIAL_INFO TLV")
+	}
+
+	size, err := img.TotalSize()
+	if err != nil {
+		return err
+	}
+	if int(info.ImageSize) != size {
+		return errors.Errorf(
+			"serial info size mismatch: have=%d want=%d",
+			info.ImageSize, size)
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(info.ImageHash, hash) {
+		return errors.Errorf(
+			"serial info hash mismatch: have=%x want=%x",
+			info.ImageHash, hash)
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const (
+	VERIFY_RULE_DEPENDENCIES = "dependencies"
+	VERIFY_RULE_DEP_CYCLE    = "dependency_cycle"
+)
+
+// SetNode is the verification result for a single image in a multi-image
+// set.
+type SetNode struct {
+	// The image's ID (its index in the set).
+	ImageId uint8
+
+	Version ImageVersion
+	Deps    []ImageDependency
+
+	Report VerifyReport
+}
+
+// SetReport is the outcome of verifying a multi-image set.
+type SetReport struct {
+	Nodes []SetNode
+
+	// Each entry lists the IDs of the images forming a dependency cycle.
+	Cycles [][]uint8
+}
+
+// Passed indicates whether every image in the set passed verification.
+func (r *SetReport) Passed() bool {
+	for i, _ := range r.Nodes {
+		if !r.Nodes[i].Report.Passed() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Err returns an error describing each failed rule of each image, or nil if
+// the whole set is valid.
+func (r *SetReport) Err() error {
+	var msgs []string
+	for _, node := range r.Nodes {
+		for _, f := range node.Report.Failures() {
+			msgs = append(msgs, fmt.Sprintf("image %d: %s: %s",
+				node.ImageId, f.Name, f.Detail))
+		}
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("image set failed verification: %s",
+		strings.Join(msgs, "; "))
+}
+
+// findDepCycles returns every elementary cycle reachable by a depth-first
+// traversal of the dependency graph.  edges[i] lists the images that image i
+// depends on.
+func findDepCycles(edges [][]int) [][]uint8 {
+	const (
+		white = iota
+		grey
+		black
+	)
+
+	var cycles [][]uint8
+	colors := make([]int, len(edges))
+	var stack []int
+
+	var visit func(n int)
+	visit = func(n int) {
+		colors[n] = grey
+		stack = append(stack, n)
+
+		for _, m := range edges[n] {
+			switch colors[m] {
+			case white:
+				visit(m)
+
+			case grey:
+				var cycle []uint8
+				for i := len(stack) - 1; i >= 0; i-- {
+					cycle = append([]uint8{uint8(stack[i])}, cycle...)
+					if stack[i] == m {
+						break
+					}
+				}
+				cycles = append(cycles, cycle)
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		colors[n] = black
+	}
+
+	for n, _ := range edges {
+		if colors[n] == white {
+			visit(n)
+		}
+	}
+
+	return cycles
+}
+
+// VerifySet verifies a set of images that are deployed together, as in a
+// multi-core product.  Each image's ID is its index in the slice, matching
+// MCUboot's image numbering.  Every image is verified individually (hash,
+// structure, and, if keys are provided, at least one valid signature).  In
+// addition, the dependency graph formed by the images' DEPENDENCY TLVs is
+// checked: each dependency must refer to an image in the set whose version
+// satisfies the constraint, and the graph must be acyclic.
+func VerifySet(images []Image, keys []sec.PubSignKey) SetReport {
+	r := SetReport{}
+
+	if len(images) > 256 {
+		r.Nodes = []SetNode{{}}
+		r.Nodes[0].Report.add(VERIFY_RULE_STRUCTURE, errors.Errorf(
+			"too many images in set: have=%d max=256", len(images)), "")
+		return r
+	}
+
+	opts := VerifyOpts{
+		SigKeys: keys,
+	}
+	if len(keys) > 0 {
+		opts.MinSigs = 1
+	}
+
+	edges := make([][]int, len(images))
+
+	for i, img := range images {
+		node := SetNode{
+			ImageId: uint8(i),
+			Version: img.Header.Vers,
+			Report:  VerifyImage(img, opts),
+		}
+
+		deps, err := img.Dependencies()
+		if err != nil {
+			node.Report.add(VERIFY_RULE_DEPENDENCIES, err, "")
+			r.Nodes = append(r.Nodes, node)
+			continue
+		}
+		node.Deps = deps
+
+		var problems []string
+		for _, dep := range deps {
+			id := int(dep.ImageId)
+			if id >= len(images) {
+				problems = append(problems, fmt.Sprintf(
+					"requires image %d >= %s; image not in set",
+					dep.ImageId, dep.MinVersion.String()))
+				continue
+			}
+
+			edges[i] = append(edges[i], id)
+
+			have := images[id].Header.Vers
+			if CompareVersions(have, dep.MinVersion) < 0 {
+				problems = append(problems, fmt.Sprintf(
+					"requires image %d >= %s; set has %s",
+					dep.ImageId, dep.MinVersion.String(), have.String()))
+			}
+		}
+
+		if len(problems) > 0 {
+			err = errors.Errorf("%s", strings.Join(problems, "; "))
+		}
+		node.Report.add(VERIFY_RULE_DEPENDENCIES, err,
+			"dependencies satisfied")
+
+		r.Nodes = append(r.Nodes, node)
+	}
+
+	r.Cycles = findDepCycles(edges)
+
+	inCycle := make([][]uint8, len(images))
+	for _, cycle := range r.Cycles {
+		for _, id := range cycle {
+			inCycle[id] = cycle
+		}
+	}
+
+	for i, _ := range r.Nodes {
+		var err error
+		if cycle := inCycle[i]; cycle != nil {
+			var ids []string
+			for _, id := range cycle {
+				ids = append(ids, fmt.Sprintf("%d", id))
+			}
+			err = errors.Errorf("image is part of dependency cycle: %s",
+				strings.Join(ids, " -> "))
+		}
+		r.Nodes[i].Report.add(VERIFY_RULE_DEP_CYCLE, err, "no cycles")
+	}
+
+	return r
+}
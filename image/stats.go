@@ -0,0 +1,165 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Stage names reported in Stats.
+const (
+	STATS_STAGE_PREPARE   = "prepare"
+	STATS_STAGE_HASH      = "hash"
+	STATS_STAGE_SIGN      = "sign"
+	STATS_STAGE_FINISH    = "finish"
+	STATS_STAGE_STRUCTURE = "structure"
+	STATS_STAGE_SECTIONS  = "sections"
+	STATS_STAGE_HASH_TREE = "hash_tree"
+	STATS_STAGE_SIGS      = "signatures"
+	STATS_STAGE_POLICY    = "policy"
+)
+
+type StageStats struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Stats describes the work done to create or verify an image.  It is
+// intended for tuning and tracking the throughput of build and release
+// pipelines.
+type Stats struct {
+	// The number of image bytes covered by the image hash and, if present,
+	// the hash tree.  Verification counts each pass over the image once.
+	BytesHashed uint64
+
+	// Time spent in each stage, in the order the stages ran.
+	Stages []StageStats
+
+	// Heap allocations made while the operation ran.  These are read from
+	// the runtime and include allocations by other goroutines.
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// Total returns the time spent in all stages.
+func (s *Stats) Total() time.Duration {
+	var total time.Duration
+	for _, st := range s.Stages {
+		total += st.Duration
+	}
+
+	return total
+}
+
+// Stage returns the time spent in the named stage, or 0 if the stage did not
+// run.
+func (s *Stats) Stage(name string) time.Duration {
+	for _, st := range s.Stages {
+		if st.Name == name {
+			return st.Duration
+		}
+	}
+
+	return 0
+}
+
+func (s *Stats) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "bytes_hashed=%d allocs=%d alloc_bytes=%d\n",
+		s.BytesHashed, s.Allocs, s.AllocBytes)
+	for _, st := range s.Stages {
+		fmt.Fprintf(&sb, "%-12s %10.3f ms\n", st.Name,
+			float64(st.Duration)/float64(time.Millisecond))
+	}
+	fmt.Fprintf(&sb, "%-12s %10.3f ms\n", "total",
+		float64(s.Total())/float64(time.Millisecond))
+
+	return sb.String()
+}
+
+// statsCollector fills in a Stats as an operation progresses.  A nil
+// collector does nothing, so callers that do not want statistics do not pay
+// for reading the runtime's memory counters.
+type statsCollector struct {
+	stats      *Stats
+	stageStart time.Time
+	mallocs    uint64
+	totalAlloc uint64
+}
+
+func newStatsCollector(stats *Stats) *statsCollector {
+	if stats == nil {
+		return nil
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return &statsCollector{
+		stats:      stats,
+		stageStart: time.Now(),
+		mallocs:    ms.Mallocs,
+		totalAlloc: ms.TotalAlloc,
+	}
+}
+
+// stage records the end of the named stage; the next stage starts now.
+func (c *statsCollector) stage(name string) {
+	if c == nil {
+		return
+	}
+
+	now := time.Now()
+	c.stats.Stages = append(c.stats.Stages, StageStats{
+		Name:     name,
+		Duration: now.Sub(c.stageStart),
+	})
+	c.stageStart = now
+}
+
+func (c *statsCollector) hashed(n int) {
+	if c == nil {
+		return
+	}
+
+	c.stats.BytesHashed += uint64(n)
+}
+
+func (c *statsCollector) finish() {
+	if c == nil {
+		return
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	c.stats.Allocs = ms.Mallocs - c.mallocs
+	c.stats.AllocBytes = ms.TotalAlloc - c.totalAlloc
+}
+
+// hashedSize returns the number of bytes covered by the image hash.
+func (img *Image) hashedSize(initialHash []byte) int {
+	return len(initialHash) + int(img.Header.HdrSz) + len(img.Body) +
+		int(img.Header.ProtSz)
+}
@@ -0,0 +1,81 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// NewThresholdSession starts a k-of-n signing ceremony for an image.  The
+// session covers the image hash, so the image must not change (other than
+// by attaching signatures) until the session is finalized.
+func NewThresholdSession(img Image, threshold int,
+	keys []sec.PubSignKey) (sec.ThresholdSession, error) {
+
+	hash, err := img.Hash()
+	if err != nil {
+		return sec.ThresholdSession{}, err
+	}
+
+	return sec.NewThresholdSession(hash, threshold, keys)
+}
+
+// FinalizeThreshold attaches the signatures collected in a threshold session
+// to the image it was started for.  It fails if the session is incomplete or
+// belongs to a different image.
+func FinalizeThreshold(img Image, s sec.ThresholdSession,
+	opts SigTlvOpts) (Image, error) {
+
+	hash, err := img.Hash()
+	if err != nil {
+		return img, err
+	}
+	want, err := hex.DecodeString(s.Hash)
+	if err != nil || !bytes.Equal(hash, want) {
+		return img, errors.Errorf(
+			"threshold session is for a different image: "+
+				"have=%x want=%s", hash, s.Hash)
+	}
+
+	if len(img.FindTlvs(IMAGE_TLV_SERIAL_INFO)) > 0 {
+		return img, errors.Errorf(
+			"image contains a SERIAL_INFO TLV; it would be invalidated")
+	}
+
+	keys, sigs, err := s.Finalize()
+	if err != nil {
+		return img, err
+	}
+
+	dup := img.Clone()
+	for i, sig := range sigs {
+		tlvs, err := BuildSigTlvPair(keys[i], sig, opts)
+		if err != nil {
+			return img, err
+		}
+		dup.Tlvs = append(dup.Tlvs, tlvs...)
+	}
+
+	return dup, nil
+}
@@ -0,0 +1,120 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/x509"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// EmbedTimestamp adds an RFC 3161 time-stamp token to the image's
+// unprotected TLVs, replacing any existing one.  The token must cover the
+// image hash.  Because the TLV is not protected, existing signatures remain
+// valid.
+func (img *Image) EmbedTimestamp(token []byte) error {
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+
+	info, err := sec.ParseTimestampToken(token)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(info.HashedMessage, hash) {
+		return errors.Errorf(
+			"time-stamp token does not cover image hash: have=%x want=%x",
+			info.HashedMessage, hash)
+	}
+
+	if len(token) > 0xffff {
+		return errors.Errorf(
+			"time-stamp token too large for TLV: %d bytes", len(token))
+	}
+
+	img.RemoveTlvsWithType(IMAGE_TLV_TIMESTAMP)
+	img.Tlvs = append(img.Tlvs, ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_TIMESTAMP,
+			Pad:  0,
+			Len:  uint16(len(token)),
+		},
+		Data: token,
+	})
+
+	return nil
+}
+
+// RequestTimestamp obtains an RFC 3161 time-stamp token over the image hash
+// from the TSA at the specified URL and embeds it in the image.
+func (img *Image) RequestTimestamp(tsaUrl string) error {
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+
+	token, err := sec.RequestTimestamp(tsaUrl, hash)
+	if err != nil {
+		return err
+	}
+
+	return img.EmbedTimestamp(token)
+}
+
+// TimestampToken returns the image's RFC 3161 time-stamp token, or nil if
+// it has none.
+func (img *Image) TimestampToken() ([]byte, error) {
+	tlv, err := img.FindUniqueTlv(IMAGE_TLV_TIMESTAMP)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	return tlv.Data, nil
+}
+
+// VerifyTimestamp verifies the image's time-stamp token against the image
+// hash.  The TSA certificate must chain to one of the given roots (or to a
+// system root if roots is nil).  On success, the token contents, including
+// the time of signing, are returned.
+func (img *Image) VerifyTimestamp(
+	roots *x509.CertPool) (sec.TimestampInfo, error) {
+
+	token, err := img.TimestampToken()
+	if err != nil {
+		return sec.TimestampInfo{}, err
+	}
+	if token == nil {
+		return sec.TimestampInfo{}, errors.Errorf(
+			"image does not contain a time-stamp token")
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return sec.TimestampInfo{}, err
+	}
+
+	return sec.VerifyTimestampToken(token, hash, roots)
+}
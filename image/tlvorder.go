@@ -0,0 +1,297 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// TlvLayout controls the order in which unprotected TLVs are emitted, and
+// which of them are protected instead.  Some boot loaders expect a
+// particular order; the zero value produces the default: the SHA256 TLV,
+// then each key's KEYHASH or PUBKEY TLV immediately followed by its
+// signature, then the encryption secret.  Signatures cover the image hash
+// rather than the TLV area, so reordering never invalidates them.
+type TlvLayout struct {
+	// Emit the SHA256 TLV after all other unprotected TLVs.
+	HashLast bool
+
+	// Emit all KEYHASH and PUBKEY TLVs before all signature TLVs.
+	GroupSigs bool
+
+	// Types of TLV to emit at the end of the protected region rather than
+	// in the unprotected region (see ValidateTlvLayout and
+	// ProtectedSigTlvTypes).
+	Protected []uint8
+}
+
+// ArrangeTlvs reorders an image's unprotected TLVs according to the given
+// layout.  TLVs not affected by the layout keep their relative order.
+func (img *Image) ArrangeTlvs(layout TlvLayout) {
+	tlvs := img.Tlvs
+
+	if layout.GroupSigs {
+		var slots []int
+		var keyIds []ImageTlv
+		var sigs []ImageTlv
+		for i, tlv := range tlvs {
+			switch {
+			case tlv.Header.Type == IMAGE_TLV_KEYHASH ||
+				tlv.Header.Type == IMAGE_TLV_PUBKEY:
+
+				keyIds = append(keyIds, tlv)
+			case ImageTlvTypeIsSig(tlv.Header.Type):
+				sigs = append(sigs, tlv)
+			default:
+				continue
+			}
+			slots = append(slots, i)
+		}
+
+		for i, tlv := range append(keyIds, sigs...) {
+			tlvs[slots[i]] = tlv
+		}
+	}
+
+	if layout.HashLast {
+		var hashes []ImageTlv
+		var others []ImageTlv
+		for _, tlv := range tlvs {
+			if ImageTlvTypeIsHash(tlv.Header.Type) {
+				hashes = append(hashes, tlv)
+			} else {
+				others = append(others, tlv)
+			}
+		}
+		tlvs = append(others, hashes...)
+	}
+
+	img.Tlvs = tlvs
+}
+
+// checkSizes verifies that the size fields in an image's header agree with
+// its contents.
+func (img *Image) checkSizes() error {
+	if int(img.Header.HdrSz) != IMAGE_HEADER_SIZE+len(img.Pad) {
+		return errors.Errorf(
+			"header size mismatch: header=%d actual=%d",
+			img.Header.HdrSz, IMAGE_HEADER_SIZE+len(img.Pad))
+	}
+	if int(img.Header.ImgSz) != len(img.Body) {
+		return errors.Errorf(
+			"body size mismatch: header=%d actual=%d",
+			img.Header.ImgSz, len(img.Body))
+	}
+	if protSz := calcProtSize(img.ProtTlvs); img.Header.ProtSz != protSz {
+		return errors.Errorf(
+			"protected TLV size mismatch: header=%d actual=%d",
+			img.Header.ProtSz, protSz)
+	}
+
+	return nil
+}
+
+// Canonicalize puts an image into the canonical form produced by
+// ImageCreator with the default TLV layout: the SHA256 TLV, then each key
+// TLV immediately followed by its signature, then the encryption secret,
+// then any other unprotected TLVs in their original order.  Trailing
+// padding is removed.  Only unhashed parts of the image change, so
+// signatures remain valid.
+//
+// An error is returned if the image's header disagrees with its contents
+// or if its key and signature TLVs do not pair up; neither can be corrected
+// without invalidating the image.
+func (img *Image) Canonicalize() error {
+	if err := img.checkSizes(); err != nil {
+		return err
+	}
+
+	var hashes []ImageTlv
+	var pairs []ImageTlv
+	var secrets []ImageTlv
+	var others []ImageTlv
+
+	// Key TLVs and signatures are matched in order, as in CollectTlvSigs().
+	var keyIds []ImageTlv
+	for _, tlv := range img.Tlvs {
+		switch {
+		case ImageTlvTypeIsHash(tlv.Header.Type):
+			hashes = append(hashes, tlv)
+
+		case tlv.Header.Type == IMAGE_TLV_KEYHASH ||
+			tlv.Header.Type == IMAGE_TLV_PUBKEY:
+
+			keyIds = append(keyIds, tlv)
+
+		case ImageTlvTypeIsSig(tlv.Header.Type):
+			if len(keyIds) == 0 {
+				return errors.Errorf(
+					"image contains signature tlv without preceding keyhash")
+			}
+			pairs = append(pairs, keyIds[0], tlv)
+			keyIds = keyIds[1:]
+
+		case ImageTlvTypeIsSecret(tlv.Header.Type):
+			secrets = append(secrets, tlv)
+
+		default:
+			others = append(others, tlv)
+		}
+	}
+
+	if len(keyIds) > 0 {
+		return errors.Errorf(
+			"image contains %s tlv without subsequent signature",
+			ImageTlvTypeName(keyIds[0].Header.Type))
+	}
+
+	var tlvs []ImageTlv
+	tlvs = append(tlvs, hashes...)
+	tlvs = append(tlvs, pairs...)
+	tlvs = append(tlvs, secrets...)
+	tlvs = append(tlvs, others...)
+
+	img.Tlvs = tlvs
+	img.TailPad = nil
+
+	return nil
+}
+
+// DupPolicy determines how the parser treats duplicate TLVs.
+type DupPolicy int
+
+const (
+	// Retain every TLV.
+	DUP_POLICY_KEEP_ALL DupPolicy = iota
+
+	// Discard unprotected duplicates.  Protected TLVs are covered by the
+	// image hash, so protected duplicates are always retained.
+	DUP_POLICY_KEEP_FIRST
+
+	// Treat any duplicate as a parse error.
+	DUP_POLICY_ERROR
+)
+
+var dupPolicyNameMap = map[DupPolicy]string{
+	DUP_POLICY_KEEP_ALL:   "keep-all",
+	DUP_POLICY_KEEP_FIRST: "keep-first",
+	DUP_POLICY_ERROR:      "error",
+}
+
+func DupPolicyString(policy DupPolicy) string {
+	s := dupPolicyNameMap[policy]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func DupPolicyFromString(s string) (DupPolicy, error) {
+	for k, v := range dupPolicyNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown duplicate TLV policy: \"%s\"", s)
+}
+
+// ImageTlvTypeIsRepeatable indicates whether an image may legitimately
+// contain several TLVs of the given type (e.g., one signature per key).
+func ImageTlvTypeIsRepeatable(tlvType uint8) bool {
+	switch tlvType {
+	case IMAGE_TLV_KEYHASH, IMAGE_TLV_PUBKEY, IMAGE_TLV_DEPENDENCY,
+		IMAGE_TLV_SECTION, IMAGE_TLV_TIMESTAMP, IMAGE_TLV_TLOG_ENTRY:
+
+		return true
+	default:
+		return ImageTlvTypeIsSig(tlvType)
+	}
+}
+
+// FindDuplicateTlvs returns the indices of the TLVs in the given list that
+// duplicate an earlier one.  For a repeatable type, only a TLV with the same
+// contents as an earlier one is a duplicate; for any other type, every TLV
+// after the first is.
+func FindDuplicateTlvs(tlvs []ImageTlv) []int {
+	var dups []int
+
+	for i, tlv := range tlvs {
+		for _, prev := range tlvs[:i] {
+			if prev.Header.Type != tlv.Header.Type {
+				continue
+			}
+
+			if !ImageTlvTypeIsRepeatable(tlv.Header.Type) ||
+				bytes.Equal(prev.Data, tlv.Data) {
+
+				dups = append(dups, i)
+				break
+			}
+		}
+	}
+
+	return dups
+}
+
+// applyDupPolicy enforces the parser's duplicate TLV policy.
+func (p *imageParser) applyDupPolicy(img *Image) error {
+	switch p.opts.Duplicates {
+	case DUP_POLICY_KEEP_ALL:
+		return nil
+
+	case DUP_POLICY_KEEP_FIRST:
+		dups := FindDuplicateTlvs(img.Tlvs)
+		for i := len(dups) - 1; i >= 0; i-- {
+			idx := dups[i]
+			img.Tlvs = append(img.Tlvs[:idx], img.Tlvs[idx+1:]...)
+		}
+		return nil
+
+	case DUP_POLICY_ERROR:
+		check := func(tlvs []ImageTlv, region string) error {
+			dups := FindDuplicateTlvs(tlvs)
+			if len(dups) == 0 {
+				return nil
+			}
+
+			tlv := tlvs[dups[0]]
+			name := ImageTlvTypeName(tlv.Header.Type)
+			return errors.WithTlv(
+				errors.Errorf("duplicate %s TLV: %s", region, name),
+				dups[0], tlv.Header.Type, name)
+		}
+
+		if err := check(img.ProtTlvs, "protected"); err != nil {
+			return p.problem(err)
+		}
+		if err := check(img.Tlvs, "unprotected"); err != nil {
+			return p.problem(err)
+		}
+		return nil
+
+	default:
+		return errors.Errorf("unknown duplicate TLV policy: %d",
+			p.opts.Duplicates)
+	}
+}
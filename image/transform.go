@@ -0,0 +1,145 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Transformer is a custom image processing step, such as adding a vendor
+// TLV, watermarking the body, or stamping telemetry metadata.  Transformers
+// let downstream projects extend image creation and the release pipeline
+// without modifying this library.
+//
+// During image creation, transformers are applied to the unpadded body,
+// before alignment padding is added and before a derived nonce is
+// calculated, so both reflect the transformed body; the hash and signatures
+// cover their changes.  A transformer may modify the body, the header flags,
+// and the protected TLVs.  At this point the protected TLVs are only the
+// creator's ExtraProtTlvs; the built-in TLVs are added afterwards.  The
+// header's size fields are recalculated after each application.
+type Transformer interface {
+	// Name identifies the transformer in the registry and in errors.
+	Name() string
+
+	// Apply returns a transformed copy of the image.  It must not modify
+	// the image it is passed.
+	Apply(img Image) (Image, error)
+}
+
+type transformerFunc struct {
+	name  string
+	apply func(img Image) (Image, error)
+}
+
+func (t *transformerFunc) Name() string {
+	return t.name
+}
+
+func (t *transformerFunc) Apply(img Image) (Image, error) {
+	return t.apply(img)
+}
+
+// NewTransformer creates a transformer from a function.
+func NewTransformer(name string,
+	apply func(img Image) (Image, error)) Transformer {
+
+	return &transformerFunc{
+		name:  name,
+		apply: apply,
+	}
+}
+
+var transformerRegistry = map[string]Transformer{}
+var transformerRegistryMtx sync.RWMutex
+
+// RegisterTransformer adds a transformer to the registry so that it can be
+// selected by name (e.g., from a build configuration).  Names must be
+// unique.
+func RegisterTransformer(t Transformer) error {
+	name := t.Name()
+	if name == "" {
+		return errors.Errorf("transformer has no name")
+	}
+
+	transformerRegistryMtx.Lock()
+	defer transformerRegistryMtx.Unlock()
+
+	if _, ok := transformerRegistry[name]; ok {
+		return errors.Errorf("transformer \"%s\" already registered", name)
+	}
+
+	transformerRegistry[name] = t
+	return nil
+}
+
+// TransformerNames returns the names of all registered transformers, in
+// sorted order.
+func TransformerNames() []string {
+	transformerRegistryMtx.RLock()
+	defer transformerRegistryMtx.RUnlock()
+
+	names := make([]string, 0, len(transformerRegistry))
+	for name := range transformerRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// LookupTransformers returns the registered transformers with the given
+// names, in the order named.
+func LookupTransformers(names []string) ([]Transformer, error) {
+	transformerRegistryMtx.RLock()
+	defer transformerRegistryMtx.RUnlock()
+
+	ts := make([]Transformer, len(names))
+	for i, name := range names {
+		t := transformerRegistry[name]
+		if t == nil {
+			return nil, errors.Errorf("unknown transformer: \"%s\"", name)
+		}
+		ts[i] = t
+	}
+
+	return ts, nil
+}
+
+// ApplyTransformers applies each transformer to the image in turn.  The
+// header's body and protected TLV sizes are updated to match the result.
+func ApplyTransformers(img Image, ts []Transformer) (Image, error) {
+	for _, t := range ts {
+		out, err := t.Apply(img.Clone())
+		if err != nil {
+			return img, errors.Wrapf(err, "transformer \"%s\" failed",
+				t.Name())
+		}
+		img = out
+	}
+
+	img.Header.ImgSz = uint32(len(img.Body))
+	img.Header.ProtSz = calcProtSize(img.ProtTlvs)
+
+	return img, nil
+}
@@ -0,0 +1,75 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// VerifyTrustBundle verifies an image's signatures against a trust bundle.
+// The bundle lists key hashes only, so the caller supplies the candidate
+// public keys.  Signatures from keys that the bundle does not trust at the
+// specified time are ignored.  On success, the index of the key that
+// verified the image is returned.
+func (img *Image) VerifyTrustBundle(tb sec.TrustBundle,
+	keys []sec.PubSignKey, at time.Time) (int, error) {
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return -1, err
+	}
+
+	hash, err := img.SigHash()
+	if err != nil {
+		return -1, err
+	}
+
+	var lastErr error
+	for i, key := range keys {
+		if err := tb.KeyTrusted(key, at); err != nil {
+			lastErr = err
+			continue
+		}
+
+		idx, err := sec.VerifySigs(key, sigs, hash)
+		if err != nil {
+			return -1, err
+		}
+		if idx != -1 {
+			return i, nil
+		}
+
+		keyHash, err := key.Hash()
+		if err != nil {
+			return -1, err
+		}
+		lastErr = errors.Errorf("no valid signature from key %x", keyHash)
+	}
+
+	if lastErr == nil {
+		return -1, errors.Errorf("no signing keys provided")
+	}
+
+	return -1, errors.Wrapf(lastErr,
+		"image not signed by a key trusted by bundle %d", tb.Serial)
+}
@@ -0,0 +1,200 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/apache/mynewt-artifact/cbor"
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// An image is uploaded to a device with a sequence of mcumgr (SMP) image
+// upload requests.  Each request carries a chunk of the image and its
+// offset; the first also carries the image's total length and SHA256, which
+// identify the upload session.  Request bodies are CBOR maps.
+
+// SMP header fields for an image upload request.
+const (
+	SMP_HDR_SIZE        = 8
+	SMP_OP_WRITE        = 2
+	SMP_GROUP_IMAGE     = 1
+	SMP_ID_IMAGE_UPLOAD = 1
+)
+
+// The default number of image bytes per upload request.
+const IMAGE_UPLOAD_CHUNK_SIZE_DEFAULT = 512
+
+// UploadOpts controls how an image is split into upload requests.
+type UploadOpts struct {
+	// The image number (slot pair) to upload to.
+	ImageNum uint8
+
+	// Image bytes per request; 0 means the image's SERIAL_INFO chunk size
+	// if it has one, or IMAGE_UPLOAD_CHUNK_SIZE_DEFAULT otherwise.
+	ChunkSize int
+
+	// Requests that the image be marked for test after the upload
+	// completes.
+	Upgrade bool
+}
+
+// UploadChunk is a single mcumgr image upload request.
+type UploadChunk struct {
+	Off  uint32
+	Data []byte
+
+	// The following are only set in the first chunk.
+	First    bool
+	ImageNum uint8
+	Len      uint32
+	Sha      []byte
+	Upgrade  bool
+}
+
+// Payload returns the CBOR-encoded body of the upload request.
+func (c *UploadChunk) Payload() []byte {
+	buf := &bytes.Buffer{}
+
+	numFields := 2
+	if c.First {
+		numFields += 3
+		if c.Upgrade {
+			numFields++
+		}
+	}
+	cbor.WriteHead(buf, cbor.MAJOR_MAP, uint64(numFields))
+
+	if c.First {
+		cbor.WriteText(buf, "image")
+		cbor.WriteHead(buf, cbor.MAJOR_UINT, uint64(c.ImageNum))
+		cbor.WriteText(buf, "len")
+		cbor.WriteHead(buf, cbor.MAJOR_UINT, uint64(c.Len))
+	}
+
+	cbor.WriteText(buf, "off")
+	cbor.WriteHead(buf, cbor.MAJOR_UINT, uint64(c.Off))
+
+	if c.First {
+		cbor.WriteText(buf, "sha")
+		cbor.WriteBytes(buf, c.Sha)
+	}
+
+	cbor.WriteText(buf, "data")
+	cbor.WriteBytes(buf, c.Data)
+
+	if c.First && c.Upgrade {
+		cbor.WriteText(buf, "upgrade")
+		buf.WriteByte(0xf5)
+	}
+
+	return buf.Bytes()
+}
+
+// Frame returns the upload request as a complete SMP packet: an SMP header
+// with the given sequence number, followed by the payload.
+func (c *UploadChunk) Frame(seq uint8) ([]byte, error) {
+	payload := c.Payload()
+	if len(payload) > 0xffff {
+		return nil, errors.Errorf(
+			"upload request too large for SMP: %d bytes", len(payload))
+	}
+
+	hdr := make([]byte, SMP_HDR_SIZE)
+	hdr[0] = SMP_OP_WRITE
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+	binary.BigEndian.PutUint16(hdr[4:], SMP_GROUP_IMAGE)
+	hdr[6] = seq
+	hdr[7] = SMP_ID_IMAGE_UPLOAD
+
+	return append(hdr, payload...), nil
+}
+
+// UploadChunks splits a serialized image into upload requests.
+func UploadChunks(data []byte, opts UploadOpts) ([]UploadChunk, error) {
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = IMAGE_UPLOAD_CHUNK_SIZE_DEFAULT
+	}
+	if opts.ChunkSize < 0 {
+		return nil, errors.Errorf("invalid chunk size: %d", opts.ChunkSize)
+	}
+	if len(data) == 0 {
+		return nil, errors.Errorf("cannot upload an empty image")
+	}
+	if uint64(len(data)) > 0xffffffff {
+		return nil, errors.Errorf(
+			"image too large to upload: %d bytes", len(data))
+	}
+
+	sha := sha256.Sum256(data)
+
+	var chunks []UploadChunk
+	for off := 0; off < len(data); off += opts.ChunkSize {
+		end := off + opts.ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		c := UploadChunk{
+			Off:  uint32(off),
+			Data: data[off:end],
+		}
+		if off == 0 {
+			c.First = true
+			c.ImageNum = opts.ImageNum
+			c.Len = uint32(len(data))
+			c.Sha = sha[:]
+			c.Upgrade = opts.Upgrade
+		}
+		chunks = append(chunks, c)
+	}
+
+	return chunks, nil
+}
+
+// UploadChunks serializes the image and splits it into upload requests.  If
+// the image has a SERIAL_INFO TLV, its image number and chunk size are used
+// in place of unspecified options, and the TLV must be up to date.
+func (img *Image) UploadChunks(opts UploadOpts) ([]UploadChunk, error) {
+	info, err := img.SerialInfo()
+	if err != nil {
+		return nil, err
+	}
+	if info != nil {
+		if err := img.VerifySerialInfo(); err != nil {
+			return nil, err
+		}
+		if opts.ImageNum == 0 {
+			opts.ImageNum = info.ImageNum
+		}
+		if opts.ChunkSize == 0 {
+			opts.ChunkSize = int(info.ChunkSize)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := img.Write(buf); err != nil {
+		return nil, err
+	}
+
+	return UploadChunks(buf.Bytes(), opts)
+}
@@ -0,0 +1,177 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/cbor"
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The USER_DATA TLV carries product-specific provisioning values (e.g., a
+// hardware revision or region code) as a CBOR map with text keys.  It is
+// protected, so the values are covered by the image hash and signatures.
+
+// EncodeUserData returns the deterministic CBOR encoding of a user data map.
+// Values may be nil, bools, integers, floats, strings, byte slices, and
+// arrays or maps of these.
+func EncodeUserData(data map[string]interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := cbor.Encode(buf, data); err != nil {
+		return nil, errors.Wrapf(err, "failed to encode user data")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DecodeUserData parses the CBOR map in a USER_DATA TLV.  Integers decode
+// as int64 (or uint64 if too large), floats as float64, arrays as
+// []interface{}, and nested maps as map[string]interface{}.
+func DecodeUserData(b []byte) (map[string]interface{}, error) {
+	v, err := cbor.Decode(b)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode user data")
+	}
+
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf(
+			"user data is not a CBOR map: have=%T", v)
+	}
+
+	return m, nil
+}
+
+// UserDataFromJson converts a JSON object to a user data map.  Integral
+// numbers become int64s; other numbers become float64s.
+func UserDataFromJson(b []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	if err := dec.Decode(&m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse user data JSON")
+	}
+	if m == nil {
+		return nil, errors.Errorf("user data JSON is not an object")
+	}
+
+	return jsonToUserData(m).(map[string]interface{}), nil
+}
+
+func jsonToUserData(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonToUserData(e)
+		}
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonToUserData(e)
+		}
+	}
+
+	return v
+}
+
+// GenerateUserDataTlv creates a USER_DATA TLV containing the CBOR encoding
+// of the given map.
+func GenerateUserDataTlv(data map[string]interface{}) (ImageTlv, error) {
+	b, err := EncodeUserData(data)
+	if err != nil {
+		return ImageTlv{}, err
+	}
+	if len(b) > 0xffff {
+		return ImageTlv{}, errors.Errorf(
+			"user data too large: have=%d max=%d", len(b), 0xffff)
+	}
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_USER_DATA,
+			Pad:  0,
+			Len:  uint16(len(b)),
+		},
+		Data: b,
+	}, nil
+}
+
+// UserData returns the decoded map in an image's protected USER_DATA TLV.
+// It returns nil if the image has no user data.
+func (img *Image) UserData() (map[string]interface{}, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_USER_DATA)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	m, err := DecodeUserData(tlv.Data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid USER_DATA TLV")
+	}
+
+	return m, nil
+}
+
+// userDataString renders a decoded user data value compactly, with map keys
+// in sorted order and byte strings in hex.
+func userDataString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		return fmt.Sprintf("h'%x'", v)
+	case []interface{}:
+		elems := make([]string, len(v))
+		for i, e := range v {
+			elems[i] = userDataString(e)
+		}
+		return "[" + strings.Join(elems, ", ") + "]"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		elems := make([]string, len(keys))
+		for i, k := range keys {
+			elems[i] = fmt.Sprintf("%q: %s", k, userDataString(v[k]))
+		}
+		return "{" + strings.Join(elems, ", ") + "}"
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -75,6 +75,7 @@ type ImageHdrV1 struct {
 
 type ImageV1 struct {
 	Header ImageHdrV1
+	Pad    []byte // Bytes between the 32-byte header and HdrSz.
 	Body   []byte
 	Tlvs   []ImageTlv
 }
@@ -115,8 +116,14 @@ func (img *ImageV1) WritePlusOffsets(w io.Writer) (ImageOffsets, error) {
 	}
 	offset += IMAGE_HEADER_SIZE
 
+	size, err := w.Write(img.Pad)
+	if err != nil {
+		return offs, errors.Wrapf(err, "failed to write image header pad")
+	}
+	offset += size
+
 	offs.Body = offset
-	size, err := w.Write(img.Body)
+	size, err = w.Write(img.Body)
 	if err != nil {
 		return offs, errors.Wrapf(err, "failed to write image body")
 	}
@@ -259,7 +266,7 @@ func generateV1SigTlvEc(key sec.PrivSignKey, hash []byte) (ImageTlv, error) {
 		Header: ImageTlvHdr{
 			Type: sigTlvTypeV1(key),
 			Pad:  0,
-			Len:  sigLen + uint16(len(pad)),
+			Len:  uint16(b.Len()),
 		},
 		Data: b.Bytes(),
 	}, nil
@@ -275,7 +282,7 @@ func generateV1SigTlv(key sec.PrivSignKey, hash []byte) (ImageTlv, error) {
 	}
 }
 
-func calcHashV1(initialHash []byte, hdr ImageHdrV1,
+func calcHashV1(initialHash []byte, hdr ImageHdrV1, pad []byte,
 	plainBody []byte) ([]byte, error) {
 
 	hash := sha256.New()
@@ -298,10 +305,8 @@ func calcHashV1(initialHash []byte, hdr ImageHdrV1,
 		return nil, err
 	}
 
-	extra := hdr.HdrSz - IMAGE_HEADER_SIZE
-	if extra > 0 {
-		b := make([]byte, extra)
-		if err := add(b); err != nil {
+	if len(pad) > 0 {
+		if err := add(pad); err != nil {
 			return nil, err
 		}
 	}
@@ -375,12 +380,10 @@ func (ic *ImageCreator) CreateV1() (ImageV1, error) {
 		}
 
 		hdr.HdrSz = uint16(ic.HeaderSize)
-		for i := 0; i < extra; i++ {
-			ri.Body = append(ri.Body, 0)
-		}
+		ri.Pad = make([]byte, extra)
 	}
 
-	hashBytes, err := calcHashV1(ic.InitialHash, hdr, ic.Body)
+	hashBytes, err := calcHashV1(ic.InitialHash, hdr, ri.Pad, ic.Body)
 	if err != nil {
 		return ri, err
 	}
@@ -487,3 +490,306 @@ func GenerateV1Image(opts ImageCreateOpts) (ImageV1, error) {
 
 	return ri, nil
 }
+
+// IsImageV1 reports whether the given data begins with a v1 image header.
+func IsImageV1(imgData []byte) bool {
+	if len(imgData) < 4 {
+		return false
+	}
+
+	return binary.LittleEndian.Uint32(imgData) == IMAGEv1_MAGIC
+}
+
+// ParseImageV1 parses a serialized version-1 image.  Unlike v2 images, v1
+// images have no TLV info header; the extent of the TLV area is specified by
+// the header's TlvSz field.
+func ParseImageV1(imgData []byte) (ImageV1, error) {
+	img := ImageV1{}
+
+	r := bytes.NewReader(imgData)
+	if err := binary.Read(r, binary.LittleEndian, &img.Header); err != nil {
+		return img, errors.WithOffset(errors.Wrapf(err,
+			"image contains invalid header"), 0)
+	}
+
+	if img.Header.Magic != IMAGEv1_MAGIC {
+		return img, errors.WithOffset(errors.Errorf(
+			"image magic incorrect; expected 0x%08x, got 0x%08x",
+			uint32(IMAGEv1_MAGIC), img.Header.Magic), 0)
+	}
+
+	if img.Header.HdrSz < IMAGE_HEADER_SIZE {
+		return img, errors.WithOffset(errors.Errorf(
+			"image header size too small: have=%d want>=%d",
+			img.Header.HdrSz, IMAGE_HEADER_SIZE), 0)
+	}
+
+	hdrSz := int(img.Header.HdrSz)
+	bodyEnd := hdrSz + int(img.Header.ImgSz)
+	tlvEnd := bodyEnd + int(img.Header.TlvSz)
+	if tlvEnd > len(imgData) {
+		return img, errors.Errorf(
+			"image truncated: header specifies %d bytes, have %d",
+			tlvEnd, len(imgData))
+	}
+	if tlvEnd < len(imgData) {
+		return img, errors.WithOffset(errors.Errorf(
+			"image contains %d bytes of trailing data",
+			len(imgData)-tlvEnd), tlvEnd)
+	}
+
+	img.Pad = imgData[IMAGE_HEADER_SIZE:hdrSz]
+	img.Body = imgData[hdrSz:bodyEnd]
+
+	tlvs, err := parseRawTlvs(imgData, bodyEnd, int(img.Header.TlvSz),
+		binary.LittleEndian)
+	if err != nil {
+		return img, err
+	}
+	img.Tlvs = tlvs
+
+	return img, nil
+}
+
+// ReadImageV1 reads and parses a version-1 image file.
+func ReadImageV1(filename string) (ImageV1, error) {
+	imgData, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ImageV1{}, errors.Wrapf(err, "failed to read image from file")
+	}
+
+	img, err := ParseImageV1(imgData)
+	if err != nil {
+		return img, errors.WithArtifact(err, "", filename)
+	}
+
+	return img, nil
+}
+
+// sigTlvTypeForFlagV1 returns the signature TLV type implied by a v1 header
+// signature flag, or 0 if the flag does not indicate a signature.
+func sigTlvTypeForFlagV1(flags uint32) uint8 {
+	switch {
+	case flags&(IMAGEv1_F_PKCS15_RSA2048_SHA256|
+		IMAGEv1_F_PKCS1_PSS_RSA2048_SHA256) != 0:
+		return IMAGEv1_TLV_RSA2048
+	case flags&IMAGEv1_F_ECDSA224_SHA256 != 0:
+		return IMAGEv1_TLV_ECDSA224
+	case flags&IMAGEv1_F_ECDSA256_SHA256 != 0:
+		return IMAGEv1_TLV_ECDSA256
+	default:
+		return 0
+	}
+}
+
+// VerifyStructure checks that a v1 image's header is consistent with its
+// TLVs: the image must contain exactly one hash TLV, and a signature TLV if
+// and only if the header indicates a signature.
+func (img *ImageV1) VerifyStructure() error {
+	if img.Header.Magic != IMAGEv1_MAGIC {
+		return errors.Errorf("image magic incorrect; expected 0x%08x, got 0x%08x",
+			uint32(IMAGEv1_MAGIC), img.Header.Magic)
+	}
+
+	if int(img.Header.HdrSz) != IMAGE_HEADER_SIZE+len(img.Pad) {
+		return errors.Errorf(
+			"image header size mismatch: hdr=%d actual=%d",
+			img.Header.HdrSz, IMAGE_HEADER_SIZE+len(img.Pad))
+	}
+
+	if int(img.Header.ImgSz) != len(img.Body) {
+		return errors.Errorf(
+			"image body size mismatch: hdr=%d actual=%d",
+			img.Header.ImgSz, len(img.Body))
+	}
+
+	tlvSz := 0
+	for _, tlv := range img.Tlvs {
+		if int(tlv.Header.Len) != len(tlv.Data) {
+			return errors.Errorf(
+				"TLV length mismatch: type=%d hdr=%d actual=%d",
+				tlv.Header.Type, tlv.Header.Len, len(tlv.Data))
+		}
+		tlvSz += IMAGE_TLV_SIZE + len(tlv.Data)
+	}
+	if int(img.Header.TlvSz) != tlvSz {
+		return errors.Errorf("image TLV size mismatch: hdr=%d actual=%d",
+			img.Header.TlvSz, tlvSz)
+	}
+
+	if img.Header.Flags&IMAGEv1_F_SHA256 == 0 {
+		return errors.Errorf("image header lacks SHA256 flag")
+	}
+	if _, err := img.Hash(); err != nil {
+		return err
+	}
+
+	sigType := sigTlvTypeForFlagV1(img.Header.Flags)
+	for _, typ := range []uint8{
+		IMAGEv1_TLV_RSA2048, IMAGEv1_TLV_ECDSA224, IMAGEv1_TLV_ECDSA256,
+	} {
+		n := len(img.FindTlvs(typ))
+		if typ == sigType && n != 1 {
+			return errors.Errorf(
+				"image header indicates signature type %d; "+
+					"image contains %d such TLVs", typ, n)
+		}
+		if typ != sigType && n != 0 {
+			return errors.Errorf(
+				"image contains signature type %d not indicated by header",
+				typ)
+		}
+	}
+
+	return nil
+}
+
+// CalcHash calculates the SHA256 hash of a v1 image.
+func (img *ImageV1) CalcHash(initialHash []byte) ([]byte, error) {
+	return calcHashV1(initialHash, img.Header, img.Pad, img.Body)
+}
+
+// VerifyHash checks that a v1 image's hash TLV matches the image contents.
+func (img *ImageV1) VerifyHash(initialHash []byte) error {
+	actual, err := img.CalcHash(initialHash)
+	if err != nil {
+		return err
+	}
+
+	expected, err := img.Hash()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(actual, expected) {
+		return errors.Errorf(
+			"image manifest contains incorrect hash: have=%x want=%x",
+			expected, actual)
+	}
+
+	return nil
+}
+
+// verifySigV1 checks a single v1 signature TLV against a public key.
+func verifySigV1(key sec.PubSignKey, flags uint32, tlv ImageTlv,
+	hash []byte) bool {
+
+	switch tlv.Header.Type {
+	case IMAGEv1_TLV_RSA2048:
+		if key.Rsa == nil {
+			return false
+		}
+		if flags&IMAGEv1_F_PKCS1_PSS_RSA2048_SHA256 != 0 {
+			opts := rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash,
+			}
+			return rsa.VerifyPSS(
+				key.Rsa, crypto.SHA256, hash, tlv.Data, &opts) == nil
+		}
+		return rsa.VerifyPKCS1v15(
+			key.Rsa, crypto.SHA256, hash, tlv.Data) == nil
+
+	case IMAGEv1_TLV_ECDSA224, IMAGEv1_TLV_ECDSA256:
+		if key.Ec == nil {
+			return false
+		}
+
+		// v1 EC signatures are zero-padded to a fixed length; the
+		// registered algorithm ignores the padding.
+		alg, ok := sec.SigAlgForKey(&key)
+		if !ok {
+			return false
+		}
+		valid, err := alg.Verify(&key, hash, tlv.Data)
+		return err == nil && valid
+
+	default:
+		return false
+	}
+}
+
+// VerifySigs checks a v1 image's signature against the provided set of keys.
+// The semantics match those of Image.VerifySigs: it succeeds if the image is
+// unsigned or if any key verifies the signature, and the returned int is the
+// index of the matching key, or -1 if none.
+func (img *ImageV1) VerifySigs(keys []sec.PubSignKey) (int, error) {
+	sigType := sigTlvTypeForFlagV1(img.Header.Flags)
+	if sigType == 0 {
+		return -1, nil
+	}
+
+	tlvs := img.FindTlvs(sigType)
+	if len(tlvs) != 1 {
+		return -1, errors.Errorf(
+			"image contains %d signature TLVs of type %d",
+			len(tlvs), sigType)
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return -1, err
+	}
+
+	for i, k := range keys {
+		if verifySigV1(k, img.Header.Flags, tlvs[0], hash) {
+			return i, nil
+		}
+	}
+
+	return -1, errors.Errorf("image signature does not match provided keys")
+}
+
+// V1ConvertOpts controls the conversion of a v1 image to the v2 format.
+type V1ConvertOpts struct {
+	// Keys used to verify the v1 signature before conversion.  If set, the
+	// v1 image must be signed by one of them.  If empty, the v1 signature is
+	// not checked.
+	Keys []sec.PubSignKey
+
+	// Signers used to sign the resulting v2 image.  v1 signatures cannot be
+	// carried over because the v2 hash covers different data.
+	Signers []sec.Signer
+
+	// Loader hash that prefixed the v1 (and resulting v2) image hash, if
+	// any.
+	LoaderHash []byte
+}
+
+// ConvertV1 produces a v2 image with the same header size, version, flags,
+// and body as the given v1 image.  The v1 image is verified first so that a
+// corrupt image is never re-signed.
+func ConvertV1(v1 ImageV1, opts V1ConvertOpts) (Image, error) {
+	if err := v1.VerifyStructure(); err != nil {
+		return Image{}, errors.Wrapf(err, "invalid v1 image")
+	}
+	if err := v1.VerifyHash(opts.LoaderHash); err != nil {
+		return Image{}, errors.Wrapf(err, "invalid v1 image")
+	}
+	if len(opts.Keys) > 0 {
+		idx, err := v1.VerifySigs(opts.Keys)
+		if err != nil {
+			return Image{}, errors.Wrapf(err, "invalid v1 image")
+		}
+		if idx < 0 {
+			return Image{}, errors.Errorf(
+				"invalid v1 image: image is not signed")
+		}
+	}
+
+	if v1.Header.Flags&IMAGEv1_F_PIC != 0 {
+		return Image{}, errors.Errorf(
+			"cannot convert v1 image: position independent images " +
+				"not supported")
+	}
+
+	ic := NewImageCreator()
+	ic.Body = v1.Body
+	ic.Version = v1.Header.Vers
+	ic.HeaderSize = int(v1.Header.HdrSz)
+	ic.Bootable = v1.Header.Flags&IMAGEv1_F_NON_BOOTABLE == 0
+	ic.InitialHash = opts.LoaderHash
+	ic.Signers = opts.Signers
+	ic.HWKeyIndex = -1
+
+	return ic.Create()
+}
@@ -22,6 +22,8 @@ package image
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"sort"
 
 	"github.com/apache/mynewt-artifact/errors"
 	"github.com/apache/mynewt-artifact/manifest"
@@ -91,29 +93,138 @@ func (img *Image) VerifyStructure() error {
 	return nil
 }
 
+// VerifySections checks that the sections listed in an image's SECTION TLVs
+// lie within the body and do not overlap.  Problems that do not make the
+// image unusable (empty or unnamed sections) are returned as warnings.
+func (img *Image) VerifySections() ([]string, error) {
+	sections, err := img.Sections()
+	if err != nil {
+		return nil, err
+	}
+
+	var warnings []string
+	for i, s := range sections {
+		if s.Name == "" {
+			warnings = append(warnings,
+				fmt.Sprintf("section %d at offset %d has no name", i, s.Offset))
+		}
+		if s.Size == 0 {
+			warnings = append(warnings,
+				fmt.Sprintf("section \"%s\" is empty", s.Name))
+		}
+
+		if s.Offset+s.Size > len(img.Body) {
+			return warnings, errors.Errorf(
+				"section \"%s\" extends beyond image body: "+
+					"offset=%d size=%d body-size=%d",
+				s.Name, s.Offset, s.Size, len(img.Body))
+		}
+	}
+
+	sorted := append([]Section(nil), sections...)
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].Offset < sorted[j].Offset
+	})
+	for i := 1; i < len(sorted); i++ {
+		prev := sorted[i-1]
+		cur := sorted[i]
+		if cur.Size > 0 && prev.Offset+prev.Size > cur.Offset {
+			return warnings, errors.Errorf(
+				"sections \"%s\" and \"%s\" overlap", prev.Name, cur.Name)
+		}
+	}
+
+	return warnings, nil
+}
+
+// HashCoverage indicates whether an encrypted image's hash covers its
+// plaintext or its ciphertext body.  MCUboot hashes the plaintext by default;
+// hashing the ciphertext allows an image to be verified without its
+// decryption key.  The hash of an unencrypted image covers the plaintext.
+type HashCoverage int
+
+const (
+	// Creation: not applicable.  Verification: accept either convention.
+	HASH_COVERAGE_AUTO HashCoverage = iota
+	HASH_COVERAGE_PLAINTEXT
+	HASH_COVERAGE_CIPHERTEXT
+)
+
+var hashCoverageNameMap = map[HashCoverage]string{
+	HASH_COVERAGE_AUTO:       "auto",
+	HASH_COVERAGE_PLAINTEXT:  "plaintext",
+	HASH_COVERAGE_CIPHERTEXT: "ciphertext",
+}
+
+func HashCoverageString(hc HashCoverage) string {
+	s := hashCoverageNameMap[hc]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func HashCoverageFromString(s string) (HashCoverage, error) {
+	for hc, name := range hashCoverageNameMap {
+		if s == name {
+			return hc, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown hash coverage: \"%s\"", s)
+}
+
 // VerifyHash calculates an image's hash and compares it to the image's SHA256
-// TLV.  If the image is encrypted, this function temporarily decrypts it
-// before calculating the hash.  The returned int is the index of the key that
-// was used to decrypt the image, or -1 if none.  An error is returned if the
-// hash is incorrect.
+// TLV.  If the image is encrypted and its hash does not cover the
+// ciphertext, this function temporarily decrypts it before calculating the
+// hash.  The returned int is the index of the key that was used to decrypt
+// the image, or -1 if none.  An error is returned if the hash is incorrect.
 func (img *Image) VerifyHash(privEncKeys []sec.PrivEncKey) (int, error) {
+	_, idx, err := img.VerifyHashCoverage(privEncKeys, HASH_COVERAGE_AUTO)
+	return idx, err
+}
+
+// VerifyHashCoverage is like VerifyHash, but only accepts the specified hash
+// convention (HASH_COVERAGE_AUTO accepts either).  It also reports which
+// convention the image uses.  A ciphertext hash is checked without
+// decrypting the image, so no keys are required.
+func (img *Image) VerifyHashCoverage(privEncKeys []sec.PrivEncKey,
+	want HashCoverage) (HashCoverage, int, error) {
+
 	secret, err := img.verifyEncState()
 	if err != nil {
-		return -1, err
+		return HASH_COVERAGE_AUTO, -1, err
 	}
 
 	if secret == nil {
 		// Image not encrypted.
+		if want == HASH_COVERAGE_CIPHERTEXT {
+			return HASH_COVERAGE_AUTO, -1, errors.Errorf(
+				"ciphertext hash required, but image not encrypted")
+		}
 		if err := img.verifyHashDecrypted(); err != nil {
-			return -1, err
+			return HASH_COVERAGE_AUTO, -1, err
 		}
 
-		return -1, nil
+		return HASH_COVERAGE_PLAINTEXT, -1, nil
+	}
+
+	// Image is encrypted.  Check for a ciphertext hash first; it does not
+	// require a key.
+	if want != HASH_COVERAGE_PLAINTEXT {
+		err := img.verifyHashDecrypted()
+		if err == nil {
+			return HASH_COVERAGE_CIPHERTEXT, -1, nil
+		}
+		if want == HASH_COVERAGE_CIPHERTEXT {
+			return HASH_COVERAGE_AUTO, -1, errors.Wrapf(err,
+				"ciphertext hash required")
+		}
 	}
 
-	// Image is encrypted.
 	if len(privEncKeys) == 0 {
-		return -1, errors.Errorf(
+		return HASH_COVERAGE_AUTO, -1, errors.Errorf(
 			"attempt to verify hash of encrypted image: no keys provided")
 	}
 
@@ -127,12 +238,53 @@ func (img *Image) VerifyHash(privEncKeys []sec.PrivEncKey) (int, error) {
 		} else {
 			hashErr = dec.verifyHashDecrypted()
 			if hashErr == nil {
-				return i, nil
+				return HASH_COVERAGE_PLAINTEXT, i, nil
 			}
 		}
 	}
 
-	return -1, hashErr
+	return HASH_COVERAGE_AUTO, -1, hashErr
+}
+
+// NonceInfo describes the nonce of an encrypted image.
+type NonceInfo struct {
+	// The contents of the nonce TLV; nil if the image has no nonce.
+	Nonce []byte
+
+	// Whether the nonce is the one NONCE_SOURCE_DERIVED produces for the
+	// plaintext body.  Random and caller-supplied nonces cannot be told
+	// apart.
+	Derived bool
+}
+
+// String returns a short description of the nonce's origin.
+func (ni NonceInfo) String() string {
+	if ni.Nonce == nil {
+		return "none"
+	} else if ni.Derived {
+		return NonceSourceString(NONCE_SOURCE_DERIVED)
+	} else {
+		return NonceSourceString(NONCE_SOURCE_RANDOM) + "/" +
+			NonceSourceString(NONCE_SOURCE_CALLER)
+	}
+}
+
+// InspectNonce reports how an image's nonce was produced.  plainBody is the
+// decrypted image body.
+func (img *Image) InspectNonce(plainBody []byte) (NonceInfo, error) {
+	nonce, err := img.Nonce()
+	if err != nil {
+		return NonceInfo{}, err
+	}
+
+	if nonce == nil {
+		return NonceInfo{}, nil
+	}
+
+	return NonceInfo{
+		Nonce:   nonce,
+		Derived: bytes.Equal(nonce, DeriveNonce(plainBody)),
+	}, nil
 }
 
 // VerifySigs checks an image's attached signatures against the provided set of
@@ -150,7 +302,7 @@ func (img *Image) VerifySigs(keys []sec.PubSignKey) (int, error) {
 		return -1, nil
 	}
 
-	hash, err := img.Hash()
+	hash, err := img.SigHash()
 	if err != nil {
 		return -1, err
 	}
@@ -169,6 +321,67 @@ func (img *Image) VerifySigs(keys []sec.PubSignKey) (int, error) {
 	return -1, errors.Errorf("image signatures do not match provided keys")
 }
 
+// VerifySigsEmbedded checks an image's attached signatures against the keys
+// embedded in its PUBKEY TLVs.  An embedded key is only used if it matches
+// one of the trusted key hashes (in any form accepted by
+// sec.KeyHashMatchesKey); an image cannot vouch for itself.  The returned int
+// is the index of the verifying key in the embedded key list.
+func (img *Image) VerifySigsEmbedded(trusted [][]byte) (int, error) {
+	if len(trusted) == 0 {
+		return -1, errors.Errorf("no trusted key hashes provided")
+	}
+
+	embedded, err := img.EmbeddedPubKeys()
+	if err != nil {
+		return -1, err
+	}
+
+	isTrusted := make([]bool, len(embedded))
+	for i := range embedded {
+		for _, kh := range trusted {
+			match, err := sec.KeyHashMatchesKey(&embedded[i], kh)
+			if err != nil {
+				return -1, err
+			}
+			if match {
+				isTrusted[i] = true
+				break
+			}
+		}
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return -1, err
+	}
+	if len(sigs) == 0 {
+		return -1, nil
+	}
+
+	hash, err := img.SigHash()
+	if err != nil {
+		return -1, err
+	}
+
+	for keyIdx, k := range embedded {
+		if !isTrusted[keyIdx] {
+			continue
+		}
+
+		sigIdx, err := sec.VerifySigs(k, sigs, hash)
+		if err != nil {
+			return -1, err
+		}
+
+		if sigIdx != -1 {
+			return keyIdx, nil
+		}
+	}
+
+	return -1, errors.Errorf(
+		"image signatures do not match any trusted embedded key")
+}
+
 // VerifyManifest compares an image's structure to its manifest.  It returns
 // an error if the image doesn't match the manifest.
 func (img *Image) VerifyManifest(man manifest.Manifest) error {
@@ -211,5 +424,39 @@ func (img *Image) VerifyManifest(man manifest.Manifest) error {
 		return err
 	}
 
+	if man.Sbom != nil {
+		if err := img.verifyManifestSbom(*man.Sbom); err != nil {
+			return err
+		}
+	}
+
+	if man.FlashMap != nil {
+		if err := img.VerifySlotFit(*man.FlashMap); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VerifySlotFit checks that the image fits in the slot named by the flash
+// map, leaving room for the boot loader's trailer.
+func (img *Image) VerifySlotFit(fm manifest.ManifestFlashMap) error {
+	maxSize, err := fm.MaxImageSize()
+	if err != nil {
+		return err
+	}
+
+	size, err := img.TotalSize()
+	if err != nil {
+		return err
+	}
+
+	if size > maxSize {
+		return errors.Errorf(
+			"image does not fit in slot \"%s\": size=%d max=%d "+
+				"(trailer=%d)", fm.Slot, size, maxSize, fm.TrailerSize)
+	}
+
 	return nil
 }
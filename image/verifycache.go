@@ -0,0 +1,264 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// VerifyCache stores verification reports so that an artifact verified
+// repeatedly against the same policy is only evaluated once.  Reports are
+// keyed by VerifyCacheKey, which covers the image contents and every
+// element of the policy, including the keys.  A change to the key set or
+// the policy therefore produces a different key; stale entries are never
+// served.  Implementations must be safe for concurrent use.
+type VerifyCache interface {
+	Get(key string) (VerifyReport, bool)
+	Put(key string, r VerifyReport)
+}
+
+// verifyPolicyDigest is the canonical form of a VerifyOpts that is hashed
+// to produce a policy fingerprint.  Keys are represented by their encoded
+// public keys.
+type verifyPolicyDigest struct {
+	SigKeys         []string        `json:"sig_keys"`
+	EncKeys         []string        `json:"enc_keys"`
+	HashCoverage    HashCoverage    `json:"hash_coverage"`
+	MinSigs         int             `json:"min_sigs"`
+	Revocations     json.RawMessage `json:"revocations"`
+	HybridKeys      [][2]string     `json:"hybrid_keys"`
+	HybridPolicy    HybridPolicy    `json:"hybrid_policy"`
+	AllowedSigTypes []int           `json:"allowed_sig_types"`
+	RequiredTlvs    []uint8         `json:"required_tlvs"`
+	ForbiddenTlvs   []uint8         `json:"forbidden_tlvs"`
+	MaxSize         int             `json:"max_size"`
+	MinVersion      *ImageVersion   `json:"min_version"`
+	MaxVersion      *ImageVersion   `json:"max_version"`
+	Channels        []string        `json:"channels"`
+	FixedAddr       *uint32         `json:"fixed_addr"`
+	MinSecCnt       *uint32         `json:"min_security_counter"`
+	RejectHashOnly  bool            `json:"reject_hash_only"`
+}
+
+// VerifyPolicyFingerprint returns a digest identifying a verification
+// policy and its keys.
+func VerifyPolicyFingerprint(opts VerifyOpts) (string, error) {
+	d := verifyPolicyDigest{
+		MinSigs:        opts.MinSigs,
+		HashCoverage:   opts.HashCoverage,
+		HybridPolicy:   opts.HybridPolicy,
+		RequiredTlvs:   opts.RequiredTlvs,
+		ForbiddenTlvs:  opts.ForbiddenTlvs,
+		MaxSize:        opts.MaxSize,
+		MinVersion:     opts.MinVersion,
+		MaxVersion:     opts.MaxVersion,
+		Channels:       opts.Channels,
+		FixedAddr:      opts.FixedAddr,
+		MinSecCnt:      opts.MinSecurityCounter,
+		RejectHashOnly: opts.RejectHashOnly,
+	}
+
+	for _, key := range opts.SigKeys {
+		b, err := key.Bytes()
+		if err != nil {
+			return "", err
+		}
+		d.SigKeys = append(d.SigKeys, hex.EncodeToString(b))
+	}
+
+	for _, key := range opts.EncKeys {
+		pub := key.PubEncKey()
+		fp, err := pub.Fingerprint()
+		if err != nil {
+			return "", err
+		}
+		d.EncKeys = append(d.EncKeys, hex.EncodeToString(fp))
+	}
+
+	if opts.Revocations != nil {
+		j, err := json.Marshal(opts.Revocations)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to encode revocation list")
+		}
+		d.Revocations = j
+	}
+
+	for _, hk := range opts.HybridKeys {
+		c, err := hk.Classical.Bytes()
+		if err != nil {
+			return "", err
+		}
+		pq, err := hk.PostQuantum.Bytes()
+		if err != nil {
+			return "", err
+		}
+		d.HybridKeys = append(d.HybridKeys,
+			[2]string{hex.EncodeToString(c), hex.EncodeToString(pq)})
+	}
+
+	for _, t := range opts.AllowedSigTypes {
+		d.AllowedSigTypes = append(d.AllowedSigTypes, int(t))
+	}
+
+	j, err := json.Marshal(d)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode verification policy")
+	}
+
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyCacheKey returns the cache key for verifying an image against a
+// policy: the SHA256 of the serialized image combined with the policy
+// fingerprint.
+func VerifyCacheKey(img Image, opts VerifyOpts) (string, error) {
+	bin, err := img.Bin()
+	if err != nil {
+		return "", err
+	}
+
+	fp, err := VerifyPolicyFingerprint(opts)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(bin)
+	return hex.EncodeToString(sum[:]) + ":" + fp, nil
+}
+
+// copyVerifyReport returns a report that shares no slices with r.
+func copyVerifyReport(r VerifyReport) VerifyReport {
+	dup := r
+	dup.Rules = append([]VerifyRuleResult(nil), r.Rules...)
+	dup.Warnings = append([]string(nil), r.Warnings...)
+	return dup
+}
+
+// VerifyImageCached evaluates an image against a policy, consulting the
+// cache first.  Reports served from the cache have Cached set.  If cache
+// is nil, or the cache key cannot be calculated, the image is verified
+// directly.
+func VerifyImageCached(img Image, opts VerifyOpts,
+	cache VerifyCache) VerifyReport {
+
+	if cache == nil {
+		return VerifyImage(img, opts)
+	}
+
+	key, err := VerifyCacheKey(img, opts)
+	if err != nil {
+		return VerifyImage(img, opts)
+	}
+
+	if r, ok := cache.Get(key); ok {
+		r = copyVerifyReport(r)
+		r.Cached = true
+		return r
+	}
+
+	r := VerifyImage(img, opts)
+	cache.Put(key, copyVerifyReport(r))
+
+	return r
+}
+
+type memVerifyCacheEntry struct {
+	key    string
+	report VerifyReport
+}
+
+// MemVerifyCache is an in-memory VerifyCache that evicts the least
+// recently used report when full.
+type MemVerifyCache struct {
+	mtx        sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+// NewMemVerifyCache creates an in-memory cache holding at most maxEntries
+// reports; 0 means unlimited.
+func NewMemVerifyCache(maxEntries int) *MemVerifyCache {
+	return &MemVerifyCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *MemVerifyCache) Get(key string) (VerifyReport, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem := c.entries[key]
+	if elem == nil {
+		return VerifyReport{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memVerifyCacheEntry).report, true
+}
+
+func (c *MemVerifyCache) Put(key string, r VerifyReport) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if elem := c.entries[key]; elem != nil {
+		elem.Value.(*memVerifyCacheEntry).report = r
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&memVerifyCacheEntry{
+		key:    key,
+		report: r,
+	})
+
+	if c.maxEntries > 0 && c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memVerifyCacheEntry).key)
+	}
+}
+
+// Len returns the number of cached reports.
+func (c *MemVerifyCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.order.Len()
+}
+
+// Purge removes every cached report; e.g., after a key is compromised and
+// reports that were produced with it must not be reused.
+func (c *MemVerifyCache) Purge() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+}
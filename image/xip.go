@@ -0,0 +1,312 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// MCUboot's direct-XIP mode executes an image from whichever of two slots it
+// occupies, so each release is built twice: once linked for each slot.  The
+// two variants form a pair.  Each is ROM-fixed at its own slot address and
+// carries a protected XIP_PEER TLV identifying the pair and the other
+// variant's address, so that tooling can check that two images belong
+// together.
+
+const XIP_NUM_SLOTS = 2
+
+const (
+	IMAGE_XIP_PAIR_ID_SIZE = 8
+	IMAGE_XIP_PEER_SIZE    = IMAGE_XIP_PAIR_ID_SIZE + 4
+)
+
+// XipPeer is the body of an XIP_PEER TLV.
+type XipPeer struct {
+	PairId   [IMAGE_XIP_PAIR_ID_SIZE]byte
+	PeerAddr uint32
+}
+
+// XipSlot specifies one variant of a direct-XIP pair.
+type XipSlot struct {
+	SrcBin         []byte // Used instead of SrcBinFilename if non-nil.
+	SrcBinFilename string
+	Addr           uint32 // Flash address the binary is linked for.
+
+	// Flash area name; if set, Addr is resolved via Image.FlashMap.
+	Area string
+}
+
+// XipPairOpts specifies a direct-XIP pair.  Every field of Image other than
+// the source and ROM-fixed address applies to both variants.
+type XipPairOpts struct {
+	Image ImageCreateOpts
+	Slots [XIP_NUM_SLOTS]XipSlot
+}
+
+// XipPair is a pair of images built for the two slots of a direct-XIP
+// device.  Images[i] runs from Slots[i].Addr.
+type XipPair struct {
+	Images [XIP_NUM_SLOTS]Image
+}
+
+// GenerateXipPeerTlv creates an XIP_PEER TLV.
+func GenerateXipPeerTlv(peer XipPeer) ImageTlv {
+	data := make([]byte, IMAGE_XIP_PEER_SIZE)
+	copy(data, peer.PairId[:])
+	binary.LittleEndian.PutUint32(data[IMAGE_XIP_PAIR_ID_SIZE:],
+		peer.PeerAddr)
+
+	return ImageTlv{
+		Header: ImageTlvHdr{
+			Type: IMAGE_TLV_XIP_PEER,
+			Pad:  0,
+			Len:  uint16(len(data)),
+		},
+		Data: data,
+	}
+}
+
+func parseXipPeerTlv(data []byte) (XipPeer, error) {
+	var peer XipPeer
+
+	if len(data) != IMAGE_XIP_PEER_SIZE {
+		return peer, errors.Errorf(
+			"invalid XIP_PEER TLV: have-len=%d want-len=%d",
+			len(data), IMAGE_XIP_PEER_SIZE)
+	}
+
+	copy(peer.PairId[:], data)
+	peer.PeerAddr = binary.LittleEndian.Uint32(data[IMAGE_XIP_PAIR_ID_SIZE:])
+
+	return peer, nil
+}
+
+func decodeXipPeerTlv(data []byte) (string, error) {
+	peer, err := parseXipPeerTlv(data)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("pair=%x peer=0x%08x", peer.PairId, peer.PeerAddr),
+		nil
+}
+
+// XipPeer returns the contents of the image's XIP_PEER TLV, or nil if the
+// image is not part of a direct-XIP pair.
+func (img *Image) XipPeer() (*XipPeer, error) {
+	tlv, err := img.FindProtUniqueTlv(IMAGE_TLV_XIP_PEER)
+	if err != nil {
+		return nil, err
+	}
+	if tlv == nil {
+		return nil, nil
+	}
+
+	peer, err := parseXipPeerTlv(tlv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+// xipPairId identifies a pair by the version and both linked binaries.
+func xipPairId(ver ImageVersion,
+	bins [XIP_NUM_SLOTS][]byte) [IMAGE_XIP_PAIR_ID_SIZE]byte {
+
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, ver)
+	for _, bin := range bins {
+		binary.Write(h, binary.LittleEndian, uint32(len(bin)))
+		h.Write(bin)
+	}
+
+	var id [IMAGE_XIP_PAIR_ID_SIZE]byte
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// GenerateXipPair builds both variants of a direct-XIP image.  The variants
+// share a version and are stamped with each other's address.
+func GenerateXipPair(opts XipPairOpts) (XipPair, error) {
+	var pair XipPair
+
+	if opts.Image.SrcElfFilename != "" {
+		return pair, errors.Errorf(
+			"direct-XIP pair requires binary sources, not ELF")
+	}
+
+	for i, slot := range opts.Slots {
+		if slot.Area == "" {
+			continue
+		}
+
+		addr, err := flashAreaAddr(opts.Image, slot.Area)
+		if err != nil {
+			return pair, err
+		}
+		if addr > 0xffffffff {
+			return pair, errors.Errorf(
+				"flash area \"%s\" address too large: 0x%x", slot.Area, addr)
+		}
+		opts.Slots[i].Addr = uint32(addr)
+	}
+
+	var bins [XIP_NUM_SLOTS][]byte
+	for i, slot := range opts.Slots {
+		bins[i] = slot.SrcBin
+		if bins[i] == nil {
+			bin, err := ioutil.ReadFile(slot.SrcBinFilename)
+			if err != nil {
+				return pair, errors.Wrapf(err, "Can't read app binary")
+			}
+			bins[i] = bin
+		}
+	}
+
+	if opts.Slots[0].Addr == opts.Slots[1].Addr {
+		return pair, errors.Errorf(
+			"direct-XIP slots share an address: 0x%08x", opts.Slots[0].Addr)
+	}
+	if bytes.Equal(bins[0], bins[1]) {
+		return pair, errors.Errorf(
+			"direct-XIP binaries are identical; " +
+				"each must be linked for its own slot")
+	}
+
+	id := xipPairId(opts.Image.Version, bins)
+
+	for i, slot := range opts.Slots {
+		peer := XipPeer{
+			PairId:   id,
+			PeerAddr: opts.Slots[XIP_NUM_SLOTS-1-i].Addr,
+		}
+
+		iopts := opts.Image
+		iopts.SrcBin = bins[i]
+		iopts.SrcBinFilename = ""
+		iopts.RomFixedAddr = new(uint32)
+		*iopts.RomFixedAddr = slot.Addr
+		iopts.RomFixedArea = ""
+		iopts.ExtraProtTlvs = append(
+			append([]ImageTlv(nil), opts.Image.ExtraProtTlvs...),
+			GenerateXipPeerTlv(peer))
+
+		img, err := GenerateImage(iopts)
+		if err != nil {
+			return pair, errors.Wrapf(err,
+				"failed to create direct-XIP image for slot %d", i)
+		}
+		pair.Images[i] = img
+	}
+
+	return pair, nil
+}
+
+// VerifyXipPair checks that two images form a direct-XIP pair: both are
+// ROM-fixed at distinct addresses, have the same version, and are stamped
+// with the same pair ID and each other's address.  The images' hashes and
+// signatures are not checked.
+func VerifyXipPair(a Image, b Image) error {
+	imgs := [XIP_NUM_SLOTS]*Image{&a, &b}
+
+	var addrs [XIP_NUM_SLOTS]uint32
+	var peers [XIP_NUM_SLOTS]*XipPeer
+	for i, img := range imgs {
+		addr, fixed, err := img.RomFixedAddr()
+		if err != nil {
+			return errors.Wrapf(err, "image %d", i)
+		}
+		if !fixed {
+			return errors.Errorf("image %d is not ROM-fixed", i)
+		}
+		addrs[i] = addr
+
+		peers[i], err = img.XipPeer()
+		if err != nil {
+			return errors.Wrapf(err, "image %d", i)
+		}
+		if peers[i] == nil {
+			return errors.Errorf("image %d lacks XIP_PEER TLV", i)
+		}
+	}
+
+	if addrs[0] == addrs[1] {
+		return errors.Errorf(
+			"direct-XIP images share an address: 0x%08x", addrs[0])
+	}
+
+	if CompareVersions(a.Header.Vers, b.Header.Vers) != 0 {
+		return errors.Errorf(
+			"direct-XIP version mismatch: %s != %s",
+			a.Header.Vers.String(), b.Header.Vers.String())
+	}
+
+	if peers[0].PairId != peers[1].PairId {
+		return errors.Errorf(
+			"direct-XIP pair ID mismatch: %x != %x",
+			peers[0].PairId, peers[1].PairId)
+	}
+
+	for i, peer := range peers {
+		want := addrs[XIP_NUM_SLOTS-1-i]
+		if peer.PeerAddr != want {
+			return errors.Errorf(
+				"image %d names wrong peer: have=0x%08x want=0x%08x",
+				i, peer.PeerAddr, want)
+		}
+	}
+
+	return nil
+}
+
+// Verify checks that the pair's images belong together.
+func (p *XipPair) Verify() error {
+	return VerifyXipPair(p.Images[0], p.Images[1])
+}
+
+// XipPairFilenames returns the filenames that WriteFiles uses for the given
+// prefix: "<prefix>.slot0.img" and "<prefix>.slot1.img".
+func XipPairFilenames(prefix string) [XIP_NUM_SLOTS]string {
+	var names [XIP_NUM_SLOTS]string
+	for i, _ := range names {
+		names[i] = fmt.Sprintf("%s.slot%d.img", prefix, i)
+	}
+
+	return names
+}
+
+// WriteFiles writes each image of the pair to its own file (see
+// XipPairFilenames).
+func (p *XipPair) WriteFiles(prefix string) error {
+	for i, name := range XipPairFilenames(prefix) {
+		if err := p.Images[i].WriteToFile(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,458 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package index builds and parses the index document of a self-hosted
+// firmware repository.
+//
+// An index describes every artifact in a directory tree: its type, version,
+// hash, signing key IDs, size, and dependencies.  Devices and tooling fetch
+// the index to discover what the repository offers without downloading each
+// artifact.  An index can be refreshed incrementally as artifacts are added,
+// replaced, or removed, and can be signed so that clients can detect
+// tampering.
+package index
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/mfg"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const INDEX_FORMAT_VERSION = 1
+
+const (
+	ARTIFACT_TYPE_IMAGE = "image"
+	ARTIFACT_TYPE_MFG   = "mfg"
+)
+
+// Dependency is a requirement that an image places on another image.
+type Dependency struct {
+	ImageId    int    `json:"image_id"`
+	MinVersion string `json:"min_version"`
+}
+
+// Entry describes a single artifact in a repository.
+type Entry struct {
+	// Slash-separated path, relative to the repository root.
+	Path string `json:"path"`
+
+	Type    string `json:"type"`
+	Version string `json:"version"`
+
+	// Hex-encoded artifact hash (image hash or mfg hash).
+	Hash string `json:"hash"`
+
+	Size int64 `json:"size"`
+
+	// Modification time of the artifact file, in nanoseconds since the Unix
+	// epoch.  Used to detect changed files during an incremental update.
+	ModTime int64 `json:"mod_time"`
+
+	// Hex-encoded hashes of the keys that signed the artifact.
+	KeyIds []string `json:"key_ids,omitempty"`
+
+	Dependencies []Dependency `json:"dependencies,omitempty"`
+}
+
+// Signature is a signature over an index's canonical body.
+type Signature struct {
+	KeyHash string `json:"key_hash"` // Hex.
+	Sig     string `json:"sig"`      // Hex.
+}
+
+// Index describes the contents of an artifact repository.
+type Index struct {
+	Version int `json:"version"`
+
+	// Sorted by path.
+	Entries []Entry `json:"entries"`
+
+	Signature *Signature `json:"signature,omitempty"`
+}
+
+// mfgManifestPath returns the path of the mfg manifest that accompanies the
+// given mfgimage (e.g., "mfgimg.json" for "mfgimg.bin").
+func mfgManifestPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".json"
+}
+
+func imageEntry(data []byte) (Entry, error) {
+	img, err := image.ParseImage(data)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	deps, err := img.Dependencies()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{
+		Type:    ARTIFACT_TYPE_IMAGE,
+		Version: img.Header.Vers.String(),
+		Hash:    hex.EncodeToString(hash),
+	}
+	for _, sig := range sigs {
+		e.KeyIds = append(e.KeyIds, hex.EncodeToString(sig.KeyHash))
+	}
+	for _, dep := range deps {
+		e.Dependencies = append(e.Dependencies, Dependency{
+			ImageId:    int(dep.ImageId),
+			MinVersion: dep.MinVersion.String(),
+		})
+	}
+
+	return e, nil
+}
+
+// mfgEntry produces an entry for an mfgimage described by the given
+// manifest.  The mfgimage's hash must match the one recorded in the manifest.
+func mfgEntry(data []byte, man manifest.MfgManifest) (Entry, error) {
+	metaEndOff := -1
+	if man.Meta != nil {
+		metaEndOff = man.Meta.EndOffset
+	}
+
+	m, err := mfg.Parse(data, metaEndOff, man.EraseVal)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	hash, err := m.Hash(man.EraseVal)
+	if err != nil {
+		return Entry{}, err
+	}
+	if hex.EncodeToString(hash) != strings.ToLower(man.MfgHash) {
+		return Entry{}, errors.Errorf(
+			"mfgimage hash (%x) does not match manifest (%s)",
+			hash, man.MfgHash)
+	}
+
+	e := Entry{
+		Type:    ARTIFACT_TYPE_MFG,
+		Version: man.Version,
+		Hash:    hex.EncodeToString(hash),
+	}
+	for _, sig := range man.Signatures {
+		e.KeyIds = append(e.KeyIds, sig.Key)
+	}
+
+	return e, nil
+}
+
+// readEntry produces an entry for the file at the given path.  It returns
+// nil if the file is not a recognized artifact.  Images are recognized by
+// their magic number; mfgimages by an accompanying mfg manifest.
+func readEntry(path string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read artifact")
+	}
+
+	var e Entry
+	if _, ok := image.DetectEndianness(data); ok {
+		e, err = imageEntry(data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		manPath := mfgManifestPath(path)
+		if manPath == path {
+			return nil, nil
+		}
+
+		manData, err := ioutil.ReadFile(manPath)
+		if err != nil {
+			return nil, nil
+		}
+		man, err := manifest.ParseMfgManifest(manData)
+		if err != nil || man.MfgHash == "" {
+			return nil, nil
+		}
+
+		e, err = mfgEntry(data, man)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.Size = int64(len(data))
+	return &e, nil
+}
+
+// scan walks a repository and produces an entry for each artifact.  If old
+// contains an entry for a file whose size and modification time are
+// unchanged, that entry is reused rather than reading the file.
+func scan(dir string, old map[string]Entry) ([]Entry, error) {
+	var entries []Entry
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if e, ok := old[rel]; ok &&
+			e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+
+			entries = append(entries, e)
+			return nil
+		}
+
+		e, err := readEntry(path)
+		if err != nil {
+			return errors.Wrapf(err, "%s", rel)
+		}
+		if e == nil {
+			return nil
+		}
+
+		e.Path = rel
+		e.ModTime = info.ModTime().UnixNano()
+		entries = append(entries, *e)
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to scan repository")
+	}
+
+	sort.Slice(entries, func(i int, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+
+	return entries, nil
+}
+
+// Build produces an index describing every artifact beneath the given
+// directory.  Files that are not recognized artifacts are ignored.
+func Build(dir string) (Index, error) {
+	entries, err := scan(dir, nil)
+	if err != nil {
+		return Index{}, err
+	}
+
+	return Index{
+		Version: INDEX_FORMAT_VERSION,
+		Entries: entries,
+	}, nil
+}
+
+// Update produces an up to date version of an existing index.  Only new
+// files and files whose size or modification time has changed are read;
+// entries for deleted files are dropped.  The existing signature is retained
+// only if the entries are unchanged.
+func Update(idx Index, dir string) (Index, error) {
+	old := make(map[string]Entry, len(idx.Entries))
+	for _, e := range idx.Entries {
+		old[e.Path] = e
+	}
+
+	entries, err := scan(dir, old)
+	if err != nil {
+		return Index{}, err
+	}
+
+	nidx := Index{
+		Version: INDEX_FORMAT_VERSION,
+		Entries: entries,
+	}
+	if idx.Version == nidx.Version &&
+		reflect.DeepEqual(idx.Entries, nidx.Entries) {
+
+		nidx.Signature = idx.Signature
+	}
+
+	return nidx, nil
+}
+
+// Parse parses a JSON index document.
+func Parse(data []byte) (Index, error) {
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return idx, errors.Wrapf(err, "failed to parse index")
+	}
+
+	if idx.Version != INDEX_FORMAT_VERSION {
+		return idx, errors.Errorf(
+			"unsupported index format version: have=%d want=%d",
+			idx.Version, INDEX_FORMAT_VERSION)
+	}
+
+	return idx, nil
+}
+
+// Read reads and parses a JSON index document from a file.
+func Read(path string) (Index, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Index{}, errors.Wrapf(err, "failed to read index")
+	}
+
+	return Parse(data)
+}
+
+// Json serializes an index to JSON.
+func (idx *Index) Json() ([]byte, error) {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal index")
+	}
+
+	return b, nil
+}
+
+// Write writes an index to a file as JSON.
+func (idx *Index) Write(path string) error {
+	b, err := idx.Json()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write index")
+	}
+
+	return nil
+}
+
+// Find returns the entry with the given path, or nil if there is none.
+func (idx *Index) Find(path string) *Entry {
+	for i := range idx.Entries {
+		if idx.Entries[i].Path == path {
+			return &idx.Entries[i]
+		}
+	}
+
+	return nil
+}
+
+// Body returns the signed portion of an index: its compact JSON encoding
+// with the signature omitted.
+func (idx *Index) Body() ([]byte, error) {
+	c := *idx
+	c.Signature = nil
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to marshal index")
+	}
+
+	return b, nil
+}
+
+// Sign fills in an index's signature.
+func (idx *Index) Sign(signer sec.Signer) error {
+	body, err := idx.Body()
+	if err != nil {
+		return err
+	}
+
+	pub := signer.PubKey()
+	keyHash, err := pub.Hash()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+	sig, err := signer.Sign(hash[:])
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign index")
+	}
+
+	idx.Signature = &Signature{
+		KeyHash: hex.EncodeToString(keyHash),
+		Sig:     hex.EncodeToString(sig),
+	}
+
+	return nil
+}
+
+// Verify checks that an index is signed by one of the given keys.
+func (idx *Index) Verify(keys []sec.PubSignKey) error {
+	if idx.Signature == nil {
+		return errors.Errorf("index is not signed")
+	}
+
+	body, err := idx.Body()
+	if err != nil {
+		return err
+	}
+
+	keyHash, err := hex.DecodeString(idx.Signature.KeyHash)
+	if err != nil {
+		return errors.Errorf("index signature has invalid key hash")
+	}
+	sigData, err := hex.DecodeString(idx.Signature.Sig)
+	if err != nil {
+		return errors.Errorf("index signature is not valid hex")
+	}
+
+	hash := sha256.Sum256(body)
+	sigs := []sec.Sig{{KeyHash: keyHash, Data: sigData}}
+
+	for _, key := range keys {
+		i, err := sec.VerifySigs(key, sigs, hash[:])
+		if err != nil {
+			return err
+		}
+		if i != -1 {
+			return nil
+		}
+	}
+
+	return errors.Errorf("index not signed by a trusted key")
+}
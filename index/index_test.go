@@ -0,0 +1,219 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package index
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newKey(t *testing.T) sec.PrivSignKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sec.PrivSignKey{Ed25519: &priv}
+}
+
+func writeImage(t *testing.T, path string, ic *image.ImageCreator) {
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, bin, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func copyFile(t *testing.T, src string, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	signKey := newKey(t)
+
+	ic := image.NewImageCreator()
+	ic.Body = make([]byte, 256)
+	ic.Version = image.ImageVersion{Major: 1, Minor: 2}
+	ic.SigKeys = []sec.PrivSignKey{signKey}
+	writeImage(t, filepath.Join(dir, "app", "blinky.img"), &ic)
+
+	ic = image.NewImageCreator()
+	ic.Body = make([]byte, 128)
+	ic.Version = image.ImageVersion{Major: 2}
+	ic.Dependencies = []image.ImageDependency{{
+		ImageId:    1,
+		MinVersion: image.ImageVersion{Major: 1, Minor: 2},
+	}}
+	writeImage(t, filepath.Join(dir, "net.img"), &ic)
+
+	const mfgName = "hash1-fm1-ext1-tgts1-sign1"
+	const mfgHash = "aaf06a2d96aeaea196118dac3c1c1be86d386c4ca219cb7a69531444219f7139"
+	copyFile(t, filepath.Join("..", "mfg", "testdata", mfgName+".bin"),
+		filepath.Join(dir, "mfgimg.bin"))
+	copyFile(t, filepath.Join("..", "mfg", "testdata", mfgName+".json"),
+		filepath.Join(dir, "mfgimg.json"))
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"),
+		[]byte("not an artifact"), 0644); err != nil {
+
+		t.Fatal(err)
+	}
+
+	idx, err := Build(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Entries) != 3 {
+		t.Fatalf("wrong number of entries: have=%d want=3", len(idx.Entries))
+	}
+
+	blinky := idx.Find("app/blinky.img")
+	if blinky == nil {
+		t.Fatalf("missing image entry")
+	}
+	pub := signKey.PubKey()
+	keyHash, err := pub.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blinky.Type != ARTIFACT_TYPE_IMAGE || blinky.Version != "1.2.0.0" ||
+		len(blinky.KeyIds) != 1 || blinky.KeyIds[0] != hex.EncodeToString(keyHash) {
+
+		t.Fatalf("wrong image entry: %+v", *blinky)
+	}
+
+	net := idx.Find("net.img")
+	if net == nil || len(net.Dependencies) != 1 ||
+		net.Dependencies[0].MinVersion != "1.2.0.0" {
+
+		t.Fatalf("wrong dependency entry: %+v", net)
+	}
+
+	m := idx.Find("mfgimg.bin")
+	if m == nil || m.Type != ARTIFACT_TYPE_MFG || m.Version != "1.0.0.0" ||
+		m.Hash != mfgHash ||
+		len(m.KeyIds) != 1 {
+
+		t.Fatalf("wrong mfg entry: %+v", m)
+	}
+
+	// Signature survives a round trip.
+	indexKey := newKey(t)
+	if err := idx.Sign(&indexKey); err != nil {
+		t.Fatal(err)
+	}
+	b, err := idx.Json()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err = Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []sec.PubSignKey{indexKey.PubKey()}
+	if err := idx.Verify(keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Verify([]sec.PubSignKey{signKey.PubKey()}); err == nil {
+		t.Fatalf("index verified with untrusted key")
+	}
+
+	// No changes: entries and signature are retained.
+	nidx, err := Update(idx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nidx.Verify(keys); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries are reused when size and modification time are unchanged.
+	stale := idx
+	stale.Entries = append([]Entry(nil), idx.Entries...)
+	stale.Find("net.img").Version = "9.9.9.9"
+	nidx, err = Update(stale, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nidx.Find("net.img").Version != "9.9.9.9" {
+		t.Fatalf("unchanged file was rescanned")
+	}
+
+	// Replace one image and remove another.
+	ic = image.NewImageCreator()
+	ic.Body = make([]byte, 512)
+	ic.Version = image.ImageVersion{Major: 1, Minor: 3}
+	writeImage(t, filepath.Join(dir, "app", "blinky.img"), &ic)
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "app", "blinky.img"),
+		future, future); err != nil {
+
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "net.img")); err != nil {
+		t.Fatal(err)
+	}
+
+	nidx, err = Update(idx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nidx.Signature != nil {
+		t.Fatalf("signature retained after entries changed")
+	}
+	if len(nidx.Entries) != 2 || nidx.Find("net.img") != nil {
+		t.Fatalf("deleted file not dropped: %+v", nidx.Entries)
+	}
+	blinky = nidx.Find("app/blinky.img")
+	if blinky == nil || blinky.Version != "1.3.0.0" || len(blinky.KeyIds) != 0 {
+		t.Fatalf("changed file not rescanned: %+v", blinky)
+	}
+
+	// Unsupported format version.
+	if _, err := Parse([]byte(`{"version":2}`)); err == nil {
+		t.Fatalf("unsupported index version accepted")
+	}
+}
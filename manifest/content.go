@@ -0,0 +1,310 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Manifests normally refer to files by host paths, which are meaningless
+// once the artifacts move to another machine or into a storage backend.  A
+// manifest can instead be rewritten to refer to each file by a content
+// reference ("sha256:<hex digest>").  The manifest's content table maps each
+// reference back to the file's original path, and a ContentResolver locates
+// the file wherever it now lives.
+
+const CONTENT_REF_PREFIX = "sha256:"
+
+// ManifestContent is an entry in a manifest's content table.
+type ManifestContent struct {
+	Ref  string `json:"ref"`
+	Path string `json:"path"` // Original path, for information.
+	Size int64  `json:"size"`
+}
+
+// ContentResolver locates the local file with the given content reference.
+type ContentResolver interface {
+	Resolve(ref string) (string, error)
+}
+
+// IsContentRef indicates whether a manifest path field holds a content
+// reference rather than a path.
+func IsContentRef(s string) bool {
+	return strings.HasPrefix(s, CONTENT_REF_PREFIX)
+}
+
+// ParseContentRef extracts the hex-encoded SHA256 from a content reference.
+func ParseContentRef(ref string) (string, error) {
+	if !IsContentRef(ref) {
+		return "", errors.Errorf("not a content reference: \"%s\"", ref)
+	}
+
+	digest := strings.ToLower(strings.TrimPrefix(ref, CONTENT_REF_PREFIX))
+	b, err := hex.DecodeString(digest)
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.Errorf("invalid content reference: \"%s\"", ref)
+	}
+
+	return digest, nil
+}
+
+// CalcContentRef computes the content reference of a file.
+func CalcContentRef(path string) (ManifestContent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ManifestContent{}, errors.Wrapf(err,
+			"failed to read manifest file")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestContent{}, errors.Wrapf(err,
+			"failed to read manifest file")
+	}
+
+	return ManifestContent{
+		Ref:  CONTENT_REF_PREFIX + hex.EncodeToString(h.Sum(nil)),
+		Path: filepath.ToSlash(path),
+		Size: size,
+	}, nil
+}
+
+// contentAddress replaces each non-empty path in fields with its content
+// reference.  Relative paths are interpreted relative to base.  The updated
+// content table is returned.
+func contentAddress(fields []*string, table []ManifestContent,
+	base string) ([]ManifestContent, error) {
+
+	for _, field := range fields {
+		if *field == "" || IsContentRef(*field) {
+			continue
+		}
+
+		path := filepath.FromSlash(*field)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(base, path)
+		}
+
+		c, err := CalcContentRef(path)
+		if err != nil {
+			return table, err
+		}
+		c.Path = *field
+
+		if findContent(table, c.Ref) == nil {
+			table = append(table, c)
+		}
+		*field = c.Ref
+	}
+
+	return table, nil
+}
+
+func findContent(table []ManifestContent, ref string) *ManifestContent {
+	for i, _ := range table {
+		if table[i].Ref == ref {
+			return &table[i]
+		}
+	}
+
+	return nil
+}
+
+// resolvePaths replaces each content reference in fields with the local path
+// that r resolves it to.  If r is nil, the table's original paths are used,
+// provided the files there still match; relative paths are interpreted
+// relative to the working directory.
+func resolvePaths(fields []*string, table []ManifestContent,
+	r ContentResolver) error {
+
+	if r == nil {
+		r = tableResolver(table)
+	}
+
+	for _, field := range fields {
+		if !IsContentRef(*field) {
+			continue
+		}
+
+		path, err := r.Resolve(*field)
+		if err != nil {
+			return err
+		}
+		*field = path
+	}
+
+	return nil
+}
+
+// tableResolver resolves references to the original paths recorded in a
+// content table.
+type tableResolver []ManifestContent
+
+func (t tableResolver) Resolve(ref string) (string, error) {
+	c := findContent(t, ref)
+	if c == nil {
+		return "", errors.Errorf(
+			"content reference not in manifest's table: %s", ref)
+	}
+
+	have, err := CalcContentRef(filepath.FromSlash(c.Path))
+	if err != nil {
+		return "", err
+	}
+	if have.Ref != ref {
+		return "", errors.Errorf(
+			"file content has changed: %s", c.Path)
+	}
+
+	return filepath.FromSlash(c.Path), nil
+}
+
+// DirResolver resolves content references to files in a directory tree.  A
+// file named after its digest (as in a content-addressed store) is found
+// directly; otherwise, the tree is indexed by hashing every regular file.
+type DirResolver struct {
+	Dir string
+
+	index map[string]string
+}
+
+// NewDirResolver creates a resolver for the given directory.
+func NewDirResolver(dir string) *DirResolver {
+	return &DirResolver{Dir: dir}
+}
+
+func (r *DirResolver) buildIndex() error {
+	r.index = map[string]string{}
+
+	return filepath.Walk(r.Dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return errors.Wrapf(err, "failed to index directory")
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			c, err := CalcContentRef(path)
+			if err != nil {
+				return err
+			}
+			if _, ok := r.index[c.Ref]; !ok {
+				r.index[c.Ref] = path
+			}
+
+			return nil
+		})
+}
+
+func (r *DirResolver) Resolve(ref string) (string, error) {
+	digest, err := ParseContentRef(ref)
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(r.Dir, digest)
+	if c, err := CalcContentRef(path); err == nil && c.Ref == ref {
+		return path, nil
+	}
+
+	if r.index == nil {
+		if err := r.buildIndex(); err != nil {
+			r.index = nil
+			return "", err
+		}
+	}
+
+	path, ok := r.index[CONTENT_REF_PREFIX+digest]
+	if !ok {
+		return "", errors.Errorf(
+			"no file in \"%s\" matches %s", r.Dir, ref)
+	}
+
+	return path, nil
+}
+
+func (m *Manifest) pathFields() []*string {
+	return []*string{&m.Image, &m.Loader}
+}
+
+func (m *MfgManifest) pathFields() []*string {
+	fields := []*string{&m.BinPath, &m.HexPath}
+	for i, _ := range m.Targets {
+		t := &m.Targets[i]
+		fields = append(fields,
+			&t.BinPath, &t.ImagePath, &t.HexPath, &t.ManifestPath)
+	}
+	for i, _ := range m.Raws {
+		r := &m.Raws[i]
+		fields = append(fields, &r.Filename, &r.BinPath, &r.HexPath)
+	}
+
+	return fields
+}
+
+// ContentAddress rewrites the manifest's file paths (image and loader) to
+// content references and records them in the content table.  Relative paths
+// are interpreted relative to base.
+func (m *Manifest) ContentAddress(base string) error {
+	table, err := contentAddress(m.pathFields(), m.Content, base)
+	if err != nil {
+		return err
+	}
+
+	m.Content = table
+	return nil
+}
+
+// ResolvePaths rewrites the manifest's content references to local paths.
+// If r is nil, the original paths are used if the files there are unchanged.
+func (m *Manifest) ResolvePaths(r ContentResolver) error {
+	return resolvePaths(m.pathFields(), m.Content, r)
+}
+
+// ContentAddress rewrites the mfg manifest's file paths (the mfgimage and
+// each target's and raw section's files) to content references and records
+// them in the content table.  Relative paths are interpreted relative to
+// base.
+func (m *MfgManifest) ContentAddress(base string) error {
+	table, err := contentAddress(m.pathFields(), m.Content, base)
+	if err != nil {
+		return err
+	}
+
+	m.Content = table
+	return nil
+}
+
+// ResolvePaths rewrites the mfg manifest's content references to local
+// paths.  If r is nil, the original paths are used if the files there are
+// unchanged.
+func (m *MfgManifest) ResolvePaths(r ContentResolver) error {
+	return resolvePaths(m.pathFields(), m.Content, r)
+}
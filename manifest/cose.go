@@ -0,0 +1,68 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"encoding/json"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// The CoAP content format for application/json; identifies the payload of
+// a COSE-signed manifest.
+const COSE_CONTENT_TYPE_JSON = 50
+
+// SignCose produces a COSE_Sign1 message carrying the manifest as compact
+// JSON.  Devices with a COSE parser can authenticate it without a JSON
+// signature scheme.
+func (m *Manifest) SignCose(signer sec.Signer) ([]byte, error) {
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cannot encode manifest")
+	}
+
+	return sec.CoseSign1(payload, COSE_CONTENT_TYPE_JSON, signer)
+}
+
+// ParseCoseManifest verifies a COSE_Sign1-signed manifest against the given
+// keys and decodes its payload.  It returns the manifest and the index of
+// the key that signed it.
+func ParseCoseManifest(msg []byte, keys []sec.PubSignKey,
+	opts ParseOpts) (Manifest, int, error) {
+
+	cm, idx, err := sec.VerifyCoseSign1(msg, keys)
+	if err != nil {
+		return Manifest{}, -1, err
+	}
+
+	if cm.ContentType != 0 && cm.ContentType != COSE_CONTENT_TYPE_JSON {
+		return Manifest{}, -1, errors.Errorf(
+			"COSE payload is not a JSON manifest: content type %d",
+			cm.ContentType)
+	}
+
+	m, err := ParseManifestOpts(cm.Payload, opts)
+	if err != nil {
+		return m, -1, err
+	}
+
+	return m, idx, nil
+}
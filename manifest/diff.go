@@ -0,0 +1,173 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"sort"
+)
+
+// SyscfgChange describes a single syscfg setting that differs between two
+// manifests.  Old is empty for added settings; New is empty for removed
+// settings.
+type SyscfgChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// RepoChange describes a repo whose commit differs between two manifests.
+// OldCommit is empty for added repos; NewCommit is empty for removed repos.
+type RepoChange struct {
+	Name      string `json:"name"`
+	OldCommit string `json:"old_commit,omitempty"`
+	NewCommit string `json:"new_commit,omitempty"`
+}
+
+// ManifestDiff describes the differences between two manifests.
+type ManifestDiff struct {
+	OldVersion  string         `json:"old_version"`
+	NewVersion  string         `json:"new_version"`
+	Syscfg      []SyscfgChange `json:"syscfg,omitempty"`
+	PkgsAdded   []string       `json:"pkgs_added,omitempty"`
+	PkgsRemoved []string       `json:"pkgs_removed,omitempty"`
+	Repos       []RepoChange   `json:"repos,omitempty"`
+}
+
+// VersionChanged indicates whether the two manifests have different build
+// versions.
+func (d *ManifestDiff) VersionChanged() bool {
+	return d.OldVersion != d.NewVersion
+}
+
+// IsEmpty indicates whether the two manifests are equivalent in all the
+// aspects compared by Diff.
+func (d *ManifestDiff) IsEmpty() bool {
+	return !d.VersionChanged() &&
+		len(d.Syscfg) == 0 &&
+		len(d.PkgsAdded) == 0 &&
+		len(d.PkgsRemoved) == 0 &&
+		len(d.Repos) == 0
+}
+
+func pkgNameSet(pkgs []*ManifestPkg) map[string]struct{} {
+	m := make(map[string]struct{}, len(pkgs))
+	for _, p := range pkgs {
+		m[p.Name] = struct{}{}
+	}
+
+	return m
+}
+
+// setDiff returns the sorted names present in a but not in b.
+func setDiff(a map[string]struct{}, b map[string]struct{}) []string {
+	var names []string
+	for name, _ := range a {
+		if _, ok := b[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func diffSyscfg(a map[string]string, b map[string]string) []SyscfgChange {
+	var changes []SyscfgChange
+
+	for name, oldVal := range a {
+		newVal, ok := b[name]
+		if !ok || newVal != oldVal {
+			changes = append(changes, SyscfgChange{
+				Name: name,
+				Old:  oldVal,
+				New:  newVal,
+			})
+		}
+	}
+
+	for name, newVal := range b {
+		if _, ok := a[name]; !ok {
+			changes = append(changes, SyscfgChange{
+				Name: name,
+				New:  newVal,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes
+}
+
+func diffRepos(a []*ManifestRepo, b []*ManifestRepo) []RepoChange {
+	am := map[string]string{}
+	for _, r := range a {
+		am[r.Name] = r.Commit
+	}
+	bm := map[string]string{}
+	for _, r := range b {
+		bm[r.Name] = r.Commit
+	}
+
+	var changes []RepoChange
+	for name, oldCommit := range am {
+		newCommit, ok := bm[name]
+		if !ok || newCommit != oldCommit {
+			changes = append(changes, RepoChange{
+				Name:      name,
+				OldCommit: oldCommit,
+				NewCommit: newCommit,
+			})
+		}
+	}
+	for name, newCommit := range bm {
+		if _, ok := am[name]; !ok {
+			changes = append(changes, RepoChange{
+				Name:      name,
+				NewCommit: newCommit,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+
+	return changes
+}
+
+// Diff compares two manifests and reports the differences in build version,
+// syscfg settings, packages, and repo commits.  a is treated as the older
+// manifest.
+func Diff(a Manifest, b Manifest) ManifestDiff {
+	aPkgs := pkgNameSet(a.Pkgs)
+	bPkgs := pkgNameSet(b.Pkgs)
+
+	return ManifestDiff{
+		OldVersion:  a.Version,
+		NewVersion:  b.Version,
+		Syscfg:      diffSyscfg(a.Syscfg, b.Syscfg),
+		PkgsAdded:   setDiff(bPkgs, aPkgs),
+		PkgsRemoved: setDiff(aPkgs, bPkgs),
+		Repos:       diffRepos(a.Repos, b.Repos),
+	}
+}
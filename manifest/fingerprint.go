@@ -0,0 +1,144 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// fingerprintInput is the canonical form of a manifest's semantically
+// relevant content.  It omits timestamps, file paths, and values derived from
+// the build output bytes (hashes and sizes).
+type fingerprintInput struct {
+	Name       string            `json:"name"`
+	Version    string            `json:"build_version"`
+	Pkgs       []ManifestPkg     `json:"pkgs"`
+	LoaderPkgs []ManifestPkg     `json:"loader_pkgs"`
+	TgtVars    []string          `json:"target"`
+	Repos      []ManifestRepo    `json:"repos"`
+	Syscfg     map[string]string `json:"syscfg"`
+}
+
+func sortedPkgs(pkgs []*ManifestPkg) []ManifestPkg {
+	sorted := make([]ManifestPkg, len(pkgs))
+	for i, p := range pkgs {
+		sorted[i] = *p
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].Repo < sorted[j].Repo
+	})
+
+	return sorted
+}
+
+func sortedRepos(repos []*ManifestRepo) []ManifestRepo {
+	sorted := make([]ManifestRepo, len(repos))
+	for i, r := range repos {
+		sorted[i] = *r
+
+		// The URL is a property of the host, not of the build.
+		sorted[i].URL = ""
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+// CalcFingerprint computes a digest over the build-relevant content of a
+// manifest: target name and settings, version, packages, repo commits, and
+// syscfg.  Build time, file paths, and output hashes and sizes are excluded,
+// so two builds from identical inputs have the same fingerprint even if their
+// binaries differ byte-for-byte.  The result is a hex-encoded SHA256.
+func (m *Manifest) CalcFingerprint() (string, error) {
+	// Absent and empty lists and maps encode identically.
+	tgtVars := append([]string{}, m.TgtVars...)
+	sort.Strings(tgtVars)
+
+	syscfg := m.Syscfg
+	if syscfg == nil {
+		syscfg = map[string]string{}
+	}
+
+	in := fingerprintInput{
+		Name:       m.Name,
+		Version:    m.Version,
+		Pkgs:       sortedPkgs(m.Pkgs),
+		LoaderPkgs: sortedPkgs(m.LoaderPkgs),
+		TgtVars:    tgtVars,
+		Repos:      sortedRepos(m.Repos),
+		Syscfg:     syscfg,
+	}
+
+	// encoding/json emits map keys in sorted order, so the encoding is
+	// canonical.
+	b, err := json.Marshal(in)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode manifest fingerprint")
+	}
+
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// FillFingerprint calculates a manifest's fingerprint and stores it in the
+// manifest's `Fingerprint` field.
+func (m *Manifest) FillFingerprint() error {
+	fp, err := m.CalcFingerprint()
+	if err != nil {
+		return err
+	}
+
+	m.Fingerprint = fp
+	return nil
+}
+
+// VerifyFingerprint recalculates a manifest's fingerprint and compares it to
+// the stored value.  It returns an error if the manifest does not contain a
+// fingerprint or if the values differ.
+func (m *Manifest) VerifyFingerprint() error {
+	if m.Fingerprint == "" {
+		return errors.Errorf("manifest does not contain a fingerprint")
+	}
+
+	fp, err := m.CalcFingerprint()
+	if err != nil {
+		return err
+	}
+
+	if fp != m.Fingerprint {
+		return errors.Errorf(
+			"manifest fingerprint mismatch: have=%s want=%s",
+			m.Fingerprint, fp)
+	}
+
+	return nil
+}
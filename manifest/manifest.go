@@ -26,6 +26,7 @@ import (
 	"strings"
 
 	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
 )
 
 /*
@@ -63,6 +64,25 @@ type ManifestRepo struct {
 	URL    string `json:"url,omitempty"`
 }
 
+// ManifestSbom describes an image's software bill of materials.  The
+// document itself is optional; it may instead be distributed separately (e.g.,
+// in a release bundle).
+type ManifestSbom struct {
+	Format   string `json:"format"`
+	Sha256   string `json:"sha256"`
+	Document string `json:"document,omitempty"`
+}
+
+// ManifestFlashMap records the flash layout an image was built for.  Slot
+// names the flash area the image is written to.  TrailerSize is the number
+// of bytes at the end of the slot reserved for the boot loader's trailer.
+type ManifestFlashMap struct {
+	Areas       []flash.FlashArea   `json:"areas"`
+	Devices     []flash.FlashDevice `json:"devices,omitempty"`
+	Slot        string              `json:"slot"`
+	TrailerSize int                 `json:"trailer_size,omitempty"`
+}
+
 type Manifest struct {
 	Name       string            `json:"name"`
 	Date       string            `json:"build_time"`
@@ -80,20 +100,98 @@ type Manifest struct {
 
 	PkgSizes       []*ManifestSizePkg `json:"pkgsz"`
 	LoaderPkgSizes []*ManifestSizePkg `json:"loader_pkgsz,omitempty"`
+
+	// Digest of the manifest's build-relevant content; see CalcFingerprint.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Transparency log entries for the image's signatures (see package
+	// tlog).
+	TlogEntries []json.RawMessage `json:"tlog_entries,omitempty"`
+
+	// The software bill of materials bound to the image by its SBOM TLV.
+	Sbom *ManifestSbom `json:"sbom,omitempty"`
+
+	// The flash map used at build time.
+	FlashMap *ManifestFlashMap `json:"flash_map,omitempty"`
+
+	// Digests of the files the build produced.
+	Outputs []ManifestOutput `json:"outputs,omitempty"`
+
+	// Maps content references in path fields to the original paths; see
+	// ContentAddress.
+	Content []ManifestContent `json:"content,omitempty"`
+}
+
+// FlashMap converts a manifest flash map to a flash.FlashMap.
+func (fm *ManifestFlashMap) FlashMap() flash.FlashMap {
+	return flash.FlashMap{
+		Areas:   fm.Areas,
+		Devices: fm.Devices,
+	}
+}
+
+// SlotArea returns the flash area the image is written to.
+func (fm *ManifestFlashMap) SlotArea() (flash.FlashArea, error) {
+	for _, area := range fm.Areas {
+		if area.Name == fm.Slot {
+			return area, nil
+		}
+	}
+
+	return flash.FlashArea{}, errors.Errorf(
+		"manifest flash map does not contain slot \"%s\"", fm.Slot)
+}
+
+// Validate checks a manifest flash map for internal consistency.
+func (fm *ManifestFlashMap) Validate() error {
+	fmap := fm.FlashMap()
+	if err := fmap.Validate(); err != nil {
+		return err
+	}
+
+	slot, err := fm.SlotArea()
+	if err != nil {
+		return err
+	}
+
+	if fm.TrailerSize < 0 || fm.TrailerSize >= slot.Size {
+		return errors.Errorf(
+			"manifest trailer size invalid for slot \"%s\": "+
+				"trailer-size=%d slot-size=%d",
+			fm.Slot, fm.TrailerSize, slot.Size)
+	}
+
+	return nil
+}
+
+// MaxImageSize returns the largest image that fits in the slot, leaving
+// room for the trailer.
+func (fm *ManifestFlashMap) MaxImageSize() (int, error) {
+	if err := fm.Validate(); err != nil {
+		return 0, err
+	}
+
+	slot, _ := fm.SlotArea()
+	return slot.Size - fm.TrailerSize, nil
 }
 
 // ReadManifest reads a JSON manifest from a file.
 func ReadManifest(path string) (Manifest, error) {
-	m := Manifest{}
+	return ReadManifestOpts(path, ParseOpts{})
+}
 
+// ReadManifestOpts reads a JSON manifest from a file with the given parse
+// options.  A schema violation in strict mode is reported as a *SchemaError;
+// use errors.Cause to retrieve it.
+func ReadManifestOpts(path string, opts ParseOpts) (Manifest, error) {
 	content, err := ioutil.ReadFile(path)
 	if err != nil {
-		return m, errors.Wrapf(err, "failed to read manifest file")
+		return Manifest{}, errors.Wrapf(err, "failed to read manifest file")
 	}
 
-	if err := json.Unmarshal(content, &m); err != nil {
-		return m, errors.Wrapf(
-			err, "failure decoding manifest with path \"%s\"", path)
+	m, err := ParseManifestOpts(content, opts)
+	if err != nil {
+		return m, errors.Wrapf(err, "path=%s", path)
 	}
 
 	return m, nil
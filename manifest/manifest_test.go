@@ -0,0 +1,497 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testManifest() Manifest {
+	return Manifest{
+		Name:      "targets/blinky",
+		Date:      "2019-06-17T18:15:11-07:00",
+		Version:   "1.0.0.0",
+		Image:     "bin/targets/blinky/app/apps/blinky/blinky.img",
+		ImageHash: "8eb006d574ace63cce18a1f2d8f0f2645f1a0e86",
+		Pkgs: []*ManifestPkg{
+			{Name: "apps/blinky", Repo: "my_project"},
+			{Name: "@apache-mynewt-core/hw/hal", Repo: "apache-mynewt-core"},
+			{Name: "@apache-mynewt-core/kernel/os", Repo: "apache-mynewt-core"},
+		},
+		TgtVars: []string{
+			"target.app=apps/blinky",
+			"target.bsp=@apache-mynewt-core/hw/bsp/nordic_pca10040",
+		},
+		Repos: []*ManifestRepo{
+			{Name: "apache-mynewt-core", Commit: "1111111"},
+			{Name: "my_project", Commit: "2222222", Dirty: true},
+		},
+		Syscfg: map[string]string{
+			"OS_MAIN_STACK_SIZE": "1024",
+			"SHELL_TASK":         "1",
+		},
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := testManifest()
+
+	d := Diff(a, testManifest())
+	if !d.IsEmpty() || d.VersionChanged() {
+		t.Fatalf("identical manifests differ: %+v", d)
+	}
+
+	b := testManifest()
+	b.Version = "1.0.1.0"
+	b.Syscfg["OS_MAIN_STACK_SIZE"] = "2048"
+	delete(b.Syscfg, "SHELL_TASK")
+	b.Syscfg["LOG_LEVEL"] = "0"
+	b.Pkgs = append(b.Pkgs[1:],
+		&ManifestPkg{Name: "@apache-mynewt-core/sys/log", Repo: "core"},
+		&ManifestPkg{Name: "@apache-mynewt-core/sys/console", Repo: "core"})
+	b.Repos = []*ManifestRepo{
+		{Name: "apache-mynewt-core", Commit: "3333333"},
+		{Name: "mcuboot", Commit: "4444444"},
+	}
+
+	d = Diff(a, b)
+	if d.IsEmpty() || !d.VersionChanged() {
+		t.Fatalf("version change not detected: %+v", d)
+	}
+	if d.OldVersion != "1.0.0.0" || d.NewVersion != "1.0.1.0" {
+		t.Fatalf("wrong versions: old=%s new=%s", d.OldVersion, d.NewVersion)
+	}
+
+	wantSyscfg := []SyscfgChange{
+		{Name: "LOG_LEVEL", New: "0"},
+		{Name: "OS_MAIN_STACK_SIZE", Old: "1024", New: "2048"},
+		{Name: "SHELL_TASK", Old: "1"},
+	}
+	if !reflect.DeepEqual(d.Syscfg, wantSyscfg) {
+		t.Fatalf("wrong syscfg changes: have=%+v want=%+v",
+			d.Syscfg, wantSyscfg)
+	}
+
+	wantAdded := []string{
+		"@apache-mynewt-core/sys/console",
+		"@apache-mynewt-core/sys/log",
+	}
+	if !reflect.DeepEqual(d.PkgsAdded, wantAdded) {
+		t.Fatalf("wrong added packages: have=%v want=%v",
+			d.PkgsAdded, wantAdded)
+	}
+	if !reflect.DeepEqual(d.PkgsRemoved, []string{"apps/blinky"}) {
+		t.Fatalf("wrong removed packages: have=%v want=[apps/blinky]",
+			d.PkgsRemoved)
+	}
+
+	wantRepos := []RepoChange{
+		{Name: "apache-mynewt-core", OldCommit: "1111111",
+			NewCommit: "3333333"},
+		{Name: "mcuboot", NewCommit: "4444444"},
+		{Name: "my_project", OldCommit: "2222222"},
+	}
+	if !reflect.DeepEqual(d.Repos, wantRepos) {
+		t.Fatalf("wrong repo changes: have=%+v want=%+v",
+			d.Repos, wantRepos)
+	}
+
+	// Swapping the manifests swaps additions and removals.
+	r := Diff(b, a)
+	if !reflect.DeepEqual(r.PkgsAdded, d.PkgsRemoved) ||
+		!reflect.DeepEqual(r.PkgsRemoved, d.PkgsAdded) {
+
+		t.Fatalf("reverse diff not symmetric: %+v", r)
+	}
+
+	// A change other than the version makes the diff non-empty.
+	for i, mod := range []func(m *Manifest){
+		func(m *Manifest) { m.Syscfg["SHELL_TASK"] = "0" },
+		func(m *Manifest) { m.Syscfg = nil },
+		func(m *Manifest) { m.Pkgs = m.Pkgs[:1] },
+		func(m *Manifest) { m.Repos[0].Commit = "5555555" },
+		func(m *Manifest) { m.Repos = nil },
+	} {
+		m := testManifest()
+		mod(&m)
+
+		d := Diff(a, m)
+		if d.VersionChanged() {
+			t.Fatalf("case %d: version change reported", i)
+		}
+		if d.IsEmpty() {
+			t.Fatalf("case %d: change not detected", i)
+		}
+	}
+
+	// Fields that Diff does not compare.
+	m := testManifest()
+	m.Date = "2020-01-01T00:00:00Z"
+	m.ImageHash = "00"
+	m.Repos[1].URL = "https://example.com/my_project"
+	if d := Diff(a, m); !d.IsEmpty() {
+		t.Fatalf("uncompared fields reported: %+v", d)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	base := testManifest()
+	want, err := base.CalcFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes that do not affect the build's inputs.
+	for i, mod := range []func(m *Manifest){
+		func(m *Manifest) { m.Date = "2020-01-01T00:00:00Z" },
+		func(m *Manifest) { m.BuildID = "00" },
+		func(m *Manifest) { m.Image = "/tmp/other/blinky.img" },
+		func(m *Manifest) { m.ImageHash = "00" },
+		func(m *Manifest) { m.Loader, m.LoaderHash = "boot.img", "00" },
+		func(m *Manifest) {
+			m.PkgSizes = []*ManifestSizePkg{{Name: "apps/blinky"}}
+		},
+		func(m *Manifest) { m.Repos[0].URL = "https://example.com/core" },
+		func(m *Manifest) { m.Fingerprint = "00" },
+		func(m *Manifest) {
+			m.Outputs = []ManifestOutput{{Path: "blinky.img", Size: 1}}
+		},
+		func(m *Manifest) {
+			m.Content = []ManifestContent{{Ref: "sha256:00", Path: "x"}}
+		},
+		func(m *Manifest) {
+			m.Sbom = &ManifestSbom{Format: "spdx", Sha256: "00"}
+		},
+
+		// Order is not significant.
+		func(m *Manifest) {
+			m.Pkgs[0], m.Pkgs[2] = m.Pkgs[2], m.Pkgs[0]
+		},
+		func(m *Manifest) {
+			m.Repos[0], m.Repos[1] = m.Repos[1], m.Repos[0]
+		},
+		func(m *Manifest) {
+			m.TgtVars[0], m.TgtVars[1] = m.TgtVars[1], m.TgtVars[0]
+		},
+	} {
+		m := testManifest()
+		mod(&m)
+
+		have, err := m.CalcFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Fatalf("case %d: fingerprint changed", i)
+		}
+	}
+
+	// Changes to the build's inputs.
+	seen := map[string]int{want: -1}
+	for i, mod := range []func(m *Manifest){
+		func(m *Manifest) { m.Name = "targets/other" },
+		func(m *Manifest) { m.Version = "1.0.0.1" },
+		func(m *Manifest) { m.Pkgs = m.Pkgs[1:] },
+		func(m *Manifest) { m.Pkgs[0].Repo = "other" },
+		func(m *Manifest) {
+			m.LoaderPkgs = []*ManifestPkg{{Name: "boot/mynewt"}}
+		},
+		func(m *Manifest) { m.TgtVars = m.TgtVars[1:] },
+		func(m *Manifest) { m.Repos[0].Commit = "3333333" },
+		func(m *Manifest) { m.Repos[1].Dirty = false },
+		func(m *Manifest) { m.Repos = m.Repos[1:] },
+		func(m *Manifest) { m.Syscfg["SHELL_TASK"] = "0" },
+		func(m *Manifest) { m.Syscfg["LOG_LEVEL"] = "0" },
+		func(m *Manifest) { delete(m.Syscfg, "SHELL_TASK") },
+	} {
+		m := testManifest()
+		mod(&m)
+
+		have, err := m.CalcFingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prev, ok := seen[have]; ok {
+			t.Fatalf("case %d: fingerprint matches case %d", i, prev)
+		}
+		seen[have] = i
+	}
+
+	// Absent and empty fields are equivalent.
+	a := Manifest{Name: "targets/blinky"}
+	b := Manifest{
+		Name:    "targets/blinky",
+		Pkgs:    []*ManifestPkg{},
+		TgtVars: []string{},
+		Repos:   []*ManifestRepo{},
+		Syscfg:  map[string]string{},
+	}
+	fa, err := a.CalcFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := b.CalcFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fa != fb {
+		t.Fatalf("empty fields change fingerprint")
+	}
+
+	// Fill and verify.
+	m := testManifest()
+	if err := m.VerifyFingerprint(); err == nil {
+		t.Fatalf("missing fingerprint accepted")
+	}
+	if err := m.FillFingerprint(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Fingerprint != want {
+		t.Fatalf("wrong fingerprint: have=%s want=%s", m.Fingerprint, want)
+	}
+	m.Date = "2021-01-01T00:00:00Z"
+	if err := m.VerifyFingerprint(); err != nil {
+		t.Fatal(err)
+	}
+	m.Syscfg["SHELL_TASK"] = "0"
+	if err := m.VerifyFingerprint(); err == nil {
+		t.Fatalf("fingerprint mismatch not detected")
+	}
+}
+
+func writeTestFile(t *testing.T, path string, data string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "app", "blinky.img"), "image")
+	writeTestFile(t, filepath.Join(dir, "app", "blinky.elf"), "elf")
+	writeTestFile(t, filepath.Join(dir, "mfg.bin"), "mfgimage")
+
+	m := testManifest()
+	for _, path := range []string{"app/blinky.img", "app/blinky.elf"} {
+		if err := m.AddOutput(dir, path, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.AddOutput(dir, "mfg.bin",
+		MANIFEST_OUTPUT_TYPE_MFGIMG); err != nil {
+
+		t.Fatal(err)
+	}
+	if err := m.AddOutput(dir, "missing.img", ""); err == nil {
+		t.Fatalf("missing output recorded")
+	}
+
+	sum := sha256.Sum256([]byte("image"))
+	want := []ManifestOutput{
+		{
+			Path:   "app/blinky.img",
+			Type:   MANIFEST_OUTPUT_TYPE_IMG,
+			Size:   5,
+			Sha256: hex.EncodeToString(sum[:]),
+		},
+	}
+	if !reflect.DeepEqual(m.Outputs[:1], want) {
+		t.Fatalf("wrong output: have=%+v want=%+v", m.Outputs[0], want[0])
+	}
+	if m.Outputs[1].Type != MANIFEST_OUTPUT_TYPE_ELF ||
+		m.Outputs[2].Type != MANIFEST_OUTPUT_TYPE_MFGIMG {
+
+		t.Fatalf("wrong output types: %+v", m.Outputs)
+	}
+
+	if err := m.VerifyOutputs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-adding an output replaces its entry.
+	writeTestFile(t, filepath.Join(dir, "app", "blinky.img"), "image2")
+	if err := m.VerifyOutputs(dir); err == nil ||
+		!strings.Contains(err.Error(), "app/blinky.img: size mismatch") {
+
+		t.Fatalf("modified output not detected: %v", err)
+	}
+	if err := m.AddOutput(dir, "app/blinky.img", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Outputs) != 3 {
+		t.Fatalf("output duplicated: %+v", m.Outputs)
+	}
+	if err := m.VerifyOutputs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tampering that preserves the size; every problem is reported.
+	writeTestFile(t, filepath.Join(dir, "app", "blinky.elf"), "ELF")
+	if err := os.Remove(filepath.Join(dir, "mfg.bin")); err != nil {
+		t.Fatal(err)
+	}
+	err := m.VerifyOutputs(dir)
+	if err == nil {
+		t.Fatalf("tampered outputs not detected")
+	}
+	for _, problem := range []string{
+		"app/blinky.elf: digest mismatch",
+		"mfg.bin: missing",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Fatalf("problem not reported: %s: %s", problem, err.Error())
+		}
+	}
+	if strings.Contains(err.Error(), "blinky.img") {
+		t.Fatalf("unmodified output reported: %s", err.Error())
+	}
+
+	// The outputs survive a JSON round trip.
+	writeTestFile(t, filepath.Join(dir, "app", "blinky.elf"), "elf")
+	writeTestFile(t, filepath.Join(dir, "mfg.bin"), "mfgimage")
+	var sb strings.Builder
+	if _, err := m.Write(&sb); err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseManifest([]byte(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parsed.VerifyOutputs(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContentAddress(t *testing.T) {
+	dir := t.TempDir()
+	imgPath := filepath.Join(dir, "bin", "blinky.img")
+	writeTestFile(t, imgPath, "image")
+	writeTestFile(t, filepath.Join(dir, "bin", "boot.img"), "loader")
+
+	m := testManifest()
+	m.Image = imgPath
+	m.Loader = "bin/boot.img"
+	if err := m.ContentAddress(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256([]byte("image"))
+	imgRef := CONTENT_REF_PREFIX + hex.EncodeToString(sum[:])
+	sum = sha256.Sum256([]byte("loader"))
+	loaderRef := CONTENT_REF_PREFIX + hex.EncodeToString(sum[:])
+	imgDigest := imgRef[len(CONTENT_REF_PREFIX):]
+
+	if m.Image != imgRef || m.Loader != loaderRef {
+		t.Fatalf("wrong content references: image=%s loader=%s",
+			m.Image, m.Loader)
+	}
+	if len(m.Content) != 2 || m.Content[1].Path != "bin/boot.img" ||
+		m.Content[1].Size != 6 {
+
+		t.Fatalf("wrong content table: %+v", m.Content)
+	}
+
+	// Content addressing is idempotent.
+	if err := m.ContentAddress(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Content) != 2 {
+		t.Fatalf("content table grew: %+v", m.Content)
+	}
+
+	if _, err := ParseContentRef("sha256:1234"); err == nil {
+		t.Fatalf("short content reference accepted")
+	}
+	if _, err := ParseContentRef("md5:" + imgDigest); err == nil {
+		t.Fatalf("non-sha256 content reference accepted")
+	}
+
+	// Hit: a content-addressed store names files by digest.
+	store := t.TempDir()
+	writeTestFile(t, filepath.Join(store, imgDigest), "image")
+	writeTestFile(t, filepath.Join(store, "sub", "loader.bin"), "loader")
+
+	resolved := m
+	if err := resolved.ResolvePaths(NewDirResolver(store)); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Image != filepath.Join(store, imgDigest) {
+		t.Fatalf("wrong resolved image: %s", resolved.Image)
+	}
+
+	// Hit: other files are found by indexing the tree.
+	if resolved.Loader != filepath.Join(store, "sub", "loader.bin") {
+		t.Fatalf("wrong resolved loader: %s", resolved.Loader)
+	}
+
+	// Miss.
+	resolved = m
+	err := resolved.ResolvePaths(NewDirResolver(t.TempDir()))
+	if err == nil || !strings.Contains(err.Error(), "no file") {
+		t.Fatalf("unresolvable reference accepted: %v", err)
+	}
+
+	// Digest mismatch: a file named after the digest with other content.
+	bad := t.TempDir()
+	writeTestFile(t, filepath.Join(bad, imgDigest), "imagf")
+	resolved = m
+	if err := resolved.ResolvePaths(NewDirResolver(bad)); err == nil {
+		t.Fatalf("file with wrong digest resolved")
+	}
+
+	// Without a resolver, the table's original paths are used while the
+	// files there are unchanged.
+	resolved = m
+	if err := resolved.ResolvePaths(nil); err == nil {
+		t.Fatalf("relative loader path resolved from wrong directory")
+	}
+
+	m.Content[1].Path = filepath.Join(dir, "bin", "boot.img")
+	resolved = m
+	if err := resolved.ResolvePaths(nil); err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Image != imgPath {
+		t.Fatalf("wrong resolved image: %s", resolved.Image)
+	}
+
+	writeTestFile(t, imgPath, "imagf")
+	resolved = m
+	err = resolved.ResolvePaths(nil)
+	if err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("changed file resolved: %v", err)
+	}
+
+	resolved = m
+	resolved.Content = nil
+	if err := resolved.ResolvePaths(nil); err == nil {
+		t.Fatalf("reference missing from table resolved")
+	}
+}
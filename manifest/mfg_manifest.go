@@ -45,6 +45,7 @@ type MfgManifestRaw struct {
 	Offset   int                    `json:"offset"`
 	Size     int                    `json:"size"`
 	BinPath  string                 `json:"bin_path"`
+	HexPath  string                 `json:"hex_path,omitempty"`
 	Extra    map[string]interface{} `json:"extra,omitempty"`
 }
 
@@ -62,6 +63,20 @@ type MfgManifestMeta struct {
 	Mmrs      []MfgManifestMetaMmr `json:"mmrs,omitempty"`
 }
 
+// MfgManifestAreaPolicy indicates how the emitter treats a flash area.  Areas
+// without a policy are written normally.
+type MfgManifestAreaPolicy struct {
+	Area   string `json:"area"`
+	Policy string `json:"policy"` // "write", "erase", or "skip".
+}
+
+// MfgManifestAreaFill specifies the pattern the emitter writes to the unused
+// portion of a flash area, rather than leaving it erased.
+type MfgManifestAreaFill struct {
+	Area string `json:"area"`
+	Fill string `json:"fill"` // Hex; e.g., "00" or "deadbeef".
+}
+
 type MfgManifestSig struct {
 	Type string `json:"type"`
 	Key  string `json:"key"`
@@ -83,9 +98,13 @@ type MfgManifest struct {
 	FlashAreas []flash.FlashArea `json:"flash_map"`
 	FlashNames []string          `json:"flash_names",omitempty`
 
-	Targets []MfgManifestTarget `json:"targets"`
-	Raws    []MfgManifestRaw    `json:"raws"`
-	Meta    *MfgManifestMeta    `json:"meta,omitempty"`
+	Targets      []MfgManifestTarget     `json:"targets"`
+	Raws         []MfgManifestRaw        `json:"raws"`
+	Meta         *MfgManifestMeta        `json:"meta,omitempty"`
+	AreaPolicies []MfgManifestAreaPolicy `json:"area_policies,omitempty"`
+	AreaFills    []MfgManifestAreaFill   `json:"area_fills,omitempty"`
+	Outputs      []ManifestOutput        `json:"outputs,omitempty"`
+	Content      []ManifestContent       `json:"content,omitempty"`
 }
 
 // ReadMfgManifest reads a JSON mfg manifest from a byte slice and produces an
@@ -0,0 +1,181 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const (
+	MANIFEST_OUTPUT_TYPE_IMG    = "img"
+	MANIFEST_OUTPUT_TYPE_HEX    = "hex"
+	MANIFEST_OUTPUT_TYPE_ELF    = "elf"
+	MANIFEST_OUTPUT_TYPE_BIN    = "bin"
+	MANIFEST_OUTPUT_TYPE_MFGIMG = "mfgimg"
+)
+
+// ManifestOutput records the digest of a file produced by a build.  Together,
+// a manifest's outputs form a tamper-evident list of the build's products.
+type ManifestOutput struct {
+	// Slash-separated path, relative to the build directory.
+	Path string `json:"path"`
+
+	Type   string `json:"type"`
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// OutputTypeFromPath infers an output's type from its filename extension.
+// mfgimages use the ".bin" extension, so they must be identified by the
+// caller.
+func OutputTypeFromPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".img":
+		return MANIFEST_OUTPUT_TYPE_IMG
+	case ".hex":
+		return MANIFEST_OUTPUT_TYPE_HEX
+	case ".elf":
+		return MANIFEST_OUTPUT_TYPE_ELF
+	case ".bin":
+		return MANIFEST_OUTPUT_TYPE_BIN
+	default:
+		return ""
+	}
+}
+
+// CalcOutput computes the digest of a build output.  path is relative to
+// dir.  If typ is empty, the type is inferred from the filename.
+func CalcOutput(dir string, path string, typ string) (ManifestOutput, error) {
+	f, err := os.Open(filepath.Join(dir, filepath.FromSlash(path)))
+	if err != nil {
+		return ManifestOutput{}, errors.Wrapf(err,
+			"failed to read build output")
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return ManifestOutput{}, errors.Wrapf(err,
+			"failed to read build output")
+	}
+
+	if typ == "" {
+		typ = OutputTypeFromPath(path)
+	}
+
+	return ManifestOutput{
+		Path:   filepath.ToSlash(path),
+		Type:   typ,
+		Size:   size,
+		Sha256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// addOutput computes an output's digest and adds it to the given list,
+// replacing any existing entry with the same path.
+func addOutput(outputs []ManifestOutput, dir string, path string,
+	typ string) ([]ManifestOutput, error) {
+
+	out, err := CalcOutput(dir, path, typ)
+	if err != nil {
+		return outputs, err
+	}
+
+	for i := range outputs {
+		if outputs[i].Path == out.Path {
+			outputs[i] = out
+			return outputs, nil
+		}
+	}
+
+	return append(outputs, out), nil
+}
+
+// VerifyOutputs checks each of the given outputs against the corresponding
+// file in a build directory.  All outputs are checked; the returned error
+// describes every missing or modified file.
+func VerifyOutputs(dir string, outputs []ManifestOutput) error {
+	var problems []string
+
+	for _, want := range outputs {
+		have, err := CalcOutput(dir, want.Path, want.Type)
+		if err != nil {
+			problems = append(problems, want.Path+": missing")
+			continue
+		}
+
+		if have.Size != want.Size {
+			problems = append(problems, want.Path+": size mismatch")
+		} else if have.Sha256 != strings.ToLower(want.Sha256) {
+			problems = append(problems, want.Path+": digest mismatch")
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("build outputs differ from manifest: %s",
+			strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// AddOutput records the digest of a build output in a manifest.  path is
+// relative to dir; if typ is empty, it is inferred from the filename.
+func (m *Manifest) AddOutput(dir string, path string, typ string) error {
+	outputs, err := addOutput(m.Outputs, dir, path, typ)
+	if err != nil {
+		return err
+	}
+
+	m.Outputs = outputs
+	return nil
+}
+
+// VerifyOutputs checks a build directory against the outputs recorded in a
+// manifest.
+func (m *Manifest) VerifyOutputs(dir string) error {
+	return VerifyOutputs(dir, m.Outputs)
+}
+
+// AddOutput records the digest of a build output in an mfg manifest.  path
+// is relative to dir; if typ is empty, it is inferred from the filename.
+func (m *MfgManifest) AddOutput(dir string, path string, typ string) error {
+	outputs, err := addOutput(m.Outputs, dir, path, typ)
+	if err != nil {
+		return err
+	}
+
+	m.Outputs = outputs
+	return nil
+}
+
+// VerifyOutputs checks a build directory against the outputs recorded in an
+// mfg manifest.
+func (m *MfgManifest) VerifyOutputs(dir string) error {
+	return VerifyOutputs(dir, m.Outputs)
+}
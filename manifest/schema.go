@@ -0,0 +1,380 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The manifest JSON Schema is generated from the Manifest type: every field
+// without "omitempty" is required, unknown fields are rejected, unsigned
+// fields are range-checked, and sizes and offsets must be non-negative.
+
+const SCHEMA_DRAFT = "http://json-schema.org/draft-07/schema#"
+
+// Integer fields with these names may not be negative.
+var schemaNonNegativeFields = map[string]bool{
+	"count":        true,
+	"offset":       true,
+	"size":         true,
+	"trailer_size": true,
+}
+
+type jsonSchema struct {
+	Schema               string                 `json:"$schema,omitempty"`
+	Title                string                 `json:"title,omitempty"`
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties interface{}            `json:"additionalProperties,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+
+	types []string
+}
+
+func (s *jsonSchema) setTypes(types ...string) {
+	s.types = types
+	if len(types) == 1 {
+		s.Type = types[0]
+	} else {
+		s.Type = types
+	}
+}
+
+func (s *jsonSchema) setRange(min float64, max float64) {
+	s.Minimum = &min
+	s.Maximum = &max
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+func typeSchema(t reflect.Type, name string) *jsonSchema {
+	s := &jsonSchema{}
+
+	if t == rawMessageType {
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		s.setTypes("boolean")
+
+	case reflect.String:
+		s.setTypes("string")
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+
+		s.setTypes("integer")
+		if schemaNonNegativeFields[name] {
+			min := float64(0)
+			s.Minimum = &min
+		}
+
+	case reflect.Uint8:
+		s.setTypes("integer")
+		s.setRange(0, math.MaxUint8)
+
+	case reflect.Uint16:
+		s.setTypes("integer")
+		s.setRange(0, math.MaxUint16)
+
+	case reflect.Uint32:
+		s.setTypes("integer")
+		s.setRange(0, math.MaxUint32)
+
+	case reflect.Uint, reflect.Uint64:
+		s.setTypes("integer")
+		min := float64(0)
+		s.Minimum = &min
+
+	case reflect.Float32, reflect.Float64:
+		s.setTypes("number")
+
+	case reflect.Slice, reflect.Array:
+		s.setTypes("array", "null")
+		s.Items = typeSchema(t.Elem(), name)
+
+	case reflect.Map:
+		s.setTypes("object", "null")
+		s.AdditionalProperties = typeSchema(t.Elem(), "")
+
+	case reflect.Ptr:
+		s = typeSchema(t.Elem(), name)
+		if len(s.types) > 0 {
+			s.setTypes(append(s.types, "null")...)
+		}
+
+	case reflect.Struct:
+		s.setTypes("object")
+		s.Properties = map[string]*jsonSchema{}
+		s.AdditionalProperties = false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			fname := tag[0]
+			if fname == "-" {
+				continue
+			}
+			if fname == "" {
+				fname = f.Name
+			}
+
+			omitempty := false
+			for _, opt := range tag[1:] {
+				if opt == "omitempty" {
+					omitempty = true
+				}
+			}
+
+			s.Properties[fname] = typeSchema(f.Type, fname)
+			if !omitempty {
+				s.Required = append(s.Required, fname)
+			}
+		}
+	}
+
+	// Interfaces and other types accept any value.
+	return s
+}
+
+func manifestSchema() *jsonSchema {
+	s := typeSchema(reflect.TypeOf(Manifest{}), "")
+	s.Schema = SCHEMA_DRAFT
+	s.Title = "Mynewt image manifest"
+	return s
+}
+
+// ManifestSchema returns a JSON Schema (draft 07) describing the manifest
+// format.
+func ManifestSchema() ([]byte, error) {
+	buf, err := json.MarshalIndent(manifestSchema(), "", "  ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot encode manifest schema")
+	}
+
+	return buf, nil
+}
+
+// SchemaViolation is a single way in which a JSON document fails to conform
+// to a schema.
+type SchemaViolation struct {
+	Field string // e.g., "flash_map.areas[0].size"; "" for the document.
+	Msg   string
+}
+
+func (v SchemaViolation) String() string {
+	if v.Field == "" {
+		return v.Msg
+	}
+
+	return fmt.Sprintf("%s: %s", v.Field, v.Msg)
+}
+
+// SchemaError is returned by a strict parse of a document that does not
+// conform to its schema.
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+func (e *SchemaError) Error() string {
+	strs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		strs[i] = v.String()
+	}
+
+	return "manifest does not conform to schema: " + strings.Join(strs, "; ")
+}
+
+type schemaValidator struct {
+	violations []SchemaViolation
+}
+
+func (sv *schemaValidator) fail(field string, format string,
+	args ...interface{}) {
+
+	sv.violations = append(sv.violations, SchemaViolation{
+		Field: field,
+		Msg:   fmt.Sprintf(format, args...),
+	})
+}
+
+func jsonTypeOf(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := n.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+func schemaAllows(s *jsonSchema, typ string) bool {
+	for _, t := range s.types {
+		if t == typ || (t == "number" && typ == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinField(parent string, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func (sv *schemaValidator) validate(s *jsonSchema, v interface{},
+	field string) {
+
+	if len(s.types) == 0 {
+		return
+	}
+
+	typ := jsonTypeOf(v)
+	if !schemaAllows(s, typ) {
+		sv.fail(field, "wrong type: have=%s want=%s",
+			typ, strings.Join(s.types, "|"))
+		return
+	}
+
+	switch val := v.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			sv.fail(field, "value too small: have=%s min=%v",
+				val, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			sv.fail(field, "value too large: have=%s max=%v",
+				val, *s.Maximum)
+		}
+
+	case []interface{}:
+		for i, elem := range val {
+			sv.validate(s.Items, elem, fmt.Sprintf("%s[%d]", field, i))
+		}
+
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := val[name]; !ok {
+				sv.fail(joinField(field, name), "missing required field")
+			}
+		}
+
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			sub := joinField(field, name)
+			if ps := s.Properties[name]; ps != nil {
+				sv.validate(ps, val[name], sub)
+			} else if as, ok := s.AdditionalProperties.(*jsonSchema); ok {
+				sv.validate(as, val[name], sub)
+			} else if s.AdditionalProperties == false {
+				sv.fail(sub, "unknown field")
+			}
+		}
+	}
+}
+
+// ValidateManifestJson checks a JSON manifest against the manifest schema.
+// It returns every violation found.  An error is returned only if the text
+// is not JSON.
+func ValidateManifestJson(jsonText []byte) ([]SchemaViolation, error) {
+	dec := json.NewDecoder(bytes.NewReader(jsonText))
+	dec.UseNumber()
+
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, errors.Wrapf(err, "failure decoding manifest")
+	}
+
+	sv := schemaValidator{}
+	sv.validate(manifestSchema(), doc, "")
+
+	return sv.violations, nil
+}
+
+// ParseOpts controls how a manifest is parsed.
+type ParseOpts struct {
+	// If true, the manifest must conform to the manifest schema; missing,
+	// unknown, mistyped, and out-of-range fields are reported as a
+	// *SchemaError rather than silently decoded as zero values.
+	Strict bool
+}
+
+// ParseManifest reads a JSON manifest from a byte slice.
+func ParseManifest(jsonText []byte) (Manifest, error) {
+	return ParseManifestOpts(jsonText, ParseOpts{})
+}
+
+// ParseManifestOpts reads a JSON manifest from a byte slice with the given
+// options.
+func ParseManifestOpts(jsonText []byte, opts ParseOpts) (Manifest, error) {
+	m := Manifest{}
+
+	if opts.Strict {
+		violations, err := ValidateManifestJson(jsonText)
+		if err != nil {
+			return m, err
+		}
+		if len(violations) > 0 {
+			return m, &SchemaError{Violations: violations}
+		}
+	}
+
+	if err := json.Unmarshal(jsonText, &m); err != nil {
+		return m, errors.Wrapf(err, "failure decoding manifest")
+	}
+
+	return m, nil
+}
@@ -0,0 +1,303 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"encoding/hex"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// AreaPolicy indicates how the emitter treats a flash area.
+type AreaPolicy int
+
+const (
+	// Write the area's contents (default).
+	AREA_POLICY_WRITE AreaPolicy = iota
+
+	// Erase the area but do not write to it.
+	AREA_POLICY_ERASE
+
+	// Leave the area untouched; e.g., pre-provisioned secure storage.
+	AREA_POLICY_SKIP
+)
+
+var areaPolicyNameMap = map[AreaPolicy]string{
+	AREA_POLICY_WRITE: "write",
+	AREA_POLICY_ERASE: "erase",
+	AREA_POLICY_SKIP:  "skip",
+}
+
+// EmitSegment is a region of flash that the emitter produces.  Regions not
+// covered by any segment (i.e., "skip" areas) must not be touched.
+type EmitSegment struct {
+	Offset int
+	Size   int
+
+	// Contents to write.  Nil for erase-only segments.
+	Data []byte
+}
+
+func AreaPolicyString(policy AreaPolicy) string {
+	s := areaPolicyNameMap[policy]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func AreaPolicyFromString(s string) (AreaPolicy, error) {
+	for k, v := range areaPolicyNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown area policy name: \"%s\"", s)
+}
+
+// AreaPolicies extracts the per-area policies from an mfg manifest, keyed by
+// flash area name.
+func AreaPolicies(man manifest.MfgManifest) (map[string]AreaPolicy, error) {
+	policies := map[string]AreaPolicy{}
+
+	for _, ap := range man.AreaPolicies {
+		if man.FindFlashAreaName(ap.Area) == nil {
+			return nil, errors.Errorf(
+				"area policy references unknown flash area \"%s\"", ap.Area)
+		}
+		if _, dup := policies[ap.Area]; dup {
+			return nil, errors.Errorf(
+				"mfg manifest contains duplicate area policy: %s", ap.Area)
+		}
+
+		policy, err := AreaPolicyFromString(ap.Policy)
+		if err != nil {
+			return nil, err
+		}
+		policies[ap.Area] = policy
+	}
+
+	return policies, nil
+}
+
+// The longest supported fill pattern, in bytes.
+const MFG_FILL_PATTERN_MAX_LEN = 16
+
+// ParseFillPattern decodes a hex fill pattern; e.g., "00" or "deadbeef".
+func ParseFillPattern(s string) ([]byte, error) {
+	pattern, err := hex.DecodeString(s)
+	if err != nil || len(pattern) == 0 ||
+		len(pattern) > MFG_FILL_PATTERN_MAX_LEN {
+
+		return nil, errors.Errorf(
+			"invalid fill pattern: \"%s\" (want 1-%d hex bytes)",
+			s, MFG_FILL_PATTERN_MAX_LEN)
+	}
+
+	return pattern, nil
+}
+
+// AreaFills extracts the per-area fill patterns from an mfg manifest, keyed
+// by flash area name.
+func AreaFills(man manifest.MfgManifest) (map[string][]byte, error) {
+	fills := map[string][]byte{}
+
+	for _, af := range man.AreaFills {
+		if man.FindFlashAreaName(af.Area) == nil {
+			return nil, errors.Errorf(
+				"area fill references unknown flash area \"%s\"", af.Area)
+		}
+		if _, dup := fills[af.Area]; dup {
+			return nil, errors.Errorf(
+				"mfg manifest contains duplicate area fill: %s", af.Area)
+		}
+
+		pattern, err := ParseFillPattern(af.Fill)
+		if err != nil {
+			return nil, err
+		}
+		fills[af.Area] = pattern
+	}
+
+	return fills, nil
+}
+
+// fillPattern writes a repeating pattern to b.  The pattern is aligned to
+// the start of the area, which begins areaOff bytes before b.
+func fillPattern(b []byte, pattern []byte, areaOff int) {
+	for i := range b {
+		b[i] = pattern[(areaOff+i)%len(pattern)]
+	}
+}
+
+func isErased(b []byte, eraseVal byte) bool {
+	for _, c := range b {
+		if c != eraseVal {
+			return false
+		}
+	}
+
+	return true
+}
+
+// EmitOpts controls how an mfgimage is split into segments.
+type EmitOpts struct {
+	// Per-area policies, keyed by flash area name.  Areas without a policy
+	// are written.
+	Policies map[string]AreaPolicy
+
+	// Per-area fill patterns, keyed by flash area name.  The unused end of
+	// a "write" area, or the whole of an "erase" area, is written with the
+	// pattern rather than left erased.  Fill is applied when emitting and
+	// is not covered by the mfgimage hash.
+	Fills map[string][]byte
+
+	EraseVal byte
+}
+
+// Emit splits a serialized mfgimage into the segments that are to be
+// programmed onto the specified device.  Areas with an "erase" policy are
+// emitted as erase-only segments; areas with a "skip" policy are omitted
+// entirely.  It is an error for the mfgimage to contain data in either kind
+// of area.
+func (m *Mfg) Emit(areas []flash.FlashArea, device int,
+	policies map[string]AreaPolicy, eraseVal byte) ([]EmitSegment, error) {
+
+	return m.EmitOpts(areas, device, EmitOpts{
+		Policies: policies,
+		EraseVal: eraseVal,
+	})
+}
+
+// EmitOpts splits a serialized mfgimage into segments according to the
+// given options.  See Emit().
+func (m *Mfg) EmitOpts(areas []flash.FlashArea, device int,
+	opts EmitOpts) ([]EmitSegment, error) {
+
+	policies := opts.Policies
+	eraseVal := opts.EraseVal
+
+	bin, err := m.Bytes(eraseVal)
+	if err != nil {
+		return nil, err
+	}
+
+	var special []flash.FlashArea
+	for _, area := range areas {
+		if area.Device != device {
+			continue
+		}
+
+		pattern := opts.Fills[area.Name]
+		switch policies[area.Name] {
+		case AREA_POLICY_WRITE:
+			if pattern != nil {
+				bin = fillArea(bin, area, pattern, eraseVal)
+			}
+		case AREA_POLICY_SKIP:
+			if pattern != nil {
+				return nil, errors.Errorf(
+					"fill specified for skipped flash area \"%s\"",
+					area.Name)
+			}
+			special = append(special, area)
+		default:
+			special = append(special, area)
+		}
+	}
+	special = flash.SortFlashAreasByDevOff(special)
+
+	var segs []EmitSegment
+	emitData := func(start int, end int) {
+		if end > len(bin) {
+			end = len(bin)
+		}
+		if start < end {
+			segs = append(segs, EmitSegment{
+				Offset: start,
+				Size:   end - start,
+				Data:   bin[start:end],
+			})
+		}
+	}
+
+	cur := 0
+	for _, area := range special {
+		start := area.Offset
+		end := area.Offset + area.Size
+		if start < cur {
+			return nil, errors.Errorf(
+				"flash area \"%s\" overlaps another area", area.Name)
+		}
+
+		emitData(cur, start)
+
+		if start < len(bin) {
+			dataEnd := end
+			if dataEnd > len(bin) {
+				dataEnd = len(bin)
+			}
+			if !isErased(bin[start:dataEnd], eraseVal) {
+				return nil, errors.Errorf(
+					"mfgimage contains data in flash area \"%s\" "+
+						"(policy=%s)", area.Name,
+					AreaPolicyString(policies[area.Name]))
+			}
+		}
+
+		if policies[area.Name] == AREA_POLICY_ERASE {
+			seg := EmitSegment{
+				Offset: start,
+				Size:   area.Size,
+			}
+			if pattern := opts.Fills[area.Name]; pattern != nil {
+				seg.Data = make([]byte, area.Size)
+				fillPattern(seg.Data, pattern, 0)
+			}
+			segs = append(segs, seg)
+		}
+
+		cur = end
+	}
+	emitData(cur, len(bin))
+
+	return segs, nil
+}
+
+// fillArea writes a fill pattern over the unused end of a flash area; i.e.,
+// everything following the last byte that differs from the erase value.
+// The mfgimage is extended to the end of the area if necessary.
+func fillArea(bin []byte, area flash.FlashArea, pattern []byte,
+	eraseVal byte) []byte {
+
+	end := area.Offset + area.Size
+	if end > len(bin) {
+		bin = AddPadding(bin, eraseVal, end-len(bin))
+	}
+
+	used := len(StripPadding(bin[area.Offset:end], eraseVal))
+	fillPattern(bin[area.Offset+used:end], pattern, used)
+
+	return bin
+}
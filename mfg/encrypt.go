@@ -0,0 +1,313 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// EncAreas returns the bodies of an mfgimage's ENC_AREA TLVs, in MMR order.
+// It returns nil if the mfgimage has no MMR.
+func (m *Mfg) EncAreas() ([]MetaTlvBodyEncArea, error) {
+	if m.Meta == nil {
+		return nil, nil
+	}
+
+	var bodies []MetaTlvBodyEncArea
+	for _, tlv := range m.Meta.FindTlvs(META_TLV_TYPE_ENC_AREA) {
+		body, err := tlv.StructuredBody()
+		if err != nil {
+			return nil, err
+		}
+		bodies = append(bodies, *body.(*MetaTlvBodyEncArea))
+	}
+
+	return bodies, nil
+}
+
+func provisioningCipher(key sec.PubEncKey) (cipher.Block, error) {
+	if key.Aes == nil {
+		return nil, errors.Errorf("provisioning key must be an AES key")
+	}
+
+	return key.Aes, nil
+}
+
+// encAreaMacKey derives the key for ENC_AREA plaintext MACs from the
+// provisioning key by encrypting two fixed blocks, so that the MAC key is
+// never the encryption key itself.
+func encAreaMacKey(block cipher.Block) []byte {
+	key := make([]byte, 2*block.BlockSize())
+	for i := 0; i < 2; i++ {
+		in := make([]byte, block.BlockSize())
+		copy(in, "mfg-enc-area-mac")
+		in[len(in)-1] = byte(i)
+		block.Encrypt(key[i*len(in):], in)
+	}
+
+	return key
+}
+
+// encAreaMac computes the HMAC-SHA256 of an area's plaintext.  An unkeyed
+// hash would let anyone with the mfgimage brute-force a short secret in an
+// otherwise erased area.  The MAC also covers the area ID, size, and nonce.
+func encAreaMac(block cipher.Block, body MetaTlvBodyEncArea,
+	plain []byte) [META_HASH_SZ]byte {
+
+	mac := hmac.New(sha256.New, encAreaMacKey(block))
+	mac.Write([]byte{body.Area})
+	binary.Write(mac, binary.LittleEndian, body.Size)
+	mac.Write(body.Nonce[:])
+	mac.Write(plain)
+
+	var sum [META_HASH_SZ]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// xorArea applies AES-CTR to a region in place.  Encryption and decryption
+// are the same operation.
+func xorArea(block cipher.Block, nonce []byte, data []byte) {
+	cipher.NewCTR(block, nonce).XORKeyStream(data, data)
+}
+
+// EncryptArea encrypts the contents of one flash area of an mfgimage with a
+// provisioning key (AES-CTR) and records the area's nonce and a keyed MAC
+// of the plaintext in a new ENC_AREA TLV.  The MMR grows toward the start of the boot
+// loader area to make room for the TLV, its version is raised to at least
+// the one that introduced ENC_AREA, and its hash is recalculated.  Each area
+// gets a random nonce.  The area may not contain the MMR.
+func EncryptArea(m Mfg, area flash.FlashArea, key sec.PubEncKey,
+	eraseVal byte) (Mfg, error) {
+
+	block, err := provisioningCipher(key)
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	if m.Meta == nil {
+		return Mfg{}, errors.Errorf("mfgimage has no mmr")
+	}
+	if area.Id < 0 || area.Id > 0xff {
+		return Mfg{}, errors.Errorf(
+			"flash area \"%s\" has invalid id: %d", area.Name, area.Id)
+	}
+
+	encs, err := m.EncAreas()
+	if err != nil {
+		return Mfg{}, err
+	}
+	for _, enc := range encs {
+		if int(enc.Area) == area.Id {
+			return Mfg{}, errors.Errorf(
+				"flash area \"%s\" already encrypted", area.Name)
+		}
+	}
+
+	tlvSz := META_TLV_HEADER_SZ + META_TLV_ENC_AREA_SZ
+	metaEnd := m.MetaOff + int(m.Meta.Footer.Size)
+	metaOff := m.MetaOff - tlvSz
+	areaEnd := area.Offset + area.Size
+	if area.Offset < metaEnd && metaOff < areaEnd {
+		return Mfg{}, errors.Errorf(
+			"flash area \"%s\" overlaps the mmr", area.Name)
+	}
+
+	// The MMR's new TLV must land in erased space.
+	if metaOff < 0 {
+		return Mfg{}, errors.Errorf("no room to extend mmr")
+	}
+	for i := metaOff; i < m.MetaOff && i < len(m.Bin); i++ {
+		if m.Bin[i] != eraseVal {
+			return Mfg{}, errors.Errorf(
+				"no room to extend mmr; offset %d in use", i)
+		}
+	}
+
+	if area.Offset >= len(m.Bin) {
+		return Mfg{}, errors.Errorf(
+			"flash area \"%s\" is beyond end of mfgimage "+
+				"(offset=%d mfgimg_len=%d)",
+			area.Name, area.Offset, len(m.Bin))
+	}
+	end := areaEnd
+	if end > len(m.Bin) {
+		end = len(m.Bin)
+	}
+
+	body := MetaTlvBodyEncArea{
+		Area: uint8(area.Id),
+		Size: uint32(end - area.Offset),
+	}
+	if _, err := rand.Read(body.Nonce[:]); err != nil {
+		return Mfg{}, errors.Wrapf(err, "failed to generate nonce")
+	}
+
+	dup := m.Clone()
+
+	region := dup.Bin[area.Offset:end]
+	body.PlainMac = encAreaMac(block, body, region)
+	xorArea(block, body.Nonce[:], region)
+
+	b := &bytes.Buffer{}
+	if err := writeElem(body, b); err != nil {
+		return Mfg{}, err
+	}
+	dup.Meta.Tlvs = append(dup.Meta.Tlvs, MetaTlv{
+		Header: MetaTlvHeader{
+			Type: META_TLV_TYPE_ENC_AREA,
+			Size: META_TLV_ENC_AREA_SZ,
+		},
+		Data: b.Bytes(),
+	})
+	dup.Meta.Footer.Size += uint16(tlvSz)
+	encVer := MetaTlvTypeVersion(META_TLV_TYPE_ENC_AREA)
+	if dup.Meta.Footer.Version < encVer {
+		dup.Meta.Footer.Version = encVer
+	}
+	dup.MetaOff = metaOff
+
+	if err := dup.RefillHash(eraseVal); err != nil {
+		return Mfg{}, err
+	}
+
+	return dup, nil
+}
+
+func findAreaId(areas []flash.FlashArea, id int) *flash.FlashArea {
+	for i, _ := range areas {
+		if areas[i].Id == id {
+			return &areas[i]
+		}
+	}
+
+	return nil
+}
+
+// DecryptAreas decrypts each flash area listed in an mfgimage's ENC_AREA
+// TLVs and verifies the plaintext against the recorded MAC.  The returned
+// mfgimage's MMR still describes the encrypted image, so it is suitable for
+// inspection rather than for programming.
+func DecryptAreas(m Mfg, areas []flash.FlashArea,
+	key sec.PubEncKey) (Mfg, error) {
+
+	block, err := provisioningCipher(key)
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	encs, err := m.EncAreas()
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	dup := m.Clone()
+	for _, enc := range encs {
+		area := findAreaId(areas, int(enc.Area))
+		if area == nil {
+			return Mfg{}, errors.Errorf(
+				"encrypted area %d not in flash map", enc.Area)
+		}
+
+		end := area.Offset + int(enc.Size)
+		if int(enc.Size) > area.Size || end > len(dup.Bin) {
+			return Mfg{}, errors.Errorf(
+				"encrypted area \"%s\" extends beyond its bounds: "+
+					"size=%d area-size=%d mfgimg_len=%d",
+				area.Name, enc.Size, area.Size, len(dup.Bin))
+		}
+
+		region := dup.Bin[area.Offset:end]
+		xorArea(block, enc.Nonce[:], region)
+
+		mac := encAreaMac(block, enc, region)
+		if !hmac.Equal(mac[:], enc.PlainMac[:]) {
+			return Mfg{}, errors.Errorf(
+				"plaintext mac mismatch in flash area \"%s\"", area.Name)
+		}
+	}
+
+	return dup, nil
+}
+
+// VerifyEncAreas checks that each of an mfgimage's encrypted flash areas
+// decrypts to plaintext matching its recorded MAC.
+func (m *Mfg) VerifyEncAreas(areas []flash.FlashArea,
+	key sec.PubEncKey) error {
+
+	_, err := DecryptAreas(*m, areas, key)
+	return err
+}
+
+// verifyMetaEncAreas checks the ENC_AREA TLVs without the provisioning key:
+// each must name a distinct flash area that fits in the mfgimage, does not
+// hold the MMR, and uses its own nonce.
+func (m *Mfg) verifyMetaEncAreas(areas []flash.FlashArea) (string, error) {
+	encs, err := m.EncAreas()
+	if err != nil {
+		return "", err
+	}
+
+	seen := map[int]struct{}{}
+	nonces := map[[META_ENC_NONCE_SZ]byte]struct{}{}
+	metaEnd := m.MetaOff + int(m.Meta.Footer.Size)
+	for _, enc := range encs {
+		if _, dup := seen[int(enc.Area)]; dup {
+			return "", errors.Errorf("encrypted area %d listed twice",
+				enc.Area)
+		}
+		seen[int(enc.Area)] = struct{}{}
+
+		if _, dup := nonces[enc.Nonce]; dup {
+			return "", errors.Errorf("encrypted area %d reuses a nonce",
+				enc.Area)
+		}
+		nonces[enc.Nonce] = struct{}{}
+
+		area := findAreaId(areas, int(enc.Area))
+		if area == nil {
+			return "", errors.Errorf("encrypted area %d not in flash map",
+				enc.Area)
+		}
+
+		end := area.Offset + int(enc.Size)
+		if int(enc.Size) > area.Size || end > len(m.Bin) {
+			return "", errors.Errorf(
+				"encrypted area \"%s\" extends beyond its bounds",
+				area.Name)
+		}
+		if area.Offset < metaEnd && m.MetaOff < end {
+			return "", errors.Errorf(
+				"encrypted area \"%s\" overlaps the mmr", area.Name)
+		}
+	}
+
+	return fmt.Sprintf("%d encrypted areas valid", len(seen)), nil
+}
@@ -0,0 +1,265 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+)
+
+// Intel HEX record types.
+const (
+	IHEX_REC_DATA         = 0x00
+	IHEX_REC_EOF          = 0x01
+	IHEX_REC_EXT_SEG_ADDR = 0x02
+	IHEX_REC_START_SEG    = 0x03
+	IHEX_REC_EXT_LIN_ADDR = 0x04
+	IHEX_REC_START_LINEAR = 0x05
+)
+
+// HexSegment is a contiguous run of data read from an Intel HEX file.
+type HexSegment struct {
+	Addr int
+	Data []byte
+}
+
+// RawEntry is a flat binary written at a fixed offset in an mfgimage.
+type RawEntry struct {
+	// Name of the flash area containing the entry.
+	Area string
+
+	// Offset within the flash device.
+	Offset int
+
+	Data []byte
+}
+
+func parseIhexRecord(line string, lineNum int) (uint8, uint16, []byte, error) {
+	if !strings.HasPrefix(line, ":") {
+		return 0, 0, nil, errors.Errorf(
+			"intel hex line %d: missing start code", lineNum)
+	}
+
+	rec, err := hex.DecodeString(line[1:])
+	if err != nil {
+		return 0, 0, nil, errors.Wrapf(err, "intel hex line %d", lineNum)
+	}
+
+	if len(rec) < 5 || len(rec) != 5+int(rec[0]) {
+		return 0, 0, nil, errors.Errorf(
+			"intel hex line %d: invalid record length", lineNum)
+	}
+
+	var sum uint8
+	for _, b := range rec {
+		sum += b
+	}
+	if sum != 0 {
+		return 0, 0, nil, errors.Errorf(
+			"intel hex line %d: checksum mismatch", lineNum)
+	}
+
+	addr := uint16(rec[1])<<8 | uint16(rec[2])
+	return rec[3], addr, rec[4 : len(rec)-1], nil
+}
+
+// ParseIntelHex parses the contents of an Intel HEX file.  Adjacent data
+// records are merged into a single segment.  Segments are returned in file
+// order.
+func ParseIntelHex(data []byte) ([]HexSegment, error) {
+	var segs []HexSegment
+	base := 0
+	eof := false
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if eof {
+			return nil, errors.Errorf(
+				"intel hex line %d: data following EOF record", lineNum)
+		}
+
+		typ, addr, body, err := parseIhexRecord(line, lineNum)
+		if err != nil {
+			return nil, err
+		}
+
+		switch typ {
+		case IHEX_REC_DATA:
+			abs := base + int(addr)
+			n := len(segs)
+			if n > 0 && segs[n-1].Addr+len(segs[n-1].Data) == abs {
+				segs[n-1].Data = append(segs[n-1].Data, body...)
+			} else {
+				segs = append(segs, HexSegment{
+					Addr: abs,
+					Data: append([]byte(nil), body...),
+				})
+			}
+
+		case IHEX_REC_EOF:
+			eof = true
+
+		case IHEX_REC_EXT_SEG_ADDR, IHEX_REC_EXT_LIN_ADDR:
+			if len(body) != 2 {
+				return nil, errors.Errorf(
+					"intel hex line %d: invalid address record", lineNum)
+			}
+			base = int(body[0])<<8 | int(body[1])
+			if typ == IHEX_REC_EXT_SEG_ADDR {
+				base <<= 4
+			} else {
+				base <<= 16
+			}
+
+		case IHEX_REC_START_SEG, IHEX_REC_START_LINEAR:
+			// Entry point; irrelevant to flash contents.
+
+		default:
+			return nil, errors.Errorf(
+				"intel hex line %d: unknown record type 0x%02x", lineNum, typ)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read intel hex data")
+	}
+
+	if !eof {
+		return nil, errors.Errorf("intel hex data lacks EOF record")
+	}
+
+	return segs, nil
+}
+
+// ReadIntelHex reads and parses an Intel HEX file.
+func ReadIntelHex(filename string) ([]HexSegment, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read intel hex file")
+	}
+
+	segs, err := ParseIntelHex(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "file=%s", filename)
+	}
+
+	return segs, nil
+}
+
+// RawEntriesFromHex converts a set of hex segments into raw mfgimage entries.
+// Hex addresses are absolute; flashBase is the address at which the flash
+// device is mapped.  Each segment must lie entirely within one of the
+// device's flash areas.
+func RawEntriesFromHex(segs []HexSegment, areas []flash.FlashArea,
+	device int, flashBase int) ([]RawEntry, error) {
+
+	var entries []RawEntry
+
+	for _, seg := range segs {
+		off := seg.Addr - flashBase
+		end := off + len(seg.Data)
+
+		var area *flash.FlashArea
+		for i := range areas {
+			fa := &areas[i]
+			if fa.Device == device &&
+				off >= fa.Offset && end <= fa.Offset+fa.Size {
+
+				area = fa
+				break
+			}
+		}
+		if area == nil {
+			return nil, errors.Errorf(
+				"hex segment 0x%x-0x%x not contained by any flash area "+
+					"on device %d", seg.Addr, seg.Addr+len(seg.Data), device)
+		}
+
+		entries = append(entries, RawEntry{
+			Area:   area.Name,
+			Offset: off,
+			Data:   seg.Data,
+		})
+	}
+
+	return entries, nil
+}
+
+// InsertRawOpts controls how a raw entry is written into an mfgimage.
+type InsertRawOpts struct {
+	// If non-nil, the entry's Offset is relative to the start of the flash
+	// area named by its Area field, and the entry must fit in that area.
+	FlashMap *flash.FlashMap
+
+	EraseVal byte
+}
+
+// InsertRaw writes a raw entry into an mfgimage, extending the image with
+// erase-value padding if necessary.
+func (m *Mfg) InsertRaw(entry RawEntry, eraseVal byte) error {
+	if m.Meta != nil {
+		if entry.Offset < m.MetaOff+int(m.Meta.Footer.Size) &&
+			entry.Offset+len(entry.Data) > m.MetaOff {
+
+			return errors.Errorf(
+				"raw entry at offset %d overlaps MMR", entry.Offset)
+		}
+	}
+
+	padLen := entry.Offset + len(entry.Data) - len(m.Bin)
+	if padLen > 0 {
+		m.Bin = AddPadding(m.Bin, eraseVal, padLen)
+	}
+
+	copy(m.Bin[entry.Offset:], entry.Data)
+
+	return nil
+}
+
+// InsertRawOpts writes a raw entry into an mfgimage according to the given
+// options.  See InsertRaw().
+func (m *Mfg) InsertRawOpts(entry RawEntry, opts InsertRawOpts) error {
+	if opts.FlashMap != nil {
+		area, err := opts.FlashMap.ResolveArea(entry.Area)
+		if err != nil {
+			return err
+		}
+		if entry.Offset < 0 || entry.Offset+len(entry.Data) > area.Size {
+			return errors.Errorf(
+				"raw entry does not fit in flash area \"%s\": "+
+					"off=%d len=%d area-size=%d",
+				area.Name, entry.Offset, len(entry.Data), area.Size)
+		}
+		entry.Offset += area.Offset
+	}
+
+	return m.InsertRaw(entry, opts.EraseVal)
+}
@@ -0,0 +1,154 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"encoding/json"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+)
+
+// LayoutArea describes the utilization of a single flash area.  Used is
+// the offset of the end of the area's last non-erased byte, so erased
+// bytes in the middle of the area count as used.
+type LayoutArea struct {
+	Name        string  `json:"name"`
+	Id          int     `json:"id"`
+	Offset      int     `json:"offset"`
+	Size        int     `json:"size"`
+	Used        int     `json:"used"`
+	Free        int     `json:"free"`
+	Utilization float64 `json:"utilization"` // Percent.
+}
+
+// LayoutGap is a range of the device that no flash area covers.  Data
+// indicates that the mfgimage contains non-erased bytes in the range.
+type LayoutGap struct {
+	Offset int  `json:"offset"`
+	Size   int  `json:"size"`
+	Data   bool `json:"data"`
+}
+
+// Layout describes how an mfgimage occupies the flash areas of its device.
+type Layout struct {
+	Device    int          `json:"device"`
+	ImageSize int          `json:"image_size"`
+	Areas     []LayoutArea `json:"areas"`
+	Gaps      []LayoutGap  `json:"gaps"`
+	TotalSize int          `json:"total_size"`
+	TotalUsed int          `json:"total_used"`
+}
+
+// usedBytes returns the number of bytes in the given range of a binary up
+// to and including the last non-erased byte.  The binary is treated as
+// erased beyond its end.
+func usedBytes(bin []byte, off int, size int, eraseVal byte) int {
+	if off >= len(bin) {
+		return 0
+	}
+
+	end := off + size
+	if end > len(bin) {
+		end = len(bin)
+	}
+
+	return len(StripPadding(bin[off:end], eraseVal))
+}
+
+// LayoutReport calculates the utilization of each flash area on the
+// specified device, along with the ranges of the device that no area
+// covers.
+func LayoutReport(m Mfg, fm flash.FlashMap, device int,
+	eraseVal byte) (Layout, error) {
+
+	l := Layout{
+		Device: device,
+		Areas:  []LayoutArea{},
+		Gaps:   []LayoutGap{},
+	}
+
+	if err := fm.Validate(); err != nil {
+		return l, err
+	}
+
+	bin, err := m.Bytes(eraseVal)
+	if err != nil {
+		return l, err
+	}
+	l.ImageSize = len(bin)
+
+	addGap := func(off int, end int) {
+		if off < end {
+			l.Gaps = append(l.Gaps, LayoutGap{
+				Offset: off,
+				Size:   end - off,
+				Data:   usedBytes(bin, off, end-off, eraseVal) > 0,
+			})
+		}
+	}
+
+	cur := 0
+	for _, area := range flash.SortFlashAreasByDevOff(fm.Areas) {
+		if area.Device != device {
+			continue
+		}
+
+		addGap(cur, area.Offset)
+		cur = area.Offset + area.Size
+
+		used := usedBytes(bin, area.Offset, area.Size, eraseVal)
+		la := LayoutArea{
+			Name:   area.Name,
+			Id:     area.Id,
+			Offset: area.Offset,
+			Size:   area.Size,
+			Used:   used,
+			Free:   area.Size - used,
+		}
+		if area.Size > 0 {
+			la.Utilization = float64(used) * 100 / float64(area.Size)
+		}
+		l.Areas = append(l.Areas, la)
+
+		l.TotalSize += area.Size
+		l.TotalUsed += used
+	}
+
+	if len(l.Areas) == 0 {
+		return l, errors.Errorf("flash map contains no areas on device %d",
+			device)
+	}
+
+	// Data beyond the last area is reported as a final gap.
+	addGap(cur, len(bin))
+
+	return l, nil
+}
+
+// Json produces a JSON representation of a layout report.
+func (l *Layout) Json() (string, error) {
+	bin, err := json.MarshalIndent(l, "", "    ")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to marshal layout report")
+	}
+
+	return string(bin), nil
+}
@@ -60,6 +60,20 @@ func (t *MetaTlv) bodyMap() (map[string]interface{}, error) {
 		}
 		return body.Map(), nil
 
+	case META_TLV_TYPE_BOOT_VERSION:
+		var body MetaTlvBodyBootVersion
+		if err := readBody(&body); err != nil {
+			return nil, err
+		}
+		return body.Map(), nil
+
+	case META_TLV_TYPE_ENC_AREA:
+		var body MetaTlvBodyEncArea
+		if err := readBody(&body); err != nil {
+			return nil, err
+		}
+		return body.Map(), nil
+
 	default:
 		return nil, errors.Errorf("unknown meta TLV type: %d", t.Header.Type)
 	}
@@ -86,6 +100,21 @@ func (b *MetaTlvBodyMmrRef) Map() map[string]interface{} {
 	}
 }
 
+func (b *MetaTlvBodyBootVersion) Map() map[string]interface{} {
+	return map[string]interface{}{
+		"version": b.String(),
+	}
+}
+
+func (b *MetaTlvBodyEncArea) Map() map[string]interface{} {
+	return map[string]interface{}{
+		"area":      b.Area,
+		"size":      b.Size,
+		"nonce":     hex.EncodeToString(b.Nonce[:]),
+		"plain_mac": hex.EncodeToString(b.PlainMac[:]),
+	}
+}
+
 // Map produces a JSON-friendly map representation of an MMR TLV.
 func (t *MetaTlv) Map(index int, offset int) map[string]interface{} {
 	hmap := map[string]interface{}{
@@ -22,8 +22,10 @@ package mfg
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 
 	"github.com/apache/mynewt-artifact/errors"
 )
@@ -54,7 +56,7 @@ import (
 //
 // Fields:
 // <Header>
-// 1. Version: Manufacturing meta version number; always 0x01.
+// 1. Version: MMR schema version (see "Versioning" below).
 //
 // <TLVs>
 // 2. TLV type: Indicates the type of data to follow.
@@ -66,11 +68,23 @@ import (
 //    includes header, TLVs, and footer.
 // 6. Magic: indicates the presence of the manufacturing meta region.
 
+// Versioning:
+// The footer's version field identifies the MMR schema.  Each TLV type is
+// introduced in a particular version; an MMR may only contain TLV types
+// defined by the version it declares.  A parser accepts any version from
+// META_VERSION_MIN upward.  TLVs of unknown types in an MMR newer than
+// META_VERSION are skipped rather than rejected, so new TLV types can be
+// added without breaking older parsers (e.g., those in deployed boot
+// loaders).
+
 const META_MAGIC = 0x3bb2a269
-const META_VERSION = 2
+const META_VERSION_MIN = 2
+const META_VERSION = 4
 const META_TLV_TYPE_HASH = 0x01
 const META_TLV_TYPE_FLASH_AREA = 0x02
 const META_TLV_TYPE_MMR_REF = 0x04
+const META_TLV_TYPE_BOOT_VERSION = 0x05
+const META_TLV_TYPE_ENC_AREA = 0x06
 
 const META_HASH_SZ = 32
 const META_FOOTER_SZ = 8
@@ -78,6 +92,10 @@ const META_TLV_HEADER_SZ = 2
 const META_TLV_HASH_SZ = META_HASH_SZ
 const META_TLV_FLASH_AREA_SZ = 10
 const META_TLV_MMR_REF_SZ = 1
+const META_TLV_BOOT_VERSION_SZ = 8
+const META_TLV_ENC_AREA_SZ = 53
+
+const META_ENC_NONCE_SZ = 16
 
 type MetaFooter struct {
 	Size    uint16 // Includes header, TLVs, and footer.
@@ -106,6 +124,24 @@ type MetaTlvBodyMmrRef struct {
 	Area uint8
 }
 
+// MetaTlvBodyBootVersion is the version of the boot loader that the MMR is
+// embedded in.
+type MetaTlvBodyBootVersion struct {
+	Major    uint8
+	Minor    uint8
+	Rev      uint16
+	BuildNum uint32
+}
+
+// MetaTlvBodyEncArea describes a flash area encrypted with a provisioning
+// key (AES-CTR).
+type MetaTlvBodyEncArea struct {
+	Area     uint8                   // ID of the encrypted flash area.
+	Size     uint32                  // Encrypted bytes from the area start.
+	Nonce    [META_ENC_NONCE_SZ]byte // Initial AES-CTR counter block.
+	PlainMac [META_HASH_SZ]byte      // HMAC-SHA256 of the plaintext.
+}
+
 type MetaTlv struct {
 	Header MetaTlvHeader
 	Data   []byte
@@ -126,6 +162,18 @@ var metaTlvTypeNameMap = map[uint8]string{
 	META_TLV_TYPE_HASH:       "hash",
 	META_TLV_TYPE_FLASH_AREA: "flash_area",
 	META_TLV_TYPE_MMR_REF:    "mmr_ref",
+
+	META_TLV_TYPE_BOOT_VERSION: "boot_version",
+	META_TLV_TYPE_ENC_AREA:     "enc_area",
+}
+
+// The MMR version in which each TLV type was introduced.
+var metaTlvTypeVersionMap = map[uint8]uint8{
+	META_TLV_TYPE_HASH:         2,
+	META_TLV_TYPE_FLASH_AREA:   2,
+	META_TLV_TYPE_MMR_REF:      2,
+	META_TLV_TYPE_BOOT_VERSION: 3,
+	META_TLV_TYPE_ENC_AREA:     4,
 }
 
 func MetaTlvTypeName(typ uint8) string {
@@ -136,6 +184,41 @@ func MetaTlvTypeName(typ uint8) string {
 	return name
 }
 
+// MetaTlvTypeVersion returns the MMR version that introduced the given TLV
+// type, or 0 if the type is unknown.
+func MetaTlvTypeVersion(typ uint8) uint8 {
+	return metaTlvTypeVersionMap[typ]
+}
+
+// MetaVersionSupportsTlv indicates whether the given MMR version defines the
+// given TLV type, i.e., whether a parser of that version understands it.
+func MetaVersionSupportsTlv(version uint8, typ uint8) bool {
+	v := MetaTlvTypeVersion(typ)
+	return v != 0 && v <= version
+}
+
+// MetaVersionTlvTypes returns the TLV types defined by the given MMR
+// version, in ascending order.
+func MetaVersionTlvTypes(version uint8) []uint8 {
+	var types []uint8
+	for typ := range metaTlvTypeVersionMap {
+		if MetaVersionSupportsTlv(version, typ) {
+			types = append(types, typ)
+		}
+	}
+	sort.Slice(types, func(i int, j int) bool {
+		return types[i] < types[j]
+	})
+
+	return types
+}
+
+// String produces a "major.minor.rev.build" representation of a boot loader
+// version.
+func (b *MetaTlvBodyBootVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", b.Major, b.Minor, b.Rev, b.BuildNum)
+}
+
 func writeElem(elem interface{}, w io.Writer) error {
 	/* XXX: Assume target platform uses little endian. */
 	if err := binary.Write(w, binary.LittleEndian, elem); err != nil {
@@ -194,6 +277,20 @@ func (tlv *MetaTlv) StructuredBody() (interface{}, error) {
 		}
 		return &body, nil
 
+	case META_TLV_TYPE_BOOT_VERSION:
+		var body MetaTlvBodyBootVersion
+		if err := readBody(&body); err != nil {
+			return nil, err
+		}
+		return &body, nil
+
+	case META_TLV_TYPE_ENC_AREA:
+		var body MetaTlvBodyEncArea
+		if err := readBody(&body); err != nil {
+			return nil, err
+		}
+		return &body, nil
+
 	default:
 		return nil, errors.Errorf("unknown meta TLV type: %d", tlv.Header.Type)
 	}
@@ -325,6 +422,72 @@ func (meta *Meta) Hash() []byte {
 	return tlv.Data
 }
 
+// Supports indicates whether an MMR's declared version defines the given TLV
+// type.
+func (meta *Meta) Supports(typ uint8) bool {
+	return MetaVersionSupportsTlv(meta.Footer.Version, typ)
+}
+
+// UnknownTlvs returns the indices of TLVs whose types this library does not
+// recognize.  These can only be legitimately present in an MMR newer than
+// META_VERSION.
+func (meta *Meta) UnknownTlvs() []int {
+	var indices []int
+	for i, tlv := range meta.Tlvs {
+		if MetaTlvTypeVersion(tlv.Header.Type) == 0 {
+			indices = append(indices, i)
+		}
+	}
+
+	return indices
+}
+
+// CheckVersion verifies that an MMR's declared version is one this library
+// can parse and that its TLVs are consistent with that version.  TLVs of
+// unknown types are permitted only if the MMR is newer than META_VERSION.
+func (meta *Meta) CheckVersion() error {
+	version := meta.Footer.Version
+	if version < META_VERSION_MIN {
+		return errors.Errorf("unsupported version: have=%d want>=%d",
+			version, META_VERSION_MIN)
+	}
+
+	for i, tlv := range meta.Tlvs {
+		typ := tlv.Header.Type
+		intro := MetaTlvTypeVersion(typ)
+
+		if intro == 0 {
+			if version <= META_VERSION {
+				return errors.Errorf(
+					"TLV %d has type %d, which is undefined in version %d",
+					i, typ, version)
+			}
+		} else if intro > version {
+			return errors.Errorf(
+				"TLV %d (%s) requires version %d; mmr declares version %d",
+				i, MetaTlvTypeName(typ), intro, version)
+		}
+	}
+
+	return nil
+}
+
+// BootVersion retrieves the boot loader version recorded in an MMR.  It
+// returns nil if the MMR doesn't have a boot version TLV.
+func (meta *Meta) BootVersion() (*MetaTlvBodyBootVersion, error) {
+	tlv := meta.FindFirstTlv(META_TLV_TYPE_BOOT_VERSION)
+	if tlv == nil {
+		return nil, nil
+	}
+
+	body, err := tlv.StructuredBody()
+	if err != nil {
+		return nil, err
+	}
+
+	return body.(*MetaTlvBodyBootVersion), nil
+}
+
 // Clone performs a deep copy of an MMR.
 func (meta *Meta) Clone() Meta {
 	tlvs := make([]MetaTlv, len(meta.Tlvs))
@@ -0,0 +1,305 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+)
+
+const (
+	META_VERIFY_RULE_PRESENT   = "present"
+	META_VERIFY_RULE_PLACEMENT = "placement"
+	META_VERIFY_RULE_FOOTER    = "footer"
+	META_VERIFY_RULE_HASH      = "hash"
+	META_VERIFY_RULE_FLASH_MAP = "flash_map"
+	META_VERIFY_RULE_MMR_REFS  = "mmr_refs"
+	META_VERIFY_RULE_ENC_AREAS = "enc_areas"
+)
+
+// MetaVerifyResult is the outcome of a single MMR check.
+type MetaVerifyResult struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+// MetaVerifyReport is the outcome of verifying an mfgimage's MMR.
+type MetaVerifyReport struct {
+	Rules []MetaVerifyResult
+}
+
+// Passed indicates whether every check passed.
+func (r *MetaVerifyReport) Passed() bool {
+	return len(r.Failures()) == 0
+}
+
+// Failures returns the results of all checks that did not pass.
+func (r *MetaVerifyReport) Failures() []MetaVerifyResult {
+	var failures []MetaVerifyResult
+	for _, rule := range r.Rules {
+		if !rule.Passed {
+			failures = append(failures, rule)
+		}
+	}
+
+	return failures
+}
+
+// Err returns an error describing each failed check, or nil if the MMR is
+// valid.
+func (r *MetaVerifyReport) Err() error {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, f := range failures {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Name, f.Detail))
+	}
+
+	return errors.Errorf("invalid mmr: %s", strings.Join(msgs, "; "))
+}
+
+func (r *MetaVerifyReport) add(name string, err error, detail string) {
+	res := MetaVerifyResult{
+		Name:   name,
+		Passed: err == nil,
+		Detail: detail,
+	}
+	if err != nil {
+		res.Detail = err.Error()
+	}
+
+	r.Rules = append(r.Rules, res)
+}
+
+// MetaEndOffset calculates where an mfgimage's MMR ends: the end of the boot
+// loader flash area on the specified device.
+func MetaEndOffset(areas []flash.FlashArea, device int) (int, error) {
+	for _, area := range areas {
+		if area.Name == flash.FLASH_AREA_NAME_BOOTLOADER &&
+			area.Device == device {
+
+			return area.Offset + area.Size, nil
+		}
+	}
+
+	return 0, errors.Errorf("flash map lacks %s on device %d",
+		flash.FLASH_AREA_NAME_BOOTLOADER, device)
+}
+
+func (m *Mfg) verifyMetaPlacement(areas []flash.FlashArea,
+	device int) error {
+
+	end, err := MetaEndOffset(areas, device)
+	if err != nil {
+		return err
+	}
+
+	haveEnd := m.MetaOff + int(m.Meta.Footer.Size)
+	if haveEnd != end {
+		return errors.Errorf(
+			"mmr does not end at end of boot loader area: have=%d want=%d",
+			haveEnd, end)
+	}
+
+	for _, area := range areas {
+		if area.Name == flash.FLASH_AREA_NAME_BOOTLOADER &&
+			area.Device == device && m.MetaOff < area.Offset {
+
+			return errors.Errorf(
+				"mmr extends before start of boot loader area: "+
+					"mmr-off=%d area-off=%d", m.MetaOff, area.Offset)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mfg) verifyMetaFooter() error {
+	ftr := m.Meta.Footer
+
+	if ftr.Magic != META_MAGIC {
+		return errors.Errorf("invalid magic: have=0x%08x want=0x%08x",
+			ftr.Magic, META_MAGIC)
+	}
+
+	if err := m.Meta.CheckVersion(); err != nil {
+		return err
+	}
+
+	if size := m.Meta.Size(); int(ftr.Size) != size {
+		return errors.Errorf(
+			"footer size inconsistent with contents: have=%d want=%d",
+			ftr.Size, size)
+	}
+
+	return nil
+}
+
+func (m *Mfg) verifyMetaHash(eraseVal byte) (string, error) {
+	tlvs := m.Meta.FindTlvs(META_TLV_TYPE_HASH)
+	if len(tlvs) == 0 {
+		return "no hash TLV", nil
+	}
+	if len(tlvs) > 1 {
+		return "", errors.Errorf("mmr contains %d hash TLVs", len(tlvs))
+	}
+	if len(tlvs[0].Data) != META_HASH_SZ {
+		return "", errors.Errorf("hash TLV has invalid size: have=%d want=%d",
+			len(tlvs[0].Data), META_HASH_SZ)
+	}
+
+	hash, err := m.RecalcHash(eraseVal)
+	if err != nil {
+		return "", err
+	}
+
+	if !bytes.Equal(hash, tlvs[0].Data) {
+		return "", errors.Errorf("incorrect hash: have=%x want=%x",
+			tlvs[0].Data, hash)
+	}
+
+	return fmt.Sprintf("hash=%x", hash), nil
+}
+
+func (m *Mfg) verifyMetaFlashMap(areas []flash.FlashArea) (string, error) {
+	idAreaMap := map[int]flash.FlashArea{}
+	for _, area := range areas {
+		idAreaMap[area.Id] = area
+	}
+
+	seen := map[int]struct{}{}
+	for _, tlv := range m.Meta.FindTlvs(META_TLV_TYPE_FLASH_AREA) {
+		body, err := tlv.StructuredBody()
+		if err != nil {
+			return "", err
+		}
+		fa := body.(*MetaTlvBodyFlashArea)
+
+		if _, dup := seen[int(fa.Area)]; dup {
+			return "", errors.Errorf("flash area %d listed twice", fa.Area)
+		}
+		seen[int(fa.Area)] = struct{}{}
+
+		area, ok := idAreaMap[int(fa.Area)]
+		if !ok {
+			return "", errors.Errorf("flash area %d not in flash map",
+				fa.Area)
+		}
+
+		if int(fa.Device) != area.Device || int(fa.Offset) != area.Offset ||
+			int(fa.Size) != area.Size {
+
+			return "", errors.Errorf(
+				"flash area %d (%s) differs from flash map: "+
+					"mmr=%d/0x%x/%d map=%d/0x%x/%d",
+				fa.Area, area.Name, fa.Device, fa.Offset, fa.Size,
+				area.Device, area.Offset, area.Size)
+		}
+	}
+
+	if len(seen) == 0 {
+		return "no flash area TLVs", nil
+	}
+
+	for _, area := range areas {
+		if _, ok := seen[area.Id]; !ok {
+			return "", errors.Errorf("flash area %d (%s) missing from mmr",
+				area.Id, area.Name)
+		}
+	}
+
+	return fmt.Sprintf("%d flash areas match", len(seen)), nil
+}
+
+func (m *Mfg) verifyMetaMmrRefs(areas []flash.FlashArea) (string, error) {
+	idAreaMap := map[int]flash.FlashArea{}
+	for _, area := range areas {
+		idAreaMap[area.Id] = area
+	}
+
+	seen := map[int]struct{}{}
+	for _, tlv := range m.Meta.FindTlvs(META_TLV_TYPE_MMR_REF) {
+		body, err := tlv.StructuredBody()
+		if err != nil {
+			return "", err
+		}
+		ref := body.(*MetaTlvBodyMmrRef)
+
+		if _, dup := seen[int(ref.Area)]; dup {
+			return "", errors.Errorf("mmr ref %d listed twice", ref.Area)
+		}
+		seen[int(ref.Area)] = struct{}{}
+
+		area, ok := idAreaMap[int(ref.Area)]
+		if !ok {
+			return "", errors.Errorf("mmr ref %d not in flash map", ref.Area)
+		}
+		if area.Name == flash.FLASH_AREA_NAME_BOOTLOADER {
+			return "", errors.Errorf("mmr refers to its own flash area")
+		}
+	}
+
+	return fmt.Sprintf("%d mmr refs valid", len(seen)), nil
+}
+
+// VerifyMeta checks an mfgimage's MMR against a flash map: its placement at
+// the end of the boot loader area, its footer, its hash, its flash area and
+// MMR reference TLVs, and its encrypted areas.  Every check is evaluated,
+// even after a failure, so that the returned report is complete.
+func (m *Mfg) VerifyMeta(areas []flash.FlashArea, device int,
+	eraseVal byte) MetaVerifyReport {
+
+	var r MetaVerifyReport
+
+	if m.Meta == nil {
+		r.add(META_VERIFY_RULE_PRESENT, errors.Errorf("mfgimage has no mmr"),
+			"")
+		return r
+	}
+	r.add(META_VERIFY_RULE_PRESENT, nil,
+		fmt.Sprintf("offset=%d size=%d", m.MetaOff, m.Meta.Footer.Size))
+
+	r.add(META_VERIFY_RULE_PLACEMENT, m.verifyMetaPlacement(areas, device),
+		"mmr at end of boot loader area")
+
+	r.add(META_VERIFY_RULE_FOOTER, m.verifyMetaFooter(), "footer valid")
+
+	detail, err := m.verifyMetaHash(eraseVal)
+	r.add(META_VERIFY_RULE_HASH, err, detail)
+
+	detail, err = m.verifyMetaFlashMap(areas)
+	r.add(META_VERIFY_RULE_FLASH_MAP, err, detail)
+
+	detail, err = m.verifyMetaMmrRefs(areas)
+	r.add(META_VERIFY_RULE_MMR_REFS, err, detail)
+
+	detail, err = m.verifyMetaEncAreas(areas)
+	r.add(META_VERIFY_RULE_ENC_AREAS, err, detail)
+
+	return r
+}
@@ -143,6 +143,10 @@ func (m *Mfg) Bytes(eraseVal byte) ([]byte, error) {
 	binCopy := make([]byte, len(m.Bin))
 	copy(binCopy, m.Bin)
 
+	if m.Meta == nil {
+		return binCopy, nil
+	}
+
 	metaBytes, err := m.Meta.Bytes()
 	if err != nil {
 		return nil, err
@@ -20,10 +20,18 @@
 package mfg
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/image"
 	"github.com/apache/mynewt-artifact/manifest"
 	"github.com/apache/mynewt-artifact/sec"
 )
@@ -234,3 +242,777 @@ func TestMfgVerify(t *testing.T) {
 		testOne(t, e)
 	}
 }
+
+func TestRawEntriesFromHex(t *testing.T) {
+	hexText := `:020000040800F2
+:0401000001020304F1
+:020104000506EE
+:0102000007F6
+:00000001FF
+`
+
+	segs, err := ParseIntelHex([]byte(hexText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segs) != 2 {
+		t.Fatalf("wrong segment count: have=%d want=2", len(segs))
+	}
+	if segs[0].Addr != 0x08000100 || len(segs[0].Data) != 6 {
+		t.Fatalf("adjacent records not merged: %+v", segs[0])
+	}
+
+	areas := []flash.FlashArea{
+		{Name: "FLASH_AREA_BOOTLOADER", Device: 0, Offset: 0, Size: 0x1000},
+	}
+	entries, err := RawEntriesFromHex(segs, areas, 0, 0x08000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[1].Offset != 0x200 || entries[1].Area != areas[0].Name {
+		t.Fatalf("wrong raw entry: %+v", entries[1])
+	}
+
+	// Segment outside every flash area.
+	if _, err := RawEntriesFromHex(segs, areas, 0, 0x07fff000); err == nil {
+		t.Fatalf("out-of-area hex segment accepted")
+	}
+
+	// Corrupt checksum.
+	bad := strings.Replace(hexText, "F1", "F2", 1)
+	if _, err := ParseIntelHex([]byte(bad)); err == nil {
+		t.Fatalf("hex with bad checksum accepted")
+	}
+}
+
+func TestEmitAreaPolicies(t *testing.T) {
+	m := Mfg{
+		Bin: []byte{1, 2, 3, 4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 5, 6},
+	}
+
+	areas := []flash.FlashArea{
+		{Name: "A", Device: 0, Offset: 0, Size: 4},
+		{Name: "B", Device: 0, Offset: 4, Size: 2},
+		{Name: "C", Device: 0, Offset: 6, Size: 4},
+		{Name: "D", Device: 0, Offset: 10, Size: 2},
+	}
+	policies := map[string]AreaPolicy{
+		"B": AREA_POLICY_SKIP,
+		"C": AREA_POLICY_ERASE,
+	}
+
+	segs, err := m.Emit(areas, 0, policies, 0xff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []EmitSegment{
+		{Offset: 0, Size: 4, Data: []byte{1, 2, 3, 4}},
+		{Offset: 6, Size: 4},
+		{Offset: 10, Size: 2, Data: []byte{5, 6}},
+	}
+	if fmt.Sprintf("%v", segs) != fmt.Sprintf("%v", exp) {
+		t.Fatalf("wrong segments: have=%v want=%v", segs, exp)
+	}
+
+	// Data in a skipped area.
+	policies["A"] = AREA_POLICY_SKIP
+	if _, err := m.Emit(areas, 0, policies, 0xff); err == nil {
+		t.Fatalf("emit succeeded despite data in skipped area")
+	}
+}
+
+func TestEmitAreaFills(t *testing.T) {
+	m := Mfg{
+		Bin: []byte{1, 2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	areas := []flash.FlashArea{
+		{Name: "A", Device: 0, Offset: 0, Size: 4},
+		{Name: "B", Device: 0, Offset: 4, Size: 4},
+		{Name: "C", Device: 0, Offset: 8, Size: 4},
+	}
+	opts := EmitOpts{
+		Policies: map[string]AreaPolicy{
+			"B": AREA_POLICY_ERASE,
+		},
+		Fills: map[string][]byte{
+			"A": {0x00},
+			"B": {0xde, 0xad, 0xbe},
+			"C": {0xa5, 0x5a},
+		},
+		EraseVal: 0xff,
+	}
+
+	segs, err := m.EmitOpts(areas, 0, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Patterns are aligned to the start of each area.
+	exp := []EmitSegment{
+		{Offset: 0, Size: 4, Data: []byte{1, 2, 0x00, 0x00}},
+		{Offset: 4, Size: 4, Data: []byte{0xde, 0xad, 0xbe, 0xde}},
+		{Offset: 8, Size: 4, Data: []byte{0xa5, 0x5a, 0xa5, 0x5a}},
+	}
+	if fmt.Sprintf("%v", segs) != fmt.Sprintf("%v", exp) {
+		t.Fatalf("wrong segments: have=%v want=%v", segs, exp)
+	}
+
+	// The mfgimage itself is unchanged.
+	if m.Bin[2] != 0xff || len(m.Bin) != 8 {
+		t.Fatalf("emit modified mfgimage")
+	}
+
+	opts.Policies["C"] = AREA_POLICY_SKIP
+	if _, err := m.EmitOpts(areas, 0, opts); err == nil {
+		t.Fatalf("emit succeeded despite fill in skipped area")
+	}
+
+	for _, s := range []string{"", "0", "zz", strings.Repeat("00", 17)} {
+		if _, err := ParseFillPattern(s); err == nil {
+			t.Fatalf("invalid fill pattern accepted: \"%s\"", s)
+		}
+	}
+}
+
+func TestVerifyMeta(t *testing.T) {
+	tests := []struct {
+		basename string
+		failures []string
+	}{
+		{"hash1-fm1-ext1-tgts1-sign0", nil},
+		{"hash1-fm1-ext0-tgts1-sign0", nil},
+		{"hashx-fm1-ext0-tgts1-sign0", []string{META_VERIFY_RULE_HASH}},
+		{"hash1-fmm-ext1-tgts1-sign0", []string{META_VERIFY_RULE_FLASH_MAP}},
+	}
+
+	for _, test := range tests {
+		man := readManifest(test.basename)
+		m, err := Parse(readMfgData(test.basename), man.Meta.EndOffset,
+			man.EraseVal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := m.VerifyMeta(man.FlashAreas, man.Device, man.EraseVal)
+
+		var have []string
+		for _, f := range r.Failures() {
+			have = append(have, f.Name)
+		}
+		if strings.Join(have, ",") != strings.Join(test.failures, ",") {
+			t.Fatalf("%s: unexpected failures: have=%v want=%v (%v)",
+				test.basename, have, test.failures, r.Err())
+		}
+	}
+
+	// Misplaced MMR.
+	man := readManifest("hash1-fm1-ext1-tgts1-sign0")
+	m, err := Parse(readMfgData("hash1-fm1-ext1-tgts1-sign0"),
+		man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.MetaOff -= 4
+
+	r := m.VerifyMeta(man.FlashAreas, man.Device, man.EraseVal)
+	failures := r.Failures()
+	if len(failures) == 0 || failures[0].Name != META_VERIFY_RULE_PLACEMENT {
+		t.Fatalf("misplaced mmr accepted: %+v", failures)
+	}
+}
+
+func TestReplaceTarget(t *testing.T) {
+	const basename = "hash1-fm1-ext1-tgts1-sign1"
+
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := image.NewImageCreator()
+	ic.Version = image.ImageVersion{Major: 2}
+	ic.Body = bytes.Repeat([]byte{0xa5}, 1000)
+	newImg, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m2, man2, err := ReplaceTarget(m, man, flash.FLASH_AREA_NAME_IMAGE_0,
+		newImg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m2.VerifyStructure(man2.EraseVal); err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.VerifyManifest(man2); err != nil {
+		t.Fatal(err)
+	}
+	if len(man2.Signatures) != 0 {
+		t.Fatalf("stale signatures retained")
+	}
+
+	imgs, err := m2.ExtractImages(man2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imgs) != 1 || imgs[0].Header.Vers.Major != 2 {
+		t.Fatalf("replacement image not extracted")
+	}
+
+	// The original is untouched.
+	if err := m.VerifyManifest(man); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReplaceTarget(m, man, flash.FLASH_AREA_NAME_IMAGE_1,
+		newImg); err == nil {
+
+		t.Fatalf("replaced target in area without target")
+	}
+}
+
+func TestStreamEmit(t *testing.T) {
+	basename := "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := m.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHash, err := m.Hash(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Describe each non-erased run outside the MMR as a section; the
+	// emitter reproduces the gaps.  Reverse the order to ensure sections
+	// get sorted.
+	body := append([]byte(nil), m.Bin...)
+	for i := 0; i < m.Meta.Size(); i++ {
+		body[m.MetaOff+i] = man.EraseVal
+	}
+	var sections []StreamSection
+	for i := 0; i < len(body); {
+		if body[i] == man.EraseVal {
+			i++
+			continue
+		}
+		start := i
+		for i < len(body) && body[i] != man.EraseVal {
+			i++
+		}
+		sections = append([]StreamSection{{
+			Offset: start,
+			Size:   i - start,
+			Data:   bytes.NewReader(body[start:i]),
+		}}, sections...)
+	}
+	if len(sections) < 2 {
+		t.Fatalf("test mfgimage has too few sections: %d", len(sections))
+	}
+
+	buf := &bytes.Buffer{}
+	hash, err := StreamEmit(buf, sections, m.Meta, m.MetaOff, StreamOpts{
+		EraseVal:  man.EraseVal,
+		ChunkSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash, wantHash) {
+		t.Fatalf("wrong hash: have=%x want=%x", hash, wantHash)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("streamed mfgimage differs from in-memory image")
+	}
+
+	// Section overlapping the MMR.
+	bad := []StreamSection{{
+		Offset: m.MetaOff - 1,
+		Size:   2,
+		Data:   bytes.NewReader([]byte{0, 0}),
+	}}
+	if _, err := StreamEmit(ioutil.Discard, bad, m.Meta, m.MetaOff,
+		StreamOpts{EraseVal: man.EraseVal}); err == nil {
+		t.Fatalf("section overlapping MMR accepted")
+	}
+}
+
+func TestMetaVersion(t *testing.T) {
+	if MetaVersionSupportsTlv(2, META_TLV_TYPE_BOOT_VERSION) ||
+		!MetaVersionSupportsTlv(3, META_TLV_TYPE_BOOT_VERSION) ||
+		MetaVersionSupportsTlv(META_VERSION, 0x7f) {
+
+		t.Fatalf("wrong TLV support")
+	}
+	if have := fmt.Sprint(MetaVersionTlvTypes(2)); have != "[1 2 4]" {
+		t.Fatalf("wrong version 2 TLV types: %s", have)
+	}
+
+	const basename = "hash1-fm1-ext1-tgts1-sign0"
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Meta.CheckVersion(); err != nil {
+		t.Fatal(err)
+	}
+
+	withTlv := func(version uint8, typ uint8, data []byte) Meta {
+		meta := m.Meta.Clone()
+		meta.Tlvs = append(meta.Tlvs, MetaTlv{
+			Header: MetaTlvHeader{Type: typ, Size: uint8(len(data))},
+			Data:   data,
+		})
+		meta.Footer.Version = version
+		meta.Footer.Size = uint16(meta.Size())
+
+		// Round trip through the binary form.
+		b, err := meta.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		meta, err = parseMeta(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	bootVer := []byte{1, 2, 3, 0, 4, 0, 0, 0}
+
+	// Boot version TLV requires version 3.
+	meta := withTlv(2, META_TLV_TYPE_BOOT_VERSION, bootVer)
+	if err := meta.CheckVersion(); err == nil {
+		t.Fatalf("version 3 TLV accepted in version 2 mmr")
+	}
+
+	meta = withTlv(3, META_TLV_TYPE_BOOT_VERSION, bootVer)
+	if err := meta.CheckVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Supports(META_TLV_TYPE_BOOT_VERSION) {
+		t.Fatalf("version 3 mmr does not support boot version TLV")
+	}
+	bv, err := meta.BootVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bv == nil || bv.String() != "1.2.3.4" {
+		t.Fatalf("wrong boot version: %v", bv)
+	}
+
+	// Unknown TLVs are only permitted in newer mmrs.
+	meta = withTlv(META_VERSION, 0x7f, []byte{0xaa})
+	if err := meta.CheckVersion(); err == nil {
+		t.Fatalf("unknown TLV accepted in current mmr")
+	}
+
+	meta = withTlv(META_VERSION+1, 0x7f, []byte{0xaa})
+	if err := meta.CheckVersion(); err != nil {
+		t.Fatal(err)
+	}
+	if unk := meta.UnknownTlvs(); len(unk) != 1 ||
+		unk[0] != len(meta.Tlvs)-1 {
+
+		t.Fatalf("wrong unknown TLVs: %v", unk)
+	}
+
+	// A newer mmr still verifies.
+	dup := m
+	dup.Meta = &meta
+	r := dup.VerifyMeta(man.FlashAreas, man.Device, man.EraseVal)
+	for _, f := range r.Failures() {
+		if f.Name == META_VERIFY_RULE_FOOTER {
+			t.Fatalf("newer mmr footer rejected: %v", r.Err())
+		}
+	}
+
+	meta = m.Meta.Clone()
+	meta.Footer.Version = META_VERSION_MIN - 1
+	if err := meta.CheckVersion(); err == nil {
+		t.Fatalf("unsupported mmr version accepted")
+	}
+}
+
+func TestPlaceTargets(t *testing.T) {
+	areas := []flash.FlashArea{
+		{Name: flash.FLASH_AREA_NAME_BOOTLOADER, Id: 0, Device: 0, Offset: 0, Size: 0x4000},
+		{Name: "FLASH_AREA_APP_A", Id: 1, Device: 0, Offset: 0x8000, Size: 0x8000},
+		{Name: flash.FLASH_AREA_NAME_IMAGE_1, Id: 2, Device: 0, Offset: 0x10000, Size: 0x8000},
+		{Name: "FLASH_AREA_NFFS", Id: 17, Device: 1, Offset: 0, Size: 0x3000},
+	}
+
+	boot := bytes.Repeat([]byte{0xb0}, 0x1000)
+	app := bytes.Repeat([]byte{0xa0}, 0x2000)
+
+	ps, err := PlaceTargets(areas, 0, []PlacementTarget{
+		{Role: TARGET_ROLE_SLOT0, Name: "app.img", Data: app},
+		{Role: TARGET_ROLE_BOOT, Name: "boot.bin", Data: boot},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Slot 0 is found by ID; the result is sorted by offset.
+	if len(ps) != 2 || ps[0].Area.Offset != 0 || ps[1].Area.Offset != 0x8000 {
+		t.Fatalf("unexpected placements: %+v", ps)
+	}
+	if ps[1].Free() != 0x6000 {
+		t.Fatalf("wrong free space: have=%d want=%d", ps[1].Free(), 0x6000)
+	}
+
+	m := Mfg{}
+	if err := m.InsertPlacements(ps, 0xff); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Bin) != 0xa000 || m.Bin[0x4000] != 0xff ||
+		!bytes.Equal(m.Bin[0x8000:], app) {
+
+		t.Fatalf("placements written incorrectly")
+	}
+
+	tgts := PlacementManifestTargets(ps)
+	if len(tgts) != 2 || tgts[1].Name != "app.img" ||
+		tgts[1].Offset != 0x8000 || tgts[1].Size != len(app) {
+
+		t.Fatalf("unexpected manifest targets: %+v", tgts)
+	}
+
+	failCases := [][]PlacementTarget{
+		// Too large.
+		{{Role: TARGET_ROLE_BOOT, Data: make([]byte, 0x4001)}},
+		// Duplicate role.
+		{{Role: TARGET_ROLE_SLOT1}, {Role: TARGET_ROLE_SLOT1}},
+	}
+	for i, tgts := range failCases {
+		if _, err := PlaceTargets(areas, 0, tgts); err == nil {
+			t.Fatalf("fail case %d accepted", i)
+		}
+	}
+
+	// The areas are on the wrong device.
+	if _, err := PlaceTargets(areas, 1, []PlacementTarget{
+		{Role: TARGET_ROLE_BOOT},
+	}); err == nil {
+		t.Fatalf("placement on wrong device accepted")
+	}
+}
+
+func TestLayoutReport(t *testing.T) {
+	fm := flash.FlashMap{Areas: []flash.FlashArea{
+		{Name: flash.FLASH_AREA_NAME_BOOTLOADER, Id: 0, Device: 0, Offset: 0, Size: 0x1000},
+		{Name: flash.FLASH_AREA_NAME_IMAGE_0, Id: 1, Device: 0, Offset: 0x2000, Size: 0x1000},
+		{Name: "FLASH_AREA_NFFS", Id: 17, Device: 1, Offset: 0, Size: 0x1000},
+	}}
+
+	bin := bytes.Repeat([]byte{0xff}, 0x3400)
+	copy(bin, bytes.Repeat([]byte{0x01}, 0x400))
+	bin[0x1800] = 0x02
+	copy(bin[0x2000:], bytes.Repeat([]byte{0x03}, 0x800))
+	bin[0x3100] = 0x04
+
+	l, err := LayoutReport(Mfg{Bin: bin}, fm, 0, 0xff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(l.Areas) != 2 {
+		t.Fatalf("wrong number of areas: have=%d want=2", len(l.Areas))
+	}
+	if l.Areas[0].Used != 0x400 || l.Areas[0].Free != 0xc00 ||
+		l.Areas[0].Utilization != 25 {
+
+		t.Fatalf("wrong boot area utilization: %+v", l.Areas[0])
+	}
+	if l.Areas[1].Used != 0x800 || l.TotalUsed != 0xc00 ||
+		l.TotalSize != 0x2000 {
+
+		t.Fatalf("wrong utilization: %+v", l)
+	}
+
+	want := []LayoutGap{
+		{Offset: 0x1000, Size: 0x1000, Data: true},
+		{Offset: 0x3000, Size: 0x400, Data: true},
+	}
+	if len(l.Gaps) != len(want) {
+		t.Fatalf("wrong gaps: have=%+v want=%+v", l.Gaps, want)
+	}
+	for i := range want {
+		if l.Gaps[i] != want[i] {
+			t.Fatalf("wrong gap %d: have=%+v want=%+v", i, l.Gaps[i], want[i])
+		}
+	}
+
+	j, err := l.Json()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(j, "\"utilization\": 25") {
+		t.Fatalf("unexpected layout JSON:\n%s", j)
+	}
+
+	if _, err := LayoutReport(Mfg{Bin: bin}, fm, 2, 0xff); err == nil {
+		t.Fatalf("layout of device without areas succeeded")
+	}
+}
+
+func TestEncryptArea(t *testing.T) {
+	const basename = "hash1-fm1-ext1-tgts1-sign0"
+
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newKey := func(b byte) sec.PubEncKey {
+		c, err := aes.NewCipher(bytes.Repeat([]byte{b}, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sec.PubEncKey{Aes: c}
+	}
+	key := newKey(1)
+
+	area := man.FindFlashAreaName(flash.FLASH_AREA_NAME_IMAGE_0)
+	if area == nil {
+		t.Fatalf("no image 0 area")
+	}
+
+	enc, err := EncryptArea(m, *area, key, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(enc.Bin[area.Offset:area.Offset+64],
+		m.Bin[area.Offset:area.Offset+64]) {
+
+		t.Fatalf("flash area not encrypted")
+	}
+
+	r := enc.VerifyMeta(man.FlashAreas, man.Device, man.EraseVal)
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ENC_AREA TLV survives a round trip.
+	b, err := enc.Bytes(man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err = Parse(b, man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encs, err := enc.EncAreas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encs) != 1 || int(encs[0].Area) != area.Id {
+		t.Fatalf("wrong encrypted areas: %+v", encs)
+	}
+
+	if err := enc.VerifyEncAreas(man.FlashAreas, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.VerifyEncAreas(man.FlashAreas, newKey(2)); err == nil {
+		t.Fatalf("wrong provisioning key accepted")
+	}
+
+	dec, err := DecryptAreas(enc, man.FlashAreas, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := area.Offset + int(encs[0].Size)
+	if !bytes.Equal(dec.Bin[area.Offset:end], m.Bin[area.Offset:end]) {
+
+		t.Fatalf("decrypted area differs from original")
+	}
+
+	// The plaintext is authenticated with a keyed MAC; a bare hash would
+	// reveal the contents of a mostly erased area to a brute-force search.
+	if encs[0].PlainMac == sha256.Sum256(m.Bin[area.Offset:end]) {
+		t.Fatalf("ENC_AREA records an unkeyed plaintext hash")
+	}
+
+	if _, err := EncryptArea(enc, *area, key, man.EraseVal); err == nil {
+		t.Fatalf("area encrypted twice")
+	}
+
+	boot := man.FindFlashAreaName(flash.FLASH_AREA_NAME_BOOTLOADER)
+	if _, err := EncryptArea(m, *boot, key, man.EraseVal); err == nil {
+		t.Fatalf("mmr area encrypted")
+	}
+}
+
+func TestNamedAreas(t *testing.T) {
+	fm := flash.FlashMap{Areas: []flash.FlashArea{
+		{Name: flash.FLASH_AREA_NAME_BOOTLOADER, Id: 0, Offset: 0, Size: 0x4000},
+		{Name: flash.FLASH_AREA_NAME_IMAGE_0, Id: 1, Offset: 0x8000, Size: 0x8000},
+		{Name: "FLASH_AREA_FACTORY", Id: 16, Offset: 0x4000, Size: 0x4000},
+	}}
+
+	// A target may name its area rather than rely on its role.
+	ps, err := PlaceTargets(fm.Areas, 0, []PlacementTarget{
+		{Role: TARGET_ROLE_SLOT0, Name: "factory.img",
+			Data: make([]byte, 0x100), Area: "FLASH_AREA_FACTORY"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Area.Offset != 0x4000 {
+		t.Fatalf("unexpected placements: %+v", ps)
+	}
+
+	if _, err := PlaceTargets(fm.Areas, 0, []PlacementTarget{
+		{Role: TARGET_ROLE_SLOT0, Area: "FLASH_AREA_BOGUS"},
+	}); err == nil {
+		t.Fatalf("unknown flash area accepted")
+	}
+
+	// Raw entry offsets are relative to the named area.
+	m := Mfg{}
+	opts := InsertRawOpts{FlashMap: &fm, EraseVal: 0xff}
+	err = m.InsertRawOpts(RawEntry{
+		Area:   flash.FLASH_AREA_NAME_IMAGE_0,
+		Offset: 0x10,
+		Data:   []byte{1, 2, 3, 4},
+	}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Bin) != 0x8014 || m.Bin[0x8010] != 1 {
+		t.Fatalf("raw entry written at wrong offset")
+	}
+
+	err = m.InsertRawOpts(RawEntry{
+		Area:   "FLASH_AREA_FACTORY",
+		Offset: 0x3ffe,
+		Data:   []byte{1, 2, 3, 4},
+	}, opts)
+	if err == nil {
+		t.Fatalf("raw entry overflowing its area accepted")
+	}
+}
+
+// writeRebuildFiles extracts the target files that an mfgimage was built
+// from into dir, along with its manifest.
+func writeRebuildFiles(t *testing.T, basename string, dir string) string {
+	man := readManifest(basename)
+	m, err := Parse(readMfgData(basename), man.Meta.EndOffset, man.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tgt := range man.Targets {
+		area := man.FindFlashAreaDevOff(man.Device, tgt.Offset)
+		if area == nil {
+			t.Fatalf("no flash area at offset %d", tgt.Offset)
+		}
+		b, err := m.ExtractFlashArea(*area, man.EraseVal)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := tgt.ImagePath
+		if tgt.IsBoot() {
+			path = tgt.BinPath
+			if m.MetaOff < area.Offset+len(b) {
+				b = b[:m.MetaOff-area.Offset]
+			}
+			b = StripPadding(b, man.EraseVal)
+		} else {
+			img, err := image.ParseImage(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := img.TotalSize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = b[:size]
+		}
+
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	j, err := man.MarshalJson()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manPath := filepath.Join(dir, MANIFEST_FILENAME)
+	if err := ioutil.WriteFile(manPath, j, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return manPath
+}
+
+func TestFromManifest(t *testing.T) {
+	good := []string{
+		"hash1-fm1-ext0-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign0",
+		"hash1-fm1-ext1-tgts1-sign1",
+	}
+	for _, basename := range good {
+		manPath := writeRebuildFiles(t, basename, t.TempDir())
+
+		m, err := FromManifest(manPath)
+		if err != nil {
+			t.Fatalf("%s: rebuild failed: %s", basename, err.Error())
+		}
+		b, err := m.Bytes(0xff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, readMfgData(basename)) {
+			t.Fatalf("%s: rebuilt mfgimage differs from original", basename)
+		}
+	}
+
+	// The MMR in these mfgimages does not match the manifest, so the
+	// manifest cannot reproduce them.
+	bad := []string{
+		"hash1-fmm-ext1-tgts1-sign0",
+		"hash1-fm1-extm-tgts1-sign0",
+	}
+	for _, basename := range bad {
+		manPath := writeRebuildFiles(t, basename, t.TempDir())
+		if _, err := FromManifest(manPath); err == nil {
+			t.Fatalf("%s: mismatched rebuild accepted", basename)
+		}
+	}
+
+	// A modified target is detected.
+	dir := t.TempDir()
+	manPath := writeRebuildFiles(t, good[0], dir)
+	man := readManifest(good[0])
+	path := filepath.Join(dir, filepath.FromSlash(man.Targets[0].BinPath))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FromManifest(manPath); err == nil {
+		t.Fatalf("modified target accepted")
+	}
+}
@@ -55,15 +55,18 @@ func parseMetaTlv(bin []byte) (MetaTlv, int, error) {
 	data := make([]byte, tlv.Header.Size)
 	sz, err := r.Read(data)
 	if err != nil {
-		return tlv, 0, errors.Wrapf(err,
+		err = errors.Wrapf(err,
 			"error reading %d bytes of TLV data",
 			tlv.Header.Size)
-	}
-	if sz != len(data) {
-		return tlv, 0, errors.Errorf(
+	} else if sz != len(data) {
+		err = errors.Errorf(
 			"error reading %d bytes of TLV data: incomplete read",
 			tlv.Header.Size)
 	}
+	if err != nil {
+		return tlv, 0, errors.WithTlv(err, -1, tlv.Header.Type,
+			MetaTlvTypeName(tlv.Header.Type))
+	}
 	tlv.Data = data
 
 	return tlv, META_TLV_HEADER_SZ + int(tlv.Header.Size), nil
@@ -78,7 +81,7 @@ func parseMeta(bin []byte) (Meta, error) {
 
 	ftr, _, err := parseMetaFooter(bin[len(bin)-META_FOOTER_SZ:])
 	if err != nil {
-		return Meta{}, err
+		return Meta{}, errors.WithOffset(err, len(bin)-META_FOOTER_SZ)
 	}
 
 	if int(ftr.Size) > len(bin) {
@@ -94,7 +97,8 @@ func parseMeta(bin []byte) (Meta, error) {
 	for off < ftrOff {
 		tlv, sz, err := parseMetaTlv(bin[off:])
 		if err != nil {
-			return Meta{}, err
+			// Return the partial MMR for the benefit of lenient parsing.
+			return Meta{Tlvs: tlvs, Footer: ftr}, errors.WithOffset(err, off)
 		}
 		tlvs = append(tlvs, tlv)
 		off += sz
@@ -106,24 +110,58 @@ func parseMeta(bin []byte) (Meta, error) {
 	}, nil
 }
 
+// ParseOpts controls how mfgimages are parsed.
+type ParseOpts struct {
+	// If true, recoverable problems are reported as warnings and parsing
+	// continues with as much of the mfgimage as can be salvaged.
+	Lenient bool
+}
+
 // Parse parses a serialized mfgimage (e.g., "mfgimg.bin") and produces an
 // Mfg object.  metaEndOff is the offset immediately following the MMR, or -1
 // if there is no MMR.
 func Parse(data []byte, metaEndOff int, eraseVal byte) (Mfg, error) {
+	m, _, err := ParseWithOpts(data, metaEndOff, eraseVal, ParseOpts{})
+	return m, err
+}
+
+// ParseWithOpts parses a serialized mfgimage according to the given options.
+// In lenient mode, the returned slice contains a warning for each recoverable
+// problem encountered.  An MMR that cannot be parsed at all is omitted; one
+// that is partially corrupt retains the TLVs preceding the corruption.
+func ParseWithOpts(data []byte, metaEndOff int, eraseVal byte,
+	opts ParseOpts) (Mfg, []error, error) {
+
 	m := Mfg{
 		Bin: data,
 	}
 
+	var warnings []error
+	problem := func(err error) error {
+		err = errors.WithArtifact(err, "mfgimage", "")
+		if !opts.Lenient {
+			return err
+		}
+		warnings = append(warnings, err)
+		return nil
+	}
+
 	if metaEndOff >= 0 {
 		if metaEndOff > len(data) {
-			return m, errors.Errorf(
+			err := problem(errors.Errorf(
 				"MMR offset (%d) beyond end of mfgimage (%d)",
-				metaEndOff, len(data))
+				metaEndOff, len(data)))
+			return m, warnings, err
 		}
 
 		meta, err := parseMeta(data[:metaEndOff])
 		if err != nil {
-			return m, err
+			if err := problem(err); err != nil {
+				return m, warnings, err
+			}
+			if meta.Footer.Magic != META_MAGIC {
+				return m, warnings, nil
+			}
 		}
 		m.Meta = &meta
 		m.MetaOff = metaEndOff - int(meta.Footer.Size)
@@ -133,5 +171,5 @@ func Parse(data []byte, metaEndOff int, eraseVal byte) (Mfg, error) {
 		}
 	}
 
-	return m, nil
+	return m, warnings, nil
 }
@@ -0,0 +1,221 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/flash"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// TargetRole identifies the purpose of an image within an mfgimage.
+type TargetRole int
+
+const (
+	TARGET_ROLE_BOOT TargetRole = iota
+	TARGET_ROLE_SLOT0
+	TARGET_ROLE_SLOT1
+)
+
+var targetRoleNameMap = map[TargetRole]string{
+	TARGET_ROLE_BOOT:  "boot",
+	TARGET_ROLE_SLOT0: "slot0",
+	TARGET_ROLE_SLOT1: "slot1",
+}
+
+// The conventional flash area for each role.  An area is matched by name
+// first and by ID if no area has the conventional name.
+var targetRoleAreaMap = map[TargetRole]struct {
+	name string
+	id   int
+}{
+	TARGET_ROLE_BOOT:  {flash.FLASH_AREA_NAME_BOOTLOADER, 0},
+	TARGET_ROLE_SLOT0: {flash.FLASH_AREA_NAME_IMAGE_0, 1},
+	TARGET_ROLE_SLOT1: {flash.FLASH_AREA_NAME_IMAGE_1, 2},
+}
+
+func TargetRoleString(role TargetRole) string {
+	s := targetRoleNameMap[role]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func TargetRoleFromString(s string) (TargetRole, error) {
+	for role, name := range targetRoleNameMap {
+		if s == name {
+			return role, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown target role: \"%s\"", s)
+}
+
+// PlacementTarget is an image to be placed according to its role.
+type PlacementTarget struct {
+	Role TargetRole
+	Name string // E.g., the image filename.
+	Data []byte // Serialized image or raw boot loader binary.
+
+	// Name of the flash area to place the target in; "" for the role's
+	// conventional area.
+	Area string
+}
+
+// Placement describes where a target was placed.
+type Placement struct {
+	Target PlacementTarget
+	Area   flash.FlashArea
+}
+
+// Free returns the number of bytes left unused in the placement's area.
+func (p *Placement) Free() int {
+	return p.Area.Size - len(p.Target.Data)
+}
+
+func (p *Placement) String() string {
+	return fmt.Sprintf("%-5s %-32s area=%s id=%d device=%d offset=0x%x "+
+		"size=%d used=%d free=%d",
+		TargetRoleString(p.Target.Role), p.Target.Name, p.Area.Name,
+		p.Area.Id, p.Area.Device, p.Area.Offset, p.Area.Size,
+		len(p.Target.Data), p.Free())
+}
+
+// findRoleArea selects the flash area conventionally used for the given
+// role.
+func findRoleArea(areas []flash.FlashArea,
+	role TargetRole) (*flash.FlashArea, error) {
+
+	conv, ok := targetRoleAreaMap[role]
+	if !ok {
+		return nil, errors.Errorf("unknown target role: %d", role)
+	}
+
+	for i, area := range areas {
+		if area.Name == conv.name {
+			return &areas[i], nil
+		}
+	}
+	for i, area := range areas {
+		if area.Id == conv.id {
+			return &areas[i], nil
+		}
+	}
+
+	return nil, errors.Errorf(
+		"flash map contains no area for role \"%s\" (name=%s id=%d)",
+		TargetRoleString(role), conv.name, conv.id)
+}
+
+// PlaceTargets assigns each target to the flash area it names, or else to
+// the one conventionally used for its role, and checks that it fits.  Every area must reside on the
+// mfgimage's device.  The placements are returned sorted by offset.
+func PlaceTargets(areas []flash.FlashArea, device int,
+	targets []PlacementTarget) ([]Placement, error) {
+
+	fm := flash.FlashMap{Areas: areas}
+	if err := fm.Validate(); err != nil {
+		return nil, err
+	}
+
+	placed := map[TargetRole]bool{}
+	var ps []Placement
+	for _, t := range targets {
+		if placed[t.Role] {
+			return nil, errors.Errorf(
+				"more than one target with role \"%s\"",
+				TargetRoleString(t.Role))
+		}
+		placed[t.Role] = true
+
+		var area *flash.FlashArea
+		var err error
+		if t.Area != "" {
+			area = fm.FindArea(t.Area)
+			if area == nil {
+				err = errors.Errorf("flash map lacks area \"%s\"", t.Area)
+			}
+		} else {
+			area, err = findRoleArea(areas, t.Role)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if area.Device != device {
+			return nil, errors.Errorf(
+				"flash area \"%s\" for role \"%s\" is on device %d; "+
+					"mfgimage is for device %d",
+				area.Name, TargetRoleString(t.Role), area.Device, device)
+		}
+		if len(t.Data) > area.Size {
+			return nil, errors.Errorf(
+				"target \"%s\" too large for flash area \"%s\": "+
+					"have=%d want<=%d",
+				t.Name, area.Name, len(t.Data), area.Size)
+		}
+
+		ps = append(ps, Placement{
+			Target: t,
+			Area:   *area,
+		})
+	}
+
+	sort.Slice(ps, func(i int, j int) bool {
+		return ps[i].Area.Offset < ps[j].Area.Offset
+	})
+
+	return ps, nil
+}
+
+// InsertPlacements writes each placed target into the mfgimage.
+func (m *Mfg) InsertPlacements(ps []Placement, eraseVal byte) error {
+	for _, p := range ps {
+		err := m.InsertRaw(RawEntry{
+			Area:   p.Area.Name,
+			Offset: p.Area.Offset,
+			Data:   p.Target.Data,
+		}, eraseVal)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PlacementManifestTargets produces the mfg manifest targets describing a
+// set of placements.
+func PlacementManifestTargets(ps []Placement) []manifest.MfgManifestTarget {
+	var targets []manifest.MfgManifestTarget
+	for _, p := range ps {
+		targets = append(targets, manifest.MfgManifestTarget{
+			Name:   p.Target.Name,
+			Offset: p.Area.Offset,
+			Size:   len(p.Target.Data),
+		})
+	}
+
+	return targets
+}
@@ -0,0 +1,442 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// An mfgimage can be rebuilt from its manifest alone: the manifest records
+// the offset and file of each target and raw section, the flash map, and
+// the layout of the MMR.  Each input is checked against the digests the
+// manifest records, and the result is checked against the manifest's mfg
+// hash, so a rebuild either reproduces the original mfgimage exactly or
+// fails.
+
+// rebuildSection is a file to be written at an offset in a rebuilt
+// mfgimage.
+type rebuildSection struct {
+	name   string
+	offset int
+	data   []byte
+}
+
+// FromManifest re-assembles an mfgimage from its manifest and the files the
+// manifest refers to.  Relative paths are interpreted relative to the
+// manifest's directory.
+func FromManifest(manifestPath string) (Mfg, error) {
+	man, err := manifest.ReadMfgManifest(manifestPath)
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	return Rebuild(man, filepath.Dir(manifestPath), nil)
+}
+
+// Rebuild re-assembles an mfgimage from a manifest.  Relative paths are
+// interpreted relative to dir.  Content references are located with r; if r
+// is nil, the paths recorded in the manifest's content table are used.
+func Rebuild(man manifest.MfgManifest, dir string,
+	r manifest.ContentResolver) (Mfg, error) {
+
+	paths, err := rebuildPaths(man, dir, r)
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	var sections []rebuildSection
+	for i, t := range man.Targets {
+		s, err := rebuildTarget(t, paths.targets[i],
+			paths.targetManifests[i])
+		if err != nil {
+			return Mfg{}, err
+		}
+		sections = append(sections, s)
+	}
+	for i, raw := range man.Raws {
+		s, err := rebuildRaw(raw, paths.raws[i])
+		if err != nil {
+			return Mfg{}, err
+		}
+		sections = append(sections, s)
+	}
+
+	bin, err := rebuildBin(sections, man.EraseVal)
+	if err != nil {
+		return Mfg{}, err
+	}
+
+	m := Mfg{
+		Bin: bin,
+	}
+
+	if man.Meta != nil {
+		meta, err := rebuildMeta(man)
+		if err != nil {
+			return Mfg{}, err
+		}
+
+		m.Meta = &meta
+		m.MetaOff = man.Meta.EndOffset - int(meta.Footer.Size)
+		if m.MetaOff < 0 {
+			return Mfg{}, errors.Errorf(
+				"mmr (%d bytes) does not fit before end offset %d",
+				meta.Footer.Size, man.Meta.EndOffset)
+		}
+		for i := m.MetaOff; i < man.Meta.EndOffset && i < len(bin); i++ {
+			if bin[i] != man.EraseVal {
+				return Mfg{}, errors.Errorf(
+					"mmr overlaps mfgimage contents at offset %d", i)
+			}
+		}
+
+		if err := m.RefillHash(man.EraseVal); err != nil {
+			return Mfg{}, err
+		}
+	}
+
+	if err := m.verifyRebuild(man); err != nil {
+		return Mfg{}, err
+	}
+
+	return m, nil
+}
+
+// rebuildFilePaths holds the local path of each target's and raw
+// section's file.
+type rebuildFilePaths struct {
+	targets         []string
+	targetManifests []string
+	raws            []string
+}
+
+// rebuildPaths determines the local path of each file a manifest refers
+// to.  Content references are resolved with r; other paths are relative to
+// dir.
+func rebuildPaths(man manifest.MfgManifest, dir string,
+	r manifest.ContentResolver) (rebuildFilePaths, error) {
+
+	// Resolve a copy, leaving the original fields intact to tell references
+	// from paths.
+	res := man
+	res.Targets = append([]manifest.MfgManifestTarget(nil), man.Targets...)
+	res.Raws = append([]manifest.MfgManifestRaw(nil), man.Raws...)
+	if err := res.ResolvePaths(r); err != nil {
+		return rebuildFilePaths{}, err
+	}
+
+	local := func(orig string, resolved string) string {
+		if orig == "" || manifest.IsContentRef(orig) {
+			return resolved
+		}
+
+		path := filepath.FromSlash(orig)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return path
+	}
+
+	paths := rebuildFilePaths{}
+	for i, t := range man.Targets {
+		orig, resolved := t.BinPath, res.Targets[i].BinPath
+		if t.ImagePath != "" {
+			orig, resolved = t.ImagePath, res.Targets[i].ImagePath
+		}
+		paths.targets = append(paths.targets, local(orig, resolved))
+		paths.targetManifests = append(paths.targetManifests,
+			local(t.ManifestPath, res.Targets[i].ManifestPath))
+	}
+	for i, raw := range man.Raws {
+		orig, resolved := raw.BinPath, res.Raws[i].BinPath
+		if orig == "" {
+			orig, resolved = raw.Filename, res.Raws[i].Filename
+		}
+		paths.raws = append(paths.raws, local(orig, resolved))
+	}
+
+	return paths, nil
+}
+
+// rebuildTarget reads a target's boot loader binary or image.  An image is
+// checked against the hash in the target's manifest, if present.
+func rebuildTarget(t manifest.MfgManifestTarget, path string,
+	manPath string) (rebuildSection, error) {
+
+	s := rebuildSection{
+		name:   t.Name,
+		offset: t.Offset,
+	}
+
+	if path == "" {
+		return s, errors.Errorf(
+			"mfg manifest target \"%s\" has no binary or image", t.Name)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, errors.Wrapf(err,
+			"failed to read mfg target \"%s\"", t.Name)
+	}
+	if t.Size > 0 && len(data) != t.Size {
+		return s, errors.Errorf(
+			"mfg target \"%s\" has wrong size: have=%d want=%d",
+			t.Name, len(data), t.Size)
+	}
+	s.data = data
+
+	if t.IsBoot() {
+		return s, nil
+	}
+
+	img, err := image.ParseImage(data)
+	if err != nil {
+		return s, errors.Wrapf(err,
+			"failed to parse mfg target \"%s\"", t.Name)
+	}
+
+	return s, checkTargetManifest(t, manPath, img)
+}
+
+// checkTargetManifest compares an image to the hash recorded in its target
+// manifest.  Target manifests are optional.
+func checkTargetManifest(t manifest.MfgManifestTarget, path string,
+	img image.Image) error {
+
+	if path == "" {
+		return nil
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	tm, err := manifest.ReadManifest(path)
+	if err != nil {
+		return err
+	}
+	if tm.ImageHash == "" {
+		return nil
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(hash) != strings.ToLower(tm.ImageHash) {
+		return errors.Errorf(
+			"mfg target \"%s\" image hash differs from its manifest: "+
+				"have=%x want=%s", t.Name, hash, tm.ImageHash)
+	}
+
+	return nil
+}
+
+// rebuildRaw reads a raw section's binary.
+func rebuildRaw(raw manifest.MfgManifestRaw,
+	path string) (rebuildSection, error) {
+
+	s := rebuildSection{
+		name:   raw.Filename,
+		offset: raw.Offset,
+	}
+
+	if path == "" {
+		return s, errors.Errorf("mfg manifest raw section at offset %d "+
+			"has no binary", raw.Offset)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, errors.Wrapf(err,
+			"failed to read mfg raw section \"%s\"", raw.Filename)
+	}
+	if raw.Size > 0 && len(data) != raw.Size {
+		return s, errors.Errorf(
+			"mfg raw section \"%s\" has wrong size: have=%d want=%d",
+			raw.Filename, len(data), raw.Size)
+	}
+	s.data = data
+
+	return s, nil
+}
+
+// rebuildBin writes each section at its offset.  Unwritten bytes contain
+// the erase value.
+func rebuildBin(sections []rebuildSection, eraseVal byte) ([]byte, error) {
+	sort.SliceStable(sections, func(i int, j int) bool {
+		return sections[i].offset < sections[j].offset
+	})
+
+	end := 0
+	for i, s := range sections {
+		if s.offset < 0 {
+			return nil, errors.Errorf(
+				"mfg section \"%s\" has negative offset", s.name)
+		}
+		if i > 0 {
+			prev := sections[i-1]
+			if prev.offset+len(prev.data) > s.offset {
+				return nil, errors.Errorf(
+					"mfg sections \"%s\" and \"%s\" overlap",
+					prev.name, s.name)
+			}
+		}
+		if s.offset+len(s.data) > end {
+			end = s.offset + len(s.data)
+		}
+	}
+
+	bin := bytes.Repeat([]byte{eraseVal}, end)
+	for _, s := range sections {
+		copy(bin[s.offset:], s.data)
+	}
+
+	return bin, nil
+}
+
+// rebuildMeta constructs an MMR from the description in a manifest.  The
+// hash TLV, if any, is zeroed.
+func rebuildMeta(man manifest.MfgManifest) (Meta, error) {
+	meta := Meta{}
+
+	add := func(typ uint8, size int, body interface{}) error {
+		b := &bytes.Buffer{}
+		if err := writeElem(body, b); err != nil {
+			return err
+		}
+		meta.Tlvs = append(meta.Tlvs, MetaTlv{
+			Header: MetaTlvHeader{
+				Type: typ,
+				Size: uint8(size),
+			},
+			Data: b.Bytes(),
+		})
+		return nil
+	}
+
+	if man.Meta.Hash {
+		err := add(META_TLV_TYPE_HASH, META_TLV_HASH_SZ, MetaTlvBodyHash{})
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	if man.Meta.FlashMap {
+		for _, area := range man.FlashAreas {
+			err := add(META_TLV_TYPE_FLASH_AREA, META_TLV_FLASH_AREA_SZ,
+				MetaTlvBodyFlashArea{
+					Area:   uint8(area.Id),
+					Device: uint8(area.Device),
+					Offset: uint32(area.Offset),
+					Size:   uint32(area.Size),
+				})
+			if err != nil {
+				return meta, err
+			}
+		}
+	}
+
+	for _, mmr := range man.Meta.Mmrs {
+		area := man.FindFlashAreaName(mmr.Area)
+		if area == nil {
+			return meta, errors.Errorf(
+				"mmr reference to unknown flash area \"%s\"", mmr.Area)
+		}
+		err := add(META_TLV_TYPE_MMR_REF, META_TLV_MMR_REF_SZ,
+			MetaTlvBodyMmrRef{Area: uint8(area.Id)})
+		if err != nil {
+			return meta, err
+		}
+	}
+
+	// Use the oldest MMR version that supports every TLV.
+	version := uint8(META_VERSION_MIN)
+	size := META_FOOTER_SZ
+	for _, tlv := range meta.Tlvs {
+		if v := MetaTlvTypeVersion(tlv.Header.Type); v > version {
+			version = v
+		}
+		size += META_TLV_HEADER_SZ + len(tlv.Data)
+	}
+
+	meta.Footer = MetaFooter{
+		Size:    uint16(size),
+		Version: version,
+		Pad8:    0xff,
+		Magic:   META_MAGIC,
+	}
+
+	if man.Meta.Size != 0 && size != man.Meta.Size {
+		return meta, errors.Errorf(
+			"rebuilt mmr has wrong size: have=%d want=%d; the mmr "+
+				"contains TLVs not described by the manifest",
+			size, man.Meta.Size)
+	}
+
+	return meta, nil
+}
+
+// verifyRebuild compares a rebuilt mfgimage to the hash and outputs
+// recorded in its manifest.
+func (m *Mfg) verifyRebuild(man manifest.MfgManifest) error {
+	if man.MfgHash != "" {
+		hash, err := m.Hash(man.EraseVal)
+		if err != nil {
+			return err
+		}
+		if hex.EncodeToString(hash) != strings.ToLower(man.MfgHash) {
+			return errors.Errorf(
+				"rebuilt mfgimage hash differs from manifest: "+
+					"have=%x want=%s", hash, man.MfgHash)
+		}
+	}
+
+	b, err := m.Bytes(man.EraseVal)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(b)
+
+	for _, out := range man.Outputs {
+		if out.Type != manifest.MANIFEST_OUTPUT_TYPE_MFGIMG {
+			continue
+		}
+		if int64(len(b)) != out.Size ||
+			hex.EncodeToString(digest[:]) != strings.ToLower(out.Sha256) {
+
+			return errors.Errorf(
+				"rebuilt mfgimage differs from build output \"%s\"",
+				out.Path)
+		}
+	}
+
+	return nil
+}
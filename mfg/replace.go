@@ -0,0 +1,123 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bytes"
+	"encoding/hex"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+)
+
+// ReplaceTarget swaps the image embedded in the named flash area of an
+// mfgimage.  The area is erased before the new image is written, and the
+// MMR hash is recalculated.  The flash map comes from the mfgimage's
+// manifest; an updated copy of the manifest is returned along with the new
+// mfgimage.  The manifest's signatures no longer apply to the new mfgimage
+// and are removed.
+func ReplaceTarget(m Mfg, man manifest.MfgManifest, areaName string,
+	newImg image.Image) (Mfg, manifest.MfgManifest, error) {
+
+	fa := man.FindFlashAreaName(areaName)
+	if fa == nil {
+		return Mfg{}, man, errors.Errorf(
+			"flash area \"%s\" missing from mfg manifest", areaName)
+	}
+	if fa.Device != man.Device {
+		return Mfg{}, man, errors.Errorf(
+			"flash area \"%s\" is on device %d; mfgimage is for device %d",
+			areaName, fa.Device, man.Device)
+	}
+
+	policies, err := AreaPolicies(man)
+	if err != nil {
+		return Mfg{}, man, err
+	}
+	if p := policies[fa.Name]; p != AREA_POLICY_WRITE {
+		return Mfg{}, man, errors.Errorf(
+			"flash area \"%s\" has policy %s", fa.Name, AreaPolicyString(p))
+	}
+
+	tgtIdx := -1
+	for i, t := range man.Targets {
+		if t.Offset == fa.Offset {
+			tgtIdx = i
+			break
+		}
+	}
+	if tgtIdx == -1 {
+		return Mfg{}, man, errors.Errorf(
+			"mfgimage has no target in flash area \"%s\"", areaName)
+	}
+
+	b := &bytes.Buffer{}
+	if _, err := newImg.Write(b); err != nil {
+		return Mfg{}, man, err
+	}
+	imgBytes := b.Bytes()
+
+	// The image may not overwrite an MMR that shares its flash area.
+	areaEnd := fa.Offset + fa.Size
+	if m.Meta != nil && m.MetaOff >= fa.Offset && m.MetaOff < areaEnd {
+		areaEnd = m.MetaOff
+	}
+	if len(imgBytes) > areaEnd-fa.Offset {
+		return Mfg{}, man, errors.Errorf(
+			"image too large for flash area \"%s\": have=%d want<=%d",
+			areaName, len(imgBytes), areaEnd-fa.Offset)
+	}
+
+	dup := m.Clone()
+
+	imgEnd := fa.Offset + len(imgBytes)
+	if imgEnd > len(dup.Bin) {
+		dup.Bin = AddPadding(dup.Bin, man.EraseVal, imgEnd-len(dup.Bin))
+	}
+	copy(dup.Bin[fa.Offset:], imgBytes)
+
+	// Erase whatever remains of the old image.
+	eraseEnd := areaEnd
+	if eraseEnd > len(dup.Bin) {
+		eraseEnd = len(dup.Bin)
+	}
+	for i := imgEnd; i < eraseEnd; i++ {
+		dup.Bin[i] = man.EraseVal
+	}
+
+	if err := dup.RefillHash(man.EraseVal); err != nil {
+		return Mfg{}, man, err
+	}
+
+	hash, err := dup.Hash(man.EraseVal)
+	if err != nil {
+		return Mfg{}, man, err
+	}
+
+	newMan := man
+	newMan.MfgHash = hex.EncodeToString(hash)
+	newMan.Signatures = nil
+	newMan.Targets = append([]manifest.MfgManifestTarget(nil),
+		man.Targets...)
+	newMan.Targets[tgtIdx].Size = len(imgBytes)
+
+	return dup, newMan, nil
+}
@@ -0,0 +1,227 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package mfg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The default number of bytes buffered at a time by StreamEmit.
+const STREAM_DEFAULT_CHUNK_SIZE = 64 * 1024
+
+// StreamSection is a span of mfgimage content located at a fixed offset.
+// Size bytes are read from Data, starting at Data's offset 0.  An
+// *os.File or an *io.SectionReader is a typical source.
+type StreamSection struct {
+	Offset int
+	Size   int
+	Data   io.ReaderAt
+}
+
+// StreamOpts controls the behavior of StreamEmit.
+type StreamOpts struct {
+	EraseVal byte
+
+	// Size of the buffer used for reads and fill; 0 for the default.
+	ChunkSize int
+}
+
+// StreamEmit writes an mfgimage to w without holding the full image in
+// memory.  The image consists of the given sections and the optional MMR at
+// metaOff, with gaps filled with the erase value.  Sections may be
+// specified in any order but must not overlap each other or the MMR.
+//
+// If the MMR contains a hash TLV, it is filled in with the hash of the
+// emitted image, calculated as by RecalcHash.  Because the MMR usually
+// precedes other content, the sections are read twice: once to calculate
+// the hash and once to write the image.
+//
+// The mfgimage hash is returned.  Memory use is bounded by the chunk size
+// and the size of the MMR.
+func StreamEmit(w io.Writer, sections []StreamSection, meta *Meta,
+	metaOff int, opts StreamOpts) ([]byte, error) {
+
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = STREAM_DEFAULT_CHUNK_SIZE
+	}
+
+	spans := make([]streamSpan, 0, len(sections)+1)
+	for _, sect := range sections {
+		spans = append(spans, streamSpan{
+			off:  sect.Offset,
+			size: sect.Size,
+			data: sect.Data,
+		})
+	}
+
+	var dup Meta
+	if meta != nil {
+		dup = meta.Clone()
+		dup.ClearHash()
+		spans = append(spans, streamSpan{
+			off:  metaOff,
+			size: dup.Size(),
+			meta: &dup,
+		})
+	}
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].off < spans[j].off
+	})
+	for i := 1; i < len(spans); i++ {
+		prev := spans[i-1]
+		if spans[i].off < prev.off+prev.size {
+			return nil, errors.Errorf(
+				"mfg stream section at offset 0x%x overlaps "+
+					"section at offset 0x%x", spans[i].off, prev.off)
+		}
+	}
+
+	se := &streamEmitter{
+		spans: spans,
+		buf:   make([]byte, chunkSize),
+		fill:  bytes.Repeat([]byte{opts.EraseVal}, chunkSize),
+	}
+
+	h := sha256.New()
+	hashSink := func(b []byte) error {
+		h.Write(b)
+		return nil
+	}
+	writeSink := func(b []byte) error {
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrapf(err, "failed to write mfgimage")
+		}
+		return nil
+	}
+
+	hashTlv := dup.FindFirstTlv(META_TLV_TYPE_HASH)
+	if hashTlv == nil {
+		// No hash to fill in; hash and write in a single pass.
+		if err := se.emit(func(b []byte) error {
+			hashSink(b)
+			return writeSink(b)
+		}); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	// Pass 1: hash the image with a zeroed hash TLV.
+	if err := se.emit(hashSink); err != nil {
+		return nil, err
+	}
+	sum := h.Sum(nil)
+	copy(hashTlv.Data, sum)
+
+	// Pass 2: write the image.
+	if err := se.emit(writeSink); err != nil {
+		return nil, err
+	}
+
+	return sum, nil
+}
+
+// streamSpan is a section or the MMR.
+type streamSpan struct {
+	off  int
+	size int
+	data io.ReaderAt
+	meta *Meta
+}
+
+type streamEmitter struct {
+	spans []streamSpan
+	buf   []byte
+	fill  []byte
+}
+
+// emit passes the full image to sink in chunks.
+func (se *streamEmitter) emit(sink func(b []byte) error) error {
+	cur := 0
+	for _, span := range se.spans {
+		if err := se.emitFill(sink, span.off-cur); err != nil {
+			return err
+		}
+
+		if span.meta != nil {
+			b, err := span.meta.Bytes()
+			if err != nil {
+				return err
+			}
+			if err := sink(b); err != nil {
+				return err
+			}
+		} else if err := se.emitSection(sink, span); err != nil {
+			return err
+		}
+
+		cur = span.off + span.size
+	}
+
+	return nil
+}
+
+func (se *streamEmitter) emitFill(sink func(b []byte) error, n int) error {
+	for n > 0 {
+		c := n
+		if c > len(se.fill) {
+			c = len(se.fill)
+		}
+		if err := sink(se.fill[:c]); err != nil {
+			return err
+		}
+		n -= c
+	}
+
+	return nil
+}
+
+func (se *streamEmitter) emitSection(sink func(b []byte) error,
+	span streamSpan) error {
+
+	for done := 0; done < span.size; {
+		c := span.size - done
+		if c > len(se.buf) {
+			c = len(se.buf)
+		}
+		n, err := span.data.ReadAt(se.buf[:c], int64(done))
+		if n < c {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return errors.Wrapf(err,
+				"failed to read mfg stream section at offset 0x%x",
+				span.off)
+		}
+		if err := sink(se.buf[:c]); err != nil {
+			return err
+		}
+		done += c
+	}
+
+	return nil
+}
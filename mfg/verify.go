@@ -125,7 +125,19 @@ func (m *Mfg) validateManMmrs(man manifest.MfgManifest) error {
 // VerifyStructure checks an mfgimage's structure and internal consistency.  It
 // returns an error if the mfgimage is incorrect.
 func (m *Mfg) VerifyStructure(eraseVal byte) error {
+	if m.Meta != nil {
+		if err := m.Meta.CheckVersion(); err != nil {
+			return err
+		}
+	}
+
 	for _, t := range m.Tlvs() {
+		// TLVs from a newer MMR version are skipped; CheckVersion has
+		// verified that the MMR is newer than this library.
+		if MetaTlvTypeVersion(t.Header.Type) == 0 {
+			continue
+		}
+
 		// Verify that TLV has a valid `type` field.
 		body, err := t.StructuredBody()
 		if err != nil {
@@ -181,13 +193,36 @@ func (m *Mfg) VerifyManifest(man manifest.MfgManifest) error {
 		return err
 	}
 
+	policies, err := AreaPolicies(man)
+	if err != nil {
+		return err
+	}
+
+	fills, err := AreaFills(man)
+	if err != nil {
+		return err
+	}
+	for area := range fills {
+		if policies[area] == AREA_POLICY_SKIP {
+			return errors.Errorf(
+				"fill specified for skipped flash area \"%s\"", area)
+		}
+	}
+
 	// Make sure each target is fully present.
 	for _, t := range man.Targets {
-		if man.FindFlashAreaDevOff(man.Device, t.Offset) == nil {
+		fa := man.FindFlashAreaDevOff(man.Device, t.Offset)
+		if fa == nil {
 			return errors.Errorf(
 				"no flash area in mfgimage corresponding to target \"%s\"",
 				t.Name)
 		}
+
+		if p := policies[fa.Name]; p != AREA_POLICY_WRITE {
+			return errors.Errorf(
+				"target \"%s\" occupies flash area \"%s\" with policy %s",
+				t.Name, fa.Name, AreaPolicyString(p))
+		}
 	}
 
 	return nil
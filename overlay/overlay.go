@@ -0,0 +1,459 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package overlay implements patch artifacts: a signed list of (address,
+// bytes) patches applied on top of a device's existing contents, as used by
+// vendors shipping ROM patches alongside main images.
+//
+// Layout:
+//
+//	Header     (OVERLAY_HEADER_SIZE bytes)
+//	Patches    (OVERLAY_PATCH_HDR_SIZE bytes + data, 4-byte aligned, each)
+//	Trailer    (image.ImageTrailer)
+//	TLVs       (SHA256, then KEYHASH / signature pairs)
+//
+// The SHA256 TLV covers the header and patches.  Signatures cover the hash.
+package overlay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const (
+	OVERLAY_MAGIC          = 0x4f56524c /* "OVRL" */
+	OVERLAY_HEADER_SIZE    = 24
+	OVERLAY_PATCH_HDR_SIZE = 8
+	OVERLAY_PATCH_ALIGN    = 4
+)
+
+type OverlayHdr struct {
+	Magic      uint32
+	HdrSz      uint16
+	NumPatches uint16
+	PayloadSz  uint32 // Size of all patch records, including padding.
+	Flags      uint32
+	Vers       image.ImageVersion
+}
+
+type PatchHdr struct {
+	Addr uint32
+	Len  uint32
+}
+
+type Patch struct {
+	Addr uint32
+	Data []byte
+}
+
+type Overlay struct {
+	Header  OverlayHdr
+	Patches []Patch
+	Tlvs    []image.ImageTlv
+}
+
+func (p *Patch) end() uint64 {
+	return uint64(p.Addr) + uint64(len(p.Data))
+}
+
+func patchPadLen(dataLen int) int {
+	return (OVERLAY_PATCH_ALIGN - dataLen%OVERLAY_PATCH_ALIGN) %
+		OVERLAY_PATCH_ALIGN
+}
+
+// validatePatches ensures that no patch is empty, that no patch wraps the
+// 32-bit address space, and that no two patches overlap.
+func validatePatches(patches []Patch) error {
+	sorted := append([]Patch(nil), patches...)
+	sort.Slice(sorted, func(i int, j int) bool {
+		return sorted[i].Addr < sorted[j].Addr
+	})
+
+	for i, p := range sorted {
+		if len(p.Data) == 0 {
+			return errors.Errorf("empty patch at 0x%08x", p.Addr)
+		}
+		if p.end() > 1<<32 {
+			return errors.Errorf("patch at 0x%08x wraps address space",
+				p.Addr)
+		}
+		if i > 0 && sorted[i-1].end() > uint64(p.Addr) {
+			return errors.Errorf("patches at 0x%08x and 0x%08x overlap",
+				sorted[i-1].Addr, p.Addr)
+		}
+	}
+
+	return nil
+}
+
+// payload returns the hashed portion of an overlay: the header and patch
+// records.
+func (o *Overlay) payload() ([]byte, error) {
+	b := &bytes.Buffer{}
+
+	if err := binary.Write(b, binary.LittleEndian, &o.Header); err != nil {
+		return nil, errors.Wrapf(err, "failed to write overlay header")
+	}
+
+	for _, p := range o.Patches {
+		hdr := PatchHdr{
+			Addr: p.Addr,
+			Len:  uint32(len(p.Data)),
+		}
+		if err := binary.Write(b, binary.LittleEndian, &hdr); err != nil {
+			return nil, errors.Wrapf(err, "failed to write patch header")
+		}
+		b.Write(p.Data)
+		b.Write(make([]byte, patchPadLen(len(p.Data))))
+	}
+
+	return b.Bytes(), nil
+}
+
+// CalcHash calculates the SHA256 of an overlay's header and patches.
+func (o *Overlay) CalcHash() ([]byte, error) {
+	payload, err := o.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(payload)
+	return sum[:], nil
+}
+
+// Hash returns the contents of an overlay's SHA256 TLV.
+func (o *Overlay) Hash() ([]byte, error) {
+	for _, tlv := range o.Tlvs {
+		if tlv.Header.Type == image.IMAGE_TLV_SHA256 {
+			return tlv.Data, nil
+		}
+	}
+
+	return nil, errors.Errorf("overlay does not contain hash TLV")
+}
+
+// Create builds an overlay from a set of patches and signs it with each of
+// the provided signers.
+func Create(ver image.ImageVersion, patches []Patch,
+	signers []sec.Signer) (Overlay, error) {
+
+	if len(patches) == 0 {
+		return Overlay{}, errors.Errorf("overlay contains no patches")
+	}
+	if len(patches) > 0xffff {
+		return Overlay{}, errors.Errorf("too many patches: %d", len(patches))
+	}
+	if err := validatePatches(patches); err != nil {
+		return Overlay{}, err
+	}
+
+	payloadSz := 0
+	for _, p := range patches {
+		payloadSz += OVERLAY_PATCH_HDR_SIZE + len(p.Data) +
+			patchPadLen(len(p.Data))
+	}
+
+	o := Overlay{
+		Header: OverlayHdr{
+			Magic:      OVERLAY_MAGIC,
+			HdrSz:      OVERLAY_HEADER_SIZE,
+			NumPatches: uint16(len(patches)),
+			PayloadSz:  uint32(payloadSz),
+			Vers:       ver,
+		},
+	}
+	for _, p := range patches {
+		o.Patches = append(o.Patches, Patch{
+			Addr: p.Addr,
+			Data: append([]byte(nil), p.Data...),
+		})
+	}
+
+	hash, err := o.CalcHash()
+	if err != nil {
+		return Overlay{}, err
+	}
+
+	o.Tlvs = append(o.Tlvs, image.ImageTlv{
+		Header: image.ImageTlvHdr{
+			Type: image.IMAGE_TLV_SHA256,
+			Len:  uint16(len(hash)),
+		},
+		Data: hash,
+	})
+
+	sigTlvs, err := image.BuildSignerSigTlvs(signers, hash,
+		image.SigTlvOpts{})
+	if err != nil {
+		return Overlay{}, err
+	}
+	o.Tlvs = append(o.Tlvs, sigTlvs...)
+
+	return o, nil
+}
+
+// Bytes serializes an overlay.
+func (o *Overlay) Bytes() ([]byte, error) {
+	payload, err := o.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	b := bytes.NewBuffer(payload)
+
+	tlvSz := image.IMAGE_TRAILER_SIZE
+	for _, tlv := range o.Tlvs {
+		tlvSz += image.IMAGE_TLV_SIZE + len(tlv.Data)
+	}
+	if tlvSz > 0xffff {
+		return nil, errors.Errorf("overlay TLVs too large: %d bytes", tlvSz)
+	}
+
+	trailer := image.ImageTrailer{
+		Magic:     image.IMAGE_TRAILER_MAGIC,
+		TlvTotLen: uint16(tlvSz),
+	}
+	if err := binary.Write(b, binary.LittleEndian, &trailer); err != nil {
+		return nil, errors.Wrapf(err, "failed to write overlay trailer")
+	}
+
+	for _, tlv := range o.Tlvs {
+		if _, err := tlv.Write(b); err != nil {
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// WriteToFile writes a serialized overlay to a file.
+func (o *Overlay) WriteToFile(filename string) error {
+	b, err := o.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write overlay file")
+	}
+
+	return nil
+}
+
+// Parse decodes a serialized overlay.
+func Parse(data []byte) (Overlay, error) {
+	r := bytes.NewReader(data)
+
+	var o Overlay
+	if err := binary.Read(r, binary.LittleEndian, &o.Header); err != nil {
+		return Overlay{}, errors.Wrapf(err, "failed to read overlay header")
+	}
+	if o.Header.Magic != OVERLAY_MAGIC {
+		return Overlay{}, errors.Errorf(
+			"overlay magic incorrect; expected 0x%08x, got 0x%08x",
+			uint32(OVERLAY_MAGIC), o.Header.Magic)
+	}
+	if o.Header.HdrSz != OVERLAY_HEADER_SIZE {
+		return Overlay{}, errors.Errorf(
+			"overlay header size incorrect; expected %d, got %d",
+			OVERLAY_HEADER_SIZE, o.Header.HdrSz)
+	}
+
+	payloadEnd := OVERLAY_HEADER_SIZE + int(o.Header.PayloadSz)
+	if payloadEnd > len(data) {
+		return Overlay{}, errors.Errorf(
+			"overlay payload extends beyond end of data: "+
+				"payload-end=%d data-len=%d", payloadEnd, len(data))
+	}
+
+	for i := 0; i < int(o.Header.NumPatches); i++ {
+		var hdr PatchHdr
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return Overlay{}, errors.Wrapf(err,
+				"failed to read header of patch %d", i)
+		}
+
+		off := int(r.Size()) - r.Len()
+		end := off + int(hdr.Len) + patchPadLen(int(hdr.Len))
+		if hdr.Len > o.Header.PayloadSz || end > payloadEnd {
+			return Overlay{}, errors.Errorf(
+				"patch %d extends beyond overlay payload", i)
+		}
+
+		o.Patches = append(o.Patches, Patch{
+			Addr: hdr.Addr,
+			Data: append([]byte(nil), data[off:off+int(hdr.Len)]...),
+		})
+		r.Seek(int64(end), io.SeekStart)
+	}
+
+	if int(r.Size())-r.Len() != payloadEnd {
+		return Overlay{}, errors.Errorf(
+			"overlay payload size mismatch: header=%d actual=%d",
+			o.Header.PayloadSz, int(r.Size())-r.Len()-OVERLAY_HEADER_SIZE)
+	}
+
+	if err := validatePatches(o.Patches); err != nil {
+		return Overlay{}, err
+	}
+
+	var trailer image.ImageTrailer
+	if err := binary.Read(r, binary.LittleEndian, &trailer); err != nil {
+		return Overlay{}, errors.Wrapf(err, "failed to read overlay trailer")
+	}
+	if trailer.Magic != image.IMAGE_TRAILER_MAGIC {
+		return Overlay{}, errors.Errorf(
+			"overlay trailer magic incorrect; expected 0x%04x, got 0x%04x",
+			image.IMAGE_TRAILER_MAGIC, trailer.Magic)
+	}
+
+	tlvEnd := payloadEnd + int(trailer.TlvTotLen)
+	if tlvEnd > len(data) {
+		return Overlay{}, errors.Errorf(
+			"overlay TLVs extend beyond end of data: "+
+				"tlv-end=%d data-len=%d", tlvEnd, len(data))
+	}
+
+	for int(r.Size())-r.Len() < tlvEnd {
+		var tlv image.ImageTlv
+		if err := binary.Read(r, binary.LittleEndian, &tlv.Header); err != nil {
+			return Overlay{}, errors.Wrapf(err,
+				"failed to read overlay TLV header")
+		}
+
+		off := int(r.Size()) - r.Len()
+		if off+int(tlv.Header.Len) > tlvEnd {
+			return Overlay{}, errors.Errorf(
+				"overlay TLV extends beyond end of trailer")
+		}
+		tlv.Data = append([]byte(nil), data[off:off+int(tlv.Header.Len)]...)
+		r.Seek(int64(off+int(tlv.Header.Len)), io.SeekStart)
+
+		o.Tlvs = append(o.Tlvs, tlv)
+	}
+
+	return o, nil
+}
+
+// ReadOverlay reads and parses an overlay file.
+func ReadOverlay(filename string) (Overlay, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Overlay{}, errors.Wrapf(err, "failed to read overlay file")
+	}
+
+	o, err := Parse(data)
+	if err != nil {
+		return Overlay{}, errors.Wrapf(err, "%s", filename)
+	}
+
+	return o, nil
+}
+
+// VerifyHash compares an overlay's SHA256 TLV against its contents.
+func (o *Overlay) VerifyHash() error {
+	have, err := o.Hash()
+	if err != nil {
+		return err
+	}
+
+	want, err := o.CalcHash()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(have, want) {
+		return errors.Errorf(
+			"overlay contains incorrect hash: have=%x want=%x", have, want)
+	}
+
+	return nil
+}
+
+// VerifySigs checks an overlay's signatures against the provided set of
+// keys.  Unlike images, overlays must be signed.  The returned int is the
+// index of the key that verified a signature.
+func (o *Overlay) VerifySigs(keys []sec.PubSignKey) (int, error) {
+	sigs, err := image.CollectTlvSigs(o.Tlvs)
+	if err != nil {
+		return -1, err
+	}
+	if len(sigs) == 0 {
+		return -1, errors.Errorf("overlay is not signed")
+	}
+
+	hash, err := o.Hash()
+	if err != nil {
+		return -1, err
+	}
+
+	for i, key := range keys {
+		idx, err := sec.VerifySigs(key, sigs, hash)
+		if err != nil {
+			return -1, err
+		}
+		if idx != -1 {
+			return i, nil
+		}
+	}
+
+	return -1, errors.Errorf("overlay signatures do not match provided keys")
+}
+
+// Verify checks an overlay's hash and signatures.
+func (o *Overlay) Verify(keys []sec.PubSignKey) error {
+	if err := o.VerifyHash(); err != nil {
+		return err
+	}
+
+	if _, err := o.VerifySigs(keys); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Apply writes an overlay's patches into a memory image that starts at the
+// specified address.  Every patch must lie entirely within the memory
+// image.  Apply does not verify the overlay; call Verify first.
+func (o *Overlay) Apply(mem []byte, base uint32) error {
+	memEnd := uint64(base) + uint64(len(mem))
+
+	for _, p := range o.Patches {
+		if p.Addr < base || p.end() > memEnd {
+			return errors.Errorf(
+				"patch 0x%08x-0x%08x outside of memory 0x%08x-0x%08x",
+				p.Addr, p.end(), base, memEnd)
+		}
+	}
+
+	for _, p := range o.Patches {
+		copy(mem[p.Addr-base:], p.Data)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package overlay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestOverlayRoundTrip(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := sec.PrivSignKey{Ed25519: &priv}
+
+	patches := []Patch{
+		{Addr: 0x1000, Data: []byte{0xaa, 0xbb, 0xcc}},
+		{Addr: 0x1010, Data: []byte{0x11, 0x22, 0x33, 0x44, 0x55}},
+	}
+
+	o, err := Create(image.ImageVersion{Major: 1}, patches,
+		[]sec.Signer{&key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := o.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o2, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(o2.Patches) != len(patches) {
+		t.Fatalf("wrong patch count: have=%d want=%d",
+			len(o2.Patches), len(patches))
+	}
+
+	if err := o2.Verify([]sec.PubSignKey{key.PubKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := bytes.Repeat([]byte{0xff}, 0x20)
+	if err := o2.Apply(mem, 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mem[0:3], patches[0].Data) ||
+		!bytes.Equal(mem[0x10:0x15], patches[1].Data) || mem[3] != 0xff {
+
+		t.Fatalf("patches applied incorrectly: %x", mem)
+	}
+
+	if err := o2.Apply(make([]byte, 0x14), 0x1000); err == nil {
+		t.Fatalf("out-of-range patch applied")
+	}
+
+	// Corrupt a patch byte.
+	b[OVERLAY_HEADER_SIZE+OVERLAY_PATCH_HDR_SIZE] ^= 0xff
+	o3, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := o3.Verify([]sec.PubSignKey{key.PubKey()}); err == nil {
+		t.Fatalf("corrupt overlay verified")
+	}
+}
+
+func TestOverlayOverlap(t *testing.T) {
+	patches := []Patch{
+		{Addr: 0x1000, Data: make([]byte, 8)},
+		{Addr: 0x1004, Data: make([]byte, 8)},
+	}
+
+	if _, err := Create(image.ImageVersion{}, patches, nil); err == nil {
+		t.Fatalf("overlapping patches accepted")
+	}
+}
@@ -0,0 +1,584 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package pipeline runs the stages that turn a build output into a release
+// artifact: build, transform, encrypt, sign, package, and verify.  Each stage
+// is declared with its options; the pipeline executes the declared stages in
+// order and records the artifact each one produces.
+package pipeline
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/bundle"
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+type StageType int
+
+const (
+	STAGE_BUILD StageType = iota
+	STAGE_ENCRYPT
+	STAGE_SIGN
+	STAGE_PACKAGE
+	STAGE_VERIFY
+	STAGE_TRANSFORM
+)
+
+var stageTypeNameMap = map[StageType]string{
+	STAGE_BUILD:     "build",
+	STAGE_ENCRYPT:   "encrypt",
+	STAGE_SIGN:      "sign",
+	STAGE_PACKAGE:   "package",
+	STAGE_VERIFY:    "verify",
+	STAGE_TRANSFORM: "transform",
+}
+
+func StageTypeString(st StageType) string {
+	s := stageTypeNameMap[st]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func StageTypeFromString(s string) (StageType, error) {
+	for st, name := range stageTypeNameMap {
+		if s == name {
+			return st, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown pipeline stage: \"%s\"", s)
+}
+
+// TransformOpts configures the transform stage, which applies custom
+// processing steps to the built or input image.  The image must be unsigned
+// and unencrypted; its hash is recalculated afterwards.
+type TransformOpts struct {
+	Transformers []image.Transformer
+}
+
+// EncryptOpts configures the encrypt stage.  The image body is encrypted
+// with a random secret that is wrapped with Key.
+type EncryptOpts struct {
+	Key sec.PubEncKey
+}
+
+// SignOpts configures the sign stage.
+type SignOpts struct {
+	Signers []sec.Signer
+	TlvOpts image.SigTlvOpts
+
+	// If non-nil, receives an event per signature.
+	Audit         sec.AuditSink
+	AuditMetadata map[string]string
+}
+
+// PackageOpts configures the package stage.  If the manifest specifies
+// neither an image hash nor a build ID, both are set to the hash of the
+// packaged image.
+type PackageOpts struct {
+	Manifest     *manifest.Manifest
+	ReleaseNotes string
+	Sbom         *image.Sbom
+
+	// Recorded in the bundle's signing info.
+	Signer      string
+	SigningDate string
+
+	// If non-empty, the bundle is written to this file.
+	Filename string
+}
+
+// Pipeline declares the stages to execute.  Exactly one of Build and Input
+// specifies the image; every other stage is optional and is skipped if
+// nil.
+type Pipeline struct {
+	Build *image.ImageCreateOpts
+	Input *image.Image
+
+	Transform *TransformOpts
+	Encrypt   *EncryptOpts
+	Sign      *SignOpts
+	Package   *PackageOpts
+	Verify    *image.VerifyOpts
+}
+
+// StageResult is the artifact produced by a single stage.
+type StageResult struct {
+	Stage StageType
+
+	// The image as it was when the stage completed.
+	Image image.Image
+}
+
+// Result is the outcome of a pipeline run.  Stages lists the result of
+// each stage that completed, in execution order.
+type Result struct {
+	Stages []StageResult
+
+	// The final image.
+	Image image.Image
+
+	// Set by the package stage.
+	Bundle *bundle.Bundle
+
+	// Set by the verify stage.
+	Report *image.VerifyReport
+}
+
+// StageError indicates that a pipeline stage failed.
+type StageError struct {
+	Stage StageType
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("pipeline stage \"%s\" failed: %s",
+		StageTypeString(e.Stage), e.Err.Error())
+}
+
+func (e *StageError) Cause() error {
+	return e.Err
+}
+
+// StageFailed returns the stage that caused err, if any.
+func StageFailed(err error) (StageType, bool) {
+	if se, ok := err.(*StageError); ok {
+		return se.Stage, true
+	}
+
+	return 0, false
+}
+
+// Stages lists the stages the pipeline declares, in execution order.
+func (p *Pipeline) Stages() []StageType {
+	var stages []StageType
+
+	if p.Build != nil {
+		stages = append(stages, STAGE_BUILD)
+	}
+	if p.Transform != nil {
+		stages = append(stages, STAGE_TRANSFORM)
+	}
+	if p.Encrypt != nil {
+		stages = append(stages, STAGE_ENCRYPT)
+	}
+	if p.Sign != nil {
+		stages = append(stages, STAGE_SIGN)
+	}
+	if p.Package != nil {
+		stages = append(stages, STAGE_PACKAGE)
+	}
+	if p.Verify != nil {
+		stages = append(stages, STAGE_VERIFY)
+	}
+
+	return stages
+}
+
+// Validate checks the pipeline's declaration for conflicts that would
+// otherwise only be detected part way through a run.
+func (p *Pipeline) Validate() error {
+	if (p.Build == nil) == (p.Input == nil) {
+		return errors.Errorf(
+			"pipeline requires exactly one of a build stage and an input " +
+				"image")
+	}
+
+	if p.Transform != nil && p.Build != nil {
+		b := p.Build
+		if len(b.SigKeys) > 0 || len(b.Signers) > 0 {
+			return errors.Errorf(
+				"build stage must not sign an image that is transformed " +
+					"by a later stage")
+		}
+		if b.SrcEncKeyFilename != "" || b.ProvisionRecords != nil ||
+			b.SrcEncKeyIndex >= 0 {
+
+			return errors.Errorf(
+				"build stage must not encrypt an image that is " +
+					"transformed by a later stage")
+		}
+	}
+
+	if p.Encrypt != nil && p.Build != nil {
+		b := p.Build
+		if len(b.SigKeys) > 0 || len(b.Signers) > 0 {
+			return errors.Errorf(
+				"build stage must not sign an image that is encrypted " +
+					"by a later stage")
+		}
+		if b.SrcEncKeyFilename != "" || b.ProvisionRecords != nil ||
+			b.SrcEncKeyIndex >= 0 {
+
+			return errors.Errorf(
+				"build stage and encrypt stage both specify encryption")
+		}
+		if b.TsaUrl != "" {
+			return errors.Errorf(
+				"build stage must not timestamp an image that is " +
+					"encrypted by a later stage")
+		}
+	}
+
+	if p.Sign != nil && len(p.Sign.Signers) == 0 {
+		return errors.Errorf("sign stage specifies no signers")
+	}
+
+	if p.Sign != nil && p.Build != nil &&
+		len(p.Build.TlvLayout.Protected) > 0 {
+
+		return errors.Errorf(
+			"sign stage cannot add signatures to an image with " +
+				"protected signatures")
+	}
+
+	return nil
+}
+
+// initialHash returns the loader hash that precedes the image in its hash,
+// or nil for non-split images.
+func (p *Pipeline) initialHash() []byte {
+	if p.Build != nil {
+		return p.Build.LoaderHash
+	}
+
+	return nil
+}
+
+// realign recalculates the image's tail padding after its TLVs change.
+func (p *Pipeline) realign(img *image.Image) error {
+	if p.Build == nil || p.Build.Align <= 1 {
+		return nil
+	}
+
+	padVal := byte(0xff)
+	if p.Build.ImagePadVal != nil {
+		padVal = *p.Build.ImagePadVal
+	}
+
+	img.TailPad = nil
+	size, err := img.TotalSize()
+	if err != nil {
+		return err
+	}
+	if rem := size % p.Build.Align; rem != 0 {
+		img.TailPad = bytes.Repeat([]byte{padVal}, p.Build.Align-rem)
+	}
+
+	return nil
+}
+
+// checkModifiable ensures that changing an image will not invalidate any
+// signatures or other TLVs that cover the image hash.
+func checkModifiable(img image.Image) error {
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return err
+	}
+	if len(sigs) > 0 {
+		return errors.Errorf(
+			"image is signed; signatures would be invalidated")
+	}
+
+	for _, typ := range []uint8{
+		image.IMAGE_TLV_TIMESTAMP,
+		image.IMAGE_TLV_TLOG_ENTRY,
+		image.IMAGE_TLV_SERIAL_INFO,
+	} {
+		if len(img.FindTlvs(typ)) > 0 {
+			return errors.Errorf(
+				"image contains a %s TLV; it would be invalidated",
+				image.ImageTlvTypeName(typ))
+		}
+	}
+
+	return nil
+}
+
+func (p *Pipeline) runTransform(img image.Image) (image.Image, error) {
+	if img.IsEncrypted() {
+		return img, errors.Errorf(
+			"image is encrypted; transform it before the encrypt stage")
+	}
+	if err := checkModifiable(img); err != nil {
+		return img, err
+	}
+
+	out, err := image.ApplyTransformers(img, p.Transform.Transformers)
+	if err != nil {
+		return img, err
+	}
+
+	if !bytes.Equal(out.Body, img.Body) &&
+		len(out.FindProtTlvs(image.IMAGE_TLV_HASH_TREE)) > 0 {
+
+		return img, errors.Errorf(
+			"transformer modified the body of an image with a hash tree")
+	}
+
+	hash, err := out.CalcHash(p.initialHash())
+	if err != nil {
+		return img, err
+	}
+	tlv, err := out.HashTlv()
+	if err != nil {
+		return img, err
+	}
+	if tlv == nil {
+		return img, errors.Errorf("image lacks a hash TLV")
+	}
+	tlv.Data = hash
+
+	if p.Build != nil {
+		out.ArrangeTlvs(p.Build.TlvLayout)
+	}
+	if err := p.realign(&out); err != nil {
+		return img, err
+	}
+
+	return out, nil
+}
+
+func (p *Pipeline) runEncrypt(img image.Image) (image.Image, error) {
+	if img.IsEncrypted() {
+		return img, errors.Errorf("image is already encrypted")
+	}
+
+	if err := checkModifiable(img); err != nil {
+		return img, err
+	}
+
+	// The hash covers the header and the plaintext body.  Setting the
+	// encrypted flag changes the hash, so it must be recalculated.
+	plain := img.Clone()
+	hash, err := plain.CalcHash(p.initialHash())
+	if err != nil {
+		return img, err
+	}
+	oldHash, err := plain.Hash()
+	if err != nil {
+		return img, err
+	}
+	if !bytes.Equal(hash, oldHash) {
+		return img, errors.Errorf(
+			"image hash does not match its contents: calculated=%x tlv=%x",
+			hash, oldHash)
+	}
+
+	plain.Header.Flags |= image.IMAGE_F_ENCRYPTED
+	hash, err = plain.CalcHash(p.initialHash())
+	if err != nil {
+		return img, err
+	}
+
+	enc, err := image.Encrypt(plain, p.Encrypt.Key)
+	if err != nil {
+		return img, err
+	}
+
+	tlv, err := enc.HashTlv()
+	if err != nil {
+		return img, err
+	}
+	tlv.Data = hash
+
+	if p.Build != nil {
+		enc.ArrangeTlvs(p.Build.TlvLayout)
+	}
+	if err := p.realign(&enc); err != nil {
+		return img, err
+	}
+
+	return enc, nil
+}
+
+func (p *Pipeline) runSign(img image.Image) (image.Image, error) {
+	hash, err := img.Hash()
+	if err != nil {
+		return img, err
+	}
+
+	signers := p.Sign.Signers
+	if p.Sign.Audit != nil {
+		signers = sec.AuditSigners(signers, p.Sign.Audit,
+			p.Sign.AuditMetadata)
+	}
+
+	tlvs, err := image.BuildSignerSigTlvs(signers, hash, p.Sign.TlvOpts)
+	if err != nil {
+		return img, err
+	}
+
+	dup := img.Clone()
+	dup.Tlvs = append(dup.Tlvs, tlvs...)
+
+	if p.Build != nil {
+		dup.ArrangeTlvs(p.Build.TlvLayout)
+	}
+	if err := p.realign(&dup); err != nil {
+		return img, err
+	}
+
+	return dup, nil
+}
+
+func (p *Pipeline) runPackage(img image.Image) (*bundle.Bundle, error) {
+	opts := p.Package
+
+	info, err := bundle.NewSigningInfo(img)
+	if err != nil {
+		return nil, err
+	}
+	info.Signer = opts.Signer
+	info.Date = opts.SigningDate
+
+	b := &bundle.Bundle{
+		Image:        img,
+		ReleaseNotes: opts.ReleaseNotes,
+		Signing:      &info,
+		Sbom:         opts.Sbom,
+	}
+
+	if opts.Manifest != nil {
+		man := *opts.Manifest
+		if man.ImageHash == "" && man.BuildID == "" {
+			hash, err := img.Hash()
+			if err != nil {
+				return nil, err
+			}
+			man.ImageHash = hex.EncodeToString(hash)
+			man.BuildID = man.ImageHash
+		}
+		b.Manifest = &man
+	}
+
+	if err := b.Verify(nil); err != nil {
+		return nil, err
+	}
+
+	if opts.Filename != "" {
+		if err := b.WriteToFile(opts.Filename); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+func (p *Pipeline) runVerify(res *Result) error {
+	r := image.VerifyImage(res.Image, *p.Verify)
+	res.Report = &r
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if res.Bundle != nil {
+		if err := res.Bundle.Verify(p.Verify.SigKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run executes each declared stage in order.  If a stage fails, the
+// returned error is a *StageError identifying it, and the result describes
+// the stages that completed before it.
+func (p *Pipeline) Run() (Result, error) {
+	res := Result{}
+
+	if err := p.Validate(); err != nil {
+		return res, err
+	}
+
+	fail := func(stage StageType, err error) (Result, error) {
+		return res, &StageError{Stage: stage, Err: err}
+	}
+	done := func(stage StageType) {
+		res.Stages = append(res.Stages, StageResult{
+			Stage: stage,
+			Image: res.Image.Clone(),
+		})
+	}
+
+	if p.Build != nil {
+		img, err := image.GenerateImage(*p.Build)
+		if err != nil {
+			return fail(STAGE_BUILD, err)
+		}
+		res.Image = img
+		done(STAGE_BUILD)
+	} else {
+		res.Image = p.Input.Clone()
+	}
+
+	if p.Transform != nil {
+		img, err := p.runTransform(res.Image)
+		if err != nil {
+			return fail(STAGE_TRANSFORM, err)
+		}
+		res.Image = img
+		done(STAGE_TRANSFORM)
+	}
+
+	if p.Encrypt != nil {
+		img, err := p.runEncrypt(res.Image)
+		if err != nil {
+			return fail(STAGE_ENCRYPT, err)
+		}
+		res.Image = img
+		done(STAGE_ENCRYPT)
+	}
+
+	if p.Sign != nil {
+		img, err := p.runSign(res.Image)
+		if err != nil {
+			return fail(STAGE_SIGN, err)
+		}
+		res.Image = img
+		done(STAGE_SIGN)
+	}
+
+	if p.Package != nil {
+		b, err := p.runPackage(res.Image)
+		if err != nil {
+			return fail(STAGE_PACKAGE, err)
+		}
+		res.Bundle = b
+		done(STAGE_PACKAGE)
+	}
+
+	if p.Verify != nil {
+		if err := p.runVerify(&res); err != nil {
+			return fail(STAGE_VERIFY, err)
+		}
+		done(STAGE_VERIFY)
+	}
+
+	return res, nil
+}
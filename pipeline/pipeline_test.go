@@ -0,0 +1,207 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/apache/mynewt-artifact/sec/testkeys"
+)
+
+func testBuildOpts() *image.ImageCreateOpts {
+	return &image.ImageCreateOpts{
+		SrcBin:         make([]byte, 1000),
+		SrcEncKeyIndex: -1,
+		Version:        image.ImageVersion{Major: 1, Minor: 2, Rev: 3, BuildNum: 4},
+		Align:          8,
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	keys := testkeys.Default()
+	signKey := keys.SignKeys()[3]
+	encKey := keys.EncKey()
+
+	p := Pipeline{
+		Build:   testBuildOpts(),
+		Encrypt: &EncryptOpts{Key: encKey.PubEncKey()},
+		Sign:    &SignOpts{Signers: []sec.Signer{&signKey}},
+		Package: &PackageOpts{
+			Manifest: &manifest.Manifest{Name: "app", Version: "1.2.3.4"},
+			Signer:   "release",
+		},
+		Verify: &image.VerifyOpts{
+			SigKeys: []sec.PubSignKey{signKey.PubKey()},
+			EncKeys: []sec.PrivEncKey{encKey},
+			MinSigs: 1,
+		},
+	}
+
+	res, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Stages) != 5 {
+		t.Fatalf("wrong number of stage results: have=%d want=5",
+			len(res.Stages))
+	}
+	for i, st := range p.Stages() {
+		if res.Stages[i].Stage != st {
+			t.Fatalf("stage %d out of order: have=%s want=%s", i,
+				StageTypeString(res.Stages[i].Stage), StageTypeString(st))
+		}
+	}
+
+	built := res.Stages[0].Image
+	if built.IsEncrypted() {
+		t.Fatalf("build stage result is encrypted")
+	}
+	if !res.Image.IsEncrypted() {
+		t.Fatalf("final image is not encrypted")
+	}
+	if res.Report == nil || !res.Report.Passed() {
+		t.Fatalf("verify stage did not produce a passing report")
+	}
+	if res.Bundle == nil || res.Bundle.Signing.Signer != "release" {
+		t.Fatalf("package stage did not produce a bundle")
+	}
+
+	size, err := res.Image.TotalSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size%8 != 0 {
+		t.Fatalf("final image not aligned: size=%d", size)
+	}
+
+	// The encrypted image decrypts to the built body.
+	dec, err := image.Decrypt(res.Image, encKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(dec.Body) != string(built.Body) {
+		t.Fatalf("decrypted body differs from built body")
+	}
+
+	// A failing policy is attributed to the verify stage.
+	p.Verify.MinSigs = 2
+	res, err = p.Run()
+	if st, ok := StageFailed(err); !ok || st != STAGE_VERIFY {
+		t.Fatalf("expected verify stage failure; have err=%v", err)
+	}
+	if len(res.Stages) != 4 {
+		t.Fatalf("wrong number of completed stages: have=%d want=4",
+			len(res.Stages))
+	}
+
+	// Signing before encryption is rejected up front.
+	p.Build.SigKeys = []sec.PrivSignKey{signKey}
+	if _, err := p.Run(); err == nil {
+		t.Fatalf("build-time signature with encrypt stage accepted")
+	}
+}
+
+func TestPipelineInput(t *testing.T) {
+	keys := testkeys.Default()
+	signKey := keys.SignKeys()[0]
+
+	img, err := image.GenerateImage(*testBuildOpts())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := Pipeline{
+		Input:  &img,
+		Sign:   &SignOpts{Signers: []sec.Signer{&signKey}},
+		Verify: &image.VerifyOpts{SigKeys: []sec.PubSignKey{signKey.PubKey()}},
+	}
+
+	res, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stages) != 2 {
+		t.Fatalf("wrong number of stage results: have=%d want=2",
+			len(res.Stages))
+	}
+	if len(img.Tlvs) == len(res.Image.Tlvs) {
+		t.Fatalf("input image modified or not signed")
+	}
+
+	p.Build = testBuildOpts()
+	if _, err := p.Run(); err == nil {
+		t.Fatalf("pipeline with both build stage and input accepted")
+	}
+}
+
+func TestPipelineTransform(t *testing.T) {
+	signKey := testkeys.Default().SignKeys()[3]
+
+	stamp := image.NewTransformer("stamp",
+		func(img image.Image) (image.Image, error) {
+			img.ProtTlvs = append(img.ProtTlvs, image.ImageTlv{
+				Header: image.ImageTlvHdr{Type: 0xc0, Len: 4},
+				Data:   []byte("tele"),
+			})
+			return img, nil
+		})
+
+	p := Pipeline{
+		Build:     testBuildOpts(),
+		Transform: &TransformOpts{Transformers: []image.Transformer{stamp}},
+		Sign:      &SignOpts{Signers: []sec.Signer{&signKey}},
+		Verify: &image.VerifyOpts{
+			SigKeys: []sec.PubSignKey{signKey.PubKey()},
+			MinSigs: 1,
+		},
+	}
+
+	res, err := p.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Stages) != 4 || res.Stages[1].Stage != STAGE_TRANSFORM {
+		t.Fatalf("transform stage did not run after build")
+	}
+	if len(res.Image.FindProtTlvs(0xc0)) != 1 {
+		t.Fatalf("transformer TLV missing from final image")
+	}
+	if !res.Report.Passed() {
+		t.Fatalf("transformed image failed verification")
+	}
+
+	// A transformer cannot run on a signed image.
+	p.Build.SigKeys = []sec.PrivSignKey{signKey}
+	if _, err := p.Run(); err == nil {
+		t.Fatalf("build-time signature with transform stage accepted")
+	}
+
+	p.Build = nil
+	p.Input = &res.Image
+	p.Sign = nil
+	_, err = p.Run()
+	if st, ok := StageFailed(err); !ok || st != STAGE_TRANSFORM {
+		t.Fatalf("expected transform stage failure; have err=%v", err)
+	}
+}
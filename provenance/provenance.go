@@ -0,0 +1,451 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package provenance generates and verifies in-toto attestations carrying
+// SLSA build provenance for images.
+//
+// A statement's subject is the image hash (the SHA256 TLV), which covers the
+// header, body, and protected TLVs but not the signatures, so the statement
+// remains valid as signatures are added.  Statements are signed in a DSSE
+// envelope.  Because sec signers operate on SHA256 hashes, each signature
+// covers the SHA256 of the DSSE pre-authentication encoding.
+package provenance
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+const (
+	STATEMENT_TYPE        = "https://in-toto.io/Statement/v1"
+	SLSA_PREDICATE_TYPE   = "https://slsa.dev/provenance/v1"
+	DSSE_PAYLOAD_TYPE     = "application/vnd.in-toto+json"
+	MYNEWT_BUILD_TYPE     = "https://mynewt.apache.org/artifact/image/v1"
+	SUBJECT_DIGEST_SHA256 = "sha256"
+)
+
+// ResourceDescriptor identifies an artifact by URI and digest.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	Uri    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+type Builder struct {
+	Id      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+type BuildMetadata struct {
+	InvocationId string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+type BuildDefinition struct {
+	BuildType            string                 `json:"buildType"`
+	ExternalParameters   map[string]interface{} `json:"externalParameters"`
+	InternalParameters   map[string]interface{} `json:"internalParameters,omitempty"`
+	ResolvedDependencies []ResourceDescriptor   `json:"resolvedDependencies,omitempty"`
+}
+
+type RunDetails struct {
+	Builder  Builder        `json:"builder"`
+	Metadata *BuildMetadata `json:"metadata,omitempty"`
+}
+
+// Provenance is a SLSA v1 provenance predicate.
+type Provenance struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// Statement is an in-toto v1 statement with a SLSA provenance predicate.
+type Statement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     Provenance           `json:"predicate"`
+}
+
+type EnvelopeSig struct {
+	KeyId string `json:"keyid"` // Hex key hash (see PubSignKey.Hash()).
+	Sig   string `json:"sig"`   // Base64.
+}
+
+// Envelope is a DSSE envelope holding a serialized statement.
+type Envelope struct {
+	PayloadType string        `json:"payloadType"`
+	Payload     string        `json:"payload"` // Base64.
+	Signatures  []EnvelopeSig `json:"signatures"`
+}
+
+// BuildInfo describes how an image was produced.
+type BuildInfo struct {
+	Builder   Builder
+	Metadata  *BuildMetadata
+	Materials []ResourceDescriptor
+
+	// Parameters the build was invoked with (e.g., image creation
+	// options).  If BuildType is empty, MYNEWT_BUILD_TYPE is used.
+	BuildType  string
+	Parameters map[string]interface{}
+}
+
+// NewStatement produces a provenance statement for an image.  name is the
+// subject name, typically the image filename.
+func NewStatement(img image.Image, name string,
+	info BuildInfo) (Statement, error) {
+
+	hash, err := img.Hash()
+	if err != nil {
+		return Statement{}, err
+	}
+
+	buildType := info.BuildType
+	if buildType == "" {
+		buildType = MYNEWT_BUILD_TYPE
+	}
+
+	params := info.Parameters
+	if params == nil {
+		params = map[string]interface{}{}
+	}
+
+	return Statement{
+		Type: STATEMENT_TYPE,
+		Subject: []ResourceDescriptor{{
+			Name: name,
+			Digest: map[string]string{
+				SUBJECT_DIGEST_SHA256: hex.EncodeToString(hash),
+			},
+		}},
+		PredicateType: SLSA_PREDICATE_TYPE,
+		Predicate: Provenance{
+			BuildDefinition: BuildDefinition{
+				BuildType:            buildType,
+				ExternalParameters:   params,
+				ResolvedDependencies: info.Materials,
+			},
+			RunDetails: RunDetails{
+				Builder:  info.Builder,
+				Metadata: info.Metadata,
+			},
+		},
+	}, nil
+}
+
+// CreateOptsParameters describes image creation options as build parameters.
+// Key material is omitted; only key hashes are recorded.
+func CreateOptsParameters(opts image.ImageCreateOpts) (map[string]interface{},
+	error) {
+
+	var keyHashes []string
+	for _, key := range opts.SigKeys {
+		pub := key.PubKey()
+		h, err := pub.Hash()
+		if err != nil {
+			return nil, err
+		}
+		keyHashes = append(keyHashes, hex.EncodeToString(h))
+	}
+	for _, signer := range opts.Signers {
+		pub := signer.PubKey()
+		h, err := pub.Hash()
+		if err != nil {
+			return nil, err
+		}
+		keyHashes = append(keyHashes, hex.EncodeToString(h))
+	}
+
+	params := map[string]interface{}{
+		"version":           opts.Version.String(),
+		"sign_keys":         keyHashes,
+		"encrypted":         opts.SrcEncKeyFilename != "",
+		"header_pad":        opts.HdrPad,
+		"image_pad":         opts.ImagePad,
+		"align":             opts.Align,
+		"legacy_tlvs":       opts.UseLegacyTLV,
+		"embed_pubkey":      opts.EmbedPubKey,
+		"nonce_source":      image.NonceSourceString(opts.NonceSource),
+		"build_time_source": image.BuildTimeSourceString(opts.BuildTimeSource),
+	}
+	if opts.SrcEncKeyFilename != "" && opts.SrcEncKeyIndex >= 0 {
+		params["hw_key_index"] = opts.SrcEncKeyIndex
+	}
+	if opts.LoaderHash != nil {
+		params["loader_hash"] = hex.EncodeToString(opts.LoaderHash)
+	}
+	if opts.BuildId != nil {
+		params["build_id"] = hex.EncodeToString(opts.BuildId)
+	}
+
+	return params, nil
+}
+
+// pae computes the DSSE pre-authentication encoding.
+func pae(payloadType string, payload []byte) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "DSSEv1 %d %s %d ", len(payloadType), payloadType,
+		len(payload))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// Sign serializes a statement and signs it with each of the given signers.
+func (s *Statement) Sign(signers []sec.Signer) (Envelope, error) {
+	if len(signers) == 0 {
+		return Envelope{}, errors.Errorf("no signers provided")
+	}
+
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return Envelope{}, errors.Wrapf(err, "failed to encode statement")
+	}
+
+	hash := sha256.Sum256(pae(DSSE_PAYLOAD_TYPE, payload))
+
+	env := Envelope{
+		PayloadType: DSSE_PAYLOAD_TYPE,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+	}
+	for _, signer := range signers {
+		pub := signer.PubKey()
+		keyHash, err := pub.Hash()
+		if err != nil {
+			return Envelope{}, err
+		}
+
+		sig, err := signer.Sign(hash[:])
+		if err != nil {
+			return Envelope{}, errors.Wrapf(err, "failed to sign statement")
+		}
+
+		env.Signatures = append(env.Signatures, EnvelopeSig{
+			KeyId: hex.EncodeToString(keyHash),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		})
+	}
+
+	return env, nil
+}
+
+// ParseEnvelope decodes a JSON DSSE envelope.
+func ParseEnvelope(data []byte) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return env, errors.Wrapf(err, "failed to parse DSSE envelope")
+	}
+
+	return env, nil
+}
+
+// Verify checks the envelope's signatures and decodes its statement.  It
+// returns the statement and the number of distinct keys that produced a
+// valid signature; at least one is required.
+func (env *Envelope) Verify(keys []sec.PubSignKey) (Statement, int, error) {
+	if env.PayloadType != DSSE_PAYLOAD_TYPE {
+		return Statement{}, 0, errors.Errorf(
+			"unexpected DSSE payload type: \"%s\"", env.PayloadType)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return Statement{}, 0, errors.Errorf(
+			"DSSE payload is not valid base64")
+	}
+
+	hash := sha256.Sum256(pae(env.PayloadType, payload))
+
+	var sigs []sec.Sig
+	for _, s := range env.Signatures {
+		keyHash, err := hex.DecodeString(s.KeyId)
+		if err != nil {
+			return Statement{}, 0, errors.Errorf(
+				"DSSE signature has invalid key ID: \"%s\"", s.KeyId)
+		}
+		data, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			return Statement{}, 0, errors.Errorf(
+				"DSSE signature is not valid base64")
+		}
+
+		sigs = append(sigs, sec.Sig{KeyHash: keyHash, Data: data})
+	}
+
+	count := 0
+	for _, key := range keys {
+		idx, err := sec.VerifySigs(key, sigs, hash[:])
+		if err != nil {
+			return Statement{}, 0, err
+		}
+		if idx != -1 {
+			count++
+		}
+	}
+	if count == 0 {
+		return Statement{}, 0, errors.Errorf(
+			"statement not signed by any trusted key")
+	}
+
+	var stmt Statement
+	if err := json.Unmarshal(payload, &stmt); err != nil {
+		return Statement{}, 0, errors.Wrapf(err,
+			"failed to parse in-toto statement")
+	}
+
+	if stmt.Type != STATEMENT_TYPE {
+		return Statement{}, 0, errors.Errorf(
+			"unsupported statement type: \"%s\"", stmt.Type)
+	}
+	if stmt.PredicateType != SLSA_PREDICATE_TYPE {
+		return Statement{}, 0, errors.Errorf(
+			"unsupported predicate type: \"%s\"", stmt.PredicateType)
+	}
+
+	return stmt, count, nil
+}
+
+// Policy describes the provenance an image must have to be accepted.
+// Zero-valued fields impose no restriction.
+type Policy struct {
+	// Minimum number of trusted keys that must have signed the statement.
+	MinSigs int
+
+	// Acceptable builder IDs.
+	Builders []string
+
+	// Acceptable build types.
+	BuildTypes []string
+
+	// URIs that must appear among the statement's materials.  A trailing
+	// "*" matches any suffix.
+	RequiredMaterials []string
+
+	// Maximum age of the build, based on the build's finish time, relative
+	// to Now.
+	MaxAge time.Duration
+	Now    time.Time
+}
+
+func stringInList(s string, list []string) bool {
+	for _, l := range list {
+		if s == l {
+			return true
+		}
+	}
+
+	return false
+}
+
+func materialMatches(pattern string, uri string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(uri, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return pattern == uri
+}
+
+// VerifyImage verifies a provenance envelope for an image: the envelope must
+// be signed by the given keys, its subject must be the image, and its
+// predicate must satisfy the policy.  The verified statement is returned.
+func VerifyImage(img image.Image, env Envelope, keys []sec.PubSignKey,
+	policy Policy) (Statement, error) {
+
+	stmt, count, err := env.Verify(keys)
+	if err != nil {
+		return stmt, err
+	}
+
+	if count < policy.MinSigs {
+		return stmt, errors.Errorf(
+			"statement has too few trusted signatures: have=%d want>=%d",
+			count, policy.MinSigs)
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return stmt, err
+	}
+	hashStr := hex.EncodeToString(hash)
+
+	found := false
+	for _, subj := range stmt.Subject {
+		if subj.Digest[SUBJECT_DIGEST_SHA256] == hashStr {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return stmt, errors.Errorf(
+			"statement does not describe image %s", hashStr)
+	}
+
+	pred := &stmt.Predicate
+	if len(policy.Builders) > 0 &&
+		!stringInList(pred.RunDetails.Builder.Id, policy.Builders) {
+
+		return stmt, errors.Errorf("builder not allowed: \"%s\"",
+			pred.RunDetails.Builder.Id)
+	}
+
+	if len(policy.BuildTypes) > 0 &&
+		!stringInList(pred.BuildDefinition.BuildType, policy.BuildTypes) {
+
+		return stmt, errors.Errorf("build type not allowed: \"%s\"",
+			pred.BuildDefinition.BuildType)
+	}
+
+	for _, req := range policy.RequiredMaterials {
+		found := false
+		for _, m := range pred.BuildDefinition.ResolvedDependencies {
+			if materialMatches(req, m.Uri) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return stmt, errors.Errorf(
+				"statement lacks required material \"%s\"", req)
+		}
+	}
+
+	if policy.MaxAge > 0 {
+		md := pred.RunDetails.Metadata
+		if md == nil || md.FinishedOn == nil {
+			return stmt, errors.Errorf("statement lacks build finish time")
+		}
+		if policy.Now.Sub(*md.FinishedOn) > policy.MaxAge {
+			return stmt, errors.Errorf("build too old: finished %s",
+				md.FinishedOn.Format(time.RFC3339))
+		}
+	}
+
+	return stmt, nil
+}
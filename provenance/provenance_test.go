@@ -0,0 +1,148 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package provenance
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newKey(t *testing.T) sec.PrivSignKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sec.PrivSignKey{Ed25519: &priv}
+}
+
+func TestProvenance(t *testing.T) {
+	ic := image.NewImageCreator()
+	ic.Version = image.ImageVersion{Major: 1, Minor: 4}
+	ic.Body = make([]byte, 256)
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	params, err := CreateOptsParameters(image.ImageCreateOpts{
+		Version:        ic.Version,
+		SrcEncKeyIndex: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	stmt, err := NewStatement(img, "app.img", BuildInfo{
+		Builder: Builder{Id: "https://ci.example.com/builders/fw"},
+		Metadata: &BuildMetadata{
+			InvocationId: "build-42",
+			FinishedOn:   &finished,
+		},
+		Materials: []ResourceDescriptor{{
+			Uri:    "git+https://github.com/apache/mynewt-core@refs/tags/v1.4",
+			Digest: map[string]string{"gitCommit": "0123abcd"},
+		}},
+		Parameters: params,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := newKey(t)
+	env, err := stmt.Sign([]sec.Signer{&key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err = ParseEnvelope(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []sec.PubSignKey{key.PubKey()}
+	policy := Policy{
+		MinSigs:           1,
+		Builders:          []string{"https://ci.example.com/builders/fw"},
+		RequiredMaterials: []string{"git+https://github.com/apache/mynewt-core@*"},
+		MaxAge:            24 * time.Hour,
+		Now:               finished.Add(time.Hour),
+	}
+
+	have, err := VerifyImage(img, env, keys, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have.Predicate.BuildDefinition.ExternalParameters["version"] !=
+		"1.4.0.0" {
+
+		t.Fatalf("wrong build parameters: %+v",
+			have.Predicate.BuildDefinition.ExternalParameters)
+	}
+
+	// Policy violations.
+	bad := policy
+	bad.Builders = []string{"https://evil.example.com"}
+	if _, err := VerifyImage(img, env, keys, bad); err == nil {
+		t.Fatalf("disallowed builder accepted")
+	}
+
+	bad = policy
+	bad.RequiredMaterials = []string{"git+https://github.com/apache/mynewt-nimble@*"}
+	if _, err := VerifyImage(img, env, keys, bad); err == nil {
+		t.Fatalf("missing material accepted")
+	}
+
+	bad = policy
+	bad.Now = finished.Add(48 * time.Hour)
+	if _, err := VerifyImage(img, env, keys, bad); err == nil {
+		t.Fatalf("stale build accepted")
+	}
+
+	// Untrusted key.
+	other := newKey(t)
+	if _, err := VerifyImage(img, env, []sec.PubSignKey{other.PubKey()},
+		policy); err == nil {
+
+		t.Fatalf("statement from untrusted key accepted")
+	}
+
+	// Different image.
+	ic.Body[0] = 1
+	img2, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyImage(img2, env, keys, policy); err == nil {
+		t.Fatalf("statement for different image accepted")
+	}
+}
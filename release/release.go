@@ -0,0 +1,475 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package release checks that the artifacts in a release directory are
+// consistent with one another.
+//
+// A release typically contains images, the manifests produced alongside
+// them, and mfgimages that embed some of the images.  Each artifact may be
+// valid on its own while the set is not: a manifest may describe a rebuilt
+// image, or an mfgimage may embed an image other than the one being
+// released.  Check loads every artifact in a directory tree and produces a
+// single report for release sign-off.
+package release
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/mfg"
+)
+
+// Names of the checks in a release report:
+//
+//	image:     Image structure and hash.
+//	manifest:  A manifest matches the image it describes.
+//	mfg:       An mfgimage matches its mfg manifest.
+//	mfg_image: An image embedded in an mfgimage is in the release.
+//	version:   Artifacts built from the same target agree on version.
+const (
+	CHECK_IMAGE     = "image"
+	CHECK_MANIFEST  = "manifest"
+	CHECK_MFG       = "mfg"
+	CHECK_MFG_IMAGE = "mfg_image"
+	CHECK_VERSION   = "version"
+)
+
+// CheckResult is the outcome of a single check of a single artifact.
+type CheckResult struct {
+	Name string
+
+	// Slash-separated path of the artifact, relative to the release
+	// directory.
+	Path string
+
+	Passed bool
+	Detail string
+}
+
+// Report is the outcome of checking a release directory.
+type Report struct {
+	// Slash-separated paths of the artifacts found, relative to the release
+	// directory.
+	Images       []string
+	Manifests    []string
+	MfgImages    []string
+	MfgManifests []string
+
+	Checks []CheckResult
+
+	// Problems that do not cause a check to fail (e.g., an image without a
+	// manifest).
+	Warnings []string
+}
+
+// Passed indicates whether every check passed.
+func (r *Report) Passed() bool {
+	return len(r.Failures()) == 0
+}
+
+// Failures returns the results of all checks that did not pass.
+func (r *Report) Failures() []CheckResult {
+	var failures []CheckResult
+	for _, c := range r.Checks {
+		if !c.Passed {
+			failures = append(failures, c)
+		}
+	}
+
+	return failures
+}
+
+// Err returns an error describing each failed check, or nil if the release
+// is consistent.
+func (r *Report) Err() error {
+	failures := r.Failures()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, f := range failures {
+		msgs = append(msgs,
+			fmt.Sprintf("%s %s: %s", f.Name, f.Path, f.Detail))
+	}
+
+	return errors.Errorf("release is inconsistent: %s",
+		strings.Join(msgs, "; "))
+}
+
+func (r *Report) add(name string, path string, err error, detail string) {
+	res := CheckResult{
+		Name:   name,
+		Path:   path,
+		Passed: err == nil,
+		Detail: detail,
+	}
+	if err != nil {
+		res.Detail = err.Error()
+	}
+
+	r.Checks = append(r.Checks, res)
+}
+
+func (r *Report) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+type releaseImage struct {
+	path string
+	img  image.Image
+	hash string
+
+	// The manifest describing the image; nil if there is none.
+	man *manifest.Manifest
+}
+
+type releaseManifest struct {
+	path string
+	man  manifest.Manifest
+}
+
+type releaseMfgManifest struct {
+	path string
+	man  manifest.MfgManifest
+}
+
+// checker accumulates the artifacts in a release directory.
+type checker struct {
+	dir          string
+	r            Report
+	images       []*releaseImage
+	manifests    []releaseManifest
+	mfgManifests []releaseMfgManifest
+}
+
+// mfgBinPath returns the path of the mfgimage that accompanies the given mfg
+// manifest (e.g., "mfgimg.bin" for "mfgimg.json").
+func mfgBinPath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".bin"
+}
+
+// readFile classifies and loads a single file.  Files that are not
+// recognized artifacts are ignored.
+func (c *checker) readFile(rel string) error {
+	path := filepath.Join(c.dir, filepath.FromSlash(rel))
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", rel)
+	}
+
+	if _, ok := image.DetectEndianness(data); ok {
+		c.r.Images = append(c.r.Images, rel)
+
+		img, err := image.ParseImage(data)
+		if err != nil {
+			c.r.add(CHECK_IMAGE, rel, err, "")
+			return nil
+		}
+
+		ri := &releaseImage{path: rel, img: img}
+		if hash, err := img.Hash(); err == nil {
+			ri.hash = hex.EncodeToString(hash)
+		}
+		c.images = append(c.images, ri)
+		return nil
+	}
+
+	if filepath.Ext(rel) != ".json" {
+		return nil
+	}
+
+	if mman, err := manifest.ParseMfgManifest(data); err == nil &&
+		mman.MfgHash != "" {
+
+		c.r.MfgManifests = append(c.r.MfgManifests, rel)
+		c.mfgManifests = append(c.mfgManifests,
+			releaseMfgManifest{path: rel, man: mman})
+		return nil
+	}
+
+	if man, err := manifest.ParseManifest(data); err == nil &&
+		man.ImageHash != "" {
+
+		c.r.Manifests = append(c.r.Manifests, rel)
+		c.manifests = append(c.manifests,
+			releaseManifest{path: rel, man: man})
+	}
+
+	return nil
+}
+
+func (c *checker) scan() error {
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(c.dir, path)
+		if err != nil {
+			return err
+		}
+
+		return c.readFile(filepath.ToSlash(rel))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to scan release directory")
+	}
+
+	return nil
+}
+
+func (c *checker) checkImages() {
+	for _, ri := range c.images {
+		err := ri.img.VerifyStructure()
+		detail := "structure and hash valid"
+		if err == nil {
+			if ri.img.IsEncrypted() {
+				detail = "structure valid; encrypted, hash not checked"
+			} else {
+				_, err = ri.img.VerifyHash(nil)
+			}
+		}
+		c.r.add(CHECK_IMAGE, ri.path, err, detail)
+	}
+}
+
+func (c *checker) findImageByHash(hash string) *releaseImage {
+	for _, ri := range c.images {
+		if ri.hash != "" && ri.hash == strings.ToLower(hash) {
+			return ri
+		}
+	}
+
+	return nil
+}
+
+func (c *checker) findImageByName(path string) *releaseImage {
+	base := filepath.Base(filepath.FromSlash(path))
+	for _, ri := range c.images {
+		if filepath.Base(filepath.FromSlash(ri.path)) == base {
+			return ri
+		}
+	}
+
+	return nil
+}
+
+// checkManifests matches each manifest with the image it describes: by
+// hash, or failing that, by file name.
+func (c *checker) checkManifests() {
+	for i := range c.manifests {
+		rm := &c.manifests[i]
+
+		ri := c.findImageByHash(rm.man.ImageHash)
+		if ri == nil {
+			ri = c.findImageByName(rm.man.Image)
+		}
+		if ri == nil {
+			c.r.add(CHECK_MANIFEST, rm.path, errors.Errorf(
+				"described image not in release: hash=%s image=%s",
+				rm.man.ImageHash, rm.man.Image), "")
+			continue
+		}
+
+		err := ri.img.VerifyManifest(rm.man)
+		if err != nil {
+			err = errors.Wrapf(err, "image=%s", ri.path)
+		} else {
+			ri.man = &rm.man
+		}
+		c.r.add(CHECK_MANIFEST, rm.path, err, "describes "+ri.path)
+	}
+
+	for _, ri := range c.images {
+		if ri.man == nil {
+			c.r.warn("image has no manifest: %s", ri.path)
+		}
+	}
+}
+
+// targetImage returns the released image built from the named target.
+func (c *checker) targetImage(target string) *releaseImage {
+	for _, ri := range c.images {
+		if ri.man != nil && ri.man.Name == target {
+			return ri
+		}
+	}
+
+	return nil
+}
+
+func (c *checker) checkMfg(rm releaseMfgManifest) {
+	binRel := mfgBinPath(rm.path)
+	c.r.MfgImages = append(c.r.MfgImages, binRel)
+
+	data, err := ioutil.ReadFile(
+		filepath.Join(c.dir, filepath.FromSlash(binRel)))
+	if err != nil {
+		c.r.add(CHECK_MFG, rm.path, errors.Errorf(
+			"mfgimage not in release: %s", binRel), "")
+		return
+	}
+
+	metaEndOff := -1
+	if rm.man.Meta != nil {
+		metaEndOff = rm.man.Meta.EndOffset
+	}
+
+	m, err := mfg.Parse(data, metaEndOff, rm.man.EraseVal)
+	if err == nil {
+		err = m.VerifyStructure(rm.man.EraseVal)
+	}
+	if err == nil {
+		err = m.VerifyManifest(rm.man)
+	}
+	c.r.add(CHECK_MFG, binRel, err, "matches "+rm.path)
+	if err != nil {
+		return
+	}
+
+	imgs, err := m.ExtractImages(rm.man)
+	if err != nil {
+		c.r.add(CHECK_MFG_IMAGE, binRel, err, "")
+		return
+	}
+
+	// ExtractImages returns one image per non-boot target, in order.
+	var targets []manifest.MfgManifestTarget
+	for _, t := range rm.man.Targets {
+		if !t.IsBoot() {
+			targets = append(targets, t)
+		}
+	}
+
+	for i, img := range imgs {
+		target := targets[i].Name
+
+		hash, err := img.Hash()
+		if err != nil {
+			c.r.add(CHECK_MFG_IMAGE, binRel,
+				errors.Wrapf(err, "target=%s", target), "")
+			continue
+		}
+
+		if ri := c.findImageByHash(hex.EncodeToString(hash)); ri != nil {
+			c.r.add(CHECK_MFG_IMAGE, binRel, nil,
+				fmt.Sprintf("target %s embeds %s", target, ri.path))
+			continue
+		}
+
+		c.r.add(CHECK_MFG_IMAGE, binRel, errors.Errorf(
+			"target %s embeds an image not in release: hash=%x",
+			target, hash), "")
+
+		if ri := c.targetImage(target); ri != nil {
+			var err error
+			if image.CompareVersions(img.Header.Vers,
+				ri.img.Header.Vers) != 0 {
+
+				err = errors.Errorf(
+					"target %s version differs from released image: "+
+						"mfg=%s %s=%s",
+					target, img.Header.Vers.String(), ri.path,
+					ri.img.Header.Vers.String())
+			}
+			c.r.add(CHECK_VERSION, binRel, err,
+				fmt.Sprintf("target %s version matches %s", target,
+					ri.path))
+		}
+	}
+}
+
+// checkVersions verifies that released images built from the same target
+// have the same version.
+func (c *checker) checkVersions() {
+	byTarget := map[string][]*releaseImage{}
+	for _, ri := range c.images {
+		if ri.man != nil {
+			byTarget[ri.man.Name] = append(byTarget[ri.man.Name], ri)
+		}
+	}
+
+	var targets []string
+	for t := range byTarget {
+		targets = append(targets, t)
+	}
+	sort.Strings(targets)
+
+	for _, t := range targets {
+		ris := byTarget[t]
+		if len(ris) < 2 {
+			continue
+		}
+
+		var err error
+		for _, ri := range ris[1:] {
+			if image.CompareVersions(ri.img.Header.Vers,
+				ris[0].img.Header.Vers) != 0 {
+
+				err = errors.Errorf(
+					"target %s released with different versions: "+
+						"%s=%s %s=%s",
+					t, ris[0].path, ris[0].img.Header.Vers.String(),
+					ri.path, ri.img.Header.Vers.String())
+				break
+			}
+		}
+		c.r.add(CHECK_VERSION, ris[0].path, err,
+			fmt.Sprintf("all images of target %s agree", t))
+	}
+}
+
+// Check loads every image, manifest, and mfgimage beneath the given
+// directory and verifies that they are consistent with one another:
+// manifests match their images, mfgimages match their manifests and embed
+// only released images, and artifacts built from the same target agree on
+// version.  Images are recognized by their magic number, manifests by their
+// contents, and mfgimages by an accompanying mfg manifest of the same name.
+// An error is returned only if the directory cannot be read; problems with
+// the release are recorded in the report.
+func Check(dir string) (Report, error) {
+	c := checker{dir: dir}
+
+	if err := c.scan(); err != nil {
+		return c.r, err
+	}
+
+	c.checkImages()
+	c.checkManifests()
+	for _, rm := range c.mfgManifests {
+		c.checkMfg(rm)
+	}
+	c.checkVersions()
+
+	return c.r, nil
+}
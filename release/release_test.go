@@ -0,0 +1,184 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package release
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/mfg"
+)
+
+func copyFile(t *testing.T, src string, dst string) {
+	b, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeManifest(t *testing.T, path string, man manifest.Manifest) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := man.Write(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func failedChecks(r Report) map[string]bool {
+	m := map[string]bool{}
+	for _, f := range r.Failures() {
+		m[f.Name] = true
+	}
+	return m
+}
+
+func TestCheck(t *testing.T) {
+	dir := t.TempDir()
+
+	// An mfgimage and the application image it embeds.
+	const mfgName = "hash1-fm1-ext0-tgts1-sign0"
+	src := filepath.Join("..", "mfg", "testdata", mfgName)
+	copyFile(t, src+".bin", filepath.Join(dir, "mfgimg.bin"))
+	copyFile(t, src+".json", filepath.Join(dir, "mfgimg.json"))
+
+	mman, err := manifest.ReadMfgManifest(src + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ioutil.ReadFile(src + ".bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mfg.Parse(bin, mman.Meta.EndOffset, mman.EraseVal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgs, err := m.ExtractImages(mman)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := imgs[0]
+
+	appBin, err := app.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appPath := filepath.Join(dir, "blinky.img")
+	if err := ioutil.WriteFile(appPath, appBin, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := app.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	man := manifest.Manifest{
+		Name:      mman.Targets[1].Name,
+		Version:   app.Header.Vers.String(),
+		BuildID:   hex.EncodeToString(hash),
+		Image:     "/build/bin/blinky.img",
+		ImageHash: hex.EncodeToString(hash),
+	}
+	manPath := filepath.Join(dir, "manifest.json")
+	writeManifest(t, manPath, man)
+
+	r, err := Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Images) != 1 || len(r.Manifests) != 1 ||
+		len(r.MfgImages) != 1 || len(r.MfgManifests) != 1 {
+
+		t.Fatalf("wrong artifacts found: %+v", r)
+	}
+	if len(r.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", r.Warnings)
+	}
+
+	// A manifest that disagrees with its image.
+	bad := man
+	bad.Version = "9.9.9"
+	writeManifest(t, manPath, bad)
+	r, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := failedChecks(r); len(f) != 1 || !f[CHECK_MANIFEST] {
+		t.Fatalf("wrong failures: %v", r.Failures())
+	}
+	if len(r.Warnings) != 1 {
+		t.Fatalf("image without matching manifest not reported: %v",
+			r.Warnings)
+	}
+	writeManifest(t, manPath, man)
+
+	// A rebuilt application that the mfgimage does not embed.
+	ic := image.NewImageCreator()
+	ic.Body = make([]byte, 64)
+	ic.Version = image.ImageVersion{Major: 2}
+	rebuilt, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rebuilt.WriteToFile(appPath); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ = rebuilt.Hash()
+	man.Version = rebuilt.Header.Vers.String()
+	man.BuildID = hex.EncodeToString(hash)
+	man.ImageHash = man.BuildID
+	writeManifest(t, manPath, man)
+
+	r, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := failedChecks(r)
+	if len(f) != 2 || !f[CHECK_MFG_IMAGE] || !f[CHECK_VERSION] {
+		t.Fatalf("wrong failures: %v", r.Failures())
+	}
+
+	// A missing mfgimage.
+	if err := os.Remove(filepath.Join(dir, "mfgimg.bin")); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Check(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f := failedChecks(r); len(f) != 1 || !f[CHECK_MFG] {
+		t.Fatalf("wrong failures: %v", r.Failures())
+	}
+}
@@ -0,0 +1,265 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Signing operations can be audited by wrapping each Signer in an
+// AuditSigner.  Every signature attempt, successful or not, produces an
+// AuditEvent that is passed to a pluggable AuditSink.  If the sink fails to
+// record the event, the signature is discarded, so nothing is signed without
+// a record.
+
+const AUDIT_HTTP_TIMEOUT = 10 * time.Second
+
+// auditMtx serializes calls to audit sinks, so that sinks need not be safe
+// for concurrent use even when signatures are computed in parallel.
+var auditMtx sync.Mutex
+
+// AuditEvent describes a single signing operation.
+type AuditEvent struct {
+	Time     time.Time         `json:"time"`
+	KeyId    string            `json:"key_id"` // Hex SHA256 of the public key.
+	SigType  string            `json:"sig_type"`
+	Hash     string            `json:"hash"` // Hex digest that was signed.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// AuditSink records audit events.
+type AuditSink interface {
+	Record(ev AuditEvent) error
+}
+
+// AuditFunc adapts an ordinary function to the AuditSink interface.
+type AuditFunc func(ev AuditEvent) error
+
+func (f AuditFunc) Record(ev AuditEvent) error {
+	return f(ev)
+}
+
+// AuditSigner is a Signer that reports each signing operation to an audit
+// sink.
+type AuditSigner struct {
+	Signer   Signer
+	Sink     AuditSink
+	Metadata map[string]string // Caller-supplied; copied into each event.
+
+	// Used instead of time.Now if non-nil.
+	Now func() time.Time
+}
+
+// NewAuditSigner wraps a signer so that its signing operations are audited.
+func NewAuditSigner(signer Signer, sink AuditSink,
+	metadata map[string]string) *AuditSigner {
+
+	return &AuditSigner{
+		Signer:   signer,
+		Sink:     sink,
+		Metadata: metadata,
+	}
+}
+
+// AuditSigners wraps each of the given signers in an AuditSigner.
+func AuditSigners(signers []Signer, sink AuditSink,
+	metadata map[string]string) []Signer {
+
+	audited := make([]Signer, len(signers))
+	for i, signer := range signers {
+		audited[i] = NewAuditSigner(signer, sink, metadata)
+	}
+
+	return audited
+}
+
+func (s *AuditSigner) PubKey() PubSignKey {
+	return s.Signer.PubKey()
+}
+
+func (s *AuditSigner) event(hash []byte) AuditEvent {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+
+	ev := AuditEvent{
+		Time: now().UTC(),
+		Hash: hex.EncodeToString(hash),
+	}
+
+	pub := s.Signer.PubKey()
+	if b, err := pub.Bytes(); err == nil {
+		ev.KeyId = hex.EncodeToString(FullKeyHash(b))
+	}
+	if typ, err := pub.SigType(); err == nil {
+		ev.SigType = SigTypeString(typ)
+	}
+
+	if len(s.Metadata) > 0 {
+		ev.Metadata = make(map[string]string, len(s.Metadata))
+		for k, v := range s.Metadata {
+			ev.Metadata[k] = v
+		}
+	}
+
+	return ev
+}
+
+// Sign signs the hash with the wrapped signer and records the operation.
+func (s *AuditSigner) Sign(hash []byte) ([]byte, error) {
+	ev := s.event(hash)
+
+	sig, err := s.Signer.Sign(hash)
+	if err != nil {
+		ev.Error = err.Error()
+	}
+
+	auditMtx.Lock()
+	auditErr := s.Sink.Record(ev)
+	auditMtx.Unlock()
+
+	if auditErr != nil {
+		return nil, errors.Wrapf(auditErr, "failed to record signing audit event")
+	}
+
+	return sig, err
+}
+
+// WriterAuditSink writes each event to a writer as a line of JSON.
+type WriterAuditSink struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewWriterAuditSink creates a sink that writes JSON lines to w.
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+func (s *WriterAuditSink) Record(ev AuditEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode audit event")
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.w.Write(b); err != nil {
+		return errors.Wrapf(err, "failed to write audit event")
+	}
+
+	return nil
+}
+
+// FileAuditSink appends JSON lines to a file.
+type FileAuditSink struct {
+	WriterAuditSink
+	f *os.File
+}
+
+// OpenFileAuditSink opens an audit log file for appending, creating it if
+// necessary.
+func OpenFileAuditSink(filename string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(filename,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log")
+	}
+
+	return &FileAuditSink{
+		WriterAuditSink: WriterAuditSink{w: f},
+		f:               f,
+	}, nil
+}
+
+// Record appends an event to the file and syncs it to stable storage.
+func (s *FileAuditSink) Record(ev AuditEvent) error {
+	if err := s.WriterAuditSink.Record(ev); err != nil {
+		return err
+	}
+
+	if err := s.f.Sync(); err != nil {
+		return errors.Wrapf(err, "failed to sync audit log")
+	}
+
+	return nil
+}
+
+// Close closes the audit log file.
+func (s *FileAuditSink) Close() error {
+	return s.f.Close()
+}
+
+// HttpAuditSink POSTs each event as JSON to a URL.  Any status other than
+// 2xx is a failure.
+type HttpAuditSink struct {
+	Url    string
+	Header http.Header // Extra request headers (e.g., authorization).
+	Client *http.Client
+}
+
+func (s *HttpAuditSink) Record(ev AuditEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode audit event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.Url, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create audit request")
+	}
+	for k, vs := range s.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: AUDIT_HTTP_TIMEOUT}
+	}
+
+	rsp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "audit request failed")
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return errors.Errorf("audit request failed: %s", rsp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build !windows && !plan9
+
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"encoding/json"
+	"log/syslog"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// SyslogAuditSink sends each event to syslog as a JSON message.
+type SyslogAuditSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditSink connects to a syslog daemon.  If network and raddr are
+// empty, the local daemon is used.
+func NewSyslogAuditSink(network string, raddr string,
+	tag string) (*SyslogAuditSink, error) {
+
+	w, err := syslog.Dial(network, raddr,
+		syslog.LOG_NOTICE|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to syslog")
+	}
+
+	return &SyslogAuditSink{w: w}, nil
+}
+
+func (s *SyslogAuditSink) Record(ev AuditEvent) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode audit event")
+	}
+
+	if err := s.w.Notice(string(b)); err != nil {
+		return errors.Wrapf(err, "failed to write audit event to syslog")
+	}
+
+	return nil
+}
+
+// Close disconnects from the syslog daemon.
+func (s *SyslogAuditSink) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,43 @@
+//go:build windows || plan9
+
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// SyslogAuditSink is unavailable on this platform.
+type SyslogAuditSink struct{}
+
+func NewSyslogAuditSink(network string, raddr string,
+	tag string) (*SyslogAuditSink, error) {
+
+	return nil, errors.Errorf("syslog is not supported on this platform")
+}
+
+func (s *SyslogAuditSink) Record(ev AuditEvent) error {
+	return errors.Errorf("syslog is not supported on this platform")
+}
+
+func (s *SyslogAuditSink) Close() error {
+	return nil
+}
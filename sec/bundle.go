@@ -0,0 +1,183 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// An optional PEM header restricting how a key in a bundle is used.  By
+// default, a key is made available for every purpose its type supports.
+const KEY_BUNDLE_USAGE_HEADER = "Key-Usage"
+
+const (
+	KEY_BUNDLE_USAGE_SIGN    = "sign"
+	KEY_BUNDLE_USAGE_ENCRYPT = "encrypt"
+)
+
+// KeyBundle holds the keys found in a file containing several concatenated
+// PEM blocks.  Within each list, keys appear in file order.
+//
+// Because RSA keys can both sign and encrypt, an RSA key without a Key-Usage
+// header appears in both the signing and encryption lists.  Likewise, a P-256
+// public key is also usable for ECIES encryption.
+type KeyBundle struct {
+	PrivSignKeys []PrivSignKey
+	PubSignKeys  []PubSignKey
+	PrivEncKeys  []PrivEncKey
+	PubEncKeys   []PubEncKey
+}
+
+// NumKeys returns the total number of keys in the bundle, counting a key that
+// appears in several lists once per list.
+func (b *KeyBundle) NumKeys() int {
+	return len(b.PrivSignKeys) + len(b.PubSignKeys) +
+		len(b.PrivEncKeys) + len(b.PubEncKeys)
+}
+
+func bundleUsage(block *pem.Block) (bool, bool, error) {
+	usage, ok := block.Headers[KEY_BUNDLE_USAGE_HEADER]
+	if !ok {
+		return true, true, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(usage)) {
+	case KEY_BUNDLE_USAGE_SIGN:
+		return true, false, nil
+	case KEY_BUNDLE_USAGE_ENCRYPT:
+		return false, true, nil
+	default:
+		return false, false, errors.Errorf(
+			"invalid %s header: \"%s\"", KEY_BUNDLE_USAGE_HEADER, usage)
+	}
+}
+
+func isPrivKeyPemType(typ string) bool {
+	switch typ {
+	case "RSA PRIVATE KEY", "EC PRIVATE KEY", "PRIVATE KEY",
+		"ENCRYPTED PRIVATE KEY", "OPENSSH PRIVATE KEY":
+		return true
+	default:
+		return false
+	}
+}
+
+func isPubKeyPemType(typ string) bool {
+	return typ == "PUBLIC KEY" || typ == "RSA PUBLIC KEY"
+}
+
+func (b *KeyBundle) addPriv(block *pem.Block, sign bool, enc bool) error {
+	key, err := ParsePrivSignKey(pem.EncodeToMemory(block))
+	if err != nil {
+		return err
+	}
+
+	if key.Rsa == nil && !sign {
+		return errors.Errorf(
+			"only RSA private keys can be used for encryption")
+	}
+	if sign {
+		b.PrivSignKeys = append(b.PrivSignKeys, key)
+	}
+	if enc && key.Rsa != nil {
+		b.PrivEncKeys = append(b.PrivEncKeys, PrivEncKey{Rsa: key.Rsa})
+	}
+
+	return nil
+}
+
+func (b *KeyBundle) addPub(block *pem.Block, sign bool, enc bool) error {
+	itf, err := parsePubPemKey(pem.EncodeToMemory(block))
+	if err != nil {
+		return err
+	}
+
+	encKey := PubEncKey{}
+	switch pub := itf.(type) {
+	case *rsa.PublicKey:
+		encKey.Rsa = pub
+	case *ecdsa.PublicKey:
+		if pub.Curve.Params().Name == "P-256" {
+			encKey.Ec = pub
+		}
+	}
+	encOk := encKey.Rsa != nil || encKey.Ec != nil
+
+	if !sign && !encOk {
+		return errors.Errorf("%T public key cannot be used for encryption", itf)
+	}
+	if sign {
+		key, err := ParsePubSignKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return err
+		}
+		b.PubSignKeys = append(b.PubSignKeys, key)
+	}
+	if enc && encOk {
+		b.PubEncKeys = append(b.PubEncKeys, encKey)
+	}
+
+	return nil
+}
+
+// ParseKeyBundle parses every key in a sequence of concatenated PEM blocks.
+// Blocks that do not contain keys (e.g., certificates and EC PARAMETERS
+// blocks) are skipped.  An error is returned if any key block cannot be
+// parsed, or if the data contains no keys.
+func ParseKeyBundle(data []byte) (KeyBundle, error) {
+	b := KeyBundle{}
+
+	for idx := 0; ; idx++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		isPriv := isPrivKeyPemType(block.Type)
+		if !isPriv && !isPubKeyPemType(block.Type) {
+			continue
+		}
+
+		sign, enc, err := bundleUsage(block)
+		if err == nil {
+			if isPriv {
+				err = b.addPriv(block, sign, enc)
+			} else {
+				err = b.addPub(block, sign, enc)
+			}
+		}
+		if err != nil {
+			return b, errors.Wrapf(err,
+				"key bundle block %d (%s)", idx, block.Type)
+		}
+	}
+
+	if b.NumKeys() == 0 {
+		return b, errors.Errorf("key bundle contains no keys")
+	}
+
+	return b, nil
+}
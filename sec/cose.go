@@ -0,0 +1,435 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math"
+	"math/big"
+
+	"github.com/apache/mynewt-artifact/cbor"
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// COSE_Sign1 (RFC 9052) is a compact, single-signer signature envelope.
+// Devices that already carry a COSE parser can authenticate a document
+// signed this way without a JSON parser or X.509 support.  The payload is
+// embedded in the message.
+
+// COSE algorithm identifiers (RFC 9053).
+const (
+	COSE_ALG_ES256 = -7
+	COSE_ALG_EDDSA = -8
+	COSE_ALG_PS256 = -37
+)
+
+// COSE header labels.
+const (
+	COSE_HDR_ALG          = 1
+	COSE_HDR_CONTENT_TYPE = 3
+	COSE_HDR_KID          = 4
+)
+
+// The CBOR tag identifying a COSE_Sign1 message.
+const COSE_TAG_SIGN1 = 18
+
+var coseAlgNameMap = map[int64]string{
+	COSE_ALG_ES256: "ES256",
+	COSE_ALG_EDDSA: "EdDSA",
+	COSE_ALG_PS256: "PS256",
+}
+
+func CoseAlgString(alg int64) string {
+	s := coseAlgNameMap[alg]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+// coseAlgForKey returns the COSE algorithm used with a signing key.
+func coseAlgForKey(key PubSignKey) (int64, error) {
+	typ, err := key.SigType()
+	if err != nil {
+		return 0, err
+	}
+
+	switch typ {
+	case SIG_TYPE_ECDSA256:
+		return COSE_ALG_ES256, nil
+	case SIG_TYPE_RSA2048, SIG_TYPE_RSA3072:
+		return COSE_ALG_PS256, nil
+	case SIG_TYPE_ED25519:
+		if key.Ed25519Opts != nil && *key.Ed25519Opts != (Ed25519Opts{}) {
+			return 0, errors.Errorf(
+				"COSE EdDSA requires pure Ed25519 (no prehash or context)")
+		}
+		return COSE_ALG_EDDSA, nil
+	default:
+		return 0, errors.Errorf("key type not supported for COSE: %s",
+			SigTypeString(typ))
+	}
+}
+
+// CoseSign1Msg is a parsed COSE_Sign1 message.
+type CoseSign1Msg struct {
+	Alg         int64
+	KeyId       []byte // nil if the message does not identify its key.
+	ContentType uint64 // CoAP content format; 0 if unspecified.
+	Payload     []byte
+	Signature   []byte
+
+	protected []byte
+}
+
+// coseSigStructure returns the Sig_structure that a COSE_Sign1 signature
+// covers.  No externally supplied data is used.
+func coseSigStructure(protected []byte, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	cbor.WriteHead(buf, cbor.MAJOR_ARRAY, 4)
+	cbor.WriteText(buf, "Signature1")
+	cbor.WriteBytes(buf, protected)
+	cbor.WriteBytes(buf, nil)
+	cbor.WriteBytes(buf, payload)
+
+	return buf.Bytes()
+}
+
+// CoseSign1 signs a payload with the given signer and returns the tagged
+// COSE_Sign1 message.  contentType is the payload's CoAP content format
+// (e.g., 50 for JSON), or 0 to omit it.  The key is identified by its key
+// hash in the unprotected kid header.
+//
+// For EdDSA, the signer is passed the full Sig_structure rather than a
+// hash, since Ed25519 signs the message itself.
+func CoseSign1(payload []byte, contentType uint64,
+	signer Signer) ([]byte, error) {
+
+	pub := signer.PubKey()
+	alg, err := coseAlgForKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	keyHash, err := pub.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	prot := &bytes.Buffer{}
+	if contentType != 0 {
+		cbor.WriteHead(prot, cbor.MAJOR_MAP, 2)
+	} else {
+		cbor.WriteHead(prot, cbor.MAJOR_MAP, 1)
+	}
+	cbor.WriteInt(prot, COSE_HDR_ALG)
+	cbor.WriteInt(prot, alg)
+	if contentType != 0 {
+		cbor.WriteInt(prot, COSE_HDR_CONTENT_TYPE)
+		cbor.WriteHead(prot, cbor.MAJOR_UINT, contentType)
+	}
+
+	tbs := coseSigStructure(prot.Bytes(), payload)
+
+	var sig []byte
+	if alg == COSE_ALG_EDDSA {
+		sig, err = signer.Sign(tbs)
+	} else {
+		digest := sha256.Sum256(tbs)
+		sig, err = signer.Sign(digest[:])
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign COSE message")
+	}
+
+	if alg == COSE_ALG_ES256 {
+		// COSE uses the fixed-size r||s form rather than ASN.1.
+		var es ecdsaSig
+		if _, err := asn1.Unmarshal(sig, &es); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse ECDSA signature")
+		}
+		sig = make([]byte, 64)
+		es.R.FillBytes(sig[:32])
+		es.S.FillBytes(sig[32:])
+	}
+
+	buf := &bytes.Buffer{}
+	cbor.WriteHead(buf, cbor.MAJOR_TAG, COSE_TAG_SIGN1)
+	cbor.WriteHead(buf, cbor.MAJOR_ARRAY, 4)
+	cbor.WriteBytes(buf, prot.Bytes())
+	cbor.WriteHead(buf, cbor.MAJOR_MAP, 1)
+	cbor.WriteInt(buf, COSE_HDR_KID)
+	cbor.WriteBytes(buf, keyHash)
+	cbor.WriteBytes(buf, payload)
+	cbor.WriteBytes(buf, sig)
+
+	return buf.Bytes(), nil
+}
+
+// readCoseBytes reads a byte string.
+func readCoseBytes(r *cbor.Reader, what string) ([]byte, error) {
+	major, _, n, err := r.Head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cbor.MAJOR_BYTES {
+		return nil, errors.Errorf(
+			"COSE_Sign1 %s is not a byte string: major type %d", what, major)
+	}
+
+	return r.Next(n)
+}
+
+// readCoseHeaders reads a header map, calling fn with each label and value.
+func readCoseHeaders(r *cbor.Reader,
+	fn func(label int64, val interface{}) error) error {
+
+	major, _, n, err := r.Head()
+	if err != nil {
+		return err
+	}
+	if major != cbor.MAJOR_MAP {
+		return errors.Errorf(
+			"COSE header is not a map: major type %d", major)
+	}
+
+	seen := map[int64]struct{}{}
+	for i := uint64(0); i < n; i++ {
+		major, _, l, err := r.Head()
+		if err != nil {
+			return err
+		}
+
+		var label int64
+		switch {
+		case major == cbor.MAJOR_UINT && l <= math.MaxInt64:
+			label = int64(l)
+		case major == cbor.MAJOR_NEGINT && l <= math.MaxInt64:
+			label = -1 - int64(l)
+		default:
+			return errors.Errorf("unsupported COSE header label")
+		}
+		if _, ok := seen[label]; ok {
+			return errors.Errorf("duplicate COSE header label: %d", label)
+		}
+		seen[label] = struct{}{}
+
+		val, err := r.Value()
+		if err != nil {
+			return err
+		}
+		if err := fn(label, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ParseCoseSign1 parses a COSE_Sign1 message, tagged or untagged.  The
+// signature is not verified.
+func ParseCoseSign1(data []byte) (CoseSign1Msg, error) {
+	msg := CoseSign1Msg{}
+	r := cbor.NewReader(data)
+
+	major, _, n, err := r.Head()
+	if err != nil {
+		return msg, err
+	}
+	if major == cbor.MAJOR_TAG {
+		if n != COSE_TAG_SIGN1 {
+			return msg, errors.Errorf(
+				"not a COSE_Sign1 message: tag %d", n)
+		}
+		major, _, n, err = r.Head()
+		if err != nil {
+			return msg, err
+		}
+	}
+	if major != cbor.MAJOR_ARRAY || n != 4 {
+		return msg, errors.Errorf(
+			"not a COSE_Sign1 message: expected a 4-element array")
+	}
+
+	msg.protected, err = readCoseBytes(r, "protected header")
+	if err != nil {
+		return msg, err
+	}
+
+	hasAlg := false
+	prot := cbor.NewReader(msg.protected)
+	err = readCoseHeaders(prot, func(label int64, val interface{}) error {
+		switch label {
+		case COSE_HDR_ALG:
+			alg, ok := val.(int64)
+			if !ok {
+				return errors.Errorf("COSE alg header is not an integer")
+			}
+			msg.Alg = alg
+			hasAlg = true
+		case COSE_HDR_CONTENT_TYPE:
+			ct, ok := val.(int64)
+			if !ok || ct < 0 {
+				return errors.Errorf(
+					"unsupported COSE content type: %v", val)
+			}
+			msg.ContentType = uint64(ct)
+		}
+		return nil
+	})
+	if err != nil {
+		return msg, err
+	}
+	if prot.Remaining() != 0 {
+		return msg, errors.Errorf(
+			"trailing bytes after COSE protected header")
+	}
+	if !hasAlg {
+		return msg, errors.Errorf("COSE protected header lacks alg")
+	}
+
+	err = readCoseHeaders(r, func(label int64, val interface{}) error {
+		switch label {
+		case COSE_HDR_ALG:
+			return errors.Errorf("COSE alg header must be protected")
+		case COSE_HDR_KID:
+			kid, ok := val.([]byte)
+			if !ok {
+				return errors.Errorf("COSE kid header is not a byte string")
+			}
+			msg.KeyId = kid
+		}
+		return nil
+	})
+	if err != nil {
+		return msg, err
+	}
+
+	major, info, n, err := r.Head()
+	if err != nil {
+		return msg, err
+	}
+	if major == cbor.MAJOR_SIMPLE && info == 22 {
+		return msg, errors.Errorf("detached COSE payloads are not supported")
+	}
+	if major != cbor.MAJOR_BYTES {
+		return msg, errors.Errorf(
+			"COSE_Sign1 payload is not a byte string: major type %d", major)
+	}
+	msg.Payload, err = r.Next(n)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Signature, err = readCoseBytes(r, "signature")
+	if err != nil {
+		return msg, err
+	}
+
+	if r.Remaining() != 0 {
+		return msg, errors.Errorf(
+			"%d trailing bytes after COSE_Sign1 message", r.Remaining())
+	}
+
+	return msg, nil
+}
+
+// checkSig verifies the message's signature with the given key.
+func (msg *CoseSign1Msg) checkSig(key PubSignKey) (bool, error) {
+	alg, err := coseAlgForKey(key)
+	if err != nil || alg != msg.Alg {
+		return false, nil
+	}
+
+	if msg.KeyId != nil {
+		match, err := KeyHashMatchesKey(&key, msg.KeyId)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+
+	tbs := coseSigStructure(msg.protected, msg.Payload)
+	digest := sha256.Sum256(tbs)
+
+	switch alg {
+	case COSE_ALG_ES256:
+		if len(msg.Signature) != 64 {
+			return false, nil
+		}
+		sigAlg, ok := SigAlgForKey(&key)
+		if !ok {
+			return false, nil
+		}
+
+		// Convert the fixed-size r||s form back to ASN.1.
+		r := new(big.Int).SetBytes(msg.Signature[:32])
+		s := new(big.Int).SetBytes(msg.Signature[32:])
+		der, err := encodeEcSig(r, s, uint16(sigAlg.SigLen))
+		if err != nil {
+			return false, err
+		}
+		return sigAlg.Verify(&key, digest[:], der)
+
+	case COSE_ALG_PS256:
+		err := rsa.VerifyPSS(key.Rsa, crypto.SHA256, digest[:],
+			msg.Signature, &rsa.PSSOptions{
+				SaltLength: rsa.PSSSaltLengthEqualsHash,
+			})
+		return err == nil, nil
+
+	case COSE_ALG_EDDSA:
+		return ed25519.Verify(key.Ed25519, tbs, msg.Signature), nil
+
+	default:
+		return false, nil
+	}
+}
+
+// VerifyCoseSign1 parses a COSE_Sign1 message and checks its signature
+// against the given keys.  It returns the message and the index of the key
+// that produced the signature.
+func VerifyCoseSign1(data []byte, keys []PubSignKey) (CoseSign1Msg, int,
+	error) {
+
+	msg, err := ParseCoseSign1(data)
+	if err != nil {
+		return msg, -1, err
+	}
+
+	for i, key := range keys {
+		ok, err := msg.checkSig(key)
+		if err != nil {
+			return msg, -1, err
+		}
+		if ok {
+			return msg, i, nil
+		}
+	}
+
+	return msg, -1, errors.Errorf(
+		"COSE_Sign1 signature (%s) does not match provided keys",
+		CoseAlgString(msg.Alg))
+}
@@ -0,0 +1,207 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/cloudflare/circl/ecc/goldilocks"
+	"github.com/cloudflare/circl/sign/ed448"
+)
+
+// Ed448 (RFC 8032) signatures.  Neither the standard library nor
+// golang.org/x/crypto implements Ed448; the curve arithmetic is provided by
+// github.com/cloudflare/circl.
+
+const (
+	ED448_SEED_SIZE        = ed448.SeedSize
+	ED448_PUBLIC_KEY_SIZE  = ed448.PublicKeySize
+	ED448_PRIVATE_KEY_SIZE = ed448.PrivateKeySize
+	ED448_SIGNATURE_SIZE   = ed448.SignatureSize
+)
+
+// Ed448PublicKey is an encoded Ed448 point.
+type Ed448PublicKey []byte
+
+// Ed448PrivateKey is a seed followed by the corresponding public key, as in
+// golang.org/x/crypto/ed25519.
+type Ed448PrivateKey []byte
+
+var oidEd448 = asn1.ObjectIdentifier{1, 3, 101, 113}
+
+// NewEd448KeyFromSeed calculates a private key from a seed.
+func NewEd448KeyFromSeed(seed []byte) (Ed448PrivateKey, error) {
+	if len(seed) != ED448_SEED_SIZE {
+		return nil, errors.Errorf("ed448 seed has wrong size: have=%d want=%d",
+			len(seed), ED448_SEED_SIZE)
+	}
+
+	return Ed448PrivateKey(ed448.NewKeyFromSeed(seed)), nil
+}
+
+// GenerateEd448Key generates a private key using entropy from rand.
+func GenerateEd448Key(rand io.Reader) (Ed448PrivateKey, error) {
+	seed := make([]byte, ED448_SEED_SIZE)
+	if _, err := io.ReadFull(rand, seed); err != nil {
+		return nil, errors.Wrapf(err, "failed to generate ed448 seed")
+	}
+
+	return NewEd448KeyFromSeed(seed)
+}
+
+// Seed returns the private key's seed.
+func (key Ed448PrivateKey) Seed() []byte {
+	return append([]byte(nil), key[:ED448_SEED_SIZE]...)
+}
+
+// Public returns the private key's public half.
+func (key Ed448PrivateKey) Public() Ed448PublicKey {
+	return append(Ed448PublicKey(nil), key[ED448_SEED_SIZE:]...)
+}
+
+// signEd448 produces a pure Ed448 signature with the given context.
+func signEd448(key Ed448PrivateKey, msg []byte, context []byte) ([]byte, error) {
+	if len(key) != ED448_PRIVATE_KEY_SIZE {
+		return nil, errors.Errorf(
+			"ed448 private key has wrong size: have=%d want=%d",
+			len(key), ED448_PRIVATE_KEY_SIZE)
+	}
+	if len(context) > ed448.ContextMaxSize {
+		return nil, errors.Errorf(
+			"ed448 context too long: have=%d max=%d",
+			len(context), ed448.ContextMaxSize)
+	}
+
+	return ed448.Sign(ed448.PrivateKey(key), msg, string(context)), nil
+}
+
+// verifyEd448 checks a pure Ed448 signature with the given context.
+func verifyEd448(key Ed448PublicKey, msg []byte, sig []byte,
+	context []byte) bool {
+
+	if len(key) != ED448_PUBLIC_KEY_SIZE ||
+		len(context) > ed448.ContextMaxSize {
+
+		return false
+	}
+
+	return ed448.Verify(ed448.PublicKey(key), msg, sig, string(context))
+}
+
+// marshalEd448 encodes a public key as a PKIX SubjectPublicKeyInfo.
+func marshalEd448(key Ed448PublicKey) ([]byte, error) {
+	ret, err := asn1.Marshal(pkixPublicKey{
+		Algo: pkix.AlgorithmIdentifier{
+			Algorithm: oidEd448,
+		},
+		BitString: asn1.BitString{
+			Bytes:     key,
+			BitLength: 8 * len(key),
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode ed448 public key")
+	}
+
+	return ret, nil
+}
+
+// parseEd448PubKey decodes a PKIX SubjectPublicKeyInfo holding an Ed448 key.
+// The bool is false if the structure holds some other kind of key.
+func parseEd448PubKey(der []byte) (Ed448PublicKey, bool, error) {
+	var spki pkixPublicKey
+	if _, err := asn1.Unmarshal(der, &spki); err != nil {
+		return nil, false, nil
+	}
+	if !spki.Algo.Algorithm.Equal(oidEd448) {
+		return nil, false, nil
+	}
+
+	if len(spki.BitString.Bytes) != ED448_PUBLIC_KEY_SIZE {
+		return nil, true, errors.Errorf(
+			"ed448 public key has wrong size: have=%d want=%d",
+			len(spki.BitString.Bytes), ED448_PUBLIC_KEY_SIZE)
+	}
+	if _, err := goldilocks.FromBytes(spki.BitString.Bytes); err != nil {
+		return nil, true, errors.Wrapf(err, "invalid ed448 public key")
+	}
+
+	return Ed448PublicKey(spki.BitString.Bytes), true, nil
+}
+
+type pkcs8PrivateKey struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// MarshalEd448PrivateKey encodes a private key in unencrypted PKCS#8 form
+// (RFC 8410).
+func MarshalEd448PrivateKey(key Ed448PrivateKey) ([]byte, error) {
+	seed, err := asn1.Marshal(key.Seed())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode ed448 private key")
+	}
+
+	der, err := asn1.Marshal(pkcs8PrivateKey{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidEd448},
+		PrivateKey: seed,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode ed448 private key")
+	}
+
+	return der, nil
+}
+
+// MarshalEd448PublicKey encodes a public key as a PKIX SubjectPublicKeyInfo.
+func MarshalEd448PublicKey(key Ed448PublicKey) ([]byte, error) {
+	return marshalEd448(key)
+}
+
+// parsePkcs8PrivateKey parses an unencrypted PKCS#8 private key.  Ed448 keys
+// are handled here; all others are passed to the standard library.
+func parsePkcs8PrivateKey(der []byte) (interface{}, error) {
+	var p8 pkcs8PrivateKey
+	if _, err := asn1.Unmarshal(der, &p8); err == nil &&
+		p8.Algo.Algorithm.Equal(oidEd448) {
+
+		var seed []byte
+		if _, err := asn1.Unmarshal(p8.PrivateKey, &seed); err != nil {
+			return nil, errors.Wrapf(err, "invalid ed448 private key")
+		}
+
+		return NewEd448KeyFromSeed(seed)
+	}
+
+	return x509.ParsePKCS8PrivateKey(der)
+}
+
+func signEd448Alg(key *PrivSignKey, hash []byte) ([]byte, error) {
+	return signEd448(key.Ed448, hash, nil)
+}
+
+func verifyEd448Alg(key *PubSignKey, hash []byte, sig []byte) (bool, error) {
+	return verifyEd448(key.Ed448, hash, sig, nil), nil
+}
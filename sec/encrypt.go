@@ -31,7 +31,6 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
-	"io"
 
 	"golang.org/x/crypto/hkdf"
 
@@ -160,6 +159,65 @@ func (key *PubEncKey) EncType() (EncType, error) {
 	}
 }
 
+// ENC_KEY_FINGERPRINT_MIN_LEN is the shortest fingerprint prefix accepted by
+// MatchesFingerprint.
+const ENC_KEY_FINGERPRINT_MIN_LEN = 4
+
+// encKeyFingerprintAesTag separates AES key fingerprints from those of
+// public keys.
+const encKeyFingerprintAesTag = "mynewt-enc-key-aes"
+
+// Fingerprint returns a SHA256 digest identifying the key.  For RSA and EC
+// keys, this is the hash of the DER-encoded SubjectPublicKeyInfo.  An AES
+// key's fingerprint is computed from the encryption of an all-zero block (a
+// key check value), so the fingerprint does not reveal the key.
+func (key *PubEncKey) Fingerprint() ([]byte, error) {
+	var pubKey interface{}
+	if key.Rsa != nil {
+		pubKey = key.Rsa
+	} else if key.Ec != nil {
+		pubKey = key.Ec
+	}
+
+	if pubKey != nil {
+		der, err := x509.MarshalPKIXPublicKey(pubKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to marshal public key")
+		}
+		sum := sha256.Sum256(der)
+		return sum[:], nil
+	}
+
+	if key.Aes == nil {
+		return nil, errors.Errorf("invalid enc key: all members nil")
+	}
+
+	kcv := make([]byte, key.Aes.BlockSize())
+	key.Aes.Encrypt(kcv, kcv)
+
+	h := sha256.New()
+	h.Write([]byte(encKeyFingerprintAesTag))
+	h.Write(kcv)
+	return h.Sum(nil), nil
+}
+
+// MatchesFingerprint indicates whether the key has the given fingerprint.
+// A prefix of at least ENC_KEY_FINGERPRINT_MIN_LEN bytes is accepted.
+func (key *PubEncKey) MatchesFingerprint(fp []byte) (bool, error) {
+	full, err := key.Fingerprint()
+	if err != nil {
+		return false, err
+	}
+
+	if len(fp) < ENC_KEY_FINGERPRINT_MIN_LEN || len(fp) > len(full) {
+		return false, errors.Errorf(
+			"invalid enc key fingerprint length: have=%d want=%d-%d",
+			len(fp), ENC_KEY_FINGERPRINT_MIN_LEN, len(full))
+	}
+
+	return bytes.Equal(fp, full[:len(fp)]), nil
+}
+
 func encryptRsa(pubk *rsa.PublicKey, plainSecret []byte) ([]byte, error) {
 	rng := rand.Reader
 	cipherSecret, err := rsa.EncryptOAEP(
@@ -251,7 +309,9 @@ func (k *PrivEncKey) Decrypt(ciph []byte) ([]byte, error) {
 	return decryptRsa(k.Rsa, ciph)
 }
 
-func EncryptAES(plain []byte, secret []byte, nonce []byte) ([]byte, error) {
+// NewAESStream creates the AES-CTR stream used to encrypt and decrypt image
+// bodies.  The nonce is zero-padded to form the initial counter block.
+func NewAESStream(secret []byte, nonce []byte) (cipher.Stream, error) {
 	if len(nonce) > 16 {
 		return nil, errors.Errorf("AES nonce has invalid length: have=%d want<=16", len(nonce))
 	}
@@ -261,31 +321,20 @@ func EncryptAES(plain []byte, secret []byte, nonce []byte) ([]byte, error) {
 		return nil, errors.Errorf("Failed to create block cipher")
 	}
 
-	iv := nonce
-	for len(iv) < 16 {
-		iv = append(iv, 0)
-	}
-
-	stream := cipher.NewCTR(blk, iv)
+	iv := make([]byte, 16)
+	copy(iv, nonce)
 
-	dataBuf := make([]byte, 16)
-	encBuf := make([]byte, 16)
-	r := bytes.NewReader(plain)
-	w := bytes.Buffer{}
-	for {
-		cnt, err := r.Read(dataBuf)
-		if err != nil && err != io.EOF {
-			return nil, errors.Wrapf(err, "Failed to read from plaintext")
-		}
-		if cnt == 0 {
-			break
-		}
+	return cipher.NewCTR(blk, iv), nil
+}
 
-		stream.XORKeyStream(encBuf, dataBuf[0:cnt])
-		if _, err = w.Write(encBuf[0:cnt]); err != nil {
-			return nil, errors.Wrapf(err, "failed to write ciphertext")
-		}
+func EncryptAES(plain []byte, secret []byte, nonce []byte) ([]byte, error) {
+	stream, err := NewAESStream(secret, nonce)
+	if err != nil {
+		return nil, err
 	}
 
-	return w.Bytes(), nil
+	ciph := make([]byte, len(plain))
+	stream.XORKeyStream(ciph, plain)
+
+	return ciph, nil
 }
@@ -0,0 +1,223 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Derivation of per-device image encryption keys.  A device whose hardware
+// key is derived from a master key and its unique ID (e.g., a serial number
+// or the SoC's unique ID register) can be targeted by deriving the same key
+// here and encrypting the image with it.
+
+type KdfAlg int
+
+const (
+	// HKDF-SHA256 (RFC 5869).  The master key is the input keying material;
+	// the info string is the label followed by the device ID.
+	KDF_ALG_HKDF_SHA256 KdfAlg = iota
+
+	// NIST SP 800-108 KDF in counter mode with AES-CMAC as the PRF.  The
+	// master key must be a valid AES key.  The fixed input data is
+	// label || 0x00 || device ID || [L]32, where L is the output length in
+	// bits; the counter is a 32-bit big-endian prefix starting at 1.
+	KDF_ALG_CMAC
+)
+
+const KDF_DEFAULT_KEY_LEN = 16
+
+var kdfAlgNameMap = map[KdfAlg]string{
+	KDF_ALG_HKDF_SHA256: "hkdf-sha256",
+	KDF_ALG_CMAC:        "cmac",
+}
+
+func KdfAlgString(alg KdfAlg) string {
+	s := kdfAlgNameMap[alg]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func KdfAlgFromString(s string) (KdfAlg, error) {
+	for k, v := range kdfAlgNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown KDF algorithm: \"%s\"", s)
+}
+
+// KdfOpts configures device key derivation.
+type KdfOpts struct {
+	Alg   KdfAlg
+	Label []byte // Identifies the purpose of the derived key.
+	Salt  []byte // HKDF only; nil for none.
+
+	// Length of the derived key, in bytes: 16, 24, or 32.  0 means
+	// KDF_DEFAULT_KEY_LEN.
+	KeyLen int
+}
+
+// cmacDouble multiplies a block by x in GF(2^128).
+func cmacDouble(b []byte) []byte {
+	d := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		d[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if carry != 0 {
+		d[len(d)-1] ^= 0x87
+	}
+
+	return d
+}
+
+func cmac(block cipher.Block, msg []byte) []byte {
+	const bs = aes.BlockSize
+
+	l := make([]byte, bs)
+	block.Encrypt(l, l)
+	k1 := cmacDouble(l)
+	k2 := cmacDouble(k1)
+
+	n := (len(msg) + bs - 1) / bs
+	complete := n > 0 && len(msg)%bs == 0
+	if n == 0 {
+		n = 1
+	}
+
+	last := make([]byte, bs)
+	if complete {
+		copy(last, msg[(n-1)*bs:])
+		for i := range last {
+			last[i] ^= k1[i]
+		}
+	} else {
+		rem := msg[(n-1)*bs:]
+		copy(last, rem)
+		last[len(rem)] = 0x80
+		for i := range last {
+			last[i] ^= k2[i]
+		}
+	}
+
+	x := make([]byte, bs)
+	for i := 0; i < n-1; i++ {
+		for j := 0; j < bs; j++ {
+			x[j] ^= msg[i*bs+j]
+		}
+		block.Encrypt(x, x)
+	}
+	for j := 0; j < bs; j++ {
+		x[j] ^= last[j]
+	}
+	block.Encrypt(x, x)
+
+	return x
+}
+
+// AesCmac calculates the AES-CMAC (RFC 4493) of a message.
+func AesCmac(key []byte, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create CMAC cipher")
+	}
+
+	return cmac(block, msg), nil
+}
+
+func deriveCmac(master []byte, label []byte, deviceId []byte,
+	keyLen int) ([]byte, error) {
+
+	block, err := aes.NewCipher(master)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid CMAC KDF master key")
+	}
+
+	var fixed []byte
+	fixed = append(fixed, label...)
+	fixed = append(fixed, 0x00)
+	fixed = append(fixed, deviceId...)
+	fixed = binary.BigEndian.AppendUint32(fixed, uint32(keyLen*8))
+
+	var key []byte
+	for i := uint32(1); len(key) < keyLen; i++ {
+		msg := binary.BigEndian.AppendUint32(nil, i)
+		msg = append(msg, fixed...)
+		key = append(key, cmac(block, msg)...)
+	}
+
+	return key[:keyLen], nil
+}
+
+// DeriveDeviceKey derives a device's AES image encryption key from a master
+// key and the device's unique ID.
+func DeriveDeviceKey(master []byte, deviceId []byte,
+	opts KdfOpts) ([]byte, error) {
+
+	keyLen := opts.KeyLen
+	if keyLen == 0 {
+		keyLen = KDF_DEFAULT_KEY_LEN
+	}
+	if keyLen != 16 && keyLen != 24 && keyLen != 32 {
+		return nil, errors.Errorf(
+			"invalid derived key length: have=%d want=16, 24, or 32",
+			keyLen)
+	}
+
+	if len(master) == 0 {
+		return nil, errors.Errorf("empty KDF master key")
+	}
+	if len(deviceId) == 0 {
+		return nil, errors.Errorf("empty device ID")
+	}
+
+	switch opts.Alg {
+	case KDF_ALG_HKDF_SHA256:
+		info := append(append([]byte(nil), opts.Label...), deviceId...)
+		key := make([]byte, keyLen)
+		r := hkdf.New(sha256.New, master, opts.Salt, info)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, errors.Wrapf(err, "HKDF failed")
+		}
+		return key, nil
+
+	case KDF_ALG_CMAC:
+		if opts.Salt != nil {
+			return nil, errors.Errorf("CMAC KDF does not take a salt")
+		}
+		return deriveCmac(master, opts.Label, deviceId, keyLen)
+
+	default:
+		return nil, errors.Errorf("unknown KDF algorithm: %d", opts.Alg)
+	}
+}
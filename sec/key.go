@@ -27,3 +27,9 @@ func RawKeyHash(pubKeyBytes []byte) []byte {
 	sum := sha256.Sum256(pubKeyBytes)
 	return sum[:4]
 }
+
+// FullKeyHash produces the untruncated key hash used by MCUboot's imgtool.
+func FullKeyHash(pubKeyBytes []byte) []byte {
+	sum := sha256.Sum256(pubKeyBytes)
+	return sum[:]
+}
@@ -0,0 +1,229 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// The number of digest bytes in a KEYHASH TLV by default, and the most and
+// fewest that a key hash scheme may specify.
+const (
+	KEY_HASH_LEN_DEFAULT = 4
+	KEY_HASH_LEN_MIN     = 4
+	KEY_HASH_LEN_FULL    = sha256.Size
+)
+
+// KeyHashEncoding selects the representation of a public key that is hashed
+// to produce its key hash.
+type KeyHashEncoding int
+
+const (
+	// The encoding written to PUBKEY TLVs: PKCS#1 for RSA keys and
+	// SubjectPublicKeyInfo for all others.
+	KEY_HASH_ENCODING_PUBKEY KeyHashEncoding = iota
+
+	// The bare key: the RSA modulus, the uncompressed EC point, or the
+	// encoded EdDSA or ML-DSA key.
+	KEY_HASH_ENCODING_RAW
+)
+
+var keyHashEncodingNameMap = map[KeyHashEncoding]string{
+	KEY_HASH_ENCODING_PUBKEY: "pubkey",
+	KEY_HASH_ENCODING_RAW:    "raw",
+}
+
+func KeyHashEncodingString(enc KeyHashEncoding) string {
+	s := keyHashEncodingNameMap[enc]
+	if s == "" {
+		return "???"
+	}
+
+	return s
+}
+
+func KeyHashEncodingFromString(s string) (KeyHashEncoding, error) {
+	for enc, name := range keyHashEncodingNameMap {
+		if s == name {
+			return enc, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown key hash encoding: \"%s\"", s)
+}
+
+// KeyHashScheme describes how a KEYHASH TLV identifies a public key: the
+// SHA256 of the key's encoding, truncated to Len bytes.  The zero value is
+// the default scheme.  Boot loaders that store 8- or 16-byte key
+// identifiers need a matching scheme.
+type KeyHashScheme struct {
+	// The number of leading digest bytes retained; 0 means
+	// KEY_HASH_LEN_DEFAULT.
+	Len int
+
+	Encoding KeyHashEncoding
+}
+
+func (s KeyHashScheme) hashLen() int {
+	if s.Len == 0 {
+		return KEY_HASH_LEN_DEFAULT
+	}
+
+	return s.Len
+}
+
+// Validate ensures the scheme specifies a usable length and encoding.
+func (s KeyHashScheme) Validate() error {
+	if n := s.hashLen(); n < KEY_HASH_LEN_MIN || n > KEY_HASH_LEN_FULL {
+		return errors.Errorf(
+			"invalid key hash length: have=%d want=%d-%d",
+			n, KEY_HASH_LEN_MIN, KEY_HASH_LEN_FULL)
+	}
+
+	if _, ok := keyHashEncodingNameMap[s.Encoding]; !ok {
+		return errors.Errorf("invalid key hash encoding: %d", s.Encoding)
+	}
+
+	return nil
+}
+
+// String produces the textual form accepted by ParseKeyHashScheme; e.g.,
+// "16" or "32:raw".
+func (s KeyHashScheme) String() string {
+	str := strconv.Itoa(s.hashLen())
+	if s.Encoding != KEY_HASH_ENCODING_PUBKEY {
+		str += ":" + KeyHashEncodingString(s.Encoding)
+	}
+
+	return str
+}
+
+// ParseKeyHashScheme parses a key hash scheme of the form
+// <len>[:<encoding>], where len is a byte count or "full".
+func ParseKeyHashScheme(s string) (KeyHashScheme, error) {
+	scheme := KeyHashScheme{}
+
+	parts := strings.SplitN(s, ":", 2)
+	if parts[0] == "full" {
+		scheme.Len = KEY_HASH_LEN_FULL
+	} else {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return scheme, errors.Errorf("invalid key hash scheme: \"%s\"", s)
+		}
+		scheme.Len = n
+	}
+
+	if len(parts) > 1 {
+		enc, err := KeyHashEncodingFromString(parts[1])
+		if err != nil {
+			return scheme, err
+		}
+		scheme.Encoding = enc
+	}
+
+	if err := scheme.Validate(); err != nil {
+		return scheme, err
+	}
+
+	return scheme, nil
+}
+
+// keyHashInput produces the encoding of a public key that is hashed.
+func keyHashInput(key *PubSignKey, enc KeyHashEncoding) ([]byte, error) {
+	if enc == KEY_HASH_ENCODING_PUBKEY {
+		return key.Bytes()
+	}
+
+	switch {
+	case key.Rsa != nil:
+		return key.Rsa.N.Bytes(), nil
+	case key.Ec != nil:
+		return elliptic.Marshal(key.Ec.Curve, key.Ec.X, key.Ec.Y), nil
+	case key.Ed25519 != nil:
+		return append([]byte(nil), key.Ed25519...), nil
+	case key.MlDsa != nil:
+		return mlDsaPubBytes(key.MlDsa), nil
+	case key.Ed448 != nil:
+		return append([]byte(nil), key.Ed448...), nil
+	default:
+		return nil, errors.Errorf("invalid key: no non-nil members")
+	}
+}
+
+// Hash produces the key hash of the given public key.
+func (s KeyHashScheme) Hash(key *PubSignKey) ([]byte, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+
+	b, err := keyHashInput(key, s.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:s.hashLen()], nil
+}
+
+// decodeKeyHash parses a hex-encoded key hash of any supported length.
+func decodeKeyHash(s string) ([]byte, error) {
+	keyHash, err := hex.DecodeString(s)
+	if err != nil || len(keyHash) < KEY_HASH_LEN_MIN ||
+		len(keyHash) > KEY_HASH_LEN_FULL {
+
+		return nil, errors.Errorf("invalid key hash: \"%s\"", s)
+	}
+
+	return keyHash, nil
+}
+
+// KeyHashMatchesKey indicates whether a KEYHASH TLV value identifies the
+// given public key under any supported scheme: any truncation of at least
+// KEY_HASH_LEN_MIN bytes, of either encoding.
+func KeyHashMatchesKey(key *PubSignKey, keyHash []byte) (bool, error) {
+	if len(keyHash) < KEY_HASH_LEN_MIN || len(keyHash) > KEY_HASH_LEN_FULL {
+		return false, nil
+	}
+
+	for _, enc := range []KeyHashEncoding{
+		KEY_HASH_ENCODING_PUBKEY,
+		KEY_HASH_ENCODING_RAW,
+	} {
+		b, err := keyHashInput(key, enc)
+		if err != nil {
+			return false, err
+		}
+
+		sum := sha256.Sum256(b)
+		if bytes.Equal(keyHash, sum[:len(keyHash)]) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
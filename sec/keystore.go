@@ -0,0 +1,464 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// A keystore is a single file holding several named keys.  The key
+// material is encrypted with AES-256-GCM under a random data key; the data
+// key itself is protected by a KeyWrapper (a password or an external key
+// management service).
+
+const KEYSTORE_VERSION = 1
+
+const (
+	KEYSTORE_DATA_KEY_SIZE     = 32
+	KEYSTORE_SALT_SIZE         = 16
+	KEYSTORE_PBKDF2_ITERATIONS = 200000
+)
+
+type KeystoreKeyType int
+
+const (
+	KEYSTORE_KEY_SIGN KeystoreKeyType = iota
+	KEYSTORE_KEY_ENC
+)
+
+var keystoreKeyTypeNameMap = map[KeystoreKeyType]string{
+	KEYSTORE_KEY_SIGN: "sign",
+	KEYSTORE_KEY_ENC:  "enc",
+}
+
+func KeystoreKeyTypeString(typ KeystoreKeyType) string {
+	s := keystoreKeyTypeNameMap[typ]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func KeystoreKeyTypeFromString(s string) (KeystoreKeyType, error) {
+	for k, v := range keystoreKeyTypeNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown keystore key type: \"%s\"", s)
+}
+
+// KeyWrapper protects a keystore's data key.
+type KeyWrapper interface {
+	// Identifies the protection method; recorded in the keystore file.
+	Method() string
+
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// KeystoreKey is a single named key.  Data holds the key in any format
+// accepted by ParsePrivSignKey or ParsePrivEncKey, as appropriate.
+type KeystoreKey struct {
+	Name string
+	Type KeystoreKeyType
+	Data []byte
+}
+
+type Keystore struct {
+	keys map[string]KeystoreKey
+}
+
+type keystoreJsonKey struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+type keystoreJsonBody struct {
+	Keys []keystoreJsonKey `json:"keys"`
+}
+
+type keystoreJson struct {
+	Version    int    `json:"version"`
+	Method     string `json:"method"`
+	WrappedKey []byte `json:"wrapped_key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func NewKeystore() *Keystore {
+	return &Keystore{
+		keys: map[string]KeystoreKey{},
+	}
+}
+
+func checkKeystoreKey(typ KeystoreKeyType, data []byte) error {
+	switch typ {
+	case KEYSTORE_KEY_SIGN:
+		_, err := ParsePrivSignKey(data)
+		return err
+
+	case KEYSTORE_KEY_ENC:
+		_, err := ParsePrivEncKey(data)
+		return err
+
+	default:
+		return errors.Errorf("unknown keystore key type: %d", typ)
+	}
+}
+
+// AddKey stores a key under the given name.  The key is parsed to ensure it
+// is usable as the specified type.
+func (ks *Keystore) AddKey(name string, typ KeystoreKeyType,
+	data []byte) error {
+
+	if name == "" {
+		return errors.Errorf("keystore key name is empty")
+	}
+	if _, ok := ks.keys[name]; ok {
+		return errors.Errorf("keystore already contains key \"%s\"", name)
+	}
+
+	if err := checkKeystoreKey(typ, data); err != nil {
+		return errors.Wrapf(err, "invalid %s key \"%s\"",
+			KeystoreKeyTypeString(typ), name)
+	}
+
+	ks.keys[name] = KeystoreKey{
+		Name: name,
+		Type: typ,
+		Data: append([]byte(nil), data...),
+	}
+
+	return nil
+}
+
+// RemoveKey deletes the named key from the keystore.
+func (ks *Keystore) RemoveKey(name string) error {
+	if _, ok := ks.keys[name]; !ok {
+		return errors.Errorf("keystore does not contain key \"%s\"", name)
+	}
+
+	delete(ks.keys, name)
+	return nil
+}
+
+// GetKey retrieves the named key.
+func (ks *Keystore) GetKey(name string) (KeystoreKey, error) {
+	k, ok := ks.keys[name]
+	if !ok {
+		return KeystoreKey{}, errors.Errorf(
+			"keystore does not contain key \"%s\"", name)
+	}
+
+	return k, nil
+}
+
+// GetSignKey retrieves and parses the named signing key.
+func (ks *Keystore) GetSignKey(name string) (PrivSignKey, error) {
+	k, err := ks.GetKey(name)
+	if err != nil {
+		return PrivSignKey{}, err
+	}
+	if k.Type != KEYSTORE_KEY_SIGN {
+		return PrivSignKey{}, errors.Errorf(
+			"keystore key \"%s\" is not a signing key", name)
+	}
+
+	return ParsePrivSignKey(k.Data)
+}
+
+// GetEncKey retrieves and parses the named encryption key.
+func (ks *Keystore) GetEncKey(name string) (PrivEncKey, error) {
+	k, err := ks.GetKey(name)
+	if err != nil {
+		return PrivEncKey{}, err
+	}
+	if k.Type != KEYSTORE_KEY_ENC {
+		return PrivEncKey{}, errors.Errorf(
+			"keystore key \"%s\" is not an encryption key", name)
+	}
+
+	return ParsePrivEncKey(k.Data)
+}
+
+// Names returns the names of all keys in the keystore, sorted.
+func (ks *Keystore) Names() []string {
+	var names []string
+	for name := range ks.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// keystoreAad binds the unencrypted keystore fields to the ciphertext.
+func keystoreAad(version int, method string) []byte {
+	b := make([]byte, 4, 4+len(method))
+	binary.BigEndian.PutUint32(b, uint32(version))
+	return append(b, method...)
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create AES cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create GCM cipher")
+	}
+
+	return gcm, nil
+}
+
+// Marshal serializes and encrypts the keystore.
+func (ks *Keystore) Marshal(w KeyWrapper) ([]byte, error) {
+	var body keystoreJsonBody
+	for _, name := range ks.Names() {
+		k := ks.keys[name]
+		body.Keys = append(body.Keys, keystoreJsonKey{
+			Name: k.Name,
+			Type: KeystoreKeyTypeString(k.Type),
+			Data: k.Data,
+		})
+	}
+
+	plain, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode keystore")
+	}
+
+	dataKey := make([]byte, KEYSTORE_DATA_KEY_SIZE)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, errors.Wrapf(err, "random generation error")
+	}
+
+	wrapped, err := w.Wrap(dataKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to wrap keystore data key")
+	}
+
+	gcm, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrapf(err, "random generation error")
+	}
+
+	kj := keystoreJson{
+		Version:    KEYSTORE_VERSION,
+		Method:     w.Method(),
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plain,
+			keystoreAad(KEYSTORE_VERSION, w.Method())),
+	}
+
+	b, err := json.MarshalIndent(kj, "", "    ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode keystore")
+	}
+
+	return b, nil
+}
+
+// UnmarshalKeystore decrypts and parses a serialized keystore.
+func UnmarshalKeystore(data []byte, w KeyWrapper) (*Keystore, error) {
+	var kj keystoreJson
+	if err := json.Unmarshal(data, &kj); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse keystore")
+	}
+
+	if kj.Version != KEYSTORE_VERSION {
+		return nil, errors.Errorf("unsupported keystore version: %d",
+			kj.Version)
+	}
+	if kj.Method != w.Method() {
+		return nil, errors.Errorf(
+			"keystore protection method mismatch: have=%s want=%s",
+			kj.Method, w.Method())
+	}
+
+	dataKey, err := w.Unwrap(kj.WrappedKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unwrap keystore data key")
+	}
+
+	gcm, err := newGcm(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(kj.Nonce) != gcm.NonceSize() {
+		return nil, errors.Errorf("keystore nonce has invalid length: %d",
+			len(kj.Nonce))
+	}
+
+	plain, err := gcm.Open(nil, kj.Nonce, kj.Ciphertext,
+		keystoreAad(kj.Version, kj.Method))
+	if err != nil {
+		return nil, errors.Errorf("failed to decrypt keystore")
+	}
+
+	var body keystoreJsonBody
+	if err := json.Unmarshal(plain, &body); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse keystore contents")
+	}
+
+	ks := NewKeystore()
+	for _, k := range body.Keys {
+		typ, err := KeystoreKeyTypeFromString(k.Type)
+		if err != nil {
+			return nil, err
+		}
+		if err := ks.AddKey(k.Name, typ, k.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return ks, nil
+}
+
+// Save encrypts the keystore and writes it to a file.
+func (ks *Keystore) Save(filename string, w KeyWrapper) error {
+	b, err := ks.Marshal(w)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filename, b, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write keystore file")
+	}
+
+	return nil
+}
+
+// LoadKeystore reads and decrypts a keystore file.
+func LoadKeystore(filename string, w KeyWrapper) (*Keystore, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read keystore file")
+	}
+
+	ks, err := UnmarshalKeystore(b, w)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", filename)
+	}
+
+	return ks, nil
+}
+
+// passwordWrapper protects a data key with a key derived from a password via
+// PBKDF2-SHA256.  The wrapped form is:
+//
+//	iterations (4 bytes, big endian) | salt | GCM nonce | GCM ciphertext
+type passwordWrapper struct {
+	password []byte
+}
+
+// NewPasswordWrapper creates a KeyWrapper that protects a keystore with a
+// password.
+func NewPasswordWrapper(password []byte) KeyWrapper {
+	return &passwordWrapper{
+		password: append([]byte(nil), password...),
+	}
+}
+
+func (pw *passwordWrapper) Method() string {
+	return "password"
+}
+
+func (pw *passwordWrapper) gcm(salt []byte, iterations int) (cipher.AEAD,
+	error) {
+
+	kek := pbkdf2.Key(pw.password, salt, iterations, KEYSTORE_DATA_KEY_SIZE,
+		sha256.New)
+	return newGcm(kek)
+}
+
+func (pw *passwordWrapper) Wrap(dataKey []byte) ([]byte, error) {
+	salt := make([]byte, KEYSTORE_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrapf(err, "random generation error")
+	}
+
+	gcm, err := pw.gcm(salt, KEYSTORE_PBKDF2_ITERATIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrapf(err, "random generation error")
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, KEYSTORE_PBKDF2_ITERATIONS)
+	b = append(b, salt...)
+	b = append(b, nonce...)
+	return gcm.Seal(b, nonce, dataKey, nil), nil
+}
+
+func (pw *passwordWrapper) Unwrap(wrapped []byte) ([]byte, error) {
+	const nonceSize = 12
+
+	if len(wrapped) < 4+KEYSTORE_SALT_SIZE+nonceSize {
+		return nil, errors.Errorf("wrapped keystore key too short")
+	}
+
+	iterations := int(binary.BigEndian.Uint32(wrapped))
+	if iterations <= 0 || iterations > 100*KEYSTORE_PBKDF2_ITERATIONS {
+		return nil, errors.Errorf("invalid PBKDF2 iteration count: %d",
+			iterations)
+	}
+	salt := wrapped[4 : 4+KEYSTORE_SALT_SIZE]
+	nonce := wrapped[4+KEYSTORE_SALT_SIZE : 4+KEYSTORE_SALT_SIZE+nonceSize]
+	ciph := wrapped[4+KEYSTORE_SALT_SIZE+nonceSize:]
+
+	gcm, err := pw.gcm(salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := gcm.Open(nil, nonce, ciph, nil)
+	if err != nil {
+		return nil, errors.Errorf("incorrect keystore password")
+	}
+
+	return dataKey, nil
+}
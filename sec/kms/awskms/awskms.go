@@ -0,0 +1,116 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package awskms implements an image signer backed by an AWS KMS asymmetric
+// key.  Supported key specs are ECC_NIST_P256, RSA_2048, and RSA_3072.
+package awskms
+
+import (
+	"context"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/apache/mynewt-artifact/sec/kms"
+)
+
+// AWS KMS signing algorithms used for image signatures.  RSA images use PSS
+// with a salt as long as the hash, which is what AWS KMS produces.
+const (
+	SIGNING_ALG_ECDSA_SHA256   = "ECDSA_SHA_256"
+	SIGNING_ALG_RSA_PSS_SHA256 = "RSASSA_PSS_SHA_256"
+)
+
+// Client is the subset of the AWS KMS API needed for signing.  It is
+// typically implemented as a thin wrapper around kms.Client from the AWS SDK.
+type Client interface {
+	// GetPublicKey returns the DER-encoded SubjectPublicKeyInfo of the
+	// specified key.
+	GetPublicKey(ctx context.Context, keyId string) ([]byte, error)
+
+	// Sign signs a SHA256 digest (MessageType DIGEST) with the specified
+	// key and signing algorithm.
+	Sign(ctx context.Context, keyId string, digest []byte,
+		alg string) ([]byte, error)
+}
+
+// Signer signs images with an AWS KMS key.
+type Signer struct {
+	ctx    context.Context
+	client Client
+	keyId  string
+	alg    string
+	pub    sec.PubSignKey
+}
+
+// NewSigner creates a signer for the specified KMS key ID, ARN, or alias.
+// The key's public half is retrieved immediately.  ctx applies to that
+// request and to every subsequent signing request.
+func NewSigner(ctx context.Context, client Client,
+	keyId string) (*Signer, error) {
+
+	der, err := client.GetPublicKey(ctx, keyId)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to retrieve public key of AWS KMS key %s", keyId)
+	}
+
+	pub, err := kms.ParsePubKey(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "AWS KMS key %s", keyId)
+	}
+
+	alg := SIGNING_ALG_ECDSA_SHA256
+	if pub.Rsa != nil {
+		alg = SIGNING_ALG_RSA_PSS_SHA256
+	}
+
+	return &Signer{
+		ctx:    ctx,
+		client: client,
+		keyId:  keyId,
+		alg:    alg,
+		pub:    pub,
+	}, nil
+}
+
+// PubKey returns the public half of the KMS key.
+func (s *Signer) PubKey() sec.PubSignKey {
+	return s.pub
+}
+
+// KeyHash returns the hash of the KMS public key, as written to an image's
+// KEYHASH TLV.
+func (s *Signer) KeyHash() ([]byte, error) {
+	return s.pub.Hash()
+}
+
+// Sign signs a SHA256 image hash with the KMS key.
+func (s *Signer) Sign(hash []byte) ([]byte, error) {
+	sig, err := s.client.Sign(s.ctx, s.keyId, hash, s.alg)
+	if err != nil {
+		return nil, errors.Wrapf(err, "AWS KMS %s signing failed for %s",
+			s.alg, s.keyId)
+	}
+
+	if err := kms.CheckSig(s.pub, hash, sig); err != nil {
+		return nil, errors.Wrapf(err, "AWS KMS key %s", s.keyId)
+	}
+
+	return sig, nil
+}
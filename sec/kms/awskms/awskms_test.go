@@ -0,0 +1,167 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package awskms_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/apache/mynewt-artifact/sec/kms/awskms"
+	"github.com/apache/mynewt-artifact/sec/testkeys"
+)
+
+// fakeClient emulates AWS KMS with local keys.
+type fakeClient struct {
+	keys map[string]crypto.Signer
+	algs []string
+}
+
+func (c *fakeClient) GetPublicKey(ctx context.Context,
+	keyId string) ([]byte, error) {
+
+	key := c.keys[keyId]
+	if key == nil {
+		return nil, fmt.Errorf("NotFoundException: %s", keyId)
+	}
+
+	return x509.MarshalPKIXPublicKey(key.Public())
+}
+
+func (c *fakeClient) Sign(ctx context.Context, keyId string, digest []byte,
+	alg string) ([]byte, error) {
+
+	c.algs = append(c.algs, alg)
+
+	switch key := c.keys[keyId].(type) {
+	case *rsa.PrivateKey:
+		opts := rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       crypto.SHA256,
+		}
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest, &opts)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, key, digest)
+	default:
+		return nil, fmt.Errorf("UnsupportedOperationException")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	keys := testkeys.Default()
+
+	client := &fakeClient{
+		keys: map[string]crypto.Signer{
+			"alias/rsa2048": keys.Rsa2048,
+			"alias/rsa3072": keys.Rsa3072,
+			"alias/p256":    keys.P256,
+			"alias/ed25519": keys.Ed25519,
+		},
+	}
+
+	local := map[string]sec.PrivSignKey{
+		"alias/rsa2048": {Rsa: keys.Rsa2048},
+		"alias/rsa3072": {Rsa: keys.Rsa3072},
+		"alias/p256":    {Ec: keys.P256},
+	}
+
+	hash := make([]byte, 32)
+	rand.Read(hash)
+
+	for keyId, priv := range local {
+		s, err := awskms.NewSigner(context.Background(), client, keyId)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", keyId, err.Error())
+		}
+
+		// The key hash must match the one derived from the local key.
+		pub := priv.PubKey()
+		want, err := pub.Hash()
+		if err != nil {
+			t.Fatalf("%s: %s", keyId, err.Error())
+		}
+		got, err := s.KeyHash()
+		if err != nil {
+			t.Fatalf("%s: %s", keyId, err.Error())
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: key hash mismatch: have=%x want=%x",
+				keyId, got, want)
+		}
+
+		sig, err := s.Sign(hash)
+		if err != nil {
+			t.Fatalf("%s: signing failed: %s", keyId, err.Error())
+		}
+
+		if priv.Rsa != nil {
+			n, err := sec.VerifySigs(s.PubKey(), []sec.Sig{{
+				KeyHash: want,
+				Data:    sig,
+			}}, hash)
+			if err != nil || n != 0 {
+				t.Fatalf("%s: signature did not verify", keyId)
+			}
+		} else if !ecdsa.VerifyASN1(priv.Ec.Public().(*ecdsa.PublicKey),
+			hash, sig) {
+
+			t.Fatalf("%s: signature did not verify", keyId)
+		}
+	}
+
+	wantAlgs := map[string]bool{
+		awskms.SIGNING_ALG_ECDSA_SHA256:   true,
+		awskms.SIGNING_ALG_RSA_PSS_SHA256: true,
+	}
+	for _, alg := range client.algs {
+		if !wantAlgs[alg] {
+			t.Fatalf("unexpected signing algorithm: %s", alg)
+		}
+	}
+
+	// Unsupported key type.
+	_, err := awskms.NewSigner(context.Background(), client, "alias/ed25519")
+	if err == nil {
+		t.Fatalf("ed25519 key accepted")
+	}
+
+	// Unknown key.
+	_, err = awskms.NewSigner(context.Background(), client, "alias/none")
+	if err == nil {
+		t.Fatalf("unknown key accepted")
+	}
+
+	// A signature from the wrong key is rejected.
+	s, err := awskms.NewSigner(context.Background(), client, "alias/p256")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	client.keys["alias/p256"] = keys.Rsa2048
+	if _, err := s.Sign(hash); err == nil {
+		t.Fatalf("invalid signature accepted")
+	}
+}
@@ -0,0 +1,135 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package gcpkms implements an image signer backed by a Google Cloud KMS
+// asymmetric signing key version.  Supported algorithms are
+// EC_SIGN_P256_SHA256, RSA_SIGN_PSS_2048_SHA256, and
+// RSA_SIGN_PSS_3072_SHA256.
+package gcpkms
+
+import (
+	"context"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/apache/mynewt-artifact/sec/kms"
+)
+
+// Cloud KMS key version algorithms that can sign images.  PKCS#1 v1.5 RSA
+// algorithms are not supported; images require PSS.
+const (
+	ALG_EC_P256_SHA256      = "EC_SIGN_P256_SHA256"
+	ALG_RSA_PSS_2048_SHA256 = "RSA_SIGN_PSS_2048_SHA256"
+	ALG_RSA_PSS_3072_SHA256 = "RSA_SIGN_PSS_3072_SHA256"
+)
+
+var algSigTypeMap = map[string]sec.SigType{
+	ALG_EC_P256_SHA256:      sec.SIG_TYPE_ECDSA256,
+	ALG_RSA_PSS_2048_SHA256: sec.SIG_TYPE_RSA2048,
+	ALG_RSA_PSS_3072_SHA256: sec.SIG_TYPE_RSA3072,
+}
+
+// Client is the subset of the Cloud KMS API needed for signing.  It is
+// typically implemented as a thin wrapper around
+// KeyManagementClient from the Cloud KMS Go SDK.
+type Client interface {
+	// GetPublicKey returns the PEM-encoded public key and the algorithm of
+	// the specified key version.
+	GetPublicKey(ctx context.Context, name string) (string, string, error)
+
+	// AsymmetricSign signs a SHA256 digest with the specified key version.
+	AsymmetricSign(ctx context.Context, name string,
+		digest []byte) ([]byte, error)
+}
+
+// Signer signs images with a Cloud KMS key version.
+type Signer struct {
+	ctx    context.Context
+	client Client
+	name   string
+	pub    sec.PubSignKey
+}
+
+// NewSigner creates a signer for the specified key version resource name
+// ("projects/.../cryptoKeyVersions/N").  The key's public half is retrieved
+// immediately.  ctx applies to that request and to every subsequent signing
+// request.
+func NewSigner(ctx context.Context, client Client,
+	name string) (*Signer, error) {
+
+	pemStr, alg, err := client.GetPublicKey(ctx, name)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to retrieve public key of Cloud KMS key %s", name)
+	}
+
+	typ, ok := algSigTypeMap[alg]
+	if !ok {
+		return nil, errors.Errorf(
+			"Cloud KMS key %s has unsupported algorithm %s", name, alg)
+	}
+
+	pub, err := kms.ParsePubKey([]byte(pemStr))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cloud KMS key %s", name)
+	}
+
+	pubType, err := pub.SigType()
+	if err != nil {
+		return nil, err
+	}
+	if pubType != typ {
+		return nil, errors.Errorf(
+			"Cloud KMS key %s: algorithm %s does not match %s public key",
+			name, alg, sec.SigTypeString(pubType))
+	}
+
+	return &Signer{
+		ctx:    ctx,
+		client: client,
+		name:   name,
+		pub:    pub,
+	}, nil
+}
+
+// PubKey returns the public half of the key version.
+func (s *Signer) PubKey() sec.PubSignKey {
+	return s.pub
+}
+
+// KeyHash returns the hash of the key version's public key, as written to an
+// image's KEYHASH TLV.
+func (s *Signer) KeyHash() ([]byte, error) {
+	return s.pub.Hash()
+}
+
+// Sign signs a SHA256 image hash with the key version.
+func (s *Signer) Sign(hash []byte) ([]byte, error) {
+	sig, err := s.client.AsymmetricSign(s.ctx, s.name, hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cloud KMS signing failed for %s",
+			s.name)
+	}
+
+	if err := kms.CheckSig(s.pub, hash, sig); err != nil {
+		return nil, errors.Wrapf(err, "Cloud KMS key %s", s.name)
+	}
+
+	return sig, nil
+}
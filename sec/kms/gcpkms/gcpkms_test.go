@@ -0,0 +1,165 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package gcpkms_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/sec"
+	"github.com/apache/mynewt-artifact/sec/kms/gcpkms"
+	"github.com/apache/mynewt-artifact/sec/testkeys"
+)
+
+type fakeKey struct {
+	key crypto.Signer
+	alg string
+}
+
+// fakeClient emulates Cloud KMS with local keys.
+type fakeClient struct {
+	keys map[string]fakeKey
+}
+
+func (c *fakeClient) GetPublicKey(ctx context.Context,
+	name string) (string, string, error) {
+
+	k, ok := c.keys[name]
+	if !ok {
+		return "", "", fmt.Errorf("NotFound: %s", name)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(k.key.Public())
+	if err != nil {
+		return "", "", err
+	}
+
+	b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return string(b), k.alg, nil
+}
+
+func (c *fakeClient) AsymmetricSign(ctx context.Context, name string,
+	digest []byte) ([]byte, error) {
+
+	switch key := c.keys[name].key.(type) {
+	case *rsa.PrivateKey:
+		opts := rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+			Hash:       crypto.SHA256,
+		}
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest, &opts)
+	case *ecdsa.PrivateKey:
+		return ecdsa.SignASN1(rand.Reader, key, digest)
+	default:
+		return nil, fmt.Errorf("FailedPrecondition")
+	}
+}
+
+func TestSigner(t *testing.T) {
+	keys := testkeys.Default()
+
+	const prefix = "projects/p/locations/global/keyRings/r/cryptoKeys/"
+
+	client := &fakeClient{
+		keys: map[string]fakeKey{
+			prefix + "rsa2048/cryptoKeyVersions/1": {
+				keys.Rsa2048, gcpkms.ALG_RSA_PSS_2048_SHA256,
+			},
+			prefix + "rsa3072/cryptoKeyVersions/1": {
+				keys.Rsa3072, gcpkms.ALG_RSA_PSS_3072_SHA256,
+			},
+			prefix + "p256/cryptoKeyVersions/1": {
+				keys.P256, gcpkms.ALG_EC_P256_SHA256,
+			},
+			prefix + "pkcs1/cryptoKeyVersions/1": {
+				keys.Rsa2048, "RSA_SIGN_PKCS1_2048_SHA256",
+			},
+			prefix + "mismatch/cryptoKeyVersions/1": {
+				keys.Rsa3072, gcpkms.ALG_RSA_PSS_2048_SHA256,
+			},
+		},
+	}
+
+	local := map[string]sec.PrivSignKey{
+		prefix + "rsa2048/cryptoKeyVersions/1": {Rsa: keys.Rsa2048},
+		prefix + "rsa3072/cryptoKeyVersions/1": {Rsa: keys.Rsa3072},
+		prefix + "p256/cryptoKeyVersions/1":    {Ec: keys.P256},
+	}
+
+	hash := make([]byte, 32)
+	rand.Read(hash)
+
+	for name, priv := range local {
+		s, err := gcpkms.NewSigner(context.Background(), client, name)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", name, err.Error())
+		}
+
+		// The key hash must match the one derived from the local key.
+		pub := priv.PubKey()
+		want, err := pub.Hash()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		got, err := s.KeyHash()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: key hash mismatch: have=%x want=%x",
+				name, got, want)
+		}
+
+		sig, err := s.Sign(hash)
+		if err != nil {
+			t.Fatalf("%s: signing failed: %s", name, err.Error())
+		}
+
+		if priv.Rsa != nil {
+			n, err := sec.VerifySigs(s.PubKey(), []sec.Sig{{
+				KeyHash: want,
+				Data:    sig,
+			}}, hash)
+			if err != nil || n != 0 {
+				t.Fatalf("%s: signature did not verify", name)
+			}
+		} else if !ecdsa.VerifyASN1(priv.Ec.Public().(*ecdsa.PublicKey),
+			hash, sig) {
+
+			t.Fatalf("%s: signature did not verify", name)
+		}
+	}
+
+	for _, key := range []string{"pkcs1", "mismatch", "none"} {
+		name := prefix + key + "/cryptoKeyVersions/1"
+		_, err := gcpkms.NewSigner(context.Background(), client, name)
+		if err == nil {
+			t.Fatalf("%s: key accepted", name)
+		}
+	}
+}
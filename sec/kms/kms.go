@@ -0,0 +1,112 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package kms contains the pieces shared by the cloud KMS signer adapters in
+// its sub-packages (awskms and gcpkms).  The adapters do not link against any
+// cloud SDK; each defines a small client interface that callers implement
+// with a thin wrapper around the official SDK client.
+package kms
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// ParsePubKey parses a public key retrieved from a KMS.  The key may be a
+// DER- or PEM-encoded SubjectPublicKeyInfo.  Only key types that can be used
+// for KMS image signing are accepted: RSA-2048, RSA-3072, and ECDSA P-256.
+func ParsePubKey(b []byte) (sec.PubSignKey, error) {
+	key := sec.PubSignKey{}
+
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "PUBLIC KEY" {
+			return key, errors.Errorf(
+				"unexpected KMS public key PEM type: \"%s\"", block.Type)
+		}
+		b = block.Bytes
+	}
+
+	itf, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return key, errors.Wrapf(err, "error parsing KMS public key")
+	}
+
+	switch pub := itf.(type) {
+	case *rsa.PublicKey:
+		key.Rsa = pub
+	case *ecdsa.PublicKey:
+		key.Ec = pub
+	default:
+		return key, errors.Errorf("unsupported KMS key type: %T", itf)
+	}
+
+	typ, err := key.SigType()
+	if err != nil {
+		return key, err
+	}
+	switch typ {
+	case sec.SIG_TYPE_RSA2048, sec.SIG_TYPE_RSA3072, sec.SIG_TYPE_ECDSA256:
+	default:
+		return key, errors.Errorf("unsupported KMS key type: %s",
+			sec.SigTypeString(typ))
+	}
+
+	return key, nil
+}
+
+// CheckSig verifies a signature returned by a KMS against the key's public
+// half.  This catches a misconfigured key version before a bad signature
+// ends up in an image.
+func CheckSig(pub sec.PubSignKey, hash []byte, sig []byte) error {
+	if pub.Rsa != nil {
+		opts := rsa.PSSOptions{
+			SaltLength: rsa.PSSSaltLengthEqualsHash,
+		}
+		err := rsa.VerifyPSS(pub.Rsa, crypto.SHA256, hash, sig, &opts)
+		if err != nil {
+			return errors.Wrapf(err, "KMS returned invalid RSA signature")
+		}
+		return nil
+	}
+
+	if pub.Ec != nil {
+		alg, ok := sec.SigAlgForKey(&pub)
+		if !ok {
+			return errors.Errorf("unsupported ecdsa curve: %s",
+				pub.Ec.Curve.Params().Name)
+		}
+		if len(sig) > alg.SigLen {
+			return errors.Errorf(
+				"KMS ecdsa signature too long: have=%d max=%d",
+				len(sig), alg.SigLen)
+		}
+		if valid, err := alg.Verify(&pub, hash, sig); err != nil || !valid {
+			return errors.Errorf("KMS returned invalid ecdsa signature")
+		}
+		return nil
+	}
+
+	return errors.Errorf("unsupported KMS key type")
+}
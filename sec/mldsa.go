@@ -0,0 +1,87 @@
+//go:build go1.27
+
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/mldsa"
+	"crypto/rand"
+	"crypto/x509"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// ML-DSA support is experimental and requires Go 1.27 (crypto/mldsa).  With
+// older toolchains, the key types are placeholders and no ML-DSA signature
+// algorithm is registered.
+
+type MlDsaPrivateKey = mldsa.PrivateKey
+type MlDsaPublicKey = mldsa.PublicKey
+
+func signMlDsaAlg(key *PrivSignKey, hash []byte) ([]byte, error) {
+	sig, err := key.MlDsa.Sign(rand.Reader, hash, &mldsa.Options{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compute signature")
+	}
+
+	return sig, nil
+}
+
+func verifyMlDsaAlg(key *PubSignKey, hash []byte, sig []byte) (bool, error) {
+	err := mldsa.Verify(key.MlDsa, hash, sig, &mldsa.Options{})
+	return err == nil, nil
+}
+
+// mlDsaSigAlgs returns the built-in ML-DSA signature algorithms.
+func mlDsaSigAlgs() []SigAlg {
+	return []SigAlg{
+		{
+			Type:        SIG_TYPE_MLDSA44,
+			Name:        "mldsa44",
+			TlvType:     0xa4,
+			SigLen:      mldsa.MLDSA44SignatureSize,
+			FixedLen:    true,
+			PostQuantum: true,
+			MatchKey: func(key *PubSignKey) bool {
+				return key.MlDsa != nil &&
+					key.MlDsa.Parameters() == mldsa.MLDSA44()
+			},
+			Sign:   signMlDsaAlg,
+			Verify: verifyMlDsaAlg,
+		},
+	}
+}
+
+func mlDsaPublicKey(priv *MlDsaPrivateKey) *MlDsaPublicKey {
+	return priv.PublicKey()
+}
+
+func mlDsaPubBytes(pub *MlDsaPublicKey) []byte {
+	return pub.Bytes()
+}
+
+func mlDsaParamsName(pub *MlDsaPublicKey) string {
+	return pub.Parameters().String()
+}
+
+func marshalMlDsa(pub *MlDsaPublicKey) ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(pub)
+}
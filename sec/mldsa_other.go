@@ -0,0 +1,49 @@
+//go:build !go1.27
+
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import "github.com/apache/mynewt-artifact/errors"
+
+// Placeholders for toolchains without crypto/mldsa.  No key of these types
+// can be parsed or generated.
+type MlDsaPrivateKey struct{}
+type MlDsaPublicKey struct{}
+
+func mlDsaSigAlgs() []SigAlg {
+	return nil
+}
+
+func mlDsaPublicKey(priv *MlDsaPrivateKey) *MlDsaPublicKey {
+	return &MlDsaPublicKey{}
+}
+
+func mlDsaPubBytes(pub *MlDsaPublicKey) []byte {
+	return nil
+}
+
+func mlDsaParamsName(pub *MlDsaPublicKey) string {
+	return "unknown"
+}
+
+func marshalMlDsa(pub *MlDsaPublicKey) ([]byte, error) {
+	return nil, errors.Errorf("ML-DSA requires Go 1.27")
+}
@@ -25,7 +25,6 @@ import (
 	"crypto/cipher"
 	"crypto/sha1"
 	"crypto/sha256"
-	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"fmt"
@@ -152,7 +151,7 @@ func unwrapPbes2Pbkdf2(param *pbkdf2Param, size int, iv []byte, hashNew hashFunc
 		return nil, err
 	}
 
-	return x509.ParsePKCS8PrivateKey(plain)
+	return parsePkcs8PrivateKey(plain)
 }
 
 // Verify that PKCS#7 padding is correct on this plaintext message.
@@ -0,0 +1,339 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+const PKCS11_URI_SCHEME = "pkcs11:"
+
+// Pkcs11URI identifies a key stored in a PKCS#11 token (RFC 7512).
+type Pkcs11URI struct {
+	// Path attributes.
+	Token        string
+	Manufacturer string
+	Model        string
+	Serial       string
+	Object       string
+	Id           []byte
+	Type         string
+
+	// Query attributes.
+	PinValue   string
+	PinSource  string
+	ModuleName string
+	ModulePath string
+}
+
+// Pkcs11Mech is a PKCS#11 signing mechanism.
+type Pkcs11Mech int
+
+const (
+	// CKM_RSA_PKCS_PSS with SHA256, MGF1-SHA256, and a 32-byte salt.  The
+	// data to sign is the SHA256 hash.
+	PKCS11_MECH_RSA_PSS_SHA256 Pkcs11Mech = iota
+
+	// CKM_ECDSA.  The data to sign is the SHA256 hash.  The module returns
+	// the raw r||s signature.
+	PKCS11_MECH_ECDSA
+
+	// CKM_EDDSA (pure Ed25519).
+	PKCS11_MECH_EDDSA
+)
+
+var pkcs11MechNameMap = map[Pkcs11Mech]string{
+	PKCS11_MECH_RSA_PSS_SHA256: "rsa-pss-sha256",
+	PKCS11_MECH_ECDSA:          "ecdsa",
+	PKCS11_MECH_EDDSA:          "eddsa",
+}
+
+// Pkcs11Module is a wrapper around a PKCS#11 library.  The sec package does
+// not link against any PKCS#11 implementation; users register a module with
+// SetPkcs11Module.
+type Pkcs11Module interface {
+	// PublicKey retrieves the public key of the object identified by uri.
+	PublicKey(uri Pkcs11URI) (PubSignKey, error)
+
+	// Sign signs data with the private key identified by uri.
+	Sign(uri Pkcs11URI, mech Pkcs11Mech, data []byte) ([]byte, error)
+}
+
+var pkcs11Module Pkcs11Module
+
+// pkcs11Mtx serializes signing requests; PKCS#11 sessions are generally not
+// safe for concurrent use.
+var pkcs11Mtx sync.Mutex
+
+// SetPkcs11Module registers the module used to resolve PKCS#11 URIs.
+func SetPkcs11Module(module Pkcs11Module) {
+	pkcs11Module = module
+}
+
+func Pkcs11MechString(mech Pkcs11Mech) string {
+	s := pkcs11MechNameMap[mech]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+// IsPkcs11URI indicates whether the given key specifier is a PKCS#11 URI.
+func IsPkcs11URI(s string) bool {
+	return strings.HasPrefix(strings.ToLower(s), PKCS11_URI_SCHEME)
+}
+
+func pkcs11Unescape(s string) (string, error) {
+	v, err := url.PathUnescape(s)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid pkcs11 URI value \"%s\"", s)
+	}
+
+	return v, nil
+}
+
+// ParsePkcs11URI parses a PKCS#11 URI of the form
+// "pkcs11:token=...;object=...?pin-value=...".
+func ParsePkcs11URI(s string) (Pkcs11URI, error) {
+	uri := Pkcs11URI{}
+
+	if !IsPkcs11URI(s) {
+		return uri, errors.Errorf("not a pkcs11 URI: \"%s\"", s)
+	}
+	s = s[len(PKCS11_URI_SCHEME):]
+
+	path := s
+	query := ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		path = s[:i]
+		query = s[i+1:]
+	}
+
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return uri, errors.Errorf(
+				"invalid pkcs11 URI attribute \"%s\"", attr)
+		}
+		val, err := pkcs11Unescape(kv[1])
+		if err != nil {
+			return uri, err
+		}
+
+		switch kv[0] {
+		case "token":
+			uri.Token = val
+		case "manufacturer":
+			uri.Manufacturer = val
+		case "model":
+			uri.Model = val
+		case "serial":
+			uri.Serial = val
+		case "object":
+			uri.Object = val
+		case "id":
+			uri.Id = []byte(val)
+		case "type":
+			uri.Type = val
+		default:
+			// Ignore library, slot, and vendor-specific attributes.
+		}
+	}
+
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return uri, errors.Errorf(
+				"invalid pkcs11 URI query attribute \"%s\"", attr)
+		}
+		val, err := pkcs11Unescape(kv[1])
+		if err != nil {
+			return uri, err
+		}
+
+		switch kv[0] {
+		case "pin-value":
+			uri.PinValue = val
+		case "pin-source":
+			uri.PinSource = val
+		case "module-name":
+			uri.ModuleName = val
+		case "module-path":
+			uri.ModulePath = val
+		default:
+		}
+	}
+
+	if uri.Object == "" && uri.Id == nil {
+		return uri, errors.Errorf(
+			"pkcs11 URI does not specify an object or id: \"%s\"",
+			PKCS11_URI_SCHEME+s)
+	}
+
+	return uri, nil
+}
+
+// Pin retrieves the PIN specified by the URI, either directly or from the
+// file named by pin-source.  An empty string indicates no PIN.
+func (uri *Pkcs11URI) Pin() (string, error) {
+	if uri.PinValue != "" {
+		return uri.PinValue, nil
+	}
+
+	if uri.PinSource != "" {
+		path := strings.TrimPrefix(uri.PinSource, "file:")
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", errors.Wrapf(err, "error reading pkcs11 PIN file")
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	return "", nil
+}
+
+// String produces a human-readable description of the URI.  The PIN is not
+// included.
+func (uri *Pkcs11URI) String() string {
+	var attrs []string
+
+	add := func(name string, val string) {
+		if val != "" {
+			attrs = append(attrs, name+"="+url.PathEscape(val))
+		}
+	}
+
+	add("token", uri.Token)
+	add("manufacturer", uri.Manufacturer)
+	add("model", uri.Model)
+	add("serial", uri.Serial)
+	add("object", uri.Object)
+	if uri.Id != nil {
+		id := ""
+		for _, b := range uri.Id {
+			id += "%" + hex.EncodeToString([]byte{b})
+		}
+		attrs = append(attrs, "id="+id)
+	}
+	add("type", uri.Type)
+
+	return PKCS11_URI_SCHEME + strings.Join(attrs, ";")
+}
+
+type pkcs11Signer struct {
+	module Pkcs11Module
+	uri    Pkcs11URI
+	pub    PubSignKey
+}
+
+// NewPkcs11Signer creates a signer for the key identified by the given
+// PKCS#11 URI.  A module must have been registered with SetPkcs11Module.
+func NewPkcs11Signer(s string) (Signer, error) {
+	uri, err := ParsePkcs11URI(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if pkcs11Module == nil {
+		return nil, errors.Errorf(
+			"no pkcs11 module registered; cannot use key %s", uri.String())
+	}
+
+	pub, err := pkcs11Module.PublicKey(uri)
+	if err != nil {
+		return nil, errors.Wrapf(err,
+			"failed to retrieve public key %s", uri.String())
+	}
+	if pub.Rsa == nil && pub.Ec == nil && pub.Ed25519 == nil &&
+		pub.MlDsa == nil {
+
+		return nil, errors.Errorf(
+			"pkcs11 module returned empty public key for %s", uri.String())
+	}
+
+	return &pkcs11Signer{
+		module: pkcs11Module,
+		uri:    uri,
+		pub:    pub,
+	}, nil
+}
+
+func (s *pkcs11Signer) PubKey() PubSignKey {
+	return s.pub
+}
+
+func (s *pkcs11Signer) Sign(hash []byte) ([]byte, error) {
+	var mech Pkcs11Mech
+	if s.pub.Rsa != nil {
+		mech = PKCS11_MECH_RSA_PSS_SHA256
+	} else if s.pub.Ec != nil {
+		mech = PKCS11_MECH_ECDSA
+	} else if s.pub.Ed25519 != nil {
+		mech = PKCS11_MECH_EDDSA
+	} else {
+		return nil, errors.Errorf(
+			"pkcs11 signing not supported for key %s", s.uri.String())
+	}
+
+	pkcs11Mtx.Lock()
+	sig, err := s.module.Sign(s.uri, mech, hash)
+	pkcs11Mtx.Unlock()
+	if err != nil {
+		return nil, errors.Wrapf(err, "pkcs11 %s signing failed for %s",
+			Pkcs11MechString(mech), s.uri.String())
+	}
+
+	if mech != PKCS11_MECH_ECDSA {
+		return sig, nil
+	}
+
+	// PKCS#11 produces a raw r||s ECDSA signature; images use ASN.1.
+	if len(sig) == 0 || len(sig)%2 != 0 {
+		return nil, errors.Errorf(
+			"pkcs11 ecdsa signature has invalid length: %d", len(sig))
+	}
+	half := len(sig) / 2
+	r := new(big.Int).SetBytes(sig[:half])
+	ss := new(big.Int).SetBytes(sig[half:])
+
+	alg, ok := SigAlgForKey(&s.pub)
+	if !ok {
+		return nil, errors.Errorf("unsupported ecdsa curve: %s",
+			s.pub.Ec.Curve.Params().Name)
+	}
+
+	return encodeEcSig(r, ss, uint16(alg.SigLen))
+}
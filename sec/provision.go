@@ -0,0 +1,230 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// Provisioning records tell which encryption key was provisioned to each
+// device in the factory.  They identify keys by fingerprint (see
+// PubEncKey.Fingerprint), so a record file never contains key material and
+// can be shared with the build system.
+//
+// Records are read from JSON or CSV.  JSON input is an array of objects:
+//
+//     [{"device_id": "0a1b2c3d", "enc_key_fingerprint": "6f2e..."}]
+//
+// CSV input has a header row naming the same two columns; other columns are
+// ignored.  Device IDs and fingerprints are hex.
+
+const (
+	PROVISION_COL_DEVICE_ID   = "device_id"
+	PROVISION_COL_FINGERPRINT = "enc_key_fingerprint"
+)
+
+// ProvisionRecord associates a device with its encryption key.
+type ProvisionRecord struct {
+	DeviceId    string `json:"device_id"`
+	Fingerprint string `json:"enc_key_fingerprint"`
+}
+
+// ProvisionRecords is a set of provisioning records keyed by device ID.
+type ProvisionRecords struct {
+	Records []ProvisionRecord
+}
+
+func parseProvisionHex(s string, what string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(b) == 0 {
+		return nil, errors.Errorf("invalid %s: \"%s\"", what, s)
+	}
+
+	return b, nil
+}
+
+func (r *ProvisionRecords) validate() error {
+	seen := map[string]struct{}{}
+
+	for i, rec := range r.Records {
+		id, err := parseProvisionHex(rec.DeviceId, "device ID")
+		if err != nil {
+			return errors.Wrapf(err, "provisioning record %d", i)
+		}
+		if _, err := parseProvisionHex(rec.Fingerprint,
+			"enc key fingerprint"); err != nil {
+
+			return errors.Wrapf(err, "provisioning record %d", i)
+		}
+
+		key := hex.EncodeToString(id)
+		if _, ok := seen[key]; ok {
+			return errors.Errorf(
+				"duplicate provisioning record for device %s", key)
+		}
+		seen[key] = struct{}{}
+	}
+
+	return nil
+}
+
+func parseProvisionCsv(data []byte) ([]ProvisionRecord, error) {
+	rd := csv.NewReader(bytes.NewReader(data))
+	rd.FieldsPerRecord = -1
+	rd.TrimLeadingSpace = true
+
+	hdr, err := rd.Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read provisioning CSV header")
+	}
+
+	idCol, fpCol := -1, -1
+	for i, name := range hdr {
+		switch strings.TrimSpace(name) {
+		case PROVISION_COL_DEVICE_ID:
+			idCol = i
+		case PROVISION_COL_FINGERPRINT:
+			fpCol = i
+		}
+	}
+	if idCol < 0 || fpCol < 0 {
+		return nil, errors.Errorf(
+			"provisioning CSV header lacks \"%s\" or \"%s\" column",
+			PROVISION_COL_DEVICE_ID, PROVISION_COL_FINGERPRINT)
+	}
+
+	var recs []ProvisionRecord
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read provisioning CSV")
+		}
+		if len(row) <= idCol || len(row) <= fpCol {
+			return nil, errors.Errorf(
+				"provisioning CSV row %d is too short", len(recs)+2)
+		}
+
+		recs = append(recs, ProvisionRecord{
+			DeviceId:    row[idCol],
+			Fingerprint: row[fpCol],
+		})
+	}
+
+	return recs, nil
+}
+
+// ParseProvisionRecords parses provisioning records in JSON or CSV form.
+func ParseProvisionRecords(data []byte) (ProvisionRecords, error) {
+	var r ProvisionRecords
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &r.Records); err != nil {
+			return r, errors.Wrapf(err,
+				"failed to parse provisioning records JSON")
+		}
+	} else {
+		recs, err := parseProvisionCsv(data)
+		if err != nil {
+			return r, err
+		}
+		r.Records = recs
+	}
+
+	if err := r.validate(); err != nil {
+		return r, err
+	}
+
+	return r, nil
+}
+
+// ReadProvisionRecords reads provisioning records from a JSON or CSV file.
+func ReadProvisionRecords(filename string) (ProvisionRecords, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ProvisionRecords{}, errors.Wrapf(err,
+			"error reading provisioning records")
+	}
+
+	return ParseProvisionRecords(data)
+}
+
+// Find returns the record for the given device, or nil if there is none.
+func (r *ProvisionRecords) Find(deviceId []byte) *ProvisionRecord {
+	for i, rec := range r.Records {
+		id, err := parseProvisionHex(rec.DeviceId, "device ID")
+		if err == nil && bytes.Equal(id, deviceId) {
+			return &r.Records[i]
+		}
+	}
+
+	return nil
+}
+
+// SelectEncKey returns the index of the key in keys that was provisioned to
+// the given device.  It is an error if the device has no record or if the
+// recorded fingerprint does not match exactly one key.
+func (r *ProvisionRecords) SelectEncKey(deviceId []byte,
+	keys []PubEncKey) (int, error) {
+
+	rec := r.Find(deviceId)
+	if rec == nil {
+		return -1, errors.Errorf(
+			"no provisioning record for device %x", deviceId)
+	}
+
+	fp, err := parseProvisionHex(rec.Fingerprint, "enc key fingerprint")
+	if err != nil {
+		return -1, err
+	}
+
+	idx := -1
+	for i, _ := range keys {
+		ok, err := keys[i].MatchesFingerprint(fp)
+		if err != nil {
+			return -1, err
+		}
+		if ok {
+			if idx >= 0 {
+				return -1, errors.Errorf(
+					"multiple enc keys match fingerprint %x", fp)
+			}
+			idx = i
+		}
+	}
+
+	if idx < 0 {
+		return -1, errors.Errorf(
+			"no enc key matches device %x's fingerprint %x", deviceId, fp)
+	}
+
+	return idx, nil
+}
@@ -105,3 +105,50 @@ func ReadPrivEncKeys(filenames []string) ([]PrivEncKey, error) {
 
 	return keys, nil
 }
+
+// ReadSigner creates a signer from a key specifier.  The specifier is a
+// PKCS#11 URI, an ssh-agent key specifier, or the name of a private key
+// file.
+func ReadSigner(spec string) (Signer, error) {
+	if IsPkcs11URI(spec) {
+		return NewPkcs11Signer(spec)
+	}
+	if IsSshAgentSpec(spec) {
+		return NewSshAgentSigner(spec)
+	}
+
+	key, err := ReadPrivSignKey(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// ReadSigners creates a set of signers from several key specifiers.  The
+// caller should release them with CloseSigners.
+func ReadSigners(specs []string) ([]Signer, error) {
+	signers := make([]Signer, len(specs))
+
+	for i, spec := range specs {
+		signer, err := ReadSigner(spec)
+		if err != nil {
+			CloseSigners(signers[:i])
+			return nil, err
+		}
+
+		signers[i] = signer
+	}
+
+	return signers, nil
+}
+
+// ReadKeyBundle reads every key in a file of concatenated PEM blocks.
+func ReadKeyBundle(filename string) (KeyBundle, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return KeyBundle{}, errors.Wrapf(err, "error reading key file")
+	}
+
+	return ParseKeyBundle(data)
+}
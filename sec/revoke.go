@@ -0,0 +1,260 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// A revocation list is a signed JSON document naming signing keys that must
+// no longer be trusted.  Unlike a trust bundle, it does not enumerate the
+// accepted keys; it only withdraws trust from the keys it lists.  Revocation
+// lists are signed by root keys in the same manner as trust bundles.
+
+const REVOCATION_LIST_VERSION = 1
+
+type RevocationReason int
+
+const (
+	REVOCATION_REASON_UNSPECIFIED RevocationReason = iota
+	REVOCATION_REASON_KEY_COMPROMISE
+	REVOCATION_REASON_SUPERSEDED
+	REVOCATION_REASON_CESSATION
+)
+
+var revocationReasonNameMap = map[RevocationReason]string{
+	REVOCATION_REASON_UNSPECIFIED:    "unspecified",
+	REVOCATION_REASON_KEY_COMPROMISE: "key-compromise",
+	REVOCATION_REASON_SUPERSEDED:     "superseded",
+	REVOCATION_REASON_CESSATION:      "cessation",
+}
+
+func RevocationReasonString(reason RevocationReason) string {
+	s := revocationReasonNameMap[reason]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func RevocationReasonFromString(s string) (RevocationReason, error) {
+	for k, v := range revocationReasonNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown revocation reason: \"%s\"", s)
+}
+
+func (reason RevocationReason) MarshalJSON() ([]byte, error) {
+	s := revocationReasonNameMap[reason]
+	if s == "" {
+		return nil, errors.Errorf("invalid revocation reason: %d", int(reason))
+	}
+	return json.Marshal(s)
+}
+
+func (reason *RevocationReason) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrapf(err, "failed to parse revocation reason")
+	}
+
+	r, err := RevocationReasonFromString(s)
+	if err != nil {
+		return err
+	}
+
+	*reason = r
+	return nil
+}
+
+type RevokedKey struct {
+	// Hex-encoded key hash.  Either the truncated (4-byte) or full
+	// (32-byte) form is accepted.
+	KeyHash string           `json:"key_hash"`
+	Reason  RevocationReason `json:"reason"`
+
+	// When the key was revoked.  This is informational; a revoked key's
+	// signatures are rejected regardless of when they were made.
+	Time time.Time `json:"time"`
+
+	Comment string `json:"comment,omitempty"`
+}
+
+type RevocationList struct {
+	Version int `json:"version"`
+
+	// Incremented with every published list.  Devices should refuse a list
+	// whose serial is lower than the one they already hold.
+	Serial uint64       `json:"serial"`
+	Issued time.Time    `json:"issued"`
+	Keys   []RevokedKey `json:"keys"`
+}
+
+// SignedRevocationList is the serialized form of a revocation list.  As with
+// trust bundles, the signatures cover the SHA256 of the compacted list JSON.
+type SignedRevocationList struct {
+	List json.RawMessage  `json:"list"`
+	Sigs []TrustBundleSig `json:"signatures"`
+}
+
+// FindKey returns the entry that revokes the given public key, or nil if the
+// key is not revoked.
+func (rl *RevocationList) FindKey(key PubSignKey) (*RevokedKey, error) {
+	for i := range rl.Keys {
+		keyHash, err := decodeKeyHash(rl.Keys[i].KeyHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "revocation list")
+		}
+		match, err := KeyHashMatchesKey(&key, keyHash)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			return &rl.Keys[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// IsRevoked indicates whether the revocation list names the given key.
+func (rl *RevocationList) IsRevoked(key PubSignKey) (bool, error) {
+	rk, err := rl.FindKey(key)
+	if err != nil {
+		return false, err
+	}
+
+	return rk != nil, nil
+}
+
+// Filter splits the given keys into those that remain trusted and those the
+// list revokes.
+func (rl *RevocationList) Filter(
+	keys []PubSignKey) ([]PubSignKey, []PubSignKey, error) {
+
+	var good []PubSignKey
+	var revoked []PubSignKey
+	for _, key := range keys {
+		r, err := rl.IsRevoked(key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if r {
+			revoked = append(revoked, key)
+		} else {
+			good = append(good, key)
+		}
+	}
+
+	return good, revoked, nil
+}
+
+func (rl *RevocationList) validate() error {
+	if rl.Version != REVOCATION_LIST_VERSION {
+		return errors.Errorf("unsupported revocation list version: %d",
+			rl.Version)
+	}
+
+	seen := map[string]struct{}{}
+	for _, rk := range rl.Keys {
+		keyHash, err := decodeKeyHash(rk.KeyHash)
+		if err != nil {
+			return errors.Wrapf(err, "revocation list")
+		}
+		h := hex.EncodeToString(keyHash)
+		if _, ok := seen[h]; ok {
+			return errors.Errorf("revocation list lists key %s twice",
+				rk.KeyHash)
+		}
+		seen[h] = struct{}{}
+	}
+
+	return nil
+}
+
+// Sign serializes the revocation list and signs it with each of the given
+// signers.
+func (rl *RevocationList) Sign(signers []Signer) ([]byte, error) {
+	if err := rl.validate(); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(rl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode revocation list")
+	}
+
+	sigs, err := signDocument(body, signers, "revocation list")
+	if err != nil {
+		return nil, err
+	}
+
+	srl := SignedRevocationList{
+		List: body,
+		Sigs: sigs,
+	}
+
+	b, err := json.MarshalIndent(srl, "", "    ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode revocation list")
+	}
+
+	return b, nil
+}
+
+// ParseRevocationList decodes a signed revocation list and verifies it
+// against the given root keys.  At least one root key must have produced a
+// valid signature.
+func ParseRevocationList(data []byte,
+	rootKeys []PubSignKey) (RevocationList, error) {
+
+	var srl SignedRevocationList
+	if err := json.Unmarshal(data, &srl); err != nil {
+		return RevocationList{}, errors.Wrapf(err,
+			"failed to parse signed revocation list")
+	}
+
+	if err := verifyDocument(srl.List, srl.Sigs, rootKeys,
+		"revocation list"); err != nil {
+
+		return RevocationList{}, err
+	}
+
+	var rl RevocationList
+	if err := json.Unmarshal(srl.List, &rl); err != nil {
+		return RevocationList{}, errors.Wrapf(err,
+			"failed to parse revocation list")
+	}
+
+	if err := rl.validate(); err != nil {
+		return RevocationList{}, err
+	}
+
+	return rl, nil
+}
@@ -0,0 +1,275 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// SigAlg describes a signature algorithm.  The set of supported algorithms is
+// maintained in a registry; new algorithms are added with RegisterSigAlg.
+type SigAlg struct {
+	Type SigType
+	Name string
+
+	// Image TLV type that carries signatures of this algorithm.
+	TlvType uint8
+
+	// Maximum signature length, in bytes.  If FixedLen is set, every
+	// signature is exactly this long.
+	SigLen   int
+	FixedLen bool
+
+	// Indicates whether the algorithm is believed to resist quantum attacks.
+	PostQuantum bool
+
+	// Indicates whether the given public key is used with this algorithm.
+	MatchKey func(key *PubSignKey) bool
+
+	// Signs a SHA256 image hash.
+	Sign func(key *PrivSignKey, hash []byte) ([]byte, error)
+
+	// Verifies a signature of a SHA256 image hash.
+	Verify func(key *PubSignKey, hash []byte, sig []byte) (bool, error)
+}
+
+// The registry is append-only: registered entries are never modified, so a
+// snapshot of the slice taken under the lock remains valid after it is
+// released.
+var sigAlgs []SigAlg
+var sigAlgsMtx sync.RWMutex
+
+func sigAlgsSnapshot() []SigAlg {
+	sigAlgsMtx.RLock()
+	defer sigAlgsMtx.RUnlock()
+
+	return sigAlgs[:len(sigAlgs):len(sigAlgs)]
+}
+
+// RegisterSigAlg adds a signature algorithm to the registry.  The
+// algorithm's type, name, and TLV type must all be unique.  It is safe to
+// call concurrently with the lookup functions.
+func RegisterSigAlg(alg SigAlg) error {
+	if alg.Name == "" || alg.MatchKey == nil || alg.Sign == nil ||
+		alg.Verify == nil {
+
+		return errors.Errorf("incomplete signature algorithm: %+v", alg)
+	}
+
+	sigAlgsMtx.Lock()
+	defer sigAlgsMtx.Unlock()
+
+	for _, a := range sigAlgs {
+		if a.Type == alg.Type || a.Name == alg.Name ||
+			a.TlvType == alg.TlvType {
+
+			return errors.Errorf(
+				"signature algorithm \"%s\" conflicts with \"%s\"",
+				alg.Name, a.Name)
+		}
+	}
+
+	sigAlgs = append(sigAlgs, alg)
+	return nil
+}
+
+// SigAlgs returns all registered signature algorithms in registration order.
+func SigAlgs() []SigAlg {
+	return append([]SigAlg(nil), sigAlgsSnapshot()...)
+}
+
+// findSigAlg runs pred against a snapshot of the registry rather than under
+// the lock, so a MatchKey callback may itself look up algorithms.
+func findSigAlg(pred func(a *SigAlg) bool) (SigAlg, bool) {
+	algs := sigAlgsSnapshot()
+	for i := range algs {
+		if pred(&algs[i]) {
+			return algs[i], true
+		}
+	}
+
+	return SigAlg{}, false
+}
+
+// SigAlgForType looks up a registered algorithm by signature type.
+func SigAlgForType(typ SigType) (SigAlg, bool) {
+	return findSigAlg(func(a *SigAlg) bool { return a.Type == typ })
+}
+
+// SigAlgForName looks up a registered algorithm by name.
+func SigAlgForName(name string) (SigAlg, bool) {
+	return findSigAlg(func(a *SigAlg) bool { return a.Name == name })
+}
+
+// SigAlgForTlv looks up a registered algorithm by image TLV type.
+func SigAlgForTlv(tlvType uint8) (SigAlg, bool) {
+	return findSigAlg(func(a *SigAlg) bool { return a.TlvType == tlvType })
+}
+
+// SigAlgForKey looks up the registered algorithm used with a public key.
+func SigAlgForKey(key *PubSignKey) (SigAlg, bool) {
+	return findSigAlg(func(a *SigAlg) bool { return a.MatchKey(key) })
+}
+
+// SigTypeIsPostQuantum indicates whether the specified signature type is a
+// registered post-quantum algorithm.
+func SigTypeIsPostQuantum(typ SigType) bool {
+	alg, ok := SigAlgForType(typ)
+	return ok && alg.PostQuantum
+}
+
+func signRsaAlg(key *PrivSignKey, hash []byte) ([]byte, error) {
+	return signRsa(key.Rsa, hash)
+}
+
+func verifyRsaAlg(key *PubSignKey, hash []byte, sig []byte) (bool, error) {
+	opts := rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+	}
+	err := rsa.VerifyPSS(key.Rsa, crypto.SHA256, hash, sig, &opts)
+	return err == nil, nil
+}
+
+func signEcAlg(key *PrivSignKey, hash []byte) ([]byte, error) {
+	return signEc(key.Ec, hash, key.SigLen())
+}
+
+// verifyEcAlg verifies an ASN.1 ECDSA signature.  Some producers zero-pad
+// the signature to a fixed length; trailing zero bytes are ignored.
+func verifyEcAlg(key *PubSignKey, hash []byte, sig []byte) (bool, error) {
+	var es ecdsaSig
+	rest, err := asn1.Unmarshal(sig, &es)
+	if err != nil {
+		return false, nil
+	}
+	for _, b := range rest {
+		if b != 0 {
+			return false, nil
+		}
+	}
+
+	return ecdsa.VerifyASN1(key.Ec, hash, sig[:len(sig)-len(rest)]), nil
+}
+
+func signEd25519Alg(key *PrivSignKey, hash []byte) ([]byte, error) {
+	return signEd25519(*key.Ed25519, hash, key.Ed25519Opts)
+}
+
+func verifyEd25519Alg(key *PubSignKey, hash []byte, sig []byte) (bool, error) {
+	if key.Ed25519Opts != nil {
+		return verifyEd25519(key.Ed25519, hash, sig, *key.Ed25519Opts)
+	}
+
+	// Auto-detect: try pure Ed25519, then Ed25519ph.
+	if ed25519.Verify(key.Ed25519, hash, sig) {
+		return true, nil
+	}
+	return verifyEd25519(key.Ed25519, hash, sig, Ed25519Opts{Prehash: true})
+}
+
+func matchRsa(size int) func(key *PubSignKey) bool {
+	return func(key *PubSignKey) bool {
+		return key.Rsa != nil && key.Rsa.Size() == size
+	}
+}
+
+func matchEc(curve string) func(key *PubSignKey) bool {
+	return func(key *PubSignKey) bool {
+		return key.Ec != nil && key.Ec.Curve.Params().Name == curve
+	}
+}
+
+func init() {
+	builtins := []SigAlg{
+		{
+			Type:     SIG_TYPE_RSA2048,
+			Name:     "rsa2048",
+			TlvType:  0x20,
+			SigLen:   256,
+			FixedLen: true,
+			MatchKey: matchRsa(2048 / 8),
+			Sign:     signRsaAlg,
+			Verify:   verifyRsaAlg,
+		},
+		{
+			Type:     SIG_TYPE_RSA3072,
+			Name:     "rsa3072",
+			TlvType:  0x23,
+			SigLen:   384,
+			FixedLen: true,
+			MatchKey: matchRsa(3072 / 8),
+			Sign:     signRsaAlg,
+			Verify:   verifyRsaAlg,
+		},
+		{
+			Type:     SIG_TYPE_ECDSA224,
+			Name:     "ecdsa224",
+			TlvType:  0x21,
+			SigLen:   68,
+			MatchKey: matchEc("P-224"),
+			Sign:     signEcAlg,
+			Verify:   verifyEcAlg,
+		},
+		{
+			Type:     SIG_TYPE_ECDSA256,
+			Name:     "ecdsa256",
+			TlvType:  0x22,
+			SigLen:   72,
+			MatchKey: matchEc("P-256"),
+			Sign:     signEcAlg,
+			Verify:   verifyEcAlg,
+		},
+		{
+			Type:     SIG_TYPE_ED25519,
+			Name:     "ed25519",
+			TlvType:  0x24,
+			SigLen:   ed25519.SignatureSize,
+			FixedLen: true,
+			MatchKey: func(key *PubSignKey) bool { return key.Ed25519 != nil },
+			Sign:     signEd25519Alg,
+			Verify:   verifyEd25519Alg,
+		},
+	}
+
+	builtins = append(builtins, mlDsaSigAlgs()...)
+	builtins = append(builtins, SigAlg{
+		Type:     SIG_TYPE_ED448,
+		Name:     "ed448",
+		TlvType:  0xae,
+		SigLen:   ED448_SIGNATURE_SIZE,
+		FixedLen: true,
+		MatchKey: func(key *PubSignKey) bool { return key.Ed448 != nil },
+		Sign:     signEd448Alg,
+		Verify:   verifyEd448Alg,
+	})
+
+	for _, alg := range builtins {
+		if err := RegisterSigAlg(alg); err != nil {
+			panic(err.Error())
+		}
+	}
+}
@@ -20,8 +20,6 @@
 package sec
 
 import (
-	"bytes"
-	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/x509"
@@ -41,27 +39,51 @@ const (
 	SIG_TYPE_ECDSA224
 	SIG_TYPE_ECDSA256
 	SIG_TYPE_ED25519
-)
 
-var sigTypeNameMap = map[SigType]string{
-	SIG_TYPE_RSA2048:  "rsa2048",
-	SIG_TYPE_ECDSA224: "ecdsa224",
-	SIG_TYPE_ECDSA256: "ecdsa256",
-	SIG_TYPE_RSA3072:  "rsa3072",
-	SIG_TYPE_ED25519:  "ed25519",
-}
+	// Experimental post-quantum signatures (FIPS 204).
+	SIG_TYPE_MLDSA44
+
+	SIG_TYPE_ED448
+)
 
 type PrivSignKey struct {
 	// Only one of these members is non-nil.
 	Rsa     *rsa.PrivateKey
 	Ec      *ecdsa.PrivateKey
 	Ed25519 *ed25519.PrivateKey
+	MlDsa   *MlDsaPrivateKey
+	Ed448   Ed448PrivateKey
+
+	// Ed25519 variant to sign with.  The zero value selects pure Ed25519.
+	Ed25519Opts Ed25519Opts
 }
 
 type PubSignKey struct {
 	Rsa     *rsa.PublicKey
 	Ec      *ecdsa.PublicKey
 	Ed25519 ed25519.PublicKey
+	MlDsa   *MlDsaPublicKey
+	Ed448   Ed448PublicKey
+
+	// Ed25519 variant to verify with.  If nil, the variant is auto-detected:
+	// pure Ed25519 and Ed25519ph without a context are both accepted.
+	Ed25519Opts *Ed25519Opts
+}
+
+// Ed25519Opts selects an Ed25519 signature variant (RFC 8032).
+type Ed25519Opts struct {
+	// Sign the SHA512 digest of the image hash (Ed25519ph).
+	Prehash bool
+
+	// Context string (Ed25519ctx or Ed25519ph).  At most 255 bytes.
+	Context string
+}
+
+// HybridPubSignKey pairs the classical and post-quantum verification keys of
+// a single signer.  A hybrid-signed image carries a signature from each.
+type HybridPubSignKey struct {
+	Classical   PubSignKey
+	PostQuantum PubSignKey
 }
 
 type Sig struct {
@@ -73,19 +95,17 @@ type Sig struct {
 var oidPrivateKeyEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
 
 func SigTypeString(typ SigType) string {
-	s := sigTypeNameMap[typ]
-	if s == "" {
+	alg, ok := SigAlgForType(typ)
+	if !ok {
 		return "unknown"
 	} else {
-		return s
+		return alg.Name
 	}
 }
 
 func SigStringType(s string) (SigType, error) {
-	for k, v := range sigTypeNameMap {
-		if s == v {
-			return k, nil
-		}
+	if alg, ok := SigAlgForName(s); ok {
+		return alg.Type, nil
 	}
 
 	return 0, errors.Errorf("unknown sig type name: \"%s\"", s)
@@ -127,7 +147,7 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 		// This indicates a PKCS#8 unencrypted private key.
 		// The particular type of key will be indicated within
 		// the key itself.
-		privKey, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		privKey, err = parsePkcs8PrivateKey(block.Bytes)
 	}
 	if block != nil && block.Type == "ENCRYPTED PRIVATE KEY" {
 		// This indicates a PKCS#8 key wrapped with PKCS#5
@@ -138,10 +158,16 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 				err, "Unable to decode encrypted private key")
 		}
 	}
+	if block != nil && block.Type == "OPENSSH PRIVATE KEY" {
+		privKey, err = parseOpenSshPrivKey(block)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if privKey == nil {
 		return nil, errors.Errorf(
 			"Unknown private key format, EC/RSA private " +
-				"key in PEM format only.")
+				"key in PEM or OpenSSH format only.")
 	}
 
 	return privKey, nil
@@ -150,7 +176,13 @@ func parsePrivSignKeyItf(keyBytes []byte) (interface{}, error) {
 func ParsePubSignKey(keyBytes []byte) (PubSignKey, error) {
 	key := PubSignKey{}
 
-	itf, err := parsePubPemKey(keyBytes)
+	var itf interface{}
+	var err error
+	if isAuthorizedKey(keyBytes) {
+		itf, err = parseAuthorizedKey(keyBytes)
+	} else {
+		itf, err = parsePubPemKey(keyBytes)
+	}
 	if err != nil {
 		return key, err
 	}
@@ -162,6 +194,10 @@ func ParsePubSignKey(keyBytes []byte) (PubSignKey, error) {
 		key.Ec = pub
 	case ed25519.PublicKey:
 		key.Ed25519 = pub
+	case *MlDsaPublicKey:
+		key.MlDsa = pub
+	case Ed448PublicKey:
+		key.Ed448 = pub
 	default:
 		return key, errors.Errorf("unknown public signing key type: %T", pub)
 	}
@@ -169,6 +205,56 @@ func ParsePubSignKey(keyBytes []byte) (PubSignKey, error) {
 	return key, nil
 }
 
+// ParsePubSignKeyBytes parses a public signing key in the binary form
+// produced by PubSignKey.Bytes() (i.e., the form used to calculate key hashes
+// and embedded in image PUBKEY TLVs).
+func ParsePubSignKeyBytes(keyBytes []byte) (PubSignKey, error) {
+	key := PubSignKey{}
+
+	if pkix, err := unmarshalEd25519(keyBytes); err == nil &&
+		pkix.Algo.Algorithm.Equal(oidPrivateKeyEd25519) {
+
+		if len(pkix.BitString.Bytes) != ed25519.PublicKeySize {
+			return key, errors.Errorf(
+				"ed25519 public key has wrong size: have=%d want=%d",
+				len(pkix.BitString.Bytes), ed25519.PublicKeySize)
+		}
+
+		key.Ed25519 = ed25519.PublicKey(pkix.BitString.Bytes)
+		return key, nil
+	}
+
+	if ed448Pub, ok, err := parseEd448PubKey(keyBytes); ok {
+		if err != nil {
+			return key, err
+		}
+		key.Ed448 = ed448Pub
+		return key, nil
+	}
+
+	if rsaPub, err := x509.ParsePKCS1PublicKey(keyBytes); err == nil {
+		key.Rsa = rsaPub
+		return key, nil
+	}
+
+	itf, err := x509.ParsePKIXPublicKey(keyBytes)
+	if err != nil {
+		return key, errors.Errorf(
+			"error parsing public key: unrecognized format")
+	}
+
+	switch pub := itf.(type) {
+	case *ecdsa.PublicKey:
+		key.Ec = pub
+	case *MlDsaPublicKey:
+		key.MlDsa = pub
+	default:
+		return key, errors.Errorf("unknown public signing key type: %T", itf)
+	}
+
+	return key, nil
+}
+
 func ParsePrivSignKey(keyBytes []byte) (PrivSignKey, error) {
 	key := PrivSignKey{}
 
@@ -184,6 +270,10 @@ func ParsePrivSignKey(keyBytes []byte) (PrivSignKey, error) {
 		key.Ec = priv
 	case ed25519.PrivateKey:
 		key.Ed25519 = &priv
+	case *MlDsaPrivateKey:
+		key.MlDsa = priv
+	case Ed448PrivateKey:
+		key.Ed448 = priv
 	default:
 		return key, errors.Errorf("unknown private key type: %T", itf)
 	}
@@ -192,8 +282,11 @@ func ParsePrivSignKey(keyBytes []byte) (PrivSignKey, error) {
 }
 
 func (key *PrivSignKey) AssertValid() {
-	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil {
-		panic("invalid key; neither RSA nor ECC nor ED25519")
+	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil &&
+		key.MlDsa == nil && key.Ed448 == nil {
+
+		panic("invalid key; neither RSA nor ECC nor ED25519 nor ML-DSA " +
+			"nor ED448")
 	}
 }
 
@@ -204,8 +297,16 @@ func (key *PrivSignKey) PubKey() PubSignKey {
 		return PubSignKey{Rsa: &key.Rsa.PublicKey}
 	} else if key.Ec != nil {
 		return PubSignKey{Ec: &key.Ec.PublicKey}
+	} else if key.MlDsa != nil {
+		return PubSignKey{MlDsa: mlDsaPublicKey(key.MlDsa)}
+	} else if key.Ed448 != nil {
+		return PubSignKey{Ed448: key.Ed448.Public()}
 	} else {
-		x := PubSignKey{Ed25519: key.Ed25519.Public().(ed25519.PublicKey)}
+		opts := key.Ed25519Opts
+		x := PubSignKey{
+			Ed25519:     key.Ed25519.Public().(ed25519.PublicKey),
+			Ed25519Opts: &opts,
+		}
 		return x
 	}
 }
@@ -216,28 +317,22 @@ func (key *PrivSignKey) PubBytes() ([]byte, error) {
 }
 
 func (key *PrivSignKey) SigLen() uint16 {
-	key.AssertValid()
+	pub := key.PubKey()
 
-	if key.Rsa != nil {
-		pubk := key.Rsa.Public().(*rsa.PublicKey)
-		return uint16(pubk.Size())
-	} else if key.Ec != nil {
-		switch key.Ec.Curve.Params().Name {
-		case "P-224":
-			return 68
-		case "P-256":
-			return 72
-		default:
-			return 0
-		}
-	} else {
-		return ed25519.SignatureSize
+	alg, ok := SigAlgForKey(&pub)
+	if !ok {
+		return 0
 	}
+
+	return uint16(alg.SigLen)
 }
 
 func (key *PubSignKey) AssertValid() {
-	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil {
-		panic("invalid public key; neither RSA nor ECC nor ED25519")
+	if key.Rsa == nil && key.Ec == nil && key.Ed25519 == nil &&
+		key.MlDsa == nil && key.Ed448 == nil {
+
+		panic("invalid public key; neither RSA nor ECC nor ED25519 nor " +
+			"ML-DSA nor ED448")
 	}
 
 	if key.Ed25519 != nil {
@@ -287,23 +382,27 @@ func (key *PubSignKey) Bytes() ([]byte, error) {
 	var b []byte
 	var err error
 
-	typ, err := key.SigType()
-	if err != nil {
+	if _, err := key.SigType(); err != nil {
 		return nil, err
 	}
 
-	switch typ {
-	case SIG_TYPE_RSA2048, SIG_TYPE_RSA3072:
+	// Encode by key representation rather than by signature type so that
+	// registered algorithms (e.g., ECDSA over another curve) are covered.
+	switch {
+	case key.Rsa != nil:
 		b, err = asn1.Marshal(*key.Rsa)
 
-	case SIG_TYPE_ECDSA224, SIG_TYPE_ECDSA256:
+	case key.Ec != nil:
 		b, err = x509.MarshalPKIXPublicKey(key.Ec)
 
-	case SIG_TYPE_ED25519:
+	case key.Ed25519 != nil:
 		b, err = marshalEd25519([]byte(key.Ed25519))
 
+	case key.MlDsa != nil:
+		b, err = marshalMlDsa(key.MlDsa)
+
 	default:
-		err = errors.Errorf("unknown sig type: %v", typ)
+		b, err = marshalEd448(key.Ed448)
 	}
 	if err != nil {
 		return nil, err
@@ -313,6 +412,10 @@ func (key *PubSignKey) Bytes() ([]byte, error) {
 }
 
 func (key *PubSignKey) SigType() (SigType, error) {
+	if alg, ok := SigAlgForKey(key); ok {
+		return alg.Type, nil
+	}
+
 	if key.Rsa != nil {
 		switch key.Rsa.Size() {
 		case 2048 / 8:
@@ -333,6 +436,9 @@ func (key *PubSignKey) SigType() (SigType, error) {
 		}
 	} else if key.Ed25519 != nil {
 		return SIG_TYPE_ED25519, nil
+	} else if key.MlDsa != nil {
+		return 0, errors.Errorf("unsupported ML-DSA parameter set: %s",
+			mlDsaParamsName(key.MlDsa))
 	}
 
 	return 0, errors.Errorf("invalid key: no non-nil members")
@@ -348,33 +454,20 @@ func (key *PubSignKey) Hash() ([]byte, error) {
 }
 
 func checkOneKeyOneSig(k PubSignKey, sig Sig, hash []byte) (bool, error) {
-	keyHash, err := k.Hash()
+	match, err := KeyHashMatchesKey(&k, sig.KeyHash)
 	if err != nil {
 		return false, err
 	}
-
-	if !bytes.Equal(keyHash, sig.KeyHash) {
+	if !match {
 		return false, nil
 	}
 
-	if k.Rsa != nil {
-		opts := rsa.PSSOptions{
-			SaltLength: rsa.PSSSaltLengthEqualsHash,
-		}
-		err := rsa.VerifyPSS(k.Rsa, crypto.SHA256, hash, sig.Data, &opts)
-		return err == nil, nil
-	}
-
-	if k.Ec != nil {
-		return false, errors.Errorf(
-			"ecdsa signature verification not supported")
-	}
-
-	if k.Ed25519 != nil {
-		return ed25519.Verify(k.Ed25519, hash, sig.Data), nil
+	alg, ok := SigAlgForKey(&k)
+	if !ok {
+		return false, nil
 	}
 
-	return false, nil
+	return alg.Verify(&k, hash, sig.Data)
 }
 
 func VerifySigs(key PubSignKey, sigs []Sig, hash []byte) (int, error) {
@@ -0,0 +1,184 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"encoding/asn1"
+	"io"
+	"math/big"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Signer produces image signatures.  A signer need not have access to the
+// private key material (e.g., the key may reside in an HSM).  Sign need not
+// be safe for concurrent use; callers that sign concurrently must know that
+// the signer allows it.
+type Signer interface {
+	// PubKey returns the public key corresponding to the signing key.
+	PubKey() PubSignKey
+
+	// Sign signs the given SHA256 image hash.  The returned signature is in
+	// the format expected in the corresponding image TLV.
+	Sign(hash []byte) ([]byte, error)
+}
+
+// CloseSigners closes each signer that implements io.Closer, e.g., to
+// release an ssh-agent connection or zeroize a private key.  Every signer is
+// closed; the first error is returned.
+func CloseSigners(signers []Signer) error {
+	var first error
+	for _, s := range signers {
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+type ecdsaSig struct {
+	R *big.Int
+	S *big.Int
+}
+
+func signRsa(key *rsa.PrivateKey, hash []byte) ([]byte, error) {
+	opts := rsa.PSSOptions{
+		SaltLength: rsa.PSSSaltLengthEqualsHash,
+	}
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, hash, &opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compute signature")
+	}
+
+	return signature, nil
+}
+
+func signEc(key *ecdsa.PrivateKey, hash []byte, sigLen uint16) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to compute signature")
+	}
+
+	return encodeEcSig(r, s, sigLen)
+}
+
+// encodeEcSig converts an ECDSA signature into the ASN.1 form used in image
+// TLVs.
+func encodeEcSig(r *big.Int, s *big.Int, sigLen uint16) ([]byte, error) {
+	signature, err := asn1.Marshal(ecdsaSig{R: r, S: s})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to construct signature")
+	}
+
+	if len(signature) > int(sigLen) {
+		return nil, errors.Errorf("signature truncated")
+	}
+
+	return signature, nil
+}
+
+// ed25519Msg returns the message and options to pass to the standard library
+// for the given Ed25519 variant.
+func ed25519Msg(hash []byte, opts Ed25519Opts) ([]byte, *stded25519.Options, error) {
+	if len(opts.Context) > 255 {
+		return nil, nil, errors.Errorf(
+			"ed25519 context too long: have=%d max=255", len(opts.Context))
+	}
+
+	stdOpts := &stded25519.Options{
+		Context: opts.Context,
+	}
+
+	if opts.Prehash {
+		digest := sha512.Sum512(hash)
+		stdOpts.Hash = crypto.SHA512
+		return digest[:], stdOpts, nil
+	}
+
+	return hash, stdOpts, nil
+}
+
+func signEd25519(key ed25519.PrivateKey, hash []byte,
+	opts Ed25519Opts) ([]byte, error) {
+
+	var sig []byte
+
+	if opts == (Ed25519Opts{}) {
+		sig = ed25519.Sign(key, hash)
+	} else {
+		msg, stdOpts, err := ed25519Msg(hash, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err = stded25519.PrivateKey(key).Sign(nil, msg, stdOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compute signature")
+		}
+	}
+
+	if len(sig) != ed25519.SignatureSize {
+		return nil, errors.Errorf(
+			"ed25519 signature has wrong length: have=%d want=%d",
+			len(sig), ed25519.SignatureSize)
+	}
+
+	return sig, nil
+}
+
+func verifyEd25519(key ed25519.PublicKey, hash []byte, sig []byte,
+	opts Ed25519Opts) (bool, error) {
+
+	msg, stdOpts, err := ed25519Msg(hash, opts)
+	if err != nil {
+		return false, err
+	}
+
+	err = stded25519.VerifyWithOptions(
+		stded25519.PublicKey(key), msg, sig, stdOpts)
+	return err == nil, nil
+}
+
+// Sign signs the given image hash with the private key.  This allows a
+// PrivSignKey to be used as a Signer.
+func (key *PrivSignKey) Sign(hash []byte) ([]byte, error) {
+	pub := key.PubKey()
+
+	alg, ok := SigAlgForKey(&pub)
+	if !ok {
+		typ, err := pub.SigType()
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.Errorf("unknown sig type: %v", typ)
+	}
+
+	return alg.Sign(key, hash)
+}
@@ -0,0 +1,150 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/pem"
+	"math/big"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const openSshKeyMagic = "openssh-key-v1\x00"
+
+// isAuthorizedKey indicates whether the given bytes look like a public key
+// in OpenSSH authorized_keys format (e.g., the contents of id_ed25519.pub).
+func isAuthorizedKey(keyBytes []byte) bool {
+	s := string(keyBytes)
+	return strings.HasPrefix(s, "ssh-") || strings.HasPrefix(s, "ecdsa-sha2-")
+}
+
+// parseAuthorizedKey parses a public key in OpenSSH authorized_keys format.
+func parseAuthorizedKey(keyBytes []byte) (interface{}, error) {
+	sshKey, _, _, _, err := ssh.ParseAuthorizedKey(keyBytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing OpenSSH public key")
+	}
+
+	cpk, ok := sshKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, errors.Errorf(
+			"unsupported OpenSSH public key type: %s", sshKey.Type())
+	}
+
+	return cpk.CryptoPublicKey(), nil
+}
+
+// parseOpenSshPrivKey parses the body of an "OPENSSH PRIVATE KEY" PEM block
+// (openssh-key-v1; see PROTOCOL.key in the OpenSSH sources).  Encrypted keys
+// are not supported; decrypt them first with `ssh-keygen -p`.
+func parseOpenSshPrivKey(block *pem.Block) (interface{}, error) {
+	data := block.Bytes
+	if !strings.HasPrefix(string(data), openSshKeyMagic) {
+		return nil, errors.Errorf("invalid OpenSSH private key: bad magic")
+	}
+
+	var outer struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}
+	if err := ssh.Unmarshal(data[len(openSshKeyMagic):], &outer); err != nil {
+		return nil, errors.Wrapf(err, "invalid OpenSSH private key")
+	}
+	if outer.CipherName != "none" || outer.KdfName != "none" {
+		return nil, errors.Errorf(
+			"encrypted OpenSSH private keys are not supported "+
+				"(cipher=%s); remove the passphrase with `ssh-keygen -p`",
+			outer.CipherName)
+	}
+
+	var inner struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Rest    []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(outer.PrivKeyBlock, &inner); err != nil {
+		return nil, errors.Wrapf(err, "invalid OpenSSH private key")
+	}
+
+	// The ssh package handles RSA and Ed25519 keys itself.
+	if !strings.HasPrefix(inner.KeyType, "ecdsa-sha2-") {
+		itf, err := ssh.ParseRawPrivateKey(pem.EncodeToMemory(block))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing OpenSSH private key")
+		}
+
+		// Normalize to the form produced by the PKCS#8 parser.
+		if edKey, ok := itf.(*ed25519.PrivateKey); ok {
+			itf = *edKey
+		}
+		return itf, nil
+	}
+
+	var ec struct {
+		Curve   string
+		Pub     []byte
+		D       *big.Int
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}
+	if err := ssh.Unmarshal(inner.Rest, &ec); err != nil {
+		return nil, errors.Wrapf(err, "invalid OpenSSH ECDSA private key")
+	}
+
+	var curve elliptic.Curve
+	switch ec.Curve {
+	case "nistp224":
+		curve = elliptic.P224()
+	case "nistp256":
+		curve = elliptic.P256()
+	default:
+		return nil, errors.Errorf(
+			"unsupported OpenSSH ECDSA curve: %s", ec.Curve)
+	}
+
+	x, y := elliptic.Unmarshal(curve, ec.Pub)
+	if x == nil {
+		return nil, errors.Errorf("invalid OpenSSH ECDSA public point")
+	}
+
+	priv := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: curve, X: x, Y: y},
+		D:         ec.D,
+	}
+
+	// Guard against a mismatched public and private half.
+	cx, cy := curve.ScalarBaseMult(ec.D.Bytes())
+	if cx.Cmp(x) != 0 || cy.Cmp(y) != 0 {
+		return nil, errors.Errorf(
+			"invalid OpenSSH ECDSA private key: public key mismatch")
+	}
+
+	return priv, nil
+}
@@ -0,0 +1,185 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Key specifiers with this prefix select a key held by the local ssh-agent.
+// The remainder of the specifier is the key's SHA256 fingerprint (as
+// printed by `ssh-add -l`) or its comment.  If empty, the agent must hold
+// exactly one usable key.
+const SSH_AGENT_SPEC_PREFIX = "ssh-agent:"
+
+type sshAgentSigner struct {
+	agent  agent.Agent
+	sshPub ssh.PublicKey
+	pub    PubSignKey
+
+	// The agent connection, if the signer opened it; nil otherwise.
+	conn io.Closer
+}
+
+// IsSshAgentSpec indicates whether a key specifier refers to an ssh-agent
+// key.
+func IsSshAgentSpec(s string) bool {
+	return strings.HasPrefix(s, SSH_AGENT_SPEC_PREFIX)
+}
+
+// NewSshAgentSigner creates a signer for a key held by the ssh-agent
+// listening on $SSH_AUTH_SOCK.  The private key never leaves the agent.
+//
+// Only Ed25519 keys are supported.  For other key types the agent hashes
+// the data it is given and applies a padding scheme that differs from
+// MCUboot's (PKCS#1 v1.5 rather than PSS for RSA), so it cannot produce a
+// valid image signature.
+//
+// The signer keeps its agent connection open.  It implements io.Closer;
+// close it (e.g., with CloseSigners) when it is no longer needed.
+func NewSshAgentSigner(spec string) (Signer, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.Errorf(
+			"cannot use key %s: SSH_AUTH_SOCK not set", spec)
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to ssh-agent")
+	}
+
+	signer, err := newSshAgentSigner(agent.NewClient(conn), spec)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	signer.conn = conn
+
+	return signer, nil
+}
+
+// NewSshAgentSignerFromAgent creates a signer for a key held by the given
+// agent.  spec has the same form as for NewSshAgentSigner.  The caller owns
+// the agent; closing the signer does not affect it.
+func NewSshAgentSignerFromAgent(a agent.Agent, spec string) (Signer, error) {
+	return newSshAgentSigner(a, spec)
+}
+
+func newSshAgentSigner(a agent.Agent, spec string) (*sshAgentSigner, error) {
+	sel := strings.TrimPrefix(spec, SSH_AGENT_SPEC_PREFIX)
+
+	keys, err := a.List()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list ssh-agent keys")
+	}
+
+	var matches []*agent.Key
+	for _, k := range keys {
+		if sel == "" && k.Type() != ssh.KeyAlgoED25519 {
+			continue
+		}
+		if sel == "" || sel == ssh.FingerprintSHA256(k) || sel == k.Comment {
+			matches = append(matches, k)
+		}
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.Errorf("ssh-agent holds no key matching \"%s\"", sel)
+	}
+	if len(matches) > 1 {
+		return nil, errors.Errorf(
+			"ssh-agent holds %d keys matching \"%s\"; "+
+				"specify a fingerprint", len(matches), sel)
+	}
+
+	k := matches[0]
+	if k.Type() != ssh.KeyAlgoED25519 {
+		return nil, errors.Errorf(
+			"ssh-agent signing not supported for %s keys; "+
+				"only Ed25519 keys can sign image hashes", k.Type())
+	}
+
+	sshPub, err := ssh.ParsePublicKey(k.Marshal())
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ssh-agent public key")
+	}
+	edPub, ok := sshPub.(ssh.CryptoPublicKey).CryptoPublicKey().(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("invalid ssh-agent Ed25519 public key")
+	}
+
+	return &sshAgentSigner{
+		agent:  a,
+		sshPub: sshPub,
+		pub:    PubSignKey{Ed25519: edPub},
+	}, nil
+}
+
+// Close releases the agent connection if the signer opened it.  The signer
+// is unusable afterwards.
+func (s *sshAgentSigner) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	s.agent = nil
+	if err != nil {
+		return errors.Wrapf(err, "failed to close ssh-agent connection")
+	}
+
+	return nil
+}
+
+func (s *sshAgentSigner) PubKey() PubSignKey {
+	return s.pub
+}
+
+func (s *sshAgentSigner) Sign(hash []byte) ([]byte, error) {
+	if s.agent == nil {
+		return nil, errors.Errorf("ssh-agent signer is closed")
+	}
+
+	sig, err := s.agent.Sign(s.sshPub, hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ssh-agent signing failed for %s",
+			ssh.FingerprintSHA256(s.sshPub))
+	}
+
+	if sig.Format != ssh.KeyAlgoED25519 ||
+		len(sig.Blob) != ed25519.SignatureSize {
+
+		return nil, errors.Errorf(
+			"ssh-agent returned unexpected signature: format=%s len=%d",
+			sig.Format, len(sig.Blob))
+	}
+
+	return sig.Blob, nil
+}
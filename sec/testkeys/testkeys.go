@@ -0,0 +1,369 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package testkeys deterministically generates a full set of signing and
+// encryption keys from a seed.  It is intended for tests: the keys are
+// reproducible, so tests need not check in key fixtures, but they are not
+// secret and must never be used to sign or encrypt production artifacts.
+package testkeys
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+// The seed used by Default().
+const DEFAULT_SEED = "mynewt-artifact test keys"
+
+// Names of the files written by Keys.WriteDir().
+const (
+	FILE_SIGN_RSA2048     = "sign-rsa2048.pem"
+	FILE_SIGN_RSA2048_PUB = "sign-rsa2048-pub.pem"
+	FILE_SIGN_RSA3072     = "sign-rsa3072.pem"
+	FILE_SIGN_RSA3072_PUB = "sign-rsa3072-pub.pem"
+	FILE_SIGN_P256        = "sign-p256.pem"
+	FILE_SIGN_P256_PUB    = "sign-p256-pub.pem"
+	FILE_SIGN_ED25519     = "sign-ed25519.pem"
+	FILE_SIGN_ED25519_PUB = "sign-ed25519-pub.pem"
+	FILE_ENC_RSA2048      = "enc-rsa2048.der"
+	FILE_ENC_RSA2048_PUB  = "enc-rsa2048-pub.pem"
+	FILE_ENC_P256_PUB     = "enc-p256-pub.pem"
+	FILE_ENC_X25519       = "enc-x25519.pem"
+	FILE_ENC_AES128       = "enc-aes128.b64"
+	FILE_ENC_AES256       = "enc-aes256.b64"
+)
+
+// Keys is a set of keys derived from a single seed.  Sets returned by
+// Generate() are shared between callers and must not be modified.
+type Keys struct {
+	Rsa2048 *rsa.PrivateKey
+	Rsa3072 *rsa.PrivateKey
+	P256    *ecdsa.PrivateKey
+	Ed25519 ed25519.PrivateKey
+	X25519  *ecdh.PrivateKey
+	Aes128  []byte
+	Aes256  []byte
+}
+
+var cache = struct {
+	mtx  sync.Mutex
+	keys map[string]*Keys
+}{
+	keys: map[string]*Keys{},
+}
+
+// keyStream produces an endless, deterministic byte stream for one key.
+// Each key is drawn from its own stream so that adding a key type does not
+// change the others.
+func keyStream(seed []byte, label string) io.Reader {
+	h := sha256.New()
+	h.Write(seed)
+	h.Write([]byte{0})
+	h.Write([]byte(label))
+
+	blk, _ := aes.NewCipher(h.Sum(nil))
+	stream := cipher.NewCTR(blk, make([]byte, aes.BlockSize))
+
+	return &cipher.StreamReader{S: stream, R: zeroReader{}}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func readBytes(r io.Reader, n int) []byte {
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return b
+}
+
+// generatePrime returns the first prime at or above a random starting point
+// whose top two bits are set.
+func generatePrime(r io.Reader, bits int) *big.Int {
+	b := readBytes(r, (bits+7)/8)
+	if excess := len(b)*8 - bits; excess > 0 {
+		b[0] &= 0xff >> uint(excess)
+	}
+
+	p := new(big.Int).SetBytes(b)
+	p.SetBit(p, bits-1, 1)
+	p.SetBit(p, bits-2, 1)
+	p.SetBit(p, 0, 1)
+
+	two := big.NewInt(2)
+	for !p.ProbablyPrime(20) {
+		p.Add(p, two)
+	}
+
+	return p
+}
+
+// generateRsa generates an RSA key from the given stream.  The standard
+// library's generator does not use the caller's random source
+// deterministically, so the primes are found here.
+func generateRsa(r io.Reader, bits int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(65537)
+	one := big.NewInt(1)
+
+	for {
+		p := generatePrime(r, bits/2)
+		q := generatePrime(r, bits-bits/2)
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+
+		pm1 := new(big.Int).Sub(p, one)
+		qm1 := new(big.Int).Sub(q, one)
+		phi := new(big.Int).Mul(pm1, qm1)
+
+		d := new(big.Int).ModInverse(e, phi)
+		if d == nil {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: int(e.Int64())},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		if err := key.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "generated invalid RSA key")
+		}
+
+		return key, nil
+	}
+}
+
+// generateP256 generates a P-256 key from the given stream.  The scalar is
+// reduced from 64 bits more than the order to keep its bias negligible.
+func generateP256(r io.Reader) (*ecdsa.PrivateKey, error) {
+	curve := elliptic.P256()
+	nm1 := new(big.Int).Sub(curve.Params().N, big.NewInt(1))
+
+	k := new(big.Int).SetBytes(readBytes(r, 40))
+	k.Mod(k, nm1)
+	k.Add(k, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{D: k}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(k.Bytes())
+
+	return key, nil
+}
+
+func generate(seed []byte) (*Keys, error) {
+	var keys Keys
+	var err error
+
+	keys.Rsa2048, err = generateRsa(keyStream(seed, "rsa2048"), 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.Rsa3072, err = generateRsa(keyStream(seed, "rsa3072"), 3072)
+	if err != nil {
+		return nil, err
+	}
+
+	keys.P256, err = generateP256(keyStream(seed, "p256"))
+	if err != nil {
+		return nil, err
+	}
+
+	keys.Ed25519 = ed25519.NewKeyFromSeed(
+		readBytes(keyStream(seed, "ed25519"), ed25519.SeedSize))
+
+	keys.X25519, err = ecdh.X25519().NewPrivateKey(
+		readBytes(keyStream(seed, "x25519"), 32))
+	if err != nil {
+		return nil, errors.Wrapf(err, "generated invalid X25519 key")
+	}
+
+	keys.Aes128 = readBytes(keyStream(seed, "aes128"), 16)
+	keys.Aes256 = readBytes(keyStream(seed, "aes256"), 32)
+
+	return &keys, nil
+}
+
+// Generate derives a set of keys from the given seed.  The same seed always
+// produces the same keys.  RSA key generation is slow, so results are
+// cached for the life of the process.
+func Generate(seed []byte) (*Keys, error) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+
+	if keys := cache.keys[string(seed)]; keys != nil {
+		return keys, nil
+	}
+
+	keys, err := generate(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.keys[string(seed)] = keys
+	return keys, nil
+}
+
+// Default returns the set of keys derived from DEFAULT_SEED.  It panics if
+// the keys cannot be generated.
+func Default() *Keys {
+	keys, err := Generate([]byte(DEFAULT_SEED))
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return keys
+}
+
+// SignKeys returns each of the set's signing keys: RSA-2048, RSA-3072,
+// P-256, and Ed25519.
+func (k *Keys) SignKeys() []sec.PrivSignKey {
+	ed := k.Ed25519
+	return []sec.PrivSignKey{
+		{Rsa: k.Rsa2048},
+		{Rsa: k.Rsa3072},
+		{Ec: k.P256},
+		{Ed25519: &ed},
+	}
+}
+
+// EncKey returns the set's RSA-2048 encryption key.
+func (k *Keys) EncKey() sec.PrivEncKey {
+	return sec.PrivEncKey{Rsa: k.Rsa2048}
+}
+
+func pemBlock(typ string, der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+}
+
+func pubPem(pub interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode public key")
+	}
+
+	return pemBlock("PUBLIC KEY", der), nil
+}
+
+func pkcs8Pem(priv interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode private key")
+	}
+
+	return pemBlock("PRIVATE KEY", der), nil
+}
+
+// Files returns the set's keys serialized in the formats the sec package
+// reads, keyed by file name (FILE_...).
+func (k *Keys) Files() (map[string][]byte, error) {
+	files := map[string][]byte{
+		FILE_SIGN_RSA2048: pemBlock("RSA PRIVATE KEY",
+			x509.MarshalPKCS1PrivateKey(k.Rsa2048)),
+		FILE_SIGN_RSA3072: pemBlock("RSA PRIVATE KEY",
+			x509.MarshalPKCS1PrivateKey(k.Rsa3072)),
+		FILE_ENC_RSA2048: x509.MarshalPKCS1PrivateKey(k.Rsa2048),
+		FILE_ENC_AES128: []byte(
+			base64.StdEncoding.EncodeToString(k.Aes128)),
+		FILE_ENC_AES256: []byte(
+			base64.StdEncoding.EncodeToString(k.Aes256)),
+	}
+
+	ecDer, err := x509.MarshalECPrivateKey(k.P256)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode private key")
+	}
+	files[FILE_SIGN_P256] = pemBlock("EC PRIVATE KEY", ecDer)
+
+	privs := map[string]interface{}{
+		FILE_SIGN_ED25519: k.Ed25519,
+		FILE_ENC_X25519:   k.X25519,
+	}
+	for name, priv := range privs {
+		files[name], err = pkcs8Pem(priv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pubs := map[string]interface{}{
+		FILE_SIGN_RSA2048_PUB: &k.Rsa2048.PublicKey,
+		FILE_SIGN_RSA3072_PUB: &k.Rsa3072.PublicKey,
+		FILE_SIGN_P256_PUB:    &k.P256.PublicKey,
+		FILE_SIGN_ED25519_PUB: k.Ed25519.Public(),
+		FILE_ENC_RSA2048_PUB:  &k.Rsa2048.PublicKey,
+		FILE_ENC_P256_PUB:     &k.P256.PublicKey,
+	}
+	for name, pub := range pubs {
+		files[name], err = pubPem(pub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// WriteDir writes the set's key files to the specified directory, which
+// must exist.
+func (k *Keys) WriteDir(dir string) error {
+	files, err := k.Files()
+	if err != nil {
+		return err
+	}
+
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, os.FileMode(0600)); err != nil {
+			return errors.Wrapf(err, "failed to write key file")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package testkeys
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+func TestGenerate(t *testing.T) {
+	a, err := generate([]byte("seed-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := generate([]byte("seed-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := generate([]byte("seed-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	af, err := a.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2f, err := a2.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bf, err := b.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range af {
+		if !bytes.Equal(data, a2f[name]) {
+			t.Fatalf("%s differs between runs with the same seed", name)
+		}
+		if bytes.Equal(data, bf[name]) {
+			t.Fatalf("%s identical for different seeds", name)
+		}
+	}
+
+	if a.Rsa2048.N.BitLen() != 2048 || a.Rsa3072.N.BitLen() != 3072 {
+		t.Fatalf("wrong RSA key sizes")
+	}
+
+	if keys, err := Generate([]byte("seed-a")); err != nil {
+		t.Fatal(err)
+	} else if again, _ := Generate([]byte("seed-a")); again != keys {
+		t.Fatalf("generated keys not cached")
+	}
+}
+
+func TestWriteDir(t *testing.T) {
+	dir := t.TempDir()
+	keys := Default()
+
+	if err := keys.WriteDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	pairs := [][2]string{
+		{FILE_SIGN_RSA2048, FILE_SIGN_RSA2048_PUB},
+		{FILE_SIGN_RSA3072, FILE_SIGN_RSA3072_PUB},
+		{FILE_SIGN_P256, FILE_SIGN_P256_PUB},
+		{FILE_SIGN_ED25519, FILE_SIGN_ED25519_PUB},
+	}
+	for _, pair := range pairs {
+		priv, err := sec.ReadPrivSignKey(path(pair[0]))
+		if err != nil {
+			t.Fatalf("%s: %s", pair[0], err.Error())
+		}
+		pub, err := sec.ReadPubSignKey(path(pair[1]))
+		if err != nil {
+			t.Fatalf("%s: %s", pair[1], err.Error())
+		}
+
+		have, err := priv.PubBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := pub.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Fatalf("%s does not match %s", pair[0], pair[1])
+		}
+	}
+
+	encKey, err := sec.ReadPrivEncKey(path(FILE_ENC_RSA2048))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubEncKey, err := sec.ReadPubEncKey(path(FILE_ENC_RSA2048_PUB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciph, err := pubEncKey.Encrypt([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := encKey.Decrypt(ciph)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != "secret" {
+		t.Fatalf("wrong decrypted secret")
+	}
+
+	for _, name := range []string{FILE_ENC_AES128, FILE_ENC_AES256} {
+		if _, err := sec.ReadPubEncKey(path(name)); err != nil {
+			t.Fatalf("%s: %s", name, err.Error())
+		}
+	}
+}
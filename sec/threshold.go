@@ -0,0 +1,427 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// A threshold signing session collects signatures over an image hash from a
+// set of n authorized keys.  The image is only finalized once k of them have
+// signed.  Signers need not be available at the same time: the session is a
+// JSON document that can be passed from one key holder to the next, so a
+// signing ceremony may span days.  Every signature is verified as it is
+// added and again whenever the session is parsed.
+
+const THRESHOLD_SESSION_VERSION = 1
+
+// ThresholdSigner identifies one of the keys authorized to sign in a
+// threshold session.
+type ThresholdSigner struct {
+	// Hex-encoded public key, in the form produced by PubSignKey.Bytes().
+	PubKey string `json:"pubkey"`
+
+	// Optional name of the key holder.
+	Name string `json:"name,omitempty"`
+}
+
+// ThresholdSig is a signature collected in a threshold session.
+type ThresholdSig struct {
+	Signer int       `json:"signer"` // Index into ThresholdSession.Signers.
+	Sig    string    `json:"sig"`    // Hex-encoded.
+	Time   time.Time `json:"time"`   // When the signature was added.
+}
+
+// ThresholdSession is the serializable state of a threshold signing
+// ceremony.
+type ThresholdSession struct {
+	Version int `json:"version"`
+
+	// Hex-encoded hash being signed.
+	Hash string `json:"hash"`
+
+	// Number of signatures required to finalize the session.
+	Threshold int `json:"threshold"`
+
+	Created time.Time         `json:"created"`
+	Comment string            `json:"comment,omitempty"`
+	Signers []ThresholdSigner `json:"signers"`
+	Sigs    []ThresholdSig    `json:"signatures"`
+}
+
+// NewThresholdSession starts a session requiring threshold signatures over
+// the given hash from the given keys.
+func NewThresholdSession(hash []byte, threshold int,
+	keys []PubSignKey) (ThresholdSession, error) {
+
+	s := ThresholdSession{
+		Version:   THRESHOLD_SESSION_VERSION,
+		Hash:      hex.EncodeToString(hash),
+		Threshold: threshold,
+		Created:   time.Now().UTC(),
+		Signers:   []ThresholdSigner{},
+		Sigs:      []ThresholdSig{},
+	}
+
+	for i := range keys {
+		b, err := keys[i].Bytes()
+		if err != nil {
+			return s, err
+		}
+		s.Signers = append(s.Signers, ThresholdSigner{
+			PubKey: hex.EncodeToString(b),
+		})
+	}
+
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// ParseThresholdSession parses a serialized threshold session and verifies
+// the signatures it contains.
+func ParseThresholdSession(data []byte) (ThresholdSession, error) {
+	var s ThresholdSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return s, errors.Wrapf(err, "failed to parse threshold session")
+	}
+
+	if err := s.validate(); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Marshal serializes the session for storage or transfer to the next key
+// holder.
+func (s *ThresholdSession) Marshal() ([]byte, error) {
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to serialize threshold session")
+	}
+
+	return append(b, '\n'), nil
+}
+
+func (s *ThresholdSession) hashBytes() ([]byte, error) {
+	hash, err := hex.DecodeString(s.Hash)
+	if err != nil || len(hash) == 0 {
+		return nil, errors.Errorf(
+			"threshold session contains invalid hash: \"%s\"", s.Hash)
+	}
+
+	return hash, nil
+}
+
+// Keys returns the public keys authorized to sign, in signer order.
+func (s *ThresholdSession) Keys() ([]PubSignKey, error) {
+	keys := make([]PubSignKey, len(s.Signers))
+	for i, ts := range s.Signers {
+		b, err := hex.DecodeString(ts.PubKey)
+		if err != nil {
+			return nil, errors.Errorf(
+				"threshold session signer %d has invalid public key", i)
+		}
+		keys[i], err = ParsePubSignKeyBytes(b)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"threshold session signer %d has invalid public key", i)
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *ThresholdSession) validate() error {
+	if s.Version != THRESHOLD_SESSION_VERSION {
+		return errors.Errorf("unsupported threshold session version: %d",
+			s.Version)
+	}
+
+	hash, err := s.hashBytes()
+	if err != nil {
+		return err
+	}
+
+	if s.Threshold < 1 || s.Threshold > len(s.Signers) {
+		return errors.Errorf("invalid signing threshold: have=%d want=1-%d",
+			s.Threshold, len(s.Signers))
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]struct{}{}
+	for i, ts := range s.Signers {
+		pk := strings.ToLower(ts.PubKey)
+		if _, ok := seen[pk]; ok {
+			return errors.Errorf(
+				"threshold session lists signer %d's key twice", i)
+		}
+		seen[pk] = struct{}{}
+	}
+
+	signed := map[int]struct{}{}
+	for _, ts := range s.Sigs {
+		if ts.Signer < 0 || ts.Signer >= len(keys) {
+			return errors.Errorf(
+				"threshold session signature has invalid signer index: %d",
+				ts.Signer)
+		}
+		if _, ok := signed[ts.Signer]; ok {
+			return errors.Errorf(
+				"threshold session contains two signatures by signer %d",
+				ts.Signer)
+		}
+		signed[ts.Signer] = struct{}{}
+
+		sig, err := hex.DecodeString(ts.Sig)
+		if err != nil {
+			return errors.Errorf(
+				"threshold session signature by signer %d is not hex",
+				ts.Signer)
+		}
+		if err := checkThresholdSig(keys[ts.Signer], hash, sig); err != nil {
+			return errors.Wrapf(err, "signer %d", ts.Signer)
+		}
+	}
+
+	return nil
+}
+
+// checkThresholdSig verifies a single signature over the session hash.
+func checkThresholdSig(key PubSignKey, hash []byte, sig []byte) error {
+	alg, found := SigAlgForKey(&key)
+	if !found {
+		return errors.Errorf("unsupported threshold signing key")
+	}
+
+	ok, err := alg.Verify(&key, hash, sig)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.Errorf("invalid threshold signature")
+	}
+
+	return nil
+}
+
+// signerIndex returns the index of the given key in the session's signer
+// list, or -1 if the key is not authorized to sign.
+func (s *ThresholdSession) signerIndex(key PubSignKey) (int, error) {
+	b, err := key.Bytes()
+	if err != nil {
+		return -1, err
+	}
+
+	for i, ts := range s.Signers {
+		pk, err := hex.DecodeString(ts.PubKey)
+		if err == nil && bytes.Equal(pk, b) {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+// HasSigned indicates whether the signer at the given index has signed.
+func (s *ThresholdSession) HasSigned(idx int) bool {
+	for _, ts := range s.Sigs {
+		if ts.Signer == idx {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Remaining returns the number of signatures still required.
+func (s *ThresholdSession) Remaining() int {
+	if n := s.Threshold - len(s.Sigs); n > 0 {
+		return n
+	}
+
+	return 0
+}
+
+// Complete indicates whether enough signatures have been collected.
+func (s *ThresholdSession) Complete() bool {
+	return s.Remaining() == 0
+}
+
+// Pending returns the indices of the signers that have not yet signed.
+func (s *ThresholdSession) Pending() []int {
+	var pending []int
+	for i := range s.Signers {
+		if !s.HasSigned(i) {
+			pending = append(pending, i)
+		}
+	}
+
+	return pending
+}
+
+// AddSig attaches a signature produced out of band by the given key.  The
+// key must be one of the session's signers and must not have signed
+// already.
+func (s *ThresholdSession) AddSig(key PubSignKey, sig []byte) error {
+	idx, err := s.signerIndex(key)
+	if err != nil {
+		return err
+	}
+	if idx == -1 {
+		keyHash, _ := key.Hash()
+		return errors.Errorf(
+			"key %x is not a signer in this threshold session", keyHash)
+	}
+	if s.HasSigned(idx) {
+		return errors.Errorf("signer %d has already signed", idx)
+	}
+
+	hash, err := s.hashBytes()
+	if err != nil {
+		return err
+	}
+	if err := checkThresholdSig(key, hash, sig); err != nil {
+		return errors.Wrapf(err, "signer %d", idx)
+	}
+
+	s.Sigs = append(s.Sigs, ThresholdSig{
+		Signer: idx,
+		Sig:    hex.EncodeToString(sig),
+		Time:   time.Now().UTC(),
+	})
+
+	return nil
+}
+
+// Sign signs the session hash with the given signer and attaches the
+// signature.
+func (s *ThresholdSession) Sign(signer Signer) error {
+	hash, err := s.hashBytes()
+	if err != nil {
+		return err
+	}
+
+	pub := signer.PubKey()
+	idx, err := s.signerIndex(pub)
+	if err != nil {
+		return err
+	}
+	if idx != -1 && s.HasSigned(idx) {
+		return errors.Errorf("signer %d has already signed", idx)
+	}
+
+	sig, err := signer.Sign(hash)
+	if err != nil {
+		return errors.Wrapf(err, "threshold signing failed")
+	}
+
+	return s.AddSig(pub, sig)
+}
+
+// Distribute asks each of the given signers to sign, stopping once the
+// threshold is met.  A signer that fails or has already signed does not
+// stop the others.  An error describing the failures is returned if the
+// session is still incomplete afterwards.
+func (s *ThresholdSession) Distribute(signers []Signer) error {
+	var failures []string
+
+	for _, signer := range signers {
+		if s.Complete() {
+			break
+		}
+
+		if err := s.Sign(signer); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if !s.Complete() {
+		msg := ""
+		if len(failures) > 0 {
+			msg = ": " + strings.Join(failures, "; ")
+		}
+		return errors.Errorf(
+			"threshold not met: have=%d want=%d%s",
+			len(s.Sigs), s.Threshold, msg)
+	}
+
+	return nil
+}
+
+// Finalize returns the collected signatures, in signer order, ready to be
+// attached to the image, along with the key that made each one.  It fails if
+// fewer than the threshold have been collected.
+func (s *ThresholdSession) Finalize() ([]PubSignKey, []Sig, error) {
+	if err := s.validate(); err != nil {
+		return nil, nil, err
+	}
+	if !s.Complete() {
+		return nil, nil, errors.Errorf(
+			"threshold not met: have=%d want=%d", len(s.Sigs), s.Threshold)
+	}
+
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signed []PubSignKey
+	var sigs []Sig
+	for i := range keys {
+		for _, ts := range s.Sigs {
+			if ts.Signer != i {
+				continue
+			}
+
+			typ, err := keys[i].SigType()
+			if err != nil {
+				return nil, nil, err
+			}
+			keyHash, err := keys[i].Hash()
+			if err != nil {
+				return nil, nil, err
+			}
+			data, _ := hex.DecodeString(ts.Sig)
+
+			signed = append(signed, keys[i])
+			sigs = append(sigs, Sig{
+				Type:    typ,
+				KeyHash: keyHash,
+				Data:    data,
+			})
+		}
+	}
+
+	return signed, sigs, nil
+}
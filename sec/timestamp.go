@@ -0,0 +1,748 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// RFC 3161 time-stamp protocol.  Only the subset of CMS (RFC 5652) needed to
+// handle time-stamp tokens is implemented: SignedData with a single signer
+// identified by issuer and serial number.
+
+const TSA_CONTENT_TYPE_QUERY = "application/timestamp-query"
+const TSA_TIMEOUT = 30 * time.Second
+
+var (
+	oidCmsSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidCmsContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidCmsMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidCmsTSTInfo       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidSha256           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSha384           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSha512           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidRsaEncryption    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidSha256WithRsa    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSha384WithRsa    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSha512WithRsa    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidEcPublicKey      = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	oidEcdsaWithSha256  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidEcdsaWithSha384  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidEcdsaWithSha512  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	oidEd25519          = asn1.ObjectIdentifier{1, 3, 101, 112}
+	oidTsaDefaultPolicy = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 4115, 1, 3}
+)
+
+type tspMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tspRequest struct {
+	Version        int
+	MessageImprint tspMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+type tspStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type tspResponse struct {
+	Status         tspStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tspAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tspTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tspMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       tspAccuracy   `asn1:"optional"`
+	Ordering       bool          `asn1:"optional,default:false"`
+	Nonce          *big.Int      `asn1:"optional"`
+	Tsa            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsIssuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	Sid                cmsIssuerAndSerial
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	Crls             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+// TimestampInfo is the content of a parsed RFC 3161 time-stamp token.
+type TimestampInfo struct {
+	// The time at which the TSA produced the token.
+	Time time.Time
+
+	// The TSA's serial number for the token.
+	Serial *big.Int
+
+	// The TSA policy under which the token was issued.
+	Policy asn1.ObjectIdentifier
+
+	// The hash that was timestamped.
+	HashedMessage []byte
+
+	// The certificate of the TSA key that signed the token, if it was
+	// included in the token.
+	Signer *x509.Certificate
+
+	// All certificates included in the token.
+	Certs []*x509.Certificate
+
+	signedData cmsSignedData
+}
+
+type tspHashAlg struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}
+
+var tspHashAlgs = []tspHashAlg{
+	{oidSha256, crypto.SHA256},
+	{oidSha384, crypto.SHA384},
+	{oidSha512, crypto.SHA512},
+}
+
+func tspHashForOid(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	for _, a := range tspHashAlgs {
+		if a.oid.Equal(oid) {
+			return a.hash, nil
+		}
+	}
+
+	return 0, errors.Errorf("unsupported digest algorithm: %s", oid.String())
+}
+
+// tspHashForLen determines the digest algorithm that produced a hash of the
+// given length.
+func tspHashForLen(hashLen int) (tspHashAlg, error) {
+	for _, a := range tspHashAlgs {
+		if a.hash.Size() == hashLen {
+			return a, nil
+		}
+	}
+
+	return tspHashAlg{}, errors.Errorf(
+		"cannot timestamp hash of length %d; must be SHA256, SHA384, "+
+			"or SHA512", hashLen)
+}
+
+func tspDigest(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+// tspSigAlg maps a CMS signer's digest and signature algorithms to an x509
+// signature algorithm.
+func tspSigAlg(digestAlg crypto.Hash,
+	sigOid asn1.ObjectIdentifier) (x509.SignatureAlgorithm, error) {
+
+	type entry struct {
+		oids []asn1.ObjectIdentifier
+		algs map[crypto.Hash]x509.SignatureAlgorithm
+	}
+
+	entries := []entry{
+		{
+			oids: []asn1.ObjectIdentifier{
+				oidRsaEncryption, oidSha256WithRsa, oidSha384WithRsa,
+				oidSha512WithRsa,
+			},
+			algs: map[crypto.Hash]x509.SignatureAlgorithm{
+				crypto.SHA256: x509.SHA256WithRSA,
+				crypto.SHA384: x509.SHA384WithRSA,
+				crypto.SHA512: x509.SHA512WithRSA,
+			},
+		},
+		{
+			oids: []asn1.ObjectIdentifier{
+				oidEcPublicKey, oidEcdsaWithSha256, oidEcdsaWithSha384,
+				oidEcdsaWithSha512,
+			},
+			algs: map[crypto.Hash]x509.SignatureAlgorithm{
+				crypto.SHA256: x509.ECDSAWithSHA256,
+				crypto.SHA384: x509.ECDSAWithSHA384,
+				crypto.SHA512: x509.ECDSAWithSHA512,
+			},
+		},
+	}
+
+	if sigOid.Equal(oidEd25519) {
+		return x509.PureEd25519, nil
+	}
+
+	for _, e := range entries {
+		for _, oid := range e.oids {
+			if oid.Equal(sigOid) {
+				if alg, ok := e.algs[digestAlg]; ok {
+					return alg, nil
+				}
+			}
+		}
+	}
+
+	return x509.UnknownSignatureAlgorithm, errors.Errorf(
+		"unsupported signature algorithm: %s", sigOid.String())
+}
+
+// CreateTimestampRequest produces a DER-encoded RFC 3161 TimeStampReq over
+// the given hash.  The digest algorithm is inferred from the hash length.
+// The returned nonce must be passed to ParseTimestampResponse.
+func CreateTimestampRequest(hash []byte) ([]byte, *big.Int, error) {
+	alg, err := tspHashForLen(len(hash))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to generate TSA nonce")
+	}
+
+	req := tspRequest{
+		Version: 1,
+		MessageImprint: tspMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg.oid},
+			HashedMessage: hash,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+
+	der, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to encode TSA request")
+	}
+
+	return der, nonce, nil
+}
+
+// ParseTimestampResponse extracts the time-stamp token from a DER-encoded
+// TimeStampResp.  If nonce is non-nil, the token's nonce must match it.
+func ParseTimestampResponse(resp []byte, nonce *big.Int) ([]byte, error) {
+	var tr tspResponse
+	rest, err := asn1.Unmarshal(resp, &tr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse TSA response")
+	}
+	if len(rest) > 0 {
+		return nil, errors.Errorf(
+			"TSA response contains %d bytes of trailing data", len(rest))
+	}
+
+	// 0=granted, 1=grantedWithMods.
+	if tr.Status.Status != 0 && tr.Status.Status != 1 {
+		return nil, errors.Errorf("TSA rejected request: status=%d %v",
+			tr.Status.Status, tr.Status.StatusString)
+	}
+
+	token := tr.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, errors.Errorf("TSA response lacks time-stamp token")
+	}
+
+	info, err := ParseTimestampToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	if nonce != nil && (info.nonce() == nil || info.nonce().Cmp(nonce) != 0) {
+		return nil, errors.Errorf("TSA response nonce mismatch")
+	}
+
+	return token, nil
+}
+
+// RequestTimestamp obtains an RFC 3161 time-stamp token over the given hash
+// from the TSA at the specified URL.
+func RequestTimestamp(url string, hash []byte) ([]byte, error) {
+	req, nonce, err := CreateTimestampRequest(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: TSA_TIMEOUT}
+	rsp, err := client.Post(url, TSA_CONTENT_TYPE_QUERY, bytes.NewReader(req))
+	if err != nil {
+		return nil, errors.Wrapf(err, "TSA request failed")
+	}
+	defer rsp.Body.Close()
+
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read TSA response")
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("TSA request failed: %s", rsp.Status)
+	}
+
+	return ParseTimestampResponse(body, nonce)
+}
+
+func (info *TimestampInfo) tstInfo() (tspTSTInfo, error) {
+	var tst tspTSTInfo
+	content := info.signedData.EncapContentInfo.EContent
+	if _, err := asn1.Unmarshal(content, &tst); err != nil {
+		return tst, errors.Wrapf(err, "failed to parse TSTInfo")
+	}
+
+	return tst, nil
+}
+
+func (info *TimestampInfo) nonce() *big.Int {
+	tst, err := info.tstInfo()
+	if err != nil {
+		return nil
+	}
+
+	return tst.Nonce
+}
+
+// ParseTimestampToken decodes an RFC 3161 time-stamp token.  The token's
+// signature is NOT verified; use VerifyTimestampToken for that.
+func ParseTimestampToken(token []byte) (TimestampInfo, error) {
+	info := TimestampInfo{}
+
+	var ci cmsContentInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		return info, errors.Wrapf(err, "failed to parse time-stamp token")
+	}
+	if !ci.ContentType.Equal(oidCmsSignedData) {
+		return info, errors.Errorf(
+			"time-stamp token has wrong content type: %s",
+			ci.ContentType.String())
+	}
+
+	// encoding/asn1 does not strip explicit tags from a RawValue.
+	if _, err := asn1.Unmarshal(ci.Content.Bytes,
+		&info.signedData); err != nil {
+
+		return info, errors.Wrapf(err, "failed to parse time-stamp token")
+	}
+
+	sd := &info.signedData
+	if !sd.EncapContentInfo.EContentType.Equal(oidCmsTSTInfo) {
+		return info, errors.Errorf(
+			"time-stamp token does not contain TSTInfo: %s",
+			sd.EncapContentInfo.EContentType.String())
+	}
+	if len(sd.SignerInfos) != 1 {
+		return info, errors.Errorf(
+			"time-stamp token has %d signers; want 1", len(sd.SignerInfos))
+	}
+
+	tst, err := info.tstInfo()
+	if err != nil {
+		return info, err
+	}
+
+	info.Time = tst.GenTime
+	info.Serial = tst.SerialNumber
+	info.Policy = tst.Policy
+	info.HashedMessage = tst.MessageImprint.HashedMessage
+
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return info, errors.Wrapf(err,
+				"failed to parse time-stamp token certificates")
+		}
+		info.Certs = certs
+	}
+
+	sid := sd.SignerInfos[0].Sid
+	for _, cert := range info.Certs {
+		if bytes.Equal(cert.RawIssuer, sid.Issuer.FullBytes) &&
+			cert.SerialNumber.Cmp(sid.Serial) == 0 {
+
+			info.Signer = cert
+			break
+		}
+	}
+
+	return info, nil
+}
+
+// signedAttrDigest returns the value of the messageDigest signed attribute,
+// after checking that the contentType attribute indicates TSTInfo.
+func signedAttrDigest(attrs []byte) ([]byte, error) {
+	var digest []byte
+	sawType := false
+
+	for len(attrs) > 0 {
+		var attr cmsAttribute
+		rest, err := asn1.Unmarshal(attrs, &attr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse signed attribute")
+		}
+		attrs = rest
+
+		switch {
+		case attr.Type.Equal(oidCmsContentType):
+			var ct asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &ct); err != nil {
+				return nil, errors.Wrapf(err,
+					"failed to parse content-type attribute")
+			}
+			if !ct.Equal(oidCmsTSTInfo) {
+				return nil, errors.Errorf(
+					"signed content-type attribute mismatch: %s",
+					ct.String())
+			}
+			sawType = true
+
+		case attr.Type.Equal(oidCmsMessageDigest):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes,
+				&digest); err != nil {
+
+				return nil, errors.Wrapf(err,
+					"failed to parse message-digest attribute")
+			}
+		}
+	}
+
+	if !sawType || digest == nil {
+		return nil, errors.Errorf(
+			"time-stamp token lacks content-type or message-digest " +
+				"attribute")
+	}
+
+	return digest, nil
+}
+
+// VerifyTimestampToken verifies that a time-stamp token was issued over the
+// specified hash and is validly signed by a TSA whose certificate chains to
+// one of the given roots.  If roots is nil, the system roots are used.  The
+// TSA certificate must be included in the token.
+func VerifyTimestampToken(token []byte, hash []byte,
+	roots *x509.CertPool) (TimestampInfo, error) {
+
+	info, err := ParseTimestampToken(token)
+	if err != nil {
+		return info, err
+	}
+
+	if !bytes.Equal(info.HashedMessage, hash) {
+		return info, errors.Errorf(
+			"time-stamp token covers wrong hash: have=%x want=%x",
+			info.HashedMessage, hash)
+	}
+
+	if info.Signer == nil {
+		return info, errors.Errorf(
+			"time-stamp token does not include the TSA certificate")
+	}
+
+	si := info.signedData.SignerInfos[0]
+	digestAlg, err := tspHashForOid(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return info, err
+	}
+
+	sigAlg, err := tspSigAlg(digestAlg, si.SignatureAlgorithm.Algorithm)
+	if err != nil {
+		return info, err
+	}
+
+	content := info.signedData.EncapContentInfo.EContent
+	signed := content
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		digest, err := signedAttrDigest(si.SignedAttrs.Bytes)
+		if err != nil {
+			return info, err
+		}
+		if !bytes.Equal(digest, tspDigest(digestAlg, content)) {
+			return info, errors.Errorf(
+				"time-stamp token message digest mismatch")
+		}
+
+		// The signature covers the attributes encoded as a SET OF, not
+		// with the implicit [0] tag they carry in the SignerInfo.
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	}
+
+	if err := info.Signer.CheckSignature(sigAlg, signed,
+		si.Signature); err != nil {
+
+		return info, errors.Wrapf(err, "time-stamp token signature invalid")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range info.Certs {
+		if cert != info.Signer {
+			intermediates.AddCert(cert)
+		}
+	}
+
+	_, err = info.Signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   info.Time,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	if err != nil {
+		return info, errors.Wrapf(err, "TSA certificate not trusted")
+	}
+
+	return info, nil
+}
+
+// CreateTimestampToken produces an RFC 3161 time-stamp token over the given
+// hash, acting as a local TSA.  This is intended for testing and for
+// air-gapped signing environments that run their own time-stamping
+// authority.  The key must be an RSA, ECDSA, or Ed25519 private key
+// corresponding to cert.
+func CreateTimestampToken(hash []byte, cert *x509.Certificate,
+	key crypto.Signer, serial *big.Int, genTime time.Time) ([]byte, error) {
+
+	return createTimestampToken(hash, nil, cert, key, serial, genTime)
+}
+
+// CreateTimestampResponse answers a DER-encoded TimeStampReq with a
+// TimeStampResp containing a token produced by CreateTimestampToken.
+func CreateTimestampResponse(req []byte, cert *x509.Certificate,
+	key crypto.Signer, serial *big.Int, genTime time.Time) ([]byte, error) {
+
+	var tr tspRequest
+	if _, err := asn1.Unmarshal(req, &tr); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse TSA request")
+	}
+
+	token, err := createTimestampToken(tr.MessageImprint.HashedMessage,
+		tr.Nonce, cert, key, serial, genTime)
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := asn1.Marshal(tspResponse{
+		Status:         tspStatusInfo{Status: 0},
+		TimeStampToken: asn1.RawValue{FullBytes: token},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode TSA response")
+	}
+
+	return rsp, nil
+}
+
+func createTimestampToken(hash []byte, nonce *big.Int,
+	cert *x509.Certificate, key crypto.Signer, serial *big.Int,
+	genTime time.Time) ([]byte, error) {
+
+	alg, err := tspHashForLen(len(hash))
+	if err != nil {
+		return nil, err
+	}
+
+	tst := tspTSTInfo{
+		Version: 1,
+		Policy:  oidTsaDefaultPolicy,
+		MessageImprint: tspMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg.oid},
+			HashedMessage: hash,
+		},
+		SerialNumber: serial,
+		GenTime:      genTime.UTC(),
+		Nonce:        nonce,
+	}
+	content, err := asn1.Marshal(tst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode TSTInfo")
+	}
+
+	var sigOid asn1.ObjectIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigOid = oidRsaEncryption
+	case *ecdsa.PublicKey:
+		sigOid = oidEcdsaWithSha256
+	case ed25519.PublicKey:
+		sigOid = oidEd25519
+	default:
+		return nil, errors.Errorf("unsupported TSA key type: %T",
+			key.Public())
+	}
+
+	ctVal, err := asn1.Marshal(oidCmsTSTInfo)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode signed attributes")
+	}
+	mdVal, err := asn1.Marshal(tspDigest(crypto.SHA256, content))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode signed attributes")
+	}
+
+	var attrs []byte
+	for _, attr := range []cmsAttribute{
+		{Type: oidCmsContentType, Values: asn1.RawValue{
+			Tag: asn1.TagSet, IsCompound: true, Bytes: ctVal}},
+		{Type: oidCmsMessageDigest, Values: asn1.RawValue{
+			Tag: asn1.TagSet, IsCompound: true, Bytes: mdVal}},
+	} {
+		b, err := asn1.Marshal(attr)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"failed to encode signed attributes")
+		}
+		attrs = append(attrs, b...)
+	}
+
+	attrSet, err := asn1.Marshal(asn1.RawValue{
+		Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode signed attributes")
+	}
+
+	var sig []byte
+	if sigOid.Equal(oidEd25519) {
+		sig, err = key.Sign(rand.Reader, attrSet, crypto.Hash(0))
+	} else {
+		sig, err = key.Sign(rand.Reader,
+			tspDigest(crypto.SHA256, attrSet), crypto.SHA256)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to sign time-stamp token")
+	}
+
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: oidSha256}
+	sd := cmsSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		EncapContentInfo: cmsEncapContentInfo{
+			EContentType: oidCmsTSTInfo,
+			EContent:     content,
+		},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      cert.Raw,
+		},
+		SignerInfos: []cmsSignerInfo{{
+			Version: 1,
+			Sid: cmsIssuerAndSerial{
+				Issuer: asn1.RawValue{FullBytes: cert.RawIssuer},
+				Serial: cert.SerialNumber,
+			},
+			DigestAlgorithm: digestAlg,
+			SignedAttrs: asn1.RawValue{
+				Class:      asn1.ClassContextSpecific,
+				Tag:        0,
+				IsCompound: true,
+				Bytes:      attrs,
+			},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigOid},
+			Signature:          sig,
+		}},
+	}
+
+	sdBytes, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode SignedData")
+	}
+
+	token, err := asn1.Marshal(cmsContentInfo{
+		ContentType: oidCmsSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      sdBytes,
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode time-stamp token")
+	}
+
+	return token, nil
+}
@@ -0,0 +1,363 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// A trust bundle is a signed JSON document listing the signing keys a fleet
+// accepts.  Each key is identified by its key hash and carries a state and
+// an optional validity period.  Bundles are signed by one or more root keys
+// that are provisioned out of band.
+
+const TRUST_BUNDLE_VERSION = 1
+
+type TrustKeyState int
+
+const (
+	// The key may sign new images.
+	TRUST_KEY_ACTIVE TrustKeyState = iota
+
+	// The key no longer signs new images, but images it signed are still
+	// accepted.
+	TRUST_KEY_RETIRED
+
+	// The key is compromised or withdrawn; its signatures are ignored.
+	TRUST_KEY_REVOKED
+)
+
+var trustKeyStateNameMap = map[TrustKeyState]string{
+	TRUST_KEY_ACTIVE:  "active",
+	TRUST_KEY_RETIRED: "retired",
+	TRUST_KEY_REVOKED: "revoked",
+}
+
+func TrustKeyStateString(state TrustKeyState) string {
+	s := trustKeyStateNameMap[state]
+	if s == "" {
+		return "unknown"
+	} else {
+		return s
+	}
+}
+
+func TrustKeyStateFromString(s string) (TrustKeyState, error) {
+	for k, v := range trustKeyStateNameMap {
+		if s == v {
+			return k, nil
+		}
+	}
+
+	return 0, errors.Errorf("unknown trust key state: \"%s\"", s)
+}
+
+func (state TrustKeyState) MarshalJSON() ([]byte, error) {
+	s := trustKeyStateNameMap[state]
+	if s == "" {
+		return nil, errors.Errorf("invalid trust key state: %d", int(state))
+	}
+	return json.Marshal(s)
+}
+
+func (state *TrustKeyState) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.Wrapf(err, "failed to parse trust key state")
+	}
+
+	st, err := TrustKeyStateFromString(s)
+	if err != nil {
+		return err
+	}
+
+	*state = st
+	return nil
+}
+
+type TrustKey struct {
+	// Hex-encoded key hash (see PubSignKey.Hash()).
+	KeyHash string        `json:"key_hash"`
+	State   TrustKeyState `json:"state"`
+
+	// Optional validity period.  A nil bound is unbounded.
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+
+	Comment string `json:"comment,omitempty"`
+}
+
+type TrustBundle struct {
+	Version int `json:"version"`
+
+	// Incremented with every published bundle.  Devices should refuse a
+	// bundle whose serial is lower than the one they already hold.
+	Serial uint64     `json:"serial"`
+	Issued time.Time  `json:"issued"`
+	Keys   []TrustKey `json:"keys"`
+}
+
+type TrustBundleSig struct {
+	KeyHash string `json:"key_hash"`
+	Sig     string `json:"sig"`
+}
+
+// SignedTrustBundle is the serialized form of a trust bundle.  The
+// signatures cover the SHA256 of the compacted bundle JSON, so the document
+// may be reformatted without invalidating it.
+type SignedTrustBundle struct {
+	Bundle json.RawMessage  `json:"bundle"`
+	Sigs   []TrustBundleSig `json:"signatures"`
+}
+
+// FindKey returns the entry for the given key, or nil if the bundle does not
+// list the key.  Entries may use any supported key hash scheme.
+func (tb *TrustBundle) FindKey(key PubSignKey) (*TrustKey, error) {
+	for i := range tb.Keys {
+		keyHash, err := decodeKeyHash(tb.Keys[i].KeyHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "trust bundle")
+		}
+		match, err := KeyHashMatchesKey(&key, keyHash)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			return &tb.Keys[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (tk *TrustKey) checkPeriod(at time.Time) error {
+	if tk.NotBefore != nil && at.Before(*tk.NotBefore) {
+		return errors.Errorf("key %s not valid before %s",
+			tk.KeyHash, tk.NotBefore.Format(time.RFC3339))
+	}
+	if tk.NotAfter != nil && at.After(*tk.NotAfter) {
+		return errors.Errorf("key %s expired at %s",
+			tk.KeyHash, tk.NotAfter.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// KeyTrusted indicates whether signatures from the specified key are
+// accepted at the given time.  Active and retired keys within their validity
+// period are trusted.
+func (tb *TrustBundle) KeyTrusted(key PubSignKey, at time.Time) error {
+	tk, err := tb.FindKey(key)
+	if err != nil {
+		return err
+	}
+	if tk == nil {
+		keyHash, _ := key.Hash()
+		return errors.Errorf("key %x not in trust bundle", keyHash)
+	}
+
+	if tk.State == TRUST_KEY_REVOKED {
+		return errors.Errorf("key %s is revoked", tk.KeyHash)
+	}
+
+	return tk.checkPeriod(at)
+}
+
+// KeyMaySign indicates whether the specified key may sign new images at the
+// given time.  Only active keys within their validity period may sign.
+func (tb *TrustBundle) KeyMaySign(key PubSignKey, at time.Time) error {
+	if err := tb.KeyTrusted(key, at); err != nil {
+		return err
+	}
+
+	tk, err := tb.FindKey(key)
+	if err != nil {
+		return err
+	}
+	if tk.State != TRUST_KEY_ACTIVE {
+		return errors.Errorf("key %s is %s",
+			tk.KeyHash, TrustKeyStateString(tk.State))
+	}
+
+	return nil
+}
+
+func (tb *TrustBundle) validate() error {
+	if tb.Version != TRUST_BUNDLE_VERSION {
+		return errors.Errorf("unsupported trust bundle version: %d",
+			tb.Version)
+	}
+
+	seen := map[string]struct{}{}
+	for _, tk := range tb.Keys {
+		keyHash, err := decodeKeyHash(tk.KeyHash)
+		if err != nil {
+			return errors.Wrapf(err, "trust bundle")
+		}
+		h := hex.EncodeToString(keyHash)
+		if _, ok := seen[h]; ok {
+			return errors.Errorf("trust bundle lists key %s twice",
+				tk.KeyHash)
+		}
+		seen[h] = struct{}{}
+
+		if tk.NotBefore != nil && tk.NotAfter != nil &&
+			tk.NotAfter.Before(*tk.NotBefore) {
+
+			return errors.Errorf("key %s has empty validity period",
+				tk.KeyHash)
+		}
+	}
+
+	return nil
+}
+
+// signDocument signs the SHA256 of a JSON document with each of the given
+// signers.
+func signDocument(body []byte, signers []Signer,
+	what string) ([]TrustBundleSig, error) {
+
+	hash := sha256.Sum256(body)
+
+	var sigs []TrustBundleSig
+	for _, signer := range signers {
+		pub := signer.PubKey()
+		keyHash, err := pub.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		sig, err := signer.Sign(hash[:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to sign %s", what)
+		}
+
+		sigs = append(sigs, TrustBundleSig{
+			KeyHash: hex.EncodeToString(keyHash),
+			Sig:     hex.EncodeToString(sig),
+		})
+	}
+
+	return sigs, nil
+}
+
+// verifyDocument checks that at least one of the given root keys produced a
+// valid signature over a JSON document.  The document is compacted before it
+// is hashed.
+func verifyDocument(doc json.RawMessage, docSigs []TrustBundleSig,
+	rootKeys []PubSignKey, what string) error {
+
+	var body bytes.Buffer
+	if err := json.Compact(&body, doc); err != nil {
+		return errors.Wrapf(err, "failed to parse %s", what)
+	}
+	hash := sha256.Sum256(body.Bytes())
+
+	var sigs []Sig
+	for _, s := range docSigs {
+		keyHash, err := hex.DecodeString(s.KeyHash)
+		if err != nil {
+			return errors.Errorf(
+				"%s signature has invalid key hash: \"%s\"", what, s.KeyHash)
+		}
+		data, err := hex.DecodeString(s.Sig)
+		if err != nil {
+			return errors.Errorf("%s signature is not valid hex", what)
+		}
+
+		sigs = append(sigs, Sig{KeyHash: keyHash, Data: data})
+	}
+
+	for _, key := range rootKeys {
+		idx, err := VerifySigs(key, sigs, hash[:])
+		if err != nil {
+			return err
+		}
+		if idx != -1 {
+			return nil
+		}
+	}
+
+	return errors.Errorf("%s not signed by any root key", what)
+}
+
+// Sign serializes the trust bundle and signs it with each of the given
+// signers.
+func (tb *TrustBundle) Sign(signers []Signer) ([]byte, error) {
+	if err := tb.validate(); err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(tb)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode trust bundle")
+	}
+
+	sigs, err := signDocument(body, signers, "trust bundle")
+	if err != nil {
+		return nil, err
+	}
+
+	stb := SignedTrustBundle{
+		Bundle: body,
+		Sigs:   sigs,
+	}
+
+	b, err := json.MarshalIndent(stb, "", "    ")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode trust bundle")
+	}
+
+	return b, nil
+}
+
+// ParseTrustBundle decodes a signed trust bundle and verifies it against the
+// given root keys.  At least one root key must have produced a valid
+// signature.
+func ParseTrustBundle(data []byte, rootKeys []PubSignKey) (TrustBundle, error) {
+	var stb SignedTrustBundle
+	if err := json.Unmarshal(data, &stb); err != nil {
+		return TrustBundle{}, errors.Wrapf(err,
+			"failed to parse signed trust bundle")
+	}
+
+	if err := verifyDocument(stb.Bundle, stb.Sigs, rootKeys,
+		"trust bundle"); err != nil {
+
+		return TrustBundle{}, err
+	}
+
+	var tb TrustBundle
+	if err := json.Unmarshal(stb.Bundle, &tb); err != nil {
+		return TrustBundle{}, errors.Wrapf(err, "failed to parse trust bundle")
+	}
+
+	if err := tb.validate(); err != nil {
+		return TrustBundle{}, err
+	}
+
+	return tb, nil
+}
@@ -20,6 +20,13 @@ func parsePubPemKey(data []byte) (interface{}, error) {
 			"error parsing public key: PEM type=\"%s\"", p.Type)
 	}
 
+	if pub, ok, err := parseEd448PubKey(p.Bytes); ok {
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing public key")
+		}
+		return pub, nil
+	}
+
 	itf, err := x509.ParsePKIXPublicKey(p.Bytes)
 	if err != nil {
 		// Not x509; assume ed25519.
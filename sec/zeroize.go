@@ -0,0 +1,305 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package sec
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/apache/mynewt-artifact/errors"
+)
+
+// KeyMemOpts controls how private key material is held in memory.
+type KeyMemOpts struct {
+	// Lock the key's private buffers into RAM (mlock) so they are never
+	// written to swap.  Fails on platforms without memory locking.
+	Lock bool
+}
+
+// Page reference counts for locked key buffers.  Locks are per page and
+// do not nest, so two keys sharing a heap page must not unlock each
+// other.
+var keyLockMtx sync.Mutex
+var keyLockPages = map[uintptr]int{}
+
+func wipeBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func wipeInt(x *big.Int) {
+	if x == nil {
+		return
+	}
+
+	bits := x.Bits()
+	for i := range bits {
+		bits[i] = 0
+	}
+	x.SetInt64(0)
+}
+
+func intBytes(x *big.Int) []byte {
+	if x == nil {
+		return nil
+	}
+
+	bits := x.Bits()
+	if len(bits) == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(unsafe.Pointer(&bits[0])),
+		len(bits)*int(unsafe.Sizeof(bits[0])))
+}
+
+// pages splits a buffer into its per-page pieces, keyed by page address.
+func pages(b []byte) map[uintptr][]byte {
+	m := map[uintptr][]byte{}
+	if len(b) == 0 {
+		return m
+	}
+
+	psize := uintptr(os.Getpagesize())
+	start := uintptr(unsafe.Pointer(&b[0]))
+	for off := 0; off < len(b); {
+		page := (start + uintptr(off)) &^ (psize - 1)
+		end := int(page + psize - start)
+		if end > len(b) {
+			end = len(b)
+		}
+		m[page] = b[off:end]
+		off = end
+	}
+
+	return m
+}
+
+func lockBufs(bufs [][]byte) error {
+	keyLockMtx.Lock()
+	defer keyLockMtx.Unlock()
+
+	var locked [][]byte
+	for _, b := range bufs {
+		for page, piece := range pages(b) {
+			if keyLockPages[page] == 0 {
+				if err := mlock(piece); err != nil {
+					unlockBufsLocked(locked)
+					return errors.Wrapf(err, "failed to lock key memory")
+				}
+			}
+			keyLockPages[page]++
+			locked = append(locked, piece)
+		}
+	}
+
+	return nil
+}
+
+func unlockBufsLocked(bufs [][]byte) {
+	for _, b := range bufs {
+		for page, piece := range pages(b) {
+			n := keyLockPages[page]
+			if n == 0 {
+				continue
+			}
+			if n == 1 {
+				munlock(piece)
+				delete(keyLockPages, page)
+			} else {
+				keyLockPages[page] = n - 1
+			}
+		}
+	}
+}
+
+func unlockBufs(bufs [][]byte) {
+	keyLockMtx.Lock()
+	defer keyLockMtx.Unlock()
+
+	unlockBufsLocked(bufs)
+}
+
+// privBufs returns the buffers holding a key's private material.  ML-DSA
+// keys are opaque and have no accessible buffers.
+func (key *PrivSignKey) privBufs() [][]byte {
+	var bufs [][]byte
+
+	if key.Rsa != nil {
+		bufs = append(bufs, rsaBufs(key.Rsa)...)
+	}
+	if key.Ec != nil {
+		bufs = append(bufs, intBytes(key.Ec.D))
+	}
+	if key.Ed25519 != nil {
+		bufs = append(bufs, []byte(*key.Ed25519))
+	}
+	if key.Ed448 != nil {
+		bufs = append(bufs, []byte(key.Ed448))
+	}
+
+	return bufs
+}
+
+func rsaBufs(key *rsa.PrivateKey) [][]byte {
+	bufs := [][]byte{intBytes(key.D)}
+	for _, p := range key.Primes {
+		bufs = append(bufs, intBytes(p))
+	}
+	bufs = append(bufs,
+		intBytes(key.Precomputed.Dp),
+		intBytes(key.Precomputed.Dq),
+		intBytes(key.Precomputed.Qinv))
+
+	return bufs
+}
+
+func wipeRsa(key *rsa.PrivateKey) {
+	wipeInt(key.D)
+	for _, p := range key.Primes {
+		wipeInt(p)
+	}
+	wipeInt(key.Precomputed.Dp)
+	wipeInt(key.Precomputed.Dq)
+	wipeInt(key.Precomputed.Qinv)
+}
+
+// Lock locks the key's private buffers into RAM so they are never written
+// to swap.  The buffers stay locked until the key is closed.
+func (key *PrivSignKey) Lock() error {
+	return lockBufs(key.privBufs())
+}
+
+// Zeroize overwrites the key's private material and clears the key.  The
+// key is unusable afterwards.  This is best-effort: copies made by the Go
+// runtime or the standard crypto packages (e.g., ML-DSA keys and RSA's
+// internal precomputed values) cannot be reached.
+func (key *PrivSignKey) Zeroize() {
+	if key.Rsa != nil {
+		wipeRsa(key.Rsa)
+	}
+	if key.Ec != nil {
+		wipeInt(key.Ec.D)
+	}
+	if key.Ed25519 != nil {
+		wipeBytes(*key.Ed25519)
+	}
+	wipeBytes(key.Ed448)
+
+	*key = PrivSignKey{}
+}
+
+// Close zeroizes the key and unlocks any buffers locked by Lock.
+func (key *PrivSignKey) Close() error {
+	bufs := key.privBufs()
+	key.Zeroize()
+	unlockBufs(bufs)
+
+	return nil
+}
+
+// Lock locks the key's private buffers into RAM so they are never written
+// to swap.  The buffers stay locked until the key is closed.
+func (key *PrivEncKey) Lock() error {
+	if key.Rsa == nil {
+		return nil
+	}
+
+	return lockBufs(rsaBufs(key.Rsa))
+}
+
+// Zeroize overwrites the key's private material and clears the key.  The
+// key is unusable afterwards.
+func (key *PrivEncKey) Zeroize() {
+	if key.Rsa != nil {
+		wipeRsa(key.Rsa)
+	}
+
+	*key = PrivEncKey{}
+}
+
+// Close zeroizes the key and unlocks any buffers locked by Lock.
+func (key *PrivEncKey) Close() error {
+	var bufs [][]byte
+	if key.Rsa != nil {
+		bufs = rsaBufs(key.Rsa)
+	}
+	key.Zeroize()
+	unlockBufs(bufs)
+
+	return nil
+}
+
+// ReadPrivSignKeyOpts reads a private signing key from a file.  The raw file
+// contents are wiped once parsed.
+func ReadPrivSignKeyOpts(filename string,
+	opts KeyMemOpts) (PrivSignKey, error) {
+
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return PrivSignKey{}, errors.Wrapf(err, "error reading key file")
+	}
+	defer wipeBytes(keyBytes)
+
+	key, err := ParsePrivSignKey(keyBytes)
+	if err != nil {
+		return key, err
+	}
+
+	if opts.Lock {
+		if err := key.Lock(); err != nil {
+			key.Zeroize()
+			return key, err
+		}
+	}
+
+	return key, nil
+}
+
+// ReadPrivEncKeyOpts reads a private encryption key from a file.  The raw
+// file contents are wiped once parsed.
+func ReadPrivEncKeyOpts(filename string,
+	opts KeyMemOpts) (PrivEncKey, error) {
+
+	keyBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return PrivEncKey{}, errors.Wrapf(err, "error reading key file")
+	}
+	defer wipeBytes(keyBytes)
+
+	key, err := ParsePrivEncKey(keyBytes)
+	if err != nil {
+		return key, err
+	}
+
+	if opts.Lock {
+		if err := key.Lock(); err != nil {
+			key.Zeroize()
+			return key, err
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,200 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package tlog
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// SubmitImage records each of an image's signatures in the log.  The
+// resulting entries are returned and embedded in the image as unprotected
+// TLOG_ENTRY TLVs, replacing any existing ones.
+func SubmitImage(log Log, img *image.Image) ([]Entry, error) {
+	hash, err := img.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) == 0 {
+		return nil, errors.Errorf("image is not signed")
+	}
+
+	var entries []Entry
+	var tlvs []image.ImageTlv
+	for _, sig := range sigs {
+		ev := NewSigningEvent(hash, sig)
+		proof, err := log.Submit(ev)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"failed to submit signing event to transparency log")
+		}
+
+		entry := Entry{Event: ev, Proof: proof}
+		tlv, err := entry.Tlv()
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+		tlvs = append(tlvs, tlv)
+	}
+
+	img.RemoveTlvsWithType(image.IMAGE_TLV_TLOG_ENTRY)
+	img.Tlvs = append(img.Tlvs, tlvs...)
+
+	return entries, nil
+}
+
+// Tlv produces an unprotected TLOG_ENTRY TLV holding the entry.
+func (e *Entry) Tlv() (image.ImageTlv, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return image.ImageTlv{}, errors.Wrapf(err,
+			"failed to encode transparency log entry")
+	}
+	if len(b) > 0xffff {
+		return image.ImageTlv{}, errors.Errorf(
+			"transparency log entry too large for TLV: %d bytes", len(b))
+	}
+
+	return image.ImageTlv{
+		Header: image.ImageTlvHdr{
+			Type: image.IMAGE_TLV_TLOG_ENTRY,
+			Pad:  0,
+			Len:  uint16(len(b)),
+		},
+		Data: b,
+	}, nil
+}
+
+// ImageEntries returns the transparency log entries embedded in an image.
+func ImageEntries(img image.Image) ([]Entry, error) {
+	var entries []Entry
+	for _, tlv := range img.FindTlvs(image.IMAGE_TLV_TLOG_ENTRY) {
+		var e Entry
+		if err := json.Unmarshal(tlv.Data, &e); err != nil {
+			return nil, errors.Wrapf(err,
+				"failed to parse transparency log entry")
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// AddManifestEntries records transparency log entries in a manifest.
+func AddManifestEntries(man *manifest.Manifest, entries []Entry) error {
+	for _, e := range entries {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return errors.Wrapf(err,
+				"failed to encode transparency log entry")
+		}
+		man.TlogEntries = append(man.TlogEntries, b)
+	}
+
+	return nil
+}
+
+// ManifestEntries returns the transparency log entries recorded in a
+// manifest.
+func ManifestEntries(man manifest.Manifest) ([]Entry, error) {
+	var entries []Entry
+	for _, raw := range man.TlogEntries {
+		var e Entry
+		if err := json.Unmarshal(raw, &e); err != nil {
+			return nil, errors.Wrapf(err,
+				"failed to parse transparency log entry")
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+// VerifyImageEntries verifies, offline, that each of the given entries
+// describes a signature actually present in the image and is included in a
+// log signed by one of logKeys.  It returns the number of entries verified;
+// at least one is required.
+func VerifyImageEntries(img image.Image, entries []Entry,
+	logKeys []sec.PubSignKey) (int, error) {
+
+	if len(entries) == 0 {
+		return 0, errors.Errorf("no transparency log entries")
+	}
+
+	hash, err := img.Hash()
+	if err != nil {
+		return 0, err
+	}
+
+	sigs, err := img.CollectSigs()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, e := range entries {
+		if e.Event.ImageHash != hex.EncodeToString(hash) {
+			return 0, errors.Errorf(
+				"transparency log entry %d is for a different image", i)
+		}
+
+		found := false
+		for _, sig := range sigs {
+			ev := NewSigningEvent(hash, sig)
+			if ev == e.Event {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errors.Errorf(
+				"transparency log entry %d describes a signature not in "+
+					"the image", i)
+		}
+
+		if err := e.Verify(logKeys); err != nil {
+			return 0, errors.Wrapf(err,
+				"transparency log entry %d invalid", i)
+		}
+	}
+
+	return len(entries), nil
+}
+
+// VerifyImage verifies the transparency log entries embedded in an image.
+func VerifyImage(img image.Image, logKeys []sec.PubSignKey) (int, error) {
+	entries, err := ImageEntries(img)
+	if err != nil {
+		return 0, err
+	}
+
+	return VerifyImageEntries(img, entries, logKeys)
+}
@@ -0,0 +1,116 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package tlog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// MemLog is an in-memory transparency log.  It is suitable for testing and
+// for air-gapped signing environments that keep their own log.
+type MemLog struct {
+	Origin string
+	Signer sec.Signer
+
+	leaves [][]byte // Leaf hashes.
+}
+
+// NewMemLog creates an empty in-memory log whose checkpoints are signed by
+// the given signer.
+func NewMemLog(origin string, signer sec.Signer) *MemLog {
+	return &MemLog{
+		Origin: origin,
+		Signer: signer,
+	}
+}
+
+// largestPow2Below returns the largest power of two smaller than n (n > 1).
+func largestPow2Below(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// mth computes the RFC 6962 Merkle tree hash of a list of leaf hashes.
+func mth(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+
+	k := largestPow2Below(len(leaves))
+	return NodeHash(mth(leaves[:k]), mth(leaves[k:]))
+}
+
+// auditPath computes the RFC 6962 audit path for leaf m.
+func auditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+
+	k := largestPow2Below(len(leaves))
+	if m < k {
+		return append(auditPath(m, leaves[:k]), mth(leaves[k:]))
+	}
+
+	return append(auditPath(m-k, leaves[k:]), mth(leaves[:k]))
+}
+
+// Size returns the number of entries in the log.
+func (l *MemLog) Size() int {
+	return len(l.leaves)
+}
+
+// Submit appends a signing event to the log.
+func (l *MemLog) Submit(ev SigningEvent) (InclusionProof, error) {
+	leaf, err := ev.Leaf()
+	if err != nil {
+		return InclusionProof{}, err
+	}
+
+	idx := len(l.leaves)
+	l.leaves = append(l.leaves, LeafHash(leaf))
+
+	proof := InclusionProof{
+		LogIndex: uint64(idx),
+		Checkpoint: Checkpoint{
+			Origin:   l.Origin,
+			TreeSize: uint64(len(l.leaves)),
+			RootHash: hex.EncodeToString(mth(l.leaves)),
+		},
+	}
+	for _, h := range auditPath(idx, l.leaves) {
+		proof.Hashes = append(proof.Hashes, hex.EncodeToString(h))
+	}
+
+	if err := proof.Checkpoint.Sign(l.Signer); err != nil {
+		return InclusionProof{}, err
+	}
+
+	return proof, nil
+}
@@ -0,0 +1,268 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package tlog records image signing events in a transparency log (e.g.,
+// sigstore Rekor) and verifies the resulting inclusion proofs offline.
+//
+// A log is any service that accepts a SigningEvent and returns an
+// InclusionProof: an RFC 6962 Merkle audit path from the event's leaf to the
+// root of a tree, plus a checkpoint in which the log operator signs that
+// root.  Given the log's public key, a proof can be verified without
+// contacting the log.
+package tlog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/apache/mynewt-artifact/errors"
+	"github.com/apache/mynewt-artifact/sec"
+)
+
+// SigningEvent describes a single signature over an image.
+type SigningEvent struct {
+	// Hex-encoded image hash.
+	ImageHash string `json:"image_hash"`
+
+	// Hex-encoded hash of the signing key (see PubSignKey.Hash()).
+	KeyHash string `json:"key_hash"`
+
+	SigType string `json:"sig_type"`
+
+	// Hex-encoded signature.
+	Sig string `json:"sig"`
+}
+
+// Checkpoint is a log operator's signed statement of the log's size and root
+// hash.
+type Checkpoint struct {
+	Origin   string `json:"origin"`
+	TreeSize uint64 `json:"tree_size"`
+	RootHash string `json:"root_hash"` // Hex.
+	KeyHash  string `json:"key_hash"`  // Hex; identifies the log key.
+	Sig      string `json:"sig"`       // Hex.
+}
+
+// InclusionProof demonstrates that an entry is present in a log.
+type InclusionProof struct {
+	LogIndex   uint64     `json:"log_index"`
+	Hashes     []string   `json:"hashes"` // Hex; audit path, leaf first.
+	Checkpoint Checkpoint `json:"checkpoint"`
+}
+
+// Entry is a signing event together with its proof of inclusion.
+type Entry struct {
+	Event SigningEvent   `json:"event"`
+	Proof InclusionProof `json:"proof"`
+}
+
+// Log is a transparency log that accepts image signing events.
+type Log interface {
+	// Submit records a signing event and returns a proof of its inclusion.
+	Submit(ev SigningEvent) (InclusionProof, error)
+}
+
+// NewSigningEvent constructs the event for a single image signature.
+func NewSigningEvent(imageHash []byte, sig sec.Sig) SigningEvent {
+	return SigningEvent{
+		ImageHash: hex.EncodeToString(imageHash),
+		KeyHash:   hex.EncodeToString(sig.KeyHash),
+		SigType:   sec.SigTypeString(sig.Type),
+		Sig:       hex.EncodeToString(sig.Data),
+	}
+}
+
+// Leaf returns the canonical serialization of a signing event, as stored in
+// the log.
+func (ev *SigningEvent) Leaf() ([]byte, error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to encode signing event")
+	}
+
+	return b, nil
+}
+
+// LeafHash computes the RFC 6962 hash of a leaf.
+func LeafHash(leaf []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+// NodeHash computes the RFC 6962 hash of an interior node.
+func NodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// RootFromInclusionProof computes the tree root implied by a leaf hash and
+// its audit path (RFC 9162, section 2.1.3.2).
+func RootFromInclusionProof(leafHash []byte, index uint64, size uint64,
+	path [][]byte) ([]byte, error) {
+
+	if index >= size {
+		return nil, errors.Errorf(
+			"leaf index %d beyond tree size %d", index, size)
+	}
+
+	fn := index
+	sn := size - 1
+	r := leafHash
+
+	for _, p := range path {
+		if sn == 0 {
+			return nil, errors.Errorf("inclusion proof too long")
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return nil, errors.Errorf("inclusion proof too short")
+	}
+
+	return r, nil
+}
+
+// Body returns the signed portion of a checkpoint, in signed-note format.
+func (cp *Checkpoint) Body() ([]byte, error) {
+	root, err := hex.DecodeString(cp.RootHash)
+	if err != nil {
+		return nil, errors.Errorf("checkpoint has invalid root hash")
+	}
+
+	return []byte(fmt.Sprintf("%s\n%d\n%s\n",
+		cp.Origin, cp.TreeSize, base64.StdEncoding.EncodeToString(root))), nil
+}
+
+// Sign fills in a checkpoint's key hash and signature.
+func (cp *Checkpoint) Sign(signer sec.Signer) error {
+	body, err := cp.Body()
+	if err != nil {
+		return err
+	}
+
+	pub := signer.PubKey()
+	keyHash, err := pub.Hash()
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(body)
+	sig, err := signer.Sign(hash[:])
+	if err != nil {
+		return errors.Wrapf(err, "failed to sign checkpoint")
+	}
+
+	cp.KeyHash = hex.EncodeToString(keyHash)
+	cp.Sig = hex.EncodeToString(sig)
+
+	return nil
+}
+
+// Verify checks that a checkpoint is signed by one of the given log keys.
+func (cp *Checkpoint) Verify(logKeys []sec.PubSignKey) error {
+	body, err := cp.Body()
+	if err != nil {
+		return err
+	}
+
+	keyHash, err := hex.DecodeString(cp.KeyHash)
+	if err != nil {
+		return errors.Errorf("checkpoint has invalid key hash")
+	}
+	sigData, err := hex.DecodeString(cp.Sig)
+	if err != nil {
+		return errors.Errorf("checkpoint signature is not valid hex")
+	}
+
+	hash := sha256.Sum256(body)
+	sigs := []sec.Sig{{KeyHash: keyHash, Data: sigData}}
+
+	for _, key := range logKeys {
+		idx, err := sec.VerifySigs(key, sigs, hash[:])
+		if err != nil {
+			return err
+		}
+		if idx != -1 {
+			return nil
+		}
+	}
+
+	return errors.Errorf("checkpoint for %s not signed by a trusted log key",
+		cp.Origin)
+}
+
+// Verify checks, without contacting the log, that an entry's event is
+// included in the tree described by its checkpoint, and that the checkpoint
+// is signed by one of the given log keys.
+func (e *Entry) Verify(logKeys []sec.PubSignKey) error {
+	leaf, err := e.Event.Leaf()
+	if err != nil {
+		return err
+	}
+
+	var path [][]byte
+	for _, s := range e.Proof.Hashes {
+		h, err := hex.DecodeString(s)
+		if err != nil || len(h) != sha256.Size {
+			return errors.Errorf("inclusion proof contains invalid hash")
+		}
+		path = append(path, h)
+	}
+
+	cp := &e.Proof.Checkpoint
+	root, err := RootFromInclusionProof(LeafHash(leaf), e.Proof.LogIndex,
+		cp.TreeSize, path)
+	if err != nil {
+		return err
+	}
+
+	want, err := hex.DecodeString(cp.RootHash)
+	if err != nil {
+		return errors.Errorf("checkpoint has invalid root hash")
+	}
+	if !bytes.Equal(root, want) {
+		return errors.Errorf(
+			"inclusion proof does not match checkpoint: have=%x want=%x",
+			root, want)
+	}
+
+	return cp.Verify(logKeys)
+}
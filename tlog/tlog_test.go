@@ -0,0 +1,161 @@
+/**
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package tlog
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/apache/mynewt-artifact/image"
+	"github.com/apache/mynewt-artifact/manifest"
+	"github.com/apache/mynewt-artifact/sec"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newKey(t *testing.T) sec.PrivSignKey {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sec.PrivSignKey{Ed25519: &priv}
+}
+
+func TestInclusionProofs(t *testing.T) {
+	var leaves [][]byte
+	for size := 1; size <= 17; size++ {
+		leaves = append(leaves, LeafHash([]byte(fmt.Sprintf("leaf%d", size))))
+		root := mth(leaves)
+
+		for i := 0; i < size; i++ {
+			have, err := RootFromInclusionProof(leaves[i], uint64(i),
+				uint64(size), auditPath(i, leaves))
+			if err != nil {
+				t.Fatalf("size=%d index=%d: %v", size, i, err)
+			}
+			if hex.EncodeToString(have) != hex.EncodeToString(root) {
+				t.Fatalf("size=%d index=%d: root mismatch", size, i)
+			}
+		}
+	}
+
+	// Wrong index.
+	if size := len(leaves); size > 1 {
+		have, err := RootFromInclusionProof(leaves[0], 1, uint64(size),
+			auditPath(0, leaves))
+		if err == nil &&
+			hex.EncodeToString(have) == hex.EncodeToString(mth(leaves)) {
+
+			t.Fatalf("proof verified at wrong index")
+		}
+	}
+}
+
+func TestImageEntries(t *testing.T) {
+	logKey := newKey(t)
+	log := NewMemLog("log.example.com/firmware", &logKey)
+
+	// Some unrelated entries so that the image's proof is non-trivial.
+	for i := 0; i < 5; i++ {
+		if _, err := log.Submit(SigningEvent{ImageHash: fmt.Sprint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	signKey := newKey(t)
+	ic := image.NewImageCreator()
+	ic.Body = make([]byte, 256)
+	ic.SigKeys = []sec.PrivSignKey{signKey}
+
+	img, err := ic.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := SubmitImage(log, &img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Proof.LogIndex != 5 {
+		t.Fatalf("wrong entries: %+v", entries)
+	}
+
+	bin, err := img.Bin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err = image.ParseImage(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logKeys := []sec.PubSignKey{logKey.PubKey()}
+	if _, err := VerifyImage(img, logKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signatures remain valid.
+	if _, err := img.VerifySigs([]sec.PubSignKey{signKey.PubKey()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Untrusted log.
+	if _, err := VerifyImage(img, []sec.PubSignKey{signKey.PubKey()}); err == nil {
+		t.Fatalf("entry from untrusted log accepted")
+	}
+
+	// Manifest round trip.
+	man := manifest.Manifest{}
+	if err := AddManifestEntries(&man, entries); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	man = manifest.Manifest{}
+	if err := json.Unmarshal(b, &man); err != nil {
+		t.Fatal(err)
+	}
+	manEntries, err := ManifestEntries(man)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyImageEntries(img, manEntries, logKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entry for a signature the image doesn't carry.
+	bad := manEntries[0]
+	bad.Event.Sig = hex.EncodeToString(make([]byte, 64))
+	if _, err := VerifyImageEntries(img, []Entry{bad}, logKeys); err == nil {
+		t.Fatalf("entry for foreign signature accepted")
+	}
+
+	// Tampered checkpoint.
+	bad = manEntries[0]
+	bad.Proof.Checkpoint.TreeSize++
+	if err := bad.Verify(logKeys); err == nil {
+		t.Fatalf("tampered checkpoint accepted")
+	}
+}